@@ -0,0 +1,284 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+// The hash the first entry of a new audit log is chained to
+const GENESIS_HASH = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// The number of recent entries held on to in memory for status reports
+const MAX_RECENT_ENTRIES = 50
+
+// The number of recent entries included in each status report
+const STATUS_REPORT_ENTRIES = 20
+
+// Entry is a single control-plane action recorded in the audit log. Every
+// entry carries the hash of the entry before it so removing or editing any
+// entry breaks the chain from that point on, which Verify will detect.
+type Entry struct {
+	Time       time.Time         `json:"time"`
+	Actor      string            `json:"actor"`  // Who performed the action
+	Action     string            `json:"action"` // What was done, e.g. the REST method and path
+	Parameters map[string]string `json:"parameters,omitempty"`
+	Result     string            `json:"result"`
+	PrevHash   string            `json:"prevHash"`
+	Hash       string            `json:"hash"`
+}
+
+var head string
+var recent []Entry
+var auditFile *os.File
+var lock sync.Mutex
+
+// Record will append a new entry to the audit log chained to the previous one.
+// The log is opened on first use.
+func Record(actor string, action string, parameters map[string]string, result string) error {
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if openErr := open(); openErr != nil {
+		logger.Lgr.LogErrorf("Could not open the audit log: %v", openErr)
+		return openErr
+	}
+
+	entry := Entry{
+		Time:       time.Now().UTC(),
+		Actor:      actor,
+		Action:     action,
+		Parameters: parameters,
+		Result:     result,
+		PrevHash:   head,
+	}
+
+	hash, hashErr := entryHash(entry)
+	if hashErr != nil {
+		return hashErr
+	}
+	entry.Hash = hash
+
+	jsonBytes, jsonErr := json.Marshal(entry)
+	if jsonErr != nil {
+		return jsonErr
+	}
+
+	if _, writeErr := auditFile.Write(append(jsonBytes, '\n')); writeErr != nil {
+		logger.Lgr.LogErrorf("Could not write to the audit log: %v", writeErr)
+		return writeErr
+	}
+
+	if syncErr := auditFile.Sync(); syncErr != nil {
+		return syncErr
+	}
+
+	head = entry.Hash
+	remember(entry)
+
+	return nil
+}
+
+// Recent returns up to count of the most recently recorded entries, oldest
+// first.
+func Recent(count int) []Entry {
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if openErr := open(); openErr != nil {
+		return nil
+	}
+
+	start := 0
+	if len(recent) > count {
+		start = len(recent) - count
+	}
+
+	entries := make([]Entry, len(recent)-start)
+	copy(entries, recent[start:])
+	return entries
+}
+
+// Head returns the hash of the most recent entry. Sending it off the machine,
+// e.g. in a status report, lets an administrator prove later that entries
+// weren't removed from the end of the log.
+func Head() string {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if openErr := open(); openErr != nil {
+		return ""
+	}
+	return head
+}
+
+// Verify will walk the whole audit log and check that every entry hashes
+// correctly and is chained to the entry before it. Returns the number of
+// entries verified and an error describing the first broken link, if any.
+func Verify() (int, error) {
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	_, count, verifyErr := readLog(config.Cfg.AuditLogFile)
+	return count, verifyErr
+}
+
+// StatusSummary returns the recent audit log entries and the current head of
+// the chain for status reports. Satisfies reporter.StatusSection.
+func StatusSummary() (string, error) {
+
+	var summary bytes.Buffer
+
+	count, verifyErr := Verify()
+	if verifyErr != nil {
+		summary.WriteString(fmt.Sprintf("AUDIT LOG VERIFICATION FAILED after %d entries: %v\n", count, verifyErr))
+	} else {
+		summary.WriteString(fmt.Sprintf("%d entries verified. head: %v\n", count, Head()))
+	}
+
+	for _, entry := range Recent(STATUS_REPORT_ENTRIES) {
+		summary.WriteString(fmt.Sprintf("%v %v %v %v -> %v\n", entry.Time.Format(time.RFC3339), entry.Actor, entry.Action, formatParameters(entry.Parameters), entry.Result))
+	}
+
+	return summary.String(), nil
+}
+
+// open will open the audit log for appending if it isn't already, verifying
+// the existing entries and recovering the head of the chain from them. Must
+// be called with the lock held.
+func open() error {
+
+	if auditFile != nil {
+		return nil
+	}
+
+	entries, _, verifyErr := readLog(config.Cfg.AuditLogFile)
+	if verifyErr != nil && !os.IsNotExist(verifyErr) {
+		// keep appending so new actions are still recorded but make some noise
+		logger.Lgr.LogErrorf("The audit log %v failed verification: %v", config.Cfg.AuditLogFile, verifyErr)
+	}
+
+	file, openErr := os.OpenFile(config.Cfg.AuditLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if openErr != nil {
+		return openErr
+	}
+
+	head = GENESIS_HASH
+	recent = nil
+	for _, entry := range entries {
+		head = entry.Hash
+		remember(entry)
+	}
+
+	auditFile = file
+	logger.Lgr.LogMessagef("Successfully opened audit log %v with %d entries", config.Cfg.AuditLogFile, len(entries))
+
+	return nil
+}
+
+// readLog will read every entry in the audit log at the given path, checking
+// the chain as it goes. Returns the entries read, the number which verified,
+// and the first verification error.
+func readLog(auditPath string) ([]Entry, int, error) {
+
+	file, openErr := os.Open(auditPath)
+	if openErr != nil {
+		if os.IsNotExist(openErr) {
+			return nil, 0, nil
+		}
+		return nil, 0, openErr
+	}
+	defer file.Close()
+
+	var entries []Entry
+	var firstErr error
+	verified := 0
+	previous := GENESIS_HASH
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+
+		var entry Entry
+		if jsonErr := json.Unmarshal(scanner.Bytes(), &entry); jsonErr != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("line %d is not a valid entry: %v", line, jsonErr)
+			}
+			continue
+		}
+
+		entries = append(entries, entry)
+
+		if firstErr != nil {
+			continue
+		}
+
+		expected, hashErr := entryHash(entry)
+		switch {
+		case hashErr != nil:
+			firstErr = hashErr
+		case entry.PrevHash != previous:
+			firstErr = fmt.Errorf("line %d is not chained to the entry before it", line)
+		case entry.Hash != expected:
+			firstErr = fmt.Errorf("line %d has been modified", line)
+		default:
+			verified++
+		}
+
+		previous = entry.Hash
+	}
+
+	if scanErr := scanner.Err(); scanErr != nil && firstErr == nil {
+		firstErr = scanErr
+	}
+
+	return entries, verified, firstErr
+}
+
+// entryHash returns the hex SHA-256 hash of the given entry with its Hash
+// field left empty.
+func entryHash(entry Entry) (string, error) {
+
+	entry.Hash = ""
+
+	jsonBytes, jsonErr := json.Marshal(entry)
+	if jsonErr != nil {
+		return "", jsonErr
+	}
+
+	sum := sha256.Sum256(jsonBytes)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// remember will add the given entry to the recent entries. Must be called with
+// the lock held.
+func remember(entry Entry) {
+	recent = append(recent, entry)
+	if len(recent) > MAX_RECENT_ENTRIES {
+		recent = recent[len(recent)-MAX_RECENT_ENTRIES:]
+	}
+}
+
+// formatParameters returns the given parameters as a single line of JSON or a
+// dash if there are none.
+func formatParameters(parameters map[string]string) string {
+	if len(parameters) == 0 {
+		return "-"
+	}
+
+	jsonBytes, _ := json.Marshal(parameters)
+	return string(jsonBytes)
+}
@@ -0,0 +1,76 @@
+package audit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+func TestMain(m *testing.M) {
+
+	logErr := logger.StandardLogger("audit_test")
+	if logErr != nil {
+		fmt.Println(fmt.Sprintf("Could not initialize logger: %v", logErr))
+		return
+	}
+
+	configErr := config.FromFile()
+	if configErr != nil {
+		fmt.Println(configErr)
+		return
+	}
+
+	auditDir, dirErr := ioutil.TempDir("", "audit_test")
+	if dirErr != nil {
+		fmt.Println(dirErr)
+		return
+	}
+	config.Cfg.AuditLogFile = filepath.Join(auditDir, "audit.jsonl")
+
+	result := m.Run()
+	os.RemoveAll(auditDir)
+	os.Exit(result)
+}
+
+func TestAuditChain(t *testing.T) {
+
+	for index := 0; index < 3; index++ {
+		if recordErr := Record("10.0.0.1", "POST /exec", map[string]string{"command": fmt.Sprintf("uptime %d", index)}, "200 OK"); recordErr != nil {
+			t.Fatal(recordErr)
+		}
+	}
+
+	if count, verifyErr := Verify(); verifyErr != nil || count != 3 {
+		t.Fatalf("expected 3 verified entries, got: %d %v", count, verifyErr)
+	}
+
+	entries := Recent(10)
+	if len(entries) != 3 || entries[0].PrevHash != GENESIS_HASH || entries[2].Hash != Head() || entries[1].PrevHash != entries[0].Hash {
+		t.Errorf("unexpected audit chain: %+v", entries)
+	}
+
+	summary, _ := StatusSummary()
+	if !strings.Contains(summary, "3 entries verified") || !strings.Contains(summary, "uptime 2") {
+		t.Errorf("unexpected status summary: %v", summary)
+	}
+
+	fileBytes, readErr := ioutil.ReadFile(config.Cfg.AuditLogFile)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+
+	tampered := strings.Replace(string(fileBytes), "uptime 1", "reboot 1", 1)
+	if writeErr := ioutil.WriteFile(config.Cfg.AuditLogFile, []byte(tampered), 0600); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+
+	if count, verifyErr := Verify(); verifyErr == nil || count != 1 {
+		t.Errorf("expected verification to fail after the first entry, got: %d %v", count, verifyErr)
+	}
+}
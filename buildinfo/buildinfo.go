@@ -0,0 +1,160 @@
+// The buildinfo package describes the build of the running binary. The values
+// are embedded at build time via ldflags, e.g.
+//
+//	go build -ldflags "-X github.com/seantcanavan/anon-eth-net/buildinfo.version=42 -X github.com/seantcanavan/anon-eth-net/buildinfo.commit=$(git rev-parse HEAD) -X github.com/seantcanavan/anon-eth-net/buildinfo.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ) -X github.com/seantcanavan/anon-eth-net/buildinfo.channel=stable"
+//
+// which `make install` does. A binary built without them falls back to the
+// version in the version.no asset and to the commit recorded by the go tool.
+package buildinfo
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The value used for anything which wasn't embedded and can't be worked out
+const UNKNOWN = "unknown"
+
+// The release channel of a binary built without one
+const DEFAULT_CHANNEL = "dev"
+
+// How much of a version file which doesn't hold a version number is quoted in
+// ErrVersionParse
+const MAX_QUOTED_VERSION_BYTES = 64
+
+// set at build time via -ldflags "-X github.com/seantcanavan/anon-eth-net/buildinfo.<name>=<value>"
+var version string
+var commit string
+var buildDate string
+var channel string
+
+var fallbackLock sync.Mutex
+var fallbackVersion uint64
+
+// Info is everything known about the build of the running binary.
+type Info struct {
+	Version   uint64 `json:"version"`
+	Embedded  bool   `json:"embedded"` // Whether Version was embedded at build time rather than read from version.no
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	Channel   string `json:"channel"`
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
+}
+
+// ErrVersionParse is returned by ParseVersion when a version file holds
+// something other than a whole version number, e.g. an error page served in
+// place of the remote version.no.
+type ErrVersionParse struct {
+	Source string
+	Value  string
+	Err    error
+}
+
+// Error describes where the version came from and what it held.
+func (evp ErrVersionParse) Error() string {
+	return fmt.Sprintf("%v doesn't hold a version number, it holds %q: %v", evp.Source, evp.Value, evp.Err)
+}
+
+// Unwrap returns the error from parsing the version.
+func (evp ErrVersionParse) Unwrap() error {
+	return evp.Err
+}
+
+// String describes the build on a single line. The version is unknown until
+// either it's embedded or version.no has been read.
+func (info Info) String() string {
+
+	localVersion := UNKNOWN
+	if info.Version != 0 {
+		localVersion = strconv.FormatUint(info.Version, 10)
+	}
+
+	return fmt.Sprintf("version %v commit %v built %v channel %v %v %v", localVersion, info.Commit, info.BuildDate, info.Channel, info.GoVersion, info.Platform)
+}
+
+// EmbeddedVersion returns the version embedded at build time and true, or
+// false if none was embedded or it isn't a number.
+func EmbeddedVersion() (uint64, bool) {
+
+	if version == "" {
+		return 0, false
+	}
+
+	embedded, parseErr := strconv.ParseUint(version, 10, 64)
+	if parseErr != nil {
+		return 0, false
+	}
+
+	return embedded, true
+}
+
+// ParseVersion will parse the contents of a version file read from the given
+// source, such as version.no or the RemoteVersionURI, as a whole version
+// number. Returns ErrVersionParse when it isn't one.
+func ParseVersion(source string, contents []byte) (uint64, error) {
+
+	value := strings.TrimSpace(string(contents))
+	parsed, parseErr := strconv.ParseUint(value, 10, 64)
+	if parseErr != nil {
+		if len(value) > MAX_QUOTED_VERSION_BYTES {
+			value = value[:MAX_QUOTED_VERSION_BYTES] + "..."
+		}
+		return 0, ErrVersionParse{Source: source, Value: value, Err: parseErr}
+	}
+
+	return parsed, nil
+}
+
+// SetFallbackVersion will set the version reported when none was embedded at
+// build time. The config package calls it with the contents of version.no.
+func SetFallbackVersion(fileVersion uint64) {
+	fallbackLock.Lock()
+	defer fallbackLock.Unlock()
+	fallbackVersion = fileVersion
+}
+
+// Version returns everything known about the build of the running binary.
+// The commit is taken from what the go tool recorded in the binary when it
+// wasn't embedded at build time.
+func Version() Info {
+
+	info := Info{
+		Commit:    commit,
+		BuildDate: buildDate,
+		Channel:   channel,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+
+	info.Version, info.Embedded = EmbeddedVersion()
+	if !info.Embedded {
+		fallbackLock.Lock()
+		info.Version = fallbackVersion
+		fallbackLock.Unlock()
+	}
+
+	if recorded, found := debug.ReadBuildInfo(); found {
+		for _, setting := range recorded.Settings {
+			if setting.Key == "vcs.revision" && info.Commit == "" {
+				info.Commit = setting.Value
+			}
+		}
+	}
+
+	if info.Commit == "" {
+		info.Commit = UNKNOWN
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = UNKNOWN
+	}
+	if info.Channel == "" {
+		info.Channel = DEFAULT_CHANNEL
+	}
+
+	return info
+}
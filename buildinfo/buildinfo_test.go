@@ -0,0 +1,71 @@
+package buildinfo
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+
+	result := m.Run()
+	os.Exit(result)
+}
+
+func TestVersion(t *testing.T) {
+
+	defer func(embeddedVersion string, embeddedCommit string, embeddedDate string, embeddedChannel string) {
+		version, commit, buildDate, channel = embeddedVersion, embeddedCommit, embeddedDate, embeddedChannel
+		SetFallbackVersion(0)
+	}(version, commit, buildDate, channel)
+
+	// without anything embedded the version comes from version.no
+	version, commit, buildDate, channel = "", "", "", ""
+	SetFallbackVersion(7)
+
+	info := Version()
+	if info.Version != 7 || info.Embedded {
+		t.Errorf("expected the fallback version 7, got: %+v", info)
+	}
+	if info.Commit == "" || info.BuildDate != UNKNOWN || info.Channel != DEFAULT_CHANNEL {
+		t.Errorf("expected defaults for everything not embedded, got: %+v", info)
+	}
+	if info.Platform != runtime.GOOS+"/"+runtime.GOARCH {
+		t.Errorf("expected the platform %v/%v, got: %v", runtime.GOOS, runtime.GOARCH, info.Platform)
+	}
+
+	// an embedded version which isn't a number is ignored
+	version = "not a number"
+	if _, embedded := EmbeddedVersion(); embedded {
+		t.Errorf("expected %v not to be treated as an embedded version", version)
+	}
+
+	version, commit, buildDate, channel = "42", "abc123", "2024-01-02T03:04:05Z", "stable"
+
+	info = Version()
+	if info.Version != 42 || !info.Embedded || info.Commit != "abc123" || info.BuildDate != "2024-01-02T03:04:05Z" || info.Channel != "stable" {
+		t.Errorf("expected the embedded build metadata, got: %+v", info)
+	}
+	if !strings.HasPrefix(info.String(), "version 42 commit abc123 built 2024-01-02T03:04:05Z channel stable") {
+		t.Errorf("expected the build to be described on one line, got: %v", info)
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+
+	if parsed, parseErr := ParseVersion("version.no", []byte("42\n")); parseErr != nil || parsed != 42 {
+		t.Errorf("expected version 42, got: %v %v", parsed, parseErr)
+	}
+
+	_, parseErr := ParseVersion("https://example.com/version.no", []byte("<html>"+strings.Repeat("not found ", 20)+"</html>"))
+	var versionErr ErrVersionParse
+	if !errors.As(parseErr, &versionErr) || versionErr.Source != "https://example.com/version.no" || len(versionErr.Value) != MAX_QUOTED_VERSION_BYTES+3 {
+		t.Errorf("expected an ErrVersionParse quoting the start of the page, got: %#v", parseErr)
+	}
+	if !errors.Is(parseErr, strconv.ErrSyntax) {
+		t.Errorf("expected the parse error to be wrapped, got: %v", parseErr)
+	}
+}
@@ -0,0 +1,150 @@
+// The clock package tells the time and waits for the loops which run on a
+// schedule, such as the update checks, the status reports and log rotation.
+// Real is used unless a Fake is swapped in to test them deterministically.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// The longest Real sleeps at a time before checking the wall clock again, so a
+// sleep still ends about on time after the machine was suspended
+const MAX_SLEEP_SLICE = time.Minute
+
+// Clock tells the time and sleeps.
+type Clock interface {
+	Now() time.Time
+	Sleep(duration time.Duration)
+}
+
+// Real is the system clock.
+var Real Clock = realClock{}
+
+// realClock is the system clock.
+type realClock struct{}
+
+// Now returns the current local time.
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// Sleep will pause the current goroutine until the given duration has passed
+// by either the monotonic or the wall clock, whichever is first. The monotonic
+// clock keeps a wall clock set backwards from stretching the sleep. The wall
+// clock keeps a suspend, during which the monotonic clock stops on most
+// systems, from stretching it instead.
+func (realClock) Sleep(duration time.Duration) {
+
+	started := time.Now()
+	wallStarted := started.Round(0)
+
+	for 1 == 1 {
+		elapsed := time.Since(started)
+		if wallElapsed := time.Now().Round(0).Sub(wallStarted); wallElapsed > elapsed {
+			elapsed = wallElapsed
+		}
+		if elapsed >= duration {
+			return
+		}
+
+		slice := duration - elapsed
+		if slice > MAX_SLEEP_SLICE {
+			slice = MAX_SLEEP_SLICE
+		}
+		time.Sleep(slice)
+	}
+}
+
+// Fake is a Clock which only moves when it's told to. Goroutines sleeping on
+// it wake once Advance or Set moves it past the end of their sleep.
+type Fake struct {
+	lock     sync.Mutex
+	now      time.Time
+	sleepers []sleeper
+}
+
+// sleeper is a goroutine sleeping on a Fake until the given time.
+type sleeper struct {
+	until time.Time
+	wake  chan struct{}
+}
+
+// NewFake returns a Fake set to the given time.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now returns the time the Fake is set to.
+func (f *Fake) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+// Sleep will pause the current goroutine until the Fake is moved on by the
+// given duration. A duration of zero or less returns straight away.
+func (f *Fake) Sleep(duration time.Duration) {
+
+	f.lock.Lock()
+	if duration <= 0 {
+		f.lock.Unlock()
+		return
+	}
+	wake := make(chan struct{})
+	f.sleepers = append(f.sleepers, sleeper{until: f.now.Add(duration), wake: wake})
+	f.lock.Unlock()
+
+	<-wake
+}
+
+// Advance will move the Fake on by the given duration and wake every goroutine
+// whose sleep has ended.
+func (f *Fake) Advance(duration time.Duration) {
+	f.lock.Lock()
+	now := f.now.Add(duration)
+	f.lock.Unlock()
+	f.Set(now)
+}
+
+// Set will move the Fake to the given time, which may be in the past like a
+// wall clock being corrected, and wake every goroutine whose sleep has ended.
+func (f *Fake) Set(now time.Time) {
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.now = now
+
+	sleeping := f.sleepers[:0]
+	for _, current := range f.sleepers {
+		if current.until.After(now) {
+			sleeping = append(sleeping, current)
+			continue
+		}
+		close(current.wake)
+	}
+	f.sleepers = sleeping
+}
+
+// Sleepers returns the number of goroutines sleeping on the Fake, so a test
+// can wait for a loop to go to sleep before moving the Fake on.
+func (f *Fake) Sleepers() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.sleepers)
+}
+
+// WaitForSleepers will wait up to the given timeout for at least the given
+// number of goroutines to be sleeping on the Fake and returns whether they
+// were.
+func (f *Fake) WaitForSleepers(count int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for f.Sleepers() < count {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
@@ -0,0 +1,87 @@
+package clock
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+
+	result := m.Run()
+	os.Exit(result)
+}
+
+func TestFake(t *testing.T) {
+
+	started := time.Date(2026, time.March, 1, 7, 59, 0, 0, time.UTC)
+	fake := NewFake(started)
+
+	var wokenLock sync.Mutex
+	var woken []time.Duration
+	sleep := func(duration time.Duration) {
+		fake.Sleep(duration)
+		wokenLock.Lock()
+		woken = append(woken, duration)
+		wokenLock.Unlock()
+	}
+	waitWoken := func(count int) []time.Duration {
+		deadline := time.Now().Add(5 * time.Second)
+		for 1 == 1 {
+			wokenLock.Lock()
+			current := append([]time.Duration{}, woken...)
+			wokenLock.Unlock()
+			if len(current) >= count || time.Now().After(deadline) {
+				return current
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return nil
+	}
+	go sleep(time.Minute)
+	go sleep(time.Hour)
+
+	if !fake.WaitForSleepers(2, 5*time.Second) {
+		t.Fatalf("expected both goroutines to be sleeping, got: %d", fake.Sleepers())
+	}
+
+	// setting the clock back wakes nobody
+	fake.Set(started.Add(-time.Hour))
+	fake.Set(started)
+	fake.Advance(59 * time.Second)
+	if fake.Sleepers() != 2 {
+		t.Errorf("expected nobody to wake before their time, got %d sleeping", fake.Sleepers())
+	}
+
+	fake.Advance(time.Second)
+	if fake.Sleepers() != 1 || !fake.Now().Equal(started.Add(time.Minute)) {
+		t.Errorf("expected the minute long sleep to end at %v, got %d sleeping at %v", started.Add(time.Minute), fake.Sleepers(), fake.Now())
+	}
+	if current := waitWoken(1); len(current) != 1 || current[0] != time.Minute {
+		t.Errorf("expected only the minute long sleep to wake, got: %v", current)
+	}
+
+	fake.Advance(2 * time.Hour)
+	if current := waitWoken(2); fake.Sleepers() != 0 || len(current) != 2 || current[1] != time.Hour {
+		t.Errorf("expected the hour long sleep to wake too, got: %v", current)
+	}
+
+	// sleeping for nothing doesn't wait for the clock to move
+	fake.Sleep(0)
+}
+
+func TestRealSleep(t *testing.T) {
+
+	started := time.Now()
+	Real.Sleep(50 * time.Millisecond)
+	if slept := time.Since(started); slept < 50*time.Millisecond || slept > 5*time.Second {
+		t.Errorf("expected to sleep for 50ms, slept for %v", slept)
+	}
+
+	started = time.Now()
+	Real.Sleep(-time.Second)
+	if slept := time.Since(started); slept > time.Second {
+		t.Errorf("expected a negative sleep to return straight away, slept for %v", slept)
+	}
+}
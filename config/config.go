@@ -5,18 +5,83 @@ package config
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
-	"math/rand"
-	"strconv"
+	"reflect"
+	"regexp"
 	"strings"
+	"time"
 
-	"github.com/nu7hatch/gouuid"
+	"github.com/seantcanavan/anon-eth-net/buildinfo"
+	"github.com/seantcanavan/anon-eth-net/events"
 	"github.com/seantcanavan/anon-eth-net/logger"
 	"github.com/seantcanavan/anon-eth-net/utils"
 )
 
 var Cfg *Config
 
+// The file Cfg was loaded from, which ToFile saves it back to
+var loadedPath string
+
+// The subsystems which can be turned off via Subsystems in the config
+const SUBSYSTEM_UPDATER = "updater"
+const SUBSYSTEM_REST = "rest"
+const SUBSYSTEM_PROFILER = "profiler"
+const SUBSYSTEM_LOADER = "loader"
+const SUBSYSTEM_REPORTER = "reporter"
+const SUBSYSTEM_CHECKIN = "checkin"
+
+// SUBSYSTEMS lists every subsystem which can be turned off
+var SUBSYSTEMS = []string{SUBSYSTEM_UPDATER, SUBSYSTEM_REST, SUBSYSTEM_PROFILER, SUBSYSTEM_LOADER, SUBSYSTEM_REPORTER, SUBSYSTEM_CHECKIN}
+
+// The REST actions which can require a second admin's approval via
+// ApprovalActions in the config
+const APPROVAL_EXEC = "exec"
+const APPROVAL_UPDATE = "update"
+const APPROVAL_AUTH = "auth"
+
+// APPROVAL_ACTIONS lists every action which can require approval
+var APPROVAL_ACTIONS = []string{APPROVAL_EXEC, APPROVAL_UPDATE, APPROVAL_AUTH}
+
+// The last argument of an ExecAllowlist entry which allows any further
+// arguments
+const EXEC_ANY_ARGUMENTS = "*"
+
+// The classes of data which can be given a retention period via RetentionDays
+// in the config
+const RETENTION_LOGS = "logs"
+const RETENTION_METRICS = "metrics"
+const RETENTION_DIAGNOSTICS = "diagnostics"
+const RETENTION_UPDATES = "updates"
+
+// RETENTION_CLASSES lists every class of data which can be given a retention
+// period
+var RETENTION_CLASSES = []string{RETENTION_LOGS, RETENTION_METRICS, RETENTION_DIAGNOSTICS, RETENTION_UPDATES}
+
+// A wallet address as it appears in EthWallets
+var ethAddressPattern = regexp.MustCompile("^0x[0-9a-fA-F]{40}$")
+
+// Config fields whose names contain any of these, ignoring case, hold secrets
+// which are masked in the logs
+var secretFieldWords = []string{"password", "secret", "token", "passphrase", "apikey"}
+
+// ErrConfigInvalid is returned by FromFile and Apply when the config can't be
+// used as it is. Fields names the settings which need correcting, when known.
+type ErrConfigInvalid struct {
+	Fields []string
+	Err    error
+}
+
+// Error describes what's wrong with the config.
+func (eci ErrConfigInvalid) Error() string {
+	return eci.Err.Error()
+}
+
+// Unwrap returns the error describing what's wrong with the config.
+func (eci ErrConfigInvalid) Unwrap() error {
+	return eci.Err
+}
+
 // Config represents a set of public configuration values used throughout the
 // program to help anon-eth-net execute in a manner that the user expects. All
 // values can be configured via the config.json file and changes to the config
@@ -27,18 +92,322 @@ var Cfg *Config
 // (D) means the value is default value already set and should only be
 // changed after careful consideration.
 type Config struct {
-	CheckInGmailAddress      string `json:"CheckInGmailAddress"`      // (R) the gmail address to send updates to and receive updates from. parsed from line 1 of CheckInEmailCredentialsFile
-	CheckInGmailPassword     string `json:"CheckInGmailPassword"`     // (R) the password for the gmail account. parsed from line 2 of CheckInEmailCredentialsFile
-	CheckInFrequencySeconds  int    `json:"CheckInFrequencySeconds"`  // (R) The frequency with which this program will send status updates. In seconds.
-	NetQueryFrequencySeconds int    `json:"NetQueryFrequencySeconds"` // (R) The frequency with which this program will attempt to connect to the outside world to verify internet connectivity
-	DeviceName               string `json:"DeviceName"`               // (O) The canonical DeviceName for the machine currently executing this program.
-	DeviceId                 string `json:"DeviceId"`                 // (O) The unique ID for the machine currently executing this program.
-	InitialStartup           string `json:"InitialStartup"`           // (D) Whether or not this is the first time that the program is starting.
-	FirstRunAfterUpdate      string `json:"FirstRunAfterUpdate"`      // (D) Whether or not this is the first time that the program is running after an update has been executed.
-	UpdateFrequencySeconds   int    `json:"UpdateFrequencySeconds"`   // (D) The frequency with which this program will attempt to update itself. In seconds.
-	RemoteUpdateURI          string `json:"RemoteUpdateURI"`          // (D) The remote location where new source code can be obtained from for this program.
-	RemoteVersionURI         string `json:"RemoteVersionURI"`         // (D) The remote URI where the latest version number of this program can be obtained from.
-	LocalVersion             uint64 `json:"LocalVersion"`             // (D) The local version of this program that is currently running.
+	CheckInGmailAddress      string    `json:"CheckInGmailAddress"`      // (R) the gmail address to send updates to and receive updates from. parsed from line 1 of CheckInEmailCredentialsFile
+	CheckInGmailPassword     string    `json:"CheckInGmailPassword"`     // (R) the password for the gmail account. parsed from line 2 of CheckInEmailCredentialsFile
+	CheckInFrequencySeconds  int       `json:"CheckInFrequencySeconds"`  // (R) The frequency with which this program will send status updates. In seconds.
+	NetQueryFrequencySeconds int       `json:"NetQueryFrequencySeconds"` // (R) The frequency with which this program will attempt to connect to the outside world to verify internet connectivity
+	DeviceName               string    `json:"DeviceName"`               // (O) The canonical DeviceName for the machine currently executing this program.
+	DeviceId                 string    `json:"DeviceId"`                 // (O) The unique ID for the machine currently executing this program.
+	InitialStartup           string    `json:"InitialStartup"`           // (D) Whether or not this is the first time that the program is starting.
+	FirstRunAfterUpdate      string    `json:"FirstRunAfterUpdate"`      // (D) Whether or not this is the first time that the program is running after an update has been executed.
+	UpdateFrequencySeconds   int       `json:"UpdateFrequencySeconds"`   // (D) The frequency with which this program will attempt to update itself. In seconds.
+	RemoteUpdateURI          string    `json:"RemoteUpdateURI"`          // (D) The remote location where new source code can be obtained from for this program.
+	RemoteVersionURI         Endpoints `json:"RemoteVersionURI"`         // (D) The remote URIs where the latest version number of this program can be obtained from. A single URI or a list which is failed over in order.
+	LocalVersion             uint64    `json:"LocalVersion"`             // (D) The local version of this program that is currently running. Embedded at build time or read from the version.no asset.
+
+	// config layering settings
+	Include      []string `json:"Include"`      // (O) Config files to merge over this one in order, relative to it, followed by every .json file in the config.d directory next to it in lexical order. Each only needs the settings it changes, e.g. {"EthWallets": ["0x..."]}. Settings set by them win on every load and are never saved back into this file.
+	StrictConfig bool     `json:"StrictConfig"` // (O) Refuse to load a config with settings this version doesn't know, such as a misspelled CheckInFrequencySecond, rather than logging an error for each and ignoring them. Defaults to false.
+
+	// status report settings
+	StatusReportTime       string   `json:"StatusReportTime"`       // (O) The local time of day, as HH:MM, to send out the daily status report at.
+	StatusReportRecipients []string `json:"StatusReportRecipients"` // (O) The email addresses the daily status report is sent to. Defaults to CheckInGmailAddress.
+
+	// notification settings
+	Notifiers                []NotifierConfig `json:"Notifiers"`                // (O) The channels notifications are delivered to. Defaults to email only.
+	NotificationRoutes       []RouteConfig    `json:"NotificationRoutes"`       // (O) Which channels each severity is delivered to. Defaults to every channel that accepts the severity.
+	EscalationTimeoutSeconds int              `json:"EscalationTimeoutSeconds"` // (O) How long a critical notification can go unacknowledged via REST before it's escalated. Zero disables escalation.
+	EscalationChannels       []string         `json:"EscalationChannels"`       // (O) The names of the channels unacknowledged critical notifications are escalated to. Defaults to every channel.
+	DigestIntervalSeconds    int              `json:"DigestIntervalSeconds"`    // (D) How often batched notifications are delivered as a single digest. In seconds.
+
+	// email command settings
+	CommandIMAPServer     string   `json:"CommandIMAPServer"`     // (O) The host:port of the IMAP server to poll for command emails, e.g. imap.gmail.com:993. Empty disables email commands.
+	CommandSecret         string   `json:"CommandSecret"`         // (O) The shared secret command emails are signed with. Required when CommandIMAPServer is set.
+	CommandAllowedSenders []string `json:"CommandAllowedSenders"` // (O) The email addresses which are allowed to send commands. Defaults to CheckInGmailAddress.
+	CommandPollSeconds    int      `json:"CommandPollSeconds"`    // (D) How often the IMAP server is checked for new command emails. In seconds.
+
+	// pgp settings
+	PGPRecipientKeyFile     string `json:"PGPRecipientKeyFile"`     // (O) The path to the ASCII armored public keys every outbound email is encrypted to. Empty disables encryption.
+	PGPSigningKeyFile       string `json:"PGPSigningKeyFile"`       // (O) The path to the ASCII armored private key every outbound email is signed with. Empty disables signing.
+	PGPSigningKeyPassphrase string `json:"PGPSigningKeyPassphrase"` // (O) The passphrase which unlocks the PGP signing key, if it has one.
+
+	// rest settings
+	RestListenAddress   string            `json:"RestListenAddress"`   // (O) The host:port the REST server listens on, e.g. :8443. Defaults to a port from 20000 to 29999 derived from the machine, so it stays the same across restarts, or a random free port when that one is taken.
+	RestTokenHashes     []string          `json:"RestTokenHashes"`     // (O) The hex SHA-256 hashes of admin bearer tokens accepted by the REST server. Prefer RestTokens.
+	RestTokens          []RestTokenConfig `json:"RestTokens"`          // (O) The named bearer tokens accepted by the REST server and their roles. Empty, along with RestTokenHashes and RestClientCAFile, serves only the dashboard and health check.
+	RestClientCAFile    string            `json:"RestClientCAFile"`    // (O) The path to the PEM CA certificates REST clients must present a certificate from. Empty disables mutual TLS.
+	RestMaxAuthFailures int               `json:"RestMaxAuthFailures"` // (D) The number of failed REST authentication attempts in a row before the client address is locked out.
+	RestLockoutSeconds  int               `json:"RestLockoutSeconds"`  // (D) How long a client address is locked out for after too many failed REST authentication attempts. In seconds.
+	RestCertFile        string            `json:"RestCertFile"`        // (O) The path to the PEM certificate the REST server uses. Defaults to the server.cert asset. A self signed certificate is generated if it doesn't exist.
+	RestKeyFile         string            `json:"RestKeyFile"`         // (O) The path to the PEM private key of the REST certificate. Defaults to the server.pkey asset.
+	RestACMEDomains     []string          `json:"RestACMEDomains"`     // (O) The public domain names of this machine to obtain a certificate for via ACME, e.g. Let's Encrypt. Overrides RestCertFile.
+	RestACMECacheDir    string            `json:"RestACMECacheDir"`    // (D) The directory ACME account keys and certificates are saved to.
+	RestAllowedCIDRs    []string          `json:"RestAllowedCIDRs"`    // (O) The networks, e.g. 10.8.0.0/24, and addresses allowed to connect to the REST server. Everything else is refused before the TLS handshake. Empty allows only loopback and private addresses.
+	RestListenInterface string            `json:"RestListenInterface"` // (O) The network interface, e.g. lo or wg0, the REST server binds to instead of every interface.
+
+	// rest middleware settings
+	RestRateLimitPerSecond float64  `json:"RestRateLimitPerSecond"` // (D) How many REST requests per second each client address can make on average.
+	RestRateLimitBurst     int      `json:"RestRateLimitBurst"`     // (D) How many REST requests each client address can make at once before being rate limited.
+	RestCORSOrigins        []string `json:"RestCORSOrigins"`        // (O) The browser origins, e.g. https://dashboard.example.com, allowed to call the REST server. "*" allows every origin. Empty disables CORS.
+
+	// rest token settings
+	RestTokenLifetimeDays   int `json:"RestTokenLifetimeDays"`   // (D) How long a token created by rotating one of the RestTokens is accepted for. In days.
+	RestTokenOverlapMinutes int `json:"RestTokenOverlapMinutes"` // (D) How long a rotated token is still accepted alongside its replacement unless the rotation says otherwise. In minutes.
+	RestTokenWarnDays       int `json:"RestTokenWarnDays"`       // (D) How long before one of the RestTokens expires that a warning is sent every day. In days.
+
+	// two-person approval settings
+	ApprovalActions        []string `json:"ApprovalActions"`        // (O) The REST actions which only run once a second admin token approves them: exec, update and auth. Empty runs every action straight away.
+	ApprovalTimeoutMinutes int      `json:"ApprovalTimeoutMinutes"` // (D) How long a pending action waits to be approved, and an approval waits to be used. In minutes.
+	UpdateWindow           string   `json:"UpdateWindow"`           // (O) The local time of day, as HH:MM-HH:MM, updates can be applied in without approval. Empty always requires it when update is one of the ApprovalActions.
+
+	// rest exec settings
+	ExecAllowlist      [][]string `json:"ExecAllowlist"`      // (O) The command lines which can be run via REST, each the command followed by exactly the arguments it allows. A last argument of "*" allows any further arguments. Empty disables remote execution.
+	ExecTimeoutSeconds int        `json:"ExecTimeoutSeconds"` // (D) How long a command run via REST can execute for before it's killed. In seconds.
+	ExecMaxOutputBytes int        `json:"ExecMaxOutputBytes"` // (D) The maximum number of bytes of stdout and of stderr returned for a command run via REST. The rest is discarded.
+
+	// rest file transfer settings
+	FileRoots    []string `json:"FileRoots"`    // (O) The directories files can be downloaded from and uploaded to via REST. Empty disables file transfers.
+	FileMaxBytes ByteSize `json:"FileMaxBytes"` // (D) The largest file which can be transferred via REST. In bytes or a size such as "100MB".
+
+	// audit settings
+	AuditLogFile string `json:"AuditLogFile"` // (D) The file every authenticated REST action is recorded to. Each entry is chained to the previous one by its hash so tampering can be detected.
+
+	// rest operation settings
+	OperationsDir string `json:"OperationsDir"` // (D) The directory the progress and results of asynchronous REST operations are saved to.
+
+	// fleet check in settings
+	FleetServerURL      Endpoints `json:"FleetServerURL"`      // (O) The URLs of the central fleet server heartbeats are POSTed to and queued commands are pulled back from. A single URL or a list which is failed over in order. Empty disables fleet check ins.
+	FleetSecret         string    `json:"FleetSecret"`         // (O) The shared secret heartbeats are signed with and commands from the fleet server must be signed with. Required when FleetServerURL or FleetChannelURL is set, unless it's obtained by enrolling with a FleetRegistrationToken.
+	FleetCheckInSeconds int       `json:"FleetCheckInSeconds"` // (D) How often to check in with the fleet server. In seconds.
+	FleetChannelURL     string    `json:"FleetChannelURL"`     // (O) The ws:// or wss:// URL of the control server's always on command channel. Commands, config pushes and update triggers sent over it run immediately. Empty disables the channel.
+
+	// fleet enrollment settings
+	FleetEnrollURL         Endpoints `json:"FleetEnrollURL"`         // (O) The URLs of the fleet server the DeviceId and FleetRegistrationToken are exchanged for this agent's own FleetSecret at. Required when FleetRegistrationToken is set.
+	FleetRegistrationToken string    `json:"FleetRegistrationToken"` // (O) The token which enrolls this agent with the fleet server the first time it runs. Cleared once the agent is enrolled.
+
+	// fleet update coordination settings
+	FleetUpdatePermitURL   Endpoints `json:"FleetUpdatePermitURL"`   // (O) The URLs of the fleet server asked for permission before an update is applied, so it can limit how many agents at a site update at once. Empty applies updates without asking.
+	FleetSite              string    `json:"FleetSite"`              // (O) The site, such as a farm or a rack, this agent belongs to when asking for permission to update.
+	FleetPermitWaitMinutes int       `json:"FleetPermitWaitMinutes"` // (D) How long to keep asking for permission to update before deferring the update to the next check. In minutes.
+
+	// outbound transport settings
+	ProxyURL        string              `json:"ProxyURL"`        // (O) The socks5:// URL of the proxy all outbound traffic is routed through, e.g. socks5://127.0.0.1:9050 for a local Tor client. Empty connects directly.
+	ProxyBypass     []string            `json:"ProxyBypass"`     // (O) The destinations which are connected to directly instead of via ProxyURL. Each is a host name, a *.zone, an IP address or a CIDR range. Loopback is always direct.
+	TLSPins         map[string][]string `json:"TLSPins"`         // (O) The SHA-256 hashes of the public keys each host's certificate chain must contain, by host name, e.g. sha256/ followed by base64. Connections to a pinned host which aren't encrypted are refused.
+	LogHTTPRequests bool                `json:"LogHTTPRequests"` // (O) Log the method, host, status, duration and retries of every outbound HTTP request.
+
+	// public IP settings
+	PublicIPServices     []string `json:"PublicIPServices"`     // (D) The URLs of the services which reply with this machine's public IP address as plain text. The address most of them agree on is used.
+	PublicIPCheckSeconds int      `json:"PublicIPCheckSeconds"` // (D) How often to resolve the public IP address and report when it changes. In seconds. Negative disables the check.
+	GeoLocationURL       string   `json:"GeoLocationURL"`       // (O) The URL of a JSON geolocation service with %v in place of the IP address, e.g. https://ipinfo.io/%v/json. Changes are reported along with the city, region and country it replies with. Empty skips geolocation.
+
+	// clock settings
+	TimeSources         []string `json:"TimeSources"`         // (D) The ntp:// servers and http:// or https:// URLs whose Date header the local clock is checked against. The first which replies is used.
+	TimeSyncSeconds     int      `json:"TimeSyncSeconds"`     // (D) How often to check the local clock against the TimeSources. In seconds. Negative disables the check.
+	MaxClockSkewSeconds int      `json:"MaxClockSkewSeconds"` // (D) How far the local clock can be from the TimeSources before it's reported. Scheduling corrects for any skew either way. In seconds.
+
+	// agent resource limits
+	MaxProcs         int    `json:"MaxProcs"`         // (O) The most CPUs the agent itself runs go code on at once. Zero uses every CPU.
+	GCPercent        int    `json:"GCPercent"`        // (O) How much the heap can grow, as a percentage of the live heap, before the garbage collector runs. Lower uses less memory and more CPU. Zero uses go's default of 100.
+	MemoryLimitMB    int    `json:"MemoryLimitMB"`    // (O) The memory the agent aims to stay under by collecting garbage more often as it gets close. In megabytes. Zero is unlimited.
+	Cgroup           string `json:"Cgroup"`           // (O) The linux cgroup v2 the agent moves itself into, e.g. anon-eth-net under /sys/fs/cgroup. Its memory.max is set to MemoryLimitMB and its cpu.max to CgroupCPUPercent. Processes started by the loader are moved back out of it. Empty leaves the agent where it started.
+	CgroupCPUPercent int    `json:"CgroupCPUPercent"` // (O) The share of a single CPU the Cgroup is held to, e.g. 50 for half a CPU or 200 for two. Zero is unlimited.
+
+	// state settings
+	StateFile string `json:"StateFile"` // (D) The file everything which has to survive a restart, such as undelivered notifications, the fleet backlog, job restart counters and the update history, is saved to.
+	DataDir   string `json:"DataDir"`   // (O) The directory the StateFile, AuditLogFile, OperationsDir, CrashReportDir, UpdateQuarantineDir, UpdateCacheDir, RestACMECacheDir and LogDir are kept in when they aren't set. Created when it doesn't exist. Defaults to the directory the privileged helper created when the agent is run by one, then to the working directory, or to a directory of the OS such as /var/lib/anon-eth-net when the working directory can't be written to.
+
+	// lan peer discovery settings
+	DiscoveryPort            int    `json:"DiscoveryPort"`            // (O) The UDP port agents broadcast their identity and version on so co-located agents find each other. Zero disables discovery.
+	DiscoveryIntervalSeconds int    `json:"DiscoveryIntervalSeconds"` // (D) How often this agent announces itself to its peers. In seconds.
+	DiscoverySecret          string `json:"DiscoverySecret"`          // (O) The shared secret announcements are signed with. When set, unsigned announcements are ignored.
+
+	// bandwidth settings
+	BandwidthLimitKbps int      `json:"BandwidthLimitKbps"` // (O) The combined rate every outbound connection is held to, in kilobits per second. Zero is unlimited.
+	MonthlyByteBudget  ByteSize `json:"MonthlyByteBudget"`  // (O) The number of bytes, or a size such as "50GB", outbound connections can send and receive each calendar month before no new ones are opened. Zero is unlimited.
+
+	// mqtt settings
+	MQTTBrokerURL      string `json:"MQTTBrokerURL"`      // (O) The mqtt:// or mqtts:// URL of the broker status and metrics are published to and commands are received from, with any credentials as user:password@. Empty disables MQTT.
+	MQTTTopicPrefix    string `json:"MQTTTopicPrefix"`    // (D) The prefix of every topic this agent publishes to or subscribes to. Defaults to anon-eth-net/ followed by the DeviceId.
+	MQTTPublishSeconds int    `json:"MQTTPublishSeconds"` // (D) How often status and metrics are published to the broker. In seconds.
+
+	// failover settings
+	EndpointSelection string `json:"EndpointSelection"` // (D) How endpoint lists are tried: order tries them as listed, latency tries the fastest to connect to first. The last one which worked is always tried first.
+
+	// instance settings
+	LockFile     string `json:"LockFile"`     // (D) The file holding the process ID of the running copy so a second copy refuses to start. A lock left behind by a crash is taken over. Defaults to anon-eth-net.lock in the DataDir.
+	RecycleHours int    `json:"RecycleHours"` // (O) How often the agent cleanly restarts itself in place, leaving the loader's processes running. In hours. Zero never recycles.
+
+	// plugin settings
+	Plugins []PluginConfig `json:"Plugins"` // (O) The external processes which add metrics, status report sections and commands to the agent by speaking JSON over stdin and stdout.
+
+	// crash report settings
+	CrashReportDir string `json:"CrashReportDir"` // (D) The directory a report is written to whenever the agent panics or hits a fatal error.
+
+	// subsystem settings
+	Subsystems map[string]bool `json:"Subsystems"` // (O) Whether each of the updater, rest, profiler, loader, reporter and checkin subsystems runs. Those left out run. Changes take effect without a restart.
+
+	// privilege separation settings
+	AgentUser        string `json:"AgentUser"`        // (O) The unprivileged user the privileged helper runs the agent as. Only the helper keeps root to replace the binary, install the service and reboot. The helper reads it from its own config, /etc/anon-eth-net/privileged.json, rather than the config.json asset.
+	PrivilegedSocket string `json:"PrivilegedSocket"` // (D) The local socket the agent sends requests which need root to the privileged helper over.
+
+	// ethereum wallet settings
+	EthWallets      []string `json:"EthWallets"`      // (O) The addresses of the wallets whose balances are monitored for payouts, e.g. 0x followed by 40 hex digits. Empty monitors none.
+	EthRPCURL       string   `json:"EthRPCURL"`       // (O) The Ethereum JSON-RPC endpoint balances are read from, e.g. http://127.0.0.1:8545 for a local node. Empty reads them from EtherscanURL instead.
+	EtherscanURL    string   `json:"EtherscanURL"`    // (D) The Etherscan API balances are read from when EthRPCURL isn't set.
+	EtherscanAPIKey string   `json:"EtherscanAPIKey"` // (O) The Etherscan API key sent along with every request to EtherscanURL.
+	EthCheckSeconds int      `json:"EthCheckSeconds"` // (D) How often the balance of each of the EthWallets is checked. In seconds.
+	EthPayoutHours  int      `json:"EthPayoutHours"`  // (O) How long a wallet can go without a payout before it's reported. In hours. Zero never reports it.
+
+	// mining pool settings
+	Pools            []PoolConfig `json:"Pools"`            // (O) The mining pool accounts whose hashrate, shares and unpaid balance are collected from the pool's API.
+	PoolCheckSeconds int          `json:"PoolCheckSeconds"` // (D) How often the stats of each of the Pools are collected. In seconds.
+
+	// profitability settings
+	ProfitCheckSeconds int     `json:"ProfitCheckSeconds"` // (O) How often the daily profit of this machine is estimated. In seconds. Zero never estimates it.
+	ProfitCurrency     string  `json:"ProfitCurrency"`     // (D) The fiat currency the price of ETH, the power cost and the profit are in, e.g. usd.
+	PriceURL           string  `json:"PriceURL"`           // (D) The service the price of ETH is fetched from. A %v is replaced by the ProfitCurrency.
+	BlockRewardEth     float64 `json:"BlockRewardEth"`     // (D) The ETH paid out for each block found.
+	PoolFeePercent     float64 `json:"PoolFeePercent"`     // (O) The percentage of the revenue kept by the pool.
+	PowerCostPerKWh    float64 `json:"PowerCostPerKWh"`    // (O) What a kilowatt hour of power costs in the ProfitCurrency.
+	PowerDrawWatts     float64 `json:"PowerDrawWatts"`     // (O) The power this machine draws while mining. In watts. Zero uses what the GPUs report drawing.
+
+	// ethereum node settings
+	NodeRPCURL          string   `json:"NodeRPCURL"`          // (O) The JSON-RPC endpoint of the local Ethereum node to supervise, e.g. http://127.0.0.1:8545. Empty supervises none.
+	NodeCheckSeconds    int      `json:"NodeCheckSeconds"`    // (D) How often the node's sync status, latest block and peer count are checked. In seconds.
+	NodeMaxBehindBlocks int      `json:"NodeMaxBehindBlocks"` // (D) How many blocks the node can fall behind the head of the chain before it's reported.
+	NodeMinPeers        int      `json:"NodeMinPeers"`        // (D) The fewest peers the node can have before it's reported.
+	NodeStallMinutes    int      `json:"NodeStallMinutes"`    // (D) How long the node can go without importing a block before it's reported and, when it's the NodeJob, restarted. In minutes.
+	NodeJob             string   `json:"NodeJob"`             // (O) The name of the loader job which runs the node. Empty only monitors the node.
+	NodeDependentJobs   []string `json:"NodeDependentJobs"`   // (O) The names of the loader jobs which are stopped while the node restarts and started again once it's back.
+	NodeDataDir         string   `json:"NodeDataDir"`         // (O) The node's data directory, whose size is measured hourly.
+	NodeMaxDataGB       int      `json:"NodeMaxDataGB"`       // (O) How large the NodeDataDir can grow before it's reported and pruned. In GB. Zero never reports it.
+	NodePruneCommand    []string `json:"NodePruneCommand"`    // (O) The command and its arguments run while the node is stopped to prune its NodeDataDir. Empty never prunes it.
+
+	// log redaction settings
+	LogRedactPatterns []string `json:"LogRedactPatterns"` // (O) Regular expressions whose matches are masked in every log message, in addition to the secrets in this config and labelled credentials.
+
+	// log rotation settings
+	LogRotateSchedule  string `json:"LogRotateSchedule"`  // (O) Start a new log file at every calendar boundary, either daily at midnight local time or hourly at the top of the hour, as well as when a log file reaches its message count or age. Empty only rotates on the count and age.
+	LogFileDateLayout  string `json:"LogFileDateLayout"`  // (O) The Go time layout of the date in the name of each log file, e.g. 2006-01-02. Defaults to 2006-01-02 daily, 2006-01-02T15 hourly, and 20060102T150405.000Z in UTC without a LogRotateSchedule.
+	LogFileNamePattern string `json:"LogFileNamePattern"` // (O) The name of each log file before the .log extension, where {base} is the name of the logger, {time} is when the file was started in the LogFileDateLayout, {pid} is the process id and {seq} is the lowest number which isn't taken yet. Must contain {seq}. Defaults to {base}.{time}.{pid}.{seq}.
+
+	// log directory settings
+	LogDir       string `json:"LogDir"`       // (O) The directory to write log files to, each logger within a directory of its own named after it. Created when it doesn't exist. Empty writes log files to the working directory.
+	LogDirMode   string `json:"LogDirMode"`   // (D) The octal permissions the LogDir and the directory of each logger are given. Defaults to 0700.
+	LogMinFreeMB int    `json:"LogMinFreeMB"` // (D) The least space in megabytes the LogDir must have free. The agent won't start with less, and deletes the oldest log file of a logger before starting a new one once there's less. Defaults to 100.
+
+	// output capture settings
+	LogCaptureOutput bool `json:"LogCaptureOutput"` // (O) Log every line the agent writes to its standard output and standard error, including the go runtime's own output, prefixed with stdout: or stderr:. Lines written to standard error still reach it too. Defaults to false.
+
+	// log flush settings
+	LogFlushLevel   string `json:"LogFlushLevel"`   // (D) Messages at this level or more severe, either info or error, are written to the log file straight away. Less severe messages are buffered. Defaults to info, which writes every message straight away.
+	LogFsync        bool   `json:"LogFsync"`        // (O) Also ask the operating system to commit each message at the LogFlushLevel or more severe to disk, so it survives the machine losing power. Slower. Defaults to false.
+	LogFlushSeconds int    `json:"LogFlushSeconds"` // (D) The longest a buffered message waits before it's written to the log file. Defaults to 5.
+
+	// log sampling settings
+	LogSampling map[string]logger.Sampling `json:"LogSampling"` // (O) Limits on how many messages of each high volume category are logged, by category, e.g. {"rest_access": {"oneIn": 10}, "profiler": {"perSecond": 1}}. oneIn only logs every nth message and perSecond logs at most that many each second. The categories are rest_access and profiler. Categories which aren't listed are logged in full. Changes take effect without a restart.
+
+	// update scanning settings
+	UpdateQuarantineDir      string   `json:"UpdateQuarantineDir"`      // (D) The directory downloaded updates are held in, without being executable, until they've been scanned and installed.
+	UpdateCacheDir           string   `json:"UpdateCacheDir"`           // (D) The directory every downloaded update is cached in by its SHA-256 hash, so it's never downloaded twice and interrupted downloads are resumed.
+	UpdateScanCommand        []string `json:"UpdateScanCommand"`        // (O) The scanner command and its arguments every update is scanned with before it's installed. The path of the update is appended. Exit status 0 is clean and 1 is malicious.
+	UpdateScanURL            string   `json:"UpdateScanURL"`            // (O) The scanning service every update is POSTed to before it's installed. It replies with JSON holding malicious and verdict.
+	UpdateScanTimeoutSeconds int      `json:"UpdateScanTimeoutSeconds"` // (D) How long scanning a single update can take before it's treated as a failed scan. In seconds.
+
+	// update component settings
+	UpdateManifestURI    Endpoints         `json:"UpdateManifestURI"`    // (O) The URIs of the manifest listing every component of the latest release, such as the agent, the watchdog and a bundled miner, with their versions, hashes and compatible versions. A single URI or a list which is failed over in order. Empty updates nothing but the version.
+	UpdateComponents     map[string]string `json:"UpdateComponents"`     // (O) The path each component of the UpdateManifestURI is installed to on this machine, by name, e.g. {"watchdog": "/usr/local/bin/aen-watchdog"}. The agent component is always the running executable. Components which aren't listed are skipped.
+	UpdatePlatform       string            `json:"UpdatePlatform"`       // (O) The platform the builds of each component are picked for, as os/arch or os/arch/libc, e.g. linux/arm64/musl. Empty uses the platform the agent is running on.
+	UpdatePinnedVersion  uint64            `json:"UpdatePinnedVersion"`  // (O) The version this machine is held at, e.g. to back out a bad release. The updater installs it even when it's older than the running version and won't move off it until it's cleared with 0, the default, which follows the latest release. {version} in the UpdateManifestURI is replaced with it.
+	UpdateTUFURI         Endpoints         `json:"UpdateTUFURI"`         // (O) The URIs of a repository of The Update Framework metadata, for deployments which shouldn't trust the update server alone. When set the manifest is downloaded from it as the target {version}/manifest.json, in place of the UpdateManifestURI, and only installed once root, timestamp, snapshot and targets metadata signed by enough of their keys vouch for it. A single URI or a list which is failed over in order.
+	UpdateTUFRootFile    string            `json:"UpdateTUFRootFile"`    // (O) The root metadata trusted the first time the UpdateTUFURI is used, distributed with the agent. Required with the UpdateTUFURI. Later roots are followed from the repository and kept in the StateFile.
+	UpdateDownloadRate   ByteSize          `json:"UpdateDownloadRate"`   // (O) The fastest the components of an update are downloaded at, so large artifacts don't crowd out mining traffic. In bytes per second, or a size per second such as "2MB". 0, the default, doesn't limit them.
+	UpdateDownloadWindow string            `json:"UpdateDownloadWindow"` // (O) The local time of day, as HH:MM-HH:MM, the updater downloads the components of an update in, e.g. off-peak hours. Once they're downloaded and verified they're applied straight away. Empty downloads them whenever an update is found.
+
+	// security posture settings
+	PostureCheckHours int      `json:"PostureCheckHours"` // (D) How often the users, sudoers, listening ports, scheduled tasks and installed packages of this machine are snapshotted and compared against the last snapshot. In hours.
+	PostureIgnore     []string `json:"PostureIgnore"`     // (O) Regular expressions matched against the section and item of each change in the security posture, e.g. "ports tcp 127.0.0.1:3333". Matching changes aren't reported.
+
+	// integrity settings
+	IntegrityAssets       []string `json:"IntegrityAssets"`       // (D) The assets whose hashes are recorded along with the running executable when the agent is installed or updated, and verified every IntegrityCheckMinutes. Loaders are found by their name without the platform.
+	IntegrityCheckMinutes int      `json:"IntegrityCheckMinutes"` // (D) How often the running executable and the IntegrityAssets are verified against their recorded hashes. In minutes.
+	IntegrityKeyFile      string   `json:"IntegrityKeyFile"`      // (D) The file holding the key the recorded hashes are signed with. Generated, readable only by the agent's user, when the hashes are first recorded.
+
+	// data retention settings
+	RetentionDays       map[string]int `json:"RetentionDays"`       // (O) How many days each class of data is kept for: logs, metrics, diagnostics and updates. Classes which aren't listed are kept as they are.
+	RetentionCheckHours int            `json:"RetentionCheckHours"` // (D) How often files older than their RetentionDays are deleted. In hours.
+	SecureDelete        bool           `json:"SecureDelete"`        // (O) Overwrite files with random data before deleting them when they expire. Wiping the agent's data always does.
+}
+
+// PluginConfig describes a single external plugin. Name prefixes the metrics
+// it collects and titles its status report section. Command is the program
+// which is started along with its Args and kept running for as long as the
+// agent is.
+type PluginConfig struct {
+	Name    string   `json:"Name"`
+	Command string   `json:"Command"`
+	Args    []string `json:"Args"`
+}
+
+// PoolConfig describes a single mining pool account. Name titles it in the
+// status report and the metrics. Type is the pool, such as ethermine or
+// flexpool. Address is the wallet address the pool pays out to. URL replaces
+// the pool's public API, e.g. for a mirror, and Coin is the coin mined on
+// pools which mine more than one, defaulting to eth.
+type PoolConfig struct {
+	Name    string `json:"Name"`
+	Type    string `json:"Type"`
+	Address string `json:"Address"`
+	URL     string `json:"URL"`
+	Coin    string `json:"Coin"`
+}
+
+// NotifierConfig describes a single notification channel. Name is how routes
+// refer to the channel and defaults to Type. Type is one of email, slack,
+// telegram, discord, webhook or twilio. URL is the webhook address for slack,
+// discord and webhook channels, or a list of them to fail over between. Token and ChatId are used by telegram. Twilio
+// uses AccountSid and Token to authenticate and texts every number in To from
+// the From number. MinSeverity is the lowest severity the channel receives:
+// info, warn or critical. Twilio defaults to critical. MaxPerHour
+// limits how many notifications the channel receives each hour with the
+// overflow going into its digest. Zero means unlimited. Critical
+// notifications are never held back by it.
+type NotifierConfig struct {
+	Name        string    `json:"Name"`
+	Type        string    `json:"Type"`
+	URL         Endpoints `json:"URL"`
+	Token       string    `json:"Token"`
+	ChatId      string    `json:"ChatId"`
+	AccountSid  string    `json:"AccountSid"`
+	From        string    `json:"From"`
+	To          []string  `json:"To"`
+	MinSeverity string    `json:"MinSeverity"`
+	MaxPerHour  int       `json:"MaxPerHour"`
+}
+
+// RestTokenConfig describes a single bearer token accepted by the REST server.
+// Name identifies the token in the logs and audit log. Hash is the hex SHA-256
+// hash of the token itself. Role is read-only, operator or admin. Read-only
+// tokens can only view status and logs, operators can also restart jobs and
+// acknowledge notifications, and only admins can update, run commands, or
+// change config. Expires is when the token stops being accepted, in RFC3339,
+// e.g. 2030-01-31T00:00:00Z. Empty never expires.
+type RestTokenConfig struct {
+	Name    string `json:"Name"`
+	Hash    string `json:"Hash"`
+	Role    string `json:"Role"`
+	Expires string `json:"Expires"`
+}
+
+// RouteConfig sends every notification of the given Severity (info, warn or
+// critical) to exactly the named Channels. When Digest is set the
+// notifications are batched into a periodic digest instead of being delivered
+// one at a time.
+type RouteConfig struct {
+	Severity string   `json:"Severity"`
+	Channels []string `json:"Channels"`
+	Digest   bool     `json:"Digest"`
 }
 
 // ConfigJSONParametersExplained() returns a nicely formatted string which
@@ -55,14 +424,159 @@ func ConfigJSONParametersExplained() string {
 	FirstRunAfterUpdate      string        json:"FirstRunAfterUpdate"      // (D) Whether or not this is the first time that the program is running after an update has been executed.
 	UpdateFrequencySeconds   int           json:"UpdateFrequencySeconds"   // (D) The frequency with which this program will attempt to update itself. In seconds.
 	RemoteUpdateURI          string        json:"RemoteUpdateURI"          // (D) The remote location where new source code can be obtained from for this program.
-	RemoteVersionURI         string        json:"RemoteVersionURI"         // (D) The remote URI where the latest version number of this program can be obtained from.
-	LocalVersion             uint64        json:"LocalVersion"             // (D) The local version of this program that is currently running.
+	RemoteVersionURI         Endpoints     json:"RemoteVersionURI"         // (D) The remote URIs where the latest version number of this program can be obtained from. A single URI or a list which is failed over in order.
+	LocalVersion             uint64        json:"LocalVersion"             // (D) The local version of this program that is currently running. Embedded at build time or read from the version.no asset.
+	Include                  []string      json:"Include"                  // (O) Config files to merge over this one in order, relative to it, followed by every .json file in the config.d directory next to it in lexical order. Each only needs the settings it changes, e.g. {"EthWallets": ["0x..."]}. Settings set by them win on every load and are never saved back into this file.
+	StrictConfig             bool          json:"StrictConfig"             // (O) Refuse to load a config with settings this version doesn't know, such as a misspelled CheckInFrequencySecond, rather than logging an error for each and ignoring them. Defaults to false.
+	StatusReportTime         string        json:"StatusReportTime"         // (O) The local time of day, as HH:MM, to send out the daily status report at.
+	StatusReportRecipients   []string      json:"StatusReportRecipients"   // (O) The email addresses the daily status report is sent to. Defaults to CheckInGmailAddress.
+	Notifiers                []object      json:"Notifiers"                // (O) The channels notifications are delivered to. Each has a Name, Type (email, slack, telegram, discord, webhook, twilio), URL, Token, ChatId, AccountSid, From, To, MinSeverity (info, warn, critical), and MaxPerHour. Defaults to email only.
+	NotificationRoutes       []object      json:"NotificationRoutes"       // (O) Which channels each severity is delivered to. Each has a Severity, a list of Channels by name, and whether to Digest them. Defaults to every channel that accepts the severity.
+	EscalationTimeoutSeconds int           json:"EscalationTimeoutSeconds" // (O) How long a critical notification can go unacknowledged via REST before it's escalated. Zero disables escalation.
+	EscalationChannels       []string      json:"EscalationChannels"       // (O) The names of the channels unacknowledged critical notifications are escalated to. Defaults to every channel.
+	DigestIntervalSeconds    int           json:"DigestIntervalSeconds"    // (D) How often batched notifications are delivered as a single digest. In seconds.
+	CommandIMAPServer        string        json:"CommandIMAPServer"        // (O) The host:port of the IMAP server to poll for command emails, e.g. imap.gmail.com:993. Empty disables email commands.
+	CommandSecret            string        json:"CommandSecret"            // (O) The shared secret command emails are signed with. Required when CommandIMAPServer is set.
+	CommandAllowedSenders    []string      json:"CommandAllowedSenders"    // (O) The email addresses which are allowed to send commands. Defaults to CheckInGmailAddress.
+	CommandPollSeconds       int           json:"CommandPollSeconds"       // (D) How often the IMAP server is checked for new command emails. In seconds.
+	PGPRecipientKeyFile      string        json:"PGPRecipientKeyFile"      // (O) The path to the ASCII armored public keys every outbound email is encrypted to. Empty disables encryption.
+	PGPSigningKeyFile        string        json:"PGPSigningKeyFile"        // (O) The path to the ASCII armored private key every outbound email is signed with. Empty disables signing.
+	PGPSigningKeyPassphrase  string        json:"PGPSigningKeyPassphrase"  // (O) The passphrase which unlocks the PGP signing key, if it has one.
+	RestListenAddress        string        json:"RestListenAddress"        // (O) The host:port the REST server listens on, e.g. :8443. Defaults to a port from 20000 to 29999 derived from the machine, so it stays the same across restarts, or a random free port when that one is taken.
+	RestTokenHashes          []string      json:"RestTokenHashes"          // (O) The hex SHA-256 hashes of admin bearer tokens accepted by the REST server. Prefer RestTokens.
+	RestTokens               []object      json:"RestTokens"               // (O) The named bearer tokens accepted by the REST server. Each has a Name, the hex SHA-256 Hash of the token, a Role (read-only, operator, admin) and optionally when it Expires in RFC3339. Empty, along with RestTokenHashes and RestClientCAFile, serves only the dashboard and health check.
+	RestClientCAFile         string        json:"RestClientCAFile"         // (O) The path to the PEM CA certificates REST clients must present a certificate from. Empty disables mutual TLS.
+	RestMaxAuthFailures      int           json:"RestMaxAuthFailures"      // (D) The number of failed REST authentication attempts in a row before the client address is locked out.
+	RestLockoutSeconds       int           json:"RestLockoutSeconds"       // (D) How long a client address is locked out for after too many failed REST authentication attempts. In seconds.
+	RestCertFile             string        json:"RestCertFile"             // (O) The path to the PEM certificate the REST server uses. Defaults to the server.cert asset. A self signed certificate is generated if it doesn't exist.
+	RestKeyFile              string        json:"RestKeyFile"              // (O) The path to the PEM private key of the REST certificate. Defaults to the server.pkey asset.
+	RestACMEDomains          []string      json:"RestACMEDomains"          // (O) The public domain names of this machine to obtain a certificate for via ACME, e.g. Let's Encrypt. Overrides RestCertFile.
+	RestACMECacheDir         string        json:"RestACMECacheDir"         // (D) The directory ACME account keys and certificates are saved to.
+	RestAllowedCIDRs         []string      json:"RestAllowedCIDRs"         // (O) The networks, e.g. 10.8.0.0/24, and addresses allowed to connect to the REST server. Everything else is refused before the TLS handshake. Empty allows only loopback and private addresses.
+	RestListenInterface      string        json:"RestListenInterface"      // (O) The network interface, e.g. lo or wg0, the REST server binds to instead of every interface.
+	RestRateLimitPerSecond   float64       json:"RestRateLimitPerSecond"   // (D) How many REST requests per second each client address can make on average.
+	RestRateLimitBurst       int           json:"RestRateLimitBurst"       // (D) How many REST requests each client address can make at once before being rate limited.
+	RestCORSOrigins          []string      json:"RestCORSOrigins"          // (O) The browser origins, e.g. https://dashboard.example.com, allowed to call the REST server. "*" allows every origin. Empty disables CORS.
+	RestTokenLifetimeDays    int           json:"RestTokenLifetimeDays"    // (D) How long a token created by rotating one of the RestTokens is accepted for. In days.
+	RestTokenOverlapMinutes  int           json:"RestTokenOverlapMinutes"  // (D) How long a rotated token is still accepted alongside its replacement unless the rotation says otherwise. In minutes.
+	RestTokenWarnDays        int           json:"RestTokenWarnDays"        // (D) How long before one of the RestTokens expires that a warning is sent every day. In days.
+	ApprovalActions          []string      json:"ApprovalActions"          // (O) The REST actions which only run once a second admin token approves them: exec, update and auth. Empty runs every action straight away.
+	ApprovalTimeoutMinutes   int           json:"ApprovalTimeoutMinutes"   // (D) How long a pending action waits to be approved, and an approval waits to be used. In minutes.
+	UpdateWindow             string        json:"UpdateWindow"             // (O) The local time of day, as HH:MM-HH:MM, updates can be applied in without approval. Empty always requires it when update is one of the ApprovalActions.
+	ExecAllowlist            [][]string    json:"ExecAllowlist"            // (O) The command lines which can be run via REST, each the command followed by exactly the arguments it allows, e.g. ["systemctl", "status", "miner"]. A last argument of "*" allows any further arguments, e.g. ["journalctl", "*"]. Empty disables remote execution.
+	ExecTimeoutSeconds       int           json:"ExecTimeoutSeconds"       // (D) How long a command run via REST can execute for before it's killed. In seconds.
+	ExecMaxOutputBytes       int           json:"ExecMaxOutputBytes"       // (D) The maximum number of bytes of stdout and of stderr returned for a command run via REST. The rest is discarded.
+	FileRoots                []string      json:"FileRoots"                // (O) The directories files can be downloaded from and uploaded to via REST. Empty disables file transfers.
+	FileMaxBytes             ByteSize      json:"FileMaxBytes"             // (D) The largest file which can be transferred via REST. In bytes or a size such as "100MB".
+	AuditLogFile             string        json:"AuditLogFile"             // (D) The file every authenticated REST action is recorded to. Each entry is chained to the previous one by its hash so tampering can be detected.
+	OperationsDir            string        json:"OperationsDir"            // (D) The directory the progress and results of asynchronous REST operations are saved to.
+	FleetServerURL           Endpoints     json:"FleetServerURL"           // (O) The URLs of the central fleet server heartbeats are POSTed to and queued commands are pulled back from. A single URL or a list which is failed over in order. Empty disables fleet check ins.
+	FleetSecret              string        json:"FleetSecret"              // (O) The shared secret heartbeats are signed with and commands from the fleet server must be signed with. Required when FleetServerURL or FleetChannelURL is set, unless it's obtained by enrolling with a FleetRegistrationToken.
+	FleetCheckInSeconds      int           json:"FleetCheckInSeconds"      // (D) How often to check in with the fleet server. In seconds.
+	FleetChannelURL          string        json:"FleetChannelURL"          // (O) The ws:// or wss:// URL of the control server's always on command channel. Commands, config pushes and update triggers sent over it run immediately. Empty disables the channel.
+	FleetEnrollURL           Endpoints     json:"FleetEnrollURL"           // (O) The URLs of the fleet server the DeviceId and FleetRegistrationToken are exchanged for this agent's own FleetSecret at. Required when FleetRegistrationToken is set.
+	FleetRegistrationToken   string        json:"FleetRegistrationToken"   // (O) The token which enrolls this agent with the fleet server the first time it runs. Cleared once the agent is enrolled.
+	FleetUpdatePermitURL     Endpoints     json:"FleetUpdatePermitURL"     // (O) The URLs of the fleet server asked for permission before an update is applied, so it can limit how many agents at a site update at once. Empty applies updates without asking.
+	FleetSite                string        json:"FleetSite"                // (O) The site, such as a farm or a rack, this agent belongs to when asking for permission to update.
+	FleetPermitWaitMinutes   int           json:"FleetPermitWaitMinutes"   // (D) How long to keep asking for permission to update before deferring the update to the next check. In minutes.
+	ProxyURL                 string        json:"ProxyURL"                 // (O) The socks5:// URL of the proxy all outbound traffic is routed through, e.g. socks5://127.0.0.1:9050 for a local Tor client. Empty connects directly.
+	ProxyBypass              []string      json:"ProxyBypass"              // (O) The destinations which are connected to directly instead of via ProxyURL. Each is a host name, a *.zone, an IP address or a CIDR range. Loopback is always direct.
+	TLSPins                  object        json:"TLSPins"                  // (O) The SHA-256 hashes of the public keys each host's certificate chain must contain, by host name, e.g. sha256/ followed by base64. Connections to a pinned host which aren't encrypted are refused.
+	LogHTTPRequests          bool          json:"LogHTTPRequests"          // (O) Log the method, host, status, duration and retries of every outbound HTTP request.
+	PublicIPServices         []string      json:"PublicIPServices"         // (D) The URLs of the services which reply with this machine's public IP address as plain text. The address most of them agree on is used.
+	PublicIPCheckSeconds     int           json:"PublicIPCheckSeconds"     // (D) How often to resolve the public IP address and report when it changes. In seconds. Negative disables the check.
+	GeoLocationURL           string        json:"GeoLocationURL"           // (O) The URL of a JSON geolocation service with %v in place of the IP address, e.g. https://ipinfo.io/%v/json. Changes are reported along with the city, region and country it replies with. Empty skips geolocation.
+	TimeSources              []string      json:"TimeSources"              // (D) The ntp:// servers and http:// or https:// URLs whose Date header the local clock is checked against. The first which replies is used.
+	TimeSyncSeconds          int           json:"TimeSyncSeconds"          // (D) How often to check the local clock against the TimeSources. In seconds. Negative disables the check.
+	MaxClockSkewSeconds      int           json:"MaxClockSkewSeconds"      // (D) How far the local clock can be from the TimeSources before it's reported. Scheduling corrects for any skew either way. In seconds.
+	MaxProcs                 int           json:"MaxProcs"                 // (O) The most CPUs the agent itself runs go code on at once. Zero uses every CPU.
+	GCPercent                int           json:"GCPercent"                // (O) How much the heap can grow, as a percentage of the live heap, before the garbage collector runs. Lower uses less memory and more CPU. Zero uses go's default of 100.
+	MemoryLimitMB            int           json:"MemoryLimitMB"            // (O) The memory the agent aims to stay under by collecting garbage more often as it gets close. In megabytes. Zero is unlimited.
+	Cgroup                   string        json:"Cgroup"                   // (O) The linux cgroup v2 the agent moves itself into, e.g. anon-eth-net under /sys/fs/cgroup. Its memory.max is set to MemoryLimitMB and its cpu.max to CgroupCPUPercent. Processes started by the loader are moved back out of it. Empty leaves the agent where it started.
+	CgroupCPUPercent         int           json:"CgroupCPUPercent"         // (O) The share of a single CPU the Cgroup is held to, e.g. 50 for half a CPU or 200 for two. Zero is unlimited.
+	StateFile                string        json:"StateFile"                // (D) The file everything which has to survive a restart, such as undelivered notifications, the fleet backlog, job restart counters and the update history, is saved to.
+	DataDir                  string        json:"DataDir"                  // (O) The directory the StateFile, AuditLogFile, OperationsDir, CrashReportDir, UpdateQuarantineDir, UpdateCacheDir, RestACMECacheDir and LogDir are kept in when they aren't set. Created when it doesn't exist. Defaults to the directory the privileged helper created when the agent is run by one, then to the working directory, or to a directory of the OS such as /var/lib/anon-eth-net when the working directory can't be written to.
+	DiscoveryPort            int           json:"DiscoveryPort"            // (O) The UDP port agents broadcast their identity and version on so co-located agents find each other. Zero disables discovery.
+	DiscoveryIntervalSeconds int           json:"DiscoveryIntervalSeconds" // (D) How often this agent announces itself to its peers. In seconds.
+	DiscoverySecret          string        json:"DiscoverySecret"          // (O) The shared secret announcements are signed with. When set, unsigned announcements are ignored.
+	BandwidthLimitKbps       int           json:"BandwidthLimitKbps"       // (O) The combined rate every outbound connection is held to, in kilobits per second. Zero is unlimited.
+	MonthlyByteBudget        ByteSize      json:"MonthlyByteBudget"        // (O) The number of bytes, or a size such as "50GB", outbound connections can send and receive each calendar month before no new ones are opened. Zero is unlimited.
+	MQTTBrokerURL            string        json:"MQTTBrokerURL"            // (O) The mqtt:// or mqtts:// URL of the broker status and metrics are published to and commands are received from, with any credentials as user:password@. Empty disables MQTT.
+	MQTTTopicPrefix          string        json:"MQTTTopicPrefix"          // (D) The prefix of every topic this agent publishes to or subscribes to. Defaults to anon-eth-net/ followed by the DeviceId.
+	MQTTPublishSeconds       int           json:"MQTTPublishSeconds"       // (D) How often status and metrics are published to the broker. In seconds.
+	EndpointSelection        string        json:"EndpointSelection"        // (D) How endpoint lists are tried: order tries them as listed, latency tries the fastest to connect to first. The last one which worked is always tried first.
+	LockFile                 string        json:"LockFile"                 // (D) The file holding the process ID of the running copy so a second copy refuses to start. A lock left behind by a crash is taken over. Defaults to anon-eth-net.lock in the DataDir.
+	RecycleHours             int           json:"RecycleHours"             // (O) How often the agent cleanly restarts itself in place, leaving the loader's processes running. In hours. Zero never recycles.
+	Plugins                  []object      json:"Plugins"                  // (O) The external processes which add metrics, status report sections and commands to the agent by speaking JSON over stdin and stdout. Each has a Name, a Command and its Args.
+	CrashReportDir           string        json:"CrashReportDir"           // (D) The directory a report is written to whenever the agent panics or hits a fatal error.
+	Subsystems               object        json:"Subsystems"               // (O) Whether each of the updater, rest, profiler, loader, reporter and checkin subsystems runs. Those left out run. Changes take effect without a restart.
+	AgentUser                string        json:"AgentUser"                // (O) The unprivileged user the privileged helper runs the agent as. Only the helper keeps root to replace the binary, install the service and reboot. The helper reads it from its own config, /etc/anon-eth-net/privileged.json, rather than the config.json asset.
+	PrivilegedSocket         string        json:"PrivilegedSocket"         // (D) The local socket the agent sends requests which need root to the privileged helper over.
+	EthWallets               []string      json:"EthWallets"               // (O) The addresses of the wallets whose balances are monitored for payouts, e.g. 0x followed by 40 hex digits. Empty monitors none.
+	EthRPCURL                string        json:"EthRPCURL"                // (O) The Ethereum JSON-RPC endpoint balances are read from, e.g. http://127.0.0.1:8545 for a local node. Empty reads them from EtherscanURL instead.
+	EtherscanURL             string        json:"EtherscanURL"             // (D) The Etherscan API balances are read from when EthRPCURL isn't set.
+	EtherscanAPIKey          string        json:"EtherscanAPIKey"          // (O) The Etherscan API key sent along with every request to EtherscanURL.
+	EthCheckSeconds          int           json:"EthCheckSeconds"          // (D) How often the balance of each of the EthWallets is checked. In seconds.
+	EthPayoutHours           int           json:"EthPayoutHours"           // (O) How long a wallet can go without a payout before it's reported. In hours. Zero never reports it.
+	Pools                    []object      json:"Pools"                    // (O) The mining pool accounts whose hashrate, shares and unpaid balance are collected from the pool's API. Each has a Name, a Type such as ethermine or flexpool, an Address and optionally a URL and a Coin.
+	PoolCheckSeconds         int           json:"PoolCheckSeconds"         // (D) How often the stats of each of the Pools are collected. In seconds.
+	ProfitCheckSeconds       int           json:"ProfitCheckSeconds"       // (O) How often the daily profit of this machine is estimated. In seconds. Zero never estimates it.
+	ProfitCurrency           string        json:"ProfitCurrency"           // (D) The fiat currency the price of ETH, the power cost and the profit are in, e.g. usd.
+	PriceURL                 string        json:"PriceURL"                 // (D) The service the price of ETH is fetched from. A %v is replaced by the ProfitCurrency.
+	BlockRewardEth           float64       json:"BlockRewardEth"           // (D) The ETH paid out for each block found.
+	PoolFeePercent           float64       json:"PoolFeePercent"           // (O) The percentage of the revenue kept by the pool.
+	PowerCostPerKWh          float64       json:"PowerCostPerKWh"          // (O) What a kilowatt hour of power costs in the ProfitCurrency.
+	PowerDrawWatts           float64       json:"PowerDrawWatts"           // (O) The power this machine draws while mining. In watts. Zero uses what the GPUs report drawing.
+	NodeRPCURL               string        json:"NodeRPCURL"               // (O) The JSON-RPC endpoint of the local Ethereum node to supervise, e.g. http://127.0.0.1:8545. Empty supervises none.
+	NodeCheckSeconds         int           json:"NodeCheckSeconds"         // (D) How often the node's sync status, latest block and peer count are checked. In seconds.
+	NodeMaxBehindBlocks      int           json:"NodeMaxBehindBlocks"      // (D) How many blocks the node can fall behind the head of the chain before it's reported.
+	NodeMinPeers             int           json:"NodeMinPeers"             // (D) The fewest peers the node can have before it's reported.
+	NodeStallMinutes         int           json:"NodeStallMinutes"         // (D) How long the node can go without importing a block before it's reported and, when it's the NodeJob, restarted. In minutes.
+	NodeJob                  string        json:"NodeJob"                  // (O) The name of the loader job which runs the node. Empty only monitors the node.
+	NodeDependentJobs        []string      json:"NodeDependentJobs"        // (O) The names of the loader jobs which are stopped while the node restarts and started again once it's back.
+	NodeDataDir              string        json:"NodeDataDir"              // (O) The node's data directory, whose size is measured hourly.
+	NodeMaxDataGB            int           json:"NodeMaxDataGB"            // (O) How large the NodeDataDir can grow before it's reported and pruned. In GB. Zero never reports it.
+	NodePruneCommand         []string      json:"NodePruneCommand"         // (O) The command and its arguments run while the node is stopped to prune its NodeDataDir. Empty never prunes it.
+	LogRedactPatterns        []string      json:"LogRedactPatterns"        // (O) Regular expressions whose matches are masked in every log message, in addition to the secrets in this config and labelled credentials.
+	LogRotateSchedule        string        json:"LogRotateSchedule"        // (O) Start a new log file at every calendar boundary, either daily at midnight local time or hourly at the top of the hour, as well as when a log file reaches its message count or age. Empty only rotates on the count and age.
+	LogFileDateLayout        string        json:"LogFileDateLayout"        // (O) The Go time layout of the date in the name of each log file, e.g. 2006-01-02. Defaults to 2006-01-02 daily, 2006-01-02T15 hourly, and 20060102T150405.000Z in UTC without a LogRotateSchedule.
+	LogFileNamePattern       string        json:"LogFileNamePattern"       // (O) The name of each log file before the .log extension, where {base} is the name of the logger, {time} is when the file was started in the LogFileDateLayout, {pid} is the process id and {seq} is the lowest number which isn't taken yet. Must contain {seq}. Defaults to {base}.{time}.{pid}.{seq}.
+	LogDir                   string        json:"LogDir"                   // (O) The directory to write log files to, each logger within a directory of its own named after it. Created when it doesn't exist. Empty writes log files to the working directory.
+	LogDirMode               string        json:"LogDirMode"               // (D) The octal permissions the LogDir and the directory of each logger are given. Defaults to 0700.
+	LogMinFreeMB             int           json:"LogMinFreeMB"             // (D) The least space in megabytes the LogDir must have free. The agent won't start with less, and deletes the oldest log file of a logger before starting a new one once there's less. Defaults to 100.
+	LogCaptureOutput         bool          json:"LogCaptureOutput"         // (O) Log every line the agent writes to its standard output and standard error, including the go runtime's own output, prefixed with stdout: or stderr:. Lines written to standard error still reach it too. Defaults to false.
+	LogFlushLevel            string        json:"LogFlushLevel"            // (D) Messages at this level or more severe, either info or error, are written to the log file straight away. Less severe messages are buffered. Defaults to info, which writes every message straight away.
+	LogFsync                 bool          json:"LogFsync"                 // (O) Also ask the operating system to commit each message at the LogFlushLevel or more severe to disk, so it survives the machine losing power. Slower. Defaults to false.
+	LogFlushSeconds          int           json:"LogFlushSeconds"          // (D) The longest a buffered message waits before it's written to the log file. Defaults to 5.
+	LogSampling              object        json:"LogSampling"              // (O) Limits on how many messages of each high volume category are logged, by category, e.g. {"rest_access": {"oneIn": 10}, "profiler": {"perSecond": 1}}. oneIn only logs every nth message and perSecond logs at most that many each second. The categories are rest_access and profiler. Categories which aren't listed are logged in full. Changes take effect without a restart.
+	UpdateQuarantineDir      string        json:"UpdateQuarantineDir"      // (D) The directory downloaded updates are held in, without being executable, until they've been scanned and installed.
+	UpdateCacheDir           string        json:"UpdateCacheDir"           // (D) The directory every downloaded update is cached in by its SHA-256 hash, so it's never downloaded twice and interrupted downloads are resumed.
+	UpdateScanCommand        []string      json:"UpdateScanCommand"        // (O) The scanner command and its arguments every update is scanned with before it's installed. The path of the update is appended. Exit status 0 is clean and 1 is malicious.
+	UpdateScanURL            string        json:"UpdateScanURL"            // (O) The scanning service every update is POSTed to before it's installed. It replies with JSON holding malicious and verdict.
+	UpdateScanTimeoutSeconds int           json:"UpdateScanTimeoutSeconds" // (D) How long scanning a single update can take before it's treated as a failed scan. In seconds.
+	UpdateManifestURI        Endpoints     json:"UpdateManifestURI"        // (O) The URIs of the manifest listing every component of the latest release, such as the agent, the watchdog and a bundled miner, with their versions, hashes and compatible versions. A single URI or a list which is failed over in order. Empty updates nothing but the version.
+	UpdateComponents         object        json:"UpdateComponents"         // (O) The path each component of the UpdateManifestURI is installed to on this machine, by name, e.g. {"watchdog": "/usr/local/bin/aen-watchdog"}. The agent component is always the running executable. Components which aren't listed are skipped.
+	UpdatePlatform           string        json:"UpdatePlatform"           // (O) The platform the builds of each component are picked for, as os/arch or os/arch/libc, e.g. linux/arm64/musl. Empty uses the platform the agent is running on.
+	UpdatePinnedVersion      uint64        json:"UpdatePinnedVersion"      // (O) The version this machine is held at, e.g. to back out a bad release. The updater installs it even when it's older than the running version and won't move off it until it's cleared with 0, the default, which follows the latest release. {version} in the UpdateManifestURI is replaced with it.
+	UpdateTUFURI             Endpoints     json:"UpdateTUFURI"             // (O) The URIs of a repository of The Update Framework metadata, for deployments which shouldn't trust the update server alone. When set the manifest is downloaded from it as the target {version}/manifest.json, in place of the UpdateManifestURI, and only installed once root, timestamp, snapshot and targets metadata signed by enough of their keys vouch for it. A single URI or a list which is failed over in order.
+	UpdateTUFRootFile        string        json:"UpdateTUFRootFile"        // (O) The root metadata trusted the first time the UpdateTUFURI is used, distributed with the agent. Required with the UpdateTUFURI. Later roots are followed from the repository and kept in the StateFile.
+	UpdateDownloadRate       ByteSize      json:"UpdateDownloadRate"       // (O) The fastest the components of an update are downloaded at, so large artifacts don't crowd out mining traffic. In bytes per second, or a size per second such as "2MB". 0, the default, doesn't limit them.
+	UpdateDownloadWindow     string        json:"UpdateDownloadWindow"     // (O) The local time of day, as HH:MM-HH:MM, the updater downloads the components of an update in, e.g. off-peak hours. Once they're downloaded and verified they're applied straight away. Empty downloads them whenever an update is found.
+	PostureCheckHours        int           json:"PostureCheckHours"        // (D) How often the users, sudoers, listening ports, scheduled tasks and installed packages of this machine are snapshotted and compared against the last snapshot. In hours.
+	PostureIgnore            []string      json:"PostureIgnore"            // (O) Regular expressions matched against the section and item of each change in the security posture, e.g. "ports tcp 127.0.0.1:3333". Matching changes aren't reported.
+	IntegrityAssets          []string      json:"IntegrityAssets"          // (D) The assets whose hashes are recorded along with the running executable when the agent is installed or updated, and verified every IntegrityCheckMinutes. Loaders are found by their name without the platform.
+	IntegrityCheckMinutes    int           json:"IntegrityCheckMinutes"    // (D) How often the running executable and the IntegrityAssets are verified against their recorded hashes. In minutes.
+	IntegrityKeyFile         string        json:"IntegrityKeyFile"         // (D) The file holding the key the recorded hashes are signed with. Generated, readable only by the agent's user, when the hashes are first recorded.
+	RetentionDays            object        json:"RetentionDays"            // (O) How many days each class of data is kept for: logs, metrics, diagnostics and updates. Classes which aren't listed are kept as they are.
+	RetentionCheckHours      int           json:"RetentionCheckHours"      // (D) How often files older than their RetentionDays are deleted. In hours.
+	SecureDelete             bool          json:"SecureDelete"             // (O) Overwrite files with random data before deleting them when they expire. Wiping the agent's data always does.
 `
 }
 
 // FromFile will generate a config struct from the local standard config file
 // which is located inside of the assets folder as 'config.json'. It will be
-// fully configured based off of the values in the json.
+// fully configured based off of the values in the json. Returns
+// ErrConfigInvalid when a value isn't valid.
 func FromFile() error {
 
 	configAssetPath, assetErr := utils.AssetPath("config.json")
@@ -70,27 +584,61 @@ func FromFile() error {
 		return assetErr
 	}
 
-	logger.Lgr.LogMessage("Successfully located config asset: %v", configAssetPath)
+	logger.Lgr.LogMessagef("Successfully located config asset: %v", configAssetPath)
+	return FromPath(configAssetPath)
+}
+
+// FromPath will generate a config struct from the given config file exactly
+// as FromFile does from the config.json asset, e.g. for the privileged helper
+// which reads a config of its own. ToFile saves the config back to the file
+// it was last loaded from.
+func FromPath(configPath string) error {
 
 	// read in the pre-existing config file
-	bytes, loadErr := ioutil.ReadFile(configAssetPath)
+	bytes, loadErr := ioutil.ReadFile(configPath)
 	if loadErr != nil {
 		return loadErr
 	}
 
-	logger.Lgr.LogMessage("Successfully read in config asset: %v", configAssetPath)
+	logger.Lgr.LogMessagef("Successfully read in config file: %v", configPath)
 
 	newConfig := &Config{}
 
+	// fill in the environment and host facts the settings refer to
+	expanded, expandErr := expandTemplates(configPath, bytes)
+	if expandErr != nil {
+		return expandErr
+	}
+
 	// unmarshal the JSON directly into a config struct instance
-	jsonErr := json.Unmarshal(bytes, &newConfig)
+	jsonErr := json.Unmarshal(expanded, &newConfig)
 	if jsonErr != nil {
-		return jsonErr
+		return invalidJSON(jsonErr)
 	}
+	rememberTemplates(bytes, expanded)
 
-	logger.Lgr.LogMessage("Successfully unmarshalled config object: %+v", newConfig)
+	unknown, unknownErr := unknownKeys(configPath, bytes, reflect.TypeOf(Config{}))
+	if unknownErr != nil {
+		return invalidJSON(unknownErr)
+	}
+
+	// layer the machine specific settings over it
+	layerUnknown, layerErr := mergeLayers(newConfig, configPath, bytes)
+	if layerErr != nil {
+		return layerErr
+	}
+	unknown = append(unknown, layerUnknown...)
+
+	// a misspelled setting would otherwise silently keep its default
+	if len(unknown) > 0 && newConfig.StrictConfig {
+		return invalid(fmt.Errorf("The config has unknown settings:\n%v\nPlease correct them in the config.json asset and restart.", strings.Join(unknown, "\n")))
+	}
+	for _, description := range unknown {
+		logger.Lgr.LogErrorf("Ignoring %v", description)
+	}
 
 	// check if a manual email login file was provided to secretly override the defaults
+	credentialsFile = ""
 	emailAssetPath, emailAssetErr := utils.AssetPath("emaillogin.conf")
 	if emailAssetErr == nil {
 		fileLines, readErr := utils.ReadLines(emailAssetPath)
@@ -99,114 +647,154 @@ func FromFile() error {
 		}
 		newConfig.CheckInGmailAddress = fileLines[0]
 		newConfig.CheckInGmailPassword = fileLines[1]
+		credentialsFile = emailAssetPath
 	}
 
-	logger.Lgr.LogMessage("Successfully loaded overriding gmail credentials: %v, %v", newConfig.CheckInGmailAddress, newConfig.CheckInGmailPassword)
-
-	// verify all the required values are correctly setup by the user
-	if newConfig.CheckInGmailAddress == "" {
-		return errors.New("Cannot use empty gmail address when starting up. Please update the config.json asset with an appropriate value and restart.")
-	}
+	logger.Lgr.LogMessagef("Successfully loaded overriding gmail credentials: %v", newConfig.CheckInGmailAddress)
 
-	if newConfig.CheckInGmailPassword == "" {
-		return errors.New("Cannot use empty email password when starting up. Please update the config.json asset with an appropriate value and restart.")
+	// verify every value and set the defaults, area by area, before any of
+	// them takes effect
+	generatedIdentity, identityErr := generateIdentity(newConfig)
+	if identityErr != nil {
+		return identityErr
 	}
 
-	if newConfig.CheckInFrequencySeconds == 0 {
-		return errors.New("Cannot use an empty or zero value for check in frequency . Please update the config.json asset with an appropriate value and restart.")
+	validations := []func(*Config) error{validateDataDir, validateLogging, validateCheckIn, validateFleet, validateNetwork, validateRest, validateRuntime, validateMining, validateUpdates, validateRetention}
+	for _, validate := range validations {
+		if validateErr := validate(newConfig); validateErr != nil {
+			return validateErr
+		}
 	}
 
-	if newConfig.NetQueryFrequencySeconds == 0 {
-		return errors.New("Cannot use an empty or zero value for internet query frequency. Please update the config.json asset with an appropriate value and restart.")
+	// prefer the version embedded at build time and fall back to the local
+	// version asset for binaries built without one
+	localVersion, embedded := buildinfo.EmbeddedVersion()
+	if !embedded {
+		fileVersion, versionErr := localVersionFromFile()
+		if versionErr != nil {
+			return versionErr
+		}
+		buildinfo.SetFallbackVersion(fileVersion)
+		localVersion = fileVersion
 	}
 
-	// verify all the optional values are correctly set to a default, if necessary
-	if newConfig.DeviceName == "" {
-		randInt := rand.Int()
-		newConfig.DeviceName = "device_" + strconv.Itoa(randInt)
-		logger.Lgr.LogMessage("Successfully generated new device name: %v", newConfig.DeviceName)
-	}
+	newConfig.LocalVersion = localVersion
+	Cfg = newConfig
+	loadedPath = configPath
 
-	if newConfig.DeviceId == "" {
-		// if the DeviceId hasn't been set by the user - let's give them a nice UUID
-		uuid, err := uuid.NewV4()
-		if err != nil {
-			return err
+	// save a newly generated identity straight away so it stays the same
+	// even if the agent never shuts down cleanly
+	if generatedIdentity {
+		if saveErr := ToFile(); saveErr != nil {
+			return fmt.Errorf("Could not save the generated DeviceId %v: %v", Cfg.DeviceId, saveErr)
 		}
-		// update the UUID if it doesn't exist
-		newConfig.DeviceId = uuid.String()
-		logger.Lgr.LogMessage("Successfully generated new device GUID: %v", newConfig.DeviceId)
 	}
 
-	if newConfig.InitialStartup == "" {
-		newConfig.InitialStartup = "yes"
-	}
+	applyLogging(Cfg)
+	logger.SetAgentId(Cfg.DeviceId)
 
-	if newConfig.FirstRunAfterUpdate == "" {
-		newConfig.FirstRunAfterUpdate = "no"
-	}
+	logger.Lgr.LogMessagef("Successfully set local version to: %v", buildinfo.Version())
+	logger.Lgr.LogMessage("Config file was successfully loaded from file in its entirety and default values were set")
+	logger.Lgr.LogMessagef("Config:\n%+v", Cfg)
 
-	if newConfig.UpdateFrequencySeconds == 0 {
-		newConfig.UpdateFrequencySeconds = 3600
-	}
+	events.Publish(events.ConfigChanged{Path: configPath, Action: "loaded"})
 
-	if newConfig.RemoteUpdateURI == "" {
-		newConfig.RemoteUpdateURI = "https://github.com/seantcanavan/anon-eth-net.git"
-	}
+	return nil
+}
 
-	if newConfig.RemoteVersionURI == "" {
-		newConfig.RemoteVersionURI = "https://raw.githubusercontent.com/seantcanavan/anon-eth-net/master/src/github.com/seantcanavan/assets/version.no"
-	}
+// Apply will merge the given JSON object of config values over the current
+// config, save it, and load it back in so defaults and validation are applied
+// exactly as they are on startup. The previous config is restored if the
+// result doesn't load. Returns ErrConfigInvalid when the overrides aren't
+// valid.
+func Apply(overrides []byte) error {
 
-	// load the local version number from the local asset
-	localVersionAsset, assetErr := utils.AssetPath("version.no")
-	if assetErr != nil {
-		return assetErr
+	previous := Cfg
+
+	currentBytes, marshalErr := json.Marshal(Cfg)
+	if marshalErr != nil {
+		return marshalErr
 	}
 
-	logger.Lgr.LogMessage("Successfully located local version asset: %v", localVersionAsset)
+	// start from a deep copy so a failed merge can't touch the current config
+	updated := &Config{}
+	if jsonErr := json.Unmarshal(currentBytes, updated); jsonErr != nil {
+		return jsonErr
+	}
 
-	bytes, err := ioutil.ReadFile(localVersionAsset)
-	if err != nil {
-		return err
+	if jsonErr := json.Unmarshal(overrides, updated); jsonErr != nil {
+		return invalidJSON(jsonErr)
 	}
 
-	logger.Lgr.LogMessage("Successfully read from local version asset: %v", localVersionAsset)
+	// unknown settings would be dropped without a trace when it's saved
+	unknown, unknownErr := unknownKeys("the pushed config", overrides, reflect.TypeOf(Config{}))
+	if unknownErr != nil {
+		return invalidJSON(unknownErr)
+	}
+	if len(unknown) > 0 && updated.StrictConfig {
+		return invalid(fmt.Errorf("The pushed config has unknown settings:\n%v", strings.Join(unknown, "\n")))
+	}
+	for _, description := range unknown {
+		logger.Lgr.LogErrorf("Ignoring %v", description)
+	}
 
-	s := string(bytes)
-	s = strings.Trim(s, "\n")
-	localVersion, castError := strconv.ParseUint(s, 10, 64)
-	if castError != nil {
-		return castError
+	Cfg = updated
+	if saveErr := ToFile(); saveErr != nil {
+		Cfg = previous
+		return saveErr
 	}
 
-	newConfig.LocalVersion = localVersion
-	Cfg = newConfig
+	if loadErr := FromFile(); loadErr != nil {
+		Cfg = previous
+		if restoreErr := ToFile(); restoreErr != nil {
+			logger.Lgr.LogErrorf("Could not restore the previous config after a failed update: %v", restoreErr)
+		}
+		return loadErr
+	}
 
-	logger.Lgr.LogMessage("Successfully set local version to: %v", newConfig.LocalVersion)
-	logger.Lgr.LogMessage("Config file was successfully loaded from file in its entirety and default values were set")
-	logger.Lgr.LogMessage("Config:\n%+v", Cfg)
+	// an include or overlay file wins over the pushed value on every load
+	var overridden map[string]json.RawMessage
+	json.Unmarshal(overrides, &overridden)
+	for field := range overridden {
+		if Layered(field) {
+			logger.Lgr.LogErrorf("The %v pushed is overridden by an include or %v file. Change it there instead", field, CONFIG_OVERLAY_DIR)
+		}
+	}
 
+	rememberPushed(overrides)
+	logger.Lgr.LogMessagef("Successfully applied config overrides: %v", string(overrides))
 	return nil
 }
 
 // ToFile will save the current instance of config to the local standard config
-// file which is located inside of the assets folder as 'config.json'. This will
-// help preserver changes to the configuration between settings.
+// file which is located inside of the assets folder as 'config.json', or to the
+// file given to FromPath when it was loaded from another. This will help
+// preserver changes to the configuration between settings.
 func ToFile() error {
 
-	configAssetPath, assetErr := utils.AssetPath("config.json")
-	if assetErr != nil {
-		return assetErr
+	configAssetPath := loadedPath
+	if configAssetPath == "" {
+		assetPath, assetErr := utils.AssetPath("config.json")
+		if assetErr != nil {
+			return assetErr
+		}
+		configAssetPath = assetPath
 	}
 
-	logger.Lgr.LogMessage("Successfully located config asset for writing: %v", configAssetPath)
+	logger.Lgr.LogMessagef("Successfully located config asset for writing: %v", configAssetPath)
 
 	bytes, marshalError := json.MarshalIndent(Cfg, "", "\t")
 	if marshalError != nil {
 		return marshalError
 	}
 
+	// leave the settings of the include and overlay files in them and the
+	// templates unexpanded
+	bytes, unlayerErr := unlayer(bytes)
+	if unlayerErr != nil {
+		return unlayerErr
+	}
+
 	logger.Lgr.LogMessage("Successfully marshaled the config to json")
 
 	writeError := ioutil.WriteFile(configAssetPath, bytes, 0644)
@@ -214,6 +802,180 @@ func ToFile() error {
 		return writeError
 	}
 
-	logger.Lgr.LogMessage("Successfully wrote the JSON bytes to the file: %v", configAssetPath)
+	logger.Lgr.LogMessagef("Successfully wrote the JSON bytes to the file: %v", configAssetPath)
+	events.Publish(events.ConfigChanged{Path: configAssetPath, Action: "saved"})
 	return nil
 }
+
+// Enabled returns whether the given subsystem should run. Subsystems which
+// aren't listed under Subsystems in the config run, as does everything before
+// the config has been loaded.
+func Enabled(subsystem string) bool {
+	return Cfg.Enabled(subsystem)
+}
+
+// Enabled returns whether the given subsystem should run according to this
+// config. Every subsystem runs when the config is nil.
+func (cfg *Config) Enabled(subsystem string) bool {
+
+	if cfg == nil {
+		return true
+	}
+
+	enabled, listed := cfg.Subsystems[subsystem]
+	return enabled || !listed
+}
+
+// knownSubsystem returns whether the given subsystem is one of SUBSYSTEMS.
+func knownSubsystem(subsystem string) bool {
+	for _, known := range SUBSYSTEMS {
+		if known == subsystem {
+			return true
+		}
+	}
+	return false
+}
+
+// knownApprovalAction returns whether the given action is one of
+// APPROVAL_ACTIONS.
+func knownApprovalAction(action string) bool {
+	for _, known := range APPROVAL_ACTIONS {
+		if action == known {
+			return true
+		}
+	}
+	return false
+}
+
+// invalid returns the given validation error as an ErrConfigInvalid naming the
+// given fields.
+func invalid(err error, fields ...string) error {
+	return ErrConfigInvalid{Fields: fields, Err: err}
+}
+
+// invalidJSON returns the given error from unmarshalling the config as an
+// ErrConfigInvalid naming the field which held the wrong type of value.
+func invalidJSON(jsonErr error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(jsonErr, &typeErr) && typeErr.Field != "" {
+		return invalid(jsonErr, typeErr.Field)
+	}
+	return invalid(jsonErr)
+}
+
+// knownRetentionClass returns whether the given class of data is one of
+// RETENTION_CLASSES.
+func knownRetentionClass(class string) bool {
+	for _, known := range RETENTION_CLASSES {
+		if class == known {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseWindow returns the start and end of the given HH:MM-HH:MM time of day
+// window as minutes past midnight. The end is before the start when the window
+// spans midnight.
+func ParseWindow(window string) (int, int, error) {
+
+	bounds := strings.Split(window, "-")
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("A window needs a start and an end separated by a dash")
+	}
+
+	var minutes [2]int
+	for index, bound := range bounds {
+		parsed, parseErr := time.Parse("15:04", strings.TrimSpace(bound))
+		if parseErr != nil {
+			return 0, 0, parseErr
+		}
+		minutes[index] = parsed.Hour()*60 + parsed.Minute()
+	}
+
+	if minutes[0] == minutes[1] {
+		return 0, 0, fmt.Errorf("A window can't start and end at the same time")
+	}
+
+	return minutes[0], minutes[1], nil
+}
+
+// InWindow returns whether the given time of day falls within the given
+// HH:MM-HH:MM window, which is checked when the config is loaded.
+func InWindow(window string, now time.Time) bool {
+
+	start, end, parseErr := ParseWindow(window)
+	if parseErr != nil {
+		return false
+	}
+
+	minute := now.Hour()*60 + now.Minute()
+	if start < end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// secretValues returns the value of every string field of the given config
+// whose name marks it as a secret, such as CommandSecret or EtherscanAPIKey,
+// and the Token of every notifier. Hashes of secrets aren't secret themselves
+// and are left out.
+func secretValues(cfg *Config) []string {
+
+	var values []string
+
+	fields := reflect.ValueOf(cfg).Elem()
+	for index := 0; index < fields.NumField(); index++ {
+		name := strings.ToLower(fields.Type().Field(index).Name)
+		if strings.Contains(name, "hash") || !containsAny(name, secretFieldWords) {
+			continue
+		}
+
+		switch field := fields.Field(index); field.Kind() {
+		case reflect.String:
+			values = append(values, field.String())
+		case reflect.Slice:
+			if secrets, isStrings := field.Interface().([]string); isStrings {
+				values = append(values, secrets...)
+			}
+		}
+	}
+
+	// e.g. a Telegram bot token, which is part of the URL it's sent to
+	for _, notifier := range cfg.Notifiers {
+		values = append(values, notifier.Token)
+	}
+
+	return values
+}
+
+// containsAny returns whether the given text contains any of the given words.
+func containsAny(text string, words []string) bool {
+	for _, word := range words {
+		if strings.Contains(text, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// localVersionFromFile returns the version number held in the version.no
+// asset.
+func localVersionFromFile() (uint64, error) {
+
+	localVersionAsset, assetErr := utils.AssetPath("version.no")
+	if assetErr != nil {
+		return 0, assetErr
+	}
+
+	logger.Lgr.LogMessagef("Successfully located local version asset: %v", localVersionAsset)
+
+	bytes, err := ioutil.ReadFile(localVersionAsset)
+	if err != nil {
+		return 0, err
+	}
+
+	logger.Lgr.LogMessagef("Successfully read from local version asset: %v", localVersionAsset)
+
+	return buildinfo.ParseVersion(localVersionAsset, bytes)
+}
@@ -1,11 +1,18 @@
 package config
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/utils"
 )
 
 func TestMain(m *testing.M) {
@@ -71,7 +78,464 @@ func TestConfigFromFilePass(t *testing.T) {
 		t.Errorf("Cfg.RemoteUpdateURI did not unmarshal correctly: %v", Cfg.RemoteUpdateURI)
 	}
 
-	if Cfg.RemoteVersionURI != "https://raw.githubusercontent.com/seantcanavan/anon-eth-net/master/src/github.com/seantcanavan/assets/version.no" {
+	if Cfg.StatusReportTime != "08:00" {
+		t.Errorf("Cfg.StatusReportTime did not default correctly: %v", Cfg.StatusReportTime)
+	}
+
+	if len(Cfg.StatusReportRecipients) != 1 || Cfg.StatusReportRecipients[0] != Cfg.CheckInGmailAddress {
+		t.Errorf("Cfg.StatusReportRecipients did not default correctly: %v", Cfg.StatusReportRecipients)
+	}
+
+	if Cfg.RemoteVersionURI.Primary() != "https://raw.githubusercontent.com/seantcanavan/anon-eth-net/master/src/github.com/seantcanavan/assets/version.no" {
 		t.Errorf("Cfg.RemoteVersionURI did not unmarshal correctly: %v", Cfg.RemoteVersionURI)
 	}
 }
+
+func TestApply(t *testing.T) {
+
+	configAssetPath, assetErr := utils.AssetPath("config.json")
+	if assetErr != nil {
+		t.Fatal(assetErr)
+	}
+
+	original, readErr := ioutil.ReadFile(configAssetPath)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	defer func() {
+		ioutil.WriteFile(configAssetPath, original, 0644)
+		FromFile()
+	}()
+
+	if applyErr := Apply([]byte(`{"CheckInFrequencySeconds": 60}`)); applyErr != nil {
+		t.Fatal(applyErr)
+	}
+
+	if Cfg.CheckInFrequencySeconds != 60 || Cfg.CheckInGmailAddress == "" {
+		t.Errorf("expected only CheckInFrequencySeconds to change, got: %+v", Cfg)
+	}
+
+	applyErr := Apply([]byte(`{"FleetServerURL": "https://fleet.example.com", "FleetSecret": ""}`))
+	var invalidErr ErrConfigInvalid
+	if !errors.As(applyErr, &invalidErr) || strings.Join(invalidErr.Fields, " ") != "FleetSecret FleetRegistrationToken" {
+		t.Errorf("expected an invalid config push to be refused naming the missing fields, got: %#v", applyErr)
+	}
+
+	if len(Cfg.FleetServerURL) != 0 || Cfg.CheckInFrequencySeconds != 60 {
+		t.Errorf("expected the previous config to be restored, got: %+v", Cfg)
+	}
+
+	if applyErr := Apply([]byte(`{"ProxyURL": "http://127.0.0.1:8080"}`)); applyErr == nil {
+		t.Errorf("expected a non SOCKS5 proxy to be refused")
+	}
+
+	// the secret still in use stays masked when a push changing it is refused
+	if applyErr := Apply([]byte(`{"CommandSecret": "applied-command-secret"}`)); applyErr != nil {
+		t.Fatal(applyErr)
+	}
+	if applyErr := Apply([]byte(`{"CommandSecret": "rejected-command-secret", "ProxyURL": "http://127.0.0.1:8080"}`)); applyErr == nil {
+		t.Errorf("expected a non SOCKS5 proxy to be refused")
+	}
+	if redacted := logger.Redact("applied-command-secret"); strings.Contains(redacted, "applied-command-secret") {
+		t.Errorf("expected the secret in use to stay masked, got: %v", redacted)
+	}
+
+	// a push refused by a later check leaves the logger alone
+	logDir := logger.LogDir()
+	refusedDir, tempErr := ioutil.TempDir("", "config_refused_logs")
+	if tempErr != nil {
+		t.Fatal(tempErr)
+	}
+	defer os.RemoveAll(refusedDir)
+	refused, _ := json.Marshal(map[string]string{"LogDir": refusedDir, "ProxyURL": "http://127.0.0.1:8080"})
+	if applyErr := Apply(refused); applyErr == nil {
+		t.Errorf("expected a non SOCKS5 proxy to be refused")
+	}
+	if logger.LogDir() != logDir {
+		t.Errorf("expected the log directory to stay %v, got: %v", logDir, logger.LogDir())
+	}
+
+	if !Enabled(SUBSYSTEM_UPDATER) || !Enabled(SUBSYSTEM_REST) {
+		t.Errorf("expected subsystems which aren't listed to be enabled")
+	}
+
+	if applyErr := Apply([]byte(`{"Subsystems": {"rest": false, "loader": false, "updater": true}}`)); applyErr != nil {
+		t.Fatal(applyErr)
+	}
+
+	if Enabled(SUBSYSTEM_REST) || Enabled(SUBSYSTEM_LOADER) || !Enabled(SUBSYSTEM_UPDATER) || !Enabled(SUBSYSTEM_PROFILER) {
+		t.Errorf("expected only rest and the loader to be turned off, got: %v", Cfg.Subsystems)
+	}
+
+	if applyErr := Apply([]byte(`{"Subsystems": {"miner": false}}`)); applyErr == nil {
+		t.Errorf("expected an unknown subsystem to be refused")
+	}
+
+	applyErr = Apply([]byte(`{"CheckInFrequencySeconds": "often"}`))
+	if !errors.As(applyErr, &invalidErr) || strings.Join(invalidErr.Fields, " ") != "CheckInFrequencySeconds" {
+		t.Errorf("expected a value of the wrong type to be refused naming its field, got: %#v", applyErr)
+	}
+}
+
+func TestLayers(t *testing.T) {
+
+	configAssetPath, assetErr := utils.AssetPath("config.json")
+	if assetErr != nil {
+		t.Fatal(assetErr)
+	}
+	configDir := filepath.Dir(configAssetPath)
+	overlayDir := filepath.Join(configDir, CONFIG_OVERLAY_DIR)
+	includePath := filepath.Join(configDir, "config_layers_test.json")
+
+	original, readErr := ioutil.ReadFile(configAssetPath)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if _, statErr := os.Stat(overlayDir); !os.IsNotExist(statErr) {
+		t.Skipf("%v already exists", overlayDir)
+	}
+	defer func() {
+		os.RemoveAll(overlayDir)
+		os.Remove(includePath)
+		ioutil.WriteFile(configAssetPath, original, 0644)
+		FromFile()
+	}()
+
+	if writeErr := ioutil.WriteFile(includePath, []byte(`{"DeviceName": "from the include", "CheckInFrequencySeconds": 120, "Subsystems": {"rest": false}}`), 0644); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	if mkdirErr := os.Mkdir(overlayDir, 0755); mkdirErr != nil {
+		t.Fatal(mkdirErr)
+	}
+	overlays := map[string]string{
+		"10-site.json":    `{"DeviceName": "from the first overlay", "Subsystems": {"loader": false}}`,
+		"20-machine.json": `{"DeviceName": "from the last overlay"}`,
+	}
+	for name, contents := range overlays {
+		if writeErr := ioutil.WriteFile(filepath.Join(overlayDir, name), []byte(contents), 0644); writeErr != nil {
+			t.Fatal(writeErr)
+		}
+	}
+
+	if applyErr := Apply([]byte(`{"Include": ["config_layers_test.json"]}`)); applyErr != nil {
+		t.Fatal(applyErr)
+	}
+
+	if Cfg.DeviceName != "from the last overlay" || Cfg.CheckInFrequencySeconds != 120 {
+		t.Errorf("expected the include and overlays to be merged in order, got: %v and %v", Cfg.DeviceName, Cfg.CheckInFrequencySeconds)
+	}
+	if Enabled(SUBSYSTEM_REST) || Enabled(SUBSYSTEM_LOADER) || !Enabled(SUBSYSTEM_UPDATER) {
+		t.Errorf("expected the layered objects to be merged key by key, got: %v", Cfg.Subsystems)
+	}
+
+	// the layered settings stay out of the config.json asset
+	var saved Config
+	savedBytes, readErr := ioutil.ReadFile(configAssetPath)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if jsonErr := json.Unmarshal(savedBytes, &saved); jsonErr != nil {
+		t.Fatal(jsonErr)
+	}
+	if saved.DeviceName != "My Little Raspberry Pi" || saved.CheckInFrequencySeconds != 3600 || len(saved.Subsystems) != 0 || len(saved.Include) != 1 {
+		t.Errorf("expected only the Include to be saved, got: %v, %v, %v and %v", saved.DeviceName, saved.CheckInFrequencySeconds, saved.Subsystems, saved.Include)
+	}
+
+	if writeErr := ioutil.WriteFile(filepath.Join(overlayDir, "30-nested.json"), []byte(`{"Include": ["other.json"]}`), 0644); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	layerErr := FromFile()
+	var invalidErr ErrConfigInvalid
+	if !errors.As(layerErr, &invalidErr) || strings.Join(invalidErr.Fields, " ") != "Include" {
+		t.Errorf("expected a layer including another file to be refused, got: %v", layerErr)
+	}
+}
+
+func TestUnknownKeys(t *testing.T) {
+
+	data := []byte(`{
+	"CheckInFrequencySecond": 60,
+	"checkinfrequencyseconds": 60,
+	"Notifiers": [{"Name": "ops", "Typ": "slack"}],
+	"Subsystems": {"rest": false},
+	"SomethingElseEntirely": true
+}`)
+
+	unknown, unknownErr := unknownKeys("config.json", data, reflect.TypeOf(Config{}))
+	if unknownErr != nil {
+		t.Fatal(unknownErr)
+	}
+
+	expected := []string{
+		`config.json:2:2: unknown setting "CheckInFrequencySecond", did you mean "CheckInFrequencySeconds"?`,
+		`config.json:4:32: unknown setting "Notifiers.0.Typ", did you mean "Notifiers.0.Type"?`,
+		`config.json:6:2: unknown setting "SomethingElseEntirely"`,
+	}
+	if strings.Join(unknown, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected the unknown settings with their positions, got:\n%v", strings.Join(unknown, "\n"))
+	}
+
+	configAssetPath, assetErr := utils.AssetPath("config.json")
+	if assetErr != nil {
+		t.Fatal(assetErr)
+	}
+	original, readErr := ioutil.ReadFile(configAssetPath)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	defer func() {
+		ioutil.WriteFile(configAssetPath, original, 0644)
+		FromFile()
+	}()
+
+	if applyErr := Apply([]byte(`{"CheckInFrequencySecond": 60}`)); applyErr != nil {
+		t.Errorf("expected an unknown setting to be ignored without StrictConfig, got: %v", applyErr)
+	}
+
+	if applyErr := Apply([]byte(`{"StrictConfig": true, "CheckInFrequencySecond": 60}`)); applyErr == nil || !strings.Contains(applyErr.Error(), "CheckInFrequencySeconds") {
+		t.Errorf("expected an unknown setting to be refused with StrictConfig, got: %v", applyErr)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+
+	configAssetPath, assetErr := utils.AssetPath("config.json")
+	if assetErr != nil {
+		t.Fatal(assetErr)
+	}
+	original, readErr := ioutil.ReadFile(configAssetPath)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	defer func() {
+		ioutil.WriteFile(configAssetPath, original, 0644)
+		FromFile()
+	}()
+
+	os.Setenv("CONFIG_TEST_SITE", "farm-1")
+	defer os.Unsetenv("CONFIG_TEST_SITE")
+	hostname, _ := os.Hostname()
+
+	template := `{"DeviceName": "rig-{{hostname}}", "FleetSite": "{{env \"CONFIG_TEST_SITE\"}}", "ProfitCurrency": "{{env \"CONFIG_TEST_UNSET\" | default \"eur\"}}"}`
+	if applyErr := Apply([]byte(template)); applyErr != nil {
+		t.Fatal(applyErr)
+	}
+
+	if Cfg.DeviceName != "rig-"+hostname || Cfg.FleetSite != "farm-1" || Cfg.ProfitCurrency != "eur" {
+		t.Errorf("expected the templates to be expanded, got: %v, %v and %v", Cfg.DeviceName, Cfg.FleetSite, Cfg.ProfitCurrency)
+	}
+
+	// the templates are saved rather than what they expanded to
+	savedBytes, readErr := ioutil.ReadFile(configAssetPath)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if !strings.Contains(string(savedBytes), "rig-{{hostname}}") || !strings.Contains(string(savedBytes), `{{env \"CONFIG_TEST_SITE\"}}`) {
+		t.Errorf("expected the templates to be saved, got: %s", savedBytes)
+	}
+
+	applyErr := Apply([]byte(`{"DeviceName": "{{hostname"}`))
+	var invalidErr ErrConfigInvalid
+	if !errors.As(applyErr, &invalidErr) || strings.Join(invalidErr.Fields, " ") != "DeviceName" {
+		t.Errorf("expected a broken template to be refused naming its setting, got: %v", applyErr)
+	}
+}
+
+func TestProvenances(t *testing.T) {
+
+	configAssetPath, assetErr := utils.AssetPath("config.json")
+	if assetErr != nil {
+		t.Fatal(assetErr)
+	}
+	overlayDir := filepath.Join(filepath.Dir(configAssetPath), CONFIG_OVERLAY_DIR)
+	overlayPath := filepath.Join(overlayDir, "10-site.json")
+
+	original, readErr := ioutil.ReadFile(configAssetPath)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if _, statErr := os.Stat(overlayDir); !os.IsNotExist(statErr) {
+		t.Skipf("%v already exists", overlayDir)
+	}
+	defer func() {
+		os.RemoveAll(overlayDir)
+		ioutil.WriteFile(configAssetPath, original, 0644)
+		FromFile()
+	}()
+
+	if mkdirErr := os.Mkdir(overlayDir, 0755); mkdirErr != nil {
+		t.Fatal(mkdirErr)
+	}
+	if writeErr := ioutil.WriteFile(overlayPath, []byte(`{"DeviceName": "from the overlay"}`), 0644); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+
+	if applyErr := Apply([]byte(`{"FleetSite": "pushed", "ProfitCurrency": "{{env \"CONFIG_TEST_UNSET\" | default \"eur\"}}"}`)); applyErr != nil {
+		t.Fatal(applyErr)
+	}
+	// a pushed template only counts as remote until it's loaded again
+	pushedValues = make(map[string]json.RawMessage)
+	if applyErr := Apply([]byte(`{"FleetSite": "pushed"}`)); applyErr != nil {
+		t.Fatal(applyErr)
+	}
+
+	// Apply saves every setting so leave one to its default
+	var saved map[string]json.RawMessage
+	savedBytes, readErr := ioutil.ReadFile(configAssetPath)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if jsonErr := json.Unmarshal(savedBytes, &saved); jsonErr != nil {
+		t.Fatal(jsonErr)
+	}
+	delete(saved, "LogMinFreeMB")
+	savedBytes, _ = json.Marshal(saved)
+	if writeErr := ioutil.WriteFile(configAssetPath, savedBytes, 0644); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	if loadErr := FromFile(); loadErr != nil {
+		t.Fatal(loadErr)
+	}
+
+	provenances, provenanceErr := Provenances()
+	if provenanceErr != nil {
+		t.Fatal(provenanceErr)
+	}
+
+	expected := map[string]Provenance{
+		"DeviceName":              {Source: SOURCE_LAYER, File: overlayPath},
+		"FleetSite":               {Source: SOURCE_REMOTE},
+		"ProfitCurrency":          {Source: SOURCE_TEMPLATE, File: configAssetPath},
+		"CheckInFrequencySeconds": {Source: SOURCE_FILE, File: configAssetPath},
+		"LogMinFreeMB":            {Source: SOURCE_DEFAULT},
+	}
+	for field, provenance := range expected {
+		if provenances[field] != provenance {
+			t.Errorf("expected the %v to come from %+v, got: %+v", field, provenance, provenances[field])
+		}
+	}
+}
+
+func TestMachineDefaults(t *testing.T) {
+
+	fingerprint := MachineFingerprint()
+	if len(fingerprint) != 64 || MachineFingerprint() != fingerprint {
+		t.Errorf("expected a stable sha256 fingerprint, got: %v", fingerprint)
+	}
+
+	offset := MachineOffset(10000)
+	if offset < 0 || offset >= 10000 || MachineOffset(10000) != offset {
+		t.Errorf("expected a stable offset within the span, got: %v", offset)
+	}
+
+	first, firstErr := machineDeviceId()
+	second, secondErr := machineDeviceId()
+	if firstErr != nil || secondErr != nil || first != second || len(first) != 36 {
+		t.Errorf("expected a stable UUID, got: %v %v %v %v", first, firstErr, second, secondErr)
+	}
+
+	configAssetPath, assetErr := utils.AssetPath("config.json")
+	if assetErr != nil {
+		t.Fatal(assetErr)
+	}
+	original, readErr := ioutil.ReadFile(configAssetPath)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	defer func() {
+		ioutil.WriteFile(configAssetPath, original, 0644)
+		FromFile()
+	}()
+
+	dataDir, tempErr := ioutil.TempDir("", "config_data_dir")
+	if tempErr != nil {
+		t.Fatal(tempErr)
+	}
+	defer os.RemoveAll(dataDir)
+	dataDir = filepath.Join(dataDir, "nested")
+
+	overrides, _ := json.Marshal(map[string]string{"DataDir": dataDir, "StateFile": "", "LogDir": ""})
+	if applyErr := Apply(overrides); applyErr != nil {
+		t.Fatal(applyErr)
+	}
+
+	if Cfg.StateFile != filepath.Join(dataDir, "agent_state.json") || Cfg.LogDir != filepath.Join(dataDir, MACHINE_LOG_DIR_NAME) {
+		t.Errorf("expected the StateFile and LogDir to default to within the DataDir, got: %v and %v", Cfg.StateFile, Cfg.LogDir)
+	}
+	if _, statErr := os.Stat(dataDir); statErr != nil {
+		t.Errorf("expected the DataDir to be created: %v", statErr)
+	}
+
+	// the directory the privileged helper created for the agent
+	helperDir := filepath.Join(filepath.Dir(dataDir), "helper")
+	os.Setenv(DATA_DIR_VARIABLE, helperDir)
+	defer os.Unsetenv(DATA_DIR_VARIABLE)
+
+	overrides, _ = json.Marshal(map[string]string{"DataDir": "", "StateFile": "", "LogDir": "", "LockFile": ""})
+	if applyErr := Apply(overrides); applyErr != nil {
+		t.Fatal(applyErr)
+	}
+
+	if Cfg.DataDir != helperDir || Cfg.LockFile != filepath.Join(helperDir, "anon-eth-net.lock") {
+		t.Errorf("expected the DataDir to default to the one the privileged helper created, got: %v and %v", Cfg.DataDir, Cfg.LockFile)
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+
+	var single struct{ URL Endpoints }
+	if jsonErr := json.Unmarshal([]byte(`{"URL": "https://one.example.com"}`), &single); jsonErr != nil || len(single.URL) != 1 || single.URL.Primary() != "https://one.example.com" {
+		t.Errorf("expected a single string to be one endpoint, got: %v %v", single.URL, jsonErr)
+	}
+
+	var list struct{ URL Endpoints }
+	if jsonErr := json.Unmarshal([]byte(`{"URL": ["https://one.example.com", "https://two.example.com"]}`), &list); jsonErr != nil || len(list.URL) != 2 || list.URL[1] != "https://two.example.com" {
+		t.Errorf("expected a list to be every endpoint, got: %v %v", list.URL, jsonErr)
+	}
+
+	var empty struct{ URL Endpoints }
+	if jsonErr := json.Unmarshal([]byte(`{"URL": ""}`), &empty); jsonErr != nil || len(empty.URL) != 0 {
+		t.Errorf("expected an empty string to be no endpoints, got: %v %v", empty.URL, jsonErr)
+	}
+
+	singleBytes, _ := json.Marshal(single)
+	listBytes, _ := json.Marshal(list)
+	if string(singleBytes) != `{"URL":"https://one.example.com"}` || string(listBytes) != `{"URL":["https://one.example.com","https://two.example.com"]}` {
+		t.Errorf("expected endpoints to marshal the way they were written, got: %s %s", singleBytes, listBytes)
+	}
+}
+
+func TestByteSize(t *testing.T) {
+
+	var sizes struct{ Human, Plain, Odd ByteSize }
+	if jsonErr := json.Unmarshal([]byte(`{"Human": "1.5GiB", "Plain": 104857600, "Odd": 1000}`), &sizes); jsonErr != nil || sizes.Human != 1536*1024*1024 || sizes.Plain != 100*1024*1024 || sizes.Odd != 1000 {
+		t.Errorf("expected both numbers and human sizes to be read, got: %+v %v", sizes, jsonErr)
+	}
+
+	var invalid struct{ Size ByteSize }
+	if jsonErr := json.Unmarshal([]byte(`{"Size": "10 parsecs"}`), &invalid); jsonErr == nil {
+		t.Error("expected a size without a known unit to be refused")
+	}
+
+	sizeBytes, _ := json.Marshal(sizes)
+	if string(sizeBytes) != `{"Human":"1536MB","Plain":"100MB","Odd":1000}` {
+		t.Errorf("expected whole sizes to be saved as human sizes, got: %s", sizeBytes)
+	}
+}
+
+func TestSecretValues(t *testing.T) {
+
+	cfg := &Config{
+		CommandSecret:   "command-secret",
+		EtherscanAPIKey: "etherscan-key",
+		RestTokenHashes: []string{"not-a-secret"},
+		DeviceName:      "not-a-secret-either",
+		Notifiers:       []NotifierConfig{{Name: "telegram", Type: "telegram", Token: "123456:bot-token"}},
+	}
+
+	values := secretValues(cfg)
+	joined := fmt.Sprint(values)
+	if !strings.Contains(joined, "command-secret") || !strings.Contains(joined, "etherscan-key") || !strings.Contains(joined, "123456:bot-token") || strings.Contains(joined, "not-a-secret") {
+		t.Errorf("expected only the secrets, got: %v", values)
+	}
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"encoding/json"
+)
+
+// Endpoints is a list of URLs which all serve the same purpose, tried in turn
+// until one of them works. In config.json it can be written as a single
+// string, as older configs are, or as a list of strings.
+type Endpoints []string
+
+// UnmarshalJSON will accept either a single string or a list of strings. An
+// empty string is no endpoints at all.
+func (e *Endpoints) UnmarshalJSON(data []byte) error {
+
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*e = nil
+		if single != "" {
+			*e = Endpoints{single}
+		}
+		return nil
+	}
+
+	var list []string
+	if jsonErr := json.Unmarshal(data, &list); jsonErr != nil {
+		return jsonErr
+	}
+
+	*e = Endpoints(list)
+	return nil
+}
+
+// MarshalJSON will write a single endpoint as a plain string so configs
+// which don't use failover look the same as they always have.
+func (e Endpoints) MarshalJSON() ([]byte, error) {
+
+	if len(e) == 0 {
+		return json.Marshal("")
+	}
+
+	if len(e) == 1 {
+		return json.Marshal(e[0])
+	}
+
+	return json.Marshal([]string(e))
+}
+
+// Primary returns the first endpoint, or an empty string when there are none.
+func (e Endpoints) Primary() string {
+
+	if len(e) == 0 {
+		return ""
+	}
+
+	return e[0]
+}
@@ -0,0 +1,171 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+// The directory next to the config.json asset whose .json files are merged
+// over it, in lexical order, after the files it includes
+const CONFIG_OVERLAY_DIR = "config.d"
+
+// the value of every top level setting an include or overlay file set, as
+// merged over the config.json asset by the last FromFile, and the value the
+// config.json asset itself had for them
+var layeredValues = make(map[string]json.RawMessage)
+var baseValues = make(map[string]json.RawMessage)
+
+// mergeLayers will merge every file the given config.json asset contents
+// include, followed by every .json file of CONFIG_OVERLAY_DIR in lexical
+// order, over the given config, so machine specific settings such as the
+// wallet or site can be layered over a base config shared by a whole fleet.
+// Each file only needs the settings it changes. Settings holding an object
+// are merged key by key and any other setting is replaced. Includes are
+// relative to the config.json asset and can't include other files. Returns a
+// description of every unknown setting in the files.
+func mergeLayers(newConfig *Config, configAssetPath string, baseBytes []byte) ([]string, error) {
+
+	layeredValues = make(map[string]json.RawMessage)
+	baseValues = make(map[string]json.RawMessage)
+	layerSources = make(map[string]string)
+	baseFile = configAssetPath
+	if jsonErr := json.Unmarshal(baseBytes, &baseValues); jsonErr != nil {
+		return nil, invalidJSON(jsonErr)
+	}
+
+	configDir := filepath.Dir(configAssetPath)
+
+	var layerFiles []string
+	for _, include := range newConfig.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(configDir, include)
+		}
+		layerFiles = append(layerFiles, include)
+	}
+
+	// Glob sorts the overlays lexically
+	overlays, _ := filepath.Glob(filepath.Join(configDir, CONFIG_OVERLAY_DIR, "*.json"))
+	layerFiles = append(layerFiles, overlays...)
+
+	if len(layerFiles) == 0 {
+		return nil, nil
+	}
+
+	includes := newConfig.Include
+	layered := make(map[string]bool)
+	var unknown []string
+
+	for _, layerFile := range layerFiles {
+
+		layerBytes, readErr := ioutil.ReadFile(layerFile)
+		if readErr != nil {
+			return nil, invalid(fmt.Errorf("Could not read the config layer %v: %v. Please correct the Include in the config.json asset and restart.", layerFile, readErr), "Include")
+		}
+
+		var fields map[string]json.RawMessage
+		if jsonErr := json.Unmarshal(layerBytes, &fields); jsonErr != nil {
+			return nil, invalid(fmt.Errorf("The config layer %v isn't a JSON object: %v. Please correct it and restart.", layerFile, jsonErr))
+		}
+		if _, nested := fields["Include"]; nested {
+			return nil, invalid(fmt.Errorf("The config layer %v can't include other files. Please move its Include to the config.json asset and restart.", layerFile), "Include")
+		}
+
+		expanded, expandErr := expandTemplates(layerFile, layerBytes)
+		if expandErr != nil {
+			return nil, expandErr
+		}
+
+		if jsonErr := json.Unmarshal(expanded, newConfig); jsonErr != nil {
+			return nil, invalidJSON(fmt.Errorf("The config layer %v: %w", layerFile, jsonErr))
+		}
+
+		layerUnknown, unknownErr := unknownKeys(layerFile, layerBytes, reflect.TypeOf(Config{}))
+		if unknownErr != nil {
+			return nil, invalidJSON(unknownErr)
+		}
+		unknown = append(unknown, layerUnknown...)
+
+		for field := range fields {
+			layered[field] = true
+			layerSources[field] = layerFile
+		}
+		logger.Lgr.LogMessagef("Successfully merged config layer: %v", layerFile)
+	}
+	newConfig.Include = includes
+
+	// hold on to the merged value of every layered setting so ToFile can tell
+	// which ones to leave out of the config.json asset
+	mergedBytes, marshalErr := json.Marshal(newConfig)
+	if marshalErr != nil {
+		return nil, marshalErr
+	}
+	var merged map[string]json.RawMessage
+	if jsonErr := json.Unmarshal(mergedBytes, &merged); jsonErr != nil {
+		return nil, jsonErr
+	}
+	for field := range layered {
+		layeredValues[field] = merged[field]
+	}
+
+	return unknown, nil
+}
+
+// unlayer returns the given config.json asset contents with every setting
+// which still has the value an include or overlay file gave it put back to
+// the value the config.json asset had, and every setting which still has the
+// value its template expanded to put back to the template, so saving the
+// config never copies the layers or the facts of this machine into it.
+// Settings changed since are saved as they are.
+func unlayer(configBytes []byte) ([]byte, error) {
+
+	if len(layeredValues) == 0 && len(templatedValues) == 0 {
+		return configBytes, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if jsonErr := json.Unmarshal(configBytes, &fields); jsonErr != nil {
+		return nil, jsonErr
+	}
+
+	for field, layeredValue := range layeredValues {
+		if !sameJSON(fields[field], layeredValue) {
+			continue
+		}
+		if baseValue, inBase := baseValues[field]; inBase {
+			fields[field] = baseValue
+		} else {
+			delete(fields, field)
+		}
+	}
+
+	for field, expandedValue := range expandedValues {
+		if sameJSON(fields[field], expandedValue) {
+			fields[field] = templatedValues[field]
+		}
+	}
+
+	return json.MarshalIndent(fields, "", "\t")
+}
+
+// Layered returns whether the given top level setting was set by an include
+// or overlay file, which wins over the config.json asset on every load.
+func Layered(field string) bool {
+	_, layered := layeredValues[field]
+	return layered
+}
+
+// sameJSON returns whether the two JSON values are equal, however they're
+// formatted.
+func sameJSON(first json.RawMessage, second json.RawMessage) bool {
+
+	var firstValue, secondValue interface{}
+	if json.Unmarshal(first, &firstValue) != nil || json.Unmarshal(second, &secondValue) != nil {
+		return false
+	}
+	return reflect.DeepEqual(firstValue, secondValue)
+}
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The name of the directory the agent keeps its data in within the data
+// directory of the OS
+const MACHINE_DATA_DIR_NAME = "anon-eth-net"
+
+// The directory within the DataDir log files default to
+const MACHINE_LOG_DIR_NAME = "logs"
+
+// The environment variable the privileged helper sets to the directory it
+// created for the agent, which the DataDir defaults to when it's set
+const DATA_DIR_VARIABLE = "ANON_ETH_NET_DATA_DIR"
+
+// The files which hold the id of a linux machine, in the order they're tried
+var machineIdFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+// Finds the id of a mac in the output of ioreg or a windows machine in the output of reg
+var platformUUIDPattern = regexp.MustCompile(`"IOPlatformUUID" = "([^"]+)"`)
+var machineGuidPattern = regexp.MustCompile(`MachineGuid\s+REG_SZ\s+(\S+)`)
+
+var fingerprint string
+var fingerprintOnce sync.Once
+
+// MachineFingerprint returns a hex digest which is the same every time the
+// agent runs on this machine and differs from one machine to the next. It's
+// derived from the id the OS gives the machine or, when there isn't one, from
+// its hostname and network hardware addresses.
+func MachineFingerprint() string {
+
+	fingerprintOnce.Do(func() {
+		digest := sha256.Sum256([]byte(MACHINE_DATA_DIR_NAME + ":" + machineId()))
+		fingerprint = hex.EncodeToString(digest[:])
+	})
+
+	return fingerprint
+}
+
+// MachineOffset returns a number from 0 up to but not including the given
+// span derived from the MachineFingerprint, e.g. to pick a port which stays
+// the same across restarts without every machine on a network picking the
+// same one.
+func MachineOffset(span int) int {
+
+	if span <= 0 {
+		return 0
+	}
+
+	digest, _ := hex.DecodeString(MachineFingerprint())
+	return int(binary.BigEndian.Uint64(digest[:8]) % uint64(span))
+}
+
+// machineDeviceId returns the DeviceId of this machine, a UUID derived from
+// the MachineFingerprint so it's the same if the agent is set up again from
+// scratch.
+func machineDeviceId() (string, error) {
+	return utils.NameUUID(MachineFingerprint())
+}
+
+// machineDataDir returns where the agent keeps its data when the working
+// directory can't be written to, e.g. when it's run from a read only install:
+// /var/lib/anon-eth-net on linux, /Library/Application Support/anon-eth-net
+// on mac and %ProgramData%\anon-eth-net on windows, or within the home
+// directory of the user when they aren't root.
+func machineDataDir() string {
+
+	if runtime.GOOS == "windows" {
+		if programData := os.Getenv("ProgramData"); programData != "" {
+			return filepath.Join(programData, MACHINE_DATA_DIR_NAME)
+		}
+	}
+
+	if os.Geteuid() == 0 {
+		if runtime.GOOS == "darwin" {
+			return filepath.Join("/Library/Application Support", MACHINE_DATA_DIR_NAME)
+		}
+		return filepath.Join("/var/lib", MACHINE_DATA_DIR_NAME)
+	}
+
+	if stateHome := os.Getenv("XDG_STATE_HOME"); stateHome != "" && runtime.GOOS != "darwin" {
+		return filepath.Join(stateHome, MACHINE_DATA_DIR_NAME)
+	}
+
+	if configDir, configErr := os.UserConfigDir(); configErr == nil && runtime.GOOS != "linux" {
+		return filepath.Join(configDir, MACHINE_DATA_DIR_NAME)
+	}
+
+	home, homeErr := os.UserHomeDir()
+	if homeErr != nil {
+		return filepath.Join(os.TempDir(), MACHINE_DATA_DIR_NAME)
+	}
+	return filepath.Join(home, ".local", "state", MACHINE_DATA_DIR_NAME)
+}
+
+// workingDirWritable returns whether a file can be created in the working
+// directory.
+func workingDirWritable() bool {
+
+	probe, createErr := ioutil.TempFile(".", ".write_probe")
+	if createErr != nil {
+		return false
+	}
+
+	probe.Close()
+	os.Remove(probe.Name())
+	return true
+}
+
+// machineId returns the id the OS gives this machine, or its hostname and
+// network hardware addresses when it doesn't have one.
+func machineId() string {
+
+	switch runtime.GOOS {
+	case "darwin":
+		if output, ioregErr := exec.Command("ioreg", "-rd1", "-c", "IOPlatformExpertDevice").Output(); ioregErr == nil {
+			if match := platformUUIDPattern.FindSubmatch(output); match != nil {
+				return string(match[1])
+			}
+		}
+	case "windows":
+		if output, regErr := exec.Command("reg", "query", `HKLM\SOFTWARE\Microsoft\Cryptography`, "/v", "MachineGuid").Output(); regErr == nil {
+			if match := machineGuidPattern.FindSubmatch(output); match != nil {
+				return string(match[1])
+			}
+		}
+	default:
+		for _, idFile := range machineIdFiles {
+			if id, readErr := ioutil.ReadFile(idFile); readErr == nil && len(strings.TrimSpace(string(id))) > 0 {
+				return strings.TrimSpace(string(id))
+			}
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	parts := []string{hostname}
+
+	interfaces, _ := net.Interfaces()
+	var addresses []string
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback == 0 && len(iface.HardwareAddr) > 0 {
+			addresses = append(addresses, iface.HardwareAddr.String())
+		}
+	}
+	sort.Strings(addresses)
+
+	return strings.Join(append(parts, addresses...), ",")
+}
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// Where the value of a setting came from, from the weakest to the strongest
+const (
+	SOURCE_DEFAULT     = "default"     // Not set anywhere, or set to a value the config.json asset left to the default
+	SOURCE_FILE        = "file"        // The config.json asset
+	SOURCE_TEMPLATE    = "template"    // A template in the config.json asset expanded from the environment or host
+	SOURCE_REMOTE      = "remote"      // Pushed via Apply since the agent started, e.g. by the fleet server or a REST token rotation
+	SOURCE_LAYER       = "layer"       // An include or CONFIG_OVERLAY_DIR file
+	SOURCE_CREDENTIALS = "credentials" // The emaillogin.conf asset
+)
+
+// Provenance is where the value of a single setting came from.
+type Provenance struct {
+	Source string `json:"source"`         // One of the SOURCE_ constants
+	File   string `json:"file,omitempty"` // The file the value was read from, when there is one
+}
+
+// the config.json asset and the file each layered setting was last merged
+// from, the path of the emaillogin.conf asset when the last FromFile read it,
+// and the value of every setting pushed via Apply once it was applied
+var baseFile = ""
+var layerSources = make(map[string]string)
+var credentialsFile = ""
+var pushedValues = make(map[string]json.RawMessage)
+
+// Provenances returns where the current value of every top level setting came
+// from, by its name in the config.json asset, so it's clear which of the
+// layers won when a setting doesn't have the value expected. A setting which
+// was changed since, e.g. an included value which was pushed over, is
+// attributed to whatever changed it.
+func Provenances() (map[string]Provenance, error) {
+
+	currentBytes, marshalErr := json.Marshal(Cfg)
+	if marshalErr != nil {
+		return nil, marshalErr
+	}
+	var current map[string]json.RawMessage
+	if jsonErr := json.Unmarshal(currentBytes, &current); jsonErr != nil {
+		return nil, jsonErr
+	}
+
+	_, known := jsonFields(reflect.TypeOf(Config{}))
+	provenances := make(map[string]Provenance)
+
+	for _, field := range known {
+
+		value := current[field]
+
+		switch {
+		case credentialsFile != "" && (field == "CheckInGmailAddress" || field == "CheckInGmailPassword"):
+			provenances[field] = Provenance{Source: SOURCE_CREDENTIALS, File: credentialsFile}
+		case layerSources[field] != "" && sameJSON(layeredValues[field], value):
+			provenances[field] = Provenance{Source: SOURCE_LAYER, File: layerSources[field]}
+		case pushedValues[field] != nil && sameJSON(pushedValues[field], value):
+			provenances[field] = Provenance{Source: SOURCE_REMOTE}
+		case expandedValues[field] != nil && sameJSON(normalized(field, expandedValues[field]), value):
+			provenances[field] = Provenance{Source: SOURCE_TEMPLATE, File: baseFile}
+		case baseValues[field] != nil && sameJSON(normalized(field, baseValues[field]), value):
+			provenances[field] = Provenance{Source: SOURCE_FILE, File: baseFile}
+		default:
+			provenances[field] = Provenance{Source: SOURCE_DEFAULT}
+		}
+	}
+
+	return provenances, nil
+}
+
+// normalized returns the given value of the given setting as it's saved, e.g.
+// a single RemoteVersionURI as a list, so it can be compared with the current
+// value.
+func normalized(field string, value json.RawMessage) json.RawMessage {
+
+	wrapped, marshalErr := json.Marshal(map[string]json.RawMessage{field: value})
+	if marshalErr != nil {
+		return value
+	}
+
+	single := &Config{}
+	if json.Unmarshal(wrapped, single) != nil {
+		return value
+	}
+
+	singleBytes, marshalErr := json.Marshal(single)
+	if marshalErr != nil {
+		return value
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(singleBytes, &fields) != nil {
+		return value
+	}
+	return fields[field]
+}
+
+// rememberPushed will hold on to the current value of every setting named in
+// the given overrides which were just applied via Apply.
+func rememberPushed(overrides []byte) {
+
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(overrides, &fields) != nil {
+		return
+	}
+
+	currentBytes, marshalErr := json.Marshal(Cfg)
+	if marshalErr != nil {
+		return
+	}
+	var current map[string]json.RawMessage
+	if json.Unmarshal(currentBytes, &current) != nil {
+		return
+	}
+
+	_, known := jsonFields(reflect.TypeOf(Config{}))
+	for field := range fields {
+		// unmarshalling ignores case so the pushed name may not be spelled
+		// the way it's saved
+		for _, name := range known {
+			if strings.EqualFold(name, field) {
+				pushedValues[name] = current[name]
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// ByteSize is a number of bytes. In config.json it can be written as a plain
+// number of bytes, as older configs are, or as a human readable size such as
+// "100MB" or "1.5GiB". See utils.ParseSize for the units.
+type ByteSize int64
+
+// UnmarshalJSON will accept either a number of bytes or a human readable size.
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+
+	var human string
+	if json.Unmarshal(data, &human) == nil {
+		bytes, parseErr := utils.ParseSize(human)
+		if parseErr != nil {
+			return parseErr
+		}
+		*b = ByteSize(bytes)
+		return nil
+	}
+
+	var bytes int64
+	if jsonErr := json.Unmarshal(data, &bytes); jsonErr != nil {
+		return jsonErr
+	}
+
+	*b = ByteSize(bytes)
+	return nil
+}
+
+// MarshalJSON will write a size which is a whole number of KB or more as a
+// human readable size, so a size given as "10GB" is saved the way it was
+// given, and any other size as a plain number of bytes.
+func (b ByteSize) MarshalJSON() ([]byte, error) {
+
+	formatted := utils.FormatSize(int64(b))
+	if formatted == strconv.FormatInt(int64(b), 10) {
+		return json.Marshal(int64(b))
+	}
+
+	return json.Marshal(formatted)
+}
+
+// String returns the size with its unit, e.g. "1.5 GB".
+func (b ByteSize) String() string {
+	return utils.FormatBytes(int64(b))
+}
@@ -0,0 +1,141 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"runtime"
+	"strings"
+	"text/template"
+)
+
+// What marks a string setting as a template
+const TEMPLATE_OPENER = "{{"
+
+// The functions config templates can call, e.g. {{env "HOME"}}, {{hostname}}
+// or {{env "WALLET" | default "0x..."}}
+var templateFuncs = template.FuncMap{
+	"env":      os.Getenv,
+	"hostname": os.Hostname,
+	"os":       func() string { return runtime.GOOS },
+	"arch":     func() string { return runtime.GOARCH },
+	"cpus":     runtime.NumCPU,
+	"user": func() (string, error) {
+		current, userErr := user.Current()
+		if userErr != nil {
+			return "", userErr
+		}
+		return current.Username, nil
+	},
+	"default": func(fallback string, value string) string {
+		if value == "" {
+			return fallback
+		}
+		return value
+	},
+}
+
+// the value the config.json asset had for every top level setting holding a
+// template, and the value it was expanded to by the last FromFile
+var templatedValues = make(map[string]json.RawMessage)
+var expandedValues = make(map[string]json.RawMessage)
+
+// expandTemplates returns the given JSON with every string value holding
+// TEMPLATE_OPENER, at any depth, expanded as a text/template with
+// templateFuncs, so one config can be given to machines which differ, e.g.
+// "DeviceName": "rig-{{hostname}}". Only strings are expanded. The given name
+// of the file is used in errors.
+func expandTemplates(fileName string, data []byte) ([]byte, error) {
+
+	if !bytes.Contains(data, []byte(TEMPLATE_OPENER)) {
+		return data, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var fields map[string]interface{}
+	if jsonErr := decoder.Decode(&fields); jsonErr != nil {
+		return nil, invalidJSON(jsonErr)
+	}
+
+	for field, value := range fields {
+		expanded, expandErr := expandValue(value)
+		if expandErr != nil {
+			return nil, invalid(fmt.Errorf("Could not expand the template of the %v in %v: %v. Please correct it and restart.", field, fileName, expandErr), field)
+		}
+		fields[field] = expanded
+	}
+
+	return json.Marshal(fields)
+}
+
+// ExpandTemplates returns the given JSON object with every string holding a
+// template expanded the same way the config.json asset's are, so other
+// assets such as the loader asset can use the same templates. The given name
+// of the file is used in errors.
+func ExpandTemplates(fileName string, data []byte) ([]byte, error) {
+	return expandTemplates(fileName, data)
+}
+
+// expandValue returns the given decoded JSON value with every string within
+// it holding TEMPLATE_OPENER expanded.
+func expandValue(value interface{}) (interface{}, error) {
+
+	switch typed := value.(type) {
+	case string:
+		if !strings.Contains(typed, TEMPLATE_OPENER) {
+			return typed, nil
+		}
+		parsed, parseErr := template.New("setting").Funcs(templateFuncs).Parse(typed)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		var expanded strings.Builder
+		if executeErr := parsed.Execute(&expanded, nil); executeErr != nil {
+			return nil, executeErr
+		}
+		return expanded.String(), nil
+	case []interface{}:
+		for index, element := range typed {
+			expanded, expandErr := expandValue(element)
+			if expandErr != nil {
+				return nil, expandErr
+			}
+			typed[index] = expanded
+		}
+	case map[string]interface{}:
+		for key, element := range typed {
+			expanded, expandErr := expandValue(element)
+			if expandErr != nil {
+				return nil, expandErr
+			}
+			typed[key] = expanded
+		}
+	}
+
+	return value, nil
+}
+
+// rememberTemplates will hold on to the template and expanded value of every
+// top level setting of the config.json asset which holds a template, so
+// ToFile saves the template rather than what it expanded to on this machine.
+func rememberTemplates(raw []byte, expanded []byte) {
+
+	templatedValues = make(map[string]json.RawMessage)
+	expandedValues = make(map[string]json.RawMessage)
+
+	var rawFields, expandedFields map[string]json.RawMessage
+	if json.Unmarshal(raw, &rawFields) != nil || json.Unmarshal(expanded, &expandedFields) != nil {
+		return
+	}
+
+	for field, rawValue := range rawFields {
+		if !sameJSON(rawValue, expandedFields[field]) {
+			templatedValues[field] = rawValue
+			expandedValues[field] = expandedFields[field]
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Unknown settings within this many edits of a known one are reported along
+// with the one which was probably meant
+const MAX_SUGGESTION_EDITS = 3
+
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// unknownKeys returns a description of every key in the given JSON, at any
+// depth, which doesn't name a setting of the given type and would otherwise
+// be silently ignored, e.g. config.json:4:2: unknown setting
+// "CheckInFrequencySecond", did you mean "CheckInFrequencySeconds"? Keys are
+// matched ignoring case as they are when unmarshalling. The given name of the
+// file is used in front of each position.
+func unknownKeys(fileName string, data []byte, typ reflect.Type) ([]string, error) {
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+
+	var unknown []string
+	if walkErr := walkKeys(decoder, typ, "", func(path string, key string, offset int64, known []string) {
+		line, column := position(data, offset)
+		description := fmt.Sprintf("%v:%d:%d: unknown setting %q", fileName, line, column, path+key)
+		if suggestion := closest(key, known); suggestion != "" {
+			description += fmt.Sprintf(", did you mean %q?", path+suggestion)
+		}
+		unknown = append(unknown, description)
+	}); walkErr != nil {
+		return nil, walkErr
+	}
+
+	return unknown, nil
+}
+
+// walkKeys will read the next value from the given decoder, calling found for
+// every key of an object unmarshalled into a struct which doesn't name one of
+// its fields. A nil type skips the value.
+func walkKeys(decoder *json.Decoder, typ reflect.Type, path string, found func(path string, key string, offset int64, known []string)) error {
+
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	// types which unmarshal themselves can hold anything
+	if typ != nil && reflect.PtrTo(typ).Implements(unmarshalerType) {
+		typ = nil
+	}
+
+	token, tokenErr := decoder.Token()
+	if tokenErr != nil {
+		return tokenErr
+	}
+
+	delim, isDelim := token.(json.Delim)
+	if !isDelim {
+		return nil
+	}
+
+	switch delim {
+	case '[':
+		var elem reflect.Type
+		if typ != nil && (typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array) {
+			elem = typ.Elem()
+		}
+		for index := 0; decoder.More(); index++ {
+			if walkErr := walkKeys(decoder, elem, path+strconv.Itoa(index)+".", found); walkErr != nil {
+				return walkErr
+			}
+		}
+	case '{':
+		var fields map[string]reflect.Type
+		var known []string
+		if typ != nil && typ.Kind() == reflect.Struct {
+			fields, known = jsonFields(typ)
+		}
+		for decoder.More() {
+			keyToken, keyErr := decoder.Token()
+			if keyErr != nil {
+				return keyErr
+			}
+			key, _ := keyToken.(string)
+
+			var valueType reflect.Type
+			switch {
+			case typ != nil && typ.Kind() == reflect.Map:
+				valueType = typ.Elem()
+			case fields != nil:
+				fieldType, isField := fields[strings.ToLower(key)]
+				if !isField {
+					found(path, key, decoder.InputOffset()-int64(len(strconv.Quote(key))), known)
+				}
+				valueType = fieldType
+			}
+
+			if walkErr := walkKeys(decoder, valueType, path+key+".", found); walkErr != nil {
+				return walkErr
+			}
+		}
+	}
+
+	// the closing delimiter
+	_, closeErr := decoder.Token()
+	return closeErr
+}
+
+// jsonFields returns the type of every field of the given struct by its JSON
+// key in lower case, including those of embedded structs, along with the keys
+// as they're spelled.
+func jsonFields(typ reflect.Type) (map[string]reflect.Type, []string) {
+
+	fields := make(map[string]reflect.Type)
+	var known []string
+
+	for index := 0; index < typ.NumField(); index++ {
+		field := typ.Field(index)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			embedded, embeddedKnown := jsonFields(field.Type)
+			for key, fieldType := range embedded {
+				fields[key] = fieldType
+			}
+			known = append(known, embeddedKnown...)
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[strings.ToLower(name)] = field.Type
+		known = append(known, name)
+	}
+
+	return fields, known
+}
+
+// position returns the line and column, both from 1, of the given byte offset
+// of data.
+func position(data []byte, offset int64) (int, int) {
+
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// closest returns the known key the given one is the fewest edits away from,
+// ignoring case, or an empty string when none are within
+// MAX_SUGGESTION_EDITS.
+func closest(key string, known []string) string {
+
+	suggestion := ""
+	fewest := MAX_SUGGESTION_EDITS + 1
+	for _, candidate := range known {
+		if edits := editDistance(strings.ToLower(key), strings.ToLower(candidate)); edits < fewest {
+			suggestion, fewest = candidate, edits
+		}
+	}
+	return suggestion
+}
+
+// editDistance returns the number of single character insertions, deletions
+// and substitutions which turn first into second.
+func editDistance(first string, second string) int {
+
+	previous := make([]int, len(second)+1)
+	current := make([]int, len(second)+1)
+	for index := range previous {
+		previous[index] = index
+	}
+
+	for i := 1; i <= len(first); i++ {
+		current[0] = i
+		for j := 1; j <= len(second); j++ {
+			substitution := previous[j-1]
+			if first[i-1] != second[j-1] {
+				substitution++
+			}
+			current[j] = minInt(substitution, minInt(previous[j]+1, current[j-1]+1))
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(second)]
+}
+
+// minInt returns the smaller of the two.
+func minInt(first int, second int) int {
+	if first < second {
+		return first
+	}
+	return second
+}
@@ -0,0 +1,669 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+// generateIdentity will give the given config a DeviceName and a DeviceId when
+// it doesn't have them yet. Returns whether it did.
+func generateIdentity(newConfig *Config) (bool, error) {
+
+	generatedIdentity := false
+
+	if newConfig.DeviceName == "" {
+		randInt := rand.Int()
+		newConfig.DeviceName = "device_" + strconv.Itoa(randInt)
+		generatedIdentity = true
+		logger.Lgr.LogMessagef("Successfully generated new device name: %v", newConfig.DeviceName)
+	}
+
+	if newConfig.DeviceId == "" {
+		// if the DeviceId hasn't been set by the user - let's give them a nice
+		// UUID which stays the same if this machine is set up again
+		deviceId, err := machineDeviceId()
+		if err != nil {
+			return false, err
+		}
+		// update the UUID if it doesn't exist
+		newConfig.DeviceId = deviceId
+		generatedIdentity = true
+		logger.Lgr.LogMessagef("Successfully generated new device GUID: %v", newConfig.DeviceId)
+	}
+
+	return generatedIdentity, nil
+}
+
+// validateDataDir will pick the DataDir when it isn't set and create it. The
+// files the agent keeps default to within it, so it's validated first.
+func validateDataDir(newConfig *Config) error {
+
+	// keep the data in the directory the privileged helper created for it
+	if newConfig.DataDir == "" && os.Getenv(DATA_DIR_VARIABLE) != "" {
+		newConfig.DataDir = os.Getenv(DATA_DIR_VARIABLE)
+		logger.Lgr.LogMessagef("Successfully picked the DataDir the privileged helper created: %v", newConfig.DataDir)
+	}
+
+	// keep the data somewhere of its own when it can't be kept in the working
+	// directory, e.g. when the agent is installed read only
+	if newConfig.DataDir == "" && !workingDirWritable() {
+		newConfig.DataDir = machineDataDir()
+		logger.Lgr.LogMessagef("Successfully picked a DataDir for this machine: %v", newConfig.DataDir)
+	}
+	if newConfig.DataDir != "" {
+		if mkdirErr := os.MkdirAll(newConfig.DataDir, 0700); mkdirErr != nil {
+			return invalid(fmt.Errorf("Could not create the DataDir %v: %v. Please correct the DataDir in the config.json asset and restart.", newConfig.DataDir, mkdirErr), "DataDir")
+		}
+		if newConfig.LogDir == "" {
+			newConfig.LogDir = filepath.Join(newConfig.DataDir, MACHINE_LOG_DIR_NAME)
+		}
+	}
+
+	return nil
+}
+
+// validateLogging will check the logging settings of the given config and set
+// their defaults, without changing how anything is logged. See applyLogging.
+func validateLogging(newConfig *Config) error {
+
+	if redactErr := logger.CheckRedactPatterns(newConfig.LogRedactPatterns); redactErr != nil {
+		return invalid(fmt.Errorf("%v. Please correct the LogRedactPatterns in the config.json asset and restart.", redactErr), "LogRedactPatterns")
+	}
+
+	if rotationErr := logger.CheckRotation(newConfig.LogRotateSchedule, newConfig.LogFileDateLayout); rotationErr != nil {
+		return invalid(fmt.Errorf("%v. Please correct the LogRotateSchedule or LogFileDateLayout in the config.json asset and restart.", rotationErr), "LogRotateSchedule", "LogFileDateLayout")
+	}
+
+	if patternErr := logger.CheckFileNamePattern(newConfig.LogFileNamePattern); patternErr != nil {
+		return invalid(fmt.Errorf("%v. Please correct the LogFileNamePattern in the config.json asset and restart.", patternErr), "LogFileNamePattern")
+	}
+
+	if newConfig.LogDirMode == "" {
+		newConfig.LogDirMode = "0700"
+	}
+	logDirMode, modeErr := strconv.ParseUint(newConfig.LogDirMode, 8, 32)
+	if modeErr != nil || logDirMode > 0777 {
+		return invalid(fmt.Errorf("The LogDirMode %v isn't octal permissions such as 0700. Please correct the LogDirMode in the config.json asset and restart.", newConfig.LogDirMode), "LogDirMode")
+	}
+
+	if newConfig.LogMinFreeMB < 0 {
+		return invalid(fmt.Errorf("The LogMinFreeMB can't be negative. Please correct the LogMinFreeMB in the config.json asset and restart."), "LogMinFreeMB")
+	}
+	if newConfig.LogMinFreeMB == 0 {
+		newConfig.LogMinFreeMB = 100
+	}
+
+	if newConfig.LogFlushLevel == "" {
+		newConfig.LogFlushLevel = logger.INFO_LEVEL
+	}
+	if newConfig.LogFlushSeconds < 0 {
+		return invalid(fmt.Errorf("The LogFlushSeconds can't be negative. Please correct the LogFlushSeconds in the config.json asset and restart."), "LogFlushSeconds")
+	}
+	if newConfig.LogFlushSeconds == 0 {
+		newConfig.LogFlushSeconds = logger.DEFAULT_FLUSH_SECONDS
+	}
+	if flushErr := logger.CheckFlushLevel(newConfig.LogFlushLevel); flushErr != nil {
+		return invalid(fmt.Errorf("%v. Please correct the LogFlushLevel in the config.json asset and restart.", flushErr), "LogFlushLevel")
+	}
+
+	if samplingErr := logger.CheckSampling(newConfig.LogSampling); samplingErr != nil {
+		return invalid(fmt.Errorf("%v. Please correct the LogSampling in the config.json asset and restart.", samplingErr), "LogSampling")
+	}
+
+	if dirErr := logger.CheckLogDir(newConfig.LogDir, os.FileMode(logDirMode), uint64(newConfig.LogMinFreeMB)*1024*1024); dirErr != nil {
+		return invalid(fmt.Errorf("%v. Please correct the LogDir in the config.json asset and restart.", dirErr), "LogDir")
+	}
+
+	return nil
+}
+
+// validateCheckIn will check the settings of the email check ins, the status
+// reports and the email commands and set their defaults.
+func validateCheckIn(newConfig *Config) error {
+
+	// verify all the required values are correctly setup by the user
+	if newConfig.CheckInGmailAddress == "" {
+		return invalid(errors.New("Cannot use empty gmail address when starting up. Please update the config.json asset with an appropriate value and restart."), "CheckInGmailAddress")
+	}
+
+	if newConfig.CheckInGmailPassword == "" {
+		return invalid(errors.New("Cannot use empty email password when starting up. Please update the config.json asset with an appropriate value and restart."), "CheckInGmailPassword")
+	}
+
+	if newConfig.CheckInFrequencySeconds == 0 {
+		return invalid(errors.New("Cannot use an empty or zero value for check in frequency . Please update the config.json asset with an appropriate value and restart."), "CheckInFrequencySeconds")
+	}
+
+	if newConfig.NetQueryFrequencySeconds == 0 {
+		return invalid(errors.New("Cannot use an empty or zero value for internet query frequency. Please update the config.json asset with an appropriate value and restart."), "NetQueryFrequencySeconds")
+	}
+
+	if newConfig.StatusReportTime == "" {
+		newConfig.StatusReportTime = "08:00"
+	}
+
+	if _, timeErr := time.Parse("15:04", newConfig.StatusReportTime); timeErr != nil {
+		return invalid(fmt.Errorf("Cannot use status report time %v. Please use the 24 hour HH:MM format in the config.json asset and restart.", newConfig.StatusReportTime), "StatusReportTime")
+	}
+
+	if len(newConfig.StatusReportRecipients) == 0 {
+		newConfig.StatusReportRecipients = []string{newConfig.CheckInGmailAddress}
+	}
+
+	if newConfig.DigestIntervalSeconds == 0 {
+		newConfig.DigestIntervalSeconds = 3600
+	}
+
+	if newConfig.CommandIMAPServer != "" && newConfig.CommandSecret == "" {
+		return invalid(fmt.Errorf("Cannot accept email commands from %v without a CommandSecret. Please set one in the config.json asset and restart.", newConfig.CommandIMAPServer), "CommandSecret")
+	}
+
+	if len(newConfig.CommandAllowedSenders) == 0 {
+		newConfig.CommandAllowedSenders = []string{newConfig.CheckInGmailAddress}
+	}
+
+	if newConfig.CommandPollSeconds == 0 {
+		newConfig.CommandPollSeconds = 300
+	}
+
+	return nil
+}
+
+// validateFleet will check the settings which reach the fleet server and the
+// MQTT broker and set their defaults.
+func validateFleet(newConfig *Config) error {
+
+	// a FleetRegistrationToken stands in for the FleetSecret until the agent
+	// has enrolled and been given its own
+	enrollable := newConfig.FleetSecret != "" || newConfig.FleetRegistrationToken != ""
+
+	if newConfig.FleetRegistrationToken != "" && len(newConfig.FleetEnrollURL) == 0 {
+		return invalid(fmt.Errorf("Cannot enroll with a FleetRegistrationToken without a FleetEnrollURL. Please set one in the config.json asset and restart."), "FleetEnrollURL")
+	}
+
+	if len(newConfig.FleetServerURL) > 0 && !enrollable {
+		return invalid(fmt.Errorf("Cannot check in with %v without a FleetSecret or a FleetRegistrationToken. Please set one in the config.json asset and restart.", newConfig.FleetServerURL.Primary()), "FleetSecret", "FleetRegistrationToken")
+	}
+
+	if len(newConfig.FleetUpdatePermitURL) > 0 && !enrollable {
+		return invalid(fmt.Errorf("Cannot ask %v for permission to update without a FleetSecret or a FleetRegistrationToken. Please set one in the config.json asset and restart.", newConfig.FleetUpdatePermitURL.Primary()), "FleetSecret", "FleetRegistrationToken")
+	}
+
+	if newConfig.FleetChannelURL != "" && !enrollable {
+		return invalid(fmt.Errorf("Cannot open a command channel to %v without a FleetSecret or a FleetRegistrationToken. Please set one in the config.json asset and restart.", newConfig.FleetChannelURL), "FleetSecret", "FleetRegistrationToken")
+	}
+
+	if newConfig.MQTTBrokerURL != "" {
+		brokerURL, parseErr := url.Parse(newConfig.MQTTBrokerURL)
+		if parseErr != nil || (brokerURL.Scheme != "mqtt" && brokerURL.Scheme != "mqtts") || brokerURL.Host == "" {
+			return invalid(fmt.Errorf("MQTTBrokerURL must be an mqtt://host:port or mqtts://host:port URL. Please fix it in the config.json asset and restart."), "MQTTBrokerURL")
+		}
+		if !enrollable {
+			return invalid(fmt.Errorf("Cannot accept MQTT commands from %v without a FleetSecret or a FleetRegistrationToken. Please set one in the config.json asset and restart.", brokerURL.Host), "FleetSecret", "FleetRegistrationToken")
+		}
+	}
+
+	if newConfig.FleetCheckInSeconds == 0 {
+		newConfig.FleetCheckInSeconds = 300
+	}
+
+	if newConfig.FleetPermitWaitMinutes == 0 {
+		newConfig.FleetPermitWaitMinutes = 60
+	}
+
+	if newConfig.MQTTTopicPrefix == "" {
+		newConfig.MQTTTopicPrefix = "anon-eth-net/" + newConfig.DeviceId
+	}
+
+	if newConfig.MQTTPublishSeconds == 0 {
+		newConfig.MQTTPublishSeconds = 60
+	}
+
+	return nil
+}
+
+// validateNetwork will check the proxy, TLS pins and the services the network
+// is checked with and set their defaults.
+func validateNetwork(newConfig *Config) error {
+
+	if newConfig.ProxyURL != "" {
+		proxyURL, parseErr := url.Parse(newConfig.ProxyURL)
+		if parseErr != nil || (proxyURL.Scheme != "socks5" && proxyURL.Scheme != "socks5h") || proxyURL.Host == "" {
+			return invalid(fmt.Errorf("ProxyURL %v must be a socks5://host:port URL. Please fix it in the config.json asset and restart.", newConfig.ProxyURL), "ProxyURL")
+		}
+	}
+
+	pins := make(map[string][]string)
+	for host, hostPins := range newConfig.TLSPins {
+		for _, pin := range hostPins {
+			hash, decodeErr := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+			if decodeErr != nil || len(hash) != sha256.Size {
+				return invalid(fmt.Errorf("The TLSPins of %v must each be sha256/ followed by the base64 SHA-256 hash of a public key, not %v. Please fix them in the config.json asset and restart.", host, pin), "TLSPins")
+			}
+			pins[strings.ToLower(host)] = append(pins[strings.ToLower(host)], "sha256/"+base64.StdEncoding.EncodeToString(hash))
+		}
+	}
+	newConfig.TLSPins = pins
+
+	if len(newConfig.PublicIPServices) == 0 {
+		newConfig.PublicIPServices = []string{"https://api.ipify.org", "https://icanhazip.com", "https://ifconfig.me/ip"}
+	}
+
+	if newConfig.PublicIPCheckSeconds == 0 {
+		newConfig.PublicIPCheckSeconds = 900
+	}
+
+	if len(newConfig.TimeSources) == 0 {
+		newConfig.TimeSources = []string{"ntp://pool.ntp.org", "ntp://time.google.com", "https://www.google.com"}
+	}
+
+	if newConfig.TimeSyncSeconds == 0 {
+		newConfig.TimeSyncSeconds = 3600
+	}
+
+	if newConfig.MaxClockSkewSeconds <= 0 {
+		newConfig.MaxClockSkewSeconds = 60
+	}
+
+	if newConfig.DiscoveryIntervalSeconds == 0 {
+		newConfig.DiscoveryIntervalSeconds = 60
+	}
+
+	if newConfig.EndpointSelection == "" {
+		newConfig.EndpointSelection = "order"
+	}
+
+	if newConfig.EndpointSelection != "order" && newConfig.EndpointSelection != "latency" {
+		return invalid(fmt.Errorf("Cannot use endpoint selection %v. Please use order or latency in the config.json asset and restart.", newConfig.EndpointSelection), "EndpointSelection")
+	}
+
+	return nil
+}
+
+// validateRest will check the settings of the REST server, its tokens,
+// approvals, exec and files and set their defaults.
+func validateRest(newConfig *Config) error {
+
+	if newConfig.RestMaxAuthFailures == 0 {
+		newConfig.RestMaxAuthFailures = 5
+	}
+
+	if newConfig.RestLockoutSeconds == 0 {
+		newConfig.RestLockoutSeconds = 900
+	}
+
+	for _, token := range newConfig.RestTokens {
+		if token.Expires == "" {
+			continue
+		}
+		if _, parseErr := time.Parse(time.RFC3339, token.Expires); parseErr != nil {
+			return invalid(fmt.Errorf("The REST token %v expires at %v which isn't an RFC3339 time such as 2030-01-31T00:00:00Z. Please correct it in the config.json asset and restart.", token.Name, token.Expires), "RestTokens")
+		}
+	}
+
+	if newConfig.RestTokenLifetimeDays <= 0 {
+		newConfig.RestTokenLifetimeDays = 90
+	}
+
+	if newConfig.RestTokenOverlapMinutes <= 0 {
+		newConfig.RestTokenOverlapMinutes = 60
+	}
+
+	if newConfig.RestTokenWarnDays <= 0 {
+		newConfig.RestTokenWarnDays = 14
+	}
+
+	for _, action := range newConfig.ApprovalActions {
+		if !knownApprovalAction(action) {
+			return invalid(fmt.Errorf("Cannot require approval for unknown action %v. Please use %v in the ApprovalActions in the config.json asset and restart.", action, strings.Join(APPROVAL_ACTIONS, ", ")), "ApprovalActions")
+		}
+	}
+
+	if newConfig.ApprovalTimeoutMinutes <= 0 {
+		newConfig.ApprovalTimeoutMinutes = 60
+	}
+
+	if newConfig.RestACMECacheDir == "" {
+		newConfig.RestACMECacheDir = filepath.Join(newConfig.DataDir, "acme_cache")
+	}
+
+	if newConfig.RestRateLimitPerSecond == 0 {
+		newConfig.RestRateLimitPerSecond = 10
+	}
+
+	if newConfig.RestRateLimitBurst == 0 {
+		newConfig.RestRateLimitBurst = 40
+	}
+
+	for _, allowed := range newConfig.ExecAllowlist {
+		if len(allowed) == 0 || allowed[0] == "" || allowed[0] == EXEC_ANY_ARGUMENTS {
+			return invalid(fmt.Errorf("Every entry of the ExecAllowlist must start with a command. Please correct the ExecAllowlist in the config.json asset and restart."), "ExecAllowlist")
+		}
+		for index, argument := range allowed {
+			if argument == EXEC_ANY_ARGUMENTS && index != len(allowed)-1 {
+				return invalid(fmt.Errorf("%q can only be the last argument of an ExecAllowlist entry: %q. Please correct the ExecAllowlist in the config.json asset and restart.", EXEC_ANY_ARGUMENTS, allowed), "ExecAllowlist")
+			}
+		}
+	}
+
+	if newConfig.ExecTimeoutSeconds == 0 {
+		newConfig.ExecTimeoutSeconds = 30
+	}
+
+	if newConfig.ExecMaxOutputBytes == 0 {
+		newConfig.ExecMaxOutputBytes = 65536
+	}
+
+	if newConfig.FileMaxBytes == 0 {
+		newConfig.FileMaxBytes = 104857600
+	}
+
+	if newConfig.AuditLogFile == "" {
+		newConfig.AuditLogFile = filepath.Join(newConfig.DataDir, "audit.jsonl")
+	}
+
+	if newConfig.OperationsDir == "" {
+		newConfig.OperationsDir = filepath.Join(newConfig.DataDir, "operations")
+	}
+
+	return nil
+}
+
+// validateRuntime will check the settings of the agent's own process, its
+// plugins and its subsystems and set their defaults.
+func validateRuntime(newConfig *Config) error {
+
+	if newConfig.MaxProcs < 0 || newConfig.GCPercent < 0 || newConfig.MemoryLimitMB < 0 || newConfig.CgroupCPUPercent < 0 {
+		return invalid(fmt.Errorf("MaxProcs, GCPercent, MemoryLimitMB and CgroupCPUPercent cannot be negative. Please fix them in the config.json asset and restart."), "MaxProcs", "GCPercent", "MemoryLimitMB", "CgroupCPUPercent")
+	}
+
+	if newConfig.StateFile == "" {
+		newConfig.StateFile = filepath.Join(newConfig.DataDir, "agent_state.json")
+	}
+
+	if newConfig.LockFile == "" {
+		newConfig.LockFile = filepath.Join(newConfig.DataDir, "anon-eth-net.lock")
+	}
+
+	if newConfig.RecycleHours < 0 {
+		return invalid(fmt.Errorf("RecycleHours cannot be negative. Please set it to zero to never recycle the agent in the config.json asset and restart."), "RecycleHours")
+	}
+
+	pluginNames := make(map[string]bool)
+	for _, plugin := range newConfig.Plugins {
+		if plugin.Name == "" || plugin.Command == "" {
+			return invalid(fmt.Errorf("Cannot use plugin %+v without both a Name and a Command. Please update the Plugins in the config.json asset and restart.", plugin), "Plugins")
+		}
+		if pluginNames[plugin.Name] {
+			return invalid(fmt.Errorf("Cannot use more than one plugin named %v. Please update the Plugins in the config.json asset and restart.", plugin.Name), "Plugins")
+		}
+		pluginNames[plugin.Name] = true
+	}
+
+	if newConfig.CrashReportDir == "" {
+		newConfig.CrashReportDir = filepath.Join(newConfig.DataDir, "crash_reports")
+	}
+
+	if newConfig.PrivilegedSocket == "" {
+		newConfig.PrivilegedSocket = "privileged.sock"
+	}
+
+	for subsystem := range newConfig.Subsystems {
+		if !knownSubsystem(subsystem) {
+			return invalid(fmt.Errorf("Cannot turn off unknown subsystem %v. Please use %v in the Subsystems in the config.json asset and restart.", subsystem, strings.Join(SUBSYSTEMS, ", ")), "Subsystems")
+		}
+	}
+
+	if newConfig.InitialStartup == "" {
+		newConfig.InitialStartup = "yes"
+	}
+
+	if newConfig.FirstRunAfterUpdate == "" {
+		newConfig.FirstRunAfterUpdate = "no"
+	}
+
+	return nil
+}
+
+// validateMining will check the settings of the wallets, pools, profit
+// estimates and the node and set their defaults.
+func validateMining(newConfig *Config) error {
+
+	for _, wallet := range newConfig.EthWallets {
+		if !ethAddressPattern.MatchString(wallet) {
+			return invalid(fmt.Errorf("Cannot monitor wallet %v. Please use addresses starting with 0x followed by 40 hex digits in the EthWallets in the config.json asset and restart.", wallet), "EthWallets")
+		}
+	}
+
+	if newConfig.EtherscanURL == "" {
+		newConfig.EtherscanURL = "https://api.etherscan.io/v2/api"
+	}
+
+	if newConfig.EthCheckSeconds <= 0 {
+		newConfig.EthCheckSeconds = 900
+	}
+
+	if newConfig.EthPayoutHours < 0 {
+		return invalid(fmt.Errorf("EthPayoutHours cannot be negative. Please set it to zero to never report overdue payouts in the config.json asset and restart."), "EthPayoutHours")
+	}
+
+	poolNames := make(map[string]bool)
+	for index := range newConfig.Pools {
+		pool := &newConfig.Pools[index]
+		if pool.Name == "" {
+			pool.Name = pool.Type
+		}
+		if pool.Type == "" || pool.Address == "" {
+			return invalid(fmt.Errorf("Cannot collect the stats of pool %+v without both a Type and an Address. Please update the Pools in the config.json asset and restart.", *pool), "Pools")
+		}
+		if poolNames[pool.Name] {
+			return invalid(fmt.Errorf("Cannot use more than one pool named %v. Please give each of the Pools its own Name in the config.json asset and restart.", pool.Name), "Pools")
+		}
+		poolNames[pool.Name] = true
+		if pool.Coin == "" {
+			pool.Coin = "eth"
+		}
+	}
+
+	if newConfig.PoolCheckSeconds <= 0 {
+		newConfig.PoolCheckSeconds = 600
+	}
+
+	if newConfig.ProfitCheckSeconds < 0 {
+		return invalid(fmt.Errorf("ProfitCheckSeconds cannot be negative. Please set it to zero to never estimate the daily profit in the config.json asset and restart."), "ProfitCheckSeconds")
+	}
+
+	if newConfig.ProfitCurrency == "" {
+		newConfig.ProfitCurrency = "usd"
+	}
+
+	if newConfig.PriceURL == "" {
+		newConfig.PriceURL = "https://api.coingecko.com/api/v3/simple/price?ids=ethereum&vs_currencies=%v"
+	}
+
+	if newConfig.BlockRewardEth <= 0 {
+		newConfig.BlockRewardEth = 2
+	}
+
+	if newConfig.PoolFeePercent < 0 || newConfig.PoolFeePercent >= 100 {
+		return invalid(fmt.Errorf("PoolFeePercent must be at least 0 and less than 100. Please correct it in the config.json asset and restart."), "PoolFeePercent")
+	}
+
+	if newConfig.PowerCostPerKWh < 0 || newConfig.PowerDrawWatts < 0 {
+		return invalid(fmt.Errorf("PowerCostPerKWh and PowerDrawWatts cannot be negative. Please correct them in the config.json asset and restart."), "PowerCostPerKWh", "PowerDrawWatts")
+	}
+
+	if newConfig.NodeCheckSeconds <= 0 {
+		newConfig.NodeCheckSeconds = 60
+	}
+
+	if newConfig.NodeMaxBehindBlocks <= 0 {
+		newConfig.NodeMaxBehindBlocks = 50
+	}
+
+	if newConfig.NodeMinPeers <= 0 {
+		newConfig.NodeMinPeers = 3
+	}
+
+	if newConfig.NodeStallMinutes <= 0 {
+		newConfig.NodeStallMinutes = 15
+	}
+
+	if newConfig.NodeMaxDataGB < 0 {
+		return invalid(fmt.Errorf("NodeMaxDataGB cannot be negative. Please set it to zero to never report the size of the NodeDataDir in the config.json asset and restart."), "NodeMaxDataGB")
+	}
+
+	if len(newConfig.NodePruneCommand) > 0 && (newConfig.NodeJob == "" || newConfig.NodeMaxDataGB == 0) {
+		return invalid(fmt.Errorf("The NodePruneCommand is only run when the NodeJob's NodeDataDir grows past NodeMaxDataGB. Please set all three in the config.json asset and restart."), "NodePruneCommand", "NodeJob", "NodeMaxDataGB")
+	}
+
+	return nil
+}
+
+// validateUpdates will check the settings of the updater and set their
+// defaults.
+func validateUpdates(newConfig *Config) error {
+
+	if newConfig.UpdateWindow != "" {
+		if _, _, windowErr := ParseWindow(newConfig.UpdateWindow); windowErr != nil {
+			return invalid(fmt.Errorf("Cannot use the UpdateWindow %v: %v. Please use the 24 hour HH:MM-HH:MM format in the config.json asset and restart.", newConfig.UpdateWindow, windowErr), "UpdateWindow")
+		}
+	}
+
+	if newConfig.UpdateFrequencySeconds == 0 {
+		newConfig.UpdateFrequencySeconds = 3600
+	}
+
+	if newConfig.RemoteUpdateURI == "" {
+		newConfig.RemoteUpdateURI = "https://github.com/seantcanavan/anon-eth-net.git"
+	}
+
+	if newConfig.UpdateQuarantineDir == "" {
+		newConfig.UpdateQuarantineDir = filepath.Join(newConfig.DataDir, "update_quarantine")
+	}
+
+	if newConfig.UpdateCacheDir == "" {
+		newConfig.UpdateCacheDir = filepath.Join(newConfig.DataDir, "update_cache")
+	}
+
+	if newConfig.UpdateScanTimeoutSeconds <= 0 {
+		newConfig.UpdateScanTimeoutSeconds = 300
+	}
+
+	if newConfig.UpdatePlatform != "" {
+		parts := strings.Split(newConfig.UpdatePlatform, "/")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return invalid(fmt.Errorf("The UpdatePlatform %q isn't a platform such as linux/amd64 or linux/arm64/musl. Please correct the UpdatePlatform in the config.json asset and restart.", newConfig.UpdatePlatform), "UpdatePlatform")
+		}
+	}
+
+	if newConfig.UpdateDownloadRate < 0 {
+		return invalid(fmt.Errorf("The UpdateDownloadRate can't be negative, got %v. Please correct the UpdateDownloadRate in the config.json asset and restart.", newConfig.UpdateDownloadRate), "UpdateDownloadRate")
+	}
+
+	if newConfig.UpdateDownloadWindow != "" {
+		if _, _, windowErr := ParseWindow(newConfig.UpdateDownloadWindow); windowErr != nil {
+			return invalid(fmt.Errorf("Cannot use the UpdateDownloadWindow %v: %v. Please use the 24 hour HH:MM-HH:MM format in the config.json asset and restart.", newConfig.UpdateDownloadWindow, windowErr), "UpdateDownloadWindow")
+		}
+	}
+
+	if len(newConfig.UpdateTUFURI) > 0 && newConfig.UpdateTUFRootFile == "" {
+		return invalid(fmt.Errorf("The UpdateTUFURI needs the UpdateTUFRootFile to be trusted. Please correct the UpdateTUFRootFile in the config.json asset and restart."), "UpdateTUFRootFile")
+	}
+
+	for component, componentPath := range newConfig.UpdateComponents {
+		if component == "" || componentPath == "" {
+			return invalid(fmt.Errorf("Every one of the UpdateComponents needs a name and a path, got %q: %q. Please correct the UpdateComponents in the config.json asset and restart.", component, componentPath), "UpdateComponents")
+		}
+	}
+
+	if newConfig.UpdateScanURL != "" {
+		if _, parseErr := url.ParseRequestURI(newConfig.UpdateScanURL); parseErr != nil {
+			return invalid(fmt.Errorf("Cannot scan updates with %v: %v. Please correct the UpdateScanURL in the config.json asset and restart.", newConfig.UpdateScanURL, parseErr), "UpdateScanURL")
+		}
+	}
+
+	if len(newConfig.RemoteVersionURI) == 0 {
+		newConfig.RemoteVersionURI = Endpoints{"https://raw.githubusercontent.com/seantcanavan/anon-eth-net/master/src/github.com/seantcanavan/assets/version.no"}
+	}
+
+	return nil
+}
+
+// validateRetention will check the settings of the posture and integrity
+// checks and of data retention and set their defaults.
+func validateRetention(newConfig *Config) error {
+
+	if newConfig.PostureCheckHours <= 0 {
+		newConfig.PostureCheckHours = 24
+	}
+
+	for _, pattern := range newConfig.PostureIgnore {
+		if _, compileErr := regexp.Compile(pattern); compileErr != nil {
+			return invalid(fmt.Errorf("Could not compile the PostureIgnore pattern %v: %v. Please correct it in the config.json asset and restart.", pattern, compileErr), "PostureIgnore")
+		}
+	}
+
+	if len(newConfig.IntegrityAssets) == 0 {
+		newConfig.IntegrityAssets = []string{"version.no", "server.cert", "server.pkey", "main_loader.json", "reboot_loader.json", "profiler_loader.json"}
+	}
+
+	if newConfig.IntegrityCheckMinutes <= 0 {
+		newConfig.IntegrityCheckMinutes = 60
+	}
+
+	if newConfig.IntegrityKeyFile == "" {
+		newConfig.IntegrityKeyFile = "integrity.key"
+	}
+
+	for class, days := range newConfig.RetentionDays {
+		if !knownRetentionClass(class) {
+			return invalid(fmt.Errorf("Cannot keep unknown class of data %v. Please use %v in the RetentionDays in the config.json asset and restart.", class, strings.Join(RETENTION_CLASSES, ", ")), "RetentionDays")
+		}
+		if days <= 0 {
+			return invalid(fmt.Errorf("Cannot keep %v for %d days. Please use a positive number of RetentionDays in the config.json asset and restart.", class, days), "RetentionDays")
+		}
+	}
+
+	if newConfig.RetentionCheckHours <= 0 {
+		newConfig.RetentionCheckHours = 24
+	}
+
+	return nil
+}
+
+// applyLogging will make the logger follow the logging settings of the given
+// config once it's been validated and loaded. Nothing about how anything is
+// logged changes while a config is being validated, so a config which is
+// refused leaves the logger as it was.
+func applyLogging(cfg *Config) {
+
+	logger.SetSecrets(secretValues(cfg))
+
+	logDirMode, _ := strconv.ParseUint(cfg.LogDirMode, 8, 32)
+	settingErrs := []error{
+		logger.SetRedactPatterns(cfg.LogRedactPatterns),
+		logger.SetRotation(cfg.LogRotateSchedule, cfg.LogFileDateLayout),
+		logger.SetFileNamePattern(cfg.LogFileNamePattern),
+		logger.SetFlushPolicy(cfg.LogFlushLevel, cfg.LogFsync, time.Duration(cfg.LogFlushSeconds)*time.Second),
+		logger.SetSampling(cfg.LogSampling),
+		logger.SetLogDir(cfg.LogDir, os.FileMode(logDirMode), uint64(cfg.LogMinFreeMB)*1024*1024),
+	}
+	for _, settingErr := range settingErrs {
+		if settingErr != nil {
+			logger.Lgr.LogErrorf("Could not apply the logging settings: %v", settingErr)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+// The crash package writes a report to the CrashReportDir whenever the agent
+// panics or hits a fatal error. Each report holds the stack traces of every
+// goroutine, the most recent log messages, a digest of the config and a
+// fingerprint of the system it ran on. A panic in the main goroutine is
+// reported on the spot via Recover. Anything else, such as a panic in another
+// goroutine or a concurrent map write, is written by the go runtime to
+// CRASH_OUTPUT_FILE and turned into a report when the agent next starts.
+//
+// Reports are handed to the reporter on the next start. Crashes are told apart
+// by a signature made from the reason and the innermost frames of the
+// goroutine which crashed, so the same crash happening over and over again is
+// only notified once and counted after that, even across restarts.
+package crash
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/buildinfo"
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/reporter"
+	"github.com/seantcanavan/anon-eth-net/state"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The file in CrashReportDir the go runtime writes fatal errors to
+const CRASH_OUTPUT_FILE = "crash_output.txt"
+
+// The file extension used for every crash report
+const REPORT_EXTENSION = ".crash"
+
+// The most crash reports kept in CrashReportDir. The oldest are deleted first
+const MAX_CRASH_REPORTS = 20
+
+// The number of the most recent log messages included in a report
+const MAX_REPORTED_LOG_LINES = 200
+
+// The number of frames of the crashed goroutine the signature is made from
+const SIGNATURE_FRAMES = 5
+
+// The most of a report which is sent in a notification. The whole report stays
+// on disk
+const MAX_NOTIFIED_REPORT_BYTES = 16 * 1024
+
+// The state bucket every crash signature is counted in
+const CRASHES_BUCKET = "crashes"
+
+// The state bucket holding the reports which haven't been handed to the
+// reporter yet, keyed by their path
+const PENDING_BUCKET = "crash_reports"
+
+// The subject of the notification sent the first time a crash happens
+const CRASH_SUBJECT = "Crashed"
+
+// Record counts every crash with the same signature.
+type Record struct {
+	Signature  string    `json:"signature"`
+	Reason     string    `json:"reason"`
+	Count      uint64    `json:"count"`
+	FirstSeen  time.Time `json:"firstSeen"`
+	LastSeen   time.Time `json:"lastSeen"`
+	LastReport string    `json:"lastReport"`
+	Notified   bool      `json:"notified"`
+}
+
+// anything which changes between two runs of the same crash
+var variablePattern = regexp.MustCompile(`0x[0-9a-fA-F]+|[0-9]+`)
+
+// Install will turn anything the go runtime wrote to CRASH_OUTPUT_FILE before
+// the agent last stopped into a report, ask the runtime to write the stack
+// traces of every goroutine there from now on, and hand any reports which
+// haven't been yet to the reporter. Must be called after the reporter is set
+// up.
+func Install() error {
+
+	if mkdirErr := os.MkdirAll(config.Cfg.CrashReportDir, 0700); mkdirErr != nil {
+		return mkdirErr
+	}
+
+	outputPath := filepath.Join(config.Cfg.CrashReportDir, CRASH_OUTPUT_FILE)
+
+	if collectErr := collect(outputPath); collectErr != nil {
+		logger.Lgr.LogErrorf("Unable to turn the last crash into a report: %v", collectErr)
+	}
+
+	output, openErr := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if openErr != nil {
+		return openErr
+	}
+	defer output.Close()
+
+	debug.SetTraceback("all")
+	if crashErr := debug.SetCrashOutput(output, debug.CrashOptions{}); crashErr != nil {
+		return crashErr
+	}
+
+	logger.Lgr.LogMessagef("Successfully set up crash reporting to: %v", config.Cfg.CrashReportDir)
+
+	ReportPending()
+	return nil
+}
+
+// Recover will write a report for a panic in the calling goroutine and then
+// panic again so the agent still exits. Must be deferred directly, e.g.
+// defer crash.Recover().
+func Recover() {
+
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+
+	reason := fmt.Sprintf("panic: %v", recovered)
+	if _, reportErr := writeReport(time.Now(), reason, allStacks(), logger.Lgr.RecentMessages(MAX_REPORTED_LOG_LINES)); reportErr != nil {
+		logger.Lgr.LogErrorf("Unable to write a crash report for %v: %v", reason, reportErr)
+	} else {
+		// the runtime would otherwise write a second report of the same panic
+		debug.SetCrashOutput(nil, debug.CrashOptions{})
+	}
+
+	logger.FlushAll()
+	panic(recovered)
+}
+
+// collect will write a report of the crash the go runtime wrote to the given
+// file, if it wrote one. The logs are taken from the end of the log file
+// written before the restart since the ones held in memory went with the
+// crashed process.
+func collect(outputPath string) error {
+
+	output, readErr := ioutil.ReadFile(outputPath)
+	if os.IsNotExist(readErr) {
+		return nil
+	}
+	if readErr != nil {
+		return readErr
+	}
+
+	if len(bytes.TrimSpace(output)) == 0 {
+		return nil
+	}
+
+	when := time.Now()
+	if fileInfo, statErr := os.Stat(outputPath); statErr == nil {
+		when = fileInfo.ModTime()
+	}
+
+	var recentLogs []string
+	if previous := logger.Lgr.PreviousLogFiles(); len(previous) > 0 {
+		if lines, linesErr := utils.ReadLines(previous[0]); linesErr == nil {
+			if len(lines) > MAX_REPORTED_LOG_LINES {
+				lines = lines[len(lines)-MAX_REPORTED_LOG_LINES:]
+			}
+			// put the stack traces and other multi line messages back together
+			for _, line := range lines {
+				recentLogs = append(recentLogs, logger.UnescapeMessage(line))
+			}
+		}
+	}
+
+	trimmed := strings.TrimSpace(string(output))
+	reason := strings.SplitN(trimmed, "\n", 2)[0]
+
+	// the captured standard error died with the process before the runtime's
+	// output could be logged
+	if logger.CapturingOutput() {
+		for _, line := range strings.Split(trimmed, "\n") {
+			logger.Lgr.LogMessage(logger.STDERR_PREFIX + line)
+		}
+	}
+	goroutines := trimmed[len(reason):]
+
+	_, reportErr := writeReport(when, reason, strings.TrimSpace(goroutines), recentLogs)
+	return reportErr
+}
+
+// writeReport will write a report of a crash for the given reason to the
+// CrashReportDir, count it against its signature and leave it for
+// ReportPending. Returns the path of the report.
+func writeReport(when time.Time, reason string, goroutines string, recentLogs []string) (string, error) {
+
+	crashSignature := signature(reason, goroutines)
+
+	var report bytes.Buffer
+	report.WriteString(fmt.Sprintf("Time: %v\n", when.Format(time.RFC3339)))
+	report.WriteString(fmt.Sprintf("Signature: %v\n", crashSignature))
+	report.WriteString(fmt.Sprintf("Reason: %v\n", reason))
+	report.WriteString(fmt.Sprintf("Build: %v\n", buildinfo.Version()))
+	report.WriteString(fmt.Sprintf("Device: %v (%v)\n", config.Cfg.DeviceName, config.Cfg.DeviceId))
+	report.WriteString(fmt.Sprintf("System: %v\n", fingerprint()))
+	report.WriteString(fmt.Sprintf("Config digest: %v\n", configDigest()))
+	report.WriteString("\n---------- Goroutines ----------\n")
+	report.WriteString(goroutines)
+	report.WriteString("\n\n---------- Recent Logs ----------\n")
+	report.WriteString(strings.Join(recentLogs, "\n"))
+	report.WriteString("\n")
+
+	if mkdirErr := os.MkdirAll(config.Cfg.CrashReportDir, 0700); mkdirErr != nil {
+		return "", mkdirErr
+	}
+
+	reportPath := filepath.Join(config.Cfg.CrashReportDir, fmt.Sprintf("crash_%v_%v%v", utils.FileTimeStamp(when), crashSignature, REPORT_EXTENSION))
+	if writeErr := ioutil.WriteFile(reportPath, report.Bytes(), 0600); writeErr != nil {
+		return "", writeErr
+	}
+
+	updateErr := state.Update(func(tx *state.Tx) error {
+		crashes := tx.Bucket(CRASHES_BUCKET)
+
+		record := Record{Signature: crashSignature, Reason: reason, FirstSeen: when}
+		if _, getErr := crashes.Get(crashSignature, &record); getErr != nil {
+			return getErr
+		}
+
+		record.Count++
+		record.LastSeen = when
+		record.LastReport = reportPath
+
+		if putErr := crashes.Put(crashSignature, record); putErr != nil {
+			return putErr
+		}
+
+		return tx.Bucket(PENDING_BUCKET).Put(reportPath, crashSignature)
+	})
+	if updateErr != nil {
+		return reportPath, updateErr
+	}
+
+	prune()
+
+	logger.Lgr.LogErrorf("Wrote crash report %v for: %v", reportPath, reason)
+	return reportPath, nil
+}
+
+// ReportPending will notify the reporter of every crash report written since
+// the last time it was called. Only the first report of each signature is sent.
+// The rest are only counted.
+func ReportPending() {
+
+	pending, keysErr := state.Keys(PENDING_BUCKET)
+	if keysErr != nil {
+		logger.Lgr.LogErrorf("Unable to read the pending crash reports: %v", keysErr)
+		return
+	}
+
+	for _, reportPath := range pending {
+
+		var crashSignature string
+		state.Get(PENDING_BUCKET, reportPath, &crashSignature)
+
+		var record Record
+		state.Get(CRASHES_BUCKET, crashSignature, &record)
+
+		if record.Notified {
+			logger.Lgr.LogMessagef("Not notifying crash %v again. It has happened %d times: %v", crashSignature, record.Count, record.Reason)
+			state.Delete(PENDING_BUCKET, reportPath)
+			continue
+		}
+
+		body, readErr := ioutil.ReadFile(reportPath)
+		if readErr != nil {
+			body = []byte(fmt.Sprintf("The crash report %v is no longer available: %v\n", reportPath, readErr))
+		}
+		if len(body) > MAX_NOTIFIED_REPORT_BYTES {
+			body = append(body[:MAX_NOTIFIED_REPORT_BYTES], []byte(fmt.Sprintf("\n... the full report is in %v\n", reportPath))...)
+		}
+
+		if notifyErr := reporter.Notify(reporter.CRITICAL, CRASH_SUBJECT+": "+record.Reason, body); notifyErr != nil {
+			logger.Lgr.LogErrorf("Unable to notify crash %v: %v", crashSignature, notifyErr)
+		}
+
+		record.Notified = true
+		state.Update(func(tx *state.Tx) error {
+			if putErr := tx.Bucket(CRASHES_BUCKET).Put(crashSignature, record); putErr != nil {
+				return putErr
+			}
+			return tx.Bucket(PENDING_BUCKET).Delete(reportPath)
+		})
+	}
+}
+
+// StatusSummary lists every crash signature seen, most recent first.
+func StatusSummary() (string, error) {
+
+	var records []Record
+	viewErr := state.View(func(tx *state.Tx) error {
+		crashes := tx.Bucket(CRASHES_BUCKET)
+		for _, crashSignature := range crashes.Keys() {
+			var record Record
+			if _, getErr := crashes.Get(crashSignature, &record); getErr != nil {
+				return getErr
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	if viewErr != nil {
+		return "", viewErr
+	}
+
+	if len(records) == 0 {
+		return "No crashes\n", nil
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].LastSeen.After(records[j].LastSeen)
+	})
+
+	var summary bytes.Buffer
+	for _, record := range records {
+		summary.WriteString(fmt.Sprintf("%v: %d times, last at %v, %v\n", record.Signature, record.Count, record.LastSeen.Format(time.RFC3339), record.Reason))
+	}
+
+	return summary.String(), nil
+}
+
+// signature identifies a crash by its reason and the innermost frames of the
+// goroutine which crashed, which is the first one listed. Addresses and other
+// numbers are left out so the same crash always has the same signature.
+func signature(reason string, goroutines string) string {
+
+	var frames []string
+	for _, line := range strings.Split(goroutines, "\n") {
+		if strings.HasPrefix(line, "goroutine ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "created by ") {
+			// the end of the crashed goroutine
+			if len(frames) > 0 {
+				break
+			}
+			continue
+		}
+
+		function := line
+		if argsStart := strings.LastIndex(line, "("); argsStart > 0 {
+			function = line[:argsStart]
+		}
+
+		if strings.HasPrefix(function, "runtime.") || strings.HasPrefix(function, "runtime/debug.") || strings.HasPrefix(function, "panic") || strings.HasPrefix(function, "github.com/seantcanavan/anon-eth-net/crash.") {
+			continue
+		}
+
+		frames = append(frames, function)
+		if len(frames) == SIGNATURE_FRAMES {
+			break
+		}
+	}
+
+	hash := sha256.Sum256([]byte(variablePattern.ReplaceAllString(reason, "N") + "\n" + strings.Join(frames, "\n")))
+	return hex.EncodeToString(hash[:8])
+}
+
+// allStacks returns the stack traces of every goroutine, starting with the
+// calling one.
+func allStacks() string {
+
+	buffer := make([]byte, 64*1024)
+	for 1 == 1 {
+		written := runtime.Stack(buffer, true)
+		if written < len(buffer) {
+			return string(buffer[:written])
+		}
+		buffer = make([]byte, len(buffer)*2)
+	}
+
+	return ""
+}
+
+// fingerprint describes the machine and process the agent is running as.
+func fingerprint() string {
+
+	hostname, hostnameErr := os.Hostname()
+	if hostnameErr != nil {
+		hostname = "unknown"
+	}
+
+	return fmt.Sprintf("host %v, %v/%v, %d cpus, %v, pid %d", hostname, runtime.GOOS, runtime.GOARCH, runtime.NumCPU(), runtime.Version(), os.Getpid())
+}
+
+// configDigest returns the SHA-256 of the config in use so reports can tell
+// whether two crashes ran with the same config without including its secrets.
+func configDigest() string {
+
+	configBytes, jsonErr := json.Marshal(config.Cfg)
+	if jsonErr != nil {
+		return "unknown"
+	}
+
+	hash := sha256.Sum256(configBytes)
+	return hex.EncodeToString(hash[:])
+}
+
+// prune will delete the oldest reports beyond MAX_CRASH_REPORTS.
+func prune() {
+
+	reports, _ := filepath.Glob(filepath.Join(config.Cfg.CrashReportDir, "crash_*"+REPORT_EXTENSION))
+	sort.Strings(reports)
+
+	for len(reports) > MAX_CRASH_REPORTS {
+		if removeErr := os.Remove(reports[0]); removeErr != nil {
+			logger.Lgr.LogErrorf("Unable to delete old crash report %v: %v", reports[0], removeErr)
+		}
+		reports = reports[1:]
+	}
+}
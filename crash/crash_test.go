@@ -0,0 +1,143 @@
+package crash
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/reporter"
+	"github.com/seantcanavan/anon-eth-net/state"
+)
+
+func TestMain(m *testing.M) {
+
+	logErr := logger.StandardLogger("crash_test")
+	if logErr != nil {
+		fmt.Println(fmt.Sprintf("Could not initialize logger: %v", logErr))
+		return
+	}
+
+	configErr := config.FromFile()
+	if configErr != nil {
+		return
+	}
+
+	result := m.Run()
+	os.Exit(result)
+}
+
+// The crash output the go runtime writes for a panic in a goroutine
+const TEST_CRASH_OUTPUT = `panic: assignment to entry in nil map
+
+goroutine 42 [running]:
+github.com/seantcanavan/anon-eth-net/loader.(*Loader).execute(0xc000120000, 0xc0001a2000)
+	/src/loader/loader.go:201 +0x%x
+github.com/seantcanavan/anon-eth-net/loader.(*Loader).Run.func1(0xc0001a2000)
+	/src/loader/loader.go:512 +0x45
+created by github.com/seantcanavan/anon-eth-net/loader.(*Loader).Run in goroutine 1
+	/src/loader/loader.go:505 +0x55
+
+goroutine 1 [select]:
+main.runAgent({0x0, 0x0, 0x0})
+	/src/main/main.go:300 +0x1b5
+`
+
+// testNotifier holds on to every notification it receives.
+type testNotifier struct {
+	received []reporter.Notification
+	lock     sync.Mutex
+}
+
+func (tn *testNotifier) Name() string {
+	return "crash_test"
+}
+
+func (tn *testNotifier) Notify(notification reporter.Notification) error {
+	tn.lock.Lock()
+	defer tn.lock.Unlock()
+	tn.received = append(tn.received, notification)
+	return nil
+}
+
+func TestSignature(t *testing.T) {
+
+	first := signature("panic: runtime error: index out of range [5] with length 3", fmt.Sprintf(TEST_CRASH_OUTPUT, 0x1a))
+	second := signature("panic: runtime error: index out of range [7] with length 2", fmt.Sprintf(TEST_CRASH_OUTPUT, 0x2b))
+	if first != second {
+		t.Errorf("expected the same crash at different addresses to have the same signature, got: %v %v", first, second)
+	}
+
+	other := signature("panic: runtime error: index out of range [5] with length 3", strings.Replace(fmt.Sprintf(TEST_CRASH_OUTPUT, 0x1a), "execute", "markStarted", 1))
+	if first == other {
+		t.Errorf("expected a crash in a different function to have a different signature")
+	}
+}
+
+func TestInstall(t *testing.T) {
+
+	crashDir, dirErr := ioutil.TempDir("", "crash_test")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(crashDir)
+
+	defer func(dir string) {
+		config.Cfg.CrashReportDir = dir
+		debug.SetCrashOutput(nil, debug.CrashOptions{})
+	}(config.Cfg.CrashReportDir)
+	config.Cfg.CrashReportDir = crashDir
+
+	if openErr := state.Open(filepath.Join(crashDir, "agent_state.json")); openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer state.Open(config.Cfg.StateFile)
+
+	notifier := &testNotifier{}
+	reporter.RegisterNotifier(notifier, reporter.CRITICAL)
+
+	// the same crash happens twice in a row
+	for attempt := 0; attempt < 2; attempt++ {
+		crashOutput := []byte(fmt.Sprintf(TEST_CRASH_OUTPUT, 0x1a+attempt))
+		if writeErr := ioutil.WriteFile(filepath.Join(crashDir, CRASH_OUTPUT_FILE), crashOutput, 0600); writeErr != nil {
+			t.Fatal(writeErr)
+		}
+		if installErr := Install(); installErr != nil {
+			t.Fatal(installErr)
+		}
+	}
+
+	reports, _ := filepath.Glob(filepath.Join(crashDir, "*"+REPORT_EXTENSION))
+	if len(reports) != 2 {
+		t.Fatalf("expected a report for each crash, got: %v", reports)
+	}
+
+	contents, _ := ioutil.ReadFile(reports[0])
+	for _, expected := range []string{"Reason: panic: assignment to entry in nil map", "Config digest: ", "loader.(*Loader).execute", "---------- Recent Logs ----------"} {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf("expected the report to contain %v, got: %v", expected, string(contents))
+		}
+	}
+
+	notifier.lock.Lock()
+	received := notifier.received
+	notifier.lock.Unlock()
+	if len(received) != 1 || received[0].Subject != CRASH_SUBJECT+": panic: assignment to entry in nil map" {
+		t.Errorf("expected the repeated crash to be notified once, got: %+v", received)
+	}
+
+	if summary, _ := StatusSummary(); !strings.Contains(summary, "2 times") {
+		t.Errorf("expected both crashes to be counted, got: %v", summary)
+	}
+
+	// the runtime's crash output is emptied once it's been reported
+	if output, _ := ioutil.ReadFile(filepath.Join(crashDir, CRASH_OUTPUT_FILE)); len(output) != 0 {
+		t.Errorf("expected the crash output to be emptied, got: %v", string(output))
+	}
+}
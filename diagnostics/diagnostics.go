@@ -0,0 +1,353 @@
+package diagnostics
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/loader"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/profiler"
+	"github.com/seantcanavan/anon-eth-net/reporter"
+	"github.com/seantcanavan/anon-eth-net/updater"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The subject of the email the diagnostics bundle is sent out with
+const DIAGNOSTICS_SUBJECT = "Diagnostics Bundle"
+
+// The base name of diagnostics bundle files
+const DIAGNOSTICS_BASE_NAME = "diagnostics"
+
+// The file extension of diagnostics bundles
+const DIAGNOSTICS_EXTENSION = ".tar.gz"
+
+// The number of the most recent main log files included in the bundle
+const DIAGNOSTICS_LOG_COUNT = 3
+
+// The maximum number of bytes included from the end of each log file
+const MAX_LOG_BYTES = 2 * 1024 * 1024
+
+// The number of recent errors and events included in the bundle
+const DIAGNOSTICS_RECENT_COUNT = 200
+
+// The largest bundle which will be emailed. Most mail servers refuse anything over 25MB
+const MAX_EMAIL_BUNDLE_BYTES = 20 * 1024 * 1024
+
+// The value written in place of every redacted config value
+const REDACTED = "REDACTED"
+
+// Config keys containing any of these, ignoring case, are redacted
+var redactedKeys = []string{"password", "secret", "token", "passphrase", "hash", "url", "accountsid", "apikey"}
+
+// The time this program started executing
+var startTime = time.Now()
+
+// Fingerprint identifies the machine and build a diagnostics bundle came from.
+type Fingerprint struct {
+	DeviceName    string    `json:"deviceName"`
+	DeviceId      string    `json:"deviceId"`
+	Hostname      string    `json:"hostname"`
+	LocalVersion  uint64    `json:"localVersion"`
+	GOOS          string    `json:"goos"`
+	GOARCH        string    `json:"goarch"`
+	GoVersion     string    `json:"goVersion"`
+	NumCPU        int       `json:"numCPU"`
+	Started       time.Time `json:"started"`
+	UptimeSeconds int64     `json:"uptimeSeconds"`
+	Generated     time.Time `json:"generated"`
+	OSRelease     string    `json:"osRelease,omitempty"`
+}
+
+// Bundle will write a gzipped tarball to the given writer containing
+// everything needed to diagnose this machine remotely: the system
+// fingerprint, the config with every secret redacted, both as it's saved and
+// annotated with where each setting came from, the profiler history, the
+// state of every job managed by the given loader, the update history and
+// recent events, recent errors, and the tail of the most recent log files.
+// The loader can be nil.
+func Bundle(ldr *loader.Loader, writer io.Writer) error {
+
+	gzipWriter := gzip.NewWriter(writer)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	pieces := []struct {
+		name     string
+		contents func() ([]byte, error)
+	}{
+		{"fingerprint.json", func() ([]byte, error) { return json.MarshalIndent(SystemFingerprint(), "", "  ") }},
+		{"config.json", RedactedConfig},
+		{"effective_config.json", EffectiveConfig},
+		{"profiler_history.json", func() ([]byte, error) { return json.MarshalIndent(profiler.Samples(), "", "  ") }},
+		{"jobs.txt", func() ([]byte, error) { return jobStates(ldr) }},
+		{"update_history.json", func() ([]byte, error) { return json.MarshalIndent(updateHistory(), "", "  ") }},
+		{"events.json", func() ([]byte, error) { return json.MarshalIndent(events.Recent(DIAGNOSTICS_RECENT_COUNT), "", "  ") }},
+		{"errors.txt", func() ([]byte, error) {
+			return []byte(strings.Join(logger.Lgr.RecentErrors(DIAGNOSTICS_RECENT_COUNT), "\n")), nil
+		}},
+	}
+
+	for _, piece := range pieces {
+		contents, pieceErr := piece.contents()
+		if pieceErr != nil {
+			// a missing piece shouldn't stop the rest of the bundle from being useful
+			contents = []byte(fmt.Sprintf("could not collect %v: %v\n", piece.name, pieceErr))
+		}
+		if writeErr := writeTarFile(tarWriter, piece.name, contents); writeErr != nil {
+			return writeErr
+		}
+	}
+
+	for _, logName := range logger.Lgr.RecentLogFiles(DIAGNOSTICS_LOG_COUNT) {
+		contents, tailErr := tailFile(logName, MAX_LOG_BYTES)
+		if tailErr != nil {
+			contents = []byte(fmt.Sprintf("could not read %v: %v\n", logName, tailErr))
+		}
+		if writeErr := writeTarFile(tarWriter, "logs/"+filepath.Base(logName), contents); writeErr != nil {
+			return writeErr
+		}
+	}
+
+	if closeErr := tarWriter.Close(); closeErr != nil {
+		return closeErr
+	}
+
+	if closeErr := gzipWriter.Close(); closeErr != nil {
+		return closeErr
+	}
+
+	logger.Lgr.LogMessage("Successfully generated diagnostics bundle")
+
+	return nil
+}
+
+// EmailBundle will generate a diagnostics bundle and send it out via the
+// reporter as an attachment. Returns a human readable result.
+func EmailBundle(ldr *loader.Loader) (string, error) {
+
+	bundleFile, createErr := os.Create(filepath.Join(os.TempDir(), utils.TimeStampFileName(DIAGNOSTICS_BASE_NAME, DIAGNOSTICS_EXTENSION)))
+	if createErr != nil {
+		return "", createErr
+	}
+	defer os.Remove(bundleFile.Name())
+
+	bundleErr := Bundle(ldr, bundleFile)
+	bundleFile.Close()
+	if bundleErr != nil {
+		return "", bundleErr
+	}
+
+	bundleInfo, statErr := os.Stat(bundleFile.Name())
+	if statErr != nil {
+		return "", statErr
+	}
+
+	if bundleInfo.Size() > MAX_EMAIL_BUNDLE_BYTES {
+		return "", fmt.Errorf("The diagnostics bundle is %d bytes which is too large to email. Download it via REST instead.", bundleInfo.Size())
+	}
+
+	attachments := []reporter.Attachment{{Path: bundleFile.Name(), MaxBytes: MAX_EMAIL_BUNDLE_BYTES}}
+	body := []byte(fmt.Sprintf("Diagnostics bundle for %v (%v) attached.\n", config.Cfg.DeviceName, config.Cfg.DeviceId))
+
+	if sendErr := reporter.SendReport(DIAGNOSTICS_SUBJECT, body, attachments); sendErr != nil {
+		return "", sendErr
+	}
+
+	return fmt.Sprintf("emailed a %d byte diagnostics bundle\n", bundleInfo.Size()), nil
+}
+
+// SystemFingerprint returns the details which identify this machine and
+// build.
+func SystemFingerprint() Fingerprint {
+
+	hostname, _ := os.Hostname()
+	now := time.Now()
+
+	fingerprint := Fingerprint{
+		DeviceName:    config.Cfg.DeviceName,
+		DeviceId:      config.Cfg.DeviceId,
+		Hostname:      hostname,
+		LocalVersion:  config.Cfg.LocalVersion,
+		GOOS:          runtime.GOOS,
+		GOARCH:        runtime.GOARCH,
+		GoVersion:     runtime.Version(),
+		NumCPU:        runtime.NumCPU(),
+		Started:       startTime,
+		UptimeSeconds: int64(now.Sub(startTime) / time.Second),
+		Generated:     now,
+	}
+
+	if release, readErr := ioutil.ReadFile("/etc/os-release"); readErr == nil {
+		fingerprint.OSRelease = string(release)
+	}
+
+	return fingerprint
+}
+
+// RedactedConfig returns the current config as JSON with the value of every
+// key which may hold a credential, at any depth, replaced with REDACTED.
+func RedactedConfig() ([]byte, error) {
+
+	jsonBytes, jsonErr := json.Marshal(config.Cfg)
+	if jsonErr != nil {
+		return nil, jsonErr
+	}
+
+	var generic interface{}
+	if jsonErr := json.Unmarshal(jsonBytes, &generic); jsonErr != nil {
+		return nil, jsonErr
+	}
+
+	return json.MarshalIndent(redact(generic), "", "  ")
+}
+
+// EffectiveSetting is the current value of a setting along with where it
+// came from.
+type EffectiveSetting struct {
+	Value interface{} `json:"value"`
+	config.Provenance
+}
+
+// EffectiveConfig returns the current config as JSON with every secret
+// redacted like RedactedConfig and every setting annotated with where its
+// value came from, e.g. {"DeviceName": {"value": "rig-1", "source":
+// "layer", "file": "assets/config.d/site.json"}}.
+func EffectiveConfig() ([]byte, error) {
+
+	redactedBytes, redactErr := RedactedConfig()
+	if redactErr != nil {
+		return nil, redactErr
+	}
+
+	var values map[string]interface{}
+	if jsonErr := json.Unmarshal(redactedBytes, &values); jsonErr != nil {
+		return nil, jsonErr
+	}
+
+	provenances, provenanceErr := config.Provenances()
+	if provenanceErr != nil {
+		return nil, provenanceErr
+	}
+
+	effective := make(map[string]EffectiveSetting)
+	for field, value := range values {
+		effective[field] = EffectiveSetting{Value: value, Provenance: provenances[field]}
+	}
+
+	return json.MarshalIndent(effective, "", "  ")
+}
+
+// redact will walk the given JSON value and replace the values of sensitive
+// keys.
+func redact(value interface{}) interface{} {
+
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for key, child := range typed {
+			if sensitiveKey(key) && child != nil && child != "" {
+				typed[key] = REDACTED
+				continue
+			}
+			typed[key] = redact(child)
+		}
+	case []interface{}:
+		for index, child := range typed {
+			typed[index] = redact(child)
+		}
+	}
+
+	return value
+}
+
+// sensitiveKey returns true if the given config key may hold a credential.
+func sensitiveKey(key string) bool {
+	lowered := strings.ToLower(key)
+	for _, redacted := range redactedKeys {
+		if strings.Contains(lowered, redacted) {
+			return true
+		}
+	}
+	return false
+}
+
+// jobStates returns the status summary of the given loader.
+func jobStates(ldr *loader.Loader) ([]byte, error) {
+	if ldr == nil {
+		return []byte("no loader configured\n"), nil
+	}
+
+	summary, summaryErr := ldr.StatusSummary()
+	return []byte(summary), summaryErr
+}
+
+// updateHistory returns the recent events describing applied updates and
+// repeatedly failing update checks.
+func updateHistory() []events.Record {
+
+	var updates []events.Record
+
+	for _, record := range events.Recent(DIAGNOSTICS_RECENT_COUNT) {
+		if record.Kind == events.UPDATE_APPLIED {
+			updates = append(updates, record)
+			continue
+		}
+		if breached, isBreach := record.Event.(events.ThresholdBreached); isBreach && breached.Metric == updater.UPDATE_FAILURES_METRIC {
+			updates = append(updates, record)
+		}
+	}
+
+	return updates
+}
+
+// tailFile returns at most maxBytes from the end of the file at the given
+// path.
+func tailFile(path string, maxBytes int64) ([]byte, error) {
+
+	file, openErr := os.Open(path)
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer file.Close()
+
+	fileInfo, statErr := file.Stat()
+	if statErr != nil {
+		return nil, statErr
+	}
+
+	if fileInfo.Size() > maxBytes {
+		if _, seekErr := file.Seek(fileInfo.Size()-maxBytes, io.SeekStart); seekErr != nil {
+			return nil, seekErr
+		}
+	}
+
+	return ioutil.ReadAll(file)
+}
+
+// writeTarFile will add a single file with the given name and contents to the
+// given tarball.
+func writeTarFile(tarWriter *tar.Writer, name string, contents []byte) error {
+
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(contents)),
+		ModTime: time.Now(),
+	}
+
+	if headerErr := tarWriter.WriteHeader(header); headerErr != nil {
+		return headerErr
+	}
+
+	_, writeErr := tarWriter.Write(contents)
+	return writeErr
+}
@@ -0,0 +1,104 @@
+package diagnostics
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+func TestMain(m *testing.M) {
+
+	logErr := logger.StandardLogger("diagnostics_test")
+	if logErr != nil {
+		fmt.Println(fmt.Sprintf("Could not initialize logger: %v", logErr))
+		return
+	}
+
+	configErr := config.FromFile()
+	if configErr != nil {
+		return
+	}
+
+	result := m.Run()
+	os.Exit(result)
+}
+
+func TestBundle(t *testing.T) {
+
+	originalPassword := config.Cfg.CheckInGmailPassword
+	config.Cfg.CheckInGmailPassword = "hunter2"
+	defer func() { config.Cfg.CheckInGmailPassword = originalPassword }()
+
+	var bundle bytes.Buffer
+	if bundleErr := Bundle(nil, &bundle); bundleErr != nil {
+		t.Fatal(bundleErr)
+	}
+
+	gzipReader, gzipErr := gzip.NewReader(&bundle)
+	if gzipErr != nil {
+		t.Fatal(gzipErr)
+	}
+
+	files := make(map[string][]byte)
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, nextErr := tarReader.Next()
+		if nextErr == io.EOF {
+			break
+		}
+		if nextErr != nil {
+			t.Fatal(nextErr)
+		}
+		var contents bytes.Buffer
+		io.Copy(&contents, tarReader)
+		files[header.Name] = contents.Bytes()
+	}
+
+	for _, name := range []string{"fingerprint.json", "config.json", "profiler_history.json", "jobs.txt", "update_history.json", "events.json", "errors.txt"} {
+		if _, exists := files[name]; !exists {
+			t.Errorf("expected %v in the diagnostics bundle", name)
+		}
+	}
+
+	if strings.Contains(string(files["config.json"]), "hunter2") {
+		t.Errorf("expected the config in the diagnostics bundle to be redacted")
+	}
+
+	var fingerprint Fingerprint
+	if jsonErr := json.Unmarshal(files["fingerprint.json"], &fingerprint); jsonErr != nil {
+		t.Fatal(jsonErr)
+	}
+	if fingerprint.GOOS == "" || fingerprint.DeviceId != config.Cfg.DeviceId {
+		t.Errorf("unexpected system fingerprint: %+v", fingerprint)
+	}
+}
+
+func TestRedact(t *testing.T) {
+
+	redacted := redact(map[string]interface{}{
+		"DeviceName": "miner",
+		"RestTokens": []interface{}{map[string]interface{}{"Name": "ci", "Hash": "abc"}},
+		"Notifiers":  []interface{}{map[string]interface{}{"Name": "slack", "URL": "https://hooks.example.com/secret"}},
+	}).(map[string]interface{})
+
+	if redacted["DeviceName"] != "miner" {
+		t.Errorf("expected DeviceName to be left alone, got: %v", redacted["DeviceName"])
+	}
+	if redacted["RestTokens"] != REDACTED {
+		t.Errorf("expected RestTokens to be redacted, got: %v", redacted["RestTokens"])
+	}
+
+	notifier := redacted["Notifiers"].([]interface{})[0].(map[string]interface{})
+	if notifier["Name"] != "slack" || notifier["URL"] != REDACTED {
+		t.Errorf("expected only the notifier URL to be redacted, got: %+v", notifier)
+	}
+}
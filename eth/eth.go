@@ -0,0 +1,421 @@
+package eth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/state"
+	"github.com/seantcanavan/anon-eth-net/transport"
+)
+
+// The state bucket each wallet's balance history is saved in by address
+const WALLET_BUCKET = "eth_wallets"
+
+// The number of balance changes remembered for each wallet
+const MAX_BALANCE_HISTORY = 100
+
+// How long a JSON-RPC endpoint or Etherscan has to reply. In seconds
+const ETH_TIMEOUT_SECONDS = 30
+
+// The most bytes read from a JSON-RPC endpoint or Etherscan reply
+const MAX_ETH_RESPONSE_BYTES = 1024 * 1024
+
+// The chain Etherscan is asked about
+const MAINNET_CHAIN_ID = "1"
+
+// The name of the metric each wallet's balance is recorded under, followed by
+// its address
+const BALANCE_METRIC_PREFIX = "eth_balance_"
+
+// The number of wei in one ETH
+var weiPerEth = new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
+
+// A wallet address as it appears in the config
+var addressPattern = regexp.MustCompile("^0x[0-9a-fA-F]{40}$")
+
+// Balance is the balance of a wallet from a point in time until it next
+// changed.
+type Balance struct {
+	Time int64  `json:"time"`
+	Wei  string `json:"wei"`
+}
+
+// Wallet is everything remembered about a single wallet across restarts.
+type Wallet struct {
+	Address    string    `json:"address"`
+	FirstSeen  int64     `json:"firstSeen"`
+	Checked    int64     `json:"checked"`
+	LastPayout int64     `json:"lastPayout"`
+	PayoutWei  string    `json:"payoutWei"`
+	Overdue    bool      `json:"overdue"`
+	Balances   []Balance `json:"balances"`
+}
+
+// rpcError is the error a JSON-RPC endpoint replies with.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// rpcResponse is the reply to a single JSON-RPC call.
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+}
+
+// etherscanResponse is the reply to a single Etherscan API call.
+type etherscanResponse struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Result  string `json:"result"`
+}
+
+var walletLock sync.Mutex
+
+// Run will check the balance of every one of the EthWallets every
+// EthCheckSeconds. A PayoutReceived event is published whenever a balance
+// goes up, and a PayoutOverdue event when a wallet goes longer than
+// EthPayoutHours without one. Wallets can be added or removed via the config
+// without a restart.
+func Run() {
+	go func() {
+		for 1 == 1 {
+			if len(config.Cfg.EthWallets) > 0 {
+				if checkErr := Check(); checkErr != nil {
+					logger.Lgr.LogErrorf("Failed to check the ETH wallet balances: %v", checkErr)
+				}
+			}
+
+			time.Sleep(time.Duration(config.Cfg.EthCheckSeconds) * time.Second)
+		}
+	}()
+}
+
+// Check will fetch the balance of every one of the EthWallets, add it to the
+// wallet's history when it changed and publish the resulting events. Returns
+// the last error hit, after checking the rest of the wallets.
+func Check() error {
+
+	var lastErr error
+	for _, address := range config.Cfg.EthWallets {
+		wei, balanceErr := FetchBalance(address)
+		if balanceErr != nil {
+			lastErr = fmt.Errorf("Could not fetch the balance of %v: %v", address, balanceErr)
+			logger.Lgr.LogError(lastErr.Error())
+			continue
+		}
+
+		if recordErr := record(address, wei, time.Now()); recordErr != nil {
+			lastErr = recordErr
+		}
+	}
+
+	return lastErr
+}
+
+// FetchBalance will return the balance of the given address in wei, read from
+// EthRPCURL or from EtherscanURL when it isn't set.
+func FetchBalance(address string) (*big.Int, error) {
+
+	if !addressPattern.MatchString(address) {
+		return nil, fmt.Errorf("%v isn't a wallet address", address)
+	}
+
+	if config.Cfg.EthRPCURL != "" {
+		var hexBalance string
+		if callErr := Call(config.Cfg.EthRPCURL, "eth_getBalance", []interface{}{address, "latest"}, &hexBalance); callErr != nil {
+			return nil, callErr
+		}
+		return ParseQuantity(hexBalance)
+	}
+
+	return etherscanBalance(address)
+}
+
+// Call will make a single JSON-RPC call of the given method to the given
+// endpoint and decode its result into result.
+func Call(endpoint string, method string, params []interface{}, result interface{}) error {
+
+	if params == nil {
+		params = []interface{}{}
+	}
+
+	body, marshalErr := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": method, "params": params})
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	request, requestErr := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if requestErr != nil {
+		return requestErr
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	replyBytes, sendErr := send(request)
+	if sendErr != nil {
+		return sendErr
+	}
+
+	var reply rpcResponse
+	if jsonErr := json.Unmarshal(replyBytes, &reply); jsonErr != nil {
+		return fmt.Errorf("Unable to read the reply to %v: %v", method, jsonErr)
+	}
+
+	if reply.Error != nil {
+		return fmt.Errorf("%v failed with code %d: %v", method, reply.Error.Code, reply.Error.Message)
+	}
+
+	return json.Unmarshal(reply.Result, result)
+}
+
+// ParseQuantity converts a hex encoded JSON-RPC quantity such as 0x1b4 to a
+// number.
+func ParseQuantity(quantity string) (*big.Int, error) {
+
+	value, parsed := new(big.Int).SetString(strings.TrimPrefix(quantity, "0x"), 16)
+	if !strings.HasPrefix(quantity, "0x") || !parsed {
+		return nil, fmt.Errorf("%v isn't a hex quantity", quantity)
+	}
+
+	return value, nil
+}
+
+// FormatEth describes the given number of wei in ETH to six decimal places.
+func FormatEth(wei *big.Int) string {
+	return new(big.Rat).SetFrac(wei, weiPerEth).FloatString(6)
+}
+
+// ToEth converts the given number of wei to ETH for metrics, losing precision
+// beyond what a float64 holds.
+func ToEth(wei *big.Int) float64 {
+	eth, _ := new(big.Rat).SetFrac(wei, weiPerEth).Float64()
+	return eth
+}
+
+// Wallets returns everything remembered about each of the EthWallets which
+// has been checked at least once.
+func Wallets() []Wallet {
+
+	walletLock.Lock()
+	defer walletLock.Unlock()
+
+	var wallets []Wallet
+	for _, address := range config.Cfg.EthWallets {
+		var wallet Wallet
+		if found, getErr := state.Get(WALLET_BUCKET, strings.ToLower(address), &wallet); getErr == nil && found {
+			wallets = append(wallets, wallet)
+		}
+	}
+
+	return wallets
+}
+
+// Metrics returns the current balance of each wallet in ETH for the profile
+// history.
+func Metrics() (map[string]float64, error) {
+
+	metrics := make(map[string]float64)
+	for _, wallet := range Wallets() {
+		if current, hasBalance := latest(wallet); hasBalance {
+			metrics[BALANCE_METRIC_PREFIX+wallet.Address] = ToEth(current)
+		}
+	}
+
+	return metrics, nil
+}
+
+// Summary describes the balance of each wallet, how much it changed over the
+// last day and its last payout for the status report.
+func Summary() (string, error) {
+
+	if len(config.Cfg.EthWallets) == 0 {
+		return "No EthWallets are configured\n", nil
+	}
+
+	now := time.Now()
+	dayAgo := now.Add(-24 * time.Hour).Unix()
+
+	var summary bytes.Buffer
+	for _, wallet := range Wallets() {
+		current, hasBalance := latest(wallet)
+		if !hasBalance {
+			continue
+		}
+
+		// the balance a day ago is the last one which was set before then
+		dayAgoWei := current
+		for _, balance := range wallet.Balances {
+			if balance.Time <= dayAgo {
+				dayAgoWei, _ = new(big.Int).SetString(balance.Wei, 10)
+			}
+		}
+		change := new(big.Int).Sub(current, dayAgoWei)
+
+		summary.WriteString(fmt.Sprintf("%v: %v ETH, %v%v ETH in the last 24 hours\n", wallet.Address, FormatEth(current), sign(change), FormatEth(change)))
+
+		if wallet.LastPayout == 0 {
+			summary.WriteString(fmt.Sprintf("  No payouts since it was first checked %v ago\n", now.Sub(time.Unix(wallet.FirstSeen, 0)).Round(time.Minute)))
+		} else {
+			payout, _ := new(big.Int).SetString(wallet.PayoutWei, 10)
+			summary.WriteString(fmt.Sprintf("  Last payout of %v ETH %v ago\n", FormatEth(payout), now.Sub(time.Unix(wallet.LastPayout, 0)).Round(time.Minute)))
+		}
+
+		if wallet.Overdue {
+			summary.WriteString(fmt.Sprintf("  This is longer than the EthPayoutHours of %d\n", config.Cfg.EthPayoutHours))
+		}
+	}
+
+	return summary.String(), nil
+}
+
+// record will add the given balance to the history of the given wallet when it
+// changed and publish a PayoutReceived event when it went up or a
+// PayoutOverdue event when the last payout was too long ago.
+func record(address string, wei *big.Int, now time.Time) error {
+
+	walletLock.Lock()
+	defer walletLock.Unlock()
+
+	key := strings.ToLower(address)
+
+	var wallet Wallet
+	if _, getErr := state.Get(WALLET_BUCKET, key, &wallet); getErr != nil {
+		return fmt.Errorf("Unable to read the balance history of %v: %v", address, getErr)
+	}
+
+	if wallet.FirstSeen == 0 {
+		wallet.Address = key
+		wallet.FirstSeen = now.Unix()
+	}
+	wallet.Checked = now.Unix()
+
+	previous, hasBalance := latest(wallet)
+	if !hasBalance || previous.Cmp(wei) != 0 {
+		wallet.Balances = append(wallet.Balances, Balance{Time: now.Unix(), Wei: wei.String()})
+		if len(wallet.Balances) > MAX_BALANCE_HISTORY {
+			wallet.Balances = wallet.Balances[len(wallet.Balances)-MAX_BALANCE_HISTORY:]
+		}
+	}
+
+	var published []events.Event
+	if hasBalance && wei.Cmp(previous) > 0 {
+		payout := new(big.Int).Sub(wei, previous)
+		wallet.LastPayout = now.Unix()
+		wallet.PayoutWei = payout.String()
+		wallet.Overdue = false
+		published = append(published, events.PayoutReceived{Address: key, Amount: FormatEth(payout), Balance: FormatEth(wei)})
+		logger.Lgr.LogMessagef("Wallet %v received a payout of %v ETH", key, FormatEth(payout))
+	}
+
+	// a wallet which has never been paid is measured from when it was first checked
+	since := wallet.LastPayout
+	if since == 0 {
+		since = wallet.FirstSeen
+	}
+	waited := now.Sub(time.Unix(since, 0))
+	if config.Cfg.EthPayoutHours > 0 && !wallet.Overdue && waited > time.Duration(config.Cfg.EthPayoutHours)*time.Hour {
+		wallet.Overdue = true
+		published = append(published, events.PayoutOverdue{Address: key, Hours: waited.Hours(), Balance: FormatEth(wei)})
+		logger.Lgr.LogErrorf("Wallet %v hasn't received a payout in %v", key, waited.Round(time.Minute))
+	}
+
+	if putErr := state.Put(WALLET_BUCKET, key, wallet); putErr != nil {
+		return fmt.Errorf("Unable to save the balance history of %v: %v", address, putErr)
+	}
+
+	for _, event := range published {
+		events.Publish(event)
+	}
+
+	return nil
+}
+
+// latest returns the most recent balance of the given wallet, if it has one.
+func latest(wallet Wallet) (*big.Int, bool) {
+
+	if len(wallet.Balances) == 0 {
+		return nil, false
+	}
+
+	return new(big.Int).SetString(wallet.Balances[len(wallet.Balances)-1].Wei, 10)
+}
+
+// sign returns a plus in front of balances which went up.
+func sign(change *big.Int) string {
+	if change.Sign() >= 0 {
+		return "+"
+	}
+	return ""
+}
+
+// etherscanBalance will ask EtherscanURL for the balance of the given address
+// in wei.
+func etherscanBalance(address string) (*big.Int, error) {
+
+	query := url.Values{}
+	query.Set("chainid", MAINNET_CHAIN_ID)
+	query.Set("module", "account")
+	query.Set("action", "balance")
+	query.Set("address", address)
+	query.Set("tag", "latest")
+	if config.Cfg.EtherscanAPIKey != "" {
+		query.Set("apikey", config.Cfg.EtherscanAPIKey)
+	}
+
+	request, requestErr := http.NewRequest("GET", config.Cfg.EtherscanURL+"?"+query.Encode(), nil)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	replyBytes, sendErr := send(request)
+	if sendErr != nil {
+		return nil, sendErr
+	}
+
+	var reply etherscanResponse
+	if jsonErr := json.Unmarshal(replyBytes, &reply); jsonErr != nil {
+		return nil, fmt.Errorf("Unable to read the reply from Etherscan: %v", jsonErr)
+	}
+
+	if reply.Status != "1" {
+		return nil, fmt.Errorf("Etherscan replied with %v: %v", reply.Message, reply.Result)
+	}
+
+	wei, parsed := new(big.Int).SetString(reply.Result, 10)
+	if !parsed {
+		return nil, fmt.Errorf("Etherscan replied with a balance of %v", reply.Result)
+	}
+
+	return wei, nil
+}
+
+// send will send the given request through the transport and return the
+// body of the reply.
+func send(request *http.Request) ([]byte, error) {
+
+	client := transport.NewClient("eth", ETH_TIMEOUT_SECONDS*time.Second, transport.DEFAULT_CLIENT_RETRIES)
+	response, sendErr := client.Do(request)
+	if sendErr != nil {
+		return nil, sendErr
+	}
+	defer response.Body.Close()
+
+	if statusErr := transport.CheckStatus(response); statusErr != nil {
+		return nil, statusErr
+	}
+
+	return ioutil.ReadAll(io.LimitReader(response.Body, MAX_ETH_RESPONSE_BYTES))
+}
@@ -0,0 +1,218 @@
+package eth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/state"
+)
+
+const TEST_WALLET = "0x00000000219ab540356cBB839Cbe05303d7705Fa"
+
+func TestMain(m *testing.M) {
+
+	logErr := logger.StandardLogger("eth_test")
+	if logErr != nil {
+		fmt.Println(fmt.Sprintf("Could not initialize logger: %v", logErr))
+		return
+	}
+
+	configErr := config.FromFile()
+	if configErr != nil {
+		return
+	}
+
+	result := m.Run()
+	os.Exit(result)
+}
+
+// useTempState will point the state store at an empty file for the length of
+// the test.
+func useTempState(t *testing.T) func() {
+
+	stateDir, dirErr := ioutil.TempDir("", "eth_test")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	if openErr := state.Open(filepath.Join(stateDir, "agent_state.json")); openErr != nil {
+		t.Fatal(openErr)
+	}
+
+	return func() {
+		state.Open(config.Cfg.StateFile)
+		os.RemoveAll(stateDir)
+	}
+}
+
+func TestCheck(t *testing.T) {
+
+	defer useTempState(t)()
+	defer func(wallets []string, rpcURL string, payoutHours int) {
+		config.Cfg.EthWallets = wallets
+		config.Cfg.EthRPCURL = rpcURL
+		config.Cfg.EthPayoutHours = payoutHours
+	}(config.Cfg.EthWallets, config.Cfg.EthRPCURL, config.Cfg.EthPayoutHours)
+
+	var balanceLock sync.Mutex
+	balance := big.NewInt(1000000000000000000)
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		var call struct {
+			Method string        `json:"method"`
+			Params []interface{} `json:"params"`
+		}
+		json.NewDecoder(request.Body).Decode(&call)
+		if call.Method != "eth_getBalance" || len(call.Params) != 2 || call.Params[0] != TEST_WALLET {
+			fmt.Fprint(writer, `{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"the method does not exist"}}`)
+			return
+		}
+		balanceLock.Lock()
+		defer balanceLock.Unlock()
+		fmt.Fprintf(writer, `{"jsonrpc":"2.0","id":1,"result":"0x%x"}`, balance)
+	}))
+	defer server.Close()
+
+	published := make(chan events.Record, 10)
+	unsubscribe := events.Subscribe("eth_test", func(record events.Record) {
+		if record.Kind == events.PAYOUT_RECEIVED || record.Kind == events.PAYOUT_OVERDUE {
+			published <- record
+		}
+	})
+	defer unsubscribe()
+
+	config.Cfg.EthWallets = []string{TEST_WALLET}
+	config.Cfg.EthRPCURL = server.URL
+	config.Cfg.EthPayoutHours = 0
+
+	if checkErr := Check(); checkErr != nil {
+		t.Fatal(checkErr)
+	}
+
+	balanceLock.Lock()
+	balance.Add(balance, big.NewInt(50000000000000000))
+	balanceLock.Unlock()
+
+	if checkErr := Check(); checkErr != nil {
+		t.Fatal(checkErr)
+	}
+
+	select {
+	case record := <-published:
+		payout := record.Event.(events.PayoutReceived)
+		if payout.Amount != "0.050000" || payout.Balance != "1.050000" {
+			t.Errorf("expected a payout of 0.05 ETH, got: %+v", payout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a PayoutReceived event")
+	}
+
+	wallets := Wallets()
+	if len(wallets) != 1 || len(wallets[0].Balances) != 2 || wallets[0].LastPayout == 0 {
+		t.Fatalf("expected the balance history to hold both balances, got: %+v", wallets)
+	}
+
+	// a balance which doesn't change isn't added to the history again
+	if checkErr := Check(); checkErr != nil {
+		t.Fatal(checkErr)
+	}
+	if wallets := Wallets(); len(wallets[0].Balances) != 2 {
+		t.Errorf("expected an unchanged balance to be left out of the history, got: %+v", wallets[0].Balances)
+	}
+
+	summary, _ := Summary()
+	if !strings.Contains(summary, "1.050000 ETH") || !strings.Contains(summary, "Last payout of 0.050000 ETH") {
+		t.Errorf("expected the summary to show the balance and the last payout, got: %v", summary)
+	}
+
+	config.Cfg.EthPayoutHours = 1
+	if recordErr := record(TEST_WALLET, big.NewInt(1050000000000000000), time.Now().Add(2*time.Hour)); recordErr != nil {
+		t.Fatal(recordErr)
+	}
+
+	select {
+	case record := <-published:
+		if overdue := record.Event.(events.PayoutOverdue); overdue.Hours < 2 {
+			t.Errorf("expected the payout to be two hours overdue, got: %+v", overdue)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a PayoutOverdue event")
+	}
+
+	// an overdue payout is only reported once
+	if recordErr := record(TEST_WALLET, big.NewInt(1050000000000000000), time.Now().Add(3*time.Hour)); recordErr != nil {
+		t.Fatal(recordErr)
+	}
+	select {
+	case record := <-published:
+		t.Errorf("expected no more events, got: %+v", record.Event)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	if _, balanceErr := FetchBalance("0x1234"); balanceErr == nil {
+		t.Errorf("expected fetching the balance of an invalid address to fail")
+	}
+}
+
+func TestEtherscanBalance(t *testing.T) {
+
+	defer func(etherscanURL string, apiKey string) {
+		config.Cfg.EtherscanURL = etherscanURL
+		config.Cfg.EtherscanAPIKey = apiKey
+	}(config.Cfg.EtherscanURL, config.Cfg.EtherscanAPIKey)
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		query := request.URL.Query()
+		if query.Get("apikey") != "test-key" {
+			fmt.Fprint(writer, `{"status":"0","message":"NOTOK","result":"Invalid API Key"}`)
+			return
+		}
+		if query.Get("module") != "account" || query.Get("action") != "balance" || query.Get("address") != TEST_WALLET {
+			fmt.Fprint(writer, `{"status":"0","message":"NOTOK","result":"Error! Invalid address format"}`)
+			return
+		}
+		fmt.Fprint(writer, `{"status":"1","message":"OK","result":"2500000000000000000"}`)
+	}))
+	defer server.Close()
+
+	config.Cfg.EtherscanURL = server.URL
+	config.Cfg.EtherscanAPIKey = "test-key"
+
+	wei, balanceErr := etherscanBalance(TEST_WALLET)
+	if balanceErr != nil {
+		t.Fatal(balanceErr)
+	}
+	if FormatEth(wei) != "2.500000" {
+		t.Errorf("expected a balance of 2.5 ETH, got: %v", FormatEth(wei))
+	}
+
+	config.Cfg.EtherscanAPIKey = "wrong-key"
+	if _, balanceErr := etherscanBalance(TEST_WALLET); balanceErr == nil || !strings.Contains(balanceErr.Error(), "Invalid API Key") {
+		t.Errorf("expected the error Etherscan replied with, got: %v", balanceErr)
+	}
+}
+
+func TestParseQuantity(t *testing.T) {
+
+	if value, parseErr := ParseQuantity("0x1b4"); parseErr != nil || value.Int64() != 436 {
+		t.Errorf("expected 0x1b4 to be 436, got: %v %v", value, parseErr)
+	}
+
+	for _, invalid := range []string{"1b4", "0xzz", ""} {
+		if _, parseErr := ParseQuantity(invalid); parseErr == nil {
+			t.Errorf("expected %q not to parse", invalid)
+		}
+	}
+}
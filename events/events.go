@@ -0,0 +1,568 @@
+package events
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The number of events buffered for each subscriber before new events are
+// dropped for that subscriber
+const SUBSCRIBER_BUFFER_SIZE = 100
+
+// The number of recently published events held on to for late subscribers
+const MAX_RECENT_EVENTS = 200
+
+// The kinds of events published by the various packages
+const UPDATE_APPLIED = "UpdateApplied"
+const JOB_CRASHED = "JobCrashed"
+const THRESHOLD_BREACHED = "ThresholdBreached"
+const CONFIG_CHANGED = "ConfigChanged"
+const PUBLIC_IP_CHANGED = "PublicIPChanged"
+const CONNECTIVITY_CHANGED = "ConnectivityChanged"
+const AGENT_CRASHED = "AgentCrashed"
+const CLOCK_SKEWED = "ClockSkewed"
+const PAYOUT_RECEIVED = "PayoutReceived"
+const PAYOUT_OVERDUE = "PayoutOverdue"
+const NODE_UNHEALTHY = "NodeUnhealthy"
+const NODE_RESTARTED = "NodeRestarted"
+const CERTIFICATE_PIN_MISMATCH = "CertificatePinMismatch"
+const UPDATE_REJECTED = "UpdateRejected"
+const TOKEN_EXPIRING = "TokenExpiring"
+const POSTURE_CHANGED = "PostureChanged"
+const APPROVAL_REQUESTED = "ApprovalRequested"
+const INTEGRITY_VIOLATED = "IntegrityViolated"
+const UPDATE_ROLLED_BACK = "UpdateRolledBack"
+const UPDATE_PROGRESS = "UpdateProgress"
+
+// The stages of an update reported by UpdateProgress events, in the order
+// they happen
+const UPDATE_STAGE_CHECKING = "checking"
+const UPDATE_STAGE_DOWNLOADING = "downloading"
+const UPDATE_STAGE_VERIFYING = "verifying"
+const UPDATE_STAGE_WAITING = "waiting"
+const UPDATE_STAGE_SCANNING = "scanning"
+const UPDATE_STAGE_SWAPPING = "swapping"
+const UPDATE_STAGE_HEALTHY = "healthy"
+const UPDATE_STAGE_RESTARTING = "restarting"
+
+// Event is something noteworthy which happened inside of one package that
+// other packages may want to react to. Packages publish events to the bus
+// rather than calling each other directly so that the reporter, logger and
+// REST interface can each decide for themselves what to do about them.
+type Event interface {
+	Kind() string    // The canonical name of this type of event
+	Summary() string // A human readable, single line description of the event
+}
+
+// UpdateApplied is published after a newer version has been installed.
+type UpdateApplied struct {
+	FromVersion uint64 `json:"fromVersion"`
+	ToVersion   uint64 `json:"toVersion"`
+}
+
+// Kind returns UPDATE_APPLIED.
+func (ua UpdateApplied) Kind() string {
+	return UPDATE_APPLIED
+}
+
+// Summary describes an applied update.
+func (ua UpdateApplied) Summary() string {
+	return fmt.Sprintf("Updated from version %d to version %d", ua.FromVersion, ua.ToVersion)
+}
+
+// JobCrashed is published when a process managed by a loader exits with an
+// error.
+type JobCrashed struct {
+	Name       string `json:"name"`
+	ExitStatus string `json:"exitStatus"`
+	Runs       uint64 `json:"runs"`
+}
+
+// Kind returns JOB_CRASHED.
+func (jc JobCrashed) Kind() string {
+	return JOB_CRASHED
+}
+
+// Summary describes a crashed job.
+func (jc JobCrashed) Summary() string {
+	return fmt.Sprintf("Job %v crashed on run %d: %v", jc.Name, jc.Runs, jc.ExitStatus)
+}
+
+// ThresholdBreached is published when a monitored value crosses its limit.
+type ThresholdBreached struct {
+	Metric string  `json:"metric"`
+	Value  float64 `json:"value"`
+	Limit  float64 `json:"limit"`
+	Detail string  `json:"detail"`
+}
+
+// Kind returns THRESHOLD_BREACHED.
+func (tb ThresholdBreached) Kind() string {
+	return THRESHOLD_BREACHED
+}
+
+// Summary describes a breached threshold.
+func (tb ThresholdBreached) Summary() string {
+	return fmt.Sprintf("%v reached %v which breaches the limit of %v. %v", tb.Metric, tb.Value, tb.Limit, tb.Detail)
+}
+
+// ConfigChanged is published whenever the config is loaded from or saved to
+// disk.
+type ConfigChanged struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+}
+
+// Kind returns CONFIG_CHANGED.
+func (cc ConfigChanged) Kind() string {
+	return CONFIG_CHANGED
+}
+
+// Summary describes a config change.
+func (cc ConfigChanged) Summary() string {
+	return fmt.Sprintf("Config %v: %v", cc.Action, cc.Path)
+}
+
+// PublicIPChanged is published when the public IP address of this machine is
+// different from the last time it was resolved. Location is only set when a
+// geolocation service is configured.
+type PublicIPChanged struct {
+	PreviousIP string `json:"previousIp"`
+	CurrentIP  string `json:"currentIp"`
+	Location   string `json:"location,omitempty"`
+}
+
+// Kind returns PUBLIC_IP_CHANGED.
+func (pic PublicIPChanged) Kind() string {
+	return PUBLIC_IP_CHANGED
+}
+
+// Summary describes a public IP change.
+func (pic PublicIPChanged) Summary() string {
+	if pic.Location == "" {
+		return fmt.Sprintf("Public IP changed from %v to %v", pic.PreviousIP, pic.CurrentIP)
+	}
+	return fmt.Sprintf("Public IP changed from %v to %v in %v", pic.PreviousIP, pic.CurrentIP, pic.Location)
+}
+
+// ConnectivityChanged is published when this machine goes offline and again
+// when it comes back online along with how long the outage lasted.
+type ConnectivityChanged struct {
+	Online        bool    `json:"online"`
+	OutageSeconds float64 `json:"outageSeconds,omitempty"`
+}
+
+// Kind returns CONNECTIVITY_CHANGED.
+func (cc ConnectivityChanged) Kind() string {
+	return CONNECTIVITY_CHANGED
+}
+
+// Summary describes a connectivity change.
+func (cc ConnectivityChanged) Summary() string {
+	if !cc.Online {
+		return "Connectivity lost. Outbound work is queued until it returns"
+	}
+	return fmt.Sprintf("Connectivity restored after an outage of %v", time.Duration(cc.OutageSeconds*float64(time.Second)))
+}
+
+// AgentCrashed is published by the watchdog when the agent it supervises exits
+// unexpectedly, before the agent is restarted.
+type AgentCrashed struct {
+	ExitStatus     string  `json:"exitStatus"`
+	Crashes        uint64  `json:"crashes"`
+	RestartSeconds float64 `json:"restartSeconds"`
+	LastStderr     string  `json:"lastStderr,omitempty"`
+}
+
+// Kind returns AGENT_CRASHED.
+func (ac AgentCrashed) Kind() string {
+	return AGENT_CRASHED
+}
+
+// Summary describes a crashed agent along with the last line it wrote to
+// stderr.
+func (ac AgentCrashed) Summary() string {
+
+	summary := fmt.Sprintf("The agent crashed for the %d time with %v. Restarting in %v", ac.Crashes, ac.ExitStatus, time.Duration(ac.RestartSeconds*float64(time.Second)))
+
+	lines := strings.Split(strings.TrimSpace(ac.LastStderr), "\n")
+	if lastLine := strings.TrimSpace(lines[len(lines)-1]); lastLine != "" {
+		summary += ". Last output: " + lastLine
+	}
+
+	return summary
+}
+
+// ClockSkewed is published when the local clock drifts further than
+// MaxClockSkewSeconds from the time sources and again once it's back within
+// it. The offset is positive when the local clock is behind.
+type ClockSkewed struct {
+	Skewed        bool    `json:"skewed"`
+	OffsetSeconds float64 `json:"offsetSeconds"`
+	Source        string  `json:"source"`
+}
+
+// Kind returns CLOCK_SKEWED.
+func (cs ClockSkewed) Kind() string {
+	return CLOCK_SKEWED
+}
+
+// Summary describes a skewed or corrected clock.
+func (cs ClockSkewed) Summary() string {
+	skew := time.Duration(cs.OffsetSeconds * float64(time.Second)).Round(time.Millisecond)
+	if !cs.Skewed {
+		return fmt.Sprintf("The local clock is only %v away from %v again", skew, cs.Source)
+	}
+	return fmt.Sprintf("The local clock is %v away from %v. Log rotation and scheduling compensate for it until it's fixed", skew, cs.Source)
+}
+
+// PayoutReceived is published when the balance of a monitored wallet goes up.
+// Amounts are in ETH.
+type PayoutReceived struct {
+	Address string `json:"address"`
+	Amount  string `json:"amount"`
+	Balance string `json:"balance"`
+}
+
+// Kind returns PAYOUT_RECEIVED.
+func (pr PayoutReceived) Kind() string {
+	return PAYOUT_RECEIVED
+}
+
+// Summary describes a received payout.
+func (pr PayoutReceived) Summary() string {
+	return fmt.Sprintf("Wallet %v received a payout of %v ETH. Its balance is now %v ETH", pr.Address, pr.Amount, pr.Balance)
+}
+
+// PayoutOverdue is published when a monitored wallet goes longer than
+// EthPayoutHours without its balance going up. It isn't published again
+// until after the next payout.
+type PayoutOverdue struct {
+	Address string  `json:"address"`
+	Hours   float64 `json:"hours"`
+	Balance string  `json:"balance"`
+}
+
+// Kind returns PAYOUT_OVERDUE.
+func (po PayoutOverdue) Kind() string {
+	return PAYOUT_OVERDUE
+}
+
+// Summary describes an overdue payout.
+func (po PayoutOverdue) Summary() string {
+	return fmt.Sprintf("Wallet %v hasn't received a payout in %v. Its balance is %v ETH", po.Address, time.Duration(po.Hours*float64(time.Hour)).Round(time.Minute), po.Balance)
+}
+
+// NodeUnhealthy is published when the supervised node is found to have a
+// problem, such as falling behind the head of the chain. It isn't published
+// again for the same problem until the problem has cleared up.
+type NodeUnhealthy struct {
+	Problem     string `json:"problem"`
+	Description string `json:"description"`
+}
+
+// Kind returns NODE_UNHEALTHY.
+func (nu NodeUnhealthy) Kind() string {
+	return NODE_UNHEALTHY
+}
+
+// Summary describes the node's problem.
+func (nu NodeUnhealthy) Summary() string {
+	return nu.Description
+}
+
+// NodeRestarted is published once the supervised node has been restarted and
+// is answering again. Dependents are the jobs which were stopped while it was
+// down.
+type NodeRestarted struct {
+	Reason     string   `json:"reason"`
+	Dependents []string `json:"dependents"`
+}
+
+// Kind returns NODE_RESTARTED.
+func (nr NodeRestarted) Kind() string {
+	return NODE_RESTARTED
+}
+
+// Summary describes the restart of the node.
+func (nr NodeRestarted) Summary() string {
+	if len(nr.Dependents) == 0 {
+		return fmt.Sprintf("The node was restarted: %v", nr.Reason)
+	}
+	return fmt.Sprintf("The node was restarted: %v. %v were stopped until it came back", nr.Reason, strings.Join(nr.Dependents, ", "))
+}
+
+// CertificatePinMismatch is published when a host with TLSPins presents a
+// certificate chain without any of them, which means the connection is being
+// intercepted or the host's keys changed. Presented are the pins of the
+// certificates it presented.
+type CertificatePinMismatch struct {
+	Host      string   `json:"host"`
+	Presented []string `json:"presented"`
+}
+
+// Kind returns CERTIFICATE_PIN_MISMATCH.
+func (cpm CertificatePinMismatch) Kind() string {
+	return CERTIFICATE_PIN_MISMATCH
+}
+
+// Summary describes the mismatched certificate.
+func (cpm CertificatePinMismatch) Summary() string {
+	return fmt.Sprintf("%v presented a certificate chain without any of its TLSPins, so the connection was refused. Either it's being intercepted or its keys changed. It presented: %v", cpm.Host, strings.Join(cpm.Presented, ", "))
+}
+
+// UpdateRejected is published when a scanner finds a downloaded update to be
+// malicious and it isn't installed.
+type UpdateRejected struct {
+	Artifact string `json:"artifact"`
+	SHA256   string `json:"sha256"`
+	Scanner  string `json:"scanner"`
+	Verdict  string `json:"verdict"`
+}
+
+// Kind returns UPDATE_REJECTED.
+func (ur UpdateRejected) Kind() string {
+	return UPDATE_REJECTED
+}
+
+// Summary describes the rejected update.
+func (ur UpdateRejected) Summary() string {
+	return fmt.Sprintf("The update %v (SHA-256 %v) was found to be malicious by %v and wasn't installed: %v", ur.Artifact, ur.SHA256, ur.Scanner, ur.Verdict)
+}
+
+// UpdateRolledBack is published when one of the components of an update
+// fails to install or fails its health check and every component already
+// installed is put back the way it was.
+type UpdateRolledBack struct {
+	ToVersion  uint64   `json:"toVersion"`
+	Component  string   `json:"component"`
+	Reason     string   `json:"reason"`
+	RolledBack []string `json:"rolledBack"`
+}
+
+// Kind returns UPDATE_ROLLED_BACK.
+func (urb UpdateRolledBack) Kind() string {
+	return UPDATE_ROLLED_BACK
+}
+
+// Summary describes the failed component and what was rolled back.
+func (urb UpdateRolledBack) Summary() string {
+	rolledBack := "nothing else had been installed"
+	if len(urb.RolledBack) > 0 {
+		rolledBack = "rolled back " + strings.Join(urb.RolledBack, ", ")
+	}
+	return fmt.Sprintf("The update to version %d failed at the %v component and %v: %v", urb.ToVersion, urb.Component, rolledBack, urb.Reason)
+}
+
+// UpdateProgress is published as an update moves through each of its stages,
+// and every few percent of each download, so a dashboard can show how far
+// along it is. Component is empty for stages which cover the whole update.
+// Percent is only set while downloading.
+type UpdateProgress struct {
+	Stage     string `json:"stage"`
+	Component string `json:"component,omitempty"`
+	Percent   int    `json:"percent,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+// Kind returns UPDATE_PROGRESS.
+func (up UpdateProgress) Kind() string {
+	return UPDATE_PROGRESS
+}
+
+// Summary describes the stage the update is at, e.g. downloading miner: 40%.
+func (up UpdateProgress) Summary() string {
+	summary := "Update " + up.Stage
+	if up.Component != "" {
+		summary += " " + up.Component
+	}
+	if up.Stage == UPDATE_STAGE_DOWNLOADING {
+		summary += fmt.Sprintf(": %d%%", up.Percent)
+	}
+	if up.Detail != "" {
+		summary += ": " + up.Detail
+	}
+	return summary
+}
+
+// TokenExpiring is published every day while one of the REST server's tokens
+// is about to expire or has expired without being removed.
+type TokenExpiring struct {
+	Name    string    `json:"name"`
+	Expires time.Time `json:"expires"`
+}
+
+// Kind returns TOKEN_EXPIRING.
+func (te TokenExpiring) Kind() string {
+	return TOKEN_EXPIRING
+}
+
+// Summary describes the expiring token.
+func (te TokenExpiring) Summary() string {
+	if time.Now().After(te.Expires) {
+		return fmt.Sprintf("The REST token %v expired at %v and is no longer accepted. Rotate it or remove it from the RestTokens", te.Name, te.Expires.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("The REST token %v expires at %v, in %v. Rotate it before then", te.Name, te.Expires.Format(time.RFC3339), time.Until(te.Expires).Round(time.Hour))
+}
+
+// PostureChanged is published when the security relevant state of the machine,
+// such as its users or listening ports, changed since the last snapshot.
+type PostureChanged struct {
+	Changes []string `json:"changes"`
+}
+
+// Kind returns POSTURE_CHANGED.
+func (pc PostureChanged) Kind() string {
+	return POSTURE_CHANGED
+}
+
+// Summary describes the changes.
+func (pc PostureChanged) Summary() string {
+	return fmt.Sprintf("The security posture of this machine changed: %v", strings.Join(pc.Changes, "; "))
+}
+
+// ApprovalRequested is published when a REST action which needs a second
+// admin's approval is held until someone approves it.
+type ApprovalRequested struct {
+	Id          string `json:"id"`
+	Action      string `json:"action"`
+	Request     string `json:"request"`
+	RequestedBy string `json:"requestedBy"`
+}
+
+// Kind returns APPROVAL_REQUESTED.
+func (ar ApprovalRequested) Kind() string {
+	return APPROVAL_REQUESTED
+}
+
+// Summary describes the held action.
+func (ar ApprovalRequested) Summary() string {
+	return fmt.Sprintf("The REST token %v is waiting for a second admin to approve %v %v: %v", ar.RequestedBy, ar.Action, ar.Id, ar.Request)
+}
+
+// IntegrityViolated is published when the running executable or one of its
+// key assets no longer matches the hash recorded when it was installed or
+// updated.
+type IntegrityViolated struct {
+	Files []string `json:"files"`
+}
+
+// Kind returns INTEGRITY_VIOLATED.
+func (iv IntegrityViolated) Kind() string {
+	return INTEGRITY_VIOLATED
+}
+
+// Summary describes the modified files.
+func (iv IntegrityViolated) Summary() string {
+	return fmt.Sprintf("The agent was modified outside of the updater: %v", strings.Join(iv.Files, "; "))
+}
+
+// Record is a single published event along with when it was published.
+type Record struct {
+	Time  time.Time `json:"time"`
+	Kind  string    `json:"kind"`
+	Event Event     `json:"event"`
+}
+
+// Handler is called with every event published after it subscribed.
+type Handler func(record Record)
+
+// subscriber delivers events to a single handler in the order they were
+// published without blocking the publisher.
+type subscriber struct {
+	name    string
+	records chan Record
+	dropped uint64
+}
+
+var subscribers = make(map[int]*subscriber)
+var nextSubscriberId int
+var recent []Record
+var busLock sync.Mutex
+
+// Subscribe will call the given handler with every event published from now
+// on. Each subscriber receives events on its own goroutine so a slow handler
+// only delays itself. If a handler falls more than SUBSCRIBER_BUFFER_SIZE
+// events behind then new events are dropped for it. The returned function
+// stops the subscription.
+func Subscribe(name string, handler Handler) func() {
+
+	sub := &subscriber{name: name, records: make(chan Record, SUBSCRIBER_BUFFER_SIZE)}
+
+	busLock.Lock()
+	id := nextSubscriberId
+	nextSubscriberId++
+	subscribers[id] = sub
+	busLock.Unlock()
+
+	go func() {
+		for record := range sub.records {
+			handler(record)
+		}
+	}()
+
+	return func() {
+		busLock.Lock()
+		defer busLock.Unlock()
+
+		if _, exists := subscribers[id]; exists {
+			delete(subscribers, id)
+			close(sub.records)
+		}
+	}
+}
+
+// Publish will deliver the event to every current subscriber. It never blocks.
+func Publish(event Event) {
+
+	record := Record{Time: time.Now(), Kind: event.Kind(), Event: event}
+
+	busLock.Lock()
+	defer busLock.Unlock()
+
+	recent = append(recent, record)
+	if len(recent) > MAX_RECENT_EVENTS {
+		recent = recent[len(recent)-MAX_RECENT_EVENTS:]
+	}
+
+	for _, sub := range subscribers {
+		select {
+		case sub.records <- record:
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// Recent returns up to count of the most recently published events, oldest
+// first.
+func Recent(count int) []Record {
+
+	busLock.Lock()
+	defer busLock.Unlock()
+
+	start := 0
+	if len(recent) > count {
+		start = len(recent) - count
+	}
+
+	records := make([]Record, len(recent)-start)
+	copy(records, recent[start:])
+	return records
+}
+
+// Dropped returns the number of events which have been dropped for each
+// subscriber, by name, because it fell too far behind.
+func Dropped() map[string]uint64 {
+
+	busLock.Lock()
+	defer busLock.Unlock()
+
+	dropped := make(map[string]uint64)
+	for _, sub := range subscribers {
+		dropped[sub.name] += sub.dropped
+	}
+	return dropped
+}
@@ -0,0 +1,70 @@
+package events
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+
+	result := m.Run()
+	os.Exit(result)
+}
+
+func TestPublishAndSubscribe(t *testing.T) {
+
+	received := make(chan Record, 10)
+	unsubscribe := Subscribe("test", func(record Record) {
+		received <- record
+	})
+
+	Publish(JobCrashed{Name: "miner", ExitStatus: "exit status 1", Runs: 3})
+	Publish(UpdateApplied{FromVersion: 1, ToVersion: 2})
+
+	for _, kind := range []string{JOB_CRASHED, UPDATE_APPLIED} {
+		select {
+		case record := <-received:
+			if record.Kind != kind || record.Event.Kind() != kind {
+				t.Errorf("expected a %v event, got: %+v", kind, record)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for a %v event", kind)
+		}
+	}
+
+	unsubscribe()
+	unsubscribe()
+
+	Publish(ConfigChanged{Path: "config.json", Action: "saved"})
+
+	select {
+	case record := <-received:
+		t.Errorf("received an event after unsubscribing: %+v", record)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	recent := Recent(2)
+	if len(recent) != 2 || recent[0].Kind != UPDATE_APPLIED || recent[1].Kind != CONFIG_CHANGED {
+		t.Errorf("Recent returned the wrong events: %+v", recent)
+	}
+}
+
+func TestSlowSubscriberDropsEvents(t *testing.T) {
+
+	block := make(chan bool)
+	unsubscribe := Subscribe("slow", func(record Record) {
+		<-block
+	})
+	defer unsubscribe()
+
+	for count := 0; count < SUBSCRIBER_BUFFER_SIZE+10; count++ {
+		Publish(ThresholdBreached{Metric: "test", Value: float64(count), Limit: 1})
+	}
+
+	if Dropped()["slow"] == 0 {
+		t.Errorf("expected events to be dropped for a slow subscriber")
+	}
+
+	close(block)
+}
@@ -0,0 +1,180 @@
+package inbox
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/transport"
+)
+
+// The maximum amount of time to wait on the IMAP server before giving up
+const IMAP_TIMEOUT_SECONDS = 60
+
+// imapClient is a deliberately tiny IMAP4rev1 client which only supports what
+// the command channel needs: logging in, searching a mailbox for unread
+// messages, fetching them and marking them as read.
+type imapClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	tag    int
+}
+
+// dialIMAP will open a TLS connection to the given IMAP server and consume
+// the server greeting. The connection is made via the transport package so
+// it honours ProxyURL.
+func dialIMAP(address string) (*imapClient, error) {
+
+	rawConn, dialErr := transport.Dial("tcp", address)
+	if dialErr != nil {
+		return nil, dialErr
+	}
+
+	conn := tls.Client(rawConn, transport.TLSConfig(strings.Split(address, ":")[0]))
+	conn.SetDeadline(time.Now().Add(IMAP_TIMEOUT_SECONDS * time.Second))
+	if handshakeErr := conn.Handshake(); handshakeErr != nil {
+		rawConn.Close()
+		return nil, handshakeErr
+	}
+	conn.SetDeadline(time.Time{})
+
+	client := &imapClient{conn: conn, reader: bufio.NewReader(conn)}
+
+	greeting, readErr := client.readLine()
+	if readErr != nil {
+		conn.Close()
+		return nil, readErr
+	}
+
+	if !strings.HasPrefix(greeting, "* OK") {
+		conn.Close()
+		return nil, fmt.Errorf("Unexpected IMAP greeting: %v", greeting)
+	}
+
+	return client, nil
+}
+
+// readLine will read a single CRLF terminated line from the server.
+func (ic *imapClient) readLine() (string, error) {
+	ic.conn.SetReadDeadline(time.Now().Add(IMAP_TIMEOUT_SECONDS * time.Second))
+	line, readErr := ic.reader.ReadString('\n')
+	return strings.TrimRight(line, "\r\n"), readErr
+}
+
+// command will send the given command to the server and collect every
+// untagged response line until the tagged completion is received. Literals
+// ({n} followed by n bytes) are returned separately in the order they appear.
+func (ic *imapClient) command(format string, values ...interface{}) ([]string, [][]byte, error) {
+
+	ic.tag++
+	tag := fmt.Sprintf("a%03d", ic.tag)
+
+	ic.conn.SetWriteDeadline(time.Now().Add(IMAP_TIMEOUT_SECONDS * time.Second))
+	if _, writeErr := fmt.Fprintf(ic.conn, "%v %v\r\n", tag, fmt.Sprintf(format, values...)); writeErr != nil {
+		return nil, nil, writeErr
+	}
+
+	var lines []string
+	var literals [][]byte
+
+	for {
+		line, readErr := ic.readLine()
+		if readErr != nil {
+			return nil, nil, readErr
+		}
+
+		if strings.HasPrefix(line, tag+" ") {
+			status := strings.TrimPrefix(line, tag+" ")
+			if !strings.HasPrefix(status, "OK") {
+				return lines, literals, fmt.Errorf("IMAP command failed: %v", status)
+			}
+			return lines, literals, nil
+		}
+
+		lines = append(lines, line)
+
+		// read in any literal announced at the end of the line
+		if strings.HasSuffix(line, "}") {
+			open := strings.LastIndex(line, "{")
+			size, sizeErr := strconv.Atoi(line[open+1 : len(line)-1])
+			if open >= 0 && sizeErr == nil {
+				literal := make([]byte, size)
+				if _, literalErr := io.ReadFull(ic.reader, literal); literalErr != nil {
+					return nil, nil, literalErr
+				}
+				literals = append(literals, literal)
+			}
+		}
+	}
+}
+
+// login will authenticate with the server.
+func (ic *imapClient) login(username string, password string) error {
+	_, _, loginErr := ic.command("LOGIN %v %v", quote(username), quote(password))
+	return loginErr
+}
+
+// selectMailbox will open the given mailbox for reading and writing.
+func (ic *imapClient) selectMailbox(mailbox string) error {
+	_, _, selectErr := ic.command("SELECT %v", quote(mailbox))
+	return selectErr
+}
+
+// searchUnseen returns the UID of every unread message with the given text in
+// its subject.
+func (ic *imapClient) searchUnseen(subject string) ([]string, error) {
+
+	lines, _, searchErr := ic.command("UID SEARCH UNSEEN SUBJECT %v", quote(subject))
+	if searchErr != nil {
+		return nil, searchErr
+	}
+
+	var uids []string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "* SEARCH") {
+			uids = append(uids, strings.Fields(strings.TrimPrefix(line, "* SEARCH"))...)
+		}
+	}
+
+	return uids, nil
+}
+
+// fetch returns the raw RFC 822 message with the given UID without marking it
+// as read.
+func (ic *imapClient) fetch(uid string) ([]byte, error) {
+
+	_, literals, fetchErr := ic.command("UID FETCH %v (BODY.PEEK[])", uid)
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+
+	if len(literals) == 0 {
+		return nil, fmt.Errorf("IMAP server returned no message for UID %v", uid)
+	}
+
+	return literals[0], nil
+}
+
+// markSeen will flag the message with the given UID as read.
+func (ic *imapClient) markSeen(uid string) error {
+	_, _, storeErr := ic.command("UID STORE %v +FLAGS (\\Seen)", uid)
+	return storeErr
+}
+
+// logout will politely end the session and close the connection.
+func (ic *imapClient) logout() {
+	ic.command("LOGOUT")
+	ic.conn.Close()
+}
+
+// quote will wrap the value in an IMAP quoted string.
+func quote(value string) string {
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	value = strings.Replace(value, "\"", "\\\"", -1)
+	return "\"" + value + "\""
+}
@@ -0,0 +1,315 @@
+package inbox
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/reporter"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The text which must appear in the subject of every command email
+const COMMAND_SUBJECT = "anon-eth-net command"
+
+// The subject of the reply sent after a command has been executed
+const COMMAND_REPLY_SUBJECT = "Result of command: %v"
+
+// The maximum number of seconds a command timestamp can differ from our clock
+const MAX_COMMAND_AGE_SECONDS = 300
+
+// The names of each of the lines in the body of a command email
+const COMMAND_FIELD = "command"
+const TIMESTAMP_FIELD = "timestamp"
+const ARGS_FIELD = "args"
+const SIGNATURE_FIELD = "signature"
+
+// CommandHandler executes a single command with the given arguments and
+// returns a human readable result, plus any files, to reply to the sender with.
+type CommandHandler func(args []string) (string, []reporter.Attachment, error)
+
+// Command is a single verified request parsed out of a command email.
+type Command struct {
+	From      string
+	Name      string
+	Args      []string
+	Timestamp int64
+	Signature string
+}
+
+var handlers = make(map[string]CommandHandler)
+var handlersLock sync.Mutex
+
+// the signatures of the commands which have been verified and when, so the
+// same email can't be executed twice
+var verifiedSignatures = make(map[string]time.Time)
+var verifiedLock sync.Mutex
+
+// RegisterCommand will execute the given handler whenever a verified command
+// email with the given name is received.
+func RegisterCommand(name string, handler CommandHandler) {
+	handlersLock.Lock()
+	defer handlersLock.Unlock()
+
+	handlers[name] = handler
+	logger.Lgr.LogMessagef("Successfully registered email command: %v", name)
+}
+
+// Registered returns true if a handler is registered for the given command.
+func Registered(name string) bool {
+	handlersLock.Lock()
+	defer handlersLock.Unlock()
+
+	_, found := handlers[name]
+	return found
+}
+
+// Run will poll the configured IMAP server for new command emails every
+// CommandPollSeconds. Each verified command is executed and the result is
+// emailed back to the sender. Does nothing when CommandIMAPServer isn't set.
+func Run() {
+
+	if config.Cfg.CommandIMAPServer == "" {
+		logger.Lgr.LogMessage("No CommandIMAPServer configured. Email commands are disabled.")
+		return
+	}
+
+	go func() {
+		for 1 == 1 {
+			if pollErr := Poll(); pollErr != nil {
+				logger.Lgr.LogErrorf("Failed to poll %v for command emails: %v", config.Cfg.CommandIMAPServer, pollErr)
+			}
+
+			time.Sleep(time.Duration(config.Cfg.CommandPollSeconds) * time.Second)
+		}
+	}()
+}
+
+// Poll will check the configured IMAP server once for unread command emails.
+// Every command email is marked as read whether or not it's valid so that it
+// isn't processed twice.
+func Poll() error {
+
+	client, dialErr := dialIMAP(config.Cfg.CommandIMAPServer)
+	if dialErr != nil {
+		return dialErr
+	}
+	defer client.logout()
+
+	if loginErr := client.login(config.Cfg.CheckInGmailAddress, config.Cfg.CheckInGmailPassword); loginErr != nil {
+		return loginErr
+	}
+
+	if selectErr := client.selectMailbox("INBOX"); selectErr != nil {
+		return selectErr
+	}
+
+	uids, searchErr := client.searchUnseen(COMMAND_SUBJECT)
+	if searchErr != nil {
+		return searchErr
+	}
+
+	logger.Lgr.LogMessagef("Successfully found %d unread command emails", len(uids))
+
+	for _, uid := range uids {
+		raw, fetchErr := client.fetch(uid)
+		if fetchErr != nil {
+			return fetchErr
+		}
+
+		if seenErr := client.markSeen(uid); seenErr != nil {
+			return seenErr
+		}
+
+		command, parseErr := ParseCommand(raw)
+		if parseErr != nil {
+			logger.Lgr.LogErrorf("Ignoring command email %v: %v", uid, parseErr)
+			continue
+		}
+
+		if verifyErr := command.Verify(config.Cfg.CommandSecret, time.Now()); verifyErr != nil {
+			logger.Lgr.LogErrorf("Ignoring command email %v from %v: %v", uid, command.From, verifyErr)
+			continue
+		}
+
+		execute(command)
+	}
+
+	return nil
+}
+
+// Dispatch will run the handler registered for the named command with the
+// given arguments. Commands received over other channels, such as the fleet
+// server, share the handlers registered for email commands.
+func Dispatch(name string, args []string) (string, []reporter.Attachment, error) {
+
+	handlersLock.Lock()
+	handler, exists := handlers[name]
+	handlersLock.Unlock()
+
+	if !exists {
+		return "", nil, fmt.Errorf("Unknown command: %v", name)
+	}
+
+	return handler(args)
+}
+
+// execute will run the handler registered for the command and email the
+// result back to the sender.
+func execute(command Command) {
+
+	var result string
+	var attachments []reporter.Attachment
+	if output, files, handlerErr := Dispatch(command.Name, command.Args); handlerErr != nil {
+		result = fmt.Sprintf("Command %v failed: %v\n%v", command.Name, handlerErr, output)
+	} else {
+		result = output
+		attachments = files
+	}
+
+	logger.Lgr.LogMessagef("Executed email command %v %v from %v", command.Name, command.Args, command.From)
+
+	subject := fmt.Sprintf(COMMAND_REPLY_SUBJECT, command.Name)
+	if replyErr := reporter.SendReportTo([]string{command.From}, subject, []byte(result), attachments); replyErr != nil {
+		logger.Lgr.LogErrorf("Failed to reply to email command %v from %v: %v", command.Name, command.From, replyErr)
+	}
+}
+
+// ParseCommand will read the sender and the command fields out of the given
+// raw RFC 822 email. The body must contain one line for each of the command,
+// timestamp, args and signature fields in the form 'field: value'. Args are
+// separated by spaces and may be omitted.
+func ParseCommand(raw []byte) (Command, error) {
+
+	message, readErr := mail.ReadMessage(bytes.NewReader(raw))
+	if readErr != nil {
+		return Command{}, readErr
+	}
+
+	from, fromErr := mail.ParseAddress(message.Header.Get("From"))
+	if fromErr != nil {
+		return Command{}, fromErr
+	}
+
+	body, bodyErr := plainTextBody(message.Header.Get("Content-Type"), message.Body)
+	if bodyErr != nil {
+		return Command{}, bodyErr
+	}
+
+	fields := make(map[string]string)
+	for _, line := range strings.Split(string(body), "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 {
+			fields[strings.ToLower(strings.TrimSpace(parts[0]))] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	if fields[COMMAND_FIELD] == "" {
+		return Command{}, fmt.Errorf("Command email is missing the %v line", COMMAND_FIELD)
+	}
+
+	timestamp, timestampErr := strconv.ParseInt(fields[TIMESTAMP_FIELD], 10, 64)
+	if timestampErr != nil {
+		return Command{}, fmt.Errorf("Command email has an invalid %v line: %v", TIMESTAMP_FIELD, timestampErr)
+	}
+
+	return Command{
+		From:      from.Address,
+		Name:      fields[COMMAND_FIELD],
+		Args:      strings.Fields(fields[ARGS_FIELD]),
+		Timestamp: timestamp,
+		Signature: fields[SIGNATURE_FIELD],
+	}, nil
+}
+
+// plainTextBody returns the body of the email. For multipart emails the first
+// text/plain part is used.
+func plainTextBody(contentType string, body io.Reader) ([]byte, error) {
+
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return ioutil.ReadAll(body)
+	}
+
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, partErr := reader.NextPart()
+		if partErr != nil {
+			return nil, fmt.Errorf("Command email has no text/plain part: %v", partErr)
+		}
+
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if partType == "text/plain" {
+			return ioutil.ReadAll(part)
+		}
+	}
+}
+
+// Verify will make sure the command came from an allowed sender, was signed
+// with the given secret, isn't more than MAX_COMMAND_AGE_SECONDS away from
+// now, and hasn't already been verified, so emails can't be replayed.
+func (cmd Command) Verify(secret string, now time.Time) error {
+
+	allowed := false
+	for _, sender := range config.Cfg.CommandAllowedSenders {
+		if strings.EqualFold(sender, cmd.From) {
+			allowed = true
+		}
+	}
+
+	if !allowed {
+		return fmt.Errorf("%v is not an allowed command sender", cmd.From)
+	}
+
+	expected := SignCommand(secret, cmd.Name, cmd.Timestamp, cmd.Args)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(cmd.Signature))) {
+		return fmt.Errorf("Command %v has an invalid signature", cmd.Name)
+	}
+
+	age := now.Unix() - cmd.Timestamp
+	if age > MAX_COMMAND_AGE_SECONDS || age < -MAX_COMMAND_AGE_SECONDS {
+		return fmt.Errorf("Command %v has a timestamp %d seconds away from now", cmd.Name, age)
+	}
+
+	verifiedLock.Lock()
+	defer verifiedLock.Unlock()
+
+	// a signature older than twice the allowed age has a timestamp which
+	// would be refused anyway
+	for signature, verified := range verifiedSignatures {
+		if now.Sub(verified) > 2*MAX_COMMAND_AGE_SECONDS*time.Second {
+			delete(verifiedSignatures, signature)
+		}
+	}
+
+	signature := strings.ToLower(cmd.Signature)
+	if _, seen := verifiedSignatures[signature]; seen {
+		return fmt.Errorf("Command %v has already been executed", cmd.Name)
+	}
+
+	verifiedSignatures[signature] = now
+	return nil
+}
+
+// SignCommand returns the hex encoded HMAC-SHA256 of the command name,
+// timestamp and args, encoded by utils.SigningArgs, joined by newlines using
+// the given secret. This is the value the signature line of a command email
+// must hold.
+func SignCommand(secret string, name string, timestamp int64, args []string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(name + "\n" + strconv.FormatInt(timestamp, 10) + "\n" + utils.SigningArgs(args)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,93 @@
+package inbox
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+func TestMain(m *testing.M) {
+
+	logErr := logger.StandardLogger("inbox_test")
+	if logErr != nil {
+		fmt.Println(fmt.Sprintf("Could not initialize logger: %v", logErr))
+		return
+	}
+
+	configErr := config.FromFile()
+	if configErr != nil {
+		fmt.Println(fmt.Sprintf("Could not initialize config: %v", configErr))
+		return
+	}
+
+	result := m.Run()
+	os.Exit(result)
+}
+
+func commandEmail(from string, contentType string, body string) []byte {
+	return []byte(fmt.Sprintf("From: Operator <%v>\r\nSubject: %v\r\nContent-Type: %v\r\n\r\n%v", from, COMMAND_SUBJECT, contentType, body))
+}
+
+func TestParseAndVerifyCommand(t *testing.T) {
+
+	now := time.Now()
+	secret := "correct horse battery staple"
+	sender := config.Cfg.CommandAllowedSenders[0]
+	signature := SignCommand(secret, "restart", now.Unix(), []string{"miner"})
+
+	body := fmt.Sprintf("command: restart\r\ntimestamp: %d\r\nargs: miner\r\nsignature: %v\r\n", now.Unix(), signature)
+
+	command, parseErr := ParseCommand(commandEmail(sender, "text/plain", body))
+	if parseErr != nil {
+		t.Fatalf("ParseCommand failed: %v", parseErr)
+	}
+
+	if command.From != sender || command.Name != "restart" || len(command.Args) != 1 || command.Args[0] != "miner" {
+		t.Errorf("ParseCommand returned the wrong command: %+v", command)
+	}
+
+	if verifyErr := command.Verify(secret, now); verifyErr != nil {
+		t.Errorf("Verify rejected a valid command: %v", verifyErr)
+	}
+
+	if command.Verify(secret, now.Add(time.Second)) == nil {
+		t.Errorf("Verify accepted the same command twice")
+	}
+
+	if command.Verify("wrong secret", now) == nil {
+		t.Errorf("Verify accepted a command signed with the wrong secret")
+	}
+
+	if command.Verify(secret, now.Add((MAX_COMMAND_AGE_SECONDS+1)*time.Second)) == nil {
+		t.Errorf("Verify accepted a command which was too old")
+	}
+
+	command.From = "stranger@example.com"
+	if command.Verify(secret, now) == nil {
+		t.Errorf("Verify accepted a command from a sender which isn't allowed")
+	}
+}
+
+func TestParseMultipartCommand(t *testing.T) {
+
+	body := "--BOUNDARY\r\nContent-Type: text/html\r\n\r\n<p>command: logs</p>\r\n" +
+		"--BOUNDARY\r\nContent-Type: text/plain; charset=utf-8\r\n\r\ncommand: logs\r\ntimestamp: 1500000000\r\nsignature: abc\r\n" +
+		"--BOUNDARY--\r\n"
+
+	command, parseErr := ParseCommand(commandEmail("operator@example.com", "multipart/alternative; boundary=BOUNDARY", body))
+	if parseErr != nil {
+		t.Fatalf("ParseCommand failed: %v", parseErr)
+	}
+
+	if command.Name != "logs" || command.Timestamp != 1500000000 || len(command.Args) != 0 {
+		t.Errorf("ParseCommand returned the wrong command: %+v", command)
+	}
+
+	if _, missingErr := ParseCommand(commandEmail("operator@example.com", "text/plain", "timestamp: 1500000000\r\n")); missingErr == nil {
+		t.Errorf("ParseCommand accepted an email without a command line")
+	}
+}
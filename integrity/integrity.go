@@ -0,0 +1,373 @@
+// The integrity package records signed hashes of the running executable and
+// its key assets whenever they're installed or updated, and verifies them
+// periodically so anything modified outside of the updater gets noticed.
+package integrity
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/state"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The state bucket and key the signed manifest is kept under
+const STATE_BUCKET = "integrity"
+const MANIFEST_KEY = "manifest"
+
+// The number of random bytes in a newly generated signing key
+const KEY_BYTES = 32
+
+// The hash recorded for a file which doesn't exist
+const MISSING = "missing"
+
+// The reasons a manifest is recorded for
+const INSTALL_REASON = "install"
+const TRACKED_FILES_REASON = "tracked files changed"
+
+// Manifest is the SHA-256 hash of every tracked file at the time it was
+// installed or updated. Signature is the HMAC-SHA256 of everything else in
+// the manifest using the key in the IntegrityKeyFile.
+type Manifest struct {
+	Recorded  int64             `json:"recorded"`
+	Reason    string            `json:"reason"`
+	Version   uint64            `json:"version"`
+	Files     map[string]string `json:"files"`
+	Signature string            `json:"signature"`
+}
+
+// Mismatch is a single tracked file whose hash isn't the one recorded in the
+// manifest. Path is the IntegrityKeyFile or MANIFEST_KEY when the manifest
+// itself can't be trusted.
+type Mismatch struct {
+	Path     string `json:"path"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// String describes the mismatch in a single line.
+func (m Mismatch) String() string {
+	switch {
+	case m.Path == MANIFEST_KEY:
+		return "the recorded hashes aren't signed by the integrity key"
+	case m.Actual == MISSING:
+		return fmt.Sprintf("%v is missing", m.Path)
+	case m.Expected == MISSING:
+		return fmt.Sprintf("%v appeared with sha256 %v", m.Path, m.Actual)
+	}
+	return fmt.Sprintf("%v was modified: expected sha256 %v, found %v", m.Path, m.Expected, m.Actual)
+}
+
+// The result of the last check, for the status report
+var lastChecked time.Time
+var lastMismatches []Mismatch
+var checkLock sync.Mutex
+
+// Run will verify the tracked files now and every IntegrityCheckMinutes.
+func Run() {
+
+	go func() {
+		for 1 == 1 {
+			if _, checkErr := Check(); checkErr != nil {
+				logger.Lgr.LogErrorf("Failed to verify the integrity of the agent: %v", checkErr)
+			}
+
+			time.Sleep(time.Duration(config.Cfg.IntegrityCheckMinutes) * time.Minute)
+		}
+	}()
+}
+
+// Check will verify every tracked file against the signed manifest and return
+// the files which don't match. A CRITICAL IntegrityViolated event is published
+// whenever the mismatches differ from the previous check. The first check
+// records the manifest instead, as does a check which finds every file intact
+// while the set of tracked files changed, e.g. after the IntegrityAssets were
+// edited.
+func Check() ([]Mismatch, error) {
+
+	checkLock.Lock()
+	defer checkLock.Unlock()
+
+	var manifest Manifest
+	found, getErr := state.Get(STATE_BUCKET, MANIFEST_KEY, &manifest)
+	if getErr != nil {
+		return nil, getErr
+	}
+
+	if !found {
+		logger.Lgr.LogMessage("No integrity manifest has been recorded. Recording the installed files")
+		lastChecked, lastMismatches = time.Now(), nil
+		return nil, record(INSTALL_REASON)
+	}
+
+	mismatches, verifyErr := Verify(manifest)
+	if verifyErr != nil {
+		return nil, verifyErr
+	}
+
+	if !sameMismatches(mismatches, lastMismatches) && len(mismatches) > 0 {
+		descriptions := make([]string, 0, len(mismatches))
+		for _, mismatch := range mismatches {
+			descriptions = append(descriptions, mismatch.String())
+		}
+		logger.Lgr.LogErrorf("The agent was modified outside of the updater: %v", strings.Join(descriptions, "; "))
+		events.Publish(events.IntegrityViolated{Files: descriptions})
+	}
+	lastChecked, lastMismatches = time.Now(), mismatches
+
+	if len(mismatches) > 0 {
+		return mismatches, nil
+	}
+
+	if !sameFiles(manifest.Files, trackedFiles()) {
+		logger.Lgr.LogMessage("The tracked files changed. Recording them")
+		return nil, record(TRACKED_FILES_REASON)
+	}
+
+	logger.Lgr.LogMessagef("Successfully verified the integrity of %d files", len(manifest.Files))
+	return nil, nil
+}
+
+// Record will hash every tracked file and save them in a newly signed
+// manifest for the given reason, such as the version updated to. Called by
+// the updater once it has installed an update so the new files are trusted.
+func Record(reason string) error {
+
+	checkLock.Lock()
+	defer checkLock.Unlock()
+
+	lastChecked, lastMismatches = time.Now(), nil
+	return record(reason)
+}
+
+// record does the work of Record. The checkLock must be held.
+func record(reason string) error {
+
+	key, keyErr := signingKey(true)
+	if keyErr != nil {
+		return keyErr
+	}
+
+	manifest := Manifest{
+		Recorded: time.Now().Unix(),
+		Reason:   reason,
+		Version:  config.Cfg.LocalVersion,
+		Files:    make(map[string]string),
+	}
+	for _, trackedPath := range trackedFiles() {
+		manifest.Files[trackedPath] = hashFile(trackedPath)
+	}
+	manifest.Signature = sign(manifest, key)
+
+	if putErr := state.Put(STATE_BUCKET, MANIFEST_KEY, manifest); putErr != nil {
+		return putErr
+	}
+
+	logger.Lgr.LogMessagef("Successfully recorded the hashes of %d files for %v", len(manifest.Files), reason)
+	return nil
+}
+
+// Verify will check the signature of the given manifest and hash every file in
+// it, returning the files which don't match. A missing signing key or a bad
+// signature is a single mismatch, since none of the hashes can be trusted.
+func Verify(manifest Manifest) ([]Mismatch, error) {
+
+	key, keyErr := signingKey(false)
+	if os.IsNotExist(keyErr) {
+		return []Mismatch{{Path: config.Cfg.IntegrityKeyFile, Expected: "present", Actual: MISSING}}, nil
+	}
+	if keyErr != nil {
+		return nil, keyErr
+	}
+
+	if !hmac.Equal([]byte(manifest.Signature), []byte(sign(manifest, key))) {
+		return []Mismatch{{Path: MANIFEST_KEY, Expected: manifest.Signature}}, nil
+	}
+
+	paths := make([]string, 0, len(manifest.Files))
+	for recordedPath := range manifest.Files {
+		paths = append(paths, recordedPath)
+	}
+	sort.Strings(paths)
+
+	var mismatches []Mismatch
+	for _, recordedPath := range paths {
+		actual := hashFile(recordedPath)
+		if actual != manifest.Files[recordedPath] {
+			mismatches = append(mismatches, Mismatch{Path: recordedPath, Expected: manifest.Files[recordedPath], Actual: actual})
+		}
+	}
+
+	return mismatches, nil
+}
+
+// Summary describes the recorded manifest and the result of the last check.
+// Used to describe the integrity of the agent in status reports.
+func Summary() (string, error) {
+
+	var manifest Manifest
+	found, getErr := state.Get(STATE_BUCKET, MANIFEST_KEY, &manifest)
+	if getErr != nil {
+		return "", getErr
+	}
+	if !found {
+		return "No integrity manifest has been recorded yet\n", nil
+	}
+
+	checkLock.Lock()
+	checked, mismatches := lastChecked, lastMismatches
+	checkLock.Unlock()
+
+	var summary strings.Builder
+	summary.WriteString(fmt.Sprintf("%d files recorded at %v for %v\n", len(manifest.Files), time.Unix(manifest.Recorded, 0).Format(time.RFC3339), manifest.Reason))
+	if checked.IsZero() {
+		summary.WriteString("Not verified since the agent started\n")
+		return summary.String(), nil
+	}
+	if len(mismatches) == 0 {
+		summary.WriteString(fmt.Sprintf("Every file was intact %v ago\n", time.Since(checked).Round(time.Minute)))
+		return summary.String(), nil
+	}
+
+	summary.WriteString(fmt.Sprintf("%d files were modified outside of the updater %v ago:\n", len(mismatches), time.Since(checked).Round(time.Minute)))
+	for _, mismatch := range mismatches {
+		summary.WriteString(mismatch.String() + "\n")
+	}
+	return summary.String(), nil
+}
+
+// trackedFiles returns the path of the running executable and of each of the
+// IntegrityAssets, sorted.
+func trackedFiles() []string {
+
+	var paths []string
+	if executable, executableErr := os.Executable(); executableErr == nil {
+		if resolved, resolveErr := filepath.EvalSymlinks(executable); resolveErr == nil {
+			executable = resolved
+		}
+		paths = append(paths, executable)
+	} else {
+		logger.Lgr.LogErrorf("Could not find the running executable to verify: %v", executableErr)
+	}
+
+	for _, asset := range config.Cfg.IntegrityAssets {
+		paths = append(paths, assetPath(asset))
+	}
+
+	sort.Strings(paths)
+	return paths
+}
+
+// assetPath returns the path to the named asset, or to the version of it for
+// this platform, e.g. main_loader_linux.json for main_loader.json. Assets which
+// don't exist are expected directly in the assets folder.
+func assetPath(asset string) string {
+	if found, assetErr := utils.AssetPath(asset); assetErr == nil {
+		return found
+	}
+	if found, assetErr := utils.SysAssetPath(asset); assetErr == nil {
+		return found
+	}
+	return path.Join("..", utils.ASSET_ROOT_DIR, asset)
+}
+
+// hashFile returns the hex SHA-256 hash of the file at the given path, or
+// MISSING when it doesn't exist.
+func hashFile(filePath string) string {
+
+	file, openErr := os.Open(filePath)
+	if openErr != nil {
+		if os.IsNotExist(openErr) {
+			return MISSING
+		}
+		return "unreadable: " + openErr.Error()
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, copyErr := io.Copy(hash, file); copyErr != nil {
+		return "unreadable: " + copyErr.Error()
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// signingKey returns the key in the IntegrityKeyFile. When create is true a
+// missing key file is generated, readable only by the agent's user.
+func signingKey(create bool) ([]byte, error) {
+
+	encoded, readErr := ioutil.ReadFile(config.Cfg.IntegrityKeyFile)
+	if readErr == nil {
+		return hex.DecodeString(strings.TrimSpace(string(encoded)))
+	}
+	if !os.IsNotExist(readErr) || !create {
+		return nil, readErr
+	}
+
+	key := make([]byte, KEY_BYTES)
+	if _, randErr := rand.Read(key); randErr != nil {
+		return nil, randErr
+	}
+	if writeErr := ioutil.WriteFile(config.Cfg.IntegrityKeyFile, []byte(hex.EncodeToString(key)+"\n"), 0600); writeErr != nil {
+		return nil, writeErr
+	}
+
+	logger.Lgr.LogMessagef("Successfully generated the integrity key %v", config.Cfg.IntegrityKeyFile)
+	return key, nil
+}
+
+// sign returns the hex HMAC-SHA256 of the given manifest, other than its
+// signature, using the given key.
+func sign(manifest Manifest, key []byte) string {
+
+	lines := []string{fmt.Sprintf("%d", manifest.Recorded), manifest.Reason, fmt.Sprintf("%d", manifest.Version)}
+	for filePath, hash := range manifest.Files {
+		lines = append(lines, filePath+" "+hash)
+	}
+	sort.Strings(lines[3:])
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sameFiles returns whether the given manifest files are exactly the given
+// paths.
+func sameFiles(files map[string]string, paths []string) bool {
+	if len(files) != len(paths) {
+		return false
+	}
+	for _, trackedPath := range paths {
+		if _, recorded := files[trackedPath]; !recorded {
+			return false
+		}
+	}
+	return true
+}
+
+// sameMismatches returns whether the two checks found the same mismatches.
+func sameMismatches(current []Mismatch, previous []Mismatch) bool {
+	if len(current) != len(previous) {
+		return false
+	}
+	for index := range current {
+		if current[index] != previous[index] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,134 @@
+package integrity
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/state"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+func TestMain(m *testing.M) {
+
+	logErr := logger.StandardLogger("integrity_test")
+	if logErr != nil {
+		fmt.Println(fmt.Sprintf("Could not initialize logger: %v", logErr))
+		return
+	}
+
+	configErr := config.FromFile()
+	if configErr != nil {
+		return
+	}
+
+	result := m.Run()
+	os.Exit(result)
+}
+
+func TestCheck(t *testing.T) {
+
+	defer func(previous *config.Config) { config.Cfg = previous }(config.Cfg)
+	testConfig := *config.Cfg
+	config.Cfg = &testConfig
+
+	stateDir, dirErr := ioutil.TempDir("", "integrity_test")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(stateDir)
+	if openErr := state.Open(filepath.Join(stateDir, "agent_state.json")); openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer state.Open(config.Cfg.StateFile)
+
+	assetName := "integrity_test.tmp"
+	assetFile := path.Join("..", utils.ASSET_ROOT_DIR, assetName)
+	if writeErr := ioutil.WriteFile(assetFile, []byte("installed"), 0644); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	defer os.Remove(assetFile)
+
+	config.Cfg.IntegrityAssets = []string{assetName}
+	config.Cfg.IntegrityKeyFile = filepath.Join(stateDir, "integrity.key")
+
+	var publishedLock sync.Mutex
+	var published []events.IntegrityViolated
+	unsubscribe := events.Subscribe("integrity_test", func(record events.Record) {
+		if violated, isViolated := record.Event.(events.IntegrityViolated); isViolated {
+			publishedLock.Lock()
+			published = append(published, violated)
+			publishedLock.Unlock()
+		}
+	})
+	defer unsubscribe()
+
+	// the first check records the installed files
+	if mismatches, checkErr := Check(); checkErr != nil || len(mismatches) != 0 {
+		t.Fatalf("expected the first check to record the manifest, got: %v %v", mismatches, checkErr)
+	}
+	if info, statErr := os.Stat(config.Cfg.IntegrityKeyFile); statErr != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected a key readable only by the agent to be generated, got: %v %v", info, statErr)
+	}
+	if mismatches, _ := Check(); len(mismatches) != 0 {
+		t.Errorf("expected the untouched files to match, got: %v", mismatches)
+	}
+
+	// modified outside of the updater, and only reported once
+	ioutil.WriteFile(assetFile, []byte("tampered"), 0644)
+	for attempt := 0; attempt < 2; attempt++ {
+		mismatches, _ := Check()
+		if len(mismatches) != 1 || mismatches[0].Path != assetFile || mismatches[0].Actual == MISSING {
+			t.Errorf("expected the modified asset to be found, got: %v", mismatches)
+		}
+	}
+
+	// an update records the new files
+	if recordErr := Record("the update to version 2"); recordErr != nil {
+		t.Fatal(recordErr)
+	}
+	if mismatches, _ := Check(); len(mismatches) != 0 {
+		t.Errorf("expected the updated files to match, got: %v", mismatches)
+	}
+	summary, _ := Summary()
+	for _, expected := range []string{"2 files recorded", "for the update to version 2", "Every file was intact"} {
+		if !strings.Contains(summary, expected) {
+			t.Errorf("expected the summary to contain %q, got: %v", expected, summary)
+		}
+	}
+
+	os.Remove(assetFile)
+	if mismatches, _ := Check(); len(mismatches) != 1 || mismatches[0].String() != assetFile+" is missing" {
+		t.Errorf("expected the deleted asset to be found, got: %v", mismatches)
+	}
+
+	// the recorded hashes themselves were edited
+	var manifest Manifest
+	state.Get(STATE_BUCKET, MANIFEST_KEY, &manifest)
+	manifest.Files[assetFile] = MISSING
+	state.Put(STATE_BUCKET, MANIFEST_KEY, manifest)
+	if mismatches, _ := Check(); len(mismatches) != 1 || mismatches[0].Path != MANIFEST_KEY {
+		t.Errorf("expected the edited manifest to be refused, got: %v", mismatches)
+	}
+
+	os.Remove(config.Cfg.IntegrityKeyFile)
+	if mismatches, _ := Check(); len(mismatches) != 1 || mismatches[0].Path != config.Cfg.IntegrityKeyFile {
+		t.Errorf("expected the missing key to be found, got: %v", mismatches)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	publishedLock.Lock()
+	defer publishedLock.Unlock()
+	if len(published) != 4 {
+		t.Errorf("expected each new set of mismatches to be published once, got: %+v", published)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+package lifecycle
+
+import (
+	"os"
+	"syscall"
+)
+
+// Exec will replace this process with the current executable, run with the
+// same arguments and environment. The process ID stays the same so any
+// children are still its own, along with any file descriptors which weren't
+// marked close on exec. Only returns if the executable can't be run.
+func Exec() error {
+
+	executable, executableErr := os.Executable()
+	if executableErr != nil {
+		return executableErr
+	}
+
+	return syscall.Exec(executable, os.Args, os.Environ())
+}
@@ -0,0 +1,12 @@
+package lifecycle
+
+import (
+	"fmt"
+)
+
+// Exec isn't supported on windows, where a process can't replace itself. The
+// error makes the program exit so the watchdog or service manager starts it
+// again instead.
+func Exec() error {
+	return fmt.Errorf("Restarting in place isn't supported on windows. Exiting so the watchdog or service manager starts the agent again")
+}
@@ -0,0 +1,168 @@
+// The lifecycle package shuts every subsystem down in an orderly fashion when
+// the program is asked to exit. Subsystems register what they need to do to
+// stop via OnShutdown and long running work can watch Context to know when to
+// give up.
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+// How long every shutdown hook combined can take before the rest are abandoned
+// and the program exits anyway. In seconds
+const SHUTDOWN_TIMEOUT_SECONDS = 30
+
+// shutdownHook is a single named step of the shutdown.
+type shutdownHook struct {
+	name string
+	stop func(ctx context.Context) error
+}
+
+var lifecycleLock sync.Mutex
+var hooks []shutdownHook
+var reason string
+var restarting bool
+var rootContext, cancelRoot = context.WithCancel(context.Background())
+var finished = make(chan struct{})
+var shutdownOnce sync.Once
+
+// Context returns the root context of the program which is cancelled as soon
+// as shutdown begins.
+func Context() context.Context {
+	return rootContext
+}
+
+// Done returns a channel which is closed once every shutdown hook has run.
+func Done() <-chan struct{} {
+	return finished
+}
+
+// Reason returns why the program is shutting down, e.g. the signal it
+// received. Empty until shutdown begins.
+func Reason() string {
+	lifecycleLock.Lock()
+	defer lifecycleLock.Unlock()
+	return reason
+}
+
+// Restarting returns whether the shutdown under way is a Restart, so hooks
+// can hand work off to the next copy of the program instead of stopping it.
+func Restarting() bool {
+	lifecycleLock.Lock()
+	defer lifecycleLock.Unlock()
+	return restarting
+}
+
+// Restart will shut down like Shutdown but marks the shutdown as a restart, so
+// once Wait returns the program should call Exec to replace itself with the
+// current executable. Does nothing if shutdown has already begun.
+func Restart(why string) {
+
+	lifecycleLock.Lock()
+	if reason == "" {
+		restarting = true
+	}
+	lifecycleLock.Unlock()
+
+	Shutdown(why)
+}
+
+// RestartAfter will Restart the program once the given duration has passed,
+// unless it shuts down before then. Does nothing when the duration isn't
+// positive.
+func RestartAfter(after time.Duration) {
+
+	if after <= 0 {
+		return
+	}
+
+	go func() {
+		select {
+		case <-time.After(after):
+			Restart(fmt.Sprintf("recycled itself after running for %v", after))
+		case <-rootContext.Done():
+		}
+	}()
+}
+
+// OnShutdown will register the given function to be called when the program
+// shuts down. Hooks are called one at a time in the reverse of the order they
+// were registered in, so whatever was started last is stopped first, and share
+// a deadline of SHUTDOWN_TIMEOUT_SECONDS via the given context.
+func OnShutdown(name string, stop func(ctx context.Context) error) {
+	lifecycleLock.Lock()
+	defer lifecycleLock.Unlock()
+	hooks = append(hooks, shutdownHook{name: name, stop: stop})
+}
+
+// Shutdown will cancel the root context and run every shutdown hook. Only the
+// first call does anything, later calls wait for it to finish. A hook which
+// fails is logged and the rest still run. Once the deadline passes the
+// remaining hooks are abandoned.
+func Shutdown(why string) {
+
+	shutdownOnce.Do(func() {
+
+		lifecycleLock.Lock()
+		reason = why
+		stopping := append([]shutdownHook{}, hooks...)
+		lifecycleLock.Unlock()
+
+		logger.Lgr.LogMessagef("Shutting down: %v", why)
+		cancelRoot()
+
+		ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT_SECONDS*time.Second)
+		defer cancel()
+
+	stopHooks:
+		for index := len(stopping) - 1; index >= 0; index-- {
+			hook := stopping[index]
+
+			stopped := make(chan error, 1)
+			go func() {
+				stopped <- hook.stop(ctx)
+			}()
+
+			select {
+			case stopErr := <-stopped:
+				if stopErr != nil {
+					logger.Lgr.LogErrorf("Failed to shut down the %v: %v", hook.name, stopErr)
+				} else {
+					logger.Lgr.LogMessagef("Successfully shut down the %v", hook.name)
+				}
+			case <-ctx.Done():
+				logger.Lgr.LogErrorf("Gave up shutting down the %v and %d more after %d seconds", hook.name, index, SHUTDOWN_TIMEOUT_SECONDS)
+				break stopHooks
+			}
+		}
+
+		close(finished)
+	})
+
+	<-finished
+}
+
+// Wait will block until SIGINT or SIGTERM is received, or Shutdown is called
+// elsewhere, and return once the shutdown has finished.
+func Wait() {
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case received := <-signals:
+		logger.Lgr.LogMessagef("Received interrupting signal: %v", received)
+		Shutdown("received " + received.String())
+	case <-rootContext.Done():
+		<-finished
+	}
+}
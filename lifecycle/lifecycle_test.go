@@ -0,0 +1,119 @@
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+func TestMain(m *testing.M) {
+
+	logErr := logger.StandardLogger("lifecycle_test")
+	if logErr != nil {
+		fmt.Println(fmt.Sprintf("Could not initialize logger: %v", logErr))
+		return
+	}
+
+	result := m.Run()
+	os.Exit(result)
+}
+
+func TestShutdown(t *testing.T) {
+
+	var stopped []string
+	record := func(name string, stopErr error) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			if Context().Err() == nil {
+				t.Errorf("expected the root context to be cancelled before %v is stopped", name)
+			}
+			stopped = append(stopped, name)
+			return stopErr
+		}
+	}
+
+	OnShutdown("loggers", record("loggers", nil))
+	OnShutdown("loader", record("loader", fmt.Errorf("a process wouldn't exit")))
+	OnShutdown("REST server", record("REST server", nil))
+
+	Shutdown("test")
+
+	// later calls only wait on the first
+	again := make(chan struct{})
+	go func() {
+		Shutdown("again")
+		close(again)
+	}()
+
+	select {
+	case <-again:
+	case <-time.After(time.Second):
+		t.Fatal("expected a second shutdown to return straight away")
+	}
+
+	if strings.Join(stopped, ", ") != "REST server, loader, loggers" {
+		t.Errorf("expected every hook to run once in reverse order, got: %v", stopped)
+	}
+
+	if Reason() != "test" {
+		t.Errorf("expected the reason of the first call, got: %v", Reason())
+	}
+}
+
+func TestAcquireLock(t *testing.T) {
+
+	lockDir, dirErr := ioutil.TempDir("", "lifecycle_test")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(lockDir)
+	lockFile := filepath.Join(lockDir, "agent.lock")
+
+	if lockErr := AcquireLock(lockFile); lockErr != nil {
+		t.Fatal(lockErr)
+	}
+
+	contents, _ := ioutil.ReadFile(lockFile)
+	if strings.TrimSpace(string(contents)) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("expected the lock file to hold this process, got: %q", contents)
+	}
+
+	if releaseErr := ReleaseLock(); releaseErr != nil {
+		t.Fatal(releaseErr)
+	}
+	if _, statErr := os.Stat(lockFile); !os.IsNotExist(statErr) {
+		t.Errorf("expected the lock file to be removed, got: %v", statErr)
+	}
+
+	// the parent of the test is alive so its lock must be respected
+	ioutil.WriteFile(lockFile, []byte(strconv.Itoa(os.Getppid())), 0644)
+	lockErr := AcquireLock(lockFile)
+	if running, isRunning := lockErr.(ErrAlreadyRunning); !isRunning || running.PID != os.Getppid() {
+		t.Errorf("expected the live instance to be reported, got: %v", lockErr)
+	}
+
+	// a process which has exited left a stale lock behind
+	exited := exec.Command("sleep", "0")
+	if runErr := exited.Run(); runErr != nil {
+		t.Fatal(runErr)
+	}
+	ioutil.WriteFile(lockFile, []byte(strconv.Itoa(exited.Process.Pid)), 0644)
+	if lockErr = AcquireLock(lockFile); lockErr != nil {
+		t.Errorf("expected the stale lock to be taken over, got: %v", lockErr)
+	}
+
+	ioutil.WriteFile(lockFile, []byte("garbage"), 0644)
+	if lockErr = AcquireLock(lockFile); lockErr != nil {
+		t.Errorf("expected an unreadable lock to be taken over, got: %v", lockErr)
+	}
+
+	ReleaseLock()
+}
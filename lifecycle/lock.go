@@ -0,0 +1,119 @@
+package lifecycle
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+// ErrAlreadyRunning is returned by AcquireLock when another live copy of the
+// program holds the lock.
+type ErrAlreadyRunning struct {
+	PID      int
+	LockFile string
+}
+
+// Error describes the copy which is already running.
+func (ear ErrAlreadyRunning) Error() string {
+	return fmt.Sprintf("Another copy is already running as process %d. Stop it first or remove %v if that process isn't this program", ear.PID, ear.LockFile)
+}
+
+var heldLock string
+
+// AcquireLock will create the given lock file holding the ID of this process
+// so a second copy of the program can't run at the same time. A lock left
+// behind by a copy which crashed, whose process no longer exists, is removed
+// and taken over. Returns ErrAlreadyRunning when the process holding the lock
+// is still alive.
+func AcquireLock(lockFile string) error {
+
+	for attempt := 0; attempt < 2; attempt++ {
+		lock, createErr := os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if createErr == nil {
+			_, writeErr := lock.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+			closeErr := lock.Close()
+			if writeErr != nil || closeErr != nil {
+				os.Remove(lockFile)
+				return fmt.Errorf("Unable to write lock file %v: %v %v", lockFile, writeErr, closeErr)
+			}
+
+			lifecycleLock.Lock()
+			heldLock = lockFile
+			lifecycleLock.Unlock()
+
+			logger.Lgr.LogMessagef("Successfully acquired lock file %v as process %d", lockFile, os.Getpid())
+			return nil
+		}
+
+		if !os.IsExist(createErr) {
+			return createErr
+		}
+
+		contents, readErr := ioutil.ReadFile(lockFile)
+		if readErr != nil && !os.IsNotExist(readErr) {
+			return readErr
+		}
+
+		pid, parseErr := strconv.Atoi(strings.TrimSpace(string(contents)))
+		if readErr == nil && parseErr == nil && pid != os.Getpid() && alive(pid) {
+			return ErrAlreadyRunning{PID: pid, LockFile: lockFile}
+		}
+
+		logger.Lgr.LogMessagef("Removing stale lock file %v left behind by process %v", lockFile, strings.TrimSpace(string(contents)))
+		if removeErr := os.Remove(lockFile); removeErr != nil && !os.IsNotExist(removeErr) {
+			return removeErr
+		}
+	}
+
+	return fmt.Errorf("Unable to acquire lock file %v. Another copy may be starting at the same time", lockFile)
+}
+
+// ReleaseLock will remove the lock file acquired by AcquireLock, if any, so
+// the next copy of the program can start straight away.
+func ReleaseLock() error {
+
+	lifecycleLock.Lock()
+	lockFile := heldLock
+	heldLock = ""
+	lifecycleLock.Unlock()
+
+	if lockFile == "" {
+		return nil
+	}
+
+	if removeErr := os.Remove(lockFile); removeErr != nil && !os.IsNotExist(removeErr) {
+		return removeErr
+	}
+
+	logger.Lgr.LogMessagef("Successfully released lock file %v", lockFile)
+	return nil
+}
+
+// alive returns true if a process with the given ID exists.
+func alive(pid int) bool {
+
+	if pid <= 0 {
+		return false
+	}
+
+	// finding a process on windows fails when it doesn't exist
+	process, findErr := os.FindProcess(pid)
+	if findErr != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		return true
+	}
+
+	// elsewhere signal 0 checks for existence without touching the process.
+	// A process owned by another user exists even though it can't be signalled
+	signalErr := process.Signal(syscall.Signal(0))
+	return signalErr == nil || errors.Is(signalErr, syscall.EPERM)
+}
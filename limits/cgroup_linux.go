@@ -0,0 +1,101 @@
+package limits
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Where the cgroup v2 hierarchy is mounted
+const CGROUP_ROOT = "/sys/fs/cgroup"
+
+// The period CgroupCPUPercent is enforced over. In microseconds
+const CPU_PERIOD_MICROSECONDS = 100000
+
+// The cgroup the agent was started in, relative to CGROUP_ROOT, which the
+// loader's processes are moved back into
+var startedIn string
+
+// place will move the agent into the given cgroup v2, creating it if needed,
+// and set its cpu.max and memory.max. A relative cgroup is under CGROUP_ROOT.
+// Returns the absolute path of the cgroup.
+func place(cgroup string, cpuPercent int, memoryLimitMB int) (string, error) {
+
+	if !filepath.IsAbs(cgroup) {
+		cgroup = filepath.Join(CGROUP_ROOT, cgroup)
+	}
+
+	if startedIn == "" {
+		current, currentErr := currentCgroup()
+		if currentErr != nil {
+			return "", currentErr
+		}
+		startedIn = current
+	}
+
+	if mkdirErr := os.MkdirAll(cgroup, 0755); mkdirErr != nil {
+		return "", mkdirErr
+	}
+
+	cpuMax := "max " + strconv.Itoa(CPU_PERIOD_MICROSECONDS)
+	if cpuPercent > 0 {
+		cpuMax = fmt.Sprintf("%d %d", cpuPercent*CPU_PERIOD_MICROSECONDS/100, CPU_PERIOD_MICROSECONDS)
+	}
+	if writeErr := writeCgroupFile(cgroup, "cpu.max", cpuMax); writeErr != nil && cpuPercent > 0 {
+		return "", writeErr
+	}
+
+	memoryMax := "max"
+	if memoryLimitMB > 0 {
+		memoryMax = strconv.Itoa(memoryLimitMB * 1024 * 1024)
+	}
+	if writeErr := writeCgroupFile(cgroup, "memory.max", memoryMax); writeErr != nil && memoryLimitMB > 0 {
+		return "", writeErr
+	}
+
+	if writeErr := writeCgroupFile(cgroup, "cgroup.procs", strconv.Itoa(os.Getpid())); writeErr != nil {
+		return "", writeErr
+	}
+
+	return cgroup, nil
+}
+
+// release will move the process with the given id back into the cgroup the
+// agent was started in.
+func release(pid int) error {
+	return writeCgroupFile(filepath.Join(CGROUP_ROOT, startedIn), "cgroup.procs", strconv.Itoa(pid))
+}
+
+// currentCgroup returns the cgroup v2 this process is in relative to
+// CGROUP_ROOT, read from /proc/self/cgroup.
+func currentCgroup() (string, error) {
+
+	cgroupBytes, readErr := ioutil.ReadFile("/proc/self/cgroup")
+	if readErr != nil {
+		return "", readErr
+	}
+
+	// the unified hierarchy is the only line with an empty controller list
+	for _, line := range strings.Split(string(cgroupBytes), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::"), nil
+		}
+	}
+
+	return "", fmt.Errorf("This machine doesn't use cgroup v2")
+}
+
+// writeCgroupFile will write the given value to the given interface file of
+// the given cgroup.
+func writeCgroupFile(cgroup string, name string, value string) error {
+
+	writeErr := ioutil.WriteFile(filepath.Join(cgroup, name), []byte(value), 0644)
+	if writeErr != nil {
+		return fmt.Errorf("Could not write %v to %v. Make sure the cpu and memory controllers are enabled in the cgroup.subtree_control of its parent: %v", value, filepath.Join(cgroup, name), writeErr)
+	}
+
+	return nil
+}
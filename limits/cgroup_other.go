@@ -0,0 +1,17 @@
+//go:build !linux
+
+package limits
+
+import (
+	"fmt"
+)
+
+// place isn't supported outside of linux.
+func place(cgroup string, cpuPercent int, memoryLimitMB int) (string, error) {
+	return "", fmt.Errorf("Cgroups are only supported on linux. Leave Cgroup empty in the config.json asset")
+}
+
+// release does nothing outside of linux.
+func release(pid int) error {
+	return nil
+}
@@ -0,0 +1,125 @@
+package limits
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"sync"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+// The GC percent go uses when GOGC isn't set
+const DEFAULT_GC_PERCENT = 100
+
+var limitsLock sync.Mutex
+var appliedProcs int
+var appliedGCPercent int
+var appliedMemoryLimitMB int
+var appliedCgroup string
+
+// Apply will hold the agent to MaxProcs, GCPercent and MemoryLimitMB and move
+// it into the Cgroup when one is set, so it never competes with the workload
+// it supervises for CPU and memory. Settings left at zero go back to the go
+// runtime's defaults. Safe to call again whenever the config changes.
+func Apply() error {
+
+	limitsLock.Lock()
+	defer limitsLock.Unlock()
+
+	procs := config.Cfg.MaxProcs
+	if procs == 0 {
+		procs = runtime.NumCPU()
+	}
+	runtime.GOMAXPROCS(procs)
+
+	gcPercent := config.Cfg.GCPercent
+	if gcPercent == 0 {
+		gcPercent = DEFAULT_GC_PERCENT
+	}
+	debug.SetGCPercent(gcPercent)
+
+	// the runtime treats MaxInt64 as no limit at all
+	memoryLimit := int64(math.MaxInt64)
+	if config.Cfg.MemoryLimitMB > 0 {
+		memoryLimit = int64(config.Cfg.MemoryLimitMB) * 1024 * 1024
+	}
+	debug.SetMemoryLimit(memoryLimit)
+
+	appliedProcs = procs
+	appliedGCPercent = gcPercent
+	appliedMemoryLimitMB = config.Cfg.MemoryLimitMB
+
+	if config.Cfg.Cgroup != "" {
+		placed, placeErr := place(config.Cfg.Cgroup, config.Cfg.CgroupCPUPercent, config.Cfg.MemoryLimitMB)
+		if placeErr != nil {
+			return fmt.Errorf("Could not move the agent into the cgroup %v: %v", config.Cfg.Cgroup, placeErr)
+		}
+		appliedCgroup = placed
+	}
+
+	logger.Lgr.LogMessagef("Successfully limited the agent to %d CPUs, a GC percent of %d and a memory limit of %v", procs, gcPercent, describeMemoryLimit(config.Cfg.MemoryLimitMB))
+	return nil
+}
+
+// Watch will apply the limits again every time the config is loaded, so
+// changes pushed via the config command, REST or the fleet take effect without
+// a restart.
+func Watch() {
+	events.Subscribe("limits", func(record events.Record) {
+		if changed, isConfig := record.Event.(events.ConfigChanged); isConfig && changed.Action == "loaded" {
+			if applyErr := Apply(); applyErr != nil {
+				logger.Lgr.LogErrorf("Could not apply the resource limits: %v", applyErr)
+			}
+		}
+	})
+}
+
+// Release will move the process with the given id back out of the Cgroup the
+// agent moved itself into, so the workload the loader starts isn't held to the
+// agent's limits. Does nothing when the agent hasn't moved into a cgroup.
+func Release(pid int) error {
+
+	limitsLock.Lock()
+	defer limitsLock.Unlock()
+
+	if appliedCgroup == "" {
+		return nil
+	}
+
+	return release(pid)
+}
+
+// Summary describes the limits the agent is currently held to for the status
+// report.
+func Summary() (string, error) {
+
+	limitsLock.Lock()
+	defer limitsLock.Unlock()
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	var summary bytes.Buffer
+	summary.WriteString(fmt.Sprintf("CPUs: %d of %d\n", appliedProcs, runtime.NumCPU()))
+	summary.WriteString(fmt.Sprintf("GC percent: %d\n", appliedGCPercent))
+	summary.WriteString(fmt.Sprintf("Memory: %.1f MB in use out of a limit of %v\n", float64(memStats.Sys)/(1024*1024), describeMemoryLimit(appliedMemoryLimitMB)))
+
+	if appliedCgroup != "" {
+		summary.WriteString(fmt.Sprintf("Cgroup: %v\n", appliedCgroup))
+	}
+
+	return summary.String(), nil
+}
+
+// describeMemoryLimit describes the given memory limit in megabytes.
+func describeMemoryLimit(limitMB int) string {
+	if limitMB <= 0 {
+		return "none"
+	}
+	return fmt.Sprintf("%d MB", limitMB)
+}
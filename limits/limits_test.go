@@ -0,0 +1,85 @@
+package limits
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"testing"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+func TestMain(m *testing.M) {
+
+	logErr := logger.StandardLogger("limits_test")
+	if logErr != nil {
+		fmt.Println(fmt.Sprintf("Could not initialize logger: %v", logErr))
+		return
+	}
+
+	configErr := config.FromFile()
+	if configErr != nil {
+		return
+	}
+
+	result := m.Run()
+	os.Exit(result)
+}
+
+func TestApply(t *testing.T) {
+
+	defer func(procs int, gcPercent int, limitMB int) {
+		config.Cfg.MaxProcs = procs
+		config.Cfg.GCPercent = gcPercent
+		config.Cfg.MemoryLimitMB = limitMB
+		Apply()
+	}(config.Cfg.MaxProcs, config.Cfg.GCPercent, config.Cfg.MemoryLimitMB)
+
+	config.Cfg.MaxProcs = 1
+	config.Cfg.GCPercent = 50
+	config.Cfg.MemoryLimitMB = 512
+
+	if applyErr := Apply(); applyErr != nil {
+		t.Fatal(applyErr)
+	}
+
+	if procs := runtime.GOMAXPROCS(0); procs != 1 {
+		t.Errorf("expected GOMAXPROCS to be 1, got: %d", procs)
+	}
+
+	if gcPercent := debug.SetGCPercent(50); gcPercent != 50 {
+		t.Errorf("expected a GC percent of 50, got: %d", gcPercent)
+	}
+
+	if limit := debug.SetMemoryLimit(-1); limit != 512*1024*1024 {
+		t.Errorf("expected a memory limit of 512 MB, got: %d", limit)
+	}
+
+	// anything left at zero goes back to the defaults
+	config.Cfg.MaxProcs = 0
+	config.Cfg.GCPercent = 0
+	config.Cfg.MemoryLimitMB = 0
+
+	if applyErr := Apply(); applyErr != nil {
+		t.Fatal(applyErr)
+	}
+
+	if procs := runtime.GOMAXPROCS(0); procs != runtime.NumCPU() {
+		t.Errorf("expected GOMAXPROCS to be back to %d, got: %d", runtime.NumCPU(), procs)
+	}
+
+	if gcPercent := debug.SetGCPercent(DEFAULT_GC_PERCENT); gcPercent != DEFAULT_GC_PERCENT {
+		t.Errorf("expected the default GC percent, got: %d", gcPercent)
+	}
+
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		t.Errorf("expected no memory limit, got: %d", limit)
+	}
+
+	if releaseErr := Release(os.Getpid()); releaseErr != nil {
+		t.Errorf("expected releasing without a cgroup to do nothing, got: %v", releaseErr)
+	}
+}
@@ -0,0 +1,123 @@
+package loader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/state"
+)
+
+// The state bucket the processes handed off to the next copy of the agent are
+// saved in by name
+const HANDOFF_BUCKET = "handoff"
+
+// handoff is what the next copy of the agent needs to adopt a running process.
+type handoff struct {
+	Pid    int     `json:"pid"`
+	Output uintptr `json:"output"`
+	Start  int64   `json:"start"`
+	Runs   uint64  `json:"runs"`
+}
+
+// HandOff will stop Run from starting or restarting any process, like
+// Shutdown, but leaves the running processes alone. Their IDs and the pipes
+// their output is read from are saved so the copy of the agent which replaces
+// this one via lifecycle.Exec adopts them in Run. Where that isn't supported
+// the processes are shut down instead.
+func (ldr *Loader) HandOff(ctx context.Context) error {
+
+	if !HANDOFF_SUPPORTED {
+		return ldr.Shutdown(ctx)
+	}
+
+	ldr.lock.Lock()
+	ldr.shuttingDown = true
+
+	handoffs := make(map[string]handoff)
+	for index := range ldr.Processes {
+		process := &ldr.Processes[index]
+		if process.proc == nil {
+			continue
+		}
+
+		// stop reading so no output is lost between this copy and the next
+		process.output.SetReadDeadline(time.Now())
+		<-process.copied
+
+		fd, inheritErr := inheritable(process.output)
+		if inheritErr != nil {
+			ldr.lock.Unlock()
+			return fmt.Errorf("Could not hand off LoaderProcess %v: %v", process.Name, inheritErr)
+		}
+
+		handoffs[process.Name] = handoff{Pid: process.proc.Pid, Output: fd, Start: process.Start, Runs: process.Runs}
+	}
+	ldr.lock.Unlock()
+
+	for name, running := range handoffs {
+		if saveErr := state.Put(HANDOFF_BUCKET, name, running); saveErr != nil {
+			return fmt.Errorf("Could not save LoaderProcess %v for the next copy of the agent: %v", name, saveErr)
+		}
+		ldr.log().LogMessagef("Successfully handed off LoaderProcess %v running as process %d", name, running.Pid)
+	}
+
+	return nil
+}
+
+// adopt will take over every process handed off via HandOff which is still
+// running. Processes which are no longer configured are killed. Returns the
+// names of the processes which were adopted.
+func (ldr *Loader) adopt() map[string]bool {
+
+	adopted := make(map[string]bool)
+
+	names, keysErr := state.Keys(HANDOFF_BUCKET)
+	if keysErr != nil {
+		ldr.log().LogErrorf("Unable to read the processes handed off by the previous copy of the agent: %v", keysErr)
+		return adopted
+	}
+
+	for _, name := range names {
+		var running handoff
+		found, getErr := state.Get(HANDOFF_BUCKET, name, &running)
+		if deleteErr := state.Delete(HANDOFF_BUCKET, name); deleteErr != nil {
+			ldr.log().LogErrorf("Unable to forget handed off LoaderProcess %v: %v", name, deleteErr)
+		}
+		if getErr != nil || !found {
+			ldr.log().LogErrorf("Discarding unreadable handed off LoaderProcess %v: %v", name, getErr)
+			continue
+		}
+
+		output := adoptable(running.Output, name)
+		proc, findErr := os.FindProcess(running.Pid)
+		if findErr != nil || !alive(proc) {
+			ldr.log().LogMessagef("Handed off LoaderProcess %v exited before it could be adopted", name)
+			output.Close()
+			continue
+		}
+
+		ldr.lock.Lock()
+		process := ldr.process(name)
+		if process == nil {
+			ldr.lock.Unlock()
+			ldr.log().LogMessagef("Killing handed off LoaderProcess %v which is no longer configured", name)
+			proc.Kill()
+			proc.Release()
+			output.Close()
+			continue
+		}
+		process.proc = proc
+		process.Running = true
+		process.Start = running.Start
+		process.Runs = running.Runs
+		process.follow(output)
+		ldr.lock.Unlock()
+
+		adopted[name] = true
+		ldr.log().LogMessagef("Successfully adopted LoaderProcess %v running as process %d", name, running.Pid)
+	}
+
+	return adopted
+}
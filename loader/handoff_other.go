@@ -0,0 +1,36 @@
+//go:build !windows
+
+package loader
+
+import (
+	"os"
+	"syscall"
+)
+
+// Whether running processes can be handed off to the next copy of the agent
+const HANDOFF_SUPPORTED = true
+
+// inheritable will let the given file survive lifecycle.Exec and return its
+// file descriptor.
+func inheritable(file *os.File) (uintptr, error) {
+
+	fd := file.Fd()
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_SETFD, 0); errno != 0 {
+		return 0, errno
+	}
+
+	return fd, nil
+}
+
+// adoptable will wrap the given file descriptor inherited from the previous
+// copy of the agent, closing it on the next exec again.
+func adoptable(fd uintptr, name string) *os.File {
+	syscall.CloseOnExec(int(fd))
+	return os.NewFile(fd, name)
+}
+
+// alive returns whether the given process is still running, or has exited
+// and hasn't been waited for yet.
+func alive(proc *os.Process) bool {
+	return proc.Signal(syscall.Signal(0)) == nil
+}
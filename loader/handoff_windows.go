@@ -0,0 +1,24 @@
+package loader
+
+import (
+	"fmt"
+	"os"
+)
+
+// Whether running processes can be handed off to the next copy of the agent
+const HANDOFF_SUPPORTED = false
+
+// inheritable isn't supported on windows, where the agent can't replace itself.
+func inheritable(file *os.File) (uintptr, error) {
+	return 0, fmt.Errorf("Handing off processes isn't supported on windows")
+}
+
+// adoptable will wrap the given file descriptor.
+func adoptable(fd uintptr, name string) *os.File {
+	return os.NewFile(fd, name)
+}
+
+// alive always returns false on windows, where nothing is ever handed off.
+func alive(proc *os.Process) bool {
+	return false
+}
@@ -1,14 +1,24 @@
 package loader
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
 	"os/exec"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/limits"
 	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/state"
 )
 
 // Loader represents a struct that will load a set of processes and watch over
@@ -17,44 +27,112 @@ import (
 // The idea of the Loader is to make sure that all external process dependencies
 // are executing and are in a healthy state as much as possible.
 type Loader struct {
-	Processes []LoaderProcess // the slice of LoaderProcesses which the loader will execute and keep an eye on
+	Processes    []LoaderProcess // the slice of LoaderProcesses which the loader will execute and keep an eye on
+	lock         sync.Mutex      // guards the running command of each process
+	shuttingDown bool            // set by Shutdown so Run stops restarting processes
+	paused       bool            // set by SetEnabled so Run doesn't start any process until it's enabled again
+	lgr          logger.Backend  // where the loader logs to, logger.Lgr when nil
+}
+
+// The number of seconds to wait before restarting a process which has exited
+const RESTART_DELAY_SECONDS = 5
+
+// How often Shutdown checks whether every process has exited. In milliseconds
+const SHUTDOWN_POLL_MILLISECONDS = 100
+
+// The state bucket the counters of each process are saved in by name
+const JOBS_BUCKET = "jobs"
+
+// jobCounters is what's remembered about a process across restarts of the
+// agent.
+type jobCounters struct {
+	Runs       uint64 `json:"runs"`
+	Start      int64  `json:"start"`
+	Duration   int64  `json:"duration"`
+	ExitStatus string `json:"exitStatus"`
 }
 
 type LoaderProcess struct {
-	Name      string
-	Command   string
-	Arguments []string
-	Start     int64
-	End       int64
-	Duration  int64
-	Lgr       *logger.Logger
+	Name       string
+	Command    string
+	Arguments  []string
+	Start      int64
+	End        int64
+	Duration   int64
+	Running    bool   // Whether or not the process is currently executing
+	Disabled   bool   // Whether the process has been stopped via Stop and shouldn't be restarted until Start is called
+	Runs       uint64 // The number of times the process has been started
+	ExitStatus string // The result of the most recent execution of the process
+	Lgr        *logger.Logger
+	Miner      *Miner        // Set when the process is a miner, whose command line is built from its pool, wallet and worker
+	proc       *os.Process   // The currently executing process, if any, started by this loader or adopted via Run
+	output     *os.File      // The read end of the pipe the current process writes its stdout and stderr to
+	copied     chan struct{} // Closed once everything written to output has been copied to Lgr
 }
 
 // NewLoader will initialize a new instance of the Loader struct and execute the
 // associated processes from the given file with the appropriate parameters.
-// Each individual process will have its own logs.
+// Each individual process will have its own logs. The number of times each
+// process has been started, and how it last exited, carry on from where they
+// were when the agent last stopped. The loader logs to logger.Lgr.
 func NewLoader(processesPath string) (*Loader, error) {
+	return NewLoaderWithLogger(processesPath, nil)
+}
 
-	loadedProcesses, loadErr := processesFromJSONFile(processesPath)
+// NewLoaderWithLogger behaves like NewLoader except the loader logs to the
+// given Backend instead of logger.Lgr. The output of each process still goes
+// to its own log files.
+func NewLoaderWithLogger(processesPath string, lgr logger.Backend) (*Loader, error) {
+
+	loader := &Loader{lgr: lgr}
+
+	loadedProcesses, loadErr := processesFromJSONFile(processesPath, loader.log())
 	if loadErr != nil {
 		return nil, loadErr
 	}
 
-	logger.Lgr.LogMessage("Successfully loaded processes from file: %v", processesPath)
-	logger.Lgr.LogMessage("Successfully instantiated loader from JSON:\n%+v", loadedProcesses)
+	loader.log().LogMessagef("Successfully loaded processes from file: %v", processesPath)
+	loader.log().LogMessagef("Successfully instantiated loader from JSON:\n%+v", loadedProcesses)
 
-	loader := &Loader{Processes: loadedProcesses}
+	for index := range loadedProcesses {
+		var counters jobCounters
+		found, countersErr := state.Get(JOBS_BUCKET, loadedProcesses[index].Name, &counters)
+		if errors.Is(countersErr, state.ErrNoStore) {
+			// nothing has been saved without a store
+			break
+		}
+		if countersErr != nil {
+			loader.log().LogErrorf("Discarding unreadable counters of LoaderProcess %v: %v", loadedProcesses[index].Name, countersErr)
+			continue
+		}
+		if found {
+			loadedProcesses[index].Runs = counters.Runs
+			loadedProcesses[index].Start = counters.Start
+			loadedProcesses[index].Duration = counters.Duration
+			loadedProcesses[index].ExitStatus = counters.ExitStatus
+		}
+	}
+
+	loader.Processes = loadedProcesses
 
 	return loader, nil
 }
 
+// log returns the Backend the loader logs to.
+func (ldr *Loader) log() logger.Backend {
+	if ldr.lgr == nil {
+		return logger.Lgr
+	}
+	return ldr.lgr
+}
+
 // processesFromJSONFile will read in a set of JSON values which define both
 // the canonical name of the process as well as the command and any associated
 // parameters to successfully execute that command. A slice containing a
 // LoaderProcess struct for each individual command to execute will be returned.
 // Each individual LoaderProcess struct and associated process will be monitored
 // and AEN will do its best to keep it running at all times.
-func processesFromJSONFile(processesPath string) ([]LoaderProcess, error) {
+func processesFromJSONFile(processesPath string, lgr logger.Backend) ([]LoaderProcess, error) {
 
 	rawJSONMap := make(map[string]*json.RawMessage)
 	var processList []LoaderProcess
@@ -64,43 +142,69 @@ func processesFromJSONFile(processesPath string) ([]LoaderProcess, error) {
 		return nil, readErr
 	}
 
-	logger.Lgr.LogMessage("Successfully loaded process map bytes from file: %v", processesPath)
+	lgr.LogMessagef("Successfully loaded process map bytes from file: %v", processesPath)
+
+	fileBytes, expandErr := config.ExpandTemplates(processesPath, fileBytes)
+	if expandErr != nil {
+		return nil, expandErr
+	}
 
 	mapErr1 := json.Unmarshal(fileBytes, &rawJSONMap)
 	if mapErr1 != nil {
 		return nil, mapErr1
 	}
 
-	logger.Lgr.LogMessage("Successfully unmarshalled JSON process file bytes into a map")
+	lgr.LogMessage("Successfully unmarshalled JSON process file bytes into a map")
 
 	for key, value := range rawJSONMap {
-		var s string
-		mapErr2 := json.Unmarshal(*value, &s)
-		if mapErr2 != nil {
-			return nil, mapErr2
+		lp, processErr := processFromJSON(key, *value)
+		if processErr != nil {
+			return nil, processErr
 		}
 
-		commandParts := strings.Split(s, " ")
-		lp := LoaderProcess{Name: key, Command: commandParts[0], Arguments: commandParts[1:]}
-
-		logger.Lgr.LogMessage("Successfully created LoaderProcess instance: %v", lp.Name)
+		lgr.LogMessagef("Successfully created LoaderProcess instance: %v", lp.Name)
 
 		logInstance, logError := logger.CustomLogger(lp.Name, 1, 50000, 604800)
 		if logError != nil {
 			return nil, logError
 		}
 
-		logger.Lgr.LogMessage("Successfully instantiated custom logger process for LoaderProcess: %v", lp.Name)
+		lgr.LogMessagef("Successfully instantiated custom logger process for LoaderProcess: %v", lp.Name)
 
 		lp.Lgr = logInstance
 		processList = append(processList, lp)
 
-		logger.Lgr.LogMessage("Successfully initialized one LoaderProcess instance: %+v", lp)
+		lgr.LogMessagef("Successfully initialized one LoaderProcess instance: %+v", lp)
 	}
 
 	return processList, nil
 }
 
+// processFromJSON returns the LoaderProcess of the given name from its value in
+// the loader asset, which is either a command line or a miner object. Its
+// logger isn't created.
+func processFromJSON(name string, value json.RawMessage) (LoaderProcess, error) {
+
+	lp := LoaderProcess{Name: name}
+
+	var s string
+	if mapErr := json.Unmarshal(value, &s); mapErr == nil {
+		commandParts := strings.Split(s, " ")
+		lp.Command = commandParts[0]
+		lp.Arguments = commandParts[1:]
+		return lp, nil
+	}
+
+	miner, minerErr := minerFromJSON(value)
+	if minerErr != nil {
+		return lp, fmt.Errorf("Could not load LoaderProcess %v: %v", name, minerErr)
+	}
+	lp.Miner = miner
+	lp.Command, lp.Arguments = miner.commandLine()
+
+	return lp, nil
+}
+
 // StartAsynchronous will execute all the processes that have been loaded into
 // this specific instance of Loader asynchronously. It will capture their
 // individual log output and put each specific process output in its own log
@@ -112,7 +216,7 @@ func (ldr *Loader) StartAsynchronous() []LoaderProcess {
 	numProcesses := len(ldr.Processes)
 	waitGroup.Add(numProcesses)
 
-	logger.Lgr.LogMessage("Adding %d processes to the Asynchronous WaitGroup", numProcesses)
+	ldr.log().LogMessagef("Adding %d processes to the Asynchronous WaitGroup", numProcesses)
 
 	for index := range ldr.Processes {
 
@@ -120,31 +224,18 @@ func (ldr *Loader) StartAsynchronous() []LoaderProcess {
 
 			defer waitGroup.Done()
 
-			logger.Lgr.LogMessage("Asynchronously executing LoaderProcess: %+v", currentProcess)
+			ldr.log().LogMessagef("Asynchronously executing LoaderProcess: %+v", currentProcess)
 
-			cmd := exec.Command(currentProcess.Command, currentProcess.Arguments...)
-			cmd.Stdout = currentProcess.Lgr
-			cmd.Stderr = currentProcess.Lgr
+			ldr.execute(currentProcess)
 
-			currentProcess.Start = time.Now().Unix()
-			err := cmd.Run()
-			currentProcess.End = time.Now().Unix()
-			currentProcess.Duration = currentProcess.End - currentProcess.Start
-
-			if err != nil {
-				currentProcess.Lgr.LogMessage("LoaderProcess:\n%+v\nexited with error status: %v", currentProcess, err.Error())
-			} else {
-				currentProcess.Lgr.LogMessage("LoaderProcess:\n%+v\nexited successfully", currentProcess)
-			}
-
-			logger.Lgr.LogMessage("Removing '%v' process from the Asynchronous WaitGroup. Execution took: %v", currentProcess.Name, currentProcess.Duration)
+			ldr.log().LogMessagef("Removing '%v' process from the Asynchronous WaitGroup. Execution took: %v", currentProcess.Name, currentProcess.Duration)
 
 		}(&ldr.Processes[index]) // passing the current process using index
 	}
 
-	logger.Lgr.LogMessage("Waiting for %d processes to finish executing asynchronously", numProcesses)
+	ldr.log().LogMessagef("Waiting for %d processes to finish executing asynchronously", numProcesses)
 	waitGroup.Wait()
-	logger.Lgr.LogMessage("%d processes finished executing asynchronously. returning.", numProcesses)
+	ldr.log().LogMessagef("%d processes finished executing asynchronously. returning.", numProcesses)
 	return ldr.Processes
 }
 
@@ -157,41 +248,486 @@ func (ldr *Loader) StartSynchronous() []LoaderProcess {
 
 	numProcesses := len(ldr.Processes)
 
-	logger.Lgr.LogMessage("Executing %d processes in series", numProcesses)
+	ldr.log().LogMessagef("Executing %d processes in series", numProcesses)
+
+	for index := range ldr.Processes {
+
+		currentProcess := &ldr.Processes[index]
+
+		ldr.log().LogMessagef("Synchronously executing LoaderProcess: %+v", currentProcess)
 
-	for _, currentProcess := range ldr.Processes {
+		ldr.execute(currentProcess)
 
-		logger.Lgr.LogMessage("Synchronously executing LoaderProcess: %+v", currentProcess)
+		ldr.log().LogMessagef("Finished executing one process out of %d", numProcesses)
+	}
 
-		cmd := exec.Command(currentProcess.Command, currentProcess.Arguments...)
-		cmd.Stdout = currentProcess.Lgr
-		cmd.Stderr = currentProcess.Lgr
+	ldr.log().LogMessagef("%d processes finished executing synchronously. returning.", numProcesses)
+	return ldr.Processes
+}
 
-		currentProcess.Start = time.Now().Unix()
-		err := cmd.Run()
-		currentProcess.End = time.Now().Unix()
-		currentProcess.Duration = currentProcess.End - currentProcess.Start
+// execute will run the given process to completion while capturing its output
+// in the process log and tracking how long it ran for. The output goes through
+// a pipe the loader holds on to so it can be handed off along with the process
+// when the agent restarts.
+func (ldr *Loader) execute(currentProcess *LoaderProcess) error {
+
+	// a miner whose API port is taken would either fail to start or have the
+	// hashrate of whatever holds the port read in its place
+	if currentProcess.Miner != nil {
+		if portErr := currentProcess.Miner.waitForAPIPort(); portErr != nil {
+			ldr.lock.Lock()
+			currentProcess.markStarted()
+			ldr.lock.Unlock()
+			return ldr.finish(currentProcess, portErr)
+		}
+	}
+
+	output, input, pipeErr := os.Pipe()
+	if pipeErr != nil {
+		return pipeErr
+	}
+
+	// a miner may have moved on to another pool since it last ran
+	if currentProcess.Miner != nil {
+		ldr.lock.Lock()
+		currentProcess.Command, currentProcess.Arguments = currentProcess.Miner.commandLine()
+		ldr.lock.Unlock()
+	}
 
-		if err != nil {
-			currentProcess.Lgr.LogMessage("LoaderProcess:\n%+v\nexited with error status: %v", currentProcess, err.Error())
+	cmd := exec.Command(currentProcess.Command, currentProcess.Arguments...)
+	cmd.Stdout = input
+	cmd.Stderr = input
+
+	// start the command while holding the lock so Restart and Stop never see
+	// a half started process
+	ldr.lock.Lock()
+	if ldr.shuttingDown {
+		ldr.lock.Unlock()
+		output.Close()
+		input.Close()
+		return fmt.Errorf("Not executing LoaderProcess %v while shutting down", currentProcess.Name)
+	}
+	currentProcess.markStarted()
+	err := cmd.Start()
+	if err == nil {
+		currentProcess.proc = cmd.Process
+		currentProcess.follow(output)
+	}
+	ldr.lock.Unlock()
+
+	// the process has its own copy of the write end
+	input.Close()
+
+	if err != nil {
+		output.Close()
+		return ldr.finish(currentProcess, err)
+	}
+
+	// the agent's own resource limits shouldn't hold back the workload
+	if releaseErr := limits.Release(cmd.Process.Pid); releaseErr != nil {
+		currentProcess.Lgr.LogErrorf("Could not move LoaderProcess %v out of the agent's cgroup: %v", currentProcess.Name, releaseErr)
+	}
+
+	return ldr.wait(currentProcess)
+}
+
+// follow will copy everything the current process writes to the given output
+// to its log. The loader lock must be held.
+func (lp *LoaderProcess) follow(output *os.File) {
+
+	copied := make(chan struct{})
+	lp.output = output
+	lp.copied = copied
+
+	go func() {
+		if lp.Miner != nil {
+			lp.Miner.copyOutput(lp.Lgr, output)
 		} else {
-			currentProcess.Lgr.LogMessage("LoaderProcess:\n%+vexited successfully", currentProcess)
+			io.Copy(lp.Lgr, output)
 		}
+		close(copied)
+	}()
+}
 
-		logger.Lgr.LogMessage("Finished executing one process out of %d", numProcesses)
+// wait will wait for the current process of the given LoaderProcess to exit
+// and for all of its output to be logged, then record how it exited. A miner's
+// hashrate is watched until then, and a miner which exits soon after it
+// started counts as failing on its pool.
+func (ldr *Loader) wait(currentProcess *LoaderProcess) error {
+
+	ldr.lock.Lock()
+	proc := currentProcess.proc
+	output := currentProcess.output
+	copied := currentProcess.copied
+	ldr.lock.Unlock()
+
+	exited := make(chan struct{})
+	if currentProcess.Miner != nil {
+		go ldr.watchMiner(currentProcess, exited)
 	}
 
-	logger.Lgr.LogMessage("%d processes finished executing synchronously. returning.", numProcesses)
-	return ldr.Processes
+	// reported the same way exec.Cmd.Wait reports it
+	var err error
+	processState, waitErr := proc.Wait()
+	if waitErr != nil {
+		err = waitErr
+	} else if !processState.Success() {
+		err = fmt.Errorf("%v", processState)
+	}
+
+	close(exited)
+	<-copied
+	output.Close()
+
+	if currentProcess.Miner != nil && err != nil && !ldr.stopping() && !ldr.disabled(currentProcess) && time.Since(time.Unix(currentProcess.Start, 0)) < MINER_POOL_FAILURE_SECONDS*time.Second {
+		ldr.minerFailed(currentProcess)
+	}
+
+	return ldr.finish(currentProcess, err)
+}
+
+// finish will record how the given LoaderProcess exited, save its counters,
+// and publish a JobCrashed event if it failed. Returns the given error.
+func (ldr *Loader) finish(currentProcess *LoaderProcess, err error) error {
+
+	ldr.lock.Lock()
+	currentProcess.proc = nil
+	currentProcess.output = nil
+	currentProcess.copied = nil
+	currentProcess.markFinished(err)
+	counters := jobCounters{Runs: currentProcess.Runs, Start: currentProcess.Start, Duration: currentProcess.Duration, ExitStatus: currentProcess.ExitStatus}
+	ldr.lock.Unlock()
+
+	if saveErr := state.Put(JOBS_BUCKET, currentProcess.Name, counters); saveErr != nil && !errors.Is(saveErr, state.ErrNoStore) {
+		ldr.log().LogErrorf("Unable to save the counters of LoaderProcess %v: %v", currentProcess.Name, saveErr)
+	}
+
+	if err != nil {
+		currentProcess.Lgr.LogMessagef("LoaderProcess:\n%+v\nexited with error status: %v", currentProcess, err.Error())
+		events.Publish(events.JobCrashed{Name: currentProcess.Name, ExitStatus: err.Error(), Runs: currentProcess.Runs})
+	} else {
+		currentProcess.Lgr.LogMessagef("LoaderProcess:\n%+v\nexited successfully", currentProcess)
+	}
+
+	return err
+}
+
+// Restart will kill the process with the given name if it's currently running.
+// When the loader is executing via Run() the process is then started again
+// after RESTART_DELAY_SECONDS.
+func (ldr *Loader) Restart(name string) error {
+
+	ldr.lock.Lock()
+	defer ldr.lock.Unlock()
+
+	process := ldr.process(name)
+	if process == nil {
+		return fmt.Errorf("No LoaderProcess named: %v", name)
+	}
+
+	if process.proc == nil {
+		return fmt.Errorf("LoaderProcess %v is not currently running", name)
+	}
+
+	ldr.log().LogMessagef("Killing LoaderProcess %v so it can be restarted", name)
+	return process.proc.Kill()
+}
+
+// Stop will kill the process with the given name if it's currently running
+// and disable it so Run() doesn't start it again until Start is called.
+func (ldr *Loader) Stop(name string) error {
+
+	ldr.lock.Lock()
+	defer ldr.lock.Unlock()
+
+	process := ldr.process(name)
+	if process == nil {
+		return fmt.Errorf("No LoaderProcess named: %v", name)
+	}
+
+	process.Disabled = true
+	ldr.log().LogMessagef("Successfully disabled LoaderProcess %v", name)
+
+	if process.proc == nil {
+		return nil
+	}
+
+	ldr.log().LogMessagef("Killing LoaderProcess %v so it stays stopped", name)
+	return process.proc.Kill()
+}
+
+// Start will enable the process with the given name again after it was
+// stopped via Stop. When the loader is executing via Run() the process is
+// started within RESTART_DELAY_SECONDS.
+func (ldr *Loader) Start(name string) error {
+
+	ldr.lock.Lock()
+	defer ldr.lock.Unlock()
+
+	process := ldr.process(name)
+	if process == nil {
+		return fmt.Errorf("No LoaderProcess named: %v", name)
+	}
+
+	if !process.Disabled {
+		return fmt.Errorf("LoaderProcess %v has not been stopped", name)
+	}
+
+	process.Disabled = false
+	ldr.log().LogMessagef("Successfully enabled LoaderProcess %v", name)
+
+	return nil
+}
+
+// SetEnabled will pause or resume every process. Pausing kills every running
+// process and Run doesn't start any of them again until the loader is resumed,
+// when they're started within RESTART_DELAY_SECONDS. Processes stopped via Stop
+// stay stopped either way.
+func (ldr *Loader) SetEnabled(enabled bool) {
+
+	ldr.lock.Lock()
+	defer ldr.lock.Unlock()
+
+	if ldr.paused == !enabled {
+		return
+	}
+
+	ldr.paused = !enabled
+
+	if enabled {
+		ldr.log().LogMessage("Successfully resumed every LoaderProcess")
+		return
+	}
+
+	for index := range ldr.Processes {
+		process := &ldr.Processes[index]
+		if process.proc == nil {
+			continue
+		}
+		ldr.log().LogMessagef("Killing LoaderProcess %v so it stays paused", process.Name)
+		process.proc.Kill()
+	}
+
+	ldr.log().LogMessage("Successfully paused every LoaderProcess")
+}
+
+// process returns the process with the given name or nil if there isn't one.
+// The loader lock must be held.
+func (ldr *Loader) process(name string) *LoaderProcess {
+	for index := range ldr.Processes {
+		if ldr.Processes[index].Name == name {
+			return &ldr.Processes[index]
+		}
+	}
+	return nil
+}
+
+// Shutdown will stop Run from restarting any process and ask every running
+// process to exit by interrupting it. It waits for them to exit until the
+// given context is done and then kills whatever is still running.
+func (ldr *Loader) Shutdown(ctx context.Context) error {
+
+	ldr.lock.Lock()
+	ldr.shuttingDown = true
+	for index := range ldr.Processes {
+		process := &ldr.Processes[index]
+		if process.proc == nil {
+			continue
+		}
+		ldr.log().LogMessagef("Interrupting LoaderProcess %v so it can exit cleanly", process.Name)
+		// not every operating system can interrupt a process
+		if signalErr := process.proc.Signal(os.Interrupt); signalErr != nil {
+			process.proc.Kill()
+		}
+	}
+	ldr.lock.Unlock()
+
+	for 1 == 1 {
+		running := ldr.running()
+		if len(running) == 0 {
+			ldr.log().LogMessage("Successfully drained every LoaderProcess")
+			return nil
+		}
+
+		select {
+		case <-time.After(SHUTDOWN_POLL_MILLISECONDS * time.Millisecond):
+		case <-ctx.Done():
+			ldr.lock.Lock()
+			for _, name := range running {
+				if process := ldr.process(name); process != nil && process.proc != nil {
+					process.proc.Kill()
+				}
+			}
+			ldr.lock.Unlock()
+			return fmt.Errorf("Killed LoaderProcesses %v which didn't exit in time", strings.Join(running, ", "))
+		}
+	}
+
+	return nil
+}
+
+// running returns the names of the processes which are currently executing.
+func (ldr *Loader) running() []string {
+
+	ldr.lock.Lock()
+	defer ldr.lock.Unlock()
+
+	var names []string
+	for index := range ldr.Processes {
+		if ldr.Processes[index].proc != nil {
+			names = append(names, ldr.Processes[index].Name)
+		}
+	}
+
+	return names
+}
+
+// stopping returns whether Shutdown has been called.
+func (ldr *Loader) stopping() bool {
+	ldr.lock.Lock()
+	defer ldr.lock.Unlock()
+	return ldr.shuttingDown
+}
+
+// disabled returns whether the given process has been stopped via Stop or
+// every process has been paused via SetEnabled.
+func (ldr *Loader) disabled(currentProcess *LoaderProcess) bool {
+	ldr.lock.Lock()
+	defer ldr.lock.Unlock()
+	return currentProcess.Disabled || ldr.paused
+}
+
+// JobStatus is a snapshot of the state of a single process managed by a
+// loader.
+type JobStatus struct {
+	Name       string   `json:"name"`
+	Command    string   `json:"command"`
+	Arguments  []string `json:"args"`
+	Running    bool     `json:"running"`
+	Disabled   bool     `json:"disabled"`
+	Runs       uint64   `json:"runs"`
+	Start      int64    `json:"start"`
+	Duration   int64    `json:"duration"`
+	ExitStatus string   `json:"exitStatus"`
+	Pool       string   `json:"pool,omitempty"`
+	Hashrate   float64  `json:"hashrateMHs,omitempty"`
+}
+
+// Jobs returns a snapshot of the state of every process managed by this
+// loader.
+func (ldr *Loader) Jobs() []JobStatus {
+
+	ldr.lock.Lock()
+	defer ldr.lock.Unlock()
+
+	jobs := make([]JobStatus, 0, len(ldr.Processes))
+
+	for _, process := range ldr.Processes {
+		job := JobStatus{
+			Name:       process.Name,
+			Command:    process.Command,
+			Arguments:  process.Arguments,
+			Running:    process.Running,
+			Disabled:   process.Disabled,
+			Runs:       process.Runs,
+			Start:      process.Start,
+			Duration:   process.Duration,
+			ExitStatus: process.ExitStatus,
+		}
+		if process.Miner != nil {
+			job.Pool = process.Miner.Pool()
+			job.Hashrate = process.Miner.Hashrate()
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs
+}
+
+// StatusSummary returns a human readable summary of every process managed by
+// this loader including whether it's running, how many times it has been
+// started and the result of its most recent execution.
+func (ldr *Loader) StatusSummary() (string, error) {
+
+	ldr.lock.Lock()
+	defer ldr.lock.Unlock()
+
+	var summary bytes.Buffer
+
+	if ldr.paused {
+		summary.WriteString("Every process is paused\n")
+	}
+
+	for _, process := range ldr.Processes {
+		state := "stopped"
+		if process.Running {
+			state = "running"
+		} else if process.Disabled {
+			state = "disabled"
+		}
+		summary.WriteString(fmt.Sprintf("%v: %v, runs: %d, last start: %v, last duration: %ds, last exit: %v\n",
+			process.Name, state, process.Runs, time.Unix(process.Start, 0), process.Duration, process.ExitStatus))
+		if process.Miner != nil {
+			summary.WriteString(fmt.Sprintf("  Miner: %v\n", process.Miner.Summary()))
+		}
+	}
+
+	return summary.String(), nil
+}
+
+// markStarted will record that the process is about to begin executing.
+func (lp *LoaderProcess) markStarted() {
+	lp.Start = time.Now().Unix()
+	lp.Running = true
+	lp.Runs++
+}
+
+// markFinished will record the result of the process after it has finished
+// executing.
+func (lp *LoaderProcess) markFinished(runErr error) {
+	lp.End = time.Now().Unix()
+	lp.Duration = lp.End - lp.Start
+	lp.Running = false
+	if runErr != nil {
+		lp.ExitStatus = runErr.Error()
+	} else {
+		lp.ExitStatus = "success"
+	}
 }
 
 // Run will continuously execute this specific instance of Loader indefinitely.
 // Should only be called externally when all configuration options have been
 // correctly setup and you wish to execute a set number of processes forever.
+// Each process is watched individually and restarted RESTART_DELAY_SECONDS
+// after it exits without waiting on the other processes. Processes disabled
+// via Stop, or paused via SetEnabled, are skipped until they're started again.
+// Nothing is restarted once Shutdown or HandOff has been called. Processes
+// handed off by the copy of the agent this one replaced are adopted and
+// watched until they exit instead of being started a second time.
 func (ldr *Loader) Run() {
-	go func() {
-		for 1 == 1 {
-			ldr.StartAsynchronous()
-		}
-	}()
+
+	adopted := ldr.adopt()
+
+	for index := range ldr.Processes {
+		go func(currentProcess *LoaderProcess) {
+			if adopted[currentProcess.Name] {
+				ldr.wait(currentProcess)
+				ldr.log().LogMessagef("Adopted LoaderProcess %v exited. Restarting in %d seconds", currentProcess.Name, RESTART_DELAY_SECONDS)
+				time.Sleep(RESTART_DELAY_SECONDS * time.Second)
+			}
+			for 1 == 1 {
+				if ldr.stopping() {
+					return
+				}
+				if ldr.disabled(currentProcess) {
+					time.Sleep(RESTART_DELAY_SECONDS * time.Second)
+					continue
+				}
+				ldr.log().LogMessagef("Executing LoaderProcess: %v", currentProcess.Name)
+				ldr.execute(currentProcess)
+				ldr.log().LogMessagef("LoaderProcess %v exited. Restarting in %d seconds", currentProcess.Name, RESTART_DELAY_SECONDS)
+				time.Sleep(RESTART_DELAY_SECONDS * time.Second)
+			}
+		}(&ldr.Processes[index])
+	}
 }
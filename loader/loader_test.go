@@ -1,12 +1,25 @@
 package loader
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/seantcanavan/anon-eth-net/config"
 	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/state"
 	"github.com/seantcanavan/anon-eth-net/utils"
 )
 
@@ -23,12 +36,35 @@ func TestMain(m *testing.M) {
 		fmt.Println(fmt.Sprintf("could not initialize config: %v", configErr))
 	}
 
+	var dirErr error
+	stateDir, dirErr = ioutil.TempDir("", "loader_test_state")
+	if dirErr != nil {
+		fmt.Println(fmt.Sprintf("could not create the state directory: %v", dirErr))
+		return
+	}
+
 	result := m.Run()
+	os.RemoveAll(stateDir)
 	os.Exit(result)
 }
 
+// the directory the state stores of the tests are kept in. It's only removed
+// once every test has run as restarted jobs can still save their counters
+// after the test which started them has finished
+var stateDir string
+
+// openTestStore will give the test a state store of its own so the counters
+// and handoffs of one test don't leak into the next.
+func openTestStore(t *testing.T) {
+	if openErr := state.Open(filepath.Join(stateDir, t.Name()+".json")); openErr != nil {
+		t.Fatal(openErr)
+	}
+}
+
 func TestProcessMap(t *testing.T) {
 
+	openTestStore(t)
+
 	loaderAssetPath, assetErr := utils.SysAssetPath("loader_test.json")
 	if assetErr != nil {
 		t.Error(assetErr)
@@ -42,3 +78,424 @@ func TestProcessMap(t *testing.T) {
 
 	loader.StartAsynchronous()
 }
+
+func TestNewLoaderWithLogger(t *testing.T) {
+
+	openTestStore(t)
+
+	loaderAssetPath, assetErr := utils.SysAssetPath("loader_test.json")
+	if assetErr != nil {
+		t.Fatal(assetErr)
+	}
+
+	backend := &recordingBackend{}
+	ldr, loaderErr := NewLoaderWithLogger(loaderAssetPath, backend)
+	if loaderErr != nil {
+		t.Fatal(loaderErr)
+	}
+
+	if len(ldr.Processes) == 0 || len(backend.messages) == 0 || !strings.HasPrefix(backend.messages[len(backend.messages)-1], "Successfully instantiated loader from JSON") {
+		t.Errorf("expected the loader to log to the given backend, got: %q", backend.messages)
+	}
+}
+
+// recordingBackend is a logger.Backend which remembers every message.
+type recordingBackend struct {
+	messages []string
+}
+
+func (rb *recordingBackend) LogMessage(message string) {
+	rb.messages = append(rb.messages, message)
+}
+
+func (rb *recordingBackend) LogMessagef(formatString string, values ...interface{}) {
+	rb.LogMessage(fmt.Sprintf(formatString, values...))
+}
+
+func (rb *recordingBackend) LogError(message string) {
+	rb.LogMessage(logger.ERROR_PREFIX + message)
+}
+
+func (rb *recordingBackend) LogErrorf(formatString string, values ...interface{}) {
+	rb.LogError(fmt.Sprintf(formatString, values...))
+}
+
+func TestStopStart(t *testing.T) {
+
+	openTestStore(t)
+
+	ldr := &Loader{Processes: []LoaderProcess{{Name: "sleeper", Command: "sleep", Arguments: []string{"30"}, Lgr: logger.Lgr}}}
+	ldr.Run()
+
+	waitFor := func(running bool) bool {
+		for attempt := 0; attempt < (RESTART_DELAY_SECONDS+5)*10; attempt++ {
+			if jobs := ldr.Jobs(); jobs[0].Running == running {
+				return true
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		return false
+	}
+
+	if !waitFor(true) {
+		t.Fatal("expected the process to start")
+	}
+
+	if startErr := ldr.Start("sleeper"); startErr == nil {
+		t.Errorf("expected starting a process which hasn't been stopped to fail")
+	}
+
+	if stopErr := ldr.Stop("sleeper"); stopErr != nil {
+		t.Fatal(stopErr)
+	}
+
+	if !waitFor(false) {
+		t.Fatal("expected the process to stop")
+	}
+
+	time.Sleep((RESTART_DELAY_SECONDS + 1) * time.Second)
+	if jobs := ldr.Jobs(); jobs[0].Running || !jobs[0].Disabled {
+		t.Errorf("expected the stopped process to stay stopped, got: %+v", jobs[0])
+	}
+
+	if startErr := ldr.Start("sleeper"); startErr != nil {
+		t.Fatal(startErr)
+	}
+
+	if !waitFor(true) {
+		t.Errorf("expected the process to start again")
+	}
+
+	if stopErr := ldr.Stop("missing"); stopErr == nil {
+		t.Errorf("expected stopping an unknown process to fail")
+	}
+
+	ldr.Stop("sleeper")
+}
+
+func TestSetEnabled(t *testing.T) {
+
+	openTestStore(t)
+
+	ldr := &Loader{Processes: []LoaderProcess{{Name: "sleeper", Command: "sleep", Arguments: []string{"30"}, Lgr: logger.Lgr}}}
+	ldr.Run()
+	defer ldr.Stop("sleeper")
+
+	for attempt := 0; attempt < 50 && !ldr.Jobs()[0].Running; attempt++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	ldr.SetEnabled(false)
+
+	time.Sleep((RESTART_DELAY_SECONDS + 1) * time.Second)
+	if jobs := ldr.Jobs(); jobs[0].Running || jobs[0].Disabled {
+		t.Errorf("expected the paused process to stay stopped without being disabled, got: %+v", jobs[0])
+	}
+
+	summary, _ := ldr.StatusSummary()
+	if !strings.HasPrefix(summary, "Every process is paused") {
+		t.Errorf("expected the status summary to say the loader is paused, got: %v", summary)
+	}
+
+	ldr.SetEnabled(true)
+
+	for attempt := 0; attempt < (RESTART_DELAY_SECONDS+5)*10 && !ldr.Jobs()[0].Running; attempt++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if jobs := ldr.Jobs(); !jobs[0].Running {
+		t.Errorf("expected the process to start again once resumed, got: %+v", jobs[0])
+	}
+}
+
+func TestShutdown(t *testing.T) {
+
+	openTestStore(t)
+
+	ldr := &Loader{Processes: []LoaderProcess{{Name: "sleeper", Command: "sleep", Arguments: []string{"30"}, Lgr: logger.Lgr}}}
+	ldr.Run()
+
+	for attempt := 0; attempt < 50 && !ldr.Jobs()[0].Running; attempt++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if shutdownErr := ldr.Shutdown(ctx); shutdownErr != nil {
+		t.Fatal(shutdownErr)
+	}
+
+	if jobs := ldr.Jobs(); jobs[0].Running {
+		t.Errorf("expected the process to have exited, got: %+v", jobs[0])
+	}
+
+	time.Sleep((RESTART_DELAY_SECONDS + 1) * time.Second)
+	if jobs := ldr.Jobs(); jobs[0].Running {
+		t.Errorf("expected the process not to be restarted after shutdown, got: %+v", jobs[0])
+	}
+}
+
+func TestHandOff(t *testing.T) {
+
+	openTestStore(t)
+
+	if !HANDOFF_SUPPORTED {
+		t.Skip("handing off processes isn't supported on this platform")
+	}
+
+	ldr := &Loader{Processes: []LoaderProcess{{Name: "sleeper", Command: "sleep", Arguments: []string{"30"}, Lgr: logger.Lgr}}}
+	ldr.Run()
+
+	for attempt := 0; attempt < 50 && !ldr.Jobs()[0].Running; attempt++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if handOffErr := ldr.HandOff(context.Background()); handOffErr != nil {
+		t.Fatal(handOffErr)
+	}
+
+	var saved handoff
+	found, getErr := state.Get(HANDOFF_BUCKET, "sleeper", &saved)
+	if getErr != nil || !found {
+		t.Fatalf("expected the running process to be saved for the next copy of the agent: %v", getErr)
+	}
+	state.Delete(HANDOFF_BUCKET, "sleeper")
+
+	if saved.Pid != ldr.Processes[0].proc.Pid || saved.Runs != 1 {
+		t.Errorf("expected the saved process to match the running one, got: %+v", saved)
+	}
+	ldr.Processes[0].proc.Kill()
+}
+
+func TestAdopt(t *testing.T) {
+
+	openTestStore(t)
+
+	if !HANDOFF_SUPPORTED {
+		t.Skip("handing off processes isn't supported on this platform")
+	}
+
+	// stand in for a process started by the previous copy of the agent. The
+	// loader closes the pipes once it adopts them
+	reader, writer, pipeErr := os.Pipe()
+	if pipeErr != nil {
+		t.Fatal(pipeErr)
+	}
+	removedReader, removedWriter, pipeErr := os.Pipe()
+	if pipeErr != nil {
+		t.Fatal(pipeErr)
+	}
+	removedWriter.Close()
+	defer runtime.KeepAlive(reader)
+	defer runtime.KeepAlive(removedReader)
+
+	cmd := exec.Command("sleep", "30")
+	cmd.Stdout = writer
+	if startErr := cmd.Start(); startErr != nil {
+		t.Fatal(startErr)
+	}
+	writer.Close()
+
+	state.Put(HANDOFF_BUCKET, "sleeper", handoff{Pid: cmd.Process.Pid, Output: reader.Fd(), Start: 42, Runs: 3})
+	state.Put(HANDOFF_BUCKET, "removed", handoff{Pid: 0x7FFFFFFF, Output: removedReader.Fd()})
+
+	ldr := &Loader{Processes: []LoaderProcess{{Name: "sleeper", Command: "sleep", Arguments: []string{"30"}, Lgr: logger.Lgr}}}
+	adopted := ldr.adopt()
+
+	if !adopted["sleeper"] || adopted["removed"] {
+		t.Fatalf("expected only the running process to be adopted, got: %v", adopted)
+	}
+
+	if process := ldr.Processes[0]; !process.Running || process.proc.Pid != cmd.Process.Pid || process.Start != 42 || process.Runs != 3 {
+		t.Errorf("expected the process to be adopted as it was handed off, got: %+v", process)
+	}
+
+	if names, _ := state.Keys(HANDOFF_BUCKET); len(names) != 0 {
+		t.Errorf("expected the handed off processes to be forgotten once adopted, got: %v", names)
+	}
+
+	ldr.Processes[0].proc.Kill()
+	ldr.wait(&ldr.Processes[0])
+}
+
+func TestMiner(t *testing.T) {
+
+	miner, minerErr := minerFromJSON([]byte(`{"type": "miner", "miner": "TRex", "pools": ["stratum+tcp://one.example.org:4444", "stratum+tcp://two.example.org:4444"], "wallet": "0xabc", "worker": "rig1", "args": ["--no-watchdog"], "minHashrateMHs": 90}`))
+	if minerErr != nil {
+		t.Fatal(minerErr)
+	}
+
+	command, arguments := miner.commandLine()
+	if command != "t-rex" || strings.Join(arguments, " ") != "-a ethash -o stratum+tcp://one.example.org:4444 -u 0xabc -w rig1 --api-bind-http 127.0.0.1:4067 --no-watchdog" {
+		t.Errorf("expected the T-Rex command line for the first pool, got: %v %v", command, arguments)
+	}
+
+	for _, invalid := range []string{
+		`{"type": "service", "miner": "trex", "pools": ["stratum+tcp://one.example.org:4444"], "wallet": "0xabc"}`,
+		`{"type": "miner", "miner": "claymore", "pools": ["stratum+tcp://one.example.org:4444"], "wallet": "0xabc"}`,
+		`{"type": "miner", "miner": "trex", "wallet": "0xabc"}`,
+	} {
+		if _, minerErr := minerFromJSON([]byte(invalid)); minerErr == nil {
+			t.Errorf("expected the miner %v to be refused", invalid)
+		}
+	}
+
+	// a single failure stays on the pool but a second moves on to the next
+	if nextPool := miner.failed(); nextPool != "" {
+		t.Errorf("expected the miner to stay on its pool after one failure, got: %v", nextPool)
+	}
+	if nextPool := miner.failed(); nextPool != "stratum+tcp://two.example.org:4444" || miner.Pool() != nextPool {
+		t.Errorf("expected the miner to move on to the second pool, got: %v", nextPool)
+	}
+	if _, arguments := miner.commandLine(); arguments[3] != "stratum+tcp://two.example.org:4444" {
+		t.Errorf("expected the command line to use the second pool, got: %v", arguments)
+	}
+	miner.failed()
+	if nextPool := miner.failed(); nextPool != "stratum+tcp://one.example.org:4444" {
+		t.Errorf("expected the miner to wrap around to the first pool, got: %v", nextPool)
+	}
+
+	// a healthy reading resets the count of low ones
+	for index, hashrate := range []float64{50e6, 60e6, 95e6, 50e6, 50e6} {
+		if miner.observe(hashrate) {
+			t.Errorf("expected no restart after reading %d, got one", index)
+		}
+	}
+	if !miner.observe(10e6) {
+		t.Errorf("expected a restart after %d low readings in a row", MINER_LOW_HASHRATE_CHECKS)
+	}
+}
+
+func TestMinerOutput(t *testing.T) {
+
+	for line, expected := range map[string]float64{
+		"20240101 12:00:00 Total: 61.52 MH/s\n":                   61.52e6,
+		"Average speed (30s): 120.5 Mh/s\n":                       120.5e6,
+		"GPU0 hashrate 950 kH/s\n":                                950e3,
+		"Total Performance  1.2 GH/s, accepted: 10 rejected: 0\n": 1.2e9,
+	} {
+		if hashrate, isStats := parseStatsLine(line); !isStats || hashrate < expected*0.999 || hashrate > expected*1.001 {
+			t.Errorf("expected %q to be a hashrate of %v, got: %v %v", line, expected, hashrate, isStats)
+		}
+	}
+
+	if _, isStats := parseStatsLine("Connected to stratum+tcp://one.example.org:4444\n"); isStats {
+		t.Errorf("expected a line without a hashrate to be left alone")
+	}
+
+	miner := &Miner{Software: "trex", Pools: []string{"stratum+tcp://one.example.org:4444"}}
+	var log bytes.Buffer
+	miner.copyOutput(&log, strings.NewReader("Starting on pool one\nTotal: 61.52 MH/s\nShare accepted\nTotal: 62.00 MH/s"))
+
+	if log.String() != "Starting on pool one\nShare accepted\n" {
+		t.Errorf("expected the hashrate lines to be left out of the log, got: %q", log.String())
+	}
+
+	// the printed hashrate is used while the API can't be reached
+	miner.APIPort = 1
+	if hashrate, measureErr := miner.measure(); measureErr != nil || hashrate != 62e6 {
+		t.Errorf("expected the last printed hashrate, got: %v %v", hashrate, measureErr)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != "/summary" {
+			http.NotFound(writer, request)
+			return
+		}
+		fmt.Fprint(writer, `{"hashrate": 63500000, "uptime": 3600}`)
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	miner.APIPort, _ = strconv.Atoi(serverURL.Port())
+	if hashrate, measureErr := miner.measure(); measureErr != nil || hashrate != 63.5e6 {
+		t.Errorf("expected the hashrate from the T-Rex API, got: %v %v", hashrate, measureErr)
+	}
+}
+
+func TestMinerFromJSONFile(t *testing.T) {
+
+	processesFile, fileErr := ioutil.TempFile("", "loader_test")
+	if fileErr != nil {
+		t.Fatal(fileErr)
+	}
+	defer os.Remove(processesFile.Name())
+
+	processesFile.WriteString(`{"sleeper": "sleep 30", "rig": {"type": "miner", "miner": "lolminer", "pools": ["stratum+tcp://one.example.org:4444"], "wallet": "0xabc"}}`)
+	processesFile.Close()
+
+	processes, loadErr := processesFromJSONFile(processesFile.Name(), logger.Lgr)
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+
+	for _, process := range processes {
+		switch process.Name {
+		case "sleeper":
+			if process.Miner != nil || process.Command != "sleep" {
+				t.Errorf("expected a plain command line, got: %+v", process)
+			}
+		case "rig":
+			if process.Miner == nil || process.Command != "lolMiner" || strings.Join(process.Arguments, " ") != "--algo ETHASH --pool stratum+tcp://one.example.org:4444 --user 0xabc.default --apiport 4068" {
+				t.Errorf("expected the lolMiner command line, got: %v %v", process.Command, process.Arguments)
+			}
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("the jobs below are unix commands")
+	}
+
+	if config.Cfg == nil {
+		t.Skip("the jobs are validated against the AgentUser of the config, which couldn't be loaded")
+	}
+
+	defer func(agentUser string) { config.Cfg.AgentUser = agentUser }(config.Cfg.AgentUser)
+	config.Cfg.AgentUser = ""
+	os.Setenv("LOADER_TEST_COMMAND", "ls")
+	defer os.Unsetenv("LOADER_TEST_COMMAND")
+
+	notExecutable, fileErr := ioutil.TempFile("", "loader_test")
+	if fileErr != nil {
+		t.Fatal(fileErr)
+	}
+	notExecutable.Close()
+	defer os.Remove(notExecutable.Name())
+
+	for definition, valid := range map[string]bool{
+		`"ls -la"`:                               true,
+		`"{{env \"LOADER_TEST_COMMAND\"}} -la"`:  true,
+		`"{{nope}}"`:                             false,
+		`"loader-test-missing-binary --flag"`:    false,
+		`"` + notExecutable.Name() + `"`:         false,
+		`{"type": "miner", "miner": "claymore"}`: false,
+		`{"type": "miner", "miner": "trex", "pools": ["stratum+tcp://one.example.org:4444"], "wallet": "0xabc", "binary": "loader-test-missing-miner"}`: false,
+	} {
+		validateErr := Validate("job", []byte(definition))
+		if (valid && validateErr != nil) || (!valid && validateErr == nil) {
+			t.Errorf("expected %v to be valid: %v, got: %v", definition, valid, validateErr)
+		}
+	}
+
+	config.Cfg.AgentUser = "loader-test-missing-user"
+	if validateErr := Validate("job", []byte(`"ls"`)); validateErr == nil || !strings.Contains(validateErr.Error(), "loader-test-missing-user") {
+		t.Errorf("expected an AgentUser which doesn't exist to be reported, got: %v", validateErr)
+	}
+	config.Cfg.AgentUser = ""
+
+	processesFile, fileErr := ioutil.TempFile("", "loader_test")
+	if fileErr != nil {
+		t.Fatal(fileErr)
+	}
+	defer os.Remove(processesFile.Name())
+	processesFile.WriteString(`{"zeta": "loader-test-missing-binary", "alpha": "{{nope}}", "fine": "pwd"}`)
+	processesFile.Close()
+
+	jobProblems, dryRunErr := DryRun(processesFile.Name())
+	if dryRunErr != nil || len(jobProblems) != 2 || jobProblems[0].Name != "alpha" || jobProblems[1].Name != "zeta" {
+		t.Errorf("expected the problems of alpha and zeta in order, got: %+v %v", jobProblems, dryRunErr)
+	}
+}
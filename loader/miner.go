@@ -0,0 +1,504 @@
+package loader
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/transport"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The type of the loader processes which are miners
+const MINER_TYPE = "miner"
+
+// The algorithm miners mine when one isn't given
+const DEFAULT_MINER_ALGORITHM = "ethash"
+
+// How long a miner has to load its DAG and reach its hashrate before it's
+// checked. In seconds
+const MINER_WARMUP_SECONDS = 180
+
+// How often a running miner's hashrate is checked. In seconds
+const MINER_CHECK_SECONDS = 60
+
+// The number of checks in a row a miner's hashrate has to be below its
+// MinHashrateMHs before it's restarted
+const MINER_LOW_HASHRATE_CHECKS = 3
+
+// A miner which exits within this long of starting failed to mine on its
+// pool. In seconds
+const MINER_POOL_FAILURE_SECONDS = 120
+
+// The number of failures in a row after which a miner moves on to its next pool
+const MINER_POOL_FAILURES = 2
+
+// How long a miner's API has to reply. In seconds
+const MINER_API_TIMEOUT_SECONDS = 5
+
+// How long a miner waits for its API port to be released, e.g. by the copy of
+// it which was just restarted, before it fails to start. In seconds
+const MINER_API_PORT_WAIT_SECONDS = 30
+
+// The hashes per second in one megahash per second
+const HASHES_PER_MEGAHASH = 1000000
+
+// The prefix of the name of the metric each miner's hashrate is recorded
+// under, followed by the name of its loader process
+const MINER_METRIC_PREFIX = "miner_"
+
+// The periodic hashrate lines miners print, such as "Total: 61.52 MH/s"
+var minerStatsPattern = regexp.MustCompile(`(?i)\b(?:total|speed|hashrate|performance)\b.*?([0-9]+(?:\.[0-9]+)?)\s*([kmgt]?)h/s`)
+
+// The number of hashes per second in each unit miners print
+var hashrateUnits = map[string]float64{"": 1, "k": 1e3, "m": 1e6, "g": 1e9, "t": 1e12}
+
+// Miner is a loader process which runs a known mining program. Its command
+// line is built from the pool, wallet and worker, its hashrate is read from
+// the program's own API and it's moved on to the next of its Pools when it
+// keeps failing on the current one. In the loader asset a miner is given as
+// an object instead of a command line:
+//
+//	"rig": {"type": "miner", "miner": "trex", "pools": ["stratum+tcp://eu1.example.org:4444"], "wallet": "0x...", "worker": "rig1", "minHashrateMHs": 90}
+type Miner struct {
+	Type           string   `json:"type"`
+	Software       string   `json:"miner"`
+	Binary         string   `json:"binary"`
+	Algorithm      string   `json:"algorithm"`
+	Pools          []string `json:"pools"`
+	Wallet         string   `json:"wallet"`
+	Worker         string   `json:"worker"`
+	Args           []string `json:"args"`
+	APIPort        int      `json:"apiPort"`
+	MinHashrateMHs float64  `json:"minHashrateMHs"`
+
+	lock         sync.Mutex
+	pool         int       // the index of the pool in Pools currently mined on
+	failures     int       // the failures in a row on the current pool
+	lowChecks    int       // the hashrate checks in a row below MinHashrateMHs
+	hashrate     float64   // the last hashrate measured, in hashes per second
+	printed      float64   // the last hashrate the miner printed, in hashes per second
+	printedAt    time.Time // when the miner last printed its hashrate
+	omittedLines uint64    // the hashrate lines left out of the log
+}
+
+// minerProfile is what the loader knows about a single mining program.
+type minerProfile struct {
+	binary   string
+	apiPort  int
+	args     func(miner *Miner, pool string) []string
+	hashrate func(port int) (float64, error)
+}
+
+// The mining programs the loader knows the flags and APIs of by name
+var minerProfiles = map[string]minerProfile{
+	"trex": {binary: "t-rex", apiPort: 4067, args: func(miner *Miner, pool string) []string {
+		return []string{"-a", miner.Algorithm, "-o", pool, "-u", miner.Wallet, "-w", miner.Worker, "--api-bind-http", "127.0.0.1:" + strconv.Itoa(miner.APIPort)}
+	}, hashrate: trexHashrate},
+	"lolminer": {binary: "lolMiner", apiPort: 4068, args: func(miner *Miner, pool string) []string {
+		return []string{"--algo", strings.ToUpper(miner.Algorithm), "--pool", pool, "--user", miner.Wallet + "." + miner.Worker, "--apiport", strconv.Itoa(miner.APIPort)}
+	}, hashrate: lolMinerHashrate},
+	"nbminer": {binary: "nbminer", apiPort: 22333, args: func(miner *Miner, pool string) []string {
+		return []string{"-a", miner.Algorithm, "-o", pool, "-u", miner.Wallet + "." + miner.Worker, "--api", "127.0.0.1:" + strconv.Itoa(miner.APIPort)}
+	}, hashrate: nbMinerHashrate},
+	"teamredminer": {binary: "teamredminer", apiPort: 4028, args: func(miner *Miner, pool string) []string {
+		return []string{"-a", miner.Algorithm, "-o", pool, "-u", miner.Wallet + "." + miner.Worker, "-p", "x", "--api_listen=127.0.0.1:" + strconv.Itoa(miner.APIPort)}
+	}, hashrate: teamRedMinerHashrate},
+}
+
+// minerFromJSON will read a miner from its object in the loader asset and
+// fill in the defaults of its mining program.
+func minerFromJSON(minerJSON []byte) (*Miner, error) {
+
+	miner := &Miner{}
+	if jsonErr := json.Unmarshal(minerJSON, miner); jsonErr != nil {
+		return nil, jsonErr
+	}
+
+	if miner.Type != MINER_TYPE {
+		return nil, fmt.Errorf("Unknown process type %q. Only %v processes can be given as an object", miner.Type, MINER_TYPE)
+	}
+
+	profile, known := minerProfiles[strings.ToLower(miner.Software)]
+	if !known {
+		return nil, fmt.Errorf("Unknown miner %q. Use one of %v", miner.Software, strings.Join(MinerNames(), ", "))
+	}
+	miner.Software = strings.ToLower(miner.Software)
+
+	if len(miner.Pools) == 0 || miner.Wallet == "" {
+		return nil, fmt.Errorf("A miner needs at least one pool and a wallet")
+	}
+
+	if miner.Binary == "" {
+		miner.Binary = profile.binary
+	}
+	if miner.Algorithm == "" {
+		miner.Algorithm = DEFAULT_MINER_ALGORITHM
+	}
+	if miner.Worker == "" {
+		miner.Worker = "default"
+	}
+	if miner.APIPort == 0 {
+		miner.APIPort = profile.apiPort
+	}
+
+	return miner, nil
+}
+
+// MinerNames returns the names of the mining programs the loader knows in
+// alphabetical order.
+func MinerNames() []string {
+
+	var names []string
+	for name := range minerProfiles {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// commandLine returns the command and arguments which start the miner on its
+// current pool.
+func (miner *Miner) commandLine() (string, []string) {
+
+	miner.lock.Lock()
+	pool := miner.Pools[miner.pool]
+	miner.lock.Unlock()
+
+	arguments := minerProfiles[miner.Software].args(miner, pool)
+	return miner.Binary, append(arguments, miner.Args...)
+}
+
+// Pool returns the pool the miner is currently mining on.
+func (miner *Miner) Pool() string {
+	miner.lock.Lock()
+	defer miner.lock.Unlock()
+	return miner.Pools[miner.pool]
+}
+
+// Summary describes the pool the miner is on, its hashrate and how many of
+// the hashrate lines it printed were left out of its log.
+func (miner *Miner) Summary() string {
+	miner.lock.Lock()
+	defer miner.lock.Unlock()
+	return fmt.Sprintf("%v on %v at %.1f MH/s, %d hashrate lines left out of its log", miner.Software, miner.Pools[miner.pool], miner.hashrate/HASHES_PER_MEGAHASH, miner.omittedLines)
+}
+
+// Hashrate returns the last hashrate measured in megahashes per second.
+func (miner *Miner) Hashrate() float64 {
+	miner.lock.Lock()
+	defer miner.lock.Unlock()
+	return miner.hashrate / HASHES_PER_MEGAHASH
+}
+
+// measure returns the miner's current hashrate in hashes per second, read
+// from its API or, when that can't be reached, from the hashrate it last
+// printed.
+func (miner *Miner) measure() (float64, error) {
+
+	hashrate, apiErr := minerProfiles[miner.Software].hashrate(miner.APIPort)
+	if apiErr == nil {
+		return hashrate, nil
+	}
+
+	miner.lock.Lock()
+	defer miner.lock.Unlock()
+
+	if time.Since(miner.printedAt) < MINER_CHECK_SECONDS*time.Second {
+		return miner.printed, nil
+	}
+
+	return 0, apiErr
+}
+
+// observe will record the given hashrate in hashes per second and return
+// whether the miner has been below its MinHashrateMHs for
+// MINER_LOW_HASHRATE_CHECKS checks in a row and should be restarted.
+func (miner *Miner) observe(hashrate float64) bool {
+
+	miner.lock.Lock()
+	defer miner.lock.Unlock()
+
+	miner.hashrate = hashrate
+
+	if miner.MinHashrateMHs <= 0 || hashrate >= miner.MinHashrateMHs*HASHES_PER_MEGAHASH {
+		// mining at full speed proves the pool works
+		miner.lowChecks = 0
+		miner.failures = 0
+		return false
+	}
+
+	miner.lowChecks++
+	if miner.lowChecks < MINER_LOW_HASHRATE_CHECKS {
+		return false
+	}
+
+	miner.lowChecks = 0
+	return true
+}
+
+// failed will count a failure of the miner on its current pool and move it on
+// to its next pool after MINER_POOL_FAILURES failures in a row. Returns the
+// pool it moved on to, or an empty string if it stays.
+func (miner *Miner) failed() string {
+
+	miner.lock.Lock()
+	defer miner.lock.Unlock()
+
+	miner.failures++
+	if miner.failures < MINER_POOL_FAILURES || len(miner.Pools) == 1 {
+		return ""
+	}
+
+	miner.failures = 0
+	miner.pool = (miner.pool + 1) % len(miner.Pools)
+	return miner.Pools[miner.pool]
+}
+
+// copyOutput will copy everything the miner writes to the given log except
+// for the hashrate lines it prints, which are parsed and left out so they
+// don't drown out everything else.
+func (miner *Miner) copyOutput(log io.Writer, output io.Reader) {
+
+	reader := bufio.NewReader(output)
+	for 1 == 1 {
+		line, readErr := reader.ReadString('\n')
+		if line != "" {
+			if hashrate, isStats := parseStatsLine(line); isStats {
+				miner.lock.Lock()
+				miner.printed = hashrate
+				miner.printedAt = time.Now()
+				miner.omittedLines++
+				miner.lock.Unlock()
+			} else {
+				log.Write([]byte(line))
+			}
+		}
+		if readErr != nil {
+			return
+		}
+	}
+}
+
+// parseStatsLine returns the hashrate in hashes per second printed on the
+// given line of miner output, if it's a hashrate line.
+func parseStatsLine(line string) (float64, bool) {
+
+	match := minerStatsPattern.FindStringSubmatch(line)
+	if match == nil {
+		return 0, false
+	}
+
+	value, parseErr := strconv.ParseFloat(match[1], 64)
+	if parseErr != nil {
+		return 0, false
+	}
+
+	return value * hashrateUnits[strings.ToLower(match[2])], true
+}
+
+// watchMiner will check the hashrate of the given miner every
+// MINER_CHECK_SECONDS once it has warmed up, until done is closed. A miner
+// which stays below its MinHashrateMHs is restarted and counts as failing on
+// its pool.
+func (ldr *Loader) watchMiner(currentProcess *LoaderProcess, done <-chan struct{}) {
+
+	miner := currentProcess.Miner
+
+	select {
+	case <-done:
+		return
+	case <-time.After(MINER_WARMUP_SECONDS * time.Second):
+	}
+
+	for 1 == 1 {
+		hashrate, measureErr := miner.measure()
+		if measureErr != nil {
+			currentProcess.Lgr.LogErrorf("Could not read the hashrate of miner %v: %v", currentProcess.Name, measureErr)
+		}
+
+		if miner.observe(hashrate) {
+			detail := fmt.Sprintf("Miner %v has been below %.1f MH/s for %d checks on %v. Restarting it", currentProcess.Name, miner.MinHashrateMHs, MINER_LOW_HASHRATE_CHECKS, miner.Pool())
+			ldr.log().LogError(detail)
+			events.Publish(events.ThresholdBreached{Metric: MINER_METRIC_PREFIX + currentProcess.Name + "_mhs", Value: hashrate / HASHES_PER_MEGAHASH, Limit: miner.MinHashrateMHs, Detail: detail})
+			ldr.minerFailed(currentProcess)
+			ldr.Restart(currentProcess.Name)
+			return
+		}
+
+		select {
+		case <-done:
+			return
+		case <-time.After(MINER_CHECK_SECONDS * time.Second):
+		}
+	}
+}
+
+// waitForAPIPort will wait up to MINER_API_PORT_WAIT_SECONDS for the API
+// port of the miner to be free. Returns why it's taken when it isn't released
+// in time.
+func (miner *Miner) waitForAPIPort() error {
+
+	address := fmt.Sprintf("127.0.0.1:%d", miner.APIPort)
+	deadline := time.Now().Add(MINER_API_PORT_WAIT_SECONDS * time.Second)
+
+	for 1 == 1 {
+		portErr := utils.PortFree(address)
+		if portErr == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("The API port %v of the miner is taken: %v", address, portErr)
+		}
+		time.Sleep(utils.PROBE_POLL_MILLISECONDS * time.Millisecond)
+	}
+
+	return nil
+}
+
+// minerFailed will count a failure of the given miner on its current pool and
+// log when it moves on to the next one.
+func (ldr *Loader) minerFailed(currentProcess *LoaderProcess) {
+	if nextPool := currentProcess.Miner.failed(); nextPool != "" {
+		ldr.log().LogMessagef("Miner %v keeps failing. Switching it to pool %v", currentProcess.Name, nextPool)
+	}
+}
+
+// MinerMetrics returns the hashrate of each miner in megahashes per second for
+// the profile history.
+func (ldr *Loader) MinerMetrics() (map[string]float64, error) {
+
+	ldr.lock.Lock()
+	defer ldr.lock.Unlock()
+
+	metrics := make(map[string]float64)
+	for _, process := range ldr.Processes {
+		if process.Miner != nil && process.Running {
+			metrics[MINER_METRIC_PREFIX+process.Name+"_mhs"] = process.Miner.Hashrate()
+		}
+	}
+
+	return metrics, nil
+}
+
+// getMinerAPI will GET the given path of a miner's HTTP API on the local
+// machine and decode its JSON reply into reply.
+func getMinerAPI(port int, path string, reply interface{}) error {
+
+	client := &http.Client{Timeout: MINER_API_TIMEOUT_SECONDS * time.Second}
+	response, getErr := client.Get(fmt.Sprintf("http://127.0.0.1:%d%v", port, path))
+	if getErr != nil {
+		return getErr
+	}
+	defer response.Body.Close()
+
+	if statusErr := transport.CheckStatus(response); statusErr != nil {
+		return statusErr
+	}
+
+	body, readErr := ioutil.ReadAll(io.LimitReader(response.Body, 1024*1024))
+	if readErr != nil {
+		return readErr
+	}
+
+	return json.Unmarshal(body, reply)
+}
+
+// trexHashrate reads the hashrate in hashes per second from T-Rex's API.
+func trexHashrate(port int) (float64, error) {
+
+	var summary struct {
+		Hashrate float64 `json:"hashrate"`
+	}
+	if getErr := getMinerAPI(port, "/summary", &summary); getErr != nil {
+		return 0, getErr
+	}
+
+	return summary.Hashrate, nil
+}
+
+// lolMinerHashrate reads the hashrate in hashes per second from lolMiner's API.
+func lolMinerHashrate(port int) (float64, error) {
+
+	var summary struct {
+		Algorithms []struct {
+			TotalPerformance float64 `json:"Total_Performance"`
+			PerformanceUnit  string  `json:"Performance_Unit"`
+		} `json:"Algorithms"`
+	}
+	if getErr := getMinerAPI(port, "/", &summary); getErr != nil {
+		return 0, getErr
+	}
+
+	if len(summary.Algorithms) == 0 {
+		return 0, fmt.Errorf("lolMiner didn't report any algorithms")
+	}
+
+	algorithm := summary.Algorithms[0]
+	unit := strings.ToLower(strings.TrimSuffix(strings.ToLower(algorithm.PerformanceUnit), "h/s"))
+	return algorithm.TotalPerformance * hashrateUnits[unit], nil
+}
+
+// nbMinerHashrate reads the hashrate in hashes per second from NBMiner's API.
+func nbMinerHashrate(port int) (float64, error) {
+
+	var status struct {
+		Miner struct {
+			TotalHashrateRaw float64 `json:"total_hashrate_raw"`
+		} `json:"miner"`
+	}
+	if getErr := getMinerAPI(port, "/api/v1/status", &status); getErr != nil {
+		return 0, getErr
+	}
+
+	return status.Miner.TotalHashrateRaw, nil
+}
+
+// teamRedMinerHashrate reads the hashrate in hashes per second from
+// TeamRedMiner's cgminer style API, which speaks JSON over a plain socket.
+func teamRedMinerHashrate(port int) (float64, error) {
+
+	conn, dialErr := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), MINER_API_TIMEOUT_SECONDS*time.Second)
+	if dialErr != nil {
+		return 0, dialErr
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(MINER_API_TIMEOUT_SECONDS * time.Second))
+
+	if _, writeErr := conn.Write([]byte(`{"command":"summary"}`)); writeErr != nil {
+		return 0, writeErr
+	}
+
+	// the reply is terminated by a null byte and the connection closing
+	replyBytes, readErr := ioutil.ReadAll(io.LimitReader(conn, 1024*1024))
+	if readErr != nil {
+		return 0, readErr
+	}
+
+	var reply struct {
+		Summary []struct {
+			MHS30s float64 `json:"MHS 30s"`
+		} `json:"SUMMARY"`
+	}
+	if jsonErr := json.Unmarshal([]byte(strings.TrimRight(string(replyBytes), "\x00")), &reply); jsonErr != nil {
+		return 0, jsonErr
+	}
+
+	if len(reply.Summary) == 0 {
+		return 0, fmt.Errorf("TeamRedMiner didn't report a summary")
+	}
+
+	return reply.Summary[0].MHS30s * HASHES_PER_MEGAHASH, nil
+}
@@ -0,0 +1,123 @@
+package loader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"os/user"
+	"sort"
+	"strings"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+)
+
+// JobProblems is everything Validate found wrong with a single job.
+type JobProblems struct {
+	Name     string   `json:"name"`
+	Problems []string `json:"problems"`
+}
+
+// Error lists the problems of the job on a single line.
+func (jp JobProblems) Error() string {
+	return fmt.Sprintf("Job %v: %v", jp.Name, strings.Join(jp.Problems, ". "))
+}
+
+// Validate will check the job of the given name could be started from the
+// given definition, as it's written in the loader asset, without starting it:
+// its templates expand, it's a valid command line or miner, its executable
+// exists and the user jobs run as, the AgentUser when one is set, exists and
+// can execute it. Returns JobProblems listing every problem found, or nil.
+func Validate(name string, definition json.RawMessage) error {
+
+	problems := JobProblems{Name: name}
+
+	wrapped, marshalErr := json.Marshal(map[string]json.RawMessage{name: definition})
+	if marshalErr != nil {
+		problems.Problems = append(problems.Problems, marshalErr.Error())
+		return problems
+	}
+
+	expanded, expandErr := config.ExpandTemplates(name, wrapped)
+	if expandErr != nil {
+		problems.Problems = append(problems.Problems, expandErr.Error())
+		return problems
+	}
+
+	var fields map[string]json.RawMessage
+	if jsonErr := json.Unmarshal(expanded, &fields); jsonErr != nil {
+		problems.Problems = append(problems.Problems, jsonErr.Error())
+		return problems
+	}
+
+	process, processErr := processFromJSON(name, fields[name])
+	if processErr != nil {
+		problems.Problems = append(problems.Problems, processErr.Error())
+		return problems
+	}
+
+	if process.Command == "" {
+		problems.Problems = append(problems.Problems, "No command is given")
+		return problems
+	}
+
+	executable, lookErr := exec.LookPath(process.Command)
+	if lookErr != nil {
+		problems.Problems = append(problems.Problems, fmt.Sprintf("The executable %v can't be run: %v", process.Command, lookErr))
+	}
+
+	if config.Cfg.AgentUser != "" {
+		if _, userErr := user.Lookup(config.Cfg.AgentUser); userErr != nil {
+			problems.Problems = append(problems.Problems, fmt.Sprintf("Jobs run as the AgentUser %v, which doesn't exist: %v", config.Cfg.AgentUser, userErr))
+		} else if lookErr == nil {
+			if executableErr := executableBy(executable, config.Cfg.AgentUser); executableErr != nil {
+				problems.Problems = append(problems.Problems, executableErr.Error())
+			}
+		}
+	}
+
+	if len(problems.Problems) > 0 {
+		return problems
+	}
+
+	return nil
+}
+
+// DryRun will Validate every job of the given loader asset without starting
+// any of them or creating their logs. Returns the problems of every job which
+// has any, in order of their names, and an error when the asset itself can't
+// be read.
+func DryRun(processesPath string) ([]JobProblems, error) {
+
+	fileBytes, readErr := ioutil.ReadFile(processesPath)
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	var definitions map[string]json.RawMessage
+	if jsonErr := json.Unmarshal(fileBytes, &definitions); jsonErr != nil {
+		return nil, fmt.Errorf("The loader asset %v isn't a JSON object: %v", processesPath, jsonErr)
+	}
+
+	return ValidateAll(definitions), nil
+}
+
+// ValidateAll will Validate every one of the given job definitions by name.
+// Returns the problems of every job which has any, in order of their names.
+func ValidateAll(definitions map[string]json.RawMessage) []JobProblems {
+
+	var names []string
+	for name := range definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	found := []JobProblems{}
+	for _, name := range names {
+		if validateErr := Validate(name, definitions[name]); validateErr != nil {
+			found = append(found, validateErr.(JobProblems))
+		}
+	}
+
+	return found
+}
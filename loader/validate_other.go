@@ -0,0 +1,73 @@
+//go:build !windows
+
+package loader
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// executableBy returns an error unless the given user can execute the file at
+// the given path, going by its owner, group and permissions.
+func executableBy(path string, username string) error {
+
+	account, lookupErr := user.Lookup(username)
+	if lookupErr != nil {
+		return lookupErr
+	}
+
+	info, statErr := os.Stat(path)
+	if statErr != nil {
+		return statErr
+	}
+	stat, isStat := info.Sys().(*syscall.Stat_t)
+	if !isStat {
+		return nil
+	}
+
+	mode := info.Mode().Perm()
+	uid := strconv.FormatUint(uint64(stat.Uid), 10)
+	gid := strconv.FormatUint(uint64(stat.Gid), 10)
+
+	var allowed bool
+	switch {
+	case account.Uid == "0":
+		allowed = mode&0111 != 0
+	case account.Uid == uid:
+		allowed = mode&0100 != 0
+	case inGroup(account, gid):
+		allowed = mode&0010 != 0
+	default:
+		allowed = mode&0001 != 0
+	}
+
+	if !allowed {
+		return fmt.Errorf("The executable %v can't be run by the AgentUser %v. Its permissions are %v", path, username, mode)
+	}
+
+	return nil
+}
+
+// inGroup returns whether the given user is a member of the group with the
+// given id.
+func inGroup(account *user.User, gid string) bool {
+
+	if account.Gid == gid {
+		return true
+	}
+
+	groups, groupsErr := account.GroupIds()
+	if groupsErr != nil {
+		return false
+	}
+	for _, group := range groups {
+		if group == gid {
+			return true
+		}
+	}
+
+	return false
+}
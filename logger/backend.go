@@ -0,0 +1,59 @@
+package logger
+
+import (
+	"fmt"
+)
+
+// Backend is the logging the updater, the loader and the reporter need. A
+// *Logger writing to rotating log files is the default. Programs embedding
+// the agent can hand them any other Backend, such as their own zap or logrus
+// logger via FromLeveled, instead.
+type Backend interface {
+	LogMessage(message string)
+	LogMessagef(formatString string, values ...interface{})
+	LogError(message string)
+	LogErrorf(formatString string, values ...interface{})
+}
+
+// *Logger is the default Backend
+var _ Backend = (*Logger)(nil)
+
+// Leveled is a logger with a printf style method for each level, such as
+// zap's *zap.SugaredLogger or logrus' *logrus.Logger and *logrus.Entry.
+type Leveled interface {
+	Infof(template string, args ...interface{})
+	Errorf(template string, args ...interface{})
+}
+
+// leveledBackend logs to a Leveled logger.
+type leveledBackend struct {
+	leveled Leveled
+}
+
+// FromLeveled returns a Backend which logs messages at info level and errors
+// at error level to the given logger, e.g. FromLeveled(zapLogger.Sugar()) or
+// FromLeveled(logrus.StandardLogger()). Secrets are redacted first just as
+// they are in the log files.
+func FromLeveled(leveled Leveled) Backend {
+	return leveledBackend{leveled: leveled}
+}
+
+// LogMessage will log the message as is at info level.
+func (lb leveledBackend) LogMessage(message string) {
+	lb.leveled.Infof("%s", Redact(message))
+}
+
+// LogMessagef will log the formatted message at info level.
+func (lb leveledBackend) LogMessagef(formatString string, values ...interface{}) {
+	lb.LogMessage(fmt.Sprintf(formatString, values...))
+}
+
+// LogError will log the message as is at error level.
+func (lb leveledBackend) LogError(message string) {
+	lb.leveled.Errorf("%s", Redact(message))
+}
+
+// LogErrorf will log the formatted message at error level.
+func (lb leveledBackend) LogErrorf(formatString string, values ...interface{}) {
+	lb.LogError(fmt.Sprintf(formatString, values...))
+}
@@ -0,0 +1,179 @@
+package logger
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// The prefixes written in front of each line the agent writes to its standard
+// output and standard error while they're captured
+const STDOUT_PREFIX = "stdout: "
+const STDERR_PREFIX = "stderr: "
+
+// The longest line read from standard output or standard error in one go.
+// Longer lines are logged in pieces
+const MAX_CAPTURED_LINE_BYTES = 64 * 1024
+
+// A stream of the agent's standard output or standard error redirected to a
+// pipe which is read into Lgr.
+type capturedStream struct {
+	original *os.File     // Where the stream went before it was captured
+	restore  func() error // Points the stream back at original
+}
+
+var captureLock sync.Mutex
+var captured []capturedStream
+var pumping sync.WaitGroup
+
+// the console messages are echoed to, which stays the real standard output
+// while it's captured so messages aren't logged twice
+var console io.Writer = os.Stdout
+var consoleLock sync.Mutex
+
+// CaptureOutput will redirect everything the agent writes to its standard
+// output and standard error into Lgr, one message per line, prefixed with
+// STDOUT_PREFIX or STDERR_PREFIX. That includes output written straight to
+// the file descriptors, e.g. by cgo or the go runtime, rather than via
+// os.Stdout and os.Stderr. Lines written to standard error are still written
+// to the real standard error too, so a watchdog or service manager keeps
+// seeing them. Messages logged by any logger keep being echoed to the real
+// standard output. A fatal error printed by the go runtime kills the agent
+// before it can be logged. The crash package logs it when the agent next
+// starts. Calling it again while the output is captured does nothing.
+func CaptureOutput() error {
+
+	if Lgr == nil {
+		return errors.New("The standard logger must be created before the output can be captured")
+	}
+
+	captureLock.Lock()
+	defer captureLock.Unlock()
+
+	if len(captured) > 0 {
+		return nil
+	}
+
+	stdout, stdoutErr := capture(&os.Stdout, STDOUT_PREFIX, false)
+	if stdoutErr != nil {
+		return fmt.Errorf("Could not capture the standard output: %v", stdoutErr)
+	}
+	setConsole(stdout.original)
+	captured = append(captured, stdout)
+
+	stderr, stderrErr := capture(&os.Stderr, STDERR_PREFIX, true)
+	if stderrErr != nil {
+		releaseLocked()
+		return fmt.Errorf("Could not capture the standard error: %v", stderrErr)
+	}
+	captured = append(captured, stderr)
+
+	Lgr.LogMessage("Successfully captured the standard output and standard error")
+	return nil
+}
+
+// CapturingOutput returns true while the standard output and standard error
+// are captured by CaptureOutput.
+func CapturingOutput() bool {
+	captureLock.Lock()
+	defer captureLock.Unlock()
+	return len(captured) > 0
+}
+
+// ReleaseOutput will point the standard output and standard error back at
+// where they went before CaptureOutput and wait for everything written to
+// them until then to be logged. Should be called on shutdown so the last
+// lines aren't lost.
+func ReleaseOutput() error {
+
+	captureLock.Lock()
+	defer captureLock.Unlock()
+
+	return releaseLocked()
+}
+
+// releaseLocked will restore every captured stream and wait for the lines
+// written to them to be logged. captureLock must be held.
+func releaseLocked() error {
+
+	var restoreErr error
+	for _, stream := range captured {
+		if err := stream.restore(); err != nil && restoreErr == nil {
+			restoreErr = err
+		}
+	}
+
+	setConsole(os.Stdout)
+	captured = nil
+
+	// the pipes reach their end once nothing can write to them any more
+	pumping.Wait()
+	return restoreErr
+}
+
+// capture will redirect the given stream to a pipe and start logging every
+// line written to it with the given prefix. The lines are also written to
+// where the stream went before when echo is true.
+func capture(stream **os.File, prefix string, echo bool) (capturedStream, error) {
+
+	reader, writer, pipeErr := os.Pipe()
+	if pipeErr != nil {
+		return capturedStream{}, pipeErr
+	}
+
+	original, restore, redirectErr := redirect(stream, writer)
+	if redirectErr != nil {
+		reader.Close()
+		writer.Close()
+		return capturedStream{}, redirectErr
+	}
+
+	var echoTo io.Writer
+	if echo {
+		echoTo = original
+	}
+
+	pumping.Add(1)
+	go pump(reader, prefix, echoTo)
+
+	return capturedStream{original: original, restore: restore}, nil
+}
+
+// pump will log every line read from the given reader with the given prefix
+// until it reaches its end, writing it to echoTo as well when it isn't nil.
+func pump(reader io.ReadCloser, prefix string, echoTo io.Writer) {
+
+	defer pumping.Done()
+	defer reader.Close()
+
+	lines := bufio.NewReaderSize(reader, MAX_CAPTURED_LINE_BYTES)
+	for 1 == 1 {
+		// a line longer than the buffer comes back in pieces, each logged
+		// on its own rather than leaving the writers blocked on a full pipe
+		line, _, readErr := lines.ReadLine()
+		if readErr != nil {
+			return
+		}
+		if echoTo != nil {
+			fmt.Fprintln(echoTo, string(line))
+		}
+		Lgr.LogMessage(prefix + string(line))
+	}
+}
+
+// consoleOutput returns where messages are echoed to for local watchers.
+func consoleOutput() io.Writer {
+	consoleLock.Lock()
+	defer consoleLock.Unlock()
+	return console
+}
+
+// setConsole will echo messages to the given writer from now on.
+func setConsole(writer io.Writer) {
+	consoleLock.Lock()
+	console = writer
+	consoleLock.Unlock()
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+
+package logger
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// redirect will point the file descriptor of the given stream at the given
+// writer, which it takes over, so anything written to the descriptor goes to
+// the writer. Returns a copy of where the descriptor pointed before and a
+// function which points it back there.
+func redirect(stream **os.File, writer *os.File) (*os.File, func() error, error) {
+
+	fd := int((*stream).Fd())
+
+	saved, dupErr := unix.Dup(fd)
+	if dupErr != nil {
+		return nil, nil, dupErr
+	}
+	original := os.NewFile(uintptr(saved), (*stream).Name())
+
+	if dupErr := unix.Dup2(int(writer.Fd()), fd); dupErr != nil {
+		original.Close()
+		return nil, nil, dupErr
+	}
+	// the descriptor holds its own copy of the writer
+	writer.Close()
+
+	restore := func() error {
+		defer original.Close()
+		return unix.Dup2(saved, fd)
+	}
+
+	return original, restore, nil
+}
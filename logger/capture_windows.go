@@ -0,0 +1,35 @@
+package logger
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// redirect will point the standard handle of the given stream at the given
+// writer, which it takes over, so anything written to the handle, including
+// by the go runtime, goes to the writer. Returns where the handle pointed
+// before and a function which points it back there.
+func redirect(stream **os.File, writer *os.File) (*os.File, func() error, error) {
+
+	handle := uint32(windows.STD_OUTPUT_HANDLE)
+	if stream == &os.Stderr {
+		handle = uint32(windows.STD_ERROR_HANDLE)
+	}
+
+	original := *stream
+	if setErr := windows.SetStdHandle(handle, windows.Handle(writer.Fd())); setErr != nil {
+		return nil, nil, setErr
+	}
+	*stream = writer
+
+	restore := func() error {
+		setErr := windows.SetStdHandle(handle, windows.Handle(original.Fd()))
+		*stream = original
+		// nothing else holds the writer so the pipe reaches its end
+		writer.Close()
+		return setErr
+	}
+
+	return original, restore, nil
+}
@@ -0,0 +1,129 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The permissions the log directory and the directory of each logger within
+// it are given unless SetLogDir is given others
+const DEFAULT_LOG_DIR_MODE = 0700
+
+var logDir string
+var logDirMode os.FileMode = DEFAULT_LOG_DIR_MODE
+var logMinFreeBytes uint64
+var logDirLock sync.Mutex
+
+// SetLogDir will make every logger, including those created from now on,
+// write its log files to a directory of its own, named after it, within the
+// given directory, e.g. /var/log/anon-eth-net/main_package. The directories
+// are created when they don't exist and given the given permissions. Loggers
+// already writing elsewhere start a new log file there straight away. An
+// empty directory writes log files to the working directory as before.
+// Returns an error, without changing anything, if the directory can't be
+// created or has less than the given number of bytes free. Once it's set, the
+// oldest log file of a logger is deleted before it starts a new one whenever
+// there's less than that free.
+func SetLogDir(dir string, mode os.FileMode, minFreeBytes uint64) error {
+
+	if dirErr := CheckLogDir(dir, mode, minFreeBytes); dirErr != nil {
+		return dirErr
+	}
+
+	logDirLock.Lock()
+	moved := dir != logDir
+	logDir = dir
+	logDirMode = mode
+	logMinFreeBytes = minFreeBytes
+	logDirLock.Unlock()
+
+	if !moved {
+		return nil
+	}
+
+	loggersLock.Lock()
+	current := append([]*Logger{}, loggers...)
+	loggersLock.Unlock()
+
+	for _, lgr := range current {
+		lgr.lock.Lock()
+		newFileErr := lgr.newFile()
+		lgr.lock.Unlock()
+		if newFileErr != nil {
+			return newFileErr
+		}
+	}
+
+	return nil
+}
+
+// CheckLogDir will create the given directory with the given permissions, as
+// SetLogDir does, and return the error SetLogDir would for it without
+// writing any log files there.
+func CheckLogDir(dir string, mode os.FileMode, minFreeBytes uint64) error {
+
+	if dir == "" {
+		return nil
+	}
+
+	if mkdirErr := os.MkdirAll(dir, mode); mkdirErr != nil {
+		return fmt.Errorf("Could not create the log directory %v: %v", dir, mkdirErr)
+	}
+	// MkdirAll leaves existing directories alone and is limited by the umask
+	if chmodErr := os.Chmod(dir, mode); chmodErr != nil {
+		return fmt.Errorf("Could not set the permissions of the log directory %v to %v: %v", dir, mode, chmodErr)
+	}
+	if free, spaceErr := freeSpace(dir); spaceErr == nil && free < minFreeBytes {
+		return fmt.Errorf("The log directory %v has %v free but needs %v", dir, utils.FormatBytes(int64(free)), utils.FormatBytes(int64(minFreeBytes)))
+	}
+
+	return nil
+}
+
+// LogDir returns the directory given to SetLogDir, or an empty string when
+// log files are written to the working directory.
+func LogDir() string {
+	logDirLock.Lock()
+	defer logDirLock.Unlock()
+	return logDir
+}
+
+// loggerDir returns the directory the logger with the given base name writes
+// its log files to, creating it first when it doesn't exist.
+func loggerDir(baseName string) (string, error) {
+
+	logDirLock.Lock()
+	dir, mode := logDir, logDirMode
+	logDirLock.Unlock()
+
+	if dir == "" {
+		return "", nil
+	}
+
+	ownDir := filepath.Join(dir, sanitizeFileName(baseName))
+	if mkdirErr := os.MkdirAll(ownDir, mode); mkdirErr != nil {
+		return "", mkdirErr
+	}
+	return ownDir, nil
+}
+
+// lowOnSpace returns how many bytes are free in the given directory and
+// whether that's less than the minimum given to SetLogDir. Space which can't
+// be measured isn't low.
+func lowOnSpace(dir string) (uint64, bool) {
+
+	logDirLock.Lock()
+	minFree := logMinFreeBytes
+	logDirLock.Unlock()
+
+	if dir == "" {
+		dir = "."
+	}
+
+	free, spaceErr := freeSpace(dir)
+	return free, spaceErr == nil && free < minFree
+}
@@ -0,0 +1,105 @@
+package logger
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// EscapeMessage returns the given message as a single line of valid UTF-8 so
+// every message, even a stack trace or binary output captured from a child
+// process, is exactly one line of the log file. Backslashes are doubled,
+// newlines and carriage returns become \n and \r, and any other control
+// character or byte which isn't valid UTF-8 becomes \x followed by its two hex
+// digits. Tabs are left alone. Messages which need none of that are returned
+// as they are. UnescapeMessage turns the line back into the message.
+func EscapeMessage(message string) string {
+
+	if !needsEscaping(message) {
+		return message
+	}
+
+	var escaped strings.Builder
+	for index := 0; index < len(message); {
+		char, size := utf8.DecodeRuneInString(message[index:])
+		switch {
+		case char == utf8.RuneError && size <= 1:
+			fmt.Fprintf(&escaped, `\x%02x`, message[index])
+		case char == '\\':
+			escaped.WriteString(`\\`)
+		case char == '\n':
+			escaped.WriteString(`\n`)
+		case char == '\r':
+			escaped.WriteString(`\r`)
+		case char != '\t' && (char < 0x20 || char == 0x7f):
+			fmt.Fprintf(&escaped, `\x%02x`, char)
+		default:
+			escaped.WriteString(message[index : index+size])
+		}
+		index += size
+	}
+
+	return escaped.String()
+}
+
+// UnescapeMessage returns the message a line written by EscapeMessage was
+// made from. Lines which contain no escapes are returned as they are, as are
+// escapes UnescapeMessage doesn't know.
+func UnescapeMessage(line string) string {
+
+	if !strings.Contains(line, `\`) {
+		return line
+	}
+
+	var unescaped strings.Builder
+	for index := 0; index < len(line); index++ {
+		if line[index] != '\\' || index+1 == len(line) {
+			unescaped.WriteByte(line[index])
+			continue
+		}
+
+		switch line[index+1] {
+		case '\\':
+			unescaped.WriteByte('\\')
+		case 'n':
+			unescaped.WriteByte('\n')
+		case 'r':
+			unescaped.WriteByte('\r')
+		case 'x':
+			if index+3 < len(line) {
+				if value, parseErr := strconv.ParseUint(line[index+2:index+4], 16, 8); parseErr == nil {
+					unescaped.WriteByte(byte(value))
+					index += 3
+					continue
+				}
+			}
+			unescaped.WriteByte('\\')
+			continue
+		default:
+			unescaped.WriteByte('\\')
+			continue
+		}
+		index++
+	}
+
+	return unescaped.String()
+}
+
+// needsEscaping returns whether the given message holds anything
+// EscapeMessage would change.
+func needsEscaping(message string) bool {
+
+	if !utf8.ValidString(message) {
+		return true
+	}
+
+	for index := 0; index < len(message); index++ {
+		char := message[index]
+		if char == '\\' || (char != '\t' && (char < 0x20 || char == 0x7f)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,158 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The placeholders of a log file name pattern
+const BASE_PLACEHOLDER = "{base}"
+const TIME_PLACEHOLDER = "{time}"
+const PID_PLACEHOLDER = "{pid}"
+const SEQ_PLACEHOLDER = "{seq}"
+
+// The pattern log files are named with, followed by LOG_EXTENSION, unless
+// SetFileNamePattern is given another
+const DEFAULT_FILE_NAME_PATTERN = BASE_PLACEHOLDER + "." + TIME_PLACEHOLDER + "." + PID_PLACEHOLDER + "." + SEQ_PLACEHOLDER
+
+// The layout of the time in log file names, in UTC, when there's no date
+// layout
+const TIME_STAMP_LAYOUT = utils.FILE_TIME_STAMP_LAYOUT
+
+// The most log files which can share a name apart from their sequence number
+const MAX_LOG_FILE_SEQUENCE = 10000
+
+// Every character which isn't one of these is replaced in log file names
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+var fileNamePattern = DEFAULT_FILE_NAME_PATTERN
+var fileNameLock sync.Mutex
+
+// SetFileNamePattern will name every log file created from now on with the
+// given pattern followed by LOG_EXTENSION. {base} is replaced with the name of
+// the logger, {time} with the time the file was started in the date layout
+// given to SetRotation, {pid} with the id of this process and {seq} with the
+// lowest number, from 0, which gives a name no other file has. An empty
+// pattern goes back to DEFAULT_FILE_NAME_PATTERN. Returns an error, without
+// changing anything, if the pattern doesn't contain {seq} or holds characters
+// other than letters, digits, dots, dashes and underscores.
+func SetFileNamePattern(pattern string) error {
+
+	if pattern == "" {
+		pattern = DEFAULT_FILE_NAME_PATTERN
+	}
+
+	if patternErr := CheckFileNamePattern(pattern); patternErr != nil {
+		return patternErr
+	}
+
+	fileNameLock.Lock()
+	fileNamePattern = pattern
+	fileNameLock.Unlock()
+
+	return nil
+}
+
+// CheckFileNamePattern returns the error SetFileNamePattern would for the
+// given pattern, without changing anything.
+func CheckFileNamePattern(pattern string) error {
+
+	if pattern == "" {
+		return nil
+	}
+
+	if !strings.Contains(pattern, SEQ_PLACEHOLDER) {
+		return fmt.Errorf("The log file name pattern %q must contain %v so every log file gets its own name", pattern, SEQ_PLACEHOLDER)
+	}
+
+	literal := strings.NewReplacer(BASE_PLACEHOLDER, "", TIME_PLACEHOLDER, "", PID_PLACEHOLDER, "", SEQ_PLACEHOLDER, "").Replace(pattern)
+	if unsafeFileNameChars.MatchString(literal) {
+		return fmt.Errorf("The log file name pattern %q can only contain letters, digits, dots, dashes, underscores and the placeholders %v, %v, %v and %v", pattern, BASE_PLACEHOLDER, TIME_PLACEHOLDER, PID_PLACEHOLDER, SEQ_PLACEHOLDER)
+	}
+
+	return nil
+}
+
+// sanitizeFileName returns the given part of a file name with every run of
+// characters other than letters, digits, dots, dashes and underscores
+// replaced with a single underscore, e.g. "GPU 0: miner" becomes GPU_0_miner.
+func sanitizeFileName(part string) string {
+	return strings.Trim(unsafeFileNameChars.ReplaceAllString(part, "_"), "_")
+}
+
+// createLogFile will create a new log file for the logger with the given base
+// name started at the given time, named with the pattern given to
+// SetFileNamePattern, within the directory of the logger when SetLogDir has
+// been given one. The file is created exclusively, so two loggers starting at
+// once, in this process or another, never share a file.
+func createLogFile(baseName string, now time.Time) (*os.File, error) {
+
+	dir, dirErr := loggerDir(baseName)
+	if dirErr != nil {
+		return nil, dirErr
+	}
+
+	fileNameLock.Lock()
+	pattern := fileNamePattern
+	fileNameLock.Unlock()
+
+	rotationLock.Lock()
+	layout := dateLayout
+	rotationLock.Unlock()
+
+	// date layouts follow the calendar of the machine like the rotation
+	// schedule does
+	stamp := utils.FileTimeStamp(now)
+	if layout != "" {
+		stamp = now.Format(layout)
+	}
+
+	named := strings.NewReplacer(
+		BASE_PLACEHOLDER, sanitizeFileName(baseName),
+		TIME_PLACEHOLDER, sanitizeFileName(stamp),
+		PID_PLACEHOLDER, strconv.Itoa(os.Getpid()),
+	).Replace(pattern)
+
+	for sequence := 0; sequence < MAX_LOG_FILE_SEQUENCE; sequence++ {
+		name := filepath.Join(dir, strings.Replace(named, SEQ_PLACEHOLDER, strconv.Itoa(sequence), -1)+LOG_EXTENSION)
+		filePtr, createErr := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if os.IsExist(createErr) {
+			continue
+		}
+		return filePtr, createErr
+	}
+
+	return nil, fmt.Errorf("Every sequence number of the log file %v is taken", named+LOG_EXTENSION)
+}
+
+// logFileGlobs returns the patterns which match every log file the logger with
+// the given base name could have written, including those named as
+// base_[date][time].log before log files were named with a pattern and those
+// written to the working directory before SetLogDir was given a directory.
+func logFileGlobs(baseName string) []string {
+
+	fileNameLock.Lock()
+	pattern := fileNamePattern
+	fileNameLock.Unlock()
+
+	current := strings.NewReplacer(
+		BASE_PLACEHOLDER, sanitizeFileName(baseName),
+		TIME_PLACEHOLDER, "*",
+		PID_PLACEHOLDER, "*",
+		SEQ_PLACEHOLDER, "*",
+	).Replace(pattern) + LOG_EXTENSION
+
+	globs := []string{current, baseName + "_*" + LOG_EXTENSION}
+	if dir := LogDir(); dir != "" {
+		globs = append(globs, filepath.Join(dir, sanitizeFileName(baseName), current))
+	}
+	return globs
+}
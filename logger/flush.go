@@ -0,0 +1,102 @@
+package logger
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How often messages below the flush level are written out when
+// SetFlushPolicy isn't given an interval
+const DEFAULT_FLUSH_SECONDS = 5
+
+var flushLevel = INFO_LEVEL
+var syncFlushed bool
+var flushLock sync.Mutex
+var stopFlusher chan struct{}
+
+// SetFlushPolicy will make every logger write each message at the given level
+// or more severe to its log file straight away, and ask the operating system
+// to commit it to disk as well when commit is true, so it survives the agent
+// crashing right after. Less severe messages are buffered and written out
+// once the buffer fills up, along with the next message which is flushed, and
+// at least once every interval, which defaults to DEFAULT_FLUSH_SECONDS. The
+// default level of INFO_LEVEL flushes every message. Returns an error, without
+// changing anything, if the level isn't known.
+func SetFlushPolicy(level string, commit bool, interval time.Duration) error {
+
+	if levelErr := CheckFlushLevel(level); levelErr != nil {
+		return levelErr
+	}
+
+	if interval <= 0 {
+		interval = DEFAULT_FLUSH_SECONDS * time.Second
+	}
+
+	flushLock.Lock()
+	defer flushLock.Unlock()
+
+	flushLevel = level
+	syncFlushed = commit
+
+	if stopFlusher != nil {
+		close(stopFlusher)
+		stopFlusher = nil
+	}
+
+	// nothing is left buffered when every message is flushed
+	if levelRank(level) > levelRank(INFO_LEVEL) {
+		stopFlusher = make(chan struct{})
+		go flushBuffered(interval, stopFlusher)
+	}
+
+	return nil
+}
+
+// CheckFlushLevel returns the error SetFlushPolicy would for the given level,
+// without changing anything.
+func CheckFlushLevel(level string) error {
+
+	if !ValidLevel(level) {
+		return fmt.Errorf("The flush level %v must be one of %v", level, levels)
+	}
+
+	return nil
+}
+
+// flushPolicy returns whether a message at the given level is written to the
+// log file straight away and whether it's committed to disk as well.
+func flushPolicy(level string) (bool, bool) {
+
+	flushLock.Lock()
+	defer flushLock.Unlock()
+
+	flush := levelRank(level) >= levelRank(flushLevel)
+	return flush, flush && syncFlushed
+}
+
+// flushBuffered will write out the buffered messages of every logger every
+// interval until stop is closed.
+func flushBuffered(interval time.Duration, stop chan struct{}) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for 1 == 1 {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		loggersLock.Lock()
+		buffered := append([]*Logger{}, loggers...)
+		loggersLock.Unlock()
+
+		for _, lgr := range buffered {
+			lgr.lock.Lock()
+			lgr.writer.Flush()
+			lgr.lock.Unlock()
+		}
+	}
+}
@@ -6,18 +6,39 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/seantcanavan/anon-eth-net/buildinfo"
+	"github.com/seantcanavan/anon-eth-net/clock"
 	"github.com/seantcanavan/anon-eth-net/utils"
 )
 
 // The file extension to use for all new log files that are created
 const LOG_EXTENSION = ".log"
 
+// The prefix written in front of every message logged via LogError
+const ERROR_PREFIX = "ERROR: "
+
+// The maximum number of recent error messages held on to in memory for reports
+const MAX_RECENT_ERRORS = 100
+
+// The number of most recent messages of any level held on to in memory for
+// crash reports
+const MAX_RECENT_MESSAGES = 200
+
 var Lgr *Logger
 
+var loggersLock sync.Mutex
+var loggers []*Logger
+
+var agentId string
+var agentIdLock sync.Mutex
+
 // Logger allows for aggressive log management in scenarios where disk space
 // might be limited. You can limit based on log message count or duration and
 // also prune log files when too many are saved on disk.
@@ -29,10 +50,15 @@ type Logger struct {
 	logFileCount       uint64        // The current number of logs that have been created
 	logFileNames       list.List     // The list of log files we're currently holding on to
 	logMessageCount    uint64        // The current number of messages that have been logged
-	logDuration        uint64        // The duration, in seconds, that this log has been logging for
-	logStamp           uint64        // The time when this log was last written to in unix time
+	logDuration        time.Duration // How long this log has been logging for, measured on the monotonic clock so changes to the wall clock don't count
+	logStamp           time.Time     // The time when this log was last written to, along with its monotonic clock reading
 	log                *os.File      // The file that we're logging to
 	writer             *bufio.Writer // our writer we use to log to the current log file
+	recentErrors       []string      // The most recent messages logged via LogError, oldest first
+	recentMessages     []string      // A ring buffer of the most recent messages of any level
+	recentNext         int           // The index in recentMessages the next message is written to
+	clock              clock.Clock   // Tells the time logDuration is measured with. clock.Real unless SetClock is called
+	rotateAt           time.Time     // The calendar boundary the next log file is started at. Zero without a rotation schedule
 	lock               sync.Mutex
 }
 
@@ -52,7 +78,7 @@ func CustomLogger(logBaseName string, maxFileCount uint64, maxMessageCount uint6
 		return nil, err
 	}
 
-	fmt.Println(fmt.Sprintf("Successfully initialized custom logger: %+v", lgr))
+	fmt.Fprintln(consoleOutput(), fmt.Sprintf("Successfully initialized custom logger: %+v", lgr))
 
 	return lgr, nil
 }
@@ -75,7 +101,7 @@ func StandardLogger(logBaseName string) error {
 		return err
 	}
 
-	fmt.Println(fmt.Sprintf("Successfully initialized standard logger: %+v", lgr))
+	fmt.Fprintln(consoleOutput(), fmt.Sprintf("Successfully initialized standard logger: %+v", lgr))
 
 	Lgr = lgr
 	return nil
@@ -108,7 +134,7 @@ func (lgr *Logger) CurrentLogName() (string, error) {
 		return "", statErr
 	}
 
-	Lgr.LogMessage("Successfully retrieved current log name: %v", fileInfo.Name())
+	Lgr.LogMessagef("Successfully retrieved current log name: %v", fileInfo.Name())
 
 	return fileInfo.Name(), nil
 }
@@ -120,14 +146,34 @@ func (lgr *Logger) CurrentLogFile() *os.File {
 	return lgr.log
 }
 
+// RecentLogFiles returns the names of the most recent log files that are still
+// being held on to by this logger instance, newest first. The current log file
+// is always the first entry. At most count names will be returned.
+func (lgr *Logger) RecentLogFiles(count int) []string {
+
+	lgr.lock.Lock()
+	defer lgr.lock.Unlock()
+
+	lgr.writer.Flush()
+
+	var logNames []string
+	for element := lgr.logFileNames.Back(); element != nil && len(logNames) < count; element = element.Prev() {
+		logNames = append(logNames, element.Value.(string))
+	}
+
+	return logNames
+}
+
 // initLogger will initialize all of the helper values required to maintain a
 // circular array of log files. When you reach the end of the circle the log
 // is 'pruned'.
 func (lgr *Logger) initLogger(logBaseName string) error {
 
-	logFileName := utils.TimeStampFileName(logBaseName, LOG_EXTENSION)
+	if lgr.clock == nil {
+		lgr.clock = clock.Real
+	}
 
-	filePtr, err := os.Create(logFileName)
+	filePtr, err := createLogFile(logBaseName, lgr.clock.Now())
 	if err != nil {
 		return err
 	}
@@ -136,78 +182,344 @@ func (lgr *Logger) initLogger(logBaseName string) error {
 	lgr.baseLogName = logBaseName
 	lgr.logFileCount = 0
 	lgr.logDuration = 0
-	lgr.logStamp = uint64(time.Now().Unix())
+	lgr.logStamp = lgr.clock.Now()
+	lgr.rotateAt = nextRotation(lgr.logStamp)
 	lgr.log = filePtr
 	lgr.writer = bufio.NewWriter(lgr.log)
-	lgr.logFileNames.PushBack(logFileName)
+	lgr.logFileNames.PushBack(filePtr.Name())
 
-	lgr.LogMessage("Successfully created initial log file: %v", filePtr.Name())
+	loggersLock.Lock()
+	loggers = append(loggers, lgr)
+	loggersLock.Unlock()
+
+	lgr.LogMessagef("Build: %v", buildinfo.Version())
+	if id := AgentId(); id != "" {
+		lgr.LogMessagef("Agent: %v", id)
+	}
+	lgr.LogMessagef("Successfully created initial log file: %v", filePtr.Name())
 
 	return nil
 }
 
+// SetAgentId will record the id of this agent in every open log file, at the
+// top of every log file created from now on, and in every streamed entry.
+func SetAgentId(id string) {
+
+	agentIdLock.Lock()
+	changed := agentId != id
+	agentId = id
+	agentIdLock.Unlock()
+
+	if !changed {
+		return
+	}
+
+	loggersLock.Lock()
+	current := make([]*Logger, len(loggers))
+	copy(current, loggers)
+	loggersLock.Unlock()
+
+	for _, lgr := range current {
+		lgr.LogMessagef("Agent: %v", id)
+	}
+}
+
+// AgentId returns the id of this agent set via SetAgentId.
+func AgentId() string {
+
+	agentIdLock.Lock()
+	defer agentIdLock.Unlock()
+
+	return agentId
+}
+
+// Flush will write anything buffered to the current log file and ask the
+// operating system to commit it to disk.
+func (lgr *Logger) Flush() error {
+
+	lgr.lock.Lock()
+	defer lgr.lock.Unlock()
+
+	if flushErr := lgr.writer.Flush(); flushErr != nil {
+		return flushErr
+	}
+
+	return lgr.log.Sync()
+}
+
+// FlushAll will flush every logger created so far, including those of the
+// loader's processes, so nothing is lost when the program exits. Returns the
+// first error encountered after trying every logger.
+func FlushAll() error {
+
+	loggersLock.Lock()
+	flushing := append([]*Logger{}, loggers...)
+	loggersLock.Unlock()
+
+	var firstErr error
+	for _, lgr := range flushing {
+		if flushErr := lgr.Flush(); flushErr != nil && firstErr == nil {
+			firstErr = flushErr
+		}
+	}
+
+	return firstErr
+}
+
+// OpenLogFiles returns the name of the log file every logger created so far is
+// currently writing to.
+func OpenLogFiles() []string {
+
+	loggersLock.Lock()
+	open := append([]*Logger{}, loggers...)
+	loggersLock.Unlock()
+
+	names := make([]string, 0, len(open))
+	for _, lgr := range open {
+		lgr.lock.Lock()
+		names = append(names, lgr.log.Name())
+		lgr.lock.Unlock()
+	}
+
+	return names
+}
+
 // Write satisfies the writer interface for golang. This allows an instance of
 // Logger to be passed in to the os/exec library for capturing from both the
-// stdout and stderr steams.
+// stdout and stderr steams. Each write is logged as a single message without
+// its trailing line break.
 func (lgr *Logger) Write(p []byte) (n int, err error) {
-	lgr.LogMessage(string(p))
+	lgr.LogMessage(strings.TrimRight(string(p), "\r\n"))
 	return len(p), nil
 }
 
+// SetClock will make the logger measure how long the current log file has
+// been written to, and tell when a calendar boundary of the rotation schedule
+// has passed, with the given clock, e.g. a clock.Fake in tests.
+func (lgr *Logger) SetClock(clk clock.Clock) {
+
+	lgr.lock.Lock()
+	defer lgr.lock.Unlock()
+
+	lgr.clock = clk
+	lgr.logStamp = clk.Now()
+	lgr.rotateAt = nextRotation(lgr.logStamp)
+}
+
 // LogMessage will write the given string to the current active log file. It
 // will then perform all the necessary checks to make sure that the max number
 // of messages, the max duration of the log file, and the maximum number of
 // overall log files has not been reached. If any of the above parameters have
-// been tripped, action will be taken accordingly.
-func (lgr *Logger) LogMessage(formatString string, values ...interface{}) {
+// been tripped, action will be taken accordingly. Secrets are redacted from
+// the message first. The message is written as is, so a % in it is never
+// mistaken for a formatting verb. Use LogMessagef to format one.
+func (lgr *Logger) LogMessage(message string) {
+	lgr.logLevel(INFO_LEVEL, Redact(message))
+}
+
+// LogMessagef will format the given values with the format string as
+// fmt.Sprintf does and log the result via LogMessage.
+func (lgr *Logger) LogMessagef(formatString string, values ...interface{}) {
+	lgr.LogMessage(fmt.Sprintf(formatString, values...))
+}
+
+// logLevel will write the given message to the current active log file, as a
+// single line escaped by EscapeMessage, and hand it to any live streams
+// listening for the given level. A message logged after a calendar boundary of
+// the rotation schedule starts a new log file first, so each file only holds
+// the messages of its own day or hour.
+func (lgr *Logger) logLevel(level string, message string) {
 
 	lgr.lock.Lock()
 	defer lgr.lock.Unlock()
 
 	// what time is it right now?
-	now := uint64(time.Now().Unix())
-	// write the logging message to the current log file
-	fmt.Fprintln(lgr.writer, fmt.Sprintf(formatString, values...))
+	now := lgr.clock.Now()
+	if !lgr.rotateAt.IsZero() && !now.Before(lgr.rotateAt) {
+		lgr.newFile()
+	}
+	// write the logging message to the current log file as a single line
+	written, _ := fmt.Fprintln(lgr.writer, EscapeMessage(message))
+	count(func(counted *Stats) {
+		counted.Messages[level]++
+		counted.BytesWritten += uint64(written)
+	})
 	// write the logging message to std.out for local watchers
-	fmt.Println(fmt.Sprintf(formatString, values...))
-	// manually flush for now... it ain't pretty but it works
-	lgr.writer.Flush()
+	fmt.Fprintln(consoleOutput(), message)
+	// write the severe messages out straight away so they survive a crash
+	if flush, commit := flushPolicy(level); flush {
+		lgr.writer.Flush()
+		if commit {
+			lgr.log.Sync()
+		}
+	}
+	// hand the logging message to any remote watchers
+	broadcast(Entry{Time: now, AgentId: AgentId(), Package: lgr.baseLogName, Level: level, Message: message})
+	// hold on to the logging message in case the program crashes
+	lgr.remember(message)
 
 	lgr.logMessageCount++
-	lgr.logDuration += now - lgr.logStamp
+	// Sub uses the monotonic clock so a wall clock set backwards or forwards
+	// by a broken RTC or NTP catching up doesn't rotate the log early
+	lgr.logDuration += now.Sub(lgr.logStamp)
 	lgr.logStamp = now
 
 	if lgr.logMessageCount >= lgr.MaxLogMessageCount ||
-		lgr.logDuration >= lgr.MaxLogDuration {
+		lgr.logDuration >= time.Duration(lgr.MaxLogDuration)*time.Second {
 		lgr.newFile()
 	}
 }
 
+// LogError will write the given message to the current active log file with
+// ERROR_PREFIX in front of it. The message is also held on to in memory so it
+// can be included in status reports via RecentErrors. Secrets are redacted
+// from the message first. The message is written as is. Use LogErrorf to
+// format one.
+func (lgr *Logger) LogError(message string) {
+
+	message = ERROR_PREFIX + Redact(message)
+
+	lgr.lock.Lock()
+	lgr.recentErrors = append(lgr.recentErrors, utils.TimeStamp(lgr.clock.Now())+" "+message)
+	if len(lgr.recentErrors) > MAX_RECENT_ERRORS {
+		lgr.recentErrors = lgr.recentErrors[len(lgr.recentErrors)-MAX_RECENT_ERRORS:]
+	}
+	lgr.lock.Unlock()
+
+	lgr.logLevel(ERROR_LEVEL, message)
+}
+
+// LogErrorf will format the given values with the format string as
+// fmt.Sprintf does and log the result via LogError.
+func (lgr *Logger) LogErrorf(formatString string, values ...interface{}) {
+	lgr.LogError(fmt.Sprintf(formatString, values...))
+}
+
+// RecentErrors returns up to count of the most recent messages logged via
+// LogError, oldest first.
+func (lgr *Logger) RecentErrors(count int) []string {
+
+	lgr.lock.Lock()
+	defer lgr.lock.Unlock()
+
+	start := 0
+	if len(lgr.recentErrors) > count {
+		start = len(lgr.recentErrors) - count
+	}
+
+	recent := make([]string, len(lgr.recentErrors)-start)
+	copy(recent, lgr.recentErrors[start:])
+	return recent
+}
+
+// remember will add the given message to the ring buffer of recent messages.
+// Must be called while holding the lock.
+func (lgr *Logger) remember(message string) {
+
+	stamped := utils.TimeStamp(lgr.clock.Now()) + " " + message
+
+	if len(lgr.recentMessages) < MAX_RECENT_MESSAGES {
+		lgr.recentMessages = append(lgr.recentMessages, stamped)
+	} else {
+		lgr.recentMessages[lgr.recentNext] = stamped
+	}
+
+	lgr.recentNext = (lgr.recentNext + 1) % MAX_RECENT_MESSAGES
+}
+
+// RecentMessages returns up to count of the most recent messages of any
+// level, oldest first.
+func (lgr *Logger) RecentMessages(count int) []string {
+
+	lgr.lock.Lock()
+	defer lgr.lock.Unlock()
+
+	// once the ring buffer is full the oldest message is the next one replaced
+	ordered := lgr.recentMessages
+	if len(lgr.recentMessages) == MAX_RECENT_MESSAGES {
+		ordered = append(append([]string{}, lgr.recentMessages[lgr.recentNext:]...), lgr.recentMessages[:lgr.recentNext]...)
+	}
+
+	if len(ordered) > count {
+		ordered = ordered[len(ordered)-count:]
+	}
+
+	return append([]string{}, ordered...)
+}
+
+// PreviousLogFiles returns the names of the log files on disk with the same
+// base name as this logger which it didn't create, such as those written
+// before the program last restarted, newest first.
+func (lgr *Logger) PreviousLogFiles() []string {
+
+	lgr.lock.Lock()
+	current := make(map[string]bool)
+	for element := lgr.logFileNames.Front(); element != nil; element = element.Next() {
+		current[element.Value.(string)] = true
+	}
+	lgr.lock.Unlock()
+
+	var logNames []string
+	for _, pattern := range logFileGlobs(lgr.baseLogName) {
+		matches, _ := filepath.Glob(pattern)
+		logNames = append(logNames, matches...)
+	}
+
+	var previous []string
+	modified := make(map[string]time.Time)
+	for _, logName := range logNames {
+		_, seen := modified[logName]
+		fileInfo, statErr := os.Stat(logName)
+		if current[logName] || seen || statErr != nil {
+			continue
+		}
+		previous = append(previous, logName)
+		modified[logName] = fileInfo.ModTime()
+	}
+
+	sort.Slice(previous, func(i, j int) bool {
+		return modified[previous[i]].After(modified[previous[j]])
+	})
+
+	return previous
+}
+
 // newFile generates a new log file to store the log messages within. It
 // intelligently keeps track of the number of log files that have already been
 // created so that you don't overload your disk with logs and can 'prune' extra
 // logs as they pass the threshold to keep around.
 func (lgr *Logger) newFile() error {
 
-	logFileName := utils.TimeStampFileName(lgr.baseLogName, LOG_EXTENSION)
-
-	filePtr, err := os.Create(logFileName)
+	now := lgr.clock.Now()
+	lgr.rotateAt = nextRotation(now)
+	filePtr, err := createLogFile(lgr.baseLogName, now)
 	if err != nil {
 		return err
 	}
 
-	Lgr.LogMessage("Created new log file: %v", filePtr.Name())
+	lgr.announcef("Created new log file: %v", filePtr.Name())
 
+	lgr.writer.Flush()
 	lgr.log.Close()
-
-	Lgr.LogMessage("Successfully closed the old log file: %v", lgr.CurrentLogFile().Name())
+	oldLogName := lgr.log.Name()
 
 	lgr.log = filePtr
 	lgr.writer = bufio.NewWriter(lgr.log)
 
+	// every log file starts with the build and agent which wrote it
+	fmt.Fprintln(lgr.writer, "Build: "+buildinfo.Version().String())
+	if id := AgentId(); id != "" {
+		fmt.Fprintln(lgr.writer, "Agent: "+id)
+	}
+
+	lgr.announcef("Successfully closed the old log file: %v", oldLogName)
+
+	count(func(counted *Stats) { counted.Rotations++ })
+
 	lgr.logMessageCount = 0
+	lgr.logDuration = 0
 	lgr.logFileCount++
-	lgr.logFileNames.PushBack(logFileName)
+	lgr.logFileNames.PushBack(filePtr.Name())
 
 	if lgr.logFileCount >= lgr.MaxLogFileCount {
 		if err := lgr.pruneFile(); err != nil {
@@ -215,6 +527,14 @@ func (lgr *Logger) newFile() error {
 		}
 	}
 
+	// keep the disk from filling up, always keeping the current log file
+	if free, low := lowOnSpace(filepath.Dir(filePtr.Name())); low && lgr.logFileNames.Len() > 1 {
+		lgr.announcef("Only %v left for log files", utils.FormatBytes(int64(free)))
+		if err := lgr.pruneFile(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -225,6 +545,26 @@ func (lgr *Logger) pruneFile() error {
 	oldestLog := lgr.logFileNames.Remove(lgr.logFileNames.Front())
 	logFileName := reflect.ValueOf(oldestLog).String()
 
-	Lgr.LogMessage("Deleting oldest log file: %v", logFileName)
-	return os.Remove(logFileName)
+	lgr.announcef("Deleting oldest log file: %v", logFileName)
+	// the retention policy may have deleted it already
+	if removeErr := os.Remove(logFileName); removeErr != nil && !os.IsNotExist(removeErr) {
+		return removeErr
+	}
+	count(func(counted *Stats) { counted.Prunes++ })
+	return nil
+}
+
+// announcef will log a message about the files of this logger via Lgr. When
+// this logger is Lgr, whose lock is already held while it changes files, the
+// message is written straight to the current log file instead.
+func (lgr *Logger) announcef(formatString string, values ...interface{}) {
+
+	message := fmt.Sprintf(formatString, values...)
+	if Lgr != nil && lgr != Lgr {
+		Lgr.LogMessage(message)
+		return
+	}
+
+	fmt.Fprintln(lgr.writer, EscapeMessage(message))
+	fmt.Fprintln(consoleOutput(), message)
 }
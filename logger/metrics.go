@@ -0,0 +1,60 @@
+package logger
+
+import (
+	"sync"
+)
+
+// Stats counts what every logger has done since the agent started.
+type Stats struct {
+	Messages     map[string]uint64 `json:"messages"`     // The messages logged at each level
+	BytesWritten uint64            `json:"bytesWritten"` // The bytes written to log files
+	Rotations    uint64            `json:"rotations"`    // The new log files started after the first
+	Prunes       uint64            `json:"prunes"`       // The old log files deleted
+	StreamDrops  uint64            `json:"streamDrops"`  // The entries dropped for live streams which fell behind
+	SampledSkips uint64            `json:"sampledSkips"` // The messages skipped by LogSampling
+}
+
+var stats = Stats{Messages: make(map[string]uint64)}
+var statsLock sync.Mutex
+
+// Statistics returns a copy of what every logger has done since the agent
+// started.
+func Statistics() Stats {
+
+	statsLock.Lock()
+	defer statsLock.Unlock()
+
+	current := stats
+	current.Messages = make(map[string]uint64)
+	for level, count := range stats.Messages {
+		current.Messages[level] = count
+	}
+	return current
+}
+
+// Metrics returns the Statistics of every logger, e.g. log_messages_error and
+// log_stream_drops, so a log storm or messages silently going missing show up
+// in the profile history. Meant to be registered with the profiler.
+func Metrics() (map[string]float64, error) {
+
+	current := Statistics()
+
+	metrics := map[string]float64{
+		"log_bytes_written": float64(current.BytesWritten),
+		"log_rotations":     float64(current.Rotations),
+		"log_prunes":        float64(current.Prunes),
+		"log_stream_drops":  float64(current.StreamDrops),
+		"log_sampled_skips": float64(current.SampledSkips),
+	}
+	for _, level := range levels {
+		metrics["log_messages_"+level] = float64(current.Messages[level])
+	}
+	return metrics, nil
+}
+
+// count will add to the statistics via the given function.
+func count(add func(counted *Stats)) {
+	statsLock.Lock()
+	add(&stats)
+	statsLock.Unlock()
+}
@@ -0,0 +1,128 @@
+package logger
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The text written in place of every redacted value
+const REDACTED = "[REDACTED]"
+
+// Secrets shorter than this aren't redacted by value since they'd mask
+// ordinary words. The patterns still catch them when they're labelled
+const MIN_SECRET_LENGTH = 6
+
+// The patterns every message is redacted with. The first group of a pattern
+// is kept in front of REDACTED and the second after it, so the label of a
+// credential survives and only its value is masked
+var builtInRedactions = []*regexp.Regexp{
+	// key=value, key: value and "key":"value" pairs whose key names a credential
+	regexp.MustCompile(`(?i)((?:password|passwd|passphrase|secret|token|api_?key|private_?key|mnemonic)[\w-]*["']?\s*[:=]\s*["']?)[^\s"',;&]+()`),
+	// HTTP authorization headers
+	regexp.MustCompile(`(?i)(\b(?:bearer|basic)\s+)[A-Za-z0-9._~+/=-]{8,}()`),
+	// the password of credentials embedded in a URL
+	regexp.MustCompile(`(://[^/\s:@]+:)[^/\s@]+(@)`),
+}
+
+var redactions = builtInRedactions
+var secrets *strings.Replacer
+var redactLock sync.RWMutex
+
+// SetRedactPatterns will redact anything matching one of the given regular
+// expressions from every message logged from now on, in addition to the
+// built in patterns for labelled credentials, authorization headers and
+// passwords in URLs. Patterns with two or more groups keep the first two on
+// either side of REDACTED like the built in ones. Returns an error, without
+// changing anything, if one of them doesn't compile.
+func SetRedactPatterns(patterns []string) error {
+
+	compiled, compileErr := compileRedactions(patterns)
+	if compileErr != nil {
+		return compileErr
+	}
+
+	redactLock.Lock()
+	redactions = compiled
+	redactLock.Unlock()
+
+	return nil
+}
+
+// CheckRedactPatterns returns the error SetRedactPatterns would for the given
+// patterns, without changing anything.
+func CheckRedactPatterns(patterns []string) error {
+	_, compileErr := compileRedactions(patterns)
+	return compileErr
+}
+
+// compileRedactions returns the built in patterns followed by the given ones,
+// compiled, or an error if one of them doesn't compile.
+func compileRedactions(patterns []string) ([]*regexp.Regexp, error) {
+
+	compiled := append([]*regexp.Regexp{}, builtInRedactions...)
+	for _, pattern := range patterns {
+		redaction, compileErr := regexp.Compile(pattern)
+		if compileErr != nil {
+			return nil, fmt.Errorf("Could not compile the redaction pattern %v: %v", pattern, compileErr)
+		}
+		compiled = append(compiled, redaction)
+	}
+
+	return compiled, nil
+}
+
+// SetSecrets will redact each of the given values wherever it appears in a
+// message logged from now on, replacing the secrets given before. Values
+// shorter than MIN_SECRET_LENGTH are skipped.
+func SetSecrets(values []string) {
+
+	var long []string
+	for _, value := range values {
+		if len(value) >= MIN_SECRET_LENGTH {
+			long = append(long, value)
+		}
+	}
+
+	// replace the longest first so a secret containing another is masked whole
+	sort.Slice(long, func(i, j int) bool { return len(long[i]) > len(long[j]) })
+
+	var replacer *strings.Replacer
+	if len(long) > 0 {
+		pairs := make([]string, 0, 2*len(long))
+		for _, value := range long {
+			pairs = append(pairs, value, REDACTED)
+		}
+		replacer = strings.NewReplacer(pairs...)
+	}
+
+	redactLock.Lock()
+	secrets = replacer
+	redactLock.Unlock()
+}
+
+// Redact returns the given text with every secret and everything matching a
+// redaction pattern replaced with REDACTED. Every message is redacted before
+// it's written to disk, stdout, the live streams or the recent messages, so
+// text which leaves the agent some other way can be passed through it too.
+func Redact(text string) string {
+
+	redactLock.RLock()
+	defer redactLock.RUnlock()
+
+	if secrets != nil {
+		text = secrets.Replace(text)
+	}
+
+	for _, redaction := range redactions {
+		if redaction.NumSubexp() >= 2 {
+			text = redaction.ReplaceAllString(text, "${1}"+REDACTED+"${2}")
+			continue
+		}
+		text = redaction.ReplaceAllString(text, REDACTED)
+	}
+
+	return text
+}
@@ -0,0 +1,114 @@
+package logger
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rotate every log file at midnight local time
+const ROTATE_DAILY = "daily"
+
+// Rotate every log file at the top of every hour
+const ROTATE_HOURLY = "hourly"
+
+// The date layouts log files are named with on a rotation schedule when no
+// layout is given
+const DAILY_DATE_LAYOUT = "2006-01-02"
+const HOURLY_DATE_LAYOUT = "2006-01-02T15"
+
+var rotationSchedule string
+var dateLayout string
+var rotationLock sync.Mutex
+
+// SetRotation will make every logger, including those created from now on,
+// start a new log file at each calendar boundary of the given schedule,
+// ROTATE_DAILY or ROTATE_HOURLY, in addition to their count and duration
+// limits, and name log files with the date in the given Go time layout. An
+// empty layout uses DAILY_DATE_LAYOUT or HOURLY_DATE_LAYOUT on a schedule and
+// TIME_STAMP_LAYOUT otherwise, and an empty schedule only rotates on the
+// limits. Returns an error, without changing anything, if the schedule isn't
+// known or the layout doesn't change from one period to the next.
+func SetRotation(schedule string, layout string) error {
+
+	layout, layoutErr := rotationLayout(schedule, layout)
+	if layoutErr != nil {
+		return layoutErr
+	}
+
+	rotationLock.Lock()
+	rotationSchedule = schedule
+	dateLayout = layout
+	rotationLock.Unlock()
+
+	loggersLock.Lock()
+	current := append([]*Logger{}, loggers...)
+	loggersLock.Unlock()
+
+	for _, lgr := range current {
+		lgr.lock.Lock()
+		lgr.rotateAt = nextRotation(lgr.clock.Now())
+		lgr.lock.Unlock()
+	}
+
+	return nil
+}
+
+// CheckRotation returns the error SetRotation would for the given schedule
+// and layout, without changing anything.
+func CheckRotation(schedule string, layout string) error {
+	_, layoutErr := rotationLayout(schedule, layout)
+	return layoutErr
+}
+
+// rotationLayout returns the date layout log files are named with on the
+// given schedule, or an error if the schedule isn't known or the layout
+// doesn't change from one period to the next.
+func rotationLayout(schedule string, layout string) (string, error) {
+
+	period, unit := 24*time.Hour, "day"
+	switch schedule {
+	case ROTATE_DAILY, "":
+		if layout == "" && schedule != "" {
+			layout = DAILY_DATE_LAYOUT
+		}
+	case ROTATE_HOURLY:
+		period, unit = time.Hour, "hour"
+		if layout == "" {
+			layout = HOURLY_DATE_LAYOUT
+		}
+	default:
+		return "", fmt.Errorf("The log rotation schedule %q isn't %v or %v", schedule, ROTATE_DAILY, ROTATE_HOURLY)
+	}
+
+	if layout != "" {
+		reference := time.Date(2001, 2, 3, 4, 5, 6, 0, time.Local)
+		formatted := reference.Format(layout)
+		if strings.ContainsAny(formatted, `/\`) {
+			return "", fmt.Errorf("The log file date layout %q can't contain a path separator", layout)
+		}
+		if formatted == reference.Add(period).Format(layout) {
+			return "", fmt.Errorf("The log file date layout %q doesn't change from one %v to the next", layout, unit)
+		}
+	}
+
+	return layout, nil
+}
+
+// nextRotation returns the first calendar boundary of the rotation schedule
+// after the given time, or the zero time when there's no schedule.
+func nextRotation(now time.Time) time.Time {
+
+	rotationLock.Lock()
+	schedule := rotationSchedule
+	rotationLock.Unlock()
+
+	switch schedule {
+	case ROTATE_DAILY:
+		return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+	case ROTATE_HOURLY:
+		return time.Date(now.Year(), now.Month(), now.Day(), now.Hour()+1, 0, 0, 0, now.Location())
+	}
+	return time.Time{}
+}
@@ -0,0 +1,117 @@
+package logger
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Sampling limits how many messages of a high volume category are logged.
+// Either limit can be left at 0 to turn it off.
+type Sampling struct {
+	OneIn     int `json:"oneIn"`     // Only every OneIn-th message is logged
+	PerSecond int `json:"perSecond"` // At most PerSecond messages are logged each second
+}
+
+// sampler tracks the messages of a single category.
+type sampler struct {
+	Sampling
+	seen        uint64    // The number of messages seen so far
+	windowStart time.Time // When the current second started
+	inWindow    int       // The number of messages logged in the current second
+	skipped     uint64    // The number of messages skipped since the last one logged
+}
+
+var samplers = make(map[string]*sampler)
+var samplersLock sync.Mutex
+
+// SetSampling will sample the messages logged via LogSampledf for each of
+// the given categories from now on, e.g. {"rest_access": {"oneIn": 10}}.
+// Categories which aren't given are logged in full. Returns an error, without
+// changing anything, if a limit is negative.
+func SetSampling(samplings map[string]Sampling) error {
+
+	if samplingErr := CheckSampling(samplings); samplingErr != nil {
+		return samplingErr
+	}
+
+	samplersLock.Lock()
+	defer samplersLock.Unlock()
+
+	samplers = make(map[string]*sampler)
+	for category, sampling := range samplings {
+		samplers[category] = &sampler{Sampling: sampling}
+	}
+
+	return nil
+}
+
+// CheckSampling returns the error SetSampling would for the given samplings,
+// without changing anything.
+func CheckSampling(samplings map[string]Sampling) error {
+
+	for category, sampling := range samplings {
+		if sampling.OneIn < 0 || sampling.PerSecond < 0 {
+			return fmt.Errorf("The sampling of %v can't be negative", category)
+		}
+	}
+
+	return nil
+}
+
+// LogSampledf will log the formatted message like LogMessagef unless the
+// sampling given to SetSampling for the given category skips it. A message
+// which is logged after others were skipped says how many were.
+func (lgr *Logger) LogSampledf(category string, formatString string, values ...interface{}) {
+
+	lgr.lock.Lock()
+	now := lgr.clock.Now()
+	lgr.lock.Unlock()
+
+	logged, skipped := sample(category, now)
+	if !logged {
+		count(func(counted *Stats) { counted.SampledSkips++ })
+		return
+	}
+
+	message := fmt.Sprintf(formatString, values...)
+	if skipped > 0 {
+		message += fmt.Sprintf(" (%d similar messages skipped)", skipped)
+	}
+	lgr.LogMessage(message)
+}
+
+// sample returns whether a message of the given category logged at the given
+// time passes its sampling and how many were skipped before it.
+func sample(category string, now time.Time) (bool, uint64) {
+
+	samplersLock.Lock()
+	defer samplersLock.Unlock()
+
+	current, sampled := samplers[category]
+	if !sampled {
+		return true, 0
+	}
+
+	current.seen++
+	if current.OneIn > 1 && (current.seen-1)%uint64(current.OneIn) != 0 {
+		current.skipped++
+		return false, 0
+	}
+
+	if current.PerSecond > 0 {
+		if now.Sub(current.windowStart) >= time.Second {
+			current.windowStart = now
+			current.inWindow = 0
+		}
+		if current.inWindow >= current.PerSecond {
+			current.skipped++
+			return false, 0
+		}
+		current.inWindow++
+	}
+
+	skipped := current.skipped
+	current.skipped = 0
+	return true, skipped
+}
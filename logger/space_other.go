@@ -0,0 +1,19 @@
+//go:build !windows
+
+package logger
+
+import (
+	"syscall"
+)
+
+// freeSpace returns how many bytes the current user can still write to the
+// filesystem holding the given directory.
+func freeSpace(dir string) (uint64, error) {
+
+	var stat syscall.Statfs_t
+	if statErr := syscall.Statfs(dir, &stat); statErr != nil {
+		return 0, statErr
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
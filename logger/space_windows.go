@@ -0,0 +1,22 @@
+package logger
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// freeSpace returns how many bytes the current user can still write to the
+// volume holding the given directory.
+func freeSpace(dir string) (uint64, error) {
+
+	dirPtr, convertErr := windows.UTF16PtrFromString(dir)
+	if convertErr != nil {
+		return 0, convertErr
+	}
+
+	var available, total, free uint64
+	if spaceErr := windows.GetDiskFreeSpaceEx(dirPtr, &available, &total, &free); spaceErr != nil {
+		return 0, spaceErr
+	}
+
+	return available, nil
+}
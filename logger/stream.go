@@ -0,0 +1,121 @@
+package logger
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// The level given to every message logged via LogMessage
+const INFO_LEVEL = "info"
+
+// The level given to every message logged via LogError
+const ERROR_LEVEL = "error"
+
+// The number of entries buffered for each live stream before entries are
+// dropped for that stream
+const STREAM_BUFFER_SIZE = 256
+
+// Every known level from least to most severe
+var levels = []string{INFO_LEVEL, ERROR_LEVEL}
+
+// Entry is a single log message as handed to live streams.
+type Entry struct {
+	Time    time.Time `json:"time"`              // When the message was logged
+	AgentId string    `json:"agentId,omitempty"` // The id of the agent which logged the message
+	Package string    `json:"package"`           // The base name of the logger which logged the message
+	Level   string    `json:"level"`             // The level the message was logged at
+	Message string    `json:"message"`           // The message itself
+}
+
+// Filter decides which entries a live stream is interested in. Empty fields
+// match everything.
+type Filter struct {
+	MinLevel string   // Only entries at this level or more severe are streamed
+	Packages []string // Only entries from loggers with one of these base names are streamed
+}
+
+var streams = make(map[chan Entry]Filter)
+var streamsLock sync.Mutex
+
+// ValidLevel returns true if the given level is one that entries are logged
+// at.
+func ValidLevel(level string) bool {
+	return levelRank(level) >= 0
+}
+
+// levelRank returns the severity of the given level, higher being more severe,
+// or -1 if the level is unknown.
+func levelRank(level string) int {
+	for rank, current := range levels {
+		if current == strings.ToLower(level) {
+			return rank
+		}
+	}
+	return -1
+}
+
+// Matches returns true if the given entry passes this filter.
+func (filter Filter) Matches(entry Entry) bool {
+
+	if filter.MinLevel != "" && levelRank(entry.Level) < levelRank(filter.MinLevel) {
+		return false
+	}
+
+	if len(filter.Packages) == 0 {
+		return true
+	}
+
+	for _, pkg := range filter.Packages {
+		if pkg == entry.Package {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Stream will return a channel which receives every entry logged by any
+// logger from now on that matches the given filter. Entries are dropped for a
+// stream whose buffer is full rather than blocking the logger. The returned
+// function must be called once the stream is no longer needed and closes the
+// channel.
+func Stream(filter Filter) (<-chan Entry, func()) {
+
+	entries := make(chan Entry, STREAM_BUFFER_SIZE)
+
+	streamsLock.Lock()
+	streams[entries] = filter
+	streamsLock.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			streamsLock.Lock()
+			delete(streams, entries)
+			streamsLock.Unlock()
+			close(entries)
+		})
+	}
+
+	return entries, cancel
+}
+
+// broadcast will hand the given entry to every live stream whose filter it
+// matches without blocking.
+func broadcast(entry Entry) {
+
+	streamsLock.Lock()
+	defer streamsLock.Unlock()
+
+	for entries, filter := range streams {
+		if !filter.Matches(entry) {
+			continue
+		}
+		select {
+		case entries <- entry:
+		default:
+			count(func(counted *Stats) { counted.StreamDrops++ })
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"github.com/seantcanavan/anon-eth-net/buildinfo"
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/diagnostics"
+	"github.com/seantcanavan/anon-eth-net/lifecycle"
+	"github.com/seantcanavan/anon-eth-net/loader"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/network"
+	"github.com/seantcanavan/anon-eth-net/privileged"
+	"github.com/seantcanavan/anon-eth-net/reporter"
+	"github.com/seantcanavan/anon-eth-net/rest"
+	"github.com/seantcanavan/anon-eth-net/service"
+	"github.com/seantcanavan/anon-eth-net/transport"
+	"github.com/seantcanavan/anon-eth-net/updater"
+	"github.com/seantcanavan/anon-eth-net/utils"
+	"github.com/seantcanavan/anon-eth-net/watchdog"
+)
+
+// The subcommand run when none is given
+const RUN_COMMAND = "run"
+
+// command is a single subcommand of the agent binary. Every subcommand runs
+// with the logger and config already loaded. A returned error is printed and
+// the program exits with a non zero status.
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(args []string) error
+}
+
+// commands returns every subcommand in the order they're listed in the usage.
+func commands() []command {
+	return []command{
+		{RUN_COMMAND, "", "Run the agent until SIGINT or SIGTERM. The default when no subcommand is given.", runAgent},
+		{"watchdog", "", "Run the agent as a child process and restart it whenever it exits unexpectedly, backing off when it keeps crashing.", runWatchdog},
+		{privileged.HELPER_COMMAND, "", "Run as root to replace the binary, install the service and reboot on behalf of the agent, which it runs under the watchdog as AgentUser.", runPrivilegedHelper},
+		{"version", "", "Print the local version of the agent.", printVersion},
+		{"check-update", "", "Check whether a newer version is available without applying it.", checkUpdate},
+		{"apply-update", "", "Check for a newer version and apply it straight away.", applyUpdate},
+		{"setup", "", "Ask for the essential settings, check each one works and save them to the config.json asset.", runSetup},
+		{"validate-config", "", "Load the config.json asset and everything it refers to and report any problems.", validateConfig},
+		{"show-config", "", "Print the config the agent runs with, secrets redacted, along with where each setting's value came from.", showConfig},
+		{"send-test-report", "", "Send a test notification through every configured channel and report which ones work.", sendTestReport},
+		{"collect-diagnostics", "[output file]", "Write a diagnostics bundle of logs, redacted config and system state to the given file.", collectDiagnostics},
+		{"show-pins", "<host:port>", "Print the TLSPins of every certificate the given server presents, leaf first.", showPins},
+		{"install", "", "Copy the agent to a standard location and install it as a service which starts on boot and restarts on failure.", installService},
+		{"uninstall", "", "Stop and remove the service installed via install along with its files.", uninstallService},
+	}
+}
+
+// commandNamed returns the subcommand with the given name.
+func commandNamed(name string) (command, bool) {
+	for _, subcommand := range commands() {
+		if subcommand.name == name {
+			return subcommand, true
+		}
+	}
+	return command{}, false
+}
+
+// usage describes every subcommand.
+func usage() string {
+
+	var usageText bytes.Buffer
+	fmt.Fprintf(&usageText, "Usage: %v [subcommand] [arguments]\n\nSubcommands:\n", os.Args[0])
+
+	for _, subcommand := range commands() {
+		fmt.Fprintf(&usageText, "  %-40v %v\n", subcommand.name+" "+subcommand.args, subcommand.summary)
+	}
+
+	usageText.WriteString("\nRefer to the default ./assets/config.json file for all the parameters required for anon-eth-net to execute successfully.")
+	return usageText.String()
+}
+
+// runWatchdog will run the agent under the watchdog until SIGINT or SIGTERM,
+// or until the agent exits cleanly. Crashes are delivered as notifications.
+func runWatchdog(args []string) error {
+
+	lockErr := lifecycle.AcquireLock(watchdog.LOCK_FILE_NAME)
+	if lockErr != nil {
+		return lockErr
+	}
+	lifecycle.OnShutdown("watchdog lock", func(ctx context.Context) error {
+		return lifecycle.ReleaseLock()
+	})
+
+	if reporterErr := configureReporter(); reporterErr != nil {
+		return reporterErr
+	}
+	reporter.SubscribeToEvents()
+
+	lifecycle.OnShutdown("loggers", func(ctx context.Context) error {
+		return logger.FlushAll()
+	})
+
+	return superviseAgent(nil)
+}
+
+// runPrivilegedHelper will perform the requests from the agent which need
+// root, and run the agent itself under the watchdog as AgentUser, until
+// SIGINT or SIGTERM or until the agent exits cleanly. Its settings come from
+// privileged.CONFIG_FILE rather than the config.json asset the agent can
+// rewrite.
+func runPrivilegedHelper(args []string) error {
+
+	if runtime.GOOS != "windows" && os.Geteuid() != 0 {
+		return fmt.Errorf("The privileged helper needs to run as root")
+	}
+
+	if configErr := privileged.LoadConfig(); configErr != nil {
+		return configErr
+	}
+
+	if config.Cfg.AgentUser == "" {
+		return fmt.Errorf("Set AgentUser in %v to the user the agent should run as", privileged.CONFIG_FILE)
+	}
+
+	lockErr := lifecycle.AcquireLock(privileged.LOCK_FILE_NAME)
+	if lockErr != nil {
+		return lockErr
+	}
+	lifecycle.OnShutdown("privileged helper lock", func(ctx context.Context) error {
+		return lifecycle.ReleaseLock()
+	})
+
+	if reporterErr := configureReporter(); reporterErr != nil {
+		return reporterErr
+	}
+	reporter.SubscribeToEvents()
+
+	if prepareErr := privileged.Prepare(config.Cfg.AgentUser); prepareErr != nil {
+		return prepareErr
+	}
+
+	// the UpdateTUFURI and its root, the UpdateManifestURI, the
+	// UpdateComponents, the scanners and the directories the update is
+	// downloaded to all come from the helper's own config, so InstallUpdate
+	// fetches and checks the release without reading anything the agent wrote
+	privileged.Handle(privileged.UPDATE_ACTION, func(args []string) (string, error) {
+		return updater.InstallUpdate()
+	})
+	privileged.Handle(privileged.INSTALL_ACTION, func(args []string) (string, error) {
+		if installErr := service.Install(); installErr != nil {
+			return "", installErr
+		}
+		return fmt.Sprintf("installed and started the %v service from %v\n", service.SERVICE_NAME, service.InstallDir()), nil
+	})
+	privileged.Handle(privileged.REBOOT_ACTION, func(args []string) (string, error) {
+		return "rebooting\n", network.RebootLocally()
+	})
+
+	helper, serveErr := privileged.Serve(config.Cfg.PrivilegedSocket, config.Cfg.AgentUser)
+	if serveErr != nil {
+		return serveErr
+	}
+
+	lifecycle.OnShutdown("loggers", func(ctx context.Context) error {
+		return logger.FlushAll()
+	})
+	lifecycle.OnShutdown("privileged helper", helper.Shutdown)
+
+	return superviseAgent(func(cmd *exec.Cmd) error {
+		return privileged.RunAs(cmd, config.Cfg.AgentUser)
+	})
+}
+
+// superviseAgent will run the agent under the watchdog, calling configure on
+// it before every start if it's not nil, until SIGINT or SIGTERM or until the
+// agent exits cleanly.
+func superviseAgent(configure func(cmd *exec.Cmd) error) error {
+
+	executable, executableErr := os.Executable()
+	if executableErr != nil {
+		return executableErr
+	}
+
+	agentWatchdog, watchdogErr := watchdog.New([]string{executable, RUN_COMMAND}, watchdog.STATE_FILE_NAME)
+	if watchdogErr != nil {
+		return watchdogErr
+	}
+	agentWatchdog.Configure = configure
+
+	lifecycle.OnShutdown("agent", agentWatchdog.Shutdown)
+
+	finished := make(chan error, 1)
+	go func() {
+		runErr := agentWatchdog.Run()
+		finished <- runErr
+		lifecycle.Shutdown("the agent exited")
+	}()
+
+	// block until we receive SIGINT or SIGTERM or the agent exits cleanly
+	lifecycle.Wait()
+	return <-finished
+}
+
+// printVersion will print the local version along with the rest of the build
+// metadata.
+func printVersion(args []string) error {
+	fmt.Println(fmt.Sprintf("anon-eth-net %v", buildinfo.Version()))
+	return nil
+}
+
+// checkUpdate will print whether a newer version is available.
+func checkUpdate(args []string) error {
+
+	summary, summaryErr := updater.PendingUpdateSummary()
+	if summaryErr != nil {
+		return summaryErr
+	}
+
+	fmt.Print(summary)
+	return nil
+}
+
+// applyUpdate will update to the newest remote version if it's newer than
+// this one.
+func applyUpdate(args []string) error {
+
+	if reporterErr := configureReporter(); reporterErr != nil {
+		return reporterErr
+	}
+
+	result, updateErr := updater.UpdateNow()
+	if updateErr != nil {
+		return updateErr
+	}
+
+	fmt.Print(result)
+	return nil
+}
+
+// validateConfig will check everything the config refers to can be loaded.
+// The config itself has already loaded by the time this runs. The jobs of the
+// main loader are dry run, so every problem with them is reported without
+// starting any of them.
+func validateConfig(args []string) error {
+
+	if reporterErr := configureReporter(); reporterErr != nil {
+		return reporterErr
+	}
+
+	loaderAssetPath, assetErr := mainLoaderAssetPath()
+	if assetErr != nil {
+		return assetErr
+	}
+
+	jobProblems, dryRunErr := loader.DryRun(loaderAssetPath)
+	if dryRunErr != nil {
+		return dryRunErr
+	}
+	for _, problems := range jobProblems {
+		fmt.Println(problems.Error())
+	}
+	if len(jobProblems) > 0 {
+		return fmt.Errorf("%d jobs of %v can't be started", len(jobProblems), loaderAssetPath)
+	}
+
+	if tokenErr := rest.ValidateTokens(); tokenErr != nil {
+		return tokenErr
+	}
+
+	fmt.Println("config is valid")
+	return nil
+}
+
+// showConfig will print the effective config with the source of every
+// setting.
+func showConfig(args []string) error {
+
+	effective, effectiveErr := diagnostics.EffectiveConfig()
+	if effectiveErr != nil {
+		return effectiveErr
+	}
+
+	fmt.Println(string(effective))
+	return nil
+}
+
+// sendTestReport will run the reporter self test and print the outcome of
+// every channel. Fails if any channel fails.
+func sendTestReport(args []string) error {
+
+	if reporterErr := configureReporter(); reporterErr != nil {
+		return reporterErr
+	}
+
+	summary, allPassed := reporter.SelfTestSummary(reporter.ReporterSelfTest())
+	fmt.Print(summary)
+
+	if !allPassed {
+		return fmt.Errorf("At least one notification channel failed the self test")
+	}
+
+	return nil
+}
+
+// collectDiagnostics will write a diagnostics bundle to the given file, or a
+// time stamped file in the current directory.
+func collectDiagnostics(args []string) error {
+
+	if len(args) > 1 {
+		return fmt.Errorf("usage: collect-diagnostics [output file]")
+	}
+
+	bundleName := utils.TimeStampFileName(diagnostics.DIAGNOSTICS_BASE_NAME, diagnostics.DIAGNOSTICS_EXTENSION)
+	if len(args) == 1 {
+		bundleName = args[0]
+	}
+
+	bundleFile, createErr := os.Create(bundleName)
+	if createErr != nil {
+		return createErr
+	}
+
+	// the jobs are listed as configured even though they aren't running
+	mainLoader, _ := newMainLoader()
+
+	bundleErr := diagnostics.Bundle(mainLoader, bundleFile)
+	closeErr := bundleFile.Close()
+	if bundleErr != nil {
+		return bundleErr
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	fmt.Println(fmt.Sprintf("wrote the diagnostics bundle to %v", bundleName))
+	return nil
+}
+
+// showPins will print the pin of every certificate the given server presents
+// so they can be copied into TLSPins.
+func showPins(args []string) error {
+
+	if len(args) != 1 {
+		return fmt.Errorf("usage: show-pins <host:port>")
+	}
+
+	pins, fetchErr := transport.FetchPins(args[0])
+	if fetchErr != nil {
+		return fetchErr
+	}
+
+	for _, pin := range pins {
+		fmt.Println(pin)
+	}
+	return nil
+}
+
+// installService will install the agent as a service and start it, via the
+// privileged helper when run without root alongside one.
+func installService(args []string) error {
+
+	if runtime.GOOS != "windows" && os.Geteuid() != 0 && privileged.Available() {
+		result, callErr := privileged.Call(privileged.INSTALL_ACTION, nil)
+		if callErr != nil {
+			return callErr
+		}
+		fmt.Print(result)
+		return nil
+	}
+
+	if installErr := service.Install(); installErr != nil {
+		return installErr
+	}
+
+	fmt.Println(fmt.Sprintf("installed and started the %v service from %v", service.SERVICE_NAME, service.InstallDir()))
+	return nil
+}
+
+// uninstallService will remove the service installed via installService.
+func uninstallService(args []string) error {
+
+	if uninstallErr := service.Uninstall(); uninstallErr != nil {
+		return uninstallErr
+	}
+
+	fmt.Println(fmt.Sprintf("uninstalled the %v service and removed %v", service.SERVICE_NAME, service.InstallDir()))
+	return nil
+}
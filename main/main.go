@@ -1,34 +1,89 @@
 package main
 
 import (
-	"crypto/x509"
+	"context"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"os/signal"
+	"path/filepath"
 	"runtime"
-	"syscall"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/seantcanavan/anon-eth-net/audit"
 	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/crash"
+	"github.com/seantcanavan/anon-eth-net/eth"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/inbox"
+	"github.com/seantcanavan/anon-eth-net/integrity"
+	"github.com/seantcanavan/anon-eth-net/lifecycle"
+	"github.com/seantcanavan/anon-eth-net/limits"
 	"github.com/seantcanavan/anon-eth-net/loader"
 	"github.com/seantcanavan/anon-eth-net/logger"
 	"github.com/seantcanavan/anon-eth-net/network"
+	"github.com/seantcanavan/anon-eth-net/node"
+	"github.com/seantcanavan/anon-eth-net/operations"
+	"github.com/seantcanavan/anon-eth-net/plugins"
+	"github.com/seantcanavan/anon-eth-net/pool"
+	"github.com/seantcanavan/anon-eth-net/posture"
 	"github.com/seantcanavan/anon-eth-net/profiler"
+	"github.com/seantcanavan/anon-eth-net/profit"
+	"github.com/seantcanavan/anon-eth-net/reporter"
 	"github.com/seantcanavan/anon-eth-net/rest"
+	"github.com/seantcanavan/anon-eth-net/retention"
+	"github.com/seantcanavan/anon-eth-net/selfcheck"
+	"github.com/seantcanavan/anon-eth-net/service"
+	"github.com/seantcanavan/anon-eth-net/state"
+	"github.com/seantcanavan/anon-eth-net/timesync"
+	"github.com/seantcanavan/anon-eth-net/transport"
 	"github.com/seantcanavan/anon-eth-net/updater"
 	"github.com/seantcanavan/anon-eth-net/utils"
+	"github.com/seantcanavan/anon-eth-net/watchdog"
 )
 
+// The subject of the notification sent when the program shuts down
+const SHUTDOWN_SUBJECT = "Shutting down"
+
+// The exit code used when another copy of the program is already running
+const ALREADY_RUNNING_EXIT_CODE = 3
+
 func main() {
 
-	//------------------ CHECK FOR COMMAND LINE HELP ARGUMENTS ------------------
+	name := RUN_COMMAND
+	var args []string
 	if len(os.Args) > 1 {
-		fmt.Println("Does not require any command line arguments. Refer to the default ./assets/config.json file for all the parameters required for anon-eth-net to execute successfully.")
+		name = os.Args[1]
+		args = os.Args[2:]
+	}
+
+	//------------------ CHECK FOR COMMAND LINE HELP ARGUMENTS ------------------
+	if name == "help" || name == "-h" || name == "--help" {
+		fmt.Println(usage())
 		fmt.Println(config.ConfigJSONParametersExplained())
+		os.Exit(0)
+	}
+
+	subcommand, found := commandNamed(name)
+	if !found {
+		fmt.Println(fmt.Sprintf("Unknown subcommand: %v", name))
+		fmt.Println(usage())
+		os.Exit(1)
+	}
+
+	//------------------ ANSWER THE SERVICE MANAGER WHEN RUNNING AS A SERVICE ------------------
+	if serviceErr := service.Supervise(); serviceErr != nil {
+		fmt.Println(fmt.Sprintf("Couldn't start as a service: %v", serviceErr))
 		os.Exit(1)
 	}
 
 	//------------------ GENERATE THE LOGGING FILE FOR THE MAIN PACKAGE ------------------
+	// the working directory belongs to root when the privileged helper runs the agent
+	if dataDir := os.Getenv(config.DATA_DIR_VARIABLE); dataDir != "" {
+		if dirErr := logger.SetLogDir(filepath.Join(dataDir, config.MACHINE_LOG_DIR_NAME), logger.DEFAULT_LOG_DIR_MODE, 0); dirErr != nil {
+			fmt.Println(dirErr)
+		}
+	}
 	loggerErr := logger.StandardLogger("main_package")
 	if loggerErr != nil {
 		fmt.Println(loggerErr)
@@ -43,60 +98,105 @@ func main() {
 		os.Exit(1)
 	}
 
-	//------------------ CREATE LOADER INSTANCE TO RUN PROCESSES LOCALLY BASED ON GOOS ------------------
-	var mainLoader *loader.Loader
-	var loaderErr error
-
-	switch runtime.GOOS {
-	case "windows", "darwin", "linux":
-		loaderAssetPath, assetErr := utils.SysAssetPath("main_loader.json")
-		if assetErr != nil {
-			fmt.Println(assetErr)
-			fmt.Println("Could not successfully load main_loader.json... Exiting...")
-			os.Exit(1)
+	//------------------ RUN THE SUBCOMMAND ------------------
+	if runErr := subcommand.run(args); runErr != nil {
+		fmt.Println(runErr)
+		if _, running := runErr.(lifecycle.ErrAlreadyRunning); running {
+			os.Exit(ALREADY_RUNNING_EXIT_CODE)
 		}
-		mainLoader, loaderErr = loader.NewLoader(loaderAssetPath)
-	default:
-		fmt.Println(fmt.Sprintf("Could not create loader for unsupported operating system: %v. Please choose from one of the selected supported operating systems to continue. Refer to the README.md for the list.", runtime.GOOS))
 		os.Exit(1)
 	}
+}
 
-	if loaderErr != nil {
-		fmt.Println(loaderErr)
-		fmt.Println("Couldn't create the loader for executing external processes... Exiting...")
-		os.Exit(1)
+// runAgent will start every subsystem of the agent and block until it's asked
+// to shut down via SIGINT or SIGTERM.
+func runAgent(args []string) error {
+
+	defer crash.Recover()
+
+	//------------------ LOG EVERYTHING WRITTEN TO STDOUT AND STDERR WHEN ASKED TO ------------------
+	if config.Cfg.LogCaptureOutput {
+		if captureErr := logger.CaptureOutput(); captureErr != nil {
+			logger.Lgr.LogErrorf("Could not capture the standard output and standard error: %v", captureErr)
+		}
 	}
 
-	mainNetwork, networkErr := network.NewNetwork()
-	if networkErr != nil {
-		fmt.Println(networkErr)
-		fmt.Println("Couldn't create the network monitor... Exiting...")
-		os.Exit(1)
+	//------------------ MAKE SURE NO OTHER COPY IS ALREADY RUNNING ON THIS MACHINE ------------------
+	lockErr := lifecycle.AcquireLock(config.Cfg.LockFile)
+	if lockErr != nil {
+		return lockErr
 	}
+	lifecycle.OnShutdown("instance lock", func(ctx context.Context) error {
+		return lifecycle.ReleaseLock()
+	})
+
+	//------------------ SUBSCRIBE THE LOGGER TO THE EVENT BUS ------------------
+	events.Subscribe("logger", func(record events.Record) {
+		logger.Lgr.LogMessagef("Event %v: %v", record.Kind, record.Event.Summary())
+	})
 
-	//------------------ CREATE REST INSTANCE TO ENABLE COMMUNICATION VIA REST ------------------
-	certPath, certPathErr := utils.AssetPath("server.cert")
-	if certPathErr != nil {
-		fmt.Println(certPathErr)
-		return
+	//------------------ CHECK EVERY DEPENDENCY AND START WITHOUT THE ONES WHICH FAIL ------------------
+	var mainLoader *loader.Loader
+	var mainNetwork *network.Network
+	var mainRest *rest.RestHandler
+
+	selfcheck.Register("resource limits", limits.Apply)
+	selfcheck.Register(selfcheck.CONFIG_CHECK, selfcheck.ConfigValid)
+	selfcheck.Register(selfcheck.LOG_DIR_CHECK, selfcheck.LogDirWritable)
+	selfcheck.Register("state store", func() error {
+		if stateErr := state.Open(config.Cfg.StateFile); stateErr != nil {
+			return fmt.Errorf("Could not open the state store. Received error %v. Move the StateFile aside to start over with an empty one.", stateErr)
+		}
+		return nil
+	})
+	selfcheck.Register("notification channels", configureReporter)
+	selfcheck.Register("loader", func() error {
+		var loaderErr error
+		mainLoader, loaderErr = newMainLoader()
+		return loaderErr
+	})
+	selfcheck.Register("network monitor", func() error {
+		var networkErr error
+		mainNetwork, networkErr = network.NewNetwork()
+		return networkErr
+	})
+	selfcheck.Register(selfcheck.NETWORK_CHECK, selfcheck.NetworkReachable)
+	selfcheck.Register("REST handler", func() error {
+		var restErr error
+		mainRest, restErr = rest.NewRestHandler()
+		return restErr
+	})
+	selfcheck.Register(selfcheck.LISTENER_CHECK, selfcheck.ListenerBindable)
+
+	summary, allPassed := selfcheck.Summary(selfcheck.Run())
+	limits.Watch()
+	if !allPassed {
+		logger.Lgr.LogErrorf("Starting in degraded mode:\n%v", summary)
 	}
+	reporter.RegisterStatusSection("Self Check", selfcheck.StatusSummary)
+
+	// warn about REST tokens which are about to expire
+	rest.WatchTokens()
 
-	certValue, certReadErr := ioutil.ReadFile(certPath)
-	if certReadErr != nil {
-		fmt.Println(certReadErr)
-		return
+	//------------------ WRITE A REPORT WHENEVER THE AGENT CRASHES AND SEND ANY FROM LAST TIME ------------------
+	if crashErr := crash.Install(); crashErr != nil {
+		logger.Lgr.LogErrorf("Could not set up crash reporting: %v", crashErr)
 	}
 
-	mainRest, restErr := rest.NewRestHandler()
-	if restErr != nil {
-		fmt.Println(restErr)
-		return
+	//------------------ SUBSCRIBE THE REPORTER TO THE EVENT BUS AND REPORT ANY FAILED CHECKS ------------------
+	reporter.SubscribeToEvents()
+	if reportErr := selfcheck.Report(); reportErr != nil {
+		logger.Lgr.LogErrorf("Could not report the failed self checks: %v", reportErr)
 	}
 
-	rootAuthorities := x509.NewCertPool()
-	if ok := rootAuthorities.AppendCertsFromPEM([]byte(certValue)); !ok {
-		fmt.Println("Unable to append certificate to set of root certificate authorities")
-		return
+	if mainRest != nil {
+		mainRest.MainLoader = mainLoader
+	}
+
+	//------------------ RESUME ANY ASYNCHRONOUS OPERATIONS INTERRUPTED BY THE LAST SHUTDOWN ------------------
+	operationsErr := operations.Load()
+	if operationsErr != nil {
+		logger.Lgr.LogErrorf("Could not load saved operations: %v", operationsErr)
 	}
 
 	//------------------ IF THIS IS OUR FIRST TIME STARTING UP EVER, TAKE APPROPRIATE ACTIONS ------------------
@@ -115,56 +215,352 @@ func main() {
 		}
 	}
 
+	// check the clock before anything is scheduled at a time of day
+	logger.Lgr.LogMessage("Initializing the clock skew check")
+	timesync.Run()
+
 	// kick off the profiler loop
 	logger.Lgr.LogMessage("Initializing the profiler")
 	profiler.Run()
+	profiler.RunHistory()
+	profiler.RegisterCollector("http", transport.ClientMetrics)
+	profiler.RegisterCollector("logger", logger.Metrics)
 
 	// kick off the updater loop
 	logger.Lgr.LogMessage("Initializing the updater")
+	updater.SetPermit(network.RequestUpdatePermit)
+	network.RunPermitRelease()
 	updater.Run()
 
 	// kick off the process loader loop that will execute things like miners
-	logger.Lgr.LogMessage("Initializing the loader")
-	mainLoader.Run()
+	if mainLoader != nil {
+		logger.Lgr.LogMessage("Initializing the loader")
+		mainLoader.SetEnabled(config.Enabled(config.SUBSYSTEM_LOADER))
+		mainLoader.Run()
+		reporter.RegisterStatusSection("Jobs", mainLoader.StatusSummary)
+		profiler.RegisterCollector("miners", mainLoader.MinerMetrics)
+	}
+
+	// kick off monitoring the wallets the miners pay out to
+	logger.Lgr.LogMessage("Initializing the ETH wallet monitor")
+	eth.Run()
+	profiler.RegisterCollector("eth", eth.Metrics)
+
+	// kick off collecting the stats of the pools the miners mine on
+	logger.Lgr.LogMessage("Initializing the mining pool stats")
+	pool.Run()
+	profiler.RegisterCollector("pool", pool.Metrics)
+
+	// kick off estimating the daily profit of this machine
+	logger.Lgr.LogMessage("Initializing the profitability estimates")
+	profit.Run()
+	profiler.RegisterCollector("profit", profit.Metrics)
+
+	// kick off supervising the local ethereum node
+	logger.Lgr.LogMessage("Initializing the node supervisor")
+	node.Run(mainLoader)
+	profiler.RegisterCollector("node", node.Metrics)
+
+	// kick off snapshotting the security posture of this machine
+	logger.Lgr.LogMessage("Initializing the security posture snapshots")
+	posture.Run()
+
+	// kick off verifying the executable and assets haven't been tampered with
+	logger.Lgr.LogMessage("Initializing the integrity checks")
+	integrity.Run()
+
+	// kick off deleting the data which has outlived its retention period
+	logger.Lgr.LogMessage("Initializing the data retention cleanup")
+	retention.Run()
 
 	// kick off the network monitor loop to monitor internet connectivity
-	logger.Lgr.LogMessage("Initializing the network monitor")
-	mainNetwork.Run()
+	if mainNetwork != nil {
+		logger.Lgr.LogMessage("Initializing the network monitor")
+		mainNetwork.Run()
+	}
+
+	// kick off the daily status reports
+	logger.Lgr.LogMessage("Initializing the status reports")
+	reporter.RegisterStatusSection("Pending Updates", updater.PendingUpdateSummary)
+	reporter.RegisterStatusSection("Update History", updater.HistorySummary)
+	reporter.RegisterStatusSection("Update Trust", updater.TUFSummary)
+	reporter.RegisterStatusSection("Audit Log", audit.StatusSummary)
+	reporter.RegisterStatusSection("Public IP", network.PublicIPSummary)
+	reporter.RegisterStatusSection("Connectivity", transport.ConnectivitySummary)
+	reporter.RegisterStatusSection("Clock", timesync.Summary)
+	reporter.RegisterStatusSection("Resources", limits.Summary)
+	reporter.RegisterStatusSection("Wallets", eth.Summary)
+	reporter.RegisterStatusSection("Pools", pool.Summary)
+	reporter.RegisterStatusSection("Profitability", profit.Summary)
+	reporter.RegisterStatusSection("Node", node.Summary)
+	reporter.RegisterStatusSection("Security Posture", posture.Summary)
+	reporter.RegisterStatusSection("Integrity", integrity.Summary)
+	reporter.RegisterStatusSection("Retention", retention.Summary)
+	reporter.RegisterStatusSection("Site", network.SiteSummary)
+	reporter.RegisterStatusSection("Fleet", network.FleetSummary)
+	reporter.RegisterStatusSection("Bandwidth", transport.BandwidthSummary)
+	reporter.RegisterStatusSection("Watchdog", watchdog.StatusSummary)
+	reporter.RegisterStatusSection("State", state.StatusSummary)
+	reporter.RegisterStatusSection("Crashes", crash.StatusSummary)
+	for _, metric := range []string{profiler.HEAP_MB_METRIC, profiler.GOROUTINES_METRIC, profiler.LOAD1_METRIC, profiler.MEM_AVAILABLE_MB_METRIC} {
+		metric := metric
+		reporter.RegisterStatusChart(metric, func() []float64 { return profiler.History(metric) })
+	}
+	reporter.RunStatusReports()
+	reporter.RunDigests()
+	reporter.RunQueue()
+
+	// kick off polling for commands sent by email
+	logger.Lgr.LogMessage("Initializing the email command channel")
+	inbox.RegisterCommand("status", func(args []string) (string, []reporter.Attachment, error) {
+		return string(reporter.StatusReport()), nil, nil
+	})
+	inbox.RegisterCommand("logs", func(args []string) (string, []reporter.Attachment, error) {
+		return "recent logs attached\n", reporter.LogAttachments(logger.Lgr, profiler.PROFILE_LOG_ATTACHMENT_COUNT), nil
+	})
+	inbox.RegisterCommand("update", func(args []string) (string, []reporter.Attachment, error) {
+		result, updateErr := updater.UpdateNow()
+		return result, nil, updateErr
+	})
+	inbox.RegisterCommand("pin", func(args []string) (string, []reporter.Attachment, error) {
+		version, parseErr := strconv.ParseUint(strings.Join(args, ""), 10, 64)
+		if len(args) != 1 || parseErr != nil || version == 0 {
+			return "", nil, fmt.Errorf("usage: pin <version>")
+		}
+		if applyErr := config.Apply([]byte(fmt.Sprintf(`{"UpdatePinnedVersion": %d}`, version))); applyErr != nil {
+			return "", nil, applyErr
+		}
+		return fmt.Sprintf("pinned to version %d. The next update check moves to it\n", version), nil, nil
+	})
+	inbox.RegisterCommand("unpin", func(args []string) (string, []reporter.Attachment, error) {
+		if applyErr := config.Apply([]byte(`{"UpdatePinnedVersion": 0}`)); applyErr != nil {
+			return "", nil, applyErr
+		}
+		return "unpinned. The next update check follows the latest release\n", nil, nil
+	})
+	inbox.RegisterCommand("restart", func(args []string) (string, []reporter.Attachment, error) {
+		if len(args) != 1 {
+			return "", nil, fmt.Errorf("usage: restart <process name>")
+		}
+		if mainLoader == nil {
+			return "", nil, fmt.Errorf("the loader isn't running because it failed its self check")
+		}
+		return fmt.Sprintf("restarting %v\n", args[0]), nil, mainLoader.Restart(args[0])
+	})
+	inbox.RegisterCommand("node-restart", func(args []string) (string, []reporter.Attachment, error) {
+		go func() {
+			if restartErr := node.Restart("An operator asked for it"); restartErr != nil {
+				logger.Lgr.LogErrorf("Failed to restart the node: %v", restartErr)
+			}
+		}()
+		return "restarting the node\n", nil, nil
+	})
+	inbox.RegisterCommand("config", func(args []string) (string, []reporter.Attachment, error) {
+		if len(args) == 0 {
+			return "", nil, fmt.Errorf("usage: config <json object of config values>")
+		}
+		return "config applied\n", nil, config.Apply([]byte(strings.Join(args, " ")))
+	})
+	inbox.RegisterCommand("wipe", func(args []string) (string, []reporter.Attachment, error) {
+		// naming the machine keeps a wipe meant for one machine off the rest of the fleet
+		if len(args) != 1 || args[0] != config.Cfg.DeviceId {
+			return "", nil, fmt.Errorf("usage: wipe <device id of this machine>")
+		}
+		retention.RequestWipe("was asked to wipe its data")
+		return fmt.Sprintf("wiping the data of %v and shutting down in %d seconds\n", config.Cfg.DeviceId, retention.WIPE_DELAY_SECONDS), nil, nil
+	})
+
+	// load the plugins after the built in commands so they can't replace them
+	logger.Lgr.LogMessage("Loading plugins")
+	plugins.Load()
+	reporter.RegisterStatusSection("Plugins", plugins.StatusSummary)
+
+	inbox.Run()
+
+	// kick off checking in with the fleet server which can queue the same commands
+	logger.Lgr.LogMessage("Initializing the fleet check ins")
+	network.RunCheckIns()
+
+	// kick off the command channel which delivers the same commands in real time
+	logger.Lgr.LogMessage("Initializing the fleet command channel")
+	network.RunChannel()
+
+	// kick off publishing telemetry and receiving commands over MQTT
+	logger.Lgr.LogMessage("Initializing MQTT")
+	network.RunMQTT()
+
+	// kick off watching for changes to the public IP address
+	logger.Lgr.LogMessage("Initializing the public IP watcher")
+	network.RunPublicIPWatcher()
+
+	// kick off finding the other agents on the same network
+	logger.Lgr.LogMessage("Initializing LAN peer discovery")
+	if discoveryErr := network.RunDiscovery(); discoveryErr != nil {
+		logger.Lgr.LogErrorf("Could not start LAN peer discovery: %v", discoveryErr)
+	}
 
 	// kick off the REST endpoints
 	logger.Lgr.LogMessage("Initializing the REST interface")
-	mainRest.StartupRestServer()
-
-	// create a channel to listen to type os.Signal on with depth = 1
-	sigs := make(chan os.Signal, 1)
-	// create a channel to listen to type bool on with depth = 1
-	done := make(chan bool, 1)
+	watchSubsystems(mainLoader, mainRest)
 
-	// redirect the signals SIGINT and SIGTERM to the channel 'sigs'
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	//------------------ SHUT EVERYTHING DOWN IN ORDER ON SIGINT OR SIGTERM ------------------
+	// hooks run in reverse so the loggers are flushed last
+	lifecycle.OnShutdown("loggers", func(ctx context.Context) error {
+		// log the last of the captured output before flushing it
+		if releaseErr := logger.ReleaseOutput(); releaseErr != nil {
+			logger.Lgr.LogErrorf("Could not release the standard output and standard error: %v", releaseErr)
+		}
+		return logger.FlushAll()
+	})
+	lifecycle.OnShutdown("config", func(ctx context.Context) error {
+		logger.Lgr.LogMessage("Backing up the latest config changes before exiting")
+		return config.ToFile()
+	})
+	if mainLoader != nil {
+		lifecycle.OnShutdown("loader", func(ctx context.Context) error {
+			// a restart leaves the jobs running for the next copy to adopt
+			if lifecycle.Restarting() {
+				return mainLoader.HandOff(ctx)
+			}
+			return mainLoader.Shutdown(ctx)
+		})
+	}
+	lifecycle.OnShutdown("plugins", plugins.Shutdown)
+	if mainRest != nil {
+		lifecycle.OnShutdown("REST server", mainRest.Shutdown)
+	}
+	lifecycle.OnShutdown("shutdown notification", func(ctx context.Context) error {
+		return reporter.Notify(reporter.INFO, SHUTDOWN_SUBJECT, []byte(fmt.Sprintf("Shutting down after it %v.\n", lifecycle.Reason())))
+	})
 
-	// wait in a separate go routine for the SIGINT and SIGTERM signals
-	go func() {
-		// when the OS sends SIGINT or SIGTERM to us, save the signal to value to 'signal'
-		signal := <-sigs
-		logger.Lgr.LogMessage("Received interrupting signal: %v", signal)
-		// push 'true' to the 'done' channel when we've successfully received SIGINT or SIGTERM
-		done <- true
-	}()
+	// recycle long running deployments on a schedule
+	lifecycle.RestartAfter(time.Duration(config.Cfg.RecycleHours) * time.Hour)
 
 	logger.Lgr.LogMessage("Executing... Press CTRL+C to exit. Browse local log files to keep an eye on each individual component.")
-	// block until we receive SIGINT or SIGTERM and 'true' is pushed down the 'done' pipe
-	<-done
-	logger.Lgr.LogMessage("Clean exit after a CTRL+C interrupt.")
-	logger.Lgr.LogMessage("Backing up the latest config changes before exiting")
-	config.ToFile()
+	// block until we receive SIGINT or SIGTERM and every subsystem has shut down
+	lifecycle.Wait()
+
+	if lifecycle.Restarting() {
+		logger.Lgr.LogMessagef("Restarting in place after it %v", lifecycle.Reason())
+		logger.FlushAll()
+		return lifecycle.Exec()
+	}
+
+	if retention.WipeRequested() {
+		if failed := retention.Wipe(); len(failed) > 0 {
+			return fmt.Errorf("Could not wipe %v", strings.Join(failed, ", "))
+		}
+		return nil
+	}
+
+	logger.Lgr.LogMessagef("Clean exit after: %v", lifecycle.Reason())
 	logger.Lgr.LogMessage("Fin")
+	service.Wait()
+	return nil
+}
+
+// configureReporter will register the configured notification channels and
+// load the PGP keys used to protect outbound email.
+func configureReporter() error {
+
+	notifierErr := reporter.NotifiersFromConfig()
+	if notifierErr != nil {
+		return fmt.Errorf("Could not successfully configure notification channels. Received error %v. Check the Notifiers values in the config.json asset.", notifierErr)
+	}
+
+	pgpErr := reporter.PGPKeysFromConfig()
+	if pgpErr != nil {
+		return fmt.Errorf("Could not successfully load the PGP keys. Received error %v. Check the PGP values in the config.json asset.", pgpErr)
+	}
+
+	return nil
+}
+
+// watchSubsystems will pause or resume the loader and start or stop the REST
+// server to match the Subsystems in the config, now and every time the config
+// is loaded again. The other subsystems check the config each time they run.
+// Either can be nil if it failed its self check.
+func watchSubsystems(mainLoader *loader.Loader, mainRest *rest.RestHandler) {
+
+	restRunning := false
+
+	apply := func() {
+		if mainLoader != nil {
+			mainLoader.SetEnabled(config.Enabled(config.SUBSYSTEM_LOADER))
+		}
+
+		if mainRest == nil {
+			return
+		}
+
+		restEnabled := config.Enabled(config.SUBSYSTEM_REST)
+		if restEnabled && !restRunning {
+			if startErr := mainRest.StartupRestServer(); startErr != nil {
+				logger.Lgr.LogErrorf("Could not start the REST server: %v", startErr)
+				return
+			}
+			restRunning = true
+		} else if !restEnabled && restRunning {
+			logger.Lgr.LogMessage("The REST server is turned off in the config. Shutting it down")
+			ctx, cancel := context.WithTimeout(context.Background(), lifecycle.SHUTDOWN_TIMEOUT_SECONDS*time.Second)
+			defer cancel()
+			if shutdownErr := mainRest.Shutdown(ctx); shutdownErr != nil {
+				logger.Lgr.LogErrorf("Could not cleanly shut down the REST server: %v", shutdownErr)
+			}
+			restRunning = false
+		}
+	}
+
+	apply()
+
+	events.Subscribe("subsystems", func(record events.Record) {
+		if changed, isConfig := record.Event.(events.ConfigChanged); isConfig && changed.Action == "loaded" {
+			apply()
+		}
+	})
+}
+
+// newMainLoader will create the loader which runs the processes, like miners,
+// listed in the main_loader.json asset for this operating system.
+func newMainLoader() (*loader.Loader, error) {
+
+	loaderAssetPath, assetErr := mainLoaderAssetPath()
+	if assetErr != nil {
+		return nil, assetErr
+	}
+
+	mainLoader, loaderErr := loader.NewLoader(loaderAssetPath)
+	if loaderErr != nil {
+		return nil, fmt.Errorf("Couldn't create the loader for executing external processes: %v", loaderErr)
+	}
+
+	return mainLoader, nil
+}
+
+// mainLoaderAssetPath returns the path of the main_loader.json asset of this
+// operating system.
+func mainLoaderAssetPath() (string, error) {
+
+	switch runtime.GOOS {
+	case "windows", "darwin", "linux":
+		loaderAssetPath, assetErr := utils.SysAssetPath("main_loader.json")
+		if assetErr != nil {
+			return "", fmt.Errorf("Could not successfully load main_loader.json: %v", assetErr)
+		}
+		return loaderAssetPath, nil
+	default:
+		return "", fmt.Errorf("Could not create loader for unsupported operating system: %v. Please choose from one of the selected supported operating systems to continue. Refer to the README.md for the list.", runtime.GOOS)
+	}
 }
 
 // initialStartup will be executed only when this program is running for the
 // first time on a new host.
 func initialStartup() error {
-	// more stuff later!
+	// make sure every notification channel actually works before it's needed
+	summary, allPassed := reporter.SelfTestSummary(reporter.ReporterSelfTest())
+	if !allPassed {
+		logger.Lgr.LogErrorf("Reporter self test failed on initial startup. Check the notification config values:\n%v", summary)
+	}
 
 	// we're finishing the first run!
 	config.Cfg.InitialStartup = "no"
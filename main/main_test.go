@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -10,3 +13,38 @@ func TestMain(m *testing.M) {
 	result := m.Run()
 	os.Exit(result)
 }
+
+func TestSetupAnswers(t *testing.T) {
+
+	step := setupStep{title: "test", fields: []setupField{
+		{"RemoteVersionURI", "versions", true, false},
+		{"CheckInGmailAddress", "address", false, false},
+		{"CheckInGmailPassword", "password", false, true},
+		{"EthWallets", "wallets", true, false},
+	}}
+
+	input := bufio.NewReader(strings.NewReader("https://a.example.com/v, https://b.example.com/v\n\n-\n-\n"))
+	var output bytes.Buffer
+
+	overrides, askErr := askStep(input, &output, step)
+	if askErr != nil {
+		t.Fatal(askErr)
+	}
+
+	if versions, _ := overrides["RemoteVersionURI"].([]string); len(versions) != 2 || versions[1] != "https://b.example.com/v" {
+		t.Errorf("Expected both version URIs, got %v", overrides["RemoteVersionURI"])
+	}
+	if _, answered := overrides["CheckInGmailAddress"]; answered {
+		t.Errorf("Expected an empty answer to keep the address, got %v", overrides["CheckInGmailAddress"])
+	}
+	if overrides["CheckInGmailPassword"] != "" {
+		t.Errorf("Expected the password to be cleared, got %v", overrides["CheckInGmailPassword"])
+	}
+	if wallets, isList := overrides["EthWallets"].([]string); !isList || len(wallets) != 0 {
+		t.Errorf("Expected the wallets to be cleared, got %v", overrides["EthWallets"])
+	}
+
+	if _, askErr := ask(input, &output, "more?"); askErr == nil {
+		t.Error("Expected running out of input to cancel the setup")
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/reporter"
+	"github.com/seantcanavan/anon-eth-net/transport"
+	"github.com/seantcanavan/anon-eth-net/updater"
+)
+
+// The answer to a setup question which clears the setting
+const SETUP_CLEAR_ANSWER = "-"
+
+// How long the setup subcommand waits for the fleet server to answer
+const SETUP_REACH_TIMEOUT_SECONDS = 15
+
+// setupField is a single setting the setup subcommand asks for.
+type setupField struct {
+	name     string // The setting as it's named in the config.json asset
+	question string // What the setting is for
+	list     bool   // Whether the answer is a comma separated list
+	secret   bool   // Whether the current value is hidden
+}
+
+// setupStep is a group of settings the setup subcommand asks for together and
+// the live check they have to pass once they're applied.
+type setupStep struct {
+	title  string
+	fields []setupField
+	check  func(output io.Writer) error // nil when there's nothing to check
+}
+
+// setupSteps returns the essential settings in the order they're asked for.
+func setupSteps() []setupStep {
+	return []setupStep{
+		{"Updates", []setupField{
+			{"RemoteVersionURI", "The URIs the latest version number is fetched from", true, false},
+		}, checkVersionURI},
+		{"Notifications", []setupField{
+			{"CheckInGmailAddress", "The gmail address reports are sent to and from", false, false},
+			{"CheckInGmailPassword", "The password of the gmail address. A {{env \"NAME\"}} template keeps it out of the config", false, true},
+		}, checkNotifications},
+		{"Wallets", []setupField{
+			{"EthWallets", "The addresses of the wallets whose balances are monitored", true, false},
+		}, nil},
+		{"Fleet server", []setupField{
+			{"FleetServerURL", "The URLs of the fleet server to check in with", true, false},
+			{"FleetSecret", "The shared secret heartbeats are signed with", false, true},
+		}, checkFleetServer},
+	}
+}
+
+// runSetup will ask for the essential settings on the terminal.
+func runSetup(args []string) error {
+	return setup(os.Stdin, os.Stdout)
+}
+
+// setup will ask for the essential settings one step at a time, apply each
+// step to the config.json asset as soon as it's answered and check it works
+// straight away, e.g. by sending a test notification. Leaving an answer empty
+// keeps the current value and answering SETUP_CLEAR_ANSWER clears it. A step
+// which isn't valid, or fails its check and isn't kept anyway, is asked again
+// with the values given as the new defaults.
+func setup(input io.Reader, output io.Writer) error {
+
+	reader := bufio.NewReader(input)
+
+	fmt.Fprintf(output, "Setting up %v. Press enter to keep the value in brackets or enter %v to clear it. Answers are shown as they're typed.\n", config.Cfg.DeviceName, SETUP_CLEAR_ANSWER)
+
+	for _, step := range setupSteps() {
+
+		fmt.Fprintf(output, "\n== %v ==\n", step.title)
+
+		for 1 == 1 {
+
+			overrides, askErr := askStep(reader, output, step)
+			if askErr != nil {
+				return askErr
+			}
+
+			if len(overrides) > 0 {
+				overrideBytes, marshalErr := json.Marshal(overrides)
+				if marshalErr != nil {
+					return marshalErr
+				}
+				applyErr := config.Apply(overrideBytes)
+				var invalidErr config.ErrConfigInvalid
+				if errors.As(applyErr, &invalidErr) {
+					fmt.Fprintf(output, "That isn't valid: %v\n", invalidErr)
+					continue
+				}
+				if applyErr != nil {
+					return applyErr
+				}
+			}
+
+			if step.check == nil {
+				break
+			}
+
+			checkErr := step.check(output)
+			if checkErr == nil {
+				break
+			}
+
+			fmt.Fprintf(output, "The check failed: %v\n", checkErr)
+			keep, keepErr := ask(reader, output, "Keep these settings anyway? [y/N]")
+			if keepErr != nil {
+				return keepErr
+			}
+			if strings.HasPrefix(strings.ToLower(keep), "y") {
+				break
+			}
+		}
+	}
+
+	fmt.Fprintln(output, "\nSuccessfully saved the settings. Run the validate-config subcommand to check the rest of the config.")
+	return nil
+}
+
+// askStep returns the JSON value of every setting of the given step which was
+// given an answer.
+func askStep(reader *bufio.Reader, output io.Writer, step setupStep) (map[string]interface{}, error) {
+
+	currentBytes, marshalErr := json.Marshal(config.Cfg)
+	if marshalErr != nil {
+		return nil, marshalErr
+	}
+	var current map[string]interface{}
+	if jsonErr := json.Unmarshal(currentBytes, &current); jsonErr != nil {
+		return nil, jsonErr
+	}
+
+	overrides := make(map[string]interface{})
+
+	for _, field := range step.fields {
+
+		shown := currentValue(current[field.name])
+		if field.secret && shown != "" {
+			shown = "********"
+		}
+
+		answer, askErr := ask(reader, output, fmt.Sprintf("%v - %v [%v]:", field.name, field.question, shown))
+		if askErr != nil {
+			return nil, askErr
+		}
+
+		switch {
+		case answer == "":
+			continue
+		case answer == SETUP_CLEAR_ANSWER && field.list:
+			overrides[field.name] = []string{}
+		case answer == SETUP_CLEAR_ANSWER:
+			overrides[field.name] = ""
+		case field.list:
+			var values []string
+			for _, value := range strings.Split(answer, ",") {
+				if value = strings.TrimSpace(value); value != "" {
+					values = append(values, value)
+				}
+			}
+			overrides[field.name] = values
+		default:
+			overrides[field.name] = answer
+		}
+	}
+
+	return overrides, nil
+}
+
+// ask will print the given question and return the line answered, trimmed.
+// Returns an error when there's no more input.
+func ask(reader *bufio.Reader, output io.Writer, question string) (string, error) {
+
+	fmt.Fprintf(output, "%v ", question)
+
+	line, readErr := reader.ReadString('\n')
+	if readErr == io.EOF && line == "" {
+		return "", fmt.Errorf("Setup was cancelled before it finished. The steps already answered have been saved")
+	}
+	if readErr != nil && readErr != io.EOF {
+		return "", readErr
+	}
+
+	return strings.TrimSpace(line), nil
+}
+
+// currentValue returns the given decoded setting as it's shown in brackets.
+func currentValue(value interface{}) string {
+
+	switch typed := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return typed
+	case []interface{}:
+		var values []string
+		for _, element := range typed {
+			values = append(values, fmt.Sprint(element))
+		}
+		return strings.Join(values, ", ")
+	}
+
+	return fmt.Sprint(value)
+}
+
+// checkVersionURI will fetch the version number from every RemoteVersionURI.
+func checkVersionURI(output io.Writer) error {
+
+	for _, versionURI := range config.Cfg.RemoteVersionURI {
+		version, fetchErr := updater.FetchVersion(versionURI)
+		if fetchErr != nil {
+			return fmt.Errorf("Could not fetch the version from %v: %v", versionURI, fetchErr)
+		}
+		fmt.Fprintf(output, "Successfully fetched version %v from %v\n", version, versionURI)
+	}
+
+	return nil
+}
+
+// checkNotifications will send a test notification through every configured
+// channel.
+func checkNotifications(output io.Writer) error {
+
+	if reporterErr := configureReporter(); reporterErr != nil {
+		return reporterErr
+	}
+
+	fmt.Fprintln(output, "Sending a test notification...")
+	summary, allPassed := reporter.SelfTestSummary(reporter.ReporterSelfTest())
+	fmt.Fprint(output, summary)
+
+	if !allPassed {
+		return fmt.Errorf("At least one notification channel failed the self test")
+	}
+
+	return nil
+}
+
+// checkFleetServer will make sure the FleetServerURL answers. Any reply
+// counts, as the fleet server only accepts signed heartbeats.
+func checkFleetServer(output io.Writer) error {
+
+	fleetURL := config.Cfg.FleetServerURL.Primary()
+	if fleetURL == "" {
+		return nil
+	}
+
+	request, requestErr := http.NewRequest(http.MethodHead, fleetURL, nil)
+	if requestErr != nil {
+		return requestErr
+	}
+
+	resp, headErr := transport.HTTPClient(SETUP_REACH_TIMEOUT_SECONDS * time.Second).Do(request)
+	if headErr != nil {
+		return fmt.Errorf("Could not reach %v: %v", fleetURL, headErr)
+	}
+	resp.Body.Close()
+
+	fmt.Fprintf(output, "Successfully reached %v\n", fleetURL)
+	return nil
+}
@@ -0,0 +1,208 @@
+package network
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/transport"
+	"golang.org/x/net/websocket"
+)
+
+// The shortest time to wait before reconnecting the command channel. In seconds
+const MIN_CHANNEL_RETRY_SECONDS = 1
+
+// The longest time to wait before reconnecting the command channel. In seconds
+const MAX_CHANNEL_RETRY_SECONDS = 300
+
+// How often a heartbeat is sent over an idle command channel. In seconds
+const CHANNEL_KEEPALIVE_SECONDS = 30
+
+// The header holding the unix time the command channel was opened at
+const FLEET_TIMESTAMP_HEADER = "X-Fleet-Timestamp"
+
+// The types of message the agent sends over the command channel
+const CHANNEL_HEARTBEAT = "heartbeat"
+const CHANNEL_RESULT = "result"
+
+// ChannelMessage is a single message sent by the agent over the command
+// channel. Exactly one of Heartbeat and Result is set depending on Type. The
+// control server sends FleetCommand messages the other way. Config pushes are
+// "config" commands holding a JSON object of config values and update
+// triggers are "update" commands.
+type ChannelMessage struct {
+	Type      string         `json:"type"`
+	Heartbeat *Heartbeat     `json:"heartbeat,omitempty"`
+	Result    *CommandResult `json:"result,omitempty"`
+}
+
+// RunChannel will keep an outbound WebSocket open to FleetChannelURL so
+// commands arrive in real time instead of waiting for the next check in. The
+// channel is reopened with exponential backoff whenever it drops, or straight
+// away when connectivity returns after an outage. Does nothing when
+// FleetChannelURL isn't set.
+func RunChannel() {
+
+	if config.Cfg.FleetChannelURL == "" {
+		logger.Lgr.LogMessage("No FleetChannelURL configured. The command channel is disabled.")
+		return
+	}
+
+	go func() {
+		backoff := time.Duration(MIN_CHANNEL_RETRY_SECONDS) * time.Second
+
+		for 1 == 1 {
+			conn, dialErr := dialChannel()
+			if dialErr == nil {
+				backoff = time.Duration(MIN_CHANNEL_RETRY_SECONDS) * time.Second
+				serveErr := serveChannel(conn)
+				logger.Lgr.LogErrorf("The command channel to %v closed: %v", config.Cfg.FleetChannelURL, serveErr)
+			} else {
+				logger.Lgr.LogErrorf("Failed to open the command channel to %v: %v", config.Cfg.FleetChannelURL, dialErr)
+			}
+
+			logger.Lgr.LogMessagef("Reopening the command channel in %v", backoff)
+			select {
+			case <-time.After(backoff):
+			case <-transport.Reconnected():
+				backoff = time.Duration(MIN_CHANNEL_RETRY_SECONDS) * time.Second
+				continue
+			}
+
+			backoff *= 2
+			if backoff > MAX_CHANNEL_RETRY_SECONDS*time.Second {
+				backoff = MAX_CHANNEL_RETRY_SECONDS * time.Second
+			}
+		}
+	}()
+}
+
+// dialChannel will open the WebSocket to FleetChannelURL via the transport
+// package so it honours ProxyURL. The handshake is signed with FleetSecret so
+// the control server knows which agent connected.
+func dialChannel() (*websocket.Conn, error) {
+
+	if !Enrolled() {
+		return nil, fmt.Errorf("This agent hasn't enrolled with the fleet server yet")
+	}
+
+	channelConfig, configErr := websocket.NewConfig(config.Cfg.FleetChannelURL, config.Cfg.FleetChannelURL)
+	if configErr != nil {
+		return nil, configErr
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	channelConfig.Header.Set(FLEET_DEVICE_HEADER, config.Cfg.DeviceId)
+	channelConfig.Header.Set(FLEET_TIMESTAMP_HEADER, timestamp)
+	channelConfig.Header.Set(FLEET_SIGNATURE_HEADER, signFleetBody(config.Cfg.FleetSecret, []byte(config.Cfg.DeviceId+"\n"+timestamp)))
+
+	host := channelConfig.Location.Hostname()
+	port := channelConfig.Location.Port()
+	if port == "" {
+		port = "80"
+		if channelConfig.Location.Scheme == "wss" {
+			port = "443"
+		}
+	}
+
+	if channelConfig.Location.Scheme != "wss" {
+		if plaintextErr := transport.CheckPlaintext(host); plaintextErr != nil {
+			return nil, plaintextErr
+		}
+	}
+
+	rawConn, dialErr := transport.Dial("tcp", net.JoinHostPort(host, port))
+	if dialErr != nil {
+		return nil, dialErr
+	}
+
+	// neither handshake can be allowed to hang the reconnect loop
+	rawConn.SetDeadline(time.Now().Add(transport.DIAL_TIMEOUT_SECONDS * time.Second))
+
+	var streamConn net.Conn = rawConn
+	if channelConfig.Location.Scheme == "wss" {
+		tlsConn := tls.Client(rawConn, transport.TLSConfig(host))
+		if handshakeErr := tlsConn.Handshake(); handshakeErr != nil {
+			rawConn.Close()
+			return nil, handshakeErr
+		}
+		streamConn = tlsConn
+	}
+
+	conn, clientErr := websocket.NewClient(channelConfig, streamConn)
+	if clientErr != nil {
+		streamConn.Close()
+		return nil, clientErr
+	}
+	rawConn.SetDeadline(time.Time{})
+
+	logger.Lgr.LogMessagef("Successfully opened the command channel to %v", config.Cfg.FleetChannelURL)
+	return conn, nil
+}
+
+// serveChannel will execute every verified command received over the given
+// connection and send its result straight back, until the connection fails.
+// A heartbeat is sent on connect and whenever the channel has been idle for
+// CHANNEL_KEEPALIVE_SECONDS so dead connections are noticed.
+func serveChannel(conn *websocket.Conn) error {
+
+	defer conn.Close()
+
+	commands := make(chan FleetCommand)
+	receiveErrs := make(chan error, 1)
+
+	go func() {
+		for 1 == 1 {
+			var command FleetCommand
+			if receiveErr := websocket.JSON.Receive(conn, &command); receiveErr != nil {
+				receiveErrs <- receiveErr
+				return
+			}
+			commands <- command
+		}
+	}()
+
+	if sendErr := sendHeartbeat(conn); sendErr != nil {
+		return sendErr
+	}
+
+	keepAlive := time.NewTicker(CHANNEL_KEEPALIVE_SECONDS * time.Second)
+	defer keepAlive.Stop()
+
+	for 1 == 1 {
+		select {
+		case receiveErr := <-receiveErrs:
+			return receiveErr
+		case <-keepAlive.C:
+			if sendErr := sendHeartbeat(conn); sendErr != nil {
+				return sendErr
+			}
+		case command := <-commands:
+			if verifyErr := verifyFleetCommand(command, time.Now()); verifyErr != nil {
+				logger.Lgr.LogErrorf("Ignoring command channel command %v: %v", command.Id, verifyErr)
+				continue
+			}
+
+			result := runFleetCommand(command)
+			if sendErr := websocket.JSON.Send(conn, ChannelMessage{Type: CHANNEL_RESULT, Result: &result}); sendErr != nil {
+				// deliver the result with the next check in instead
+				queueResult(result)
+				return sendErr
+			}
+		}
+	}
+
+	return nil
+}
+
+// sendHeartbeat will send the current state of this agent over the given
+// connection. Undelivered results stay queued for the next check in.
+func sendHeartbeat(conn *websocket.Conn) error {
+	heartbeat := currentHeartbeat()
+	heartbeat.Results = nil
+	return websocket.JSON.Send(conn, ChannelMessage{Type: CHANNEL_HEARTBEAT, Heartbeat: &heartbeat})
+}
@@ -0,0 +1,183 @@
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/transport"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The layers Diagnose can find a problem at, from the bottom up
+const DIAGNOSIS_NO_INTERFACE = "no interface"
+const DIAGNOSIS_NO_DNS = "no DNS"
+const DIAGNOSIS_NO_ROUTE = "no route"
+const DIAGNOSIS_TLS_FAILURE = "TLS failure"
+const DIAGNOSIS_ENDPOINT_DOWN = "endpoint down"
+const DIAGNOSIS_OK = "ok"
+
+// How long each layer of a diagnosis can take. In seconds
+const DIAGNOSIS_TIMEOUT_SECONDS = 10
+
+// Diagnosis is the lowest layer at which an endpoint couldn't be reached and
+// what went wrong there.
+type Diagnosis struct {
+	Endpoint string `json:"endpoint"`
+	Layer    string `json:"layer"`
+	Detail   string `json:"detail"`
+}
+
+// Healthy returns true if the endpoint was reached at every layer.
+func (d Diagnosis) Healthy() bool {
+	return d.Layer == DIAGNOSIS_OK
+}
+
+// String describes the diagnosis in a single line suitable for an alert.
+func (d Diagnosis) String() string {
+	if d.Detail == "" {
+		return fmt.Sprintf("%v: %v", d.Endpoint, d.Layer)
+	}
+	return fmt.Sprintf("%v: %v (%v)", d.Endpoint, d.Layer, d.Detail)
+}
+
+// Diagnose will work out why the given URL can't be reached by testing each
+// layer in turn: whether this machine has a network interface which is up,
+// whether the host name resolves, whether a connection can be opened to it,
+// whether the TLS handshake succeeds, and finally whether an HTTP endpoint
+// replies without a server error. The first layer which fails is returned and
+// logged so failure alerts can say why instead of only that something failed.
+// When ProxyURL is set host names are resolved by the proxy so the DNS layer
+// is left to the connection.
+func Diagnose(endpoint string) Diagnosis {
+
+	diagnosis := diagnose(endpoint)
+
+	if diagnosis.Healthy() {
+		logger.Lgr.LogMessagef("Successfully diagnosed %v", diagnosis)
+	} else {
+		logger.Lgr.LogErrorf("Diagnosed %v", diagnosis)
+	}
+
+	return diagnosis
+}
+
+// diagnose does the work of Diagnose without logging.
+func diagnose(endpoint string) Diagnosis {
+
+	diagnosis := Diagnosis{Endpoint: endpoint}
+
+	parsed, parseErr := url.Parse(endpoint)
+	if parseErr != nil || parsed.Hostname() == "" {
+		diagnosis.Layer = DIAGNOSIS_ENDPOINT_DOWN
+		diagnosis.Detail = fmt.Sprintf("%v isn't a URL with a host", endpoint)
+		return diagnosis
+	}
+
+	host := parsed.Hostname()
+	port := parsed.Port()
+	if port == "" {
+		port = defaultPort(parsed.Scheme)
+	}
+
+	loopback := host == "localhost" || (net.ParseIP(host) != nil && net.ParseIP(host).IsLoopback())
+
+	if !loopback {
+		if interfaceErr := checkInterfaces(); interfaceErr != nil {
+			diagnosis.Layer = DIAGNOSIS_NO_INTERFACE
+			diagnosis.Detail = interfaceErr.Error()
+			return diagnosis
+		}
+	}
+
+	if net.ParseIP(host) == nil && config.Cfg.ProxyURL == "" {
+		ctx, cancel := context.WithTimeout(context.Background(), DIAGNOSIS_TIMEOUT_SECONDS*time.Second)
+		_, lookupErr := net.DefaultResolver.LookupHost(ctx, host)
+		cancel()
+		if lookupErr != nil {
+			diagnosis.Layer = DIAGNOSIS_NO_DNS
+			diagnosis.Detail = lookupErr.Error()
+			return diagnosis
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DIAGNOSIS_TIMEOUT_SECONDS*time.Second)
+	conn, dialErr := transport.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	cancel()
+	if dialErr != nil {
+		// a refused connection means the host was reached but nothing is
+		// listening on it
+		diagnosis.Layer = DIAGNOSIS_NO_ROUTE
+		if errors.Is(dialErr, syscall.ECONNREFUSED) {
+			diagnosis.Layer = DIAGNOSIS_ENDPOINT_DOWN
+		}
+		diagnosis.Detail = dialErr.Error()
+		return diagnosis
+	}
+
+	if parsed.Scheme == "https" || parsed.Scheme == "wss" || parsed.Scheme == "mqtts" {
+		tlsConn := tls.Client(conn, transport.TLSConfig(host))
+		tlsConn.SetDeadline(time.Now().Add(DIAGNOSIS_TIMEOUT_SECONDS * time.Second))
+		if handshakeErr := tlsConn.Handshake(); handshakeErr != nil {
+			conn.Close()
+			diagnosis.Layer = DIAGNOSIS_TLS_FAILURE
+			diagnosis.Detail = handshakeErr.Error()
+			return diagnosis
+		}
+	}
+	conn.Close()
+
+	if parsed.Scheme == "http" || parsed.Scheme == "https" {
+		if _, probeErr := utils.ProbeEndpoint(transport.HTTPClient(DIAGNOSIS_TIMEOUT_SECONDS*time.Second), endpoint, 0); probeErr != nil {
+			diagnosis.Layer = DIAGNOSIS_ENDPOINT_DOWN
+			diagnosis.Detail = probeErr.Error()
+			return diagnosis
+		}
+	}
+
+	diagnosis.Layer = DIAGNOSIS_OK
+	return diagnosis
+}
+
+// checkInterfaces returns an error unless at least one network interface
+// other than loopback is up and has an address.
+func checkInterfaces() error {
+
+	interfaces, interfacesErr := net.Interfaces()
+	if interfacesErr != nil {
+		return interfacesErr
+	}
+
+	for _, networkInterface := range interfaces {
+		if networkInterface.Flags&net.FlagUp == 0 || networkInterface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if addresses, addressesErr := networkInterface.Addrs(); addressesErr == nil && len(addresses) > 0 {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("No network interface other than loopback is up with an address")
+}
+
+// defaultPort returns the port the given URL scheme connects to when the URL
+// doesn't say.
+func defaultPort(scheme string) string {
+	switch scheme {
+	case "https", "wss":
+		return "443"
+	case "mqtt":
+		return "1883"
+	case "mqtts":
+		return "8883"
+	default:
+		return "80"
+	}
+}
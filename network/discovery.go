@@ -0,0 +1,237 @@
+package network
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+// The largest announcement accepted from a peer
+const MAX_ANNOUNCEMENT_BYTES = 4096
+
+// The number of announcement intervals a peer can go quiet for before it's
+// forgotten
+const PEER_EXPIRY_INTERVALS = 3
+
+// How far a signed announcement's timestamp can be from now. In seconds
+const MAX_ANNOUNCEMENT_AGE_SECONDS = 300
+
+// Announcement is what each agent broadcasts to the other agents on its
+// network every DiscoveryIntervalSeconds. The signature is the hex
+// HMAC-SHA256 of the announcement without its signature using DiscoverySecret.
+type Announcement struct {
+	DeviceId   string `json:"deviceId"`
+	DeviceName string `json:"deviceName"`
+	Version    uint64 `json:"version"`
+	Hostname   string `json:"hostname"`
+	Time       int64  `json:"time"`
+	Signature  string `json:"signature,omitempty"`
+}
+
+// Peer is another agent found on the same network.
+type Peer struct {
+	DeviceId   string    `json:"deviceId"`
+	DeviceName string    `json:"deviceName"`
+	Version    uint64    `json:"version"`
+	Hostname   string    `json:"hostname"`
+	Address    string    `json:"address"`
+	LastSeen   time.Time `json:"lastSeen"`
+}
+
+var peersLock sync.Mutex
+var peers = make(map[string]Peer)
+
+// RunDiscovery will broadcast an Announcement on DiscoveryPort every
+// DiscoveryIntervalSeconds and listen for the announcements of other agents
+// on the same network so co-located agents know about each other. Does
+// nothing when DiscoveryPort isn't set.
+func RunDiscovery() error {
+
+	if config.Cfg.DiscoveryPort == 0 {
+		logger.Lgr.LogMessage("No DiscoveryPort configured. LAN peer discovery is disabled.")
+		return nil
+	}
+
+	conn, listenErr := net.ListenUDP("udp4", &net.UDPAddr{Port: config.Cfg.DiscoveryPort})
+	if listenErr != nil {
+		return listenErr
+	}
+
+	go listenForPeers(conn)
+
+	go func() {
+		broadcast := &net.UDPAddr{IP: net.IPv4bcast, Port: config.Cfg.DiscoveryPort}
+		for 1 == 1 {
+			if announceErr := announce(conn, broadcast); announceErr != nil {
+				logger.Lgr.LogErrorf("Failed to announce this agent on port %d: %v", config.Cfg.DiscoveryPort, announceErr)
+			}
+			time.Sleep(time.Duration(config.Cfg.DiscoveryIntervalSeconds) * time.Second)
+		}
+	}()
+
+	logger.Lgr.LogMessagef("Successfully started LAN peer discovery on port %d", config.Cfg.DiscoveryPort)
+	return nil
+}
+
+// Peers returns every agent heard from recently on the same network, ordered
+// by device name.
+func Peers() []Peer {
+
+	peersLock.Lock()
+	defer peersLock.Unlock()
+
+	expiry := time.Duration(PEER_EXPIRY_INTERVALS*config.Cfg.DiscoveryIntervalSeconds) * time.Second
+
+	var recent []Peer
+	for id, peer := range peers {
+		if time.Since(peer.LastSeen) > expiry {
+			delete(peers, id)
+			continue
+		}
+		recent = append(recent, peer)
+	}
+
+	sort.Slice(recent, func(i, j int) bool {
+		if recent[i].DeviceName == recent[j].DeviceName {
+			return recent[i].DeviceId < recent[j].DeviceId
+		}
+		return recent[i].DeviceName < recent[j].DeviceName
+	})
+
+	return recent
+}
+
+// SiteSummary lists the agents co-located with this one for the status
+// report. Peers running a newer version are flagged since they can share
+// their update.
+func SiteSummary() (string, error) {
+
+	recent := Peers()
+	if len(recent) == 0 {
+		return "no other agents found on this network\n", nil
+	}
+
+	var summary bytes.Buffer
+	for _, peer := range recent {
+		fmt.Fprintf(&summary, "%v (%v) at %v version %d, last seen %v", peer.DeviceName, peer.DeviceId, peer.Address, peer.Version, peer.LastSeen.Format(time.RFC1123))
+		if peer.Version > config.Cfg.LocalVersion {
+			summary.WriteString(" [newer version]")
+		}
+		summary.WriteString("\n")
+	}
+
+	return summary.String(), nil
+}
+
+// announce will send the announcement of this agent to the given address.
+func announce(conn *net.UDPConn, to *net.UDPAddr) error {
+
+	hostname, _ := os.Hostname()
+
+	announcement := Announcement{
+		DeviceId:   config.Cfg.DeviceId,
+		DeviceName: config.Cfg.DeviceName,
+		Version:    config.Cfg.LocalVersion,
+		Hostname:   hostname,
+		Time:       time.Now().Unix(),
+	}
+	announcement.Signature = signAnnouncement(config.Cfg.DiscoverySecret, announcement)
+
+	announcementBytes, jsonErr := json.Marshal(announcement)
+	if jsonErr != nil {
+		return jsonErr
+	}
+
+	_, writeErr := conn.WriteToUDP(announcementBytes, to)
+	return writeErr
+}
+
+// listenForPeers will record every valid announcement received on the given
+// connection until it's closed.
+func listenForPeers(conn *net.UDPConn) {
+
+	buffer := make([]byte, MAX_ANNOUNCEMENT_BYTES)
+
+	for 1 == 1 {
+		count, from, readErr := conn.ReadFromUDP(buffer)
+		if readErr != nil {
+			logger.Lgr.LogErrorf("Stopped listening for peers: %v", readErr)
+			return
+		}
+
+		if recordErr := recordAnnouncement(buffer[:count], from, time.Now()); recordErr != nil {
+			logger.Lgr.LogMessagef("Ignoring announcement from %v: %v", from, recordErr)
+		}
+	}
+}
+
+// recordAnnouncement will remember the peer which sent the given
+// announcement. Announcements from this agent are ignored. When
+// DiscoverySecret is set, announcements with bad signatures or more than
+// MAX_ANNOUNCEMENT_AGE_SECONDS away from now are refused too.
+func recordAnnouncement(data []byte, from *net.UDPAddr, now time.Time) error {
+
+	var announcement Announcement
+	if jsonErr := json.Unmarshal(data, &announcement); jsonErr != nil {
+		return jsonErr
+	}
+
+	if announcement.DeviceId == "" || announcement.DeviceId == config.Cfg.DeviceId {
+		return fmt.Errorf("Announcement has no device id or came from this agent")
+	}
+
+	if config.Cfg.DiscoverySecret != "" {
+		expected := signAnnouncement(config.Cfg.DiscoverySecret, announcement)
+		if !hmac.Equal([]byte(expected), []byte(strings.ToLower(announcement.Signature))) {
+			return fmt.Errorf("Announcement from %v has an invalid signature", announcement.DeviceId)
+		}
+
+		age := now.Unix() - announcement.Time
+		if age > MAX_ANNOUNCEMENT_AGE_SECONDS || age < -MAX_ANNOUNCEMENT_AGE_SECONDS {
+			return fmt.Errorf("Announcement from %v has a timestamp %d seconds away from now", announcement.DeviceId, age)
+		}
+	}
+
+	peer := Peer{
+		DeviceId:   announcement.DeviceId,
+		DeviceName: announcement.DeviceName,
+		Version:    announcement.Version,
+		Hostname:   announcement.Hostname,
+		Address:    from.IP.String(),
+		LastSeen:   now,
+	}
+
+	peersLock.Lock()
+	_, known := peers[peer.DeviceId]
+	peers[peer.DeviceId] = peer
+	peersLock.Unlock()
+
+	if !known {
+		logger.Lgr.LogMessagef("Successfully discovered peer %v (%v) at %v running version %d", peer.DeviceName, peer.DeviceId, peer.Address, peer.Version)
+	}
+
+	return nil
+}
+
+// signAnnouncement returns the hex HMAC-SHA256 of the given announcement
+// without its signature. Returns an empty signature when there's no secret.
+func signAnnouncement(secret string, announcement Announcement) string {
+
+	if secret == "" {
+		return ""
+	}
+
+	announcement.Signature = ""
+	unsigned, _ := json.Marshal(announcement)
+	return signFleetBody(secret, unsigned)
+}
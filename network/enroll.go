@@ -0,0 +1,128 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/state"
+	"github.com/seantcanavan/anon-eth-net/transport"
+)
+
+// The key within FLEET_BUCKET the time this agent enrolled is saved under
+const ENROLLED_KEY = "enrolled"
+
+// EnrollRequest is what an agent POSTs to the FleetEnrollURL to exchange its
+// DeviceId and FleetRegistrationToken for its own FleetSecret.
+type EnrollRequest struct {
+	DeviceId          string `json:"deviceId"`
+	DeviceName        string `json:"deviceName"`
+	Hostname          string `json:"hostname"`
+	Version           uint64 `json:"version"`
+	Time              int64  `json:"time"`
+	RegistrationToken string `json:"registrationToken"`
+}
+
+// EnrollResponse is what the fleet server replies to an enrollment with. The
+// secret becomes the FleetSecret of the agent which enrolled.
+type EnrollResponse struct {
+	Secret string `json:"secret"`
+}
+
+// Enrolled returns whether this agent has a FleetSecret to sign heartbeats
+// and verify commands with, either set in the config or obtained by enrolling.
+func Enrolled() bool {
+	return config.Cfg.FleetSecret != ""
+}
+
+// Enroll will exchange the DeviceId and FleetRegistrationToken for this
+// agent's own FleetSecret at the FleetEnrollURL. The secret is saved to the
+// config and the token, which the fleet server only accepts once, is cleared.
+func Enroll() error {
+
+	if config.Cfg.FleetRegistrationToken == "" {
+		return fmt.Errorf("Cannot enroll with the fleet server without a FleetRegistrationToken")
+	}
+
+	hostname, _ := os.Hostname()
+	enrollment := EnrollRequest{
+		DeviceId:          config.Cfg.DeviceId,
+		DeviceName:        config.Cfg.DeviceName,
+		Hostname:          hostname,
+		Version:           config.Cfg.LocalVersion,
+		Time:              time.Now().Unix(),
+		RegistrationToken: config.Cfg.FleetRegistrationToken,
+	}
+
+	body, jsonErr := json.Marshal(enrollment)
+	if jsonErr != nil {
+		return jsonErr
+	}
+
+	var responseBytes []byte
+	endpoint, failoverErr := transport.Failover(config.Cfg.FleetEnrollURL, func(enrollURL string) error {
+		var postErr error
+		responseBytes, postErr = postEnrollment(enrollURL, body)
+		return postErr
+	})
+	if failoverErr != nil {
+		return failoverErr
+	}
+
+	var reply EnrollResponse
+	if jsonErr := json.Unmarshal(responseBytes, &reply); jsonErr != nil {
+		return fmt.Errorf("Unable to read the reply from %v: %v", endpoint, jsonErr)
+	}
+
+	if reply.Secret == "" {
+		return fmt.Errorf("The fleet server %v didn't reply with a secret", endpoint)
+	}
+
+	credentials, jsonErr := json.Marshal(map[string]string{"FleetSecret": reply.Secret, "FleetRegistrationToken": ""})
+	if jsonErr != nil {
+		return jsonErr
+	}
+
+	if applyErr := config.Apply(credentials); applyErr != nil {
+		return fmt.Errorf("Enrolled with %v but couldn't save the FleetSecret: %v", endpoint, applyErr)
+	}
+
+	if saveErr := state.Put(FLEET_BUCKET, ENROLLED_KEY, time.Now()); saveErr != nil {
+		logger.Lgr.LogErrorf("Unable to save the time this agent enrolled: %v", saveErr)
+	}
+
+	logger.Lgr.LogMessagef("Successfully enrolled %v with the fleet server %v", config.Cfg.DeviceId, endpoint)
+	return nil
+}
+
+// postEnrollment will POST the given enrollment to the given URL and return
+// the reply.
+func postEnrollment(enrollURL string, body []byte) ([]byte, error) {
+
+	request, requestErr := http.NewRequest("POST", enrollURL, bytes.NewReader(body))
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(FLEET_DEVICE_HEADER, config.Cfg.DeviceId)
+
+	response, postErr := fleetClient().Do(request)
+	if postErr != nil {
+		return nil, postErr
+	}
+	defer response.Body.Close()
+
+	if statusErr := transport.CheckStatus(response); statusErr != nil {
+		return nil, statusErr
+	}
+
+	return ioutil.ReadAll(io.LimitReader(response.Body, MAX_FLEET_RESPONSE_BYTES))
+}
@@ -0,0 +1,487 @@
+package network
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/inbox"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/profiler"
+	"github.com/seantcanavan/anon-eth-net/reporter"
+	"github.com/seantcanavan/anon-eth-net/state"
+	"github.com/seantcanavan/anon-eth-net/transport"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The header holding the hex HMAC-SHA256 of the heartbeat body
+const FLEET_SIGNATURE_HEADER = "X-Fleet-Signature"
+
+// The header holding the id of the device checking in
+const FLEET_DEVICE_HEADER = "X-Fleet-Device-Id"
+
+// How long a single check in with the fleet server can take. In seconds
+const FLEET_TIMEOUT_SECONDS = 30
+
+// The name the requests to the fleet server are counted under
+const FLEET_CLIENT = "fleet"
+
+// The largest response accepted from the fleet server
+const MAX_FLEET_RESPONSE_BYTES = 1024 * 1024
+
+// The most output of a single command which is reported back to the fleet server
+const MAX_FLEET_OUTPUT_BYTES = 64 * 1024
+
+// The most heartbeats recorded while offline which are kept for delivery. The
+// oldest are dropped first
+const MAX_FLEET_BACKLOG = 288
+
+// The state bucket the fleet backlog and the time of the last check in are
+// saved in
+const FLEET_BUCKET = "fleet"
+
+// The keys within FLEET_BUCKET
+const FLEET_BACKLOG_KEY = "backlog"
+const LAST_CHECK_IN_KEY = "lastCheckIn"
+
+// Heartbeat is the signed summary every agent POSTs to the fleet server on each
+// check in. It also carries the results of the commands pulled back on the
+// previous check in, and the heartbeats recorded while the agent was offline,
+// oldest first.
+type Heartbeat struct {
+	DeviceId      string             `json:"deviceId"`
+	DeviceName    string             `json:"deviceName"`
+	Version       uint64             `json:"version"`
+	Time          int64              `json:"time"`
+	Metrics       map[string]float64 `json:"metrics"`
+	PendingAlerts []Alert            `json:"pendingAlerts"`
+	Results       []CommandResult    `json:"results"`
+	Backlog       []Heartbeat        `json:"backlog,omitempty"`
+}
+
+// Alert is a critical notification which hasn't been acknowledged yet.
+type Alert struct {
+	Id       string `json:"id"`
+	Severity string `json:"severity"`
+	Subject  string `json:"subject"`
+}
+
+// FleetCommand is a single command queued for this agent on the fleet server.
+// The signature is the value returned by SignFleetCommand using FleetSecret.
+type FleetCommand struct {
+	Id        string   `json:"id"`
+	Command   string   `json:"command"`
+	Args      []string `json:"args"`
+	Timestamp int64    `json:"timestamp"`
+	Signature string   `json:"signature"`
+}
+
+// CommandResult is the outcome of a single FleetCommand.
+type CommandResult struct {
+	Id      string `json:"id"`
+	Command string `json:"command"`
+	Output  string `json:"output"`
+	Error   string `json:"error,omitempty"`
+}
+
+// fleetResponse is the body the fleet server replies to a heartbeat with.
+type fleetResponse struct {
+	Commands []FleetCommand `json:"commands"`
+}
+
+// fleetBacklog is everything waiting to be delivered to the fleet server. It's
+// saved in the state store so nothing is lost if the agent restarts during an
+// outage.
+type fleetBacklog struct {
+	Heartbeats []Heartbeat     `json:"heartbeats"`
+	Results    []CommandResult `json:"results"`
+}
+
+var fleetLock sync.Mutex
+var pendingResults []CommandResult
+var offlineHeartbeats []Heartbeat
+var executedCommands = make(map[string]time.Time)
+
+var injectedFleetClient transport.Doer
+var fleetClientLock sync.Mutex
+
+// RunCheckIns will check in with the fleet server every FleetCheckInSeconds,
+// enrolling first with the FleetRegistrationToken if there's no FleetSecret.
+// After any commands are executed it checks in again straight away so their
+// results are delivered and further queued commands are pulled. While offline
+// a heartbeat is recorded instead of each check in and they're all delivered,
+// in order, as soon as connectivity returns. Does nothing when FleetServerURL
+// isn't set. Check ins are skipped while they're turned off under Subsystems in
+// the config.
+func RunCheckIns() {
+
+	if len(config.Cfg.FleetServerURL) == 0 {
+		logger.Lgr.LogMessage("No FleetServerURL configured. Fleet check ins are disabled.")
+		return
+	}
+
+	loadFleetBacklog()
+
+	go func() {
+		for 1 == 1 {
+			executed := 0
+
+			if !config.Enabled(config.SUBSYSTEM_CHECKIN) {
+				logger.Lgr.LogMessage("Fleet check ins are turned off in the config. Skipping the check in")
+			} else {
+				if transport.Online() && !Enrolled() {
+					if enrollErr := Enroll(); enrollErr != nil {
+						logger.Lgr.LogErrorf("Failed to enroll with the fleet server: %v. Diagnosis: %v", enrollErr, Diagnose(config.Cfg.FleetEnrollURL.Primary()))
+					}
+				}
+
+				if transport.Online() && Enrolled() {
+					var checkInErr error
+					executed, checkInErr = CheckIn()
+					if checkInErr != nil {
+						logger.Lgr.LogErrorf("Failed to check in with the fleet server: %v. Diagnosis: %v", checkInErr, Diagnose(config.Cfg.FleetServerURL.Primary()))
+					}
+				}
+
+				if !transport.Online() {
+					recordOfflineHeartbeat()
+				}
+			}
+
+			if executed == 0 {
+				select {
+				case <-time.After(time.Duration(config.Cfg.FleetCheckInSeconds) * time.Second):
+				case <-transport.Reconnected():
+				}
+			}
+		}
+	}()
+}
+
+// CheckIn will POST a signed heartbeat to the fleet server and execute every
+// verified command it replies with. Returns how many commands were executed.
+// Their results are sent with the next heartbeat.
+func CheckIn() (int, error) {
+
+	heartbeat := currentHeartbeat()
+
+	fleetLock.Lock()
+	heartbeat.Backlog = append([]Heartbeat{}, offlineHeartbeats...)
+	fleetLock.Unlock()
+
+	body, jsonErr := json.Marshal(heartbeat)
+	if jsonErr != nil {
+		return 0, jsonErr
+	}
+
+	var responseBytes []byte
+	endpoint, failoverErr := transport.Failover(config.Cfg.FleetServerURL, func(fleetServerURL string) error {
+		var postErr error
+		responseBytes, postErr = postHeartbeat(fleetServerURL, body)
+		return postErr
+	})
+	if failoverErr != nil {
+		return 0, failoverErr
+	}
+
+	// the results and backlog made it to the fleet server so they don't need
+	// sending again
+	acknowledgeResults(len(heartbeat.Results), len(heartbeat.Backlog))
+
+	if saveErr := state.Put(FLEET_BUCKET, LAST_CHECK_IN_KEY, time.Now()); saveErr != nil {
+		logger.Lgr.LogErrorf("Unable to save the time of the last check in: %v", saveErr)
+	}
+
+	var reply fleetResponse
+	if len(bytes.TrimSpace(responseBytes)) > 0 {
+		if jsonErr := json.Unmarshal(responseBytes, &reply); jsonErr != nil {
+			return 0, jsonErr
+		}
+	}
+
+	logger.Lgr.LogMessagef("Successfully checked in with the fleet server %v and received %d commands", endpoint, len(reply.Commands))
+
+	executed := 0
+	for _, command := range reply.Commands {
+		if verifyErr := verifyFleetCommand(command, time.Now()); verifyErr != nil {
+			logger.Lgr.LogErrorf("Ignoring fleet command %v: %v", command.Id, verifyErr)
+			continue
+		}
+
+		executeFleetCommand(command)
+		executed++
+	}
+
+	return executed, nil
+}
+
+// SetFleetClient will make check ins and enrollment reach the fleet server with
+// the given client. Passing nil goes back to a client made by
+// transport.NewClient with a timeout of FLEET_TIMEOUT_SECONDS.
+func SetFleetClient(client transport.Doer) {
+	fleetClientLock.Lock()
+	defer fleetClientLock.Unlock()
+	injectedFleetClient = client
+}
+
+// fleetClient returns the client given to SetFleetClient or a new one.
+func fleetClient() transport.Doer {
+	fleetClientLock.Lock()
+	defer fleetClientLock.Unlock()
+	if injectedFleetClient == nil {
+		return transport.NewClient(FLEET_CLIENT, FLEET_TIMEOUT_SECONDS*time.Second, 0)
+	}
+	return injectedFleetClient
+}
+
+// postHeartbeat will POST the given signed heartbeat to the given fleet server
+// and return its reply.
+func postHeartbeat(fleetServerURL string, body []byte) ([]byte, error) {
+
+	request, requestErr := http.NewRequest("POST", fleetServerURL, bytes.NewReader(body))
+	if requestErr != nil {
+		return nil, requestErr
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(FLEET_DEVICE_HEADER, config.Cfg.DeviceId)
+	request.Header.Set(FLEET_SIGNATURE_HEADER, signFleetBody(config.Cfg.FleetSecret, body))
+
+	response, postErr := fleetClient().Do(request)
+	if postErr != nil {
+		return nil, postErr
+	}
+	defer response.Body.Close()
+
+	if statusErr := transport.CheckStatus(response); statusErr != nil {
+		return nil, statusErr
+	}
+
+	return ioutil.ReadAll(io.LimitReader(response.Body, MAX_FLEET_RESPONSE_BYTES))
+}
+
+// SignFleetCommand returns the hex encoded HMAC-SHA256 of the command id,
+// name, timestamp and args, encoded by utils.SigningArgs, joined by newlines
+// using the given secret. The fleet server must sign every queued command
+// with it.
+func SignFleetCommand(secret string, id string, name string, timestamp int64, args []string) string {
+	return signFleetBody(secret, []byte(id+"\n"+name+"\n"+strconv.FormatInt(timestamp, 10)+"\n"+utils.SigningArgs(args)))
+}
+
+// signFleetBody returns the hex encoded HMAC-SHA256 of the given bytes using
+// the given secret.
+func signFleetBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// currentHeartbeat will gather the latest state of this agent along with the
+// results which haven't been delivered yet.
+func currentHeartbeat() Heartbeat {
+
+	heartbeat := Heartbeat{
+		DeviceId:      config.Cfg.DeviceId,
+		DeviceName:    config.Cfg.DeviceName,
+		Version:       config.Cfg.LocalVersion,
+		Time:          time.Now().Unix(),
+		Metrics:       make(map[string]float64),
+		PendingAlerts: []Alert{},
+	}
+
+	if samples := profiler.Samples(); len(samples) > 0 {
+		heartbeat.Metrics = samples[len(samples)-1].Metrics
+	}
+
+	for _, notification := range reporter.PendingAcknowledgements() {
+		heartbeat.PendingAlerts = append(heartbeat.PendingAlerts, Alert{Id: notification.Id, Severity: notification.Severity.String(), Subject: notification.Subject})
+	}
+
+	fleetLock.Lock()
+	heartbeat.Results = append([]CommandResult{}, pendingResults...)
+	fleetLock.Unlock()
+
+	return heartbeat
+}
+
+// acknowledgeResults will drop the given number of the oldest pending results
+// and offline heartbeats once the fleet server has received them.
+func acknowledgeResults(results int, heartbeats int) {
+	fleetLock.Lock()
+	defer fleetLock.Unlock()
+
+	pendingResults = pendingResults[results:]
+	offlineHeartbeats = offlineHeartbeats[heartbeats:]
+
+	if results > 0 || heartbeats > 0 {
+		saveFleetBacklog()
+	}
+}
+
+// queueResult will hold on to the result of a command until it's delivered to
+// the fleet server.
+func queueResult(result CommandResult) {
+	fleetLock.Lock()
+	defer fleetLock.Unlock()
+
+	pendingResults = append(pendingResults, result)
+	saveFleetBacklog()
+}
+
+// recordOfflineHeartbeat will hold on to the current state of this agent while
+// it's offline so the fleet server gets the full history once it's back.
+func recordOfflineHeartbeat() {
+
+	heartbeat := currentHeartbeat()
+	heartbeat.Results = nil
+
+	fleetLock.Lock()
+	defer fleetLock.Unlock()
+
+	offlineHeartbeats = append(offlineHeartbeats, heartbeat)
+	if len(offlineHeartbeats) > MAX_FLEET_BACKLOG {
+		offlineHeartbeats = offlineHeartbeats[len(offlineHeartbeats)-MAX_FLEET_BACKLOG:]
+	}
+
+	saveFleetBacklog()
+	logger.Lgr.LogMessagef("Offline for %v. Recorded heartbeat %d for the fleet server", transport.OutageDuration(), len(offlineHeartbeats))
+}
+
+// saveFleetBacklog will save the undelivered heartbeats and results in the
+// state store. The caller must hold fleetLock.
+func saveFleetBacklog() {
+
+	backlog := fleetBacklog{Heartbeats: offlineHeartbeats, Results: pendingResults}
+	if saveErr := state.Put(FLEET_BUCKET, FLEET_BACKLOG_KEY, backlog); saveErr != nil {
+		logger.Lgr.LogErrorf("Unable to save the fleet backlog: %v", saveErr)
+	}
+}
+
+// loadFleetBacklog will pick up the heartbeats and results which weren't
+// delivered before the agent last stopped.
+func loadFleetBacklog() {
+
+	var backlog fleetBacklog
+	found, loadErr := state.Get(FLEET_BUCKET, FLEET_BACKLOG_KEY, &backlog)
+	if loadErr != nil {
+		logger.Lgr.LogErrorf("Discarding unreadable fleet backlog: %v", loadErr)
+		return
+	}
+	if !found {
+		return
+	}
+
+	fleetLock.Lock()
+	defer fleetLock.Unlock()
+
+	offlineHeartbeats = append(backlog.Heartbeats, offlineHeartbeats...)
+	pendingResults = append(backlog.Results, pendingResults...)
+
+	logger.Lgr.LogMessagef("Successfully loaded %d heartbeats and %d results waiting for the fleet server", len(backlog.Heartbeats), len(backlog.Results))
+}
+
+// FleetSummary describes when this agent last checked in with the fleet
+// server and what's waiting to be delivered to it.
+func FleetSummary() (string, error) {
+
+	if len(config.Cfg.FleetServerURL) == 0 {
+		return "No FleetServerURL configured\n", nil
+	}
+
+	var summary bytes.Buffer
+	summary.WriteString(fmt.Sprintf("Agent ID: %v\n", config.Cfg.DeviceId))
+
+	var enrolled time.Time
+	if found, _ := state.Get(FLEET_BUCKET, ENROLLED_KEY, &enrolled); found {
+		summary.WriteString(fmt.Sprintf("Enrolled at %v\n", enrolled.Format(time.RFC3339)))
+	} else if !Enrolled() {
+		summary.WriteString("Waiting to enroll\n")
+	}
+
+	var lastCheckIn time.Time
+	if found, _ := state.Get(FLEET_BUCKET, LAST_CHECK_IN_KEY, &lastCheckIn); found {
+		summary.WriteString(fmt.Sprintf("Last checked in %v ago at %v\n", time.Since(lastCheckIn).Round(time.Second), lastCheckIn.Format(time.RFC3339)))
+	} else {
+		summary.WriteString("Never checked in\n")
+	}
+
+	fleetLock.Lock()
+	summary.WriteString(fmt.Sprintf("%d heartbeats and %d command results waiting to be delivered\n", len(offlineHeartbeats), len(pendingResults)))
+	fleetLock.Unlock()
+
+	return summary.String(), nil
+}
+
+// verifyFleetCommand will make sure the command was signed with FleetSecret,
+// isn't more than inbox.MAX_COMMAND_AGE_SECONDS away from now, and hasn't
+// already been executed, so commands can't be forged or replayed.
+func verifyFleetCommand(command FleetCommand, now time.Time) error {
+
+	// anyone could sign a command with an empty secret
+	if !Enrolled() {
+		return fmt.Errorf("Command %v can't be verified until this agent has enrolled", command.Command)
+	}
+
+	expected := SignFleetCommand(config.Cfg.FleetSecret, command.Id, command.Command, command.Timestamp, command.Args)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(command.Signature))) {
+		return fmt.Errorf("Command %v has an invalid signature", command.Command)
+	}
+
+	age := now.Unix() - command.Timestamp
+	if age > inbox.MAX_COMMAND_AGE_SECONDS || age < -inbox.MAX_COMMAND_AGE_SECONDS {
+		return fmt.Errorf("Command %v has a timestamp %d seconds away from now", command.Command, age)
+	}
+
+	fleetLock.Lock()
+	defer fleetLock.Unlock()
+
+	for id, executed := range executedCommands {
+		if now.Sub(executed) > 2*inbox.MAX_COMMAND_AGE_SECONDS*time.Second {
+			delete(executedCommands, id)
+		}
+	}
+
+	if _, seen := executedCommands[command.Id]; seen {
+		return fmt.Errorf("Command %v has already been executed", command.Id)
+	}
+
+	executedCommands[command.Id] = now
+	return nil
+}
+
+// executeFleetCommand will run the handler registered for the command and
+// queue its result for the next heartbeat.
+func executeFleetCommand(command FleetCommand) {
+
+	queueResult(runFleetCommand(command))
+}
+
+// runFleetCommand will run the handler registered for the command and return
+// its result.
+func runFleetCommand(command FleetCommand) CommandResult {
+
+	output, _, dispatchErr := inbox.Dispatch(command.Command, command.Args)
+	if len(output) > MAX_FLEET_OUTPUT_BYTES {
+		output = output[:MAX_FLEET_OUTPUT_BYTES]
+	}
+
+	result := CommandResult{Id: command.Id, Command: command.Command, Output: output}
+	if dispatchErr != nil {
+		result.Error = dispatchErr.Error()
+	}
+
+	logger.Lgr.LogMessagef("Executed fleet command %v %v %v", command.Id, command.Command, command.Args)
+
+	return result
+}
@@ -0,0 +1,166 @@
+package network
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/transport"
+)
+
+// The topics under MQTTTopicPrefix the agent publishes to and subscribes to
+const MQTT_ONLINE_TOPIC = "online"
+const MQTT_STATUS_TOPIC = "status"
+const MQTT_METRICS_TOPIC = "metrics"
+const MQTT_COMMANDS_TOPIC = "commands"
+const MQTT_RESULTS_TOPIC = "results"
+
+// RunMQTT will keep a connection open to MQTTBrokerURL, publishing this
+// agent's status and latest metrics every MQTTPublishSeconds and executing
+// the verified commands published to its commands topic. Fleets already
+// built around an MQTT broker can manage agents without the fleet server.
+// The connection is reopened with exponential backoff whenever it drops.
+// Does nothing when MQTTBrokerURL isn't set.
+func RunMQTT() {
+
+	if config.Cfg.MQTTBrokerURL == "" {
+		logger.Lgr.LogMessage("No MQTTBrokerURL configured. MQTT is disabled.")
+		return
+	}
+
+	go func() {
+		backoff := time.Duration(MIN_CHANNEL_RETRY_SECONDS) * time.Second
+
+		for 1 == 1 {
+			client, dialErr := dialMQTT(config.Cfg.MQTTBrokerURL, config.Cfg.DeviceId, mqttTopic(MQTT_ONLINE_TOPIC), []byte("false"))
+			if dialErr == nil {
+				logger.Lgr.LogMessagef("Successfully connected to the MQTT broker %v", config.Cfg.MQTTBrokerURL)
+				backoff = time.Duration(MIN_CHANNEL_RETRY_SECONDS) * time.Second
+				serveErr := serveMQTT(client)
+				logger.Lgr.LogErrorf("The connection to the MQTT broker %v closed: %v", config.Cfg.MQTTBrokerURL, serveErr)
+			} else {
+				logger.Lgr.LogErrorf("Failed to connect to the MQTT broker %v: %v", config.Cfg.MQTTBrokerURL, dialErr)
+			}
+
+			logger.Lgr.LogMessagef("Reconnecting to the MQTT broker in %v", backoff)
+			select {
+			case <-time.After(backoff):
+			case <-transport.Reconnected():
+				backoff = time.Duration(MIN_CHANNEL_RETRY_SECONDS) * time.Second
+				continue
+			}
+
+			backoff *= 2
+			if backoff > MAX_CHANNEL_RETRY_SECONDS*time.Second {
+				backoff = MAX_CHANNEL_RETRY_SECONDS * time.Second
+			}
+		}
+	}()
+}
+
+// serveMQTT will publish telemetry and execute commands over the given
+// connection until it fails.
+func serveMQTT(client *mqttClient) error {
+
+	defer client.disconnect()
+
+	if publishErr := client.publish(mqttTopic(MQTT_ONLINE_TOPIC), []byte("true"), true); publishErr != nil {
+		return publishErr
+	}
+
+	if subscribeErr := client.subscribe(mqttTopic(MQTT_COMMANDS_TOPIC)); subscribeErr != nil {
+		return subscribeErr
+	}
+
+	messages := make(chan mqttMessage)
+	receiveErrs := make(chan error, 1)
+
+	go func() {
+		for 1 == 1 {
+			message, receiveErr := client.receive()
+			if receiveErr != nil {
+				receiveErrs <- receiveErr
+				return
+			}
+			messages <- message
+		}
+	}()
+
+	if publishErr := publishTelemetry(client); publishErr != nil {
+		return publishErr
+	}
+
+	telemetry := time.NewTicker(time.Duration(config.Cfg.MQTTPublishSeconds) * time.Second)
+	defer telemetry.Stop()
+
+	keepAlive := time.NewTicker(MQTT_KEEPALIVE_SECONDS / 2 * time.Second)
+	defer keepAlive.Stop()
+
+	for 1 == 1 {
+		select {
+		case receiveErr := <-receiveErrs:
+			return receiveErr
+		case <-keepAlive.C:
+			if pingErr := client.ping(); pingErr != nil {
+				return pingErr
+			}
+		case <-telemetry.C:
+			if publishErr := publishTelemetry(client); publishErr != nil {
+				return publishErr
+			}
+		case message := <-messages:
+			var command FleetCommand
+			if jsonErr := json.Unmarshal(message.Payload, &command); jsonErr != nil {
+				logger.Lgr.LogErrorf("Ignoring unreadable MQTT command on %v: %v", message.Topic, jsonErr)
+				continue
+			}
+
+			if verifyErr := verifyFleetCommand(command, time.Now()); verifyErr != nil {
+				logger.Lgr.LogErrorf("Ignoring MQTT command %v: %v", command.Id, verifyErr)
+				continue
+			}
+
+			resultBytes, jsonErr := json.Marshal(runFleetCommand(command))
+			if jsonErr != nil {
+				logger.Lgr.LogErrorf("Unable to encode the result of MQTT command %v: %v", command.Id, jsonErr)
+				continue
+			}
+
+			if publishErr := client.publish(mqttTopic(MQTT_RESULTS_TOPIC), resultBytes, false); publishErr != nil {
+				return publishErr
+			}
+		}
+	}
+
+	return nil
+}
+
+// publishTelemetry will publish the current heartbeat, retained, to the status
+// topic and the latest metrics to the metrics topic.
+func publishTelemetry(client *mqttClient) error {
+
+	heartbeat := currentHeartbeat()
+	heartbeat.Results = nil
+
+	statusBytes, jsonErr := json.Marshal(heartbeat)
+	if jsonErr != nil {
+		return jsonErr
+	}
+
+	if publishErr := client.publish(mqttTopic(MQTT_STATUS_TOPIC), statusBytes, true); publishErr != nil {
+		return publishErr
+	}
+
+	metricsBytes, jsonErr := json.Marshal(heartbeat.Metrics)
+	if jsonErr != nil {
+		return jsonErr
+	}
+
+	return client.publish(mqttTopic(MQTT_METRICS_TOPIC), metricsBytes, false)
+}
+
+// mqttTopic returns the full name of the given topic under MQTTTopicPrefix.
+func mqttTopic(name string) string {
+	return config.Cfg.MQTTTopicPrefix + "/" + name
+}
@@ -0,0 +1,277 @@
+package network
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/transport"
+)
+
+// The MQTT control packet types this client sends or understands
+const MQTT_CONNECT = 1
+const MQTT_CONNACK = 2
+const MQTT_PUBLISH = 3
+const MQTT_SUBSCRIBE = 8
+const MQTT_SUBACK = 9
+const MQTT_PINGREQ = 12
+const MQTT_PINGRESP = 13
+const MQTT_DISCONNECT = 14
+
+// The keep alive interval negotiated with the broker. In seconds
+const MQTT_KEEPALIVE_SECONDS = 60
+
+// How long to wait on the broker to accept a connection. In seconds
+const MQTT_TIMEOUT_SECONDS = 30
+
+// The largest packet accepted from the broker
+const MAX_MQTT_PACKET_BYTES = 256 * 1024
+
+// mqttClient is a deliberately tiny MQTT 3.1.1 client which only supports
+// what the agent needs: connecting with credentials and a last will,
+// publishing and subscribing at QoS 0, and keeping the connection alive.
+type mqttClient struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeLock sync.Mutex
+	packetId  uint16
+}
+
+// mqttMessage is a single PUBLISH received from the broker.
+type mqttMessage struct {
+	Topic   string
+	Payload []byte
+}
+
+// dialMQTT will connect to the broker at the given mqtt:// or mqtts:// URL
+// via the transport package. Credentials are taken from the URL. The will
+// message is published, retained, by the broker if the connection drops.
+func dialMQTT(brokerURL string, clientId string, willTopic string, willMessage []byte) (*mqttClient, error) {
+
+	broker, parseErr := url.Parse(brokerURL)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+
+	port := broker.Port()
+	if port == "" {
+		port = "1883"
+		if broker.Scheme == "mqtts" {
+			port = "8883"
+		}
+	}
+
+	if broker.Scheme != "mqtts" {
+		if plaintextErr := transport.CheckPlaintext(broker.Hostname()); plaintextErr != nil {
+			return nil, plaintextErr
+		}
+	}
+
+	rawConn, dialErr := transport.Dial("tcp", net.JoinHostPort(broker.Hostname(), port))
+	if dialErr != nil {
+		return nil, dialErr
+	}
+
+	conn := rawConn
+	if broker.Scheme == "mqtts" {
+		conn = tls.Client(rawConn, transport.TLSConfig(broker.Hostname()))
+	}
+
+	client := &mqttClient{conn: conn, reader: bufio.NewReader(conn)}
+
+	var flags byte = 0x02 // clean session
+	var payload []byte
+	payload = appendMQTTString(payload, []byte(clientId))
+
+	if willTopic != "" {
+		flags |= 0x04 | 0x20 // will flag and will retain
+		payload = appendMQTTString(payload, []byte(willTopic))
+		payload = appendMQTTString(payload, willMessage)
+	}
+
+	if broker.User != nil {
+		flags |= 0x80
+		payload = appendMQTTString(payload, []byte(broker.User.Username()))
+		if password, set := broker.User.Password(); set {
+			flags |= 0x40
+			payload = appendMQTTString(payload, []byte(password))
+		}
+	}
+
+	variable := appendMQTTString(nil, []byte("MQTT"))
+	variable = append(variable, 4, flags, MQTT_KEEPALIVE_SECONDS>>8, MQTT_KEEPALIVE_SECONDS&0xff)
+
+	conn.SetDeadline(time.Now().Add(MQTT_TIMEOUT_SECONDS * time.Second))
+
+	if writeErr := client.writePacket(MQTT_CONNECT<<4, append(variable, payload...)); writeErr != nil {
+		conn.Close()
+		return nil, writeErr
+	}
+
+	packetType, body, readErr := client.readPacket()
+	if readErr != nil {
+		conn.Close()
+		return nil, readErr
+	}
+
+	if packetType != MQTT_CONNACK || len(body) != 2 {
+		conn.Close()
+		return nil, fmt.Errorf("Expected a CONNACK from the MQTT broker, got packet type %d", packetType)
+	}
+
+	if body[1] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("The MQTT broker refused the connection with return code %d", body[1])
+	}
+
+	conn.SetDeadline(time.Time{})
+	return client, nil
+}
+
+// publish will send the given payload to the given topic at QoS 0.
+func (mc *mqttClient) publish(topic string, payload []byte, retain bool) error {
+
+	var header byte = MQTT_PUBLISH << 4
+	if retain {
+		header |= 0x01
+	}
+
+	return mc.writePacket(header, append(appendMQTTString(nil, []byte(topic)), payload...))
+}
+
+// subscribe will ask the broker for every message sent to the given topic at
+// QoS 0. The SUBACK arrives through receive.
+func (mc *mqttClient) subscribe(topic string) error {
+
+	mc.writeLock.Lock()
+	mc.packetId++
+	packetId := mc.packetId
+	mc.writeLock.Unlock()
+
+	body := []byte{byte(packetId >> 8), byte(packetId)}
+	body = appendMQTTString(body, []byte(topic))
+	body = append(body, 0)
+
+	return mc.writePacket(MQTT_SUBSCRIBE<<4|0x02, body)
+}
+
+// ping will tell the broker this client is still alive.
+func (mc *mqttClient) ping() error {
+	return mc.writePacket(MQTT_PINGREQ<<4, nil)
+}
+
+// disconnect will tell the broker this client is going away cleanly, so the
+// will message isn't published, and close the connection.
+func (mc *mqttClient) disconnect() {
+	mc.writePacket(MQTT_DISCONNECT<<4, nil)
+	mc.conn.Close()
+}
+
+// receive will return the next message published to a subscribed topic.
+// Acknowledgements and ping responses are consumed along the way. The broker
+// is considered gone if nothing arrives within one and a half keep alive
+// intervals.
+func (mc *mqttClient) receive() (mqttMessage, error) {
+
+	for {
+		mc.conn.SetReadDeadline(time.Now().Add(MQTT_KEEPALIVE_SECONDS * 3 / 2 * time.Second))
+
+		packetType, body, readErr := mc.readPacket()
+		if readErr != nil {
+			return mqttMessage{}, readErr
+		}
+
+		switch packetType {
+		case MQTT_PUBLISH:
+			if len(body) < 2 {
+				return mqttMessage{}, fmt.Errorf("Received a truncated PUBLISH from the MQTT broker")
+			}
+			topicLength := int(binary.BigEndian.Uint16(body))
+			if len(body) < 2+topicLength {
+				return mqttMessage{}, fmt.Errorf("Received a truncated PUBLISH from the MQTT broker")
+			}
+			return mqttMessage{Topic: string(body[2 : 2+topicLength]), Payload: body[2+topicLength:]}, nil
+		case MQTT_SUBACK:
+			if len(body) == 3 && body[2] == 0x80 {
+				return mqttMessage{}, fmt.Errorf("The MQTT broker refused the subscription")
+			}
+		case MQTT_PINGRESP:
+		default:
+			return mqttMessage{}, fmt.Errorf("Received unexpected packet type %d from the MQTT broker", packetType)
+		}
+	}
+}
+
+// writePacket will send a single control packet with the given first header
+// byte and body.
+func (mc *mqttClient) writePacket(header byte, body []byte) error {
+
+	packet := []byte{header}
+	length := len(body)
+	for {
+		encoded := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			encoded |= 0x80
+		}
+		packet = append(packet, encoded)
+		if length == 0 {
+			break
+		}
+	}
+	packet = append(packet, body...)
+
+	mc.writeLock.Lock()
+	defer mc.writeLock.Unlock()
+
+	mc.conn.SetWriteDeadline(time.Now().Add(MQTT_TIMEOUT_SECONDS * time.Second))
+	_, writeErr := mc.conn.Write(packet)
+	return writeErr
+}
+
+// readPacket will read a single control packet and return its type and body.
+func (mc *mqttClient) readPacket() (byte, []byte, error) {
+
+	header, headerErr := mc.reader.ReadByte()
+	if headerErr != nil {
+		return 0, nil, headerErr
+	}
+
+	length := 0
+	for multiplier := 1; ; multiplier *= 128 {
+		encoded, lengthErr := mc.reader.ReadByte()
+		if lengthErr != nil {
+			return 0, nil, lengthErr
+		}
+		length += int(encoded&0x7f) * multiplier
+		if encoded&0x80 == 0 {
+			break
+		}
+		if multiplier > 128*128 {
+			return 0, nil, fmt.Errorf("Received a malformed packet length from the MQTT broker")
+		}
+	}
+
+	if length > MAX_MQTT_PACKET_BYTES {
+		return 0, nil, fmt.Errorf("Received a %d byte packet from the MQTT broker which is too large", length)
+	}
+
+	body := make([]byte, length)
+	if _, readErr := io.ReadFull(mc.reader, body); readErr != nil {
+		return 0, nil, readErr
+	}
+
+	return header >> 4, body, nil
+}
+
+// appendMQTTString will append the given bytes prefixed by their length.
+func appendMQTTString(packet []byte, value []byte) []byte {
+	packet = append(packet, byte(len(value)>>8), byte(len(value)))
+	return append(packet, value...)
+}
@@ -3,17 +3,22 @@ package network
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"time"
 
 	"github.com/seantcanavan/anon-eth-net/config"
 	"github.com/seantcanavan/anon-eth-net/loader"
 	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/privileged"
+	"github.com/seantcanavan/anon-eth-net/transport"
 	"github.com/seantcanavan/anon-eth-net/utils"
 )
 
+// How long a single connectivity check query can take. In seconds
+const CONNECTIVITY_TIMEOUT_SECONDS = 30
+
 type Network struct {
 	endpoints map[string]string
 }
@@ -25,14 +30,14 @@ func NewNetwork() (*Network, error) {
 		return nil, assetPathErr
 	}
 
-	logger.Lgr.LogMessage("Successfully loaded connections from file: %v", connectionAssetPath)
+	logger.Lgr.LogMessagef("Successfully loaded connections from file: %v", connectionAssetPath)
 
 	fileBytes, readErr := ioutil.ReadFile(connectionAssetPath)
 	if readErr != nil {
 		return nil, readErr
 	}
 
-	logger.Lgr.LogMessage("Successfully read connections file: %v", connectionAssetPath)
+	logger.Lgr.LogMessagef("Successfully read connections file: %v", connectionAssetPath)
 
 	loadedEndpoints := make(map[string]string)
 
@@ -41,7 +46,7 @@ func NewNetwork() (*Network, error) {
 		return nil, jsonErr
 	}
 
-	logger.Lgr.LogMessage("Successfully unmarshalled JSON endpoint data into map: %+v", loadedEndpoints)
+	logger.Lgr.LogMessagef("Successfully unmarshalled JSON endpoint data into map: %+v", loadedEndpoints)
 
 	netw := &Network{endpoints: loadedEndpoints}
 	return netw, nil
@@ -58,19 +63,21 @@ func (con *Network) IsInternetReachable() bool {
 	errorCount := 0
 	threshold := numQueries / 2
 
-	logger.Lgr.LogMessage("Checking internet connectivity with threshold: %d", threshold)
+	logger.Lgr.LogMessagef("Checking internet connectivity with threshold: %d", threshold)
+
+	client := transport.HTTPClient(CONNECTIVITY_TIMEOUT_SECONDS * time.Second)
 
 	for name, url := range con.endpoints {
 
-		result, err := http.Get(url)
+		result, err := client.Get(url)
 		if err != nil {
-			logger.Lgr.LogMessage("Error querying internet endpoint: %v at: %v received: %v", name, url, err.Error())
+			logger.Lgr.LogMessagef("Error querying internet endpoint: %v at: %v received: %v", name, url, err.Error())
 			errorCount++
 		} else {
 			defer result.Body.Close()
 			var bodyBuffer bytes.Buffer
 			_, _ = io.Copy(&bodyBuffer, result.Body)
-			logger.Lgr.LogMessage("Successfully queried internet endpoint: %v at: %v", name, url)
+			logger.Lgr.LogMessagef("Successfully queried internet endpoint: %v at: %v", name, url)
 			// if we have a good ratio of errors to non-errors, we can afford to quit
 			if !(errorCount > (numQueries / 2)) {
 				break
@@ -79,7 +86,7 @@ func (con *Network) IsInternetReachable() bool {
 	}
 
 	logger.Lgr.LogMessage("Finished querying external APIs to test internet connectivity")
-	logger.Lgr.LogMessage("Received %d errors back with a threshold of %d", errorCount, threshold)
+	logger.Lgr.LogMessagef("Received %d errors back with a threshold of %d", errorCount, threshold)
 
 	// if more than half the queries error out return false, else true
 	return !(errorCount > (numQueries / 2))
@@ -95,31 +102,65 @@ func (con *Network) Run() {
 
 			interval := config.Cfg.NetQueryFrequencySeconds
 
-			logger.Lgr.LogMessage("Network manager will sleep for %d seconds before querying the internet", interval)
+			logger.Lgr.LogMessagef("Network manager will sleep for %d seconds before querying the internet", interval)
 
 			time.Sleep(time.Duration(interval) * time.Second)
 
 			connected := con.IsInternetReachable()
 
 			if !connected {
+				transport.MarkOffline()
 				//reboot machine
+				// diagnose one of the endpoints so the logs say why before the reboot
+				for _, url := range con.endpoints {
+					Diagnose(url)
+					break
+				}
 				logger.Lgr.LogMessage("Internet is unreachable. Rebooting the machine immediately.")
-				rebootAssetPath, assetErr := utils.SysAssetPath("reboot_loader.json")
-				if assetErr != nil {
-					logger.Lgr.LogMessage("Unable to load the reboot loader asset: %v", assetErr.Error())
-				} else {
-					rebootLoader, loaderErr := loader.NewLoader(rebootAssetPath)
-					if loaderErr != nil {
-						logger.Lgr.LogMessage("Unable to instantiate new loader from asset: %v with error: %v", rebootAssetPath, loaderErr.Error())
-					} else {
-						_ = rebootLoader.StartSynchronous()
-					}
+				if rebootErr := Reboot(); rebootErr != nil {
+					logger.Lgr.LogMessagef("Unable to reboot the machine: %v", rebootErr)
 				}
 			} else {
-				logger.Lgr.LogMessage("Internet is reachable. Sleeping for %d seconds before checking again", interval)
+				transport.MarkOnline()
+				logger.Lgr.LogMessagef("Internet is reachable. Sleeping for %d seconds before checking again", interval)
 			}
 		}
 
 	}()
 
 }
+
+// Reboot will reboot the machine, asking the privileged helper to do it when
+// the agent is running under one without root.
+func Reboot() error {
+
+	if privileged.Available() {
+		_, callErr := privileged.Call(privileged.REBOOT_ACTION, nil)
+		return callErr
+	}
+
+	return RebootLocally()
+}
+
+// RebootLocally will reboot the machine by running the reboot_loader.json
+// asset for this operating system. Needs root.
+func RebootLocally() error {
+
+	rebootAssetPath, assetErr := utils.SysAssetPath("reboot_loader.json")
+	if assetErr != nil {
+		return fmt.Errorf("Unable to load the reboot loader asset: %v", assetErr)
+	}
+
+	rebootLoader, loaderErr := loader.NewLoader(rebootAssetPath)
+	if loaderErr != nil {
+		return fmt.Errorf("Unable to instantiate new loader from asset: %v with error: %v", rebootAssetPath, loaderErr)
+	}
+
+	for _, process := range rebootLoader.StartSynchronous() {
+		if process.ExitStatus != "success" {
+			return fmt.Errorf("%v failed: %v", process.Name, process.ExitStatus)
+		}
+	}
+
+	return nil
+}
@@ -1,13 +1,27 @@
 package network
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/inbox"
 	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/reporter"
+	"github.com/seantcanavan/anon-eth-net/transport"
+	"github.com/seantcanavan/anon-eth-net/utils"
+	"golang.org/x/net/websocket"
 )
 
 var netw *Network
@@ -51,3 +65,544 @@ func TestRunPass(t *testing.T) {
 	netw.Run()
 	time.Sleep(time.Second * 5)
 }
+
+func TestFleetCheckIn(t *testing.T) {
+
+	defer func(url config.Endpoints, secret string) {
+		config.Cfg.FleetServerURL = url
+		config.Cfg.FleetSecret = secret
+	}(config.Cfg.FleetServerURL, config.Cfg.FleetSecret)
+	config.Cfg.FleetSecret = "fleet secret"
+
+	inbox.RegisterCommand("fleet-echo", func(args []string) (string, []reporter.Attachment, error) {
+		return strings.Join(args, " "), nil, nil
+	})
+
+	var heartbeats []Heartbeat
+	now := time.Now().Unix()
+	queued := []FleetCommand{
+		{Id: "1", Command: "fleet-echo", Args: []string{"hello"}, Timestamp: now, Signature: SignFleetCommand("fleet secret", "1", "fleet-echo", now, []string{"hello"})},
+		{Id: "2", Command: "fleet-echo", Args: []string{"forged"}, Timestamp: now, Signature: SignFleetCommand("wrong secret", "2", "fleet-echo", now, []string{"forged"})},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		if request.Header.Get(FLEET_SIGNATURE_HEADER) != signFleetBody("fleet secret", body) {
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var heartbeat Heartbeat
+		json.Unmarshal(body, &heartbeat)
+		heartbeats = append(heartbeats, heartbeat)
+
+		json.NewEncoder(writer).Encode(fleetResponse{Commands: queued})
+		queued = nil
+	}))
+	defer server.Close()
+	config.Cfg.FleetServerURL = config.Endpoints{server.URL}
+
+	executed, checkInErr := CheckIn()
+	if checkInErr != nil || executed != 1 {
+		t.Fatalf("expected only the correctly signed command to execute, got: %d %v", executed, checkInErr)
+	}
+
+	if _, checkInErr := CheckIn(); checkInErr != nil {
+		t.Fatal(checkInErr)
+	}
+
+	if len(heartbeats) != 2 || heartbeats[0].DeviceId != config.Cfg.DeviceId {
+		t.Fatalf("expected 2 signed heartbeats, got: %+v", heartbeats)
+	}
+
+	results := heartbeats[1].Results
+	if len(results) != 1 || results[0].Id != "1" || results[0].Output != "hello" {
+		t.Errorf("expected the command result in the next heartbeat, got: %+v", results)
+	}
+
+	replayed := FleetCommand{Id: "1", Command: "fleet-echo", Args: []string{"hello"}, Timestamp: now, Signature: SignFleetCommand("fleet secret", "1", "fleet-echo", now, []string{"hello"})}
+	if verifyErr := verifyFleetCommand(replayed, time.Now()); verifyErr == nil {
+		t.Errorf("expected a replayed command to be refused")
+	}
+}
+
+func TestFleetChannel(t *testing.T) {
+
+	defer func(url string, secret string) {
+		config.Cfg.FleetChannelURL = url
+		config.Cfg.FleetSecret = secret
+	}(config.Cfg.FleetChannelURL, config.Cfg.FleetSecret)
+	config.Cfg.FleetSecret = "fleet secret"
+
+	inbox.RegisterCommand("channel-echo", func(args []string) (string, []reporter.Attachment, error) {
+		return strings.Join(args, " "), nil, nil
+	})
+
+	now := time.Now().Unix()
+	received := make(chan []ChannelMessage, 1)
+
+	server := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		request := conn.Request()
+		signed := request.Header.Get(FLEET_DEVICE_HEADER) + "\n" + request.Header.Get(FLEET_TIMESTAMP_HEADER)
+		if request.Header.Get(FLEET_SIGNATURE_HEADER) != signFleetBody("fleet secret", []byte(signed)) {
+			received <- nil
+			return
+		}
+
+		var messages []ChannelMessage
+		var heartbeat ChannelMessage
+		websocket.JSON.Receive(conn, &heartbeat)
+		messages = append(messages, heartbeat)
+
+		websocket.JSON.Send(conn, FleetCommand{Id: "channel-2", Command: "channel-echo", Args: []string{"forged"}, Timestamp: now, Signature: SignFleetCommand("wrong secret", "channel-2", "channel-echo", now, []string{"forged"})})
+		websocket.JSON.Send(conn, FleetCommand{Id: "channel-1", Command: "channel-echo", Args: []string{"hello"}, Timestamp: now, Signature: SignFleetCommand("fleet secret", "channel-1", "channel-echo", now, []string{"hello"})})
+
+		var result ChannelMessage
+		websocket.JSON.Receive(conn, &result)
+		messages = append(messages, result)
+
+		received <- messages
+	}))
+	defer server.Close()
+	config.Cfg.FleetChannelURL = "ws://" + server.Listener.Addr().String()
+
+	conn, dialErr := dialChannel()
+	if dialErr != nil {
+		t.Fatal(dialErr)
+	}
+	go serveChannel(conn)
+
+	var messages []ChannelMessage
+	select {
+	case messages = <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the command channel")
+	}
+
+	if len(messages) != 2 {
+		t.Fatalf("expected a signed handshake followed by a heartbeat and a result, got: %+v", messages)
+	}
+
+	if messages[0].Type != CHANNEL_HEARTBEAT || messages[0].Heartbeat == nil || messages[0].Heartbeat.DeviceId != config.Cfg.DeviceId {
+		t.Errorf("expected a heartbeat on connect, got: %+v", messages[0])
+	}
+
+	if messages[1].Type != CHANNEL_RESULT || messages[1].Result == nil || messages[1].Result.Id != "channel-1" || messages[1].Result.Output != "hello" {
+		t.Errorf("expected only the correctly signed command result, got: %+v", messages[1])
+	}
+}
+
+func TestEnroll(t *testing.T) {
+
+	configAssetPath, assetErr := utils.AssetPath("config.json")
+	if assetErr != nil {
+		t.Fatal(assetErr)
+	}
+
+	original, readErr := ioutil.ReadFile(configAssetPath)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	defer func() {
+		ioutil.WriteFile(configAssetPath, original, 0644)
+		config.FromFile()
+	}()
+
+	var enrollments []EnrollRequest
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		var enrollment EnrollRequest
+		json.NewDecoder(request.Body).Decode(&enrollment)
+		enrollments = append(enrollments, enrollment)
+
+		if enrollment.RegistrationToken != "registration token" {
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		json.NewEncoder(writer).Encode(EnrollResponse{Secret: "enrolled secret"})
+	}))
+	defer server.Close()
+
+	config.Cfg.FleetSecret = ""
+	config.Cfg.FleetEnrollURL = config.Endpoints{server.URL}
+	config.Cfg.FleetRegistrationToken = "wrong token"
+
+	if enrollErr := Enroll(); enrollErr == nil || Enrolled() {
+		t.Fatalf("expected an enrollment with the wrong token to be refused, got: %v", enrollErr)
+	}
+
+	unsigned := FleetCommand{Id: "unsigned", Command: "fleet-echo", Timestamp: time.Now().Unix(), Signature: SignFleetCommand("", "unsigned", "fleet-echo", time.Now().Unix(), nil)}
+	if verifyErr := verifyFleetCommand(unsigned, time.Now()); verifyErr == nil {
+		t.Errorf("expected commands to be refused before enrolling")
+	}
+
+	config.Cfg.FleetRegistrationToken = "registration token"
+	if enrollErr := Enroll(); enrollErr != nil {
+		t.Fatal(enrollErr)
+	}
+
+	if len(enrollments) != 2 || enrollments[1].DeviceId != config.Cfg.DeviceId {
+		t.Errorf("expected the enrollment to identify this agent, got: %+v", enrollments)
+	}
+
+	if config.Cfg.FleetSecret != "enrolled secret" || config.Cfg.FleetRegistrationToken != "" {
+		t.Errorf("expected the secret to be saved and the token cleared, got: %v %v", config.Cfg.FleetSecret, config.Cfg.FleetRegistrationToken)
+	}
+
+	saved, readErr := ioutil.ReadFile(configAssetPath)
+	if readErr != nil || !strings.Contains(string(saved), "enrolled secret") {
+		t.Errorf("expected the secret to be saved to the config.json asset, got: %v", readErr)
+	}
+}
+
+func TestUpdatePermit(t *testing.T) {
+
+	defer func(url config.Endpoints, secret string, site string, wait int) {
+		config.Cfg.FleetUpdatePermitURL = url
+		config.Cfg.FleetSecret = secret
+		config.Cfg.FleetSite = site
+		config.Cfg.FleetPermitWaitMinutes = wait
+	}(config.Cfg.FleetUpdatePermitURL, config.Cfg.FleetSecret, config.Cfg.FleetSite, config.Cfg.FleetPermitWaitMinutes)
+	config.Cfg.FleetSecret = "fleet secret"
+	config.Cfg.FleetSite = "farm-1"
+	config.Cfg.FleetPermitWaitMinutes = 1
+
+	if release, permitErr := RequestUpdatePermit(70, 71); permitErr != nil || release == nil {
+		t.Errorf("expected updates to be permitted without a FleetUpdatePermitURL, got: %v", permitErr)
+	}
+
+	// another agent at the site is updating the first time it's asked
+	var permits []PermitRequest
+	retryAfter := 1
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		if request.Header.Get(FLEET_SIGNATURE_HEADER) != signFleetBody("fleet secret", body) {
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var permit PermitRequest
+		json.Unmarshal(body, &permit)
+		permits = append(permits, permit)
+
+		granted := len(permits) > 1 && retryAfter == 1
+		json.NewEncoder(writer).Encode(PermitResponse{Granted: granted, RetryAfterSeconds: retryAfter, Reason: "1 of 1 agents at farm-1 are updating"})
+	}))
+	defer server.Close()
+	config.Cfg.FleetUpdatePermitURL = config.Endpoints{server.URL}
+
+	release, permitErr := RequestUpdatePermit(70, 71)
+	if permitErr != nil {
+		t.Fatal(permitErr)
+	}
+	if len(permits) != 2 || permits[1].Action != PERMIT_ACQUIRE || permits[1].Site != "farm-1" || permits[1].ToVersion != 71 || permits[1].DeviceId != config.Cfg.DeviceId {
+		t.Errorf("expected the permit to be asked for again for this agent and site, got: %+v", permits)
+	}
+
+	release(nil)
+	if len(permits) != 3 || permits[2].Action != PERMIT_RELEASE || permits[2].Outcome != PERMIT_APPLIED {
+		t.Errorf("expected the permit to be handed back once the update was applied, got: %+v", permits)
+	}
+	if releaseErr := ReleaseUpdatePermit(PERMIT_APPLIED); releaseErr != nil || len(permits) != 3 {
+		t.Errorf("expected nothing to be handed back once the permit was released, got: %v after %d requests", releaseErr, len(permits))
+	}
+
+	// the server won't permit it again within FleetPermitWaitMinutes
+	retryAfter = 120
+	var denied ErrPermitDenied
+	if _, permitErr := RequestUpdatePermit(70, 71); !errors.As(permitErr, &denied) || denied.Reason != "1 of 1 agents at farm-1 are updating" {
+		t.Errorf("expected the update not to be permitted, got: %v", permitErr)
+	}
+}
+
+func TestPublicIPChange(t *testing.T) {
+
+	defer func(services []string, geoURL string) {
+		config.Cfg.PublicIPServices = services
+		config.Cfg.GeoLocationURL = geoURL
+	}(config.Cfg.PublicIPServices, config.Cfg.GeoLocationURL)
+
+	current := "203.0.113.7"
+	honest := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		fmt.Fprintln(writer, current)
+	}))
+	defer honest.Close()
+
+	liar := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		fmt.Fprintln(writer, "198.51.100.1")
+	}))
+	defer liar.Close()
+
+	broken := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("<html>rate limited</html>"))
+	}))
+	defer broken.Close()
+
+	geo := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(`{"city": "Reykjavik", "region": "Capital Region", "country": "IS"}`))
+	}))
+	defer geo.Close()
+
+	config.Cfg.PublicIPServices = []string{liar.URL, broken.URL, honest.URL, honest.URL}
+	config.Cfg.GeoLocationURL = geo.URL + "/%v/json"
+
+	changes := make(chan events.PublicIPChanged, 1)
+	unsubscribe := events.Subscribe("network_test", func(record events.Record) {
+		if changed, ok := record.Event.(events.PublicIPChanged); ok {
+			changes <- changed
+		}
+	})
+	defer unsubscribe()
+
+	publicIP = ""
+	if resolved, checkErr := CheckPublicIP(); checkErr != nil || resolved != "203.0.113.7" {
+		t.Fatalf("expected the address most services agree on, got: %v %v", resolved, checkErr)
+	}
+
+	current = "203.0.113.8"
+	if _, checkErr := CheckPublicIP(); checkErr != nil {
+		t.Fatal(checkErr)
+	}
+
+	select {
+	case changed := <-changes:
+		if changed.PreviousIP != "203.0.113.7" || changed.CurrentIP != "203.0.113.8" || changed.Location != "Reykjavik, Capital Region, IS" {
+			t.Errorf("unexpected change event: %+v", changed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a PublicIPChanged event")
+	}
+
+	if summary, _ := PublicIPSummary(); !strings.Contains(summary, "203.0.113.8 in Reykjavik") {
+		t.Errorf("expected the status summary to show the new address, got: %v", summary)
+	}
+}
+
+func TestFleetOfflineBacklog(t *testing.T) {
+
+	defer func(url config.Endpoints, secret string) {
+		config.Cfg.FleetServerURL = url
+		config.Cfg.FleetSecret = secret
+	}(config.Cfg.FleetServerURL, config.Cfg.FleetSecret)
+	config.Cfg.FleetSecret = "fleet secret"
+
+	var heartbeats []Heartbeat
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		var heartbeat Heartbeat
+		json.NewDecoder(request.Body).Decode(&heartbeat)
+		heartbeats = append(heartbeats, heartbeat)
+	}))
+	defer server.Close()
+	config.Cfg.FleetServerURL = config.Endpoints{server.URL}
+
+	transport.MarkOffline()
+	recordOfflineHeartbeat()
+	recordOfflineHeartbeat()
+	queueResult(CommandResult{Id: "offline-1", Command: "status"})
+
+	// the backlog survives a restart
+	offlineHeartbeats = nil
+	pendingResults = nil
+	loadFleetBacklog()
+
+	transport.MarkOnline()
+
+	if _, checkInErr := CheckIn(); checkInErr != nil {
+		t.Fatal(checkInErr)
+	}
+
+	if len(heartbeats) != 1 || len(heartbeats[0].Backlog) != 2 || len(heartbeats[0].Results) != 1 {
+		t.Fatalf("expected the offline heartbeats and results to be delivered on reconnect, got: %+v", heartbeats)
+	}
+
+	if heartbeats[0].Backlog[0].Time > heartbeats[0].Backlog[1].Time {
+		t.Errorf("expected the offline heartbeats oldest first, got: %+v", heartbeats[0].Backlog)
+	}
+
+	if _, checkInErr := CheckIn(); checkInErr != nil {
+		t.Fatal(checkInErr)
+	}
+
+	if len(heartbeats[1].Backlog) != 0 || len(heartbeats[1].Results) != 0 {
+		t.Errorf("expected the backlog to be cleared once delivered, got: %+v", heartbeats[1])
+	}
+
+	if summary, _ := FleetSummary(); !strings.HasPrefix(summary, "Agent ID: "+config.Cfg.DeviceId) || !strings.Contains(summary, "Last checked in") || !strings.Contains(summary, "0 heartbeats and 0 command results") {
+		t.Errorf("unexpected fleet summary: %v", summary)
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+
+	defer func(secret string) {
+		config.Cfg.DiscoverySecret = secret
+	}(config.Cfg.DiscoverySecret)
+	config.Cfg.DiscoverySecret = "site secret"
+
+	listener, listenErr := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	defer listener.Close()
+	go listenForPeers(listener)
+
+	sender, senderErr := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if senderErr != nil {
+		t.Fatal(senderErr)
+	}
+	defer sender.Close()
+
+	// this agent's own announcements are ignored
+	if announceErr := announce(sender, listener.LocalAddr().(*net.UDPAddr)); announceErr != nil {
+		t.Fatal(announceErr)
+	}
+
+	forged := Announcement{DeviceId: "forged", DeviceName: "forged", Version: 1, Time: time.Now().Unix()}
+	forged.Signature = signAnnouncement("wrong secret", forged)
+	peer := Announcement{DeviceId: "peer", DeviceName: "miner-2", Version: config.Cfg.LocalVersion + 1, Time: time.Now().Unix()}
+	peer.Signature = signAnnouncement("site secret", peer)
+
+	for _, announcement := range []Announcement{forged, peer} {
+		announcementBytes, _ := json.Marshal(announcement)
+		sender.WriteToUDP(announcementBytes, listener.LocalAddr().(*net.UDPAddr))
+	}
+
+	var found []Peer
+	for attempt := 0; attempt < 50 && len(found) == 0; attempt++ {
+		time.Sleep(100 * time.Millisecond)
+		found = Peers()
+	}
+
+	if len(found) != 1 || found[0].DeviceId != "peer" || found[0].Address != "127.0.0.1" {
+		t.Fatalf("expected only the correctly signed peer to be found, got: %+v", found)
+	}
+
+	if summary, _ := SiteSummary(); !strings.Contains(summary, "miner-2 (peer) at 127.0.0.1") || !strings.Contains(summary, "[newer version]") {
+		t.Errorf("expected the site summary to list the newer peer, got: %v", summary)
+	}
+}
+
+func TestMQTT(t *testing.T) {
+
+	defer func(brokerURL string, prefix string, secret string) {
+		config.Cfg.MQTTBrokerURL = brokerURL
+		config.Cfg.MQTTTopicPrefix = prefix
+		config.Cfg.FleetSecret = secret
+	}(config.Cfg.MQTTBrokerURL, config.Cfg.MQTTTopicPrefix, config.Cfg.FleetSecret)
+	config.Cfg.FleetSecret = "fleet secret"
+	config.Cfg.MQTTTopicPrefix = "test/agent"
+
+	inbox.RegisterCommand("mqtt-echo", func(args []string) (string, []reporter.Attachment, error) {
+		return strings.Join(args, " "), nil, nil
+	})
+
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	defer listener.Close()
+	config.Cfg.MQTTBrokerURL = "mqtt://agent:hunter2@" + listener.Addr().String()
+
+	go func() {
+		client, dialErr := dialMQTT(config.Cfg.MQTTBrokerURL, config.Cfg.DeviceId, mqttTopic(MQTT_ONLINE_TOPIC), []byte("false"))
+		if dialErr == nil {
+			serveMQTT(client)
+		}
+	}()
+
+	conn, acceptErr := listener.Accept()
+	if acceptErr != nil {
+		t.Fatal(acceptErr)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// the broker side speaks the same framing as the client
+	broker := &mqttClient{conn: conn, reader: bufio.NewReader(conn)}
+
+	packetType, body, readErr := broker.readPacket()
+	if readErr != nil || packetType != MQTT_CONNECT || !strings.Contains(string(body), "hunter2") || !strings.Contains(string(body), "test/agent/online") {
+		t.Fatalf("expected a CONNECT with credentials and a will, got: %d %q %v", packetType, body, readErr)
+	}
+	broker.writePacket(MQTT_CONNACK<<4, []byte{0, 0})
+
+	published := make(map[string][]byte)
+	for len(published) < 3 {
+		packetType, body, readErr = broker.readPacket()
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		switch packetType {
+		case MQTT_SUBSCRIBE:
+			if !strings.Contains(string(body), "test/agent/commands") {
+				t.Errorf("expected a subscription to the commands topic, got: %q", body)
+			}
+			broker.writePacket(MQTT_SUBACK<<4, []byte{body[0], body[1], 0})
+		case MQTT_PUBLISH:
+			topicLength := int(body[0])<<8 | int(body[1])
+			published[string(body[2:2+topicLength])] = body[2+topicLength:]
+		}
+	}
+
+	if string(published["test/agent/online"]) != "true" {
+		t.Errorf("expected the agent to announce it's online, got: %q", published["test/agent/online"])
+	}
+
+	var status Heartbeat
+	if jsonErr := json.Unmarshal(published["test/agent/status"], &status); jsonErr != nil || status.DeviceId != config.Cfg.DeviceId {
+		t.Errorf("expected the status heartbeat, got: %q %v", published["test/agent/status"], jsonErr)
+	}
+
+	now := time.Now().Unix()
+	command, _ := json.Marshal(FleetCommand{Id: "mqtt-1", Command: "mqtt-echo", Args: []string{"hello"}, Timestamp: now, Signature: SignFleetCommand("fleet secret", "mqtt-1", "mqtt-echo", now, []string{"hello"})})
+	broker.writePacket(MQTT_PUBLISH<<4, append(appendMQTTString(nil, []byte("test/agent/commands")), command...))
+
+	for {
+		packetType, body, readErr = broker.readPacket()
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		topicLength := int(body[0])<<8 | int(body[1])
+		if packetType == MQTT_PUBLISH && string(body[2:2+topicLength]) == "test/agent/results" {
+			var result CommandResult
+			json.Unmarshal(body[2+topicLength:], &result)
+			if result.Id != "mqtt-1" || result.Output != "hello" {
+				t.Errorf("expected the command result, got: %+v", result)
+			}
+			break
+		}
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {}))
+	defer healthy.Close()
+
+	broken := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+
+	selfSigned := httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {}))
+	defer selfSigned.Close()
+
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedAddress := closed.Addr().String()
+	closed.Close()
+
+	expected := map[string]string{
+		healthy.URL:    DIAGNOSIS_OK,
+		broken.URL:     DIAGNOSIS_ENDPOINT_DOWN,
+		selfSigned.URL: DIAGNOSIS_TLS_FAILURE,
+		"https://" + healthy.Listener.Addr().String(): DIAGNOSIS_TLS_FAILURE,
+		"http://" + closedAddress:                     DIAGNOSIS_ENDPOINT_DOWN,
+		"http://anon-eth-net.invalid":                 DIAGNOSIS_NO_DNS,
+	}
+
+	for endpoint, layer := range expected {
+		if diagnosis := Diagnose(endpoint); diagnosis.Layer != layer {
+			t.Errorf("expected %v to be diagnosed as %v, got: %v", endpoint, layer, diagnosis)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/lifecycle"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/state"
+	"github.com/seantcanavan/anon-eth-net/transport"
+)
+
+// The key within FLEET_BUCKET the update permit held across a restart is
+// saved under
+const UPDATE_PERMIT_KEY = "updatePermit"
+
+// How long to wait before asking for an update permit again when the fleet
+// server doesn't say. In seconds
+const FLEET_PERMIT_RETRY_SECONDS = 60
+
+// The actions of a PermitRequest
+const PERMIT_ACQUIRE = "acquire"
+const PERMIT_RELEASE = "release"
+
+// The outcomes an update permit is released with
+const PERMIT_APPLIED = "applied"
+const PERMIT_FAILED = "failed"
+
+// PermitRequest is what an agent POSTs, signed like a heartbeat, to the
+// FleetUpdatePermitURL to acquire permission to apply an update and to hand it
+// back afterwards. The fleet server decides how many agents of the same site
+// can hold a permit at once.
+type PermitRequest struct {
+	DeviceId    string `json:"deviceId"`
+	DeviceName  string `json:"deviceName"`
+	Site        string `json:"site"`
+	Action      string `json:"action"`
+	FromVersion uint64 `json:"fromVersion"`
+	ToVersion   uint64 `json:"toVersion"`
+	Outcome     string `json:"outcome,omitempty"`
+	Time        int64  `json:"time"`
+}
+
+// PermitResponse is what the fleet server replies to a PermitRequest with.
+// An agent which isn't granted a permit asks again after RetryAfterSeconds.
+type PermitResponse struct {
+	Granted           bool   `json:"granted"`
+	RetryAfterSeconds int    `json:"retryAfterSeconds,omitempty"`
+	Reason            string `json:"reason,omitempty"`
+}
+
+// ErrPermitDenied is returned when the fleet server didn't grant an update
+// permit within FleetPermitWaitMinutes.
+type ErrPermitDenied struct {
+	Reason string
+	Waited time.Duration
+}
+
+// Error describes why the update wasn't permitted.
+func (epd ErrPermitDenied) Error() string {
+	return fmt.Sprintf("The fleet server didn't permit the update within %v: %v", epd.Waited, epd.Reason)
+}
+
+// heldPermit is the update permit saved while the agent restarts into an
+// update, so the new copy of the agent can hand it back.
+type heldPermit struct {
+	FromVersion uint64    `json:"fromVersion"`
+	ToVersion   uint64    `json:"toVersion"`
+	Granted     time.Time `json:"granted"`
+}
+
+// RequestUpdatePermit will ask the fleet server at the FleetUpdatePermitURL
+// for permission to update from one version to the other, asking again for
+// up to FleetPermitWaitMinutes while it's refused. Returns ErrPermitDenied
+// once the wait is over. The returned function hands the permit back with the
+// outcome of the update, except when the agent is restarting into the update,
+// in which case RunPermitRelease hands it back once the new copy is running.
+// Updates are always permitted when there's no FleetUpdatePermitURL.
+func RequestUpdatePermit(from uint64, to uint64) (func(updateErr error), error) {
+
+	if len(config.Cfg.FleetUpdatePermitURL) == 0 {
+		return func(error) {}, nil
+	}
+
+	if !Enrolled() {
+		return nil, fmt.Errorf("Cannot ask the fleet server for an update permit until this agent has enrolled")
+	}
+
+	started := time.Now()
+	deadline := started.Add(time.Duration(config.Cfg.FleetPermitWaitMinutes) * time.Minute)
+	for 1 == 1 {
+		reply, endpoint, permitErr := postPermit(PermitRequest{Action: PERMIT_ACQUIRE, FromVersion: from, ToVersion: to})
+		if permitErr != nil {
+			return nil, permitErr
+		}
+
+		if reply.Granted {
+			if saveErr := state.Put(FLEET_BUCKET, UPDATE_PERMIT_KEY, heldPermit{FromVersion: from, ToVersion: to, Granted: time.Now()}); saveErr != nil {
+				logger.Lgr.LogErrorf("Unable to save the update permit: %v", saveErr)
+			}
+			logger.Lgr.LogMessagef("Successfully acquired an update permit from %v for the update to version %d", endpoint, to)
+			return releaseAfter, nil
+		}
+
+		retry := time.Duration(reply.RetryAfterSeconds) * time.Second
+		if retry <= 0 {
+			retry = FLEET_PERMIT_RETRY_SECONDS * time.Second
+		}
+		if time.Now().Add(retry).After(deadline) {
+			return nil, ErrPermitDenied{Reason: reply.Reason, Waited: time.Since(started).Round(time.Second)}
+		}
+
+		logger.Lgr.LogMessagef("The fleet server %v hasn't permitted the update to version %d yet: %v. Asking again in %v", endpoint, to, reply.Reason, retry)
+		time.Sleep(retry)
+	}
+
+	return nil, nil
+}
+
+// releaseAfter will hand back the update permit once the update has been
+// applied or has failed, unless the agent is restarting into the update.
+func releaseAfter(updateErr error) {
+
+	if updateErr == nil && lifecycle.Restarting() {
+		logger.Lgr.LogMessage("Holding on to the update permit until the agent has restarted into the update")
+		return
+	}
+
+	outcome := PERMIT_APPLIED
+	if updateErr != nil {
+		outcome = PERMIT_FAILED
+	}
+	if releaseErr := ReleaseUpdatePermit(outcome); releaseErr != nil {
+		logger.Lgr.LogErrorf("Failed to hand back the update permit: %v", releaseErr)
+	}
+}
+
+// ReleaseUpdatePermit will hand the update permit this agent holds back to the
+// fleet server with the given outcome. Does nothing when it doesn't hold one.
+func ReleaseUpdatePermit(outcome string) error {
+
+	var held heldPermit
+	found, loadErr := state.Get(FLEET_BUCKET, UPDATE_PERMIT_KEY, &held)
+	if loadErr != nil {
+		return loadErr
+	}
+	if !found {
+		return nil
+	}
+
+	_, endpoint, permitErr := postPermit(PermitRequest{Action: PERMIT_RELEASE, FromVersion: held.FromVersion, ToVersion: held.ToVersion, Outcome: outcome})
+	if permitErr != nil {
+		return permitErr
+	}
+
+	if deleteErr := state.Delete(FLEET_BUCKET, UPDATE_PERMIT_KEY); deleteErr != nil {
+		return deleteErr
+	}
+
+	logger.Lgr.LogMessagef("Successfully handed the update permit for version %d back to %v", held.ToVersion, endpoint)
+	return nil
+}
+
+// RunPermitRelease will hand back the update permit the agent was holding when
+// it restarted into an update, now that the new copy is running, asking again
+// every FLEET_PERMIT_RETRY_SECONDS until the fleet server has it. Does nothing
+// when no permit is held.
+func RunPermitRelease() {
+
+	if len(config.Cfg.FleetUpdatePermitURL) == 0 {
+		return
+	}
+
+	go func() {
+		for 1 == 1 {
+			releaseErr := ReleaseUpdatePermit(PERMIT_APPLIED)
+			if releaseErr == nil {
+				return
+			}
+			logger.Lgr.LogErrorf("Failed to hand back the update permit: %v", releaseErr)
+			time.Sleep(FLEET_PERMIT_RETRY_SECONDS * time.Second)
+		}
+	}()
+}
+
+// postPermit will sign and POST the given request for this agent to each of
+// the FleetUpdatePermitURL endpoints until one replies. Returns the reply and
+// the endpoint which gave it.
+func postPermit(permit PermitRequest) (PermitResponse, string, error) {
+
+	permit.DeviceId = config.Cfg.DeviceId
+	permit.DeviceName = config.Cfg.DeviceName
+	permit.Site = config.Cfg.FleetSite
+	permit.Time = time.Now().Unix()
+
+	var reply PermitResponse
+	body, jsonErr := json.Marshal(permit)
+	if jsonErr != nil {
+		return reply, "", jsonErr
+	}
+
+	var responseBytes []byte
+	endpoint, failoverErr := transport.Failover(config.Cfg.FleetUpdatePermitURL, func(permitURL string) error {
+		request, requestErr := http.NewRequest("POST", permitURL, bytes.NewReader(body))
+		if requestErr != nil {
+			return requestErr
+		}
+
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set(FLEET_DEVICE_HEADER, config.Cfg.DeviceId)
+		request.Header.Set(FLEET_SIGNATURE_HEADER, signFleetBody(config.Cfg.FleetSecret, body))
+
+		response, postErr := fleetClient().Do(request)
+		if postErr != nil {
+			return postErr
+		}
+		defer response.Body.Close()
+
+		if statusErr := transport.CheckStatus(response); statusErr != nil {
+			return statusErr
+		}
+
+		var readErr error
+		responseBytes, readErr = ioutil.ReadAll(io.LimitReader(response.Body, MAX_FLEET_RESPONSE_BYTES))
+		return readErr
+	})
+	if failoverErr != nil {
+		return reply, "", failoverErr
+	}
+
+	if len(bytes.TrimSpace(responseBytes)) > 0 {
+		if jsonErr := json.Unmarshal(responseBytes, &reply); jsonErr != nil {
+			return reply, endpoint, fmt.Errorf("Unable to read the reply from %v: %v", endpoint, jsonErr)
+		}
+	}
+
+	return reply, endpoint, nil
+}
@@ -0,0 +1,215 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/transport"
+)
+
+// How long a single public IP or geolocation lookup can take. In seconds
+const PUBLIC_IP_TIMEOUT_SECONDS = 15
+
+// The largest response accepted from a public IP or geolocation service
+const MAX_PUBLIC_IP_RESPONSE_BYTES = 64 * 1024
+
+var publicIPLock sync.Mutex
+var publicIP string
+var publicIPLocation string
+var publicIPChecked time.Time
+
+// RunPublicIPWatcher will resolve the public IP address of this machine every
+// PublicIPCheckSeconds and publish a PublicIPChanged event whenever it's
+// different from the last time, so roaming machines and DHCP reassignments
+// can be tracked. Does nothing when PublicIPCheckSeconds is negative.
+func RunPublicIPWatcher() {
+
+	if config.Cfg.PublicIPCheckSeconds < 0 {
+		logger.Lgr.LogMessage("PublicIPCheckSeconds is negative. Public IP change detection is disabled.")
+		return
+	}
+
+	go func() {
+		for 1 == 1 {
+			if _, checkErr := CheckPublicIP(); checkErr != nil {
+				logger.Lgr.LogErrorf("Failed to resolve the public IP address: %v", checkErr)
+			}
+
+			time.Sleep(time.Duration(config.Cfg.PublicIPCheckSeconds) * time.Second)
+		}
+	}()
+}
+
+// CheckPublicIP will resolve the public IP address of this machine and
+// publish a PublicIPChanged event if it's different from the previously
+// resolved address. The first address resolved is only recorded. Returns
+// the current address.
+func CheckPublicIP() (string, error) {
+
+	current, resolveErr := ResolvePublicIP()
+	if resolveErr != nil {
+		return "", resolveErr
+	}
+
+	publicIPLock.Lock()
+	previous := publicIP
+	publicIP = current
+	publicIPChecked = time.Now()
+	publicIPLock.Unlock()
+
+	if previous == current {
+		return current, nil
+	}
+
+	location, geoErr := geolocate(current)
+	if geoErr != nil {
+		logger.Lgr.LogErrorf("Failed to geolocate public IP %v: %v", current, geoErr)
+	}
+
+	publicIPLock.Lock()
+	publicIPLocation = location
+	publicIPLock.Unlock()
+
+	if previous == "" {
+		logger.Lgr.LogMessagef("Successfully resolved the public IP address: %v %v", current, location)
+		return current, nil
+	}
+
+	events.Publish(events.PublicIPChanged{PreviousIP: previous, CurrentIP: current, Location: location})
+	return current, nil
+}
+
+// ResolvePublicIP will ask every one of the PublicIPServices for this
+// machine's public IP address and return the address most of them agree on.
+// Ties go to the service listed first. Services which fail or reply with
+// something other than an IP address are ignored.
+func ResolvePublicIP() (string, error) {
+
+	client := transport.HTTPClient(PUBLIC_IP_TIMEOUT_SECONDS * time.Second)
+
+	votes := make(map[string]int)
+	var order []string
+	var lastErr error
+
+	for _, service := range config.Cfg.PublicIPServices {
+		body, getErr := getLimited(client, service)
+		if getErr != nil {
+			lastErr = getErr
+			logger.Lgr.LogMessagef("Public IP service %v failed: %v", service, getErr)
+			continue
+		}
+
+		ip := net.ParseIP(strings.TrimSpace(string(body)))
+		if ip == nil {
+			lastErr = fmt.Errorf("Public IP service %v replied with something other than an IP address", service)
+			logger.Lgr.LogMessagef("Public IP service %v replied with something other than an IP address", service)
+			continue
+		}
+
+		address := ip.String()
+		if votes[address] == 0 {
+			order = append(order, address)
+		}
+		votes[address]++
+	}
+
+	if len(order) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("No PublicIPServices are configured")
+		}
+		return "", lastErr
+	}
+
+	best := order[0]
+	for _, address := range order[1:] {
+		if votes[address] > votes[best] {
+			best = address
+		}
+	}
+
+	if len(order) > 1 {
+		logger.Lgr.LogMessagef("Public IP services disagreed: %v. Using %v", votes, best)
+	}
+
+	return best, nil
+}
+
+// PublicIPSummary describes the last resolved public IP address for the
+// status report.
+func PublicIPSummary() (string, error) {
+
+	publicIPLock.Lock()
+	defer publicIPLock.Unlock()
+
+	if publicIP == "" {
+		return "not resolved yet\n", nil
+	}
+
+	if publicIPLocation == "" {
+		return fmt.Sprintf("%v as of %v\n", publicIP, publicIPChecked.Format(time.RFC1123)), nil
+	}
+
+	return fmt.Sprintf("%v in %v as of %v\n", publicIP, publicIPLocation, publicIPChecked.Format(time.RFC1123)), nil
+}
+
+// geolocate will look up the given IP address with the GeoLocationURL service
+// and return the city, region and country it replies with. Returns an empty
+// location when no service is configured.
+func geolocate(ip string) (string, error) {
+
+	if config.Cfg.GeoLocationURL == "" {
+		return "", nil
+	}
+
+	client := transport.HTTPClient(PUBLIC_IP_TIMEOUT_SECONDS * time.Second)
+
+	body, getErr := getLimited(client, fmt.Sprintf(config.Cfg.GeoLocationURL, ip))
+	if getErr != nil {
+		return "", getErr
+	}
+
+	var reply map[string]interface{}
+	if jsonErr := json.Unmarshal(body, &reply); jsonErr != nil {
+		return "", jsonErr
+	}
+
+	// the field names used by the common free geolocation services
+	var parts []string
+	for _, fields := range [][]string{{"city"}, {"region", "regionName", "region_name"}, {"country", "countryCode", "country_name"}} {
+		for _, field := range fields {
+			if value, ok := reply[field].(string); ok && value != "" {
+				parts = append(parts, value)
+				break
+			}
+		}
+	}
+
+	return strings.Join(parts, ", "), nil
+}
+
+// getLimited will GET the given URI and return at most
+// MAX_PUBLIC_IP_RESPONSE_BYTES of a successful response.
+func getLimited(client *http.Client, uri string) ([]byte, error) {
+
+	response, getErr := client.Get(uri)
+	if getErr != nil {
+		return nil, getErr
+	}
+	defer response.Body.Close()
+
+	if statusErr := transport.CheckStatus(response); statusErr != nil {
+		return nil, statusErr
+	}
+
+	return ioutil.ReadAll(io.LimitReader(response.Body, MAX_PUBLIC_IP_RESPONSE_BYTES))
+}
@@ -0,0 +1,494 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/eth"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/loader"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// How long the node has to come back after being restarted before its
+// dependent jobs are started again anyway. In seconds
+const NODE_START_TIMEOUT_SECONDS = 600
+
+// How often a restarted node is checked for having come back. In seconds
+const NODE_POLL_SECONDS = 5
+
+// How often the size of the NodeDataDir is measured. In minutes
+const DATA_DIR_CHECK_MINUTES = 60
+
+// How long to wait after pruning the node before pruning it again. In hours
+const PRUNE_HOURS = 24
+
+// The bytes in one gigabyte
+const BYTES_PER_GB = 1024 * 1024 * 1024
+
+// The problems the node can have. Each is reported once until it clears up
+const UNREACHABLE = "unreachable"
+const BEHIND = "behind"
+const PEERS = "peers"
+const STALLED = "stalled"
+const DATA_DIR = "datadir"
+
+// Status is what was learned about the node the last time it was checked.
+type Status struct {
+	Time         int64             `json:"time"`
+	Reachable    bool              `json:"reachable"`
+	Syncing      bool              `json:"syncing"`
+	Block        uint64            `json:"block"`
+	Head         uint64            `json:"head"`
+	Behind       uint64            `json:"behind"`
+	Peers        uint64            `json:"peers"`
+	DataDirBytes int64             `json:"dataDirBytes"`
+	Problems     map[string]string `json:"problems"`
+}
+
+// syncProgress is the reply to eth_syncing while the node is syncing.
+type syncProgress struct {
+	CurrentBlock string `json:"currentBlock"`
+	HighestBlock string `json:"highestBlock"`
+}
+
+var supervised *loader.Loader
+
+var latest Status
+var lastBlock uint64
+var lastProgress time.Time
+var dataDirBytes int64
+var dataDirMeasured time.Time
+var alerted = make(map[string]bool)
+var lastRestart time.Time
+var statusLock sync.Mutex
+
+var lastPrune time.Time
+var restartLock sync.Mutex
+
+// Run will check the health of the node at NodeRPCURL every NodeCheckSeconds.
+// The given loader runs the NodeJob and NodeDependentJobs, and may be nil when
+// the node isn't run by the agent, in which case it's only monitored. Does
+// nothing while NodeRPCURL is empty, so it can be turned on via the config
+// without a restart.
+func Run(ldr *loader.Loader) {
+
+	supervised = ldr
+
+	go func() {
+		for 1 == 1 {
+			if config.Cfg.NodeRPCURL != "" {
+				if _, checkErr := Check(); checkErr != nil {
+					logger.Lgr.LogErrorf("Failed to check the node: %v", checkErr)
+				}
+			}
+
+			time.Sleep(time.Duration(config.Cfg.NodeCheckSeconds) * time.Second)
+		}
+	}()
+}
+
+// Check will ask the node for its sync status, latest block and peer count,
+// measure its NodeDataDir every DATA_DIR_CHECK_MINUTES and publish a
+// NodeUnhealthy event for each new problem found. A node which hasn't
+// imported a block in NodeStallMinutes is restarted, and one whose NodeDataDir
+// has grown past NodeMaxDataGB is pruned with the NodePruneCommand, when the
+// agent runs it as the NodeJob.
+func Check() (Status, error) {
+
+	now := time.Now()
+	current := Status{Time: now.Unix(), Problems: make(map[string]string)}
+
+	queryErr := query(&current)
+	if queryErr != nil {
+		current.Problems[UNREACHABLE] = fmt.Sprintf("The node at %v isn't answering: %v", config.Cfg.NodeRPCURL, queryErr)
+	} else {
+		if current.Behind > uint64(config.Cfg.NodeMaxBehindBlocks) {
+			current.Problems[BEHIND] = fmt.Sprintf("The node is %d blocks behind the head of the chain at block %d", current.Behind, current.Head)
+		}
+		if current.Peers < uint64(config.Cfg.NodeMinPeers) {
+			current.Problems[PEERS] = fmt.Sprintf("The node has %d peers, fewer than the %d it needs", current.Peers, config.Cfg.NodeMinPeers)
+		}
+	}
+
+	if config.Cfg.NodeDataDir != "" && now.Sub(dataDirMeasured) >= DATA_DIR_CHECK_MINUTES*time.Minute {
+		size, sizeErr := dirSize(config.Cfg.NodeDataDir)
+		if sizeErr != nil {
+			logger.Lgr.LogErrorf("Could not measure the NodeDataDir %v: %v", config.Cfg.NodeDataDir, sizeErr)
+		} else {
+			statusLock.Lock()
+			dataDirBytes = size
+			statusLock.Unlock()
+		}
+		dataDirMeasured = now
+	}
+
+	statusLock.Lock()
+
+	current.DataDirBytes = dataDirBytes
+	if config.Cfg.NodeMaxDataGB > 0 && current.DataDirBytes > int64(config.Cfg.NodeMaxDataGB)*BYTES_PER_GB {
+		current.Problems[DATA_DIR] = fmt.Sprintf("The NodeDataDir %v has grown to %v, past the %d GB it's allowed", config.Cfg.NodeDataDir, utils.FormatBytes(current.DataDirBytes), config.Cfg.NodeMaxDataGB)
+	}
+
+	if lastProgress.IsZero() || current.Block > lastBlock {
+		lastBlock = current.Block
+		lastProgress = now
+	}
+	if stalled := now.Sub(lastProgress); stalled >= time.Duration(config.Cfg.NodeStallMinutes)*time.Minute {
+		current.Problems[STALLED] = fmt.Sprintf("The node hasn't imported a block in %v", stalled.Round(time.Second))
+	}
+
+	var raised []events.NodeUnhealthy
+	for problem, description := range current.Problems {
+		if !alerted[problem] {
+			alerted[problem] = true
+			raised = append(raised, events.NodeUnhealthy{Problem: problem, Description: description})
+		}
+	}
+	for problem := range alerted {
+		if _, ongoing := current.Problems[problem]; !ongoing {
+			delete(alerted, problem)
+			logger.Lgr.LogMessagef("Successfully cleared the node problem: %v", problem)
+		}
+	}
+
+	latest = current
+	sinceRestart := time.Since(lastRestart)
+	statusLock.Unlock()
+
+	for _, unhealthy := range raised {
+		logger.Lgr.LogError(unhealthy.Description)
+		events.Publish(unhealthy)
+	}
+
+	if queryErr == nil {
+		logger.Lgr.LogMessagef("Successfully checked the node at block %d with %d peers, %d blocks behind", current.Block, current.Peers, current.Behind)
+	}
+
+	if config.Cfg.NodeJob != "" && supervised != nil {
+		if _, stalled := current.Problems[STALLED]; stalled && sinceRestart >= time.Duration(config.Cfg.NodeStallMinutes)*time.Minute {
+			if restartErr := Restart(current.Problems[STALLED]); restartErr != nil {
+				logger.Lgr.LogErrorf("Failed to restart the stalled node: %v", restartErr)
+			}
+		}
+		if _, full := current.Problems[DATA_DIR]; full && len(config.Cfg.NodePruneCommand) > 0 && time.Since(lastPrune) >= PRUNE_HOURS*time.Hour {
+			if pruneErr := Prune(); pruneErr != nil {
+				logger.Lgr.LogErrorf("Failed to prune the node: %v", pruneErr)
+			}
+		}
+	}
+
+	return current, queryErr
+}
+
+// query will fill in the sync status, latest block and peer count of the
+// given status from the node. The head of the chain is the highest block the
+// node knows of while it's syncing, or the latest block of the EthRPCURL when
+// that's a different endpoint to check the node against.
+func query(status *Status) error {
+
+	var syncing json.RawMessage
+	if callErr := eth.Call(config.Cfg.NodeRPCURL, "eth_syncing", []interface{}{}, &syncing); callErr != nil {
+		return callErr
+	}
+
+	block, blockErr := blockNumber(config.Cfg.NodeRPCURL)
+	if blockErr != nil {
+		return blockErr
+	}
+
+	var peers string
+	if callErr := eth.Call(config.Cfg.NodeRPCURL, "net_peerCount", []interface{}{}, &peers); callErr != nil {
+		return callErr
+	}
+	peerCount, peersErr := eth.ParseQuantity(peers)
+	if peersErr != nil {
+		return peersErr
+	}
+
+	status.Reachable = true
+	status.Block = block
+	status.Head = block
+	status.Peers = peerCount.Uint64()
+
+	// eth_syncing replies false once the node has caught up
+	var progress syncProgress
+	if json.Unmarshal(syncing, &progress) == nil && progress.HighestBlock != "" {
+		status.Syncing = true
+		if highest, highestErr := eth.ParseQuantity(progress.HighestBlock); highestErr == nil && highest.Uint64() > status.Head {
+			status.Head = highest.Uint64()
+		}
+	}
+
+	if config.Cfg.EthRPCURL != "" && config.Cfg.EthRPCURL != config.Cfg.NodeRPCURL {
+		if head, headErr := blockNumber(config.Cfg.EthRPCURL); headErr != nil {
+			logger.Lgr.LogErrorf("Could not read the head of the chain from %v: %v", config.Cfg.EthRPCURL, headErr)
+		} else if head > status.Head {
+			status.Head = head
+		}
+	}
+
+	status.Behind = status.Head - status.Block
+	return nil
+}
+
+// blockNumber returns the latest block of the given JSON-RPC endpoint.
+func blockNumber(endpoint string) (uint64, error) {
+
+	var number string
+	if callErr := eth.Call(endpoint, "eth_blockNumber", []interface{}{}, &number); callErr != nil {
+		return 0, callErr
+	}
+
+	block, parseErr := eth.ParseQuantity(number)
+	if parseErr != nil {
+		return 0, parseErr
+	}
+
+	return block.Uint64(), nil
+}
+
+// Restart will restart the node's NodeJob for the given reason. The
+// NodeDependentJobs are stopped first and started again once the node is
+// running and answering again, or after NODE_START_TIMEOUT_SECONDS when it
+// doesn't come back.
+func Restart(reason string) error {
+	return coordinate(reason, nil)
+}
+
+// Prune will stop the node's NodeJob, run the NodePruneCommand and start the
+// node again, stopping the NodeDependentJobs for as long as the node is down
+// the same as Restart does.
+func Prune() error {
+
+	command := config.Cfg.NodePruneCommand
+	if len(command) == 0 {
+		return fmt.Errorf("Set the NodePruneCommand to prune the node")
+	}
+
+	lastPrune = time.Now()
+
+	return coordinate(fmt.Sprintf("Its NodeDataDir was pruned with %v", strings.Join(command, " ")), func() error {
+		output, runErr := exec.Command(command[0], command[1:]...).CombinedOutput()
+		logger.Lgr.LogMessagef("The NodePruneCommand output:\n%s", output)
+		if runErr != nil {
+			return fmt.Errorf("The NodePruneCommand failed: %v", runErr)
+		}
+
+		// measure the NodeDataDir again on the next check
+		dataDirMeasured = time.Time{}
+		logger.Lgr.LogMessage("Successfully pruned the node")
+		return nil
+	})
+}
+
+// coordinate will stop the NodeDependentJobs which are running, restart the
+// NodeJob, wait for the node to come back and start the dependent jobs again.
+// When whileStopped is given the NodeJob is stopped instead of restarted,
+// whileStopped is run and then the NodeJob is started again.
+func coordinate(reason string, whileStopped func() error) error {
+
+	restartLock.Lock()
+	defer restartLock.Unlock()
+
+	ldr := supervised
+	if ldr == nil || config.Cfg.NodeJob == "" {
+		return fmt.Errorf("Set the NodeJob to the loader job which runs the node to restart it")
+	}
+
+	nodeJob, found := job(ldr, config.Cfg.NodeJob)
+	if !found {
+		return fmt.Errorf("The NodeJob %v isn't one of the loader's jobs", config.Cfg.NodeJob)
+	}
+	if nodeJob.Disabled {
+		return fmt.Errorf("The NodeJob %v has been stopped and won't be restarted", config.Cfg.NodeJob)
+	}
+
+	logger.Lgr.LogMessagef("Restarting the node: %v", reason)
+	statusLock.Lock()
+	lastRestart = time.Now()
+	statusLock.Unlock()
+
+	var stopped []string
+	for _, dependent := range config.Cfg.NodeDependentJobs {
+		if dependentJob, found := job(ldr, dependent); !found || dependentJob.Disabled {
+			continue
+		}
+		if stopErr := ldr.Stop(dependent); stopErr != nil {
+			logger.Lgr.LogErrorf("Could not stop the node's dependent job %v: %v", dependent, stopErr)
+			continue
+		}
+		stopped = append(stopped, dependent)
+	}
+
+	defer func() {
+		for _, dependent := range stopped {
+			if startErr := ldr.Start(dependent); startErr != nil {
+				logger.Lgr.LogErrorf("Could not start the node's dependent job %v again: %v", dependent, startErr)
+			}
+		}
+	}()
+
+	var coordinateErr error
+	if whileStopped != nil {
+		if stopErr := ldr.Stop(config.Cfg.NodeJob); stopErr != nil {
+			return stopErr
+		}
+		if exitErr := waitFor(ldr, func(nodeJob loader.JobStatus) bool { return !nodeJob.Running }); exitErr != nil {
+			coordinateErr = exitErr
+		} else {
+			coordinateErr = whileStopped()
+		}
+		if startErr := ldr.Start(config.Cfg.NodeJob); startErr != nil {
+			return startErr
+		}
+	} else if restartErr := ldr.Restart(config.Cfg.NodeJob); restartErr != nil {
+		// the loader starts it again when it isn't running
+		logger.Lgr.LogErrorf("Could not kill the node: %v", restartErr)
+	}
+
+	cameBack := waitFor(ldr, func(restartedJob loader.JobStatus) bool {
+		if !restartedJob.Running || restartedJob.Runs <= nodeJob.Runs {
+			return false
+		}
+		_, blockErr := blockNumber(config.Cfg.NodeRPCURL)
+		return blockErr == nil
+	})
+	if cameBack != nil {
+		return fmt.Errorf("The node didn't come back after restarting: %v", cameBack)
+	}
+
+	events.Publish(events.NodeRestarted{Reason: reason, Dependents: stopped})
+	logger.Lgr.LogMessage("Successfully restarted the node")
+
+	return coordinateErr
+}
+
+// waitFor polls the NodeJob every NODE_POLL_SECONDS until done returns true
+// for it or NODE_START_TIMEOUT_SECONDS pass.
+func waitFor(ldr *loader.Loader, done func(loader.JobStatus) bool) error {
+
+	deadline := time.Now().Add(NODE_START_TIMEOUT_SECONDS * time.Second)
+	for time.Now().Before(deadline) {
+		if nodeJob, found := job(ldr, config.Cfg.NodeJob); found && done(nodeJob) {
+			return nil
+		}
+		time.Sleep(NODE_POLL_SECONDS * time.Second)
+	}
+
+	return fmt.Errorf("Gave up after %d seconds", NODE_START_TIMEOUT_SECONDS)
+}
+
+// job returns the status of the loader's job with the given name.
+func job(ldr *loader.Loader, name string) (loader.JobStatus, bool) {
+	for _, status := range ldr.Jobs() {
+		if status.Name == name {
+			return status, true
+		}
+	}
+	return loader.JobStatus{}, false
+}
+
+// dirSize returns the combined size of every file under the given directory.
+func dirSize(dir string) (int64, error) {
+
+	var size int64
+	walkErr := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// files can be removed by the node while it's being walked
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size, walkErr
+}
+
+// Latest returns the status of the node as of the last check.
+func Latest() Status {
+
+	statusLock.Lock()
+	defer statusLock.Unlock()
+
+	return latest
+}
+
+// Metrics returns the node's latest block, how far behind it is, its peer
+// count and the size of its NodeDataDir for the profile history.
+func Metrics() (map[string]float64, error) {
+
+	metrics := make(map[string]float64)
+
+	current := Latest()
+	if !current.Reachable {
+		return metrics, nil
+	}
+
+	metrics["node_block"] = float64(current.Block)
+	metrics["node_behind_blocks"] = float64(current.Behind)
+	metrics["node_peers"] = float64(current.Peers)
+	if config.Cfg.NodeDataDir != "" {
+		metrics["node_datadir_gb"] = float64(current.DataDirBytes) / BYTES_PER_GB
+	}
+
+	return metrics, nil
+}
+
+// Summary describes the node as of the last check for the status report.
+func Summary() (string, error) {
+
+	if config.Cfg.NodeRPCURL == "" {
+		return "No node is supervised. Set NodeRPCURL to supervise one\n", nil
+	}
+
+	current := Latest()
+	if current.Time == 0 {
+		return "The node hasn't been checked yet\n", nil
+	}
+
+	var summary bytes.Buffer
+	summary.WriteString(fmt.Sprintf("%v as of %v ago:\n", config.Cfg.NodeRPCURL, time.Since(time.Unix(current.Time, 0)).Round(time.Second)))
+	if current.Reachable {
+		syncing := "in sync"
+		if current.Syncing {
+			syncing = "syncing"
+		}
+		summary.WriteString(fmt.Sprintf("Block %d of %d, %d behind and %v, with %d peers\n", current.Block, current.Head, current.Behind, syncing, current.Peers))
+	}
+	if config.Cfg.NodeDataDir != "" {
+		summary.WriteString(fmt.Sprintf("NodeDataDir: %v\n", utils.FormatBytes(current.DataDirBytes)))
+	}
+
+	problems := make([]string, 0, len(current.Problems))
+	for _, description := range current.Problems {
+		problems = append(problems, description)
+	}
+	sort.Strings(problems)
+	for _, description := range problems {
+		summary.WriteString(fmt.Sprintf("Problem: %v\n", description))
+	}
+
+	statusLock.Lock()
+	if !lastRestart.IsZero() {
+		summary.WriteString(fmt.Sprintf("Last restarted %v ago\n", time.Since(lastRestart).Round(time.Minute)))
+	}
+	statusLock.Unlock()
+
+	return summary.String(), nil
+}
@@ -0,0 +1,246 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/loader"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+func TestMain(m *testing.M) {
+
+	logErr := logger.StandardLogger("node_test")
+	if logErr != nil {
+		fmt.Println(fmt.Sprintf("Could not initialize logger: %v", logErr))
+		return
+	}
+
+	configErr := config.FromFile()
+	if configErr != nil {
+		return
+	}
+
+	result := m.Run()
+	os.Exit(result)
+}
+
+// fakeNode answers the JSON-RPC calls made to a node from its fields.
+type fakeNode struct {
+	lock    sync.Mutex
+	block   uint64
+	highest uint64
+	peers   uint64
+}
+
+func (fn *fakeNode) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+
+	var call struct {
+		Method string `json:"method"`
+	}
+	json.NewDecoder(request.Body).Decode(&call)
+
+	fn.lock.Lock()
+	defer fn.lock.Unlock()
+
+	var result string
+	switch call.Method {
+	case "eth_syncing":
+		result = "false"
+		if fn.highest > fn.block {
+			result = fmt.Sprintf(`{"currentBlock":"0x%x","highestBlock":"0x%x"}`, fn.block, fn.highest)
+		}
+	case "eth_blockNumber":
+		result = fmt.Sprintf(`"0x%x"`, fn.block)
+	case "net_peerCount":
+		result = fmt.Sprintf(`"0x%x"`, fn.peers)
+	default:
+		fmt.Fprint(writer, `{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"the method does not exist"}}`)
+		return
+	}
+
+	fmt.Fprintf(writer, `{"jsonrpc":"2.0","id":1,"result":%v}`, result)
+}
+
+// set changes what the fake node answers with.
+func (fn *fakeNode) set(block uint64, highest uint64, peers uint64) {
+	fn.lock.Lock()
+	defer fn.lock.Unlock()
+	fn.block, fn.highest, fn.peers = block, highest, peers
+}
+
+func TestCheck(t *testing.T) {
+
+	defer func(previous *config.Config) { config.Cfg = previous }(config.Cfg)
+	testConfig := *config.Cfg
+	config.Cfg = &testConfig
+
+	fake := &fakeNode{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	dataDir, dirErr := ioutil.TempDir("", "node_test")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(dataDir)
+	ioutil.WriteFile(filepath.Join(dataDir, "chaindata"), make([]byte, 2048), 0600)
+
+	config.Cfg.NodeRPCURL = server.URL
+	config.Cfg.EthRPCURL = ""
+	config.Cfg.NodeMaxBehindBlocks = 50
+	config.Cfg.NodeMinPeers = 3
+	config.Cfg.NodeStallMinutes = 15
+	config.Cfg.NodeJob = ""
+	config.Cfg.NodeDataDir = dataDir
+	config.Cfg.NodeMaxDataGB = 0
+
+	var publishedLock sync.Mutex
+	var published []string
+	unsubscribe := events.Subscribe("node_test", func(record events.Record) {
+		if unhealthy, isUnhealthy := record.Event.(events.NodeUnhealthy); isUnhealthy {
+			publishedLock.Lock()
+			published = append(published, unhealthy.Problem)
+			publishedLock.Unlock()
+		}
+	})
+	defer unsubscribe()
+
+	fake.set(1000, 0, 10)
+	status, checkErr := Check()
+	if checkErr != nil || len(status.Problems) != 0 || status.Block != 1000 || status.Peers != 10 || status.DataDirBytes != 2048 {
+		t.Fatalf("expected a healthy node, got: %+v %v", status, checkErr)
+	}
+
+	// syncing far behind the head with too few peers, checked twice
+	fake.set(1000, 1200, 1)
+	Check()
+	status, _ = Check()
+	if !status.Syncing || status.Behind != 200 || len(status.Problems) != 2 {
+		t.Errorf("expected the node to be behind with too few peers, got: %+v", status)
+	}
+
+	summary, _ := Summary()
+	for _, expected := range []string{
+		"Block 1000 of 1200, 200 behind and syncing, with 1 peers",
+		"Problem: The node has 1 peers, fewer than the 3 it needs",
+		"Problem: The node is 200 blocks behind the head of the chain at block 1200",
+	} {
+		if !strings.Contains(summary, expected) {
+			t.Errorf("expected the summary to contain %q, got: %v", expected, summary)
+		}
+	}
+
+	// stalled without importing a block
+	statusLock.Lock()
+	lastProgress = time.Now().Add(-time.Hour)
+	statusLock.Unlock()
+	if status, _ = Check(); status.Problems[STALLED] == "" {
+		t.Errorf("expected the node to have stalled, got: %+v", status)
+	}
+
+	// caught up again
+	fake.set(1201, 0, 10)
+	if status, _ = Check(); len(status.Problems) != 0 {
+		t.Errorf("expected the node to be healthy again, got: %+v", status)
+	}
+
+	server.Close()
+	if status, checkErr = Check(); checkErr == nil || status.Reachable || status.Problems[UNREACHABLE] == "" {
+		t.Errorf("expected the node to be unreachable, got: %+v %v", status, checkErr)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	publishedLock.Lock()
+	defer publishedLock.Unlock()
+	if strings.Join(published, ",") != BEHIND+","+PEERS+","+STALLED+","+UNREACHABLE && strings.Join(published, ",") != PEERS+","+BEHIND+","+STALLED+","+UNREACHABLE {
+		t.Errorf("expected each problem to be published once, got: %v", published)
+	}
+}
+
+func TestRestart(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("the test jobs sleep")
+	}
+
+	defer func(previous *config.Config) { config.Cfg = previous }(config.Cfg)
+	testConfig := *config.Cfg
+	config.Cfg = &testConfig
+
+	server := httptest.NewServer(&fakeNode{block: 1000, peers: 10})
+	defer server.Close()
+
+	ldr := &loader.Loader{Processes: []loader.LoaderProcess{
+		{Name: "geth", Command: "sleep", Arguments: []string{"30"}, Lgr: logger.Lgr},
+		{Name: "proxy", Command: "sleep", Arguments: []string{"30"}, Lgr: logger.Lgr},
+		{Name: "stopped", Command: "sleep", Arguments: []string{"30"}, Lgr: logger.Lgr},
+	}}
+	ldr.Run()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ldr.Shutdown(ctx)
+	}()
+	ldr.Stop("stopped")
+
+	for attempt := 0; attempt < 50 && !ldr.Jobs()[0].Running; attempt++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	config.Cfg.NodeRPCURL = server.URL
+	config.Cfg.NodeJob = "geth"
+	config.Cfg.NodeDependentJobs = []string{"proxy", "stopped"}
+
+	supervised = nil
+	if restartErr := Restart("testing"); restartErr == nil {
+		t.Errorf("expected the restart to fail without a loader")
+	}
+
+	supervised = ldr
+	defer func() { supervised = nil }()
+
+	var restartedLock sync.Mutex
+	var restarted events.NodeRestarted
+	unsubscribe := events.Subscribe("node_test_restart", func(record events.Record) {
+		if nodeRestarted, isRestarted := record.Event.(events.NodeRestarted); isRestarted {
+			restartedLock.Lock()
+			restarted = nodeRestarted
+			restartedLock.Unlock()
+		}
+	})
+	defer unsubscribe()
+
+	runs := ldr.Jobs()[0].Runs
+	if restartErr := Restart("testing"); restartErr != nil {
+		t.Fatal(restartErr)
+	}
+
+	jobs := ldr.Jobs()
+	if !jobs[0].Running || jobs[0].Runs != runs+1 {
+		t.Errorf("expected the node to have been restarted, got: %+v", jobs[0])
+	}
+	if jobs[1].Disabled || !jobs[2].Disabled {
+		t.Errorf("expected only the dependent job which was running to be started again, got: %+v", jobs)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	restartedLock.Lock()
+	defer restartedLock.Unlock()
+	if restarted.Reason != "testing" || strings.Join(restarted.Dependents, ",") != "proxy" {
+		t.Errorf("expected the restart to be published, got: %+v", restarted)
+	}
+}
@@ -0,0 +1,255 @@
+package operations
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The states an operation moves through
+const PENDING = "pending"
+const RUNNING = "running"
+const SUCCEEDED = "succeeded"
+const FAILED = "failed"
+
+// The file extension operations are persisted with
+const OPERATION_EXTENSION = ".json"
+
+// The maximum number of times an operation is started again after the agent
+// restarted while it was running
+const MAX_OPERATION_ATTEMPTS = 3
+
+// Operation is a slow task started via REST which runs in the background. Its
+// progress and result are saved to disk every time they change so they can be
+// queried after the fact and so the operation can be resumed if the agent
+// restarts while it's running.
+type Operation struct {
+	ID       string    `json:"id"`
+	Kind     string    `json:"kind"`
+	State    string    `json:"state"`
+	Progress int       `json:"progress"` // How far along the operation is from 0 to 100
+	Message  string    `json:"message"`  // A human readable description of what the operation is currently doing
+	Result   string    `json:"result"`
+	Error    string    `json:"error,omitempty"`
+	Attempts int       `json:"attempts"` // The number of times the operation has been started
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+}
+
+// Progress is handed to a Runner so it can report how far along it is.
+type Progress func(percent int, message string)
+
+// Runner performs the work of one kind of operation and returns a human
+// readable result. Runners must be safe to start again from scratch since an
+// operation interrupted by a restart is run again.
+type Runner func(progress Progress) (string, error)
+
+var runners = make(map[string]Runner)
+var operations = make(map[string]*Operation)
+var lock sync.Mutex
+
+// RegisterKind will make operations of the given kind startable. Every kind
+// must be registered before Load is called so interrupted operations can be
+// resumed.
+func RegisterKind(kind string, runner Runner) {
+	lock.Lock()
+	defer lock.Unlock()
+	runners[kind] = runner
+}
+
+// Start will create a new operation of the given kind, run it in the
+// background, and return it immediately in the PENDING state.
+func Start(kind string) (Operation, error) {
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, registered := runners[kind]; !registered {
+		return Operation{}, fmt.Errorf("Unknown operation kind: %v", kind)
+	}
+
+	id, idErr := utils.NewULID()
+	if idErr != nil {
+		return Operation{}, idErr
+	}
+
+	now := time.Now()
+	operation := &Operation{ID: id, Kind: kind, State: PENDING, Created: now, Updated: now}
+	operations[operation.ID] = operation
+
+	if saveErr := save(operation); saveErr != nil {
+		delete(operations, operation.ID)
+		return Operation{}, saveErr
+	}
+
+	logger.Lgr.LogMessagef("Successfully created operation %v of kind %v", operation.ID, kind)
+
+	go run(operation.ID)
+
+	return *operation, nil
+}
+
+// Get returns a copy of the operation with the given ID and whether it exists.
+func Get(id string) (Operation, bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	operation, exists := operations[id]
+	if !exists {
+		return Operation{}, false
+	}
+	return *operation, true
+}
+
+// List returns a copy of every known operation, oldest first.
+func List() []Operation {
+	lock.Lock()
+	defer lock.Unlock()
+
+	list := make([]Operation, 0, len(operations))
+	for _, operation := range operations {
+		list = append(list, *operation)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// Load will read every operation saved in the OperationsDir. Operations which
+// were still pending or running when the agent stopped are started again, up
+// to MAX_OPERATION_ATTEMPTS times, or marked as failed if they can't be.
+func Load() error {
+
+	if mkdirErr := os.MkdirAll(config.Cfg.OperationsDir, 0700); mkdirErr != nil {
+		return mkdirErr
+	}
+
+	fileInfos, readErr := ioutil.ReadDir(config.Cfg.OperationsDir)
+	if readErr != nil {
+		return readErr
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	for _, fileInfo := range fileInfos {
+		if !strings.HasSuffix(fileInfo.Name(), OPERATION_EXTENSION) {
+			continue
+		}
+
+		fileBytes, fileErr := ioutil.ReadFile(filepath.Join(config.Cfg.OperationsDir, fileInfo.Name()))
+		if fileErr != nil {
+			logger.Lgr.LogErrorf("Could not read saved operation %v: %v", fileInfo.Name(), fileErr)
+			continue
+		}
+
+		operation := &Operation{}
+		if jsonErr := json.Unmarshal(fileBytes, operation); jsonErr != nil {
+			logger.Lgr.LogErrorf("Could not parse saved operation %v: %v", fileInfo.Name(), jsonErr)
+			continue
+		}
+
+		operations[operation.ID] = operation
+
+		if operation.State != PENDING && operation.State != RUNNING {
+			continue
+		}
+
+		if _, registered := runners[operation.Kind]; !registered || operation.Attempts >= MAX_OPERATION_ATTEMPTS {
+			operation.State = FAILED
+			operation.Error = fmt.Sprintf("interrupted by a restart after %d attempts", operation.Attempts)
+			operation.Updated = time.Now()
+			save(operation)
+			logger.Lgr.LogErrorf("Operation %v of kind %v was interrupted and can't be resumed", operation.ID, operation.Kind)
+			continue
+		}
+
+		logger.Lgr.LogMessagef("Resuming operation %v of kind %v interrupted by a restart", operation.ID, operation.Kind)
+		operation.State = PENDING
+		go run(operation.ID)
+	}
+
+	logger.Lgr.LogMessagef("Successfully loaded %d operations from %v", len(operations), config.Cfg.OperationsDir)
+
+	return nil
+}
+
+// run will execute the runner for the operation with the given ID, recording
+// its progress and result as it goes.
+func run(id string) {
+
+	lock.Lock()
+	operation := operations[id]
+	runner := runners[operation.Kind]
+	operation.State = RUNNING
+	operation.Attempts++
+	operation.Updated = time.Now()
+	save(operation)
+	lock.Unlock()
+
+	result, runErr := runner(func(percent int, message string) {
+		lock.Lock()
+		defer lock.Unlock()
+		operation.Progress = percent
+		operation.Message = message
+		operation.Updated = time.Now()
+		save(operation)
+	})
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	operation.Result = result
+	operation.Updated = time.Now()
+	if runErr != nil {
+		operation.State = FAILED
+		operation.Error = runErr.Error()
+		logger.Lgr.LogErrorf("Operation %v of kind %v failed: %v", operation.ID, operation.Kind, runErr)
+	} else {
+		operation.State = SUCCEEDED
+		operation.Progress = 100
+		logger.Lgr.LogMessagef("Successfully finished operation %v of kind %v", operation.ID, operation.Kind)
+	}
+	save(operation)
+}
+
+// save will write the given operation to its file in the OperationsDir. The
+// file is replaced atomically so a crash can't leave it half written. Must be
+// called with the lock held.
+func save(operation *Operation) error {
+
+	jsonBytes, jsonErr := json.MarshalIndent(operation, "", "  ")
+	if jsonErr != nil {
+		return jsonErr
+	}
+
+	if mkdirErr := os.MkdirAll(config.Cfg.OperationsDir, 0700); mkdirErr != nil {
+		logger.Lgr.LogErrorf("Could not create the operations directory: %v", mkdirErr)
+		return mkdirErr
+	}
+
+	operationPath := filepath.Join(config.Cfg.OperationsDir, operation.ID+OPERATION_EXTENSION)
+	tempPath := operationPath + ".tmp"
+
+	if writeErr := ioutil.WriteFile(tempPath, jsonBytes, 0600); writeErr != nil {
+		logger.Lgr.LogErrorf("Could not save operation %v: %v", operation.ID, writeErr)
+		return writeErr
+	}
+
+	if renameErr := os.Rename(tempPath, operationPath); renameErr != nil {
+		logger.Lgr.LogErrorf("Could not save operation %v: %v", operation.ID, renameErr)
+		return renameErr
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package operations
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+func TestMain(m *testing.M) {
+
+	logErr := logger.StandardLogger("operations_test")
+	if logErr != nil {
+		fmt.Println(fmt.Sprintf("Could not initialize logger: %v", logErr))
+		return
+	}
+
+	configErr := config.FromFile()
+	if configErr != nil {
+		fmt.Println(configErr)
+		return
+	}
+
+	operationsDir, dirErr := ioutil.TempDir("", "operations_test")
+	if dirErr != nil {
+		fmt.Println(dirErr)
+		return
+	}
+	config.Cfg.OperationsDir = operationsDir
+
+	result := m.Run()
+	os.RemoveAll(operationsDir)
+	os.Exit(result)
+}
+
+// waitForState will wait for the operation with the given id to finish
+// and return it.
+func waitForState(t *testing.T, id string) Operation {
+	for attempt := 0; attempt < 100; attempt++ {
+		operation, exists := Get(id)
+		if !exists {
+			t.Fatalf("operation %v doesn't exist", id)
+		}
+		if operation.State == SUCCEEDED || operation.State == FAILED {
+			return operation
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("operation %v never finished", id)
+	return Operation{}
+}
+
+func TestStartOperation(t *testing.T) {
+
+	RegisterKind("succeeds", func(progress Progress) (string, error) {
+		progress(50, "half way")
+		return "done", nil
+	})
+	RegisterKind("fails", func(progress Progress) (string, error) {
+		return "", errors.New("broken")
+	})
+
+	if _, startErr := Start("unknown"); startErr == nil {
+		t.Error("expected an unknown kind to be refused")
+	}
+
+	started, startErr := Start("succeeds")
+	if startErr != nil {
+		t.Fatal(startErr)
+	}
+
+	succeeded := waitForState(t, started.ID)
+	if succeeded.State != SUCCEEDED || succeeded.Result != "done" || succeeded.Progress != 100 || succeeded.Attempts != 1 {
+		t.Errorf("unexpected operation: %+v", succeeded)
+	}
+
+	failing, startErr := Start("fails")
+	if startErr != nil {
+		t.Fatal(startErr)
+	}
+
+	failed := waitForState(t, failing.ID)
+	if failed.State != FAILED || failed.Error != "broken" {
+		t.Errorf("unexpected operation: %+v", failed)
+	}
+}
+
+func TestLoadResumesInterruptedOperations(t *testing.T) {
+
+	RegisterKind("resumable", func(progress Progress) (string, error) {
+		return "resumed", nil
+	})
+
+	now := time.Now()
+	interrupted := &Operation{ID: "interrupted", Kind: "resumable", State: RUNNING, Attempts: 1, Created: now, Updated: now}
+	unknown := &Operation{ID: "unknown", Kind: "unregistered", State: RUNNING, Attempts: 1, Created: now, Updated: now}
+
+	lock.Lock()
+	save(interrupted)
+	save(unknown)
+	lock.Unlock()
+
+	if loadErr := Load(); loadErr != nil {
+		t.Fatal(loadErr)
+	}
+
+	resumed := waitForState(t, "interrupted")
+	if resumed.State != SUCCEEDED || resumed.Attempts != 2 {
+		t.Errorf("expected the interrupted operation to be resumed, got: %+v", resumed)
+	}
+
+	abandoned := waitForState(t, "unknown")
+	if abandoned.State != FAILED {
+		t.Errorf("expected the unregistered operation to fail, got: %+v", abandoned)
+	}
+}
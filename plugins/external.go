@@ -0,0 +1,261 @@
+package plugins
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+// How long an external plugin can take to respond to a request before it's
+// killed and started again on the next one. In seconds
+const REQUEST_TIMEOUT_SECONDS = 10
+
+// The largest single response an external plugin can write. In bytes
+const MAX_RESPONSE_BYTES = 1024 * 1024
+
+// The requests an external plugin can receive
+const DESCRIBE_METHOD = "describe"
+const COLLECT_METHOD = "collect"
+const STATUS_METHOD = "status"
+const COMMAND_METHOD = "command"
+
+// pluginRequest is a single line written to the stdin of an external plugin.
+type pluginRequest struct {
+	Id      uint64   `json:"id"`
+	Method  string   `json:"method"`
+	Command string   `json:"command,omitempty"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// pluginResponse is a single line read from the stdout of an external plugin.
+type pluginResponse struct {
+	Id       uint64             `json:"id"`
+	Error    string             `json:"error,omitempty"`
+	Collects bool               `json:"collects,omitempty"`
+	Reports  bool               `json:"reports,omitempty"`
+	Commands []string           `json:"commands,omitempty"`
+	Metrics  map[string]float64 `json:"metrics,omitempty"`
+	Status   string             `json:"status,omitempty"`
+	Output   string             `json:"output,omitempty"`
+}
+
+// externalPlugin is a plugin run as a separate process. Requests are sent one
+// at a time. A process which exits or stops responding is started again on
+// the next request.
+type externalPlugin struct {
+	pluginConfig config.PluginConfig
+	description  pluginResponse
+	lgr          *logger.Logger
+	cmd          *exec.Cmd
+	stdin        io.WriteCloser
+	responses    chan []byte
+	nextId       uint64
+	lock         sync.Mutex
+}
+
+// startExternal will start the process of the given plugin and ask it what it
+// handles.
+func startExternal(pluginConfig config.PluginConfig) (*externalPlugin, error) {
+
+	lgr, loggerErr := logger.CustomLogger("plugin_"+pluginConfig.Name, 1, 50000, 604800)
+	if loggerErr != nil {
+		return nil, loggerErr
+	}
+
+	ep := &externalPlugin{pluginConfig: pluginConfig, lgr: lgr}
+
+	description, describeErr := ep.call(pluginRequest{Method: DESCRIBE_METHOD})
+	if describeErr != nil {
+		ep.stop(context.Background())
+		return nil, describeErr
+	}
+
+	ep.description = description
+	return ep, nil
+}
+
+// Name returns the name of the plugin from the config.
+func (ep *externalPlugin) Name() string {
+	return ep.pluginConfig.Name
+}
+
+// Collect asks the plugin for its metrics.
+func (ep *externalPlugin) Collect() (map[string]float64, error) {
+	response, callErr := ep.call(pluginRequest{Method: COLLECT_METHOD})
+	return response.Metrics, callErr
+}
+
+// StatusSection asks the plugin for its status report section.
+func (ep *externalPlugin) StatusSection() (string, error) {
+	response, callErr := ep.call(pluginRequest{Method: STATUS_METHOD})
+	return response.Status, callErr
+}
+
+// Commands returns the commands the plugin said it handles when it started.
+func (ep *externalPlugin) Commands() []string {
+	return ep.description.Commands
+}
+
+// HandleCommand asks the plugin to run the given command.
+func (ep *externalPlugin) HandleCommand(name string, args []string) (string, error) {
+	response, callErr := ep.call(pluginRequest{Method: COMMAND_METHOD, Command: name, Args: args})
+	return response.Output, callErr
+}
+
+// call will send the given request to the plugin, starting its process first
+// if it isn't running, and return its response. The process is killed if it
+// doesn't respond within REQUEST_TIMEOUT_SECONDS or responds with something
+// other than a response to the request.
+func (ep *externalPlugin) call(request pluginRequest) (pluginResponse, error) {
+
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+
+	var response pluginResponse
+
+	if ep.cmd == nil {
+		if startErr := ep.start(); startErr != nil {
+			return response, startErr
+		}
+	}
+
+	ep.nextId++
+	request.Id = ep.nextId
+
+	requestBytes, jsonErr := json.Marshal(request)
+	if jsonErr != nil {
+		return response, jsonErr
+	}
+
+	if _, writeErr := ep.stdin.Write(append(requestBytes, '\n')); writeErr != nil {
+		ep.kill()
+		return response, fmt.Errorf("Unable to send the %v request to plugin %v: %v", request.Method, ep.pluginConfig.Name, writeErr)
+	}
+
+	var line []byte
+	select {
+	case received, open := <-ep.responses:
+		if !open {
+			ep.kill()
+			return response, fmt.Errorf("Plugin %v exited without responding to the %v request", ep.pluginConfig.Name, request.Method)
+		}
+		line = received
+	case <-time.After(REQUEST_TIMEOUT_SECONDS * time.Second):
+		ep.kill()
+		return response, fmt.Errorf("Plugin %v didn't respond to the %v request within %d seconds", ep.pluginConfig.Name, request.Method, REQUEST_TIMEOUT_SECONDS)
+	}
+
+	if jsonErr := json.Unmarshal(line, &response); jsonErr != nil || response.Id != request.Id {
+		ep.kill()
+		return pluginResponse{}, fmt.Errorf("Plugin %v responded to the %v request with something other than its response: %v", ep.pluginConfig.Name, request.Method, string(line))
+	}
+
+	if response.Error != "" {
+		return response, fmt.Errorf("%v", response.Error)
+	}
+
+	return response, nil
+}
+
+// start will start the process of the plugin with its stdout read one line at
+// a time into the responses channel, which is closed when the process exits.
+// Must be called while holding the lock.
+func (ep *externalPlugin) start() error {
+
+	cmd := exec.Command(ep.pluginConfig.Command, ep.pluginConfig.Args...)
+	cmd.Stderr = ep.lgr
+
+	stdin, stdinErr := cmd.StdinPipe()
+	if stdinErr != nil {
+		return stdinErr
+	}
+
+	stdout, stdoutErr := cmd.StdoutPipe()
+	if stdoutErr != nil {
+		return stdoutErr
+	}
+
+	if startErr := cmd.Start(); startErr != nil {
+		return startErr
+	}
+
+	responses := make(chan []byte)
+	go func() {
+		defer close(responses)
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 4096), MAX_RESPONSE_BYTES)
+		for scanner.Scan() {
+			responses <- append([]byte{}, scanner.Bytes()...)
+		}
+		cmd.Wait()
+	}()
+
+	ep.cmd = cmd
+	ep.stdin = stdin
+	ep.responses = responses
+
+	logger.Lgr.LogMessagef("Successfully started plugin %v as process %d", ep.pluginConfig.Name, cmd.Process.Pid)
+	return nil
+}
+
+// kill will kill the process of the plugin so it's started again on the next
+// request. Must be called while holding the lock.
+func (ep *externalPlugin) kill() {
+
+	if ep.cmd == nil {
+		return
+	}
+
+	ep.cmd.Process.Kill()
+	ep.stdin.Close()
+
+	// drain anything left so the reader can finish
+	go func(responses chan []byte) {
+		for range responses {
+		}
+	}(ep.responses)
+
+	ep.cmd = nil
+	ep.stdin = nil
+	ep.responses = nil
+}
+
+// stop will close the stdin of the plugin, which asks it to exit, and kill it
+// if it hasn't by the time the given context is done.
+func (ep *externalPlugin) stop(ctx context.Context) error {
+
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+
+	if ep.cmd == nil {
+		return nil
+	}
+
+	ep.stdin.Close()
+
+	for 1 == 1 {
+		select {
+		case _, open := <-ep.responses:
+			if !open {
+				ep.cmd = nil
+				ep.stdin = nil
+				ep.responses = nil
+				logger.Lgr.LogMessagef("Successfully stopped plugin %v", ep.pluginConfig.Name)
+				return nil
+			}
+		case <-ctx.Done():
+			ep.kill()
+			return fmt.Errorf("Killed plugin %v which didn't exit in time", ep.pluginConfig.Name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,203 @@
+// The plugins package lets custom metric collectors, status report sections
+// and command handlers be added to the agent without forking it. Plugins are
+// either compiled in, by registering them with Register from the init function
+// of a package imported by main, or external processes listed under Plugins in
+// the config which speak JSON over stdin and stdout.
+//
+// An external plugin receives one JSON request per line on stdin and must
+// write exactly one JSON response per line to stdout, echoing the id of the
+// request. Anything written to stderr is logged. The requests are:
+//
+//	{"id": 1, "method": "describe"}
+//	{"id": 2, "method": "collect"}
+//	{"id": 3, "method": "status"}
+//	{"id": 4, "method": "command", "command": "name", "args": ["arg"]}
+//
+// and the responses:
+//
+//	{"id": 1, "collects": true, "reports": true, "commands": ["name"]}
+//	{"id": 2, "metrics": {"temperature_c": 61.5}}
+//	{"id": 3, "status": "multiple lines for the status report"}
+//	{"id": 4, "output": "the result of the command"}
+//
+// Any response can carry an "error" instead. describe is sent once when the
+// plugin starts and says which of the other requests it handles.
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/inbox"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/profiler"
+	"github.com/seantcanavan/anon-eth-net/reporter"
+)
+
+// Plugin is a piece of custom behaviour added to the agent. What it adds
+// depends on which of Collector, StatusReporter and Commander it also
+// implements.
+type Plugin interface {
+	Name() string // Prefixes the metrics the plugin collects and titles its status report section
+}
+
+// Collector is a plugin which adds metrics to every profiler sample. Each
+// metric is recorded as the name of the plugin, an underscore, and the name
+// of the metric.
+type Collector interface {
+	Collect() (map[string]float64, error)
+}
+
+// StatusReporter is a plugin which adds a section to every status report.
+type StatusReporter interface {
+	StatusSection() (string, error)
+}
+
+// Commander is a plugin which handles commands delivered by email, the fleet
+// server, the command channel or MQTT. Commands which are already handled by
+// the agent, or by another plugin, are ignored.
+type Commander interface {
+	Commands() []string
+	HandleCommand(name string, args []string) (string, error)
+}
+
+var registered []Plugin
+var loaded []Plugin
+var pluginsLock sync.Mutex
+
+// Register will add the given compiled in plugin to the agent when Load is
+// called. Meant to be called from an init function.
+func Register(plugin Plugin) {
+	pluginsLock.Lock()
+	defer pluginsLock.Unlock()
+	registered = append(registered, plugin)
+}
+
+// Load will start every external plugin in the config and hook every plugin
+// up to the profiler, the reporter and the command handlers. An external
+// plugin which can't be started is logged and left out rather than stopping
+// the agent.
+func Load() {
+
+	pluginsLock.Lock()
+	plugins := append([]Plugin{}, registered...)
+	pluginsLock.Unlock()
+
+	for _, pluginConfig := range config.Cfg.Plugins {
+		external, startErr := startExternal(pluginConfig)
+		if startErr != nil {
+			logger.Lgr.LogErrorf("Failed to start plugin %v: %v", pluginConfig.Name, startErr)
+			continue
+		}
+		plugins = append(plugins, external)
+	}
+
+	for _, plugin := range plugins {
+		hookUp(plugin)
+	}
+
+	pluginsLock.Lock()
+	loaded = plugins
+	pluginsLock.Unlock()
+}
+
+// hookUp will register whatever the given plugin adds to the agent.
+func hookUp(plugin Plugin) {
+
+	name := plugin.Name()
+	var adds []string
+
+	collector, collects := plugin.(Collector)
+	statusReporter, reports := plugin.(StatusReporter)
+	commander, _ := plugin.(Commander)
+
+	// an external plugin says which requests it handles when it starts
+	if external, isExternal := plugin.(*externalPlugin); isExternal {
+		collects = external.description.Collects
+		reports = external.description.Reports
+	}
+
+	if collects {
+		profiler.RegisterCollector(name, func() (map[string]float64, error) {
+			metrics, collectErr := collector.Collect()
+			if collectErr != nil {
+				return nil, collectErr
+			}
+			prefixed := make(map[string]float64, len(metrics))
+			for metric, value := range metrics {
+				prefixed[name+"_"+metric] = value
+			}
+			return prefixed, nil
+		})
+		adds = append(adds, "metrics")
+	}
+
+	if reports {
+		reporter.RegisterStatusSection(name, statusReporter.StatusSection)
+		adds = append(adds, "a status report section")
+	}
+
+	if commander != nil {
+		for _, command := range commander.Commands() {
+			if inbox.Registered(command) {
+				logger.Lgr.LogErrorf("Plugin %v can't handle the %v command which is already handled", name, command)
+				continue
+			}
+			commandName := command
+			inbox.RegisterCommand(commandName, func(args []string) (string, []reporter.Attachment, error) {
+				output, commandErr := commander.HandleCommand(commandName, args)
+				return output, nil, commandErr
+			})
+			adds = append(adds, "the "+command+" command")
+		}
+	}
+
+	logger.Lgr.LogMessagef("Successfully loaded plugin %v which adds %v", name, strings.Join(adds, ", "))
+}
+
+// StatusSummary lists every loaded plugin.
+func StatusSummary() (string, error) {
+
+	pluginsLock.Lock()
+	defer pluginsLock.Unlock()
+
+	if len(loaded) == 0 {
+		return "No plugins are loaded\n", nil
+	}
+
+	var names []string
+	for _, plugin := range loaded {
+		names = append(names, plugin.Name())
+	}
+	sort.Strings(names)
+
+	return fmt.Sprintf("Loaded plugins: %v\n", strings.Join(names, ", ")), nil
+}
+
+// Shutdown will stop every external plugin. Compiled in plugins have nothing
+// to stop.
+func Shutdown(ctx context.Context) error {
+
+	pluginsLock.Lock()
+	plugins := append([]Plugin{}, loaded...)
+	pluginsLock.Unlock()
+
+	var failures []string
+	for _, plugin := range plugins {
+		if external, isExternal := plugin.(*externalPlugin); isExternal {
+			if stopErr := external.stop(ctx); stopErr != nil {
+				failures = append(failures, stopErr.Error())
+			}
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%v", strings.Join(failures, ". "))
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package plugins
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/inbox"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/profiler"
+	"github.com/seantcanavan/anon-eth-net/reporter"
+)
+
+// Set to run the test binary as an external plugin instead of the tests
+const TEST_PLUGIN_ENV = "ANON_ETH_NET_TEST_PLUGIN"
+
+func TestMain(m *testing.M) {
+
+	if os.Getenv(TEST_PLUGIN_ENV) == "1" {
+		runTestPlugin()
+		return
+	}
+
+	logErr := logger.StandardLogger("plugins_test")
+	if logErr != nil {
+		fmt.Println(fmt.Sprintf("Could not initialize logger: %v", logErr))
+		return
+	}
+
+	configErr := config.FromFile()
+	if configErr != nil {
+		return
+	}
+
+	result := m.Run()
+	os.Exit(result)
+}
+
+// runTestPlugin answers requests like an external plugin would. The crash
+// command makes it exit without responding.
+func runTestPlugin() {
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var request pluginRequest
+		json.Unmarshal(scanner.Bytes(), &request)
+
+		response := pluginResponse{Id: request.Id}
+		switch request.Method {
+		case DESCRIBE_METHOD:
+			response.Collects = true
+			response.Commands = []string{"echo", "crash", "status"}
+		case COLLECT_METHOD:
+			response.Metrics = map[string]float64{"temperature_c": 61.5}
+		case COMMAND_METHOD:
+			if request.Command == "crash" {
+				fmt.Fprintln(os.Stderr, "crashing on purpose")
+				os.Exit(1)
+			}
+			response.Output = strings.Join(request.Args, " ")
+		default:
+			response.Error = "unsupported method " + request.Method
+		}
+
+		responseBytes, _ := json.Marshal(response)
+		fmt.Println(string(responseBytes))
+	}
+}
+
+// compiledPlugin is a compiled in plugin which adds a status report section.
+type compiledPlugin struct{}
+
+func (compiledPlugin) Name() string {
+	return "compiled"
+}
+
+func (compiledPlugin) StatusSection() (string, error) {
+	return "compiled plugin status\n", nil
+}
+
+func TestLoad(t *testing.T) {
+
+	executable, executableErr := os.Executable()
+	if executableErr != nil {
+		t.Fatal(executableErr)
+	}
+
+	os.Setenv(TEST_PLUGIN_ENV, "1")
+	defer os.Unsetenv(TEST_PLUGIN_ENV)
+
+	defer func(configured []config.PluginConfig) {
+		config.Cfg.Plugins = configured
+	}(config.Cfg.Plugins)
+	config.Cfg.Plugins = []config.PluginConfig{
+		{Name: "external", Command: executable},
+		{Name: "missing", Command: "/this/plugin/does/not/exist"},
+	}
+
+	inbox.RegisterCommand("status", func(args []string) (string, []reporter.Attachment, error) {
+		return "built in status\n", nil, nil
+	})
+
+	Register(compiledPlugin{})
+	Load()
+	defer Shutdown(context.Background())
+
+	summary, _ := StatusSummary()
+	if summary != "Loaded plugins: compiled, external\n" {
+		t.Errorf("expected the compiled and external plugins to load without the missing one, got: %v", summary)
+	}
+
+	if !strings.Contains(string(reporter.StatusReport()), "compiled plugin status") {
+		t.Errorf("expected the compiled plugin's section in the status report")
+	}
+
+	sample := profiler.TakeSample()
+	if sample.Metrics["external_temperature_c"] != 61.5 {
+		t.Errorf("expected the external plugin's metric prefixed with its name, got: %+v", sample.Metrics)
+	}
+
+	output, _, echoErr := inbox.Dispatch("echo", []string{"hello", "world"})
+	if echoErr != nil || output != "hello world" {
+		t.Errorf("expected the external plugin to echo its arguments, got: %v %v", output, echoErr)
+	}
+
+	output, _, _ = inbox.Dispatch("status", nil)
+	if output != "built in status\n" {
+		t.Errorf("expected a plugin not to replace a built in command, got: %v", output)
+	}
+
+	// a crashed plugin is started again on the next request
+	if _, _, crashErr := inbox.Dispatch("crash", nil); crashErr == nil {
+		t.Errorf("expected the crash command to fail")
+	}
+	output, _, echoErr = inbox.Dispatch("echo", []string{"again"})
+	if echoErr != nil || output != "again" {
+		t.Errorf("expected the external plugin to be restarted after crashing, got: %v %v", output, echoErr)
+	}
+
+	if shutdownErr := Shutdown(context.Background()); shutdownErr != nil {
+		t.Error(shutdownErr)
+	}
+}
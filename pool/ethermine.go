@@ -0,0 +1,116 @@
+package pool
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+)
+
+// The Type of the pools whose API is run by Ethermine
+const ETHERMINE_TYPE = "ethermine"
+
+// The API of Ethermine when a pool doesn't give its own URL
+const ETHERMINE_API_URL = "https://api.ethermine.org"
+
+// How long a worker can go without submitting a share before Ethermine's
+// stats are taken to mean it's offline. In seconds
+const ETHERMINE_OFFLINE_SECONDS = 1800
+
+// ethermineReply wraps everything Ethermine replies with.
+type ethermineReply struct {
+	Status string          `json:"status"`
+	Error  string          `json:"error"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// ethermineCurrentStats is the reply to /miner/{address}/currentStats.
+type ethermineCurrentStats struct {
+	CurrentHashrate  float64     `json:"currentHashrate"`
+	ReportedHashrate float64     `json:"reportedHashrate"`
+	AverageHashrate  float64     `json:"averageHashrate"`
+	ValidShares      uint64      `json:"validShares"`
+	StaleShares      uint64      `json:"staleShares"`
+	InvalidShares    uint64      `json:"invalidShares"`
+	Unpaid           json.Number `json:"unpaid"`
+}
+
+// ethermineWorker is a single worker in the reply to /miner/{address}/workers.
+type ethermineWorker struct {
+	Worker           string  `json:"worker"`
+	LastSeen         int64   `json:"lastSeen"`
+	CurrentHashrate  float64 `json:"currentHashrate"`
+	ReportedHashrate float64 `json:"reportedHashrate"`
+	ValidShares      uint64  `json:"validShares"`
+	StaleShares      uint64  `json:"staleShares"`
+	InvalidShares    uint64  `json:"invalidShares"`
+}
+
+// ethermineStats will collect the stats of the given account and its workers
+// from Ethermine.
+func ethermineStats(pool config.PoolConfig) (Stats, error) {
+
+	apiURL := pool.URL
+	if apiURL == "" {
+		apiURL = ETHERMINE_API_URL
+	}
+	minerURL := strings.TrimSuffix(apiURL, "/") + "/miner/" + pool.Address
+
+	var current ethermineCurrentStats
+	if getErr := getEthermine(minerURL+"/currentStats", &current); getErr != nil {
+		return Stats{}, getErr
+	}
+
+	var workers []ethermineWorker
+	if getErr := getEthermine(minerURL+"/workers", &workers); getErr != nil {
+		return Stats{}, getErr
+	}
+
+	stats := Stats{
+		ReportedHashrate:  current.ReportedHashrate,
+		EffectiveHashrate: current.CurrentHashrate,
+		AverageHashrate:   current.AverageHashrate,
+		ValidShares:       current.ValidShares,
+		StaleShares:       current.StaleShares,
+		InvalidShares:     current.InvalidShares,
+		UnpaidWei:         weiString(current.Unpaid),
+	}
+
+	for _, worker := range workers {
+		stats.Workers = append(stats.Workers, WorkerStats{
+			Name:              worker.Worker,
+			Online:            time.Since(time.Unix(worker.LastSeen, 0)) < ETHERMINE_OFFLINE_SECONDS*time.Second,
+			ReportedHashrate:  worker.ReportedHashrate,
+			EffectiveHashrate: worker.CurrentHashrate,
+			ValidShares:       worker.ValidShares,
+			StaleShares:       worker.StaleShares,
+			InvalidShares:     worker.InvalidShares,
+			LastSeen:          worker.LastSeen,
+		})
+	}
+
+	return stats, nil
+}
+
+// getEthermine will GET the given Ethermine URL and decode the data of its
+// reply into data.
+func getEthermine(url string, data interface{}) error {
+
+	var reply ethermineReply
+	if getErr := getJSON(url, &reply); getErr != nil {
+		return getErr
+	}
+
+	if reply.Status != "OK" {
+		return fmt.Errorf("Ethermine replied with %v: %v", reply.Status, reply.Error)
+	}
+
+	// an address which hasn't mined yet has no data
+	if len(reply.Data) == 0 || string(reply.Data) == "null" || string(reply.Data) == "NO DATA" {
+		return nil
+	}
+
+	return json.Unmarshal(reply.Data, data)
+}
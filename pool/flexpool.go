@@ -0,0 +1,112 @@
+package pool
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+)
+
+// The Type of the pools whose API is run by Flexpool
+const FLEXPOOL_TYPE = "flexpool"
+
+// The API of Flexpool when a pool doesn't give its own URL
+const FLEXPOOL_API_URL = "https://api.flexpool.io/v2"
+
+// flexpoolReply wraps everything Flexpool replies with.
+type flexpoolReply struct {
+	Error  *string         `json:"error"`
+	Result json.RawMessage `json:"result"`
+}
+
+// flexpoolMinerStats is the reply to /miner/stats and a single worker in the reply
+// to /miner/workers.
+type flexpoolMinerStats struct {
+	Name                     string  `json:"name"`
+	IsOnline                 bool    `json:"isOnline"`
+	ReportedHashrate         float64 `json:"reportedHashrate"`
+	CurrentEffectiveHashrate float64 `json:"currentEffectiveHashrate"`
+	AverageEffectiveHashrate float64 `json:"averageEffectiveHashrate"`
+	ValidShares              uint64  `json:"validShares"`
+	StaleShares              uint64  `json:"staleShares"`
+	InvalidShares            uint64  `json:"invalidShares"`
+	LastSeen                 int64   `json:"lastSeen"`
+}
+
+// flexpoolBalance is the reply to /miner/balance.
+type flexpoolBalance struct {
+	Balance json.Number `json:"balance"`
+}
+
+// flexpoolStats will collect the stats of the given account, its workers and
+// its unpaid balance from Flexpool.
+func flexpoolStats(pool config.PoolConfig) (Stats, error) {
+
+	apiURL := pool.URL
+	if apiURL == "" {
+		apiURL = FLEXPOOL_API_URL
+	}
+	minerURL := strings.TrimSuffix(apiURL, "/") + "/miner/"
+
+	query := url.Values{}
+	query.Set("coin", pool.Coin)
+	query.Set("address", pool.Address)
+
+	var miner flexpoolMinerStats
+	if getErr := getFlexpool(minerURL+"stats?"+query.Encode(), &miner); getErr != nil {
+		return Stats{}, getErr
+	}
+
+	var workers []flexpoolMinerStats
+	if getErr := getFlexpool(minerURL+"workers?"+query.Encode(), &workers); getErr != nil {
+		return Stats{}, getErr
+	}
+
+	var balance flexpoolBalance
+	if getErr := getFlexpool(minerURL+"balance?"+query.Encode(), &balance); getErr != nil {
+		return Stats{}, getErr
+	}
+
+	stats := Stats{
+		ReportedHashrate:  miner.ReportedHashrate,
+		EffectiveHashrate: miner.CurrentEffectiveHashrate,
+		AverageHashrate:   miner.AverageEffectiveHashrate,
+		ValidShares:       miner.ValidShares,
+		StaleShares:       miner.StaleShares,
+		InvalidShares:     miner.InvalidShares,
+		UnpaidWei:         weiString(balance.Balance),
+	}
+
+	for _, worker := range workers {
+		stats.Workers = append(stats.Workers, WorkerStats{
+			Name:              worker.Name,
+			Online:            worker.IsOnline,
+			ReportedHashrate:  worker.ReportedHashrate,
+			EffectiveHashrate: worker.CurrentEffectiveHashrate,
+			ValidShares:       worker.ValidShares,
+			StaleShares:       worker.StaleShares,
+			InvalidShares:     worker.InvalidShares,
+			LastSeen:          worker.LastSeen,
+		})
+	}
+
+	return stats, nil
+}
+
+// getFlexpool will GET the given Flexpool URL and decode the result of its
+// reply into result.
+func getFlexpool(url string, result interface{}) error {
+
+	var reply flexpoolReply
+	if getErr := getJSON(url, &reply); getErr != nil {
+		return getErr
+	}
+
+	if reply.Error != nil {
+		return fmt.Errorf("Flexpool replied with an error: %v", *reply.Error)
+	}
+
+	return json.Unmarshal(reply.Result, result)
+}
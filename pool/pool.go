@@ -0,0 +1,342 @@
+package pool
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/eth"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/profiler"
+	"github.com/seantcanavan/anon-eth-net/transport"
+)
+
+// How long a pool's API has to reply. In seconds
+const POOL_TIMEOUT_SECONDS = 30
+
+// The most bytes read from a pool's API
+const MAX_POOL_RESPONSE_BYTES = 4 * 1024 * 1024
+
+// The hashes per second in one megahash per second
+const HASHES_PER_MEGAHASH = 1000000
+
+// The prefix of the name of every pool metric, followed by the pool's Name
+const POOL_METRIC_PREFIX = "pool_"
+
+// Stats is everything collected from a pool about a single account.
+// Hashrates are in hashes per second.
+type Stats struct {
+	Pool              string        `json:"pool"`
+	Address           string        `json:"address"`
+	Time              int64         `json:"time"`
+	ReportedHashrate  float64       `json:"reportedHashrate"`
+	EffectiveHashrate float64       `json:"effectiveHashrate"`
+	AverageHashrate   float64       `json:"averageHashrate"`
+	ValidShares       uint64        `json:"validShares"`
+	StaleShares       uint64        `json:"staleShares"`
+	InvalidShares     uint64        `json:"invalidShares"`
+	UnpaidWei         string        `json:"unpaidWei"`
+	Workers           []WorkerStats `json:"workers"`
+}
+
+// WorkerStats is what a pool reports about a single worker of an account.
+type WorkerStats struct {
+	Name              string  `json:"name"`
+	Online            bool    `json:"online"`
+	ReportedHashrate  float64 `json:"reportedHashrate"`
+	EffectiveHashrate float64 `json:"effectiveHashrate"`
+	ValidShares       uint64  `json:"validShares"`
+	StaleShares       uint64  `json:"staleShares"`
+	InvalidShares     uint64  `json:"invalidShares"`
+	LastSeen          int64   `json:"lastSeen"`
+}
+
+// Collector fetches the stats of the account described by the given pool
+// config from the pool's API.
+type Collector func(pool config.PoolConfig) (Stats, error)
+
+// gpuTotals sums up the latest GPU metrics recorded by the profiler.
+type gpuTotals struct {
+	count       int
+	powerW      float64
+	utilization float64
+	maxTempC    float64
+}
+
+var collectors = map[string]Collector{
+	ETHERMINE_TYPE: ethermineStats,
+	FLEXPOOL_TYPE:  flexpoolStats,
+}
+var collectorsLock sync.Mutex
+
+var latestStats = make(map[string]Stats)
+var latestErrs = make(map[string]error)
+var statsLock sync.Mutex
+
+// Register will add a collector for a type of pool which isn't built in, or
+// replace the built in one. Call it from the init function of a package
+// imported by main.
+func Register(poolType string, collector Collector) {
+
+	collectorsLock.Lock()
+	defer collectorsLock.Unlock()
+
+	collectors[poolType] = collector
+	logger.Lgr.LogMessagef("Successfully registered pool collector: %v", poolType)
+}
+
+// Run will collect the stats of every one of the Pools every
+// PoolCheckSeconds. Pools can be added or removed via the config without a
+// restart.
+func Run() {
+	go func() {
+		for 1 == 1 {
+			if len(config.Cfg.Pools) > 0 {
+				if checkErr := Check(); checkErr != nil {
+					logger.Lgr.LogErrorf("Failed to collect the mining pool stats: %v", checkErr)
+				}
+			}
+
+			time.Sleep(time.Duration(config.Cfg.PoolCheckSeconds) * time.Second)
+		}
+	}()
+}
+
+// Check will collect the stats of every one of the Pools and keep them for the
+// status report and the metrics. Returns the last error hit, after collecting
+// the rest of the pools.
+func Check() error {
+
+	var lastErr error
+	for _, pool := range config.Cfg.Pools {
+		collectorsLock.Lock()
+		collector, known := collectors[pool.Type]
+		collectorsLock.Unlock()
+
+		var stats Stats
+		collectErr := fmt.Errorf("Unknown pool type %v", pool.Type)
+		if known {
+			stats, collectErr = collector(pool)
+		}
+
+		statsLock.Lock()
+		latestErrs[pool.Name] = collectErr
+		if collectErr == nil {
+			stats.Pool = pool.Name
+			stats.Address = pool.Address
+			stats.Time = time.Now().Unix()
+			latestStats[pool.Name] = stats
+		}
+		statsLock.Unlock()
+
+		if collectErr != nil {
+			lastErr = fmt.Errorf("Could not collect the stats of pool %v: %v", pool.Name, collectErr)
+			logger.Lgr.LogError(lastErr.Error())
+			continue
+		}
+
+		logger.Lgr.LogMessagef("Successfully collected the stats of pool %v: %.1f MH/s effective", pool.Name, stats.EffectiveHashrate/HASHES_PER_MEGAHASH)
+	}
+
+	return lastErr
+}
+
+// Latest returns the most recently collected stats of every one of the Pools
+// which has been collected at least once, in the order they're configured.
+func Latest() []Stats {
+
+	statsLock.Lock()
+	defer statsLock.Unlock()
+
+	var latest []Stats
+	for _, pool := range config.Cfg.Pools {
+		if stats, collected := latestStats[pool.Name]; collected {
+			latest = append(latest, stats)
+		}
+	}
+
+	return latest
+}
+
+// StalePercent returns the share of the given counts which were stale.
+func StalePercent(valid uint64, stale uint64, invalid uint64) float64 {
+
+	total := valid + stale + invalid
+	if total == 0 {
+		return 0
+	}
+
+	return float64(stale) * 100 / float64(total)
+}
+
+// Metrics returns the hashrates, stale share percentage and unpaid balance of
+// every pool for the profile history.
+func Metrics() (map[string]float64, error) {
+
+	metrics := make(map[string]float64)
+	for _, stats := range Latest() {
+		prefix := POOL_METRIC_PREFIX + stats.Pool + "_"
+		metrics[prefix+"reported_mhs"] = stats.ReportedHashrate / HASHES_PER_MEGAHASH
+		metrics[prefix+"effective_mhs"] = stats.EffectiveHashrate / HASHES_PER_MEGAHASH
+		metrics[prefix+"stale_percent"] = StalePercent(stats.ValidShares, stats.StaleShares, stats.InvalidShares)
+		if unpaid, parsed := new(big.Int).SetString(stats.UnpaidWei, 10); parsed {
+			metrics[prefix+"unpaid_eth"] = eth.ToEth(unpaid)
+		}
+	}
+
+	return metrics, nil
+}
+
+// Summary describes the hashrates, shares and unpaid balance of every pool
+// and each of its workers for the status report. The worker named after this
+// machine is shown alongside its local GPU metrics, so a pool reporting less
+// than the GPUs are working for stands out.
+func Summary() (string, error) {
+
+	if len(config.Cfg.Pools) == 0 {
+		return "No Pools are configured\n", nil
+	}
+
+	statsLock.Lock()
+	defer statsLock.Unlock()
+
+	hostname, _ := os.Hostname()
+	gpus, hasGPUs := localGPUs()
+
+	var summary bytes.Buffer
+	for _, pool := range config.Cfg.Pools {
+		summary.WriteString(fmt.Sprintf("%v (%v):\n", pool.Name, pool.Address))
+
+		stats, collected := latestStats[pool.Name]
+		if collectErr := latestErrs[pool.Name]; collectErr != nil {
+			summary.WriteString(fmt.Sprintf("  The last collection failed: %v\n", collectErr))
+		}
+		if !collected {
+			continue
+		}
+
+		summary.WriteString(fmt.Sprintf("  Hashrate: %v reported, %v effective%v, %v average\n", megahashes(stats.ReportedHashrate), megahashes(stats.EffectiveHashrate), percentOf(stats.EffectiveHashrate, stats.ReportedHashrate), megahashes(stats.AverageHashrate)))
+		summary.WriteString(fmt.Sprintf("  Shares: %d valid, %d stale (%.2f%%), %d invalid\n", stats.ValidShares, stats.StaleShares, StalePercent(stats.ValidShares, stats.StaleShares, stats.InvalidShares), stats.InvalidShares))
+		if unpaid, parsed := new(big.Int).SetString(stats.UnpaidWei, 10); parsed {
+			summary.WriteString(fmt.Sprintf("  Unpaid: %v ETH\n", eth.FormatEth(unpaid)))
+		}
+
+		for _, worker := range stats.Workers {
+			status := "offline"
+			if worker.Online {
+				status = "online"
+			}
+			summary.WriteString(fmt.Sprintf("  Worker %v: %v, %v reported, %v effective, %.2f%% stale\n", worker.Name, status, megahashes(worker.ReportedHashrate), megahashes(worker.EffectiveHashrate), StalePercent(worker.ValidShares, worker.StaleShares, worker.InvalidShares)))
+
+			if hasGPUs && (strings.EqualFold(worker.Name, config.Cfg.DeviceName) || strings.EqualFold(worker.Name, hostname)) {
+				summary.WriteString(fmt.Sprintf("    This machine: %d GPUs at %.0f%% utilization drawing %.1f W, up to %.0f C", gpus.count, gpus.utilization, gpus.powerW, gpus.maxTempC))
+				if gpus.powerW > 0 {
+					summary.WriteString(fmt.Sprintf(", %.3f MH/s per W effective", worker.EffectiveHashrate/HASHES_PER_MEGAHASH/gpus.powerW))
+				}
+				summary.WriteString("\n")
+			}
+		}
+	}
+
+	if hasGPUs {
+		summary.WriteString(fmt.Sprintf("Local GPUs: %d at %.0f%% utilization drawing %.1f W, up to %.0f C\n", gpus.count, gpus.utilization, gpus.powerW, gpus.maxTempC))
+	}
+
+	return summary.String(), nil
+}
+
+// localGPUs sums up the GPU metrics in the latest profile history sample.
+// Returns false when there aren't any.
+func localGPUs() (gpuTotals, bool) {
+
+	var totals gpuTotals
+
+	samples := profiler.Samples()
+	if len(samples) == 0 {
+		return totals, false
+	}
+
+	for metric, value := range samples[len(samples)-1].Metrics {
+		if !strings.HasPrefix(metric, profiler.GPU_METRIC_PREFIX) {
+			continue
+		}
+
+		switch {
+		case strings.HasSuffix(metric, "_utilization"):
+			totals.count++
+			totals.utilization += value
+		case strings.HasSuffix(metric, "_power_w"):
+			totals.powerW += value
+		case strings.HasSuffix(metric, "_temp_c") && value > totals.maxTempC:
+			totals.maxTempC = value
+		}
+	}
+
+	if totals.count == 0 {
+		return totals, false
+	}
+
+	totals.utilization /= float64(totals.count)
+	return totals, true
+}
+
+// megahashes describes the given hashrate in megahashes per second.
+func megahashes(hashrate float64) string {
+	return fmt.Sprintf("%.1f MH/s", hashrate/HASHES_PER_MEGAHASH)
+}
+
+// percentOf describes the given hashrate as a percentage of the reported one.
+func percentOf(hashrate float64, reported float64) string {
+	if reported == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%.1f%% of reported)", hashrate*100/reported)
+}
+
+// weiString converts a balance in wei which a pool replied with as a JSON
+// number, which may be written with an exponent, to an integer string. Empty
+// when there's no balance.
+func weiString(number json.Number) string {
+
+	if wei, parsed := new(big.Int).SetString(number.String(), 10); parsed {
+		return wei.String()
+	}
+
+	if float, parsed := new(big.Float).SetString(number.String()); parsed {
+		wei, _ := float.Int(nil)
+		return wei.String()
+	}
+
+	return ""
+}
+
+// getJSON will GET the given URL through the transport and decode its JSON
+// reply into reply.
+func getJSON(url string, reply interface{}) error {
+
+	client := transport.NewClient("pool", POOL_TIMEOUT_SECONDS*time.Second, transport.DEFAULT_CLIENT_RETRIES)
+	response, getErr := client.Get(url)
+	if getErr != nil {
+		return getErr
+	}
+	defer response.Body.Close()
+
+	if statusErr := transport.CheckStatus(response); statusErr != nil {
+		return statusErr
+	}
+
+	body, readErr := ioutil.ReadAll(io.LimitReader(response.Body, MAX_POOL_RESPONSE_BYTES))
+	if readErr != nil {
+		return readErr
+	}
+
+	return json.Unmarshal(body, reply)
+}
@@ -0,0 +1,131 @@
+package pool
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/profiler"
+)
+
+const TEST_ADDRESS = "0x00000000219ab540356cBB839Cbe05303d7705Fa"
+
+func TestMain(m *testing.M) {
+
+	logErr := logger.StandardLogger("pool_test")
+	if logErr != nil {
+		fmt.Println(fmt.Sprintf("Could not initialize logger: %v", logErr))
+		return
+	}
+
+	configErr := config.FromFile()
+	if configErr != nil {
+		return
+	}
+
+	result := m.Run()
+	os.Exit(result)
+}
+
+// poolServer replies to the Ethermine and Flexpool API calls for
+// TEST_ADDRESS with the given worker.
+func poolServer(worker string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/ethermine/miner/" + TEST_ADDRESS + "/currentStats":
+			fmt.Fprint(writer, `{"status":"OK","data":{"currentHashrate":480000000,"reportedHashrate":500000000,"averageHashrate":490000000,"validShares":990,"staleShares":10,"invalidShares":0,"unpaid":1.5e+17}}`)
+		case "/ethermine/miner/" + TEST_ADDRESS + "/workers":
+			fmt.Fprintf(writer, `{"status":"OK","data":[{"worker":"%v","lastSeen":%d,"currentHashrate":480000000,"reportedHashrate":500000000,"validShares":990,"staleShares":10,"invalidShares":0}]}`, worker, time.Now().Unix())
+		case "/flexpool/miner/stats", "/flexpool/miner/workers", "/flexpool/miner/balance":
+			if request.URL.Query().Get("coin") != "eth" || request.URL.Query().Get("address") != TEST_ADDRESS {
+				fmt.Fprint(writer, `{"error":"invalid address","result":null}`)
+				return
+			}
+			switch request.URL.Path {
+			case "/flexpool/miner/stats":
+				fmt.Fprint(writer, `{"error":null,"result":{"reportedHashrate":200000000,"currentEffectiveHashrate":210000000,"averageEffectiveHashrate":205000000,"validShares":500,"staleShares":0,"invalidShares":5}}`)
+			case "/flexpool/miner/workers":
+				fmt.Fprint(writer, `{"error":null,"result":[{"name":"other","isOnline":false,"reportedHashrate":0,"currentEffectiveHashrate":0,"validShares":0,"staleShares":0,"invalidShares":0}]}`)
+			default:
+				fmt.Fprint(writer, `{"error":null,"result":{"balance":42000000000000000}}`)
+			}
+		default:
+			http.NotFound(writer, request)
+		}
+	}))
+}
+
+func TestCheck(t *testing.T) {
+
+	defer func(pools []config.PoolConfig) {
+		config.Cfg.Pools = pools
+	}(config.Cfg.Pools)
+
+	server := poolServer(config.Cfg.DeviceName)
+	defer server.Close()
+
+	config.Cfg.Pools = []config.PoolConfig{
+		{Name: "ethermine", Type: ETHERMINE_TYPE, Address: TEST_ADDRESS, URL: server.URL + "/ethermine"},
+		{Name: "flexpool", Type: FLEXPOOL_TYPE, Address: TEST_ADDRESS, URL: server.URL + "/flexpool", Coin: "eth"},
+		{Name: "unknown", Type: "nopool", Address: TEST_ADDRESS},
+	}
+
+	if checkErr := Check(); checkErr == nil || !strings.Contains(checkErr.Error(), "Unknown pool type nopool") {
+		t.Errorf("expected the unknown pool to fail, got: %v", checkErr)
+	}
+
+	latest := Latest()
+	if len(latest) != 2 {
+		t.Fatalf("expected the stats of both known pools, got: %+v", latest)
+	}
+
+	if ethermine := latest[0]; ethermine.EffectiveHashrate != 480000000 || ethermine.UnpaidWei != "150000000000000000" || len(ethermine.Workers) != 1 || !ethermine.Workers[0].Online {
+		t.Errorf("expected the Ethermine stats, got: %+v", ethermine)
+	}
+
+	if flexpool := latest[1]; flexpool.ReportedHashrate != 200000000 || flexpool.UnpaidWei != "42000000000000000" || len(flexpool.Workers) != 1 || flexpool.Workers[0].Online {
+		t.Errorf("expected the Flexpool stats, got: %+v", flexpool)
+	}
+
+	metrics, _ := Metrics()
+	if metrics["pool_ethermine_stale_percent"] != 1 || metrics["pool_flexpool_effective_mhs"] != 210 || metrics["pool_ethermine_unpaid_eth"] != 0.15 {
+		t.Errorf("expected the pool metrics, got: %+v", metrics)
+	}
+
+	// stand in for the GPU metrics of this machine
+	profiler.RegisterCollector("pool_test", func() (map[string]float64, error) {
+		return map[string]float64{"gpu0_utilization": 100, "gpu0_power_w": 120, "gpu0_temp_c": 60, "gpu1_utilization": 90, "gpu1_power_w": 120, "gpu1_temp_c": 70}, nil
+	})
+	profiler.RecordSample()
+
+	summary, _ := Summary()
+	for _, expected := range []string{
+		"Hashrate: 500.0 MH/s reported, 480.0 MH/s effective (96.0% of reported), 490.0 MH/s average",
+		"Shares: 990 valid, 10 stale (1.00%), 0 invalid",
+		"Unpaid: 0.150000 ETH",
+		"This machine: 2 GPUs at 95% utilization drawing 240.0 W, up to 70 C, 2.000 MH/s per W effective",
+		"Worker other: offline",
+		"The last collection failed: Unknown pool type nopool",
+	} {
+		if !strings.Contains(summary, expected) {
+			t.Errorf("expected the summary to contain %q, got: %v", expected, summary)
+		}
+	}
+}
+
+func TestStalePercent(t *testing.T) {
+
+	if percent := StalePercent(0, 0, 0); percent != 0 {
+		t.Errorf("expected no shares to be 0%% stale, got: %v", percent)
+	}
+
+	if percent := StalePercent(98, 1, 1); percent != 1 {
+		t.Errorf("expected 1 stale share out of 100 to be 1%% stale, got: %v", percent)
+	}
+}
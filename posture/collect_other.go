@@ -0,0 +1,218 @@
+//go:build !windows
+
+package posture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// The account database users are read from
+const PASSWD_FILE = "/etc/passwd"
+
+// The shells which don't allow logging in
+var noLoginShells = []string{"nologin", "false", "sync", "shutdown", "halt"}
+
+// The sudo configuration whose contents are fingerprinted
+var sudoersFiles = []string{"/etc/sudoers", "/etc/sudoers.d", "/etc/doas.conf"}
+
+// The crontabs and timers whose contents are fingerprinted
+var scheduledFiles = []string{
+	"/etc/crontab",
+	"/etc/cron.d",
+	"/etc/cron.hourly",
+	"/etc/cron.daily",
+	"/etc/cron.weekly",
+	"/etc/cron.monthly",
+	"/var/spool/cron",
+	"/etc/systemd/system/*.timer",
+	"/etc/systemd/system/timers.target.wants",
+	"/Library/LaunchDaemons",
+	"/Library/LaunchAgents",
+}
+
+// The /proc files holding the IPv4 and IPv6 TCP sockets on linux
+var procNetFiles = []string{"/proc/net/tcp", "/proc/net/tcp6"}
+
+// The state of a listening TCP socket in /proc/net/tcp
+const PROC_NET_LISTEN = "0A"
+
+// The package managers tried in turn to list the installed packages, and the
+// arguments which list each package followed by its version
+var packageManagers = [][]string{
+	{"dpkg-query", "-W", "-f=${Package} ${Version}\n"},
+	{"rpm", "-qa", "--queryformat", "%{NAME} %{VERSION}-%{RELEASE}\n"},
+	{"apk", "info", "-v"},
+	{"pacman", "-Q"},
+	{"pkg", "query", "%n %v"},
+	{"brew", "list", "--versions"},
+}
+
+func init() {
+	collectors = map[string]func() (map[string]string, error){
+		USERS:     loginUsers,
+		SUDOERS:   func() (map[string]string, error) { return hashFiles(sudoersFiles) },
+		PORTS:     listeningPorts,
+		SCHEDULED: func() (map[string]string, error) { return hashFiles(scheduledFiles) },
+		PACKAGES:  installedPackages,
+	}
+}
+
+// loginUsers returns every user in PASSWD_FILE with a shell which allows
+// logging in, along with its shell.
+func loginUsers() (map[string]string, error) {
+
+	passwd, readErr := ioutil.ReadFile(PASSWD_FILE)
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(passwd))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 7 || strings.HasPrefix(fields[0], "#") || fields[6] == "" {
+			continue
+		}
+
+		shell := fields[6]
+		if containsShell(shell, noLoginShells) {
+			continue
+		}
+		users[fields[0]] = fmt.Sprintf("uid %v with %v", fields[2], shell)
+	}
+
+	return users, nil
+}
+
+// containsShell returns whether the given shell is one of the given names.
+func containsShell(shell string, names []string) bool {
+	for _, name := range names {
+		if strings.HasSuffix(shell, "/"+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// listeningPorts returns every listening TCP socket, read from /proc on linux
+// and from netstat elsewhere.
+func listeningPorts() (map[string]string, error) {
+
+	if _, statErr := os.Stat("/proc/net/tcp"); statErr != nil {
+		output, netstatErr := run("netstat", "-an")
+		if netstatErr != nil {
+			return nil, netstatErr
+		}
+		return parseNetstat(output), nil
+	}
+
+	listening := make(map[string]string)
+	for _, procFile := range procNetFiles {
+		contents, readErr := ioutil.ReadFile(procFile)
+		if os.IsNotExist(readErr) {
+			continue
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+
+		for _, line := range strings.Split(string(contents), "\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) < 4 || fields[3] != PROC_NET_LISTEN {
+				continue
+			}
+			local, parseErr := parseProcAddress(fields[1])
+			if parseErr != nil {
+				return nil, parseErr
+			}
+			listening["tcp "+local] = ""
+		}
+	}
+
+	return listening, nil
+}
+
+// parseProcAddress returns the host:port of the given /proc/net address, e.g.
+// 0100007F:0016 is 127.0.0.1:22. The address is stored as 32 bit words in
+// host byte order, which is little endian on every platform the agent runs.
+func parseProcAddress(address string) (string, error) {
+
+	parts := strings.Split(address, ":")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("Unexpected /proc/net address: %v", address)
+	}
+
+	raw, hexErr := hex.DecodeString(parts[0])
+	if hexErr != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return "", fmt.Errorf("Unexpected /proc/net address: %v", address)
+	}
+	for word := 0; word < len(raw); word += 4 {
+		raw[word], raw[word+1], raw[word+2], raw[word+3] = raw[word+3], raw[word+2], raw[word+1], raw[word]
+	}
+
+	port, portErr := strconv.ParseUint(parts[1], 16, 16)
+	if portErr != nil {
+		return "", fmt.Errorf("Unexpected /proc/net port: %v", address)
+	}
+
+	return net.JoinHostPort(net.IP(raw).String(), strconv.FormatUint(port, 10)), nil
+}
+
+// installedPackages returns every installed package and its version from the
+// first of the packageManagers found on the machine.
+func installedPackages() (map[string]string, error) {
+
+	for _, manager := range packageManagers {
+		if _, lookErr := exec.LookPath(manager[0]); lookErr != nil {
+			continue
+		}
+
+		output, runErr := run(manager[0], manager[1:]...)
+		if runErr != nil {
+			return nil, runErr
+		}
+		return parsePackages(output), nil
+	}
+
+	return nil, fmt.Errorf("None of the supported package managers was found")
+}
+
+// parsePackages returns the packages in the given output of a package manager
+// which lists one package per line. Lines holding a name and a version
+// separated by a space are split there, and lines holding a single
+// name-version, as apk lists them, are split at the last dash followed
+// by a digit.
+func parsePackages(output []byte) map[string]string {
+
+	packages := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 0:
+			continue
+		case len(fields) > 1:
+			packages[fields[0]] = strings.Join(fields[1:], " ")
+		default:
+			name, version := fields[0], ""
+			for index := len(name) - 2; index > 0; index-- {
+				if name[index] == '-' && name[index+1] >= '0' && name[index+1] <= '9' {
+					name, version = fields[0][:index], fields[0][index+1:]
+					break
+				}
+			}
+			packages[name] = version
+		}
+	}
+
+	return packages
+}
@@ -0,0 +1,84 @@
+package posture
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The PowerShell commands which list the enabled local users, the members of
+// the local Administrators group, the scheduled tasks and the installed
+// packages, one per line with its fingerprint after a tab
+const USERS_SCRIPT = "Get-LocalUser | Where-Object Enabled | ForEach-Object { $_.Name + \"`t\" + $_.SID }"
+const ADMINS_SCRIPT = "Get-LocalGroupMember -SID S-1-5-32-544 | ForEach-Object { $_.Name + \"`t\" + $_.ObjectClass }"
+const TASKS_SCRIPT = "Get-ScheduledTask | Where-Object State -ne Disabled | ForEach-Object { $_.TaskPath + $_.TaskName + \"`t\" + (($_.Actions | ForEach-Object { $_.Execute + ' ' + $_.Arguments }) -join '; ') }"
+const PACKAGES_SCRIPT = "Get-ItemProperty HKLM:\\Software\\Microsoft\\Windows\\CurrentVersion\\Uninstall\\*, HKLM:\\Software\\WOW6432Node\\Microsoft\\Windows\\CurrentVersion\\Uninstall\\* -ErrorAction SilentlyContinue | Where-Object DisplayName | ForEach-Object { $_.DisplayName + \"`t\" + $_.DisplayVersion }"
+
+func init() {
+	collectors = map[string]func() (map[string]string, error){
+		USERS:     func() (map[string]string, error) { return powershell(USERS_SCRIPT) },
+		SUDOERS:   func() (map[string]string, error) { return powershell(ADMINS_SCRIPT) },
+		PORTS:     listeningPorts,
+		SCHEDULED: scheduledTasks,
+		PACKAGES:  func() (map[string]string, error) { return powershell(PACKAGES_SCRIPT) },
+	}
+}
+
+// listeningPorts returns every listening TCP socket from netstat.
+func listeningPorts() (map[string]string, error) {
+
+	output, netstatErr := run("netstat", "-an", "-p", "TCP")
+	if netstatErr != nil {
+		return nil, netstatErr
+	}
+
+	return parseNetstat(output), nil
+}
+
+// scheduledTasks returns every enabled scheduled task along with what it
+// runs, and the fingerprint of everything in the startup folder of all users.
+func scheduledTasks() (map[string]string, error) {
+
+	tasks, tasksErr := powershell(TASKS_SCRIPT)
+	if tasksErr != nil {
+		return nil, tasksErr
+	}
+
+	startup, startupErr := hashFiles([]string{filepath.Join(os.Getenv("ProgramData"), "Microsoft", "Windows", "Start Menu", "Programs", "StartUp")})
+	if startupErr != nil {
+		return nil, startupErr
+	}
+	for path, hash := range startup {
+		tasks[path] = hash
+	}
+
+	return tasks, nil
+}
+
+// powershell will run the given script and return the items it prints, one
+// per line with its fingerprint after a tab.
+func powershell(script string) (map[string]string, error) {
+
+	output, runErr := run("powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+	if runErr != nil {
+		return nil, runErr
+	}
+
+	items := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+		items[parts[0]] = parts[1]
+	}
+
+	return items, nil
+}
@@ -0,0 +1,452 @@
+// The posture package snapshots the security relevant state of the machine,
+// such as who can log in and what's listening, and reports what changed
+// between snapshots so tampering with an unattended machine gets noticed.
+package posture
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/state"
+)
+
+// The sections of a snapshot. Each maps the items found, e.g. a user or a
+// file, to a fingerprint of them, e.g. their shell or a hash of the file
+const USERS = "users"
+const SUDOERS = "sudoers"
+const PORTS = "ports"
+const SCHEDULED = "scheduled"
+const PACKAGES = "packages"
+
+// SECTIONS lists every section of a snapshot in the order they're reported
+var SECTIONS = []string{USERS, SUDOERS, PORTS, SCHEDULED, PACKAGES}
+
+// The kinds of change between two snapshots
+const ADDED = "added"
+const REMOVED = "removed"
+const CHANGED = "changed"
+
+// The state bucket the last snapshot and the recent changes are kept in
+const STATE_BUCKET = "posture"
+const SNAPSHOT_KEY = "snapshot"
+const CHANGES_KEY = "changes"
+
+// The most changes which are remembered. The oldest are dropped first
+const MAX_CHANGES = 200
+
+// How far back the status report lists changes. In days
+const REPORT_DAYS = 7
+
+// The most changes listed in a single PostureChanged event
+const MAX_EVENT_CHANGES = 20
+
+// How long a single command run to take a snapshot can take. In seconds
+const COMMAND_TIMEOUT_SECONDS = 120
+
+// The number of hex characters of a file's SHA-256 hash used as its
+// fingerprint
+const HASH_LENGTH = 16
+
+// Snapshot is the security relevant state of the machine at a single point in
+// time. Sections maps each section to its items and their fingerprints.
+// Errors holds why a section couldn't be collected, in which case the section
+// is carried over from the previous snapshot.
+type Snapshot struct {
+	Time     int64                        `json:"time"`
+	Sections map[string]map[string]string `json:"sections"`
+	Errors   map[string]string            `json:"errors,omitempty"`
+}
+
+// Change is a single difference between two snapshots.
+type Change struct {
+	Time    int64  `json:"time"`
+	Section string `json:"section"`
+	Item    string `json:"item"`
+	Kind    string `json:"kind"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// String describes the change in a single line.
+func (c Change) String() string {
+	if c.Detail != "" {
+		return fmt.Sprintf("%v %v %v: %v", c.Section, c.Item, c.Kind, c.Detail)
+	}
+	return fmt.Sprintf("%v %v %v", c.Section, c.Item, c.Kind)
+}
+
+// collectors gathers the items of each section. Set for each platform
+var collectors map[string]func() (map[string]string, error)
+
+var checkLock sync.Mutex
+
+// Run will snapshot the machine every PostureCheckHours and report what
+// changed since the previous snapshot.
+func Run() {
+
+	go func() {
+		for 1 == 1 {
+			if _, checkErr := Check(); checkErr != nil {
+				logger.Lgr.LogErrorf("Failed to check the security posture: %v", checkErr)
+			}
+
+			time.Sleep(time.Duration(config.Cfg.PostureCheckHours) * time.Hour)
+		}
+	}()
+}
+
+// Check will take a snapshot of the machine, compare it against the previous
+// one and save it in its place. The changes found, except those matching one
+// of the PostureIgnore patterns, are remembered for the status report and
+// published in a PostureChanged event. Nothing is reported the first time,
+// when there's no previous snapshot to compare against.
+func Check() ([]Change, error) {
+
+	checkLock.Lock()
+	defer checkLock.Unlock()
+
+	var previous Snapshot
+	found, getErr := state.Get(STATE_BUCKET, SNAPSHOT_KEY, &previous)
+	if getErr != nil {
+		return nil, getErr
+	}
+
+	current := Take(previous)
+
+	ignored, ignoreErr := ignorePatterns()
+	if ignoreErr != nil {
+		return nil, ignoreErr
+	}
+
+	var changes []Change
+	if found {
+		for _, change := range Diff(previous, current) {
+			if !matchesAny(change.Section+" "+change.Item, ignored) {
+				changes = append(changes, change)
+			}
+		}
+	}
+
+	updateErr := state.Update(func(tx *state.Tx) error {
+		bucket := tx.Bucket(STATE_BUCKET)
+		if putErr := bucket.Put(SNAPSHOT_KEY, current); putErr != nil {
+			return putErr
+		}
+		if len(changes) == 0 {
+			return nil
+		}
+
+		var remembered []Change
+		if _, getErr := bucket.Get(CHANGES_KEY, &remembered); getErr != nil {
+			return getErr
+		}
+		remembered = append(remembered, changes...)
+		if len(remembered) > MAX_CHANGES {
+			remembered = remembered[len(remembered)-MAX_CHANGES:]
+		}
+		return bucket.Put(CHANGES_KEY, remembered)
+	})
+	if updateErr != nil {
+		return changes, updateErr
+	}
+
+	if !found {
+		logger.Lgr.LogMessage("Successfully took the first security posture snapshot to compare the next ones against")
+		return nil, nil
+	}
+
+	if len(changes) > 0 {
+		descriptions := make([]string, 0, MAX_EVENT_CHANGES)
+		for index, change := range changes {
+			if index == MAX_EVENT_CHANGES {
+				descriptions = append(descriptions, fmt.Sprintf("and %d more", len(changes)-MAX_EVENT_CHANGES))
+				break
+			}
+			descriptions = append(descriptions, change.String())
+		}
+		logger.Lgr.LogErrorf("The security posture of this machine changed: %v", strings.Join(descriptions, "; "))
+		events.Publish(events.PostureChanged{Changes: descriptions})
+	}
+
+	logger.Lgr.LogMessagef("Successfully checked the security posture and found %d changes", len(changes))
+	return changes, nil
+}
+
+// Take will collect every section of a snapshot of the machine. A section
+// which can't be collected is copied from the given previous snapshot so it
+// isn't mistaken for everything in it having been removed.
+func Take(previous Snapshot) Snapshot {
+
+	current := Snapshot{Time: time.Now().Unix(), Sections: make(map[string]map[string]string)}
+
+	for _, section := range SECTIONS {
+		collect, exists := collectors[section]
+		if !exists {
+			continue
+		}
+
+		items, collectErr := collect()
+		if collectErr != nil {
+			if current.Errors == nil {
+				current.Errors = make(map[string]string)
+			}
+			current.Errors[section] = collectErr.Error()
+			logger.Lgr.LogErrorf("Could not collect the %v for the security posture: %v", section, collectErr)
+			if previousItems, existed := previous.Sections[section]; existed {
+				current.Sections[section] = previousItems
+			}
+			continue
+		}
+
+		current.Sections[section] = items
+	}
+
+	return current
+}
+
+// Diff returns every item added to, removed from or changed in each section
+// between the previous and current snapshots, in the order of SECTIONS and
+// then of the items. Sections missing from either snapshot aren't compared.
+func Diff(previous Snapshot, current Snapshot) []Change {
+
+	var changes []Change
+	for _, section := range SECTIONS {
+		before, hadBefore := previous.Sections[section]
+		after, hasAfter := current.Sections[section]
+		if !hadBefore || !hasAfter {
+			continue
+		}
+
+		items := make([]string, 0, len(before)+len(after))
+		for item := range before {
+			items = append(items, item)
+		}
+		for item := range after {
+			if _, existed := before[item]; !existed {
+				items = append(items, item)
+			}
+		}
+		sort.Strings(items)
+
+		for _, item := range items {
+			beforeValue, existed := before[item]
+			afterValue, exists := after[item]
+			change := Change{Time: current.Time, Section: section, Item: item}
+			switch {
+			case !existed:
+				change.Kind, change.Detail = ADDED, afterValue
+			case !exists:
+				change.Kind, change.Detail = REMOVED, beforeValue
+			case beforeValue != afterValue:
+				change.Kind, change.Detail = CHANGED, fmt.Sprintf("%v to %v", beforeValue, afterValue)
+			default:
+				continue
+			}
+			changes = append(changes, change)
+		}
+	}
+
+	return changes
+}
+
+// Latest returns the last snapshot taken, if any, and the changes remembered
+// from the last REPORT_DAYS.
+func Latest() (Snapshot, []Change, error) {
+
+	var snapshot Snapshot
+	var recent []Change
+	viewErr := state.View(func(tx *state.Tx) error {
+		bucket := tx.Bucket(STATE_BUCKET)
+		if _, getErr := bucket.Get(SNAPSHOT_KEY, &snapshot); getErr != nil {
+			return getErr
+		}
+
+		var remembered []Change
+		if _, getErr := bucket.Get(CHANGES_KEY, &remembered); getErr != nil {
+			return getErr
+		}
+		since := time.Now().AddDate(0, 0, -REPORT_DAYS).Unix()
+		for _, change := range remembered {
+			if change.Time >= since {
+				recent = append(recent, change)
+			}
+		}
+		return nil
+	})
+
+	return snapshot, recent, viewErr
+}
+
+// Summary describes the last snapshot and every change found in the last
+// REPORT_DAYS. Used to describe the security posture in status reports.
+func Summary() (string, error) {
+
+	snapshot, recent, latestErr := Latest()
+	if latestErr != nil {
+		return "", latestErr
+	}
+
+	if snapshot.Time == 0 {
+		return "No security posture snapshot has been taken yet\n", nil
+	}
+
+	var summary bytes.Buffer
+	counts := make([]string, 0, len(SECTIONS))
+	for _, section := range SECTIONS {
+		if items, exists := snapshot.Sections[section]; exists {
+			counts = append(counts, fmt.Sprintf("%d %v", len(items), section))
+		}
+	}
+	summary.WriteString(fmt.Sprintf("Snapshot taken %v ago: %v\n", time.Since(time.Unix(snapshot.Time, 0)).Round(time.Minute), strings.Join(counts, ", ")))
+
+	for _, section := range SECTIONS {
+		if collectErr, failed := snapshot.Errors[section]; failed {
+			summary.WriteString(fmt.Sprintf("Could not collect the %v: %v\n", section, collectErr))
+		}
+	}
+
+	if len(recent) == 0 {
+		summary.WriteString(fmt.Sprintf("No changes in the last %d days\n", REPORT_DAYS))
+		return summary.String(), nil
+	}
+
+	summary.WriteString(fmt.Sprintf("%d changes in the last %d days:\n", len(recent), REPORT_DAYS))
+	for index := len(recent) - 1; index >= 0; index-- {
+		summary.WriteString(fmt.Sprintf("%v: %v\n", time.Unix(recent[index].Time, 0).Format(time.RFC3339), recent[index]))
+	}
+
+	return summary.String(), nil
+}
+
+// ignorePatterns compiles the PostureIgnore patterns.
+func ignorePatterns() ([]*regexp.Regexp, error) {
+
+	patterns := make([]*regexp.Regexp, 0, len(config.Cfg.PostureIgnore))
+	for _, pattern := range config.Cfg.PostureIgnore {
+		compiled, compileErr := regexp.Compile(pattern)
+		if compileErr != nil {
+			return nil, compileErr
+		}
+		patterns = append(patterns, compiled)
+	}
+
+	return patterns, nil
+}
+
+// matchesAny returns whether the given text matches one of the given patterns.
+func matchesAny(text string, patterns []*regexp.Regexp) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// hashFiles returns the fingerprint of each of the files matching the given
+// glob patterns, and of every file under the matching directories. Patterns
+// which don't match anything are skipped.
+func hashFiles(patterns []string) (map[string]string, error) {
+
+	hashes := make(map[string]string)
+	for _, pattern := range patterns {
+		matches, globErr := filepath.Glob(pattern)
+		if globErr != nil {
+			return nil, globErr
+		}
+
+		for _, match := range matches {
+			walkErr := filepath.Walk(match, func(path string, info os.FileInfo, walkErr error) error {
+				if walkErr != nil {
+					// unreadable entries are reported as such rather than failing the section
+					hashes[path] = "unreadable"
+					return nil
+				}
+				if info.IsDir() {
+					return nil
+				}
+				hashes[path] = hashFile(path)
+				return nil
+			})
+			if walkErr != nil {
+				return nil, walkErr
+			}
+		}
+	}
+
+	return hashes, nil
+}
+
+// hashFile returns the fingerprint of the file at the given path, or
+// "unreadable" if it can't be read.
+func hashFile(path string) string {
+
+	file, openErr := os.Open(path)
+	if openErr != nil {
+		return "unreadable"
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, copyErr := io.Copy(hash, file); copyErr != nil {
+		return "unreadable"
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))[:HASH_LENGTH]
+}
+
+// run will run the given command for up to COMMAND_TIMEOUT_SECONDS and return
+// its output.
+func run(name string, args ...string) ([]byte, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), COMMAND_TIMEOUT_SECONDS*time.Second)
+	defer cancel()
+
+	output, runErr := exec.CommandContext(ctx, name, args...).Output()
+	if runErr != nil {
+		return nil, fmt.Errorf("%v failed: %v", name, runErr)
+	}
+
+	return output, nil
+}
+
+// parseNetstat returns the listening TCP sockets in the output of netstat -an,
+// e.g. "tcp 0.0.0.0:22".
+func parseNetstat(output []byte) map[string]string {
+
+	listening := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !strings.HasPrefix(strings.ToLower(fields[0]), "tcp") {
+			continue
+		}
+		if last := fields[len(fields)-1]; last != "LISTEN" && last != "LISTENING" {
+			continue
+		}
+
+		// the local address follows the queue sizes on unix but not on windows
+		local := fields[1]
+		if len(fields) >= 6 {
+			local = fields[3]
+		}
+		listening["tcp "+local] = ""
+	}
+
+	return listening
+}
@@ -0,0 +1,160 @@
+package posture
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/state"
+)
+
+func TestMain(m *testing.M) {
+
+	logErr := logger.StandardLogger("posture_test")
+	if logErr != nil {
+		fmt.Println(fmt.Sprintf("Could not initialize logger: %v", logErr))
+		return
+	}
+
+	configErr := config.FromFile()
+	if configErr != nil {
+		return
+	}
+
+	result := m.Run()
+	os.Exit(result)
+}
+
+func TestCheck(t *testing.T) {
+
+	defer func(previous *config.Config) { config.Cfg = previous }(config.Cfg)
+	testConfig := *config.Cfg
+	config.Cfg = &testConfig
+
+	stateDir, dirErr := ioutil.TempDir("", "posture_test")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(stateDir)
+	if openErr := state.Open(filepath.Join(stateDir, "agent_state.json")); openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer state.Open(config.Cfg.StateFile)
+
+	// stand in for the machine
+	machine := map[string]map[string]string{
+		USERS:    {"root": "uid 0 with /bin/bash", "miner": "uid 1000 with /bin/sh"},
+		SUDOERS:  {"/etc/sudoers": "1111"},
+		PORTS:    {"tcp 0.0.0.0:22": "", "tcp 127.0.0.1:3333": ""},
+		PACKAGES: {"openssh-server": "9.6"},
+	}
+	var failing string
+	defer func(previous map[string]func() (map[string]string, error)) { collectors = previous }(collectors)
+	collectors = make(map[string]func() (map[string]string, error))
+	for section := range machine {
+		section := section
+		collectors[section] = func() (map[string]string, error) {
+			if section == failing {
+				return nil, fmt.Errorf("the %v can't be read", section)
+			}
+			items := make(map[string]string)
+			for item, fingerprint := range machine[section] {
+				items[item] = fingerprint
+			}
+			return items, nil
+		}
+	}
+
+	var publishedLock sync.Mutex
+	var published []events.PostureChanged
+	unsubscribe := events.Subscribe("posture_test", func(record events.Record) {
+		if changed, isChanged := record.Event.(events.PostureChanged); isChanged {
+			publishedLock.Lock()
+			published = append(published, changed)
+			publishedLock.Unlock()
+		}
+	})
+	defer unsubscribe()
+
+	if changes, checkErr := Check(); checkErr != nil || len(changes) != 0 {
+		t.Fatalf("expected the first snapshot to be the baseline, got: %v %v", changes, checkErr)
+	}
+
+	// tampered with, while a miner's API port moved and the packages can't be listed
+	machine[USERS]["backdoor"] = "uid 0 with /bin/bash"
+	machine[SUDOERS]["/etc/sudoers"] = "2222"
+	delete(machine[PORTS], "tcp 127.0.0.1:3333")
+	machine[PORTS]["tcp 127.0.0.1:3334"] = ""
+	machine[PORTS]["tcp 0.0.0.0:4444"] = ""
+	failing = PACKAGES
+	config.Cfg.PostureIgnore = []string{`^ports tcp 127\.0\.0\.1:333\d$`}
+
+	changes, checkErr := Check()
+	if checkErr != nil {
+		t.Fatal(checkErr)
+	}
+	var described []string
+	for _, change := range changes {
+		described = append(described, change.String())
+	}
+	expected := "users backdoor added: uid 0 with /bin/bash,sudoers /etc/sudoers changed: 1111 to 2222,ports tcp 0.0.0.0:4444 added"
+	if strings.Join(described, ",") != expected {
+		t.Errorf("expected the tampering to be found, got: %v", described)
+	}
+
+	// the packages which couldn't be listed weren't all removed
+	failing = ""
+	machine[PACKAGES]["netcat"] = "1.10"
+	if changes, _ = Check(); len(changes) != 1 || changes[0].String() != "packages netcat added: 1.10" {
+		t.Errorf("expected only the new package, got: %v", changes)
+	}
+
+	summary, _ := Summary()
+	for _, expected := range []string{
+		"3 users, 1 sudoers, 3 ports, 2 packages",
+		"4 changes in the last 7 days",
+		"users backdoor added: uid 0 with /bin/bash",
+		"packages netcat added: 1.10",
+	} {
+		if !strings.Contains(summary, expected) {
+			t.Errorf("expected the summary to contain %q, got: %v", expected, summary)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	publishedLock.Lock()
+	defer publishedLock.Unlock()
+	if len(published) != 2 || len(published[0].Changes) != 3 {
+		t.Errorf("expected each check with changes to be published, got: %+v", published)
+	}
+}
+
+func TestParseNetstat(t *testing.T) {
+
+	output := []byte(`Active Internet connections (including servers)
+Proto Recv-Q Send-Q  Local Address          Foreign Address        (state)
+tcp4       0      0  *.22                   *.*                    LISTEN
+tcp4       0      0  192.168.1.5.51234      140.82.112.3.443       ESTABLISHED
+udp4       0      0  *.5353                 *.*
+  TCP    0.0.0.0:135            0.0.0.0:0              LISTENING
+  TCP    10.0.0.2:50000         20.42.73.29:443        ESTABLISHED
+`)
+
+	listening := parseNetstat(output)
+	if len(listening) != 2 {
+		t.Errorf("expected the two listening sockets, got: %v", listening)
+	}
+	for _, socket := range []string{"tcp *.22", "tcp 0.0.0.0:135"} {
+		if _, found := listening[socket]; !found {
+			t.Errorf("expected %v to be listening, got: %v", socket, listening)
+		}
+	}
+}
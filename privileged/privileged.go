@@ -0,0 +1,391 @@
+// The privileged package separates the few things the agent needs root for,
+// replacing its binary, installing the service and rebooting, from everything
+// else. The privileged helper runs as root, answers requests on a local socket
+// and runs the agent itself as the unprivileged AgentUser, so the REST server,
+// the loader and everything else facing the network never hold root. The
+// helper reads its settings from CONFIG_FILE, which only root can change, and
+// never from anything the agent can write to.
+//
+// The helper writes a random key beside the socket which only root and the
+// AgentUser can read. Every request is signed with it and carries a timestamp
+// and a nonce so it can't be replayed. The agent checks Available to decide
+// whether to send a request to the helper or do the work itself, as it does
+// when it isn't running under one.
+package privileged
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The subcommand which runs the privileged helper
+const HELPER_COMMAND = "privileged-helper"
+
+// The actions the helper performs on behalf of the agent
+const UPDATE_ACTION = "update"
+const INSTALL_ACTION = "install"
+const REBOOT_ACTION = "reboot"
+
+// The lock file which stops a second helper from starting
+const LOCK_FILE_NAME = "privileged_helper.lock"
+
+// The config the helper reads instead of the config.json asset, which the
+// agent can rewrite. It must be owned by root and writable by root only, as
+// must the directory it's in
+const CONFIG_FILE = "/etc/anon-eth-net/privileged.json"
+
+// The directory the helper creates for the agent to keep its data in. It's
+// the only thing the helper hands over to AgentUser
+const AGENT_DATA_DIR = "/var/lib/anon-eth-net-agent"
+
+// Appended to PrivilegedSocket to get the file holding the key requests are
+// signed with
+const KEY_EXTENSION = ".key"
+
+// The furthest a request's timestamp can be from now before it's refused. In
+// seconds
+const MAX_REQUEST_AGE_SECONDS = 30
+
+// How long a single request can take, including the action itself. In seconds
+const CALL_TIMEOUT_SECONDS = 600
+
+// Request asks the helper to perform a single action.
+type Request struct {
+	Action    string   `json:"action"`
+	Args      []string `json:"args"`
+	Timestamp int64    `json:"timestamp"`
+	Nonce     string   `json:"nonce"`
+	Signature string   `json:"signature"`
+}
+
+// Response is what the helper replies to a request with. Error is empty when
+// the action succeeded.
+type Response struct {
+	Output string `json:"output"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Handler performs an action for the given arguments and returns its output.
+// Requests with arguments are refused before they reach a handler, so the
+// arguments are always empty for now.
+type Handler func(args []string) (string, error)
+
+// Server is a running privileged helper.
+type Server struct {
+	socketPath string
+	key        string
+	listener   net.Listener
+	nonces     map[string]time.Time
+	requests   sync.WaitGroup
+	lock       sync.Mutex
+}
+
+var handlers = make(map[string]Handler)
+var handlersLock sync.Mutex
+
+// serving is set in the helper itself so it never sends requests to itself
+var serving bool
+var servingLock sync.Mutex
+
+// Handle will register the handler which performs the given action in the
+// helper. Registering the same action again replaces its handler.
+func Handle(action string, handler Handler) {
+
+	handlersLock.Lock()
+	defer handlersLock.Unlock()
+
+	handlers[action] = handler
+}
+
+// Serve will start answering requests on the given socket. The socket and the
+// key requests must be signed with are readable by root and the given user
+// only.
+func Serve(socketPath string, username string) (*Server, error) {
+
+	keyBytes := make([]byte, 32)
+	if _, randErr := rand.Read(keyBytes); randErr != nil {
+		return nil, randErr
+	}
+
+	srv := &Server{socketPath: socketPath, key: hex.EncodeToString(keyBytes), nonces: make(map[string]time.Time)}
+
+	// a socket left behind by a helper which didn't shut down cleanly
+	if removeErr := os.Remove(socketPath); removeErr != nil && !os.IsNotExist(removeErr) {
+		return nil, removeErr
+	}
+
+	// the key is created afresh so nothing left in its place, such as a
+	// symlink to a file only root should write to, is ever written through
+	keyPath := socketPath + KEY_EXTENSION
+	if removeErr := os.Remove(keyPath); removeErr != nil && !os.IsNotExist(removeErr) {
+		return nil, removeErr
+	}
+	keyFile, createErr := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|NO_FOLLOW_FLAG, 0600)
+	if createErr != nil {
+		return nil, createErr
+	}
+	_, writeErr := keyFile.WriteString(srv.key)
+	if closeErr := keyFile.Close(); writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr != nil {
+		os.Remove(keyPath)
+		return nil, writeErr
+	}
+	if chownErr := chownTo(keyPath, username); chownErr != nil {
+		return nil, chownErr
+	}
+
+	// listening fails rather than following anything already at the path,
+	// and the socket is checked again before its permissions are changed
+	listener, listenErr := net.Listen("unix", socketPath)
+	if listenErr != nil {
+		return nil, listenErr
+	}
+	if info, statErr := os.Lstat(socketPath); statErr != nil || info.Mode()&os.ModeSocket == 0 {
+		listener.Close()
+		return nil, fmt.Errorf("%v was replaced while the privileged helper was starting", socketPath)
+	}
+	if chmodErr := os.Chmod(socketPath, 0600); chmodErr != nil {
+		listener.Close()
+		return nil, chmodErr
+	}
+	if chownErr := chownTo(socketPath, username); chownErr != nil {
+		listener.Close()
+		return nil, chownErr
+	}
+
+	srv.listener = listener
+
+	servingLock.Lock()
+	serving = true
+	servingLock.Unlock()
+
+	go srv.accept()
+
+	logger.Lgr.LogMessagef("Successfully started the privileged helper on %v for %v", socketPath, username)
+	return srv, nil
+}
+
+// accept will answer every connection to the socket until it's closed.
+func (srv *Server) accept() {
+
+	for 1 == 1 {
+		conn, acceptErr := srv.listener.Accept()
+		if acceptErr != nil {
+			return
+		}
+
+		srv.requests.Add(1)
+		go func() {
+			defer srv.requests.Done()
+			srv.answer(conn)
+		}()
+	}
+
+	return
+}
+
+// answer will read a single request from the given connection, perform it if
+// it's genuine and reply with the outcome.
+func (srv *Server) answer(conn net.Conn) {
+
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(CALL_TIMEOUT_SECONDS * time.Second))
+
+	var request Request
+	if decodeErr := json.NewDecoder(conn).Decode(&request); decodeErr != nil {
+		logger.Lgr.LogErrorf("Unable to read a privileged request: %v", decodeErr)
+		return
+	}
+
+	response := Response{}
+	output, actionErr := srv.perform(request, time.Now())
+	response.Output = output
+	if actionErr != nil {
+		response.Error = actionErr.Error()
+	}
+
+	if encodeErr := json.NewEncoder(conn).Encode(response); encodeErr != nil {
+		logger.Lgr.LogErrorf("Unable to reply to the privileged request %v: %v", request.Action, encodeErr)
+	}
+}
+
+// perform will verify the given request and run the handler for its action.
+func (srv *Server) perform(request Request, now time.Time) (string, error) {
+
+	if verifyErr := request.Verify(srv.key, now); verifyErr != nil {
+		logger.Lgr.LogErrorf("Refused privileged request %v: %v", request.Action, verifyErr)
+		return "", verifyErr
+	}
+
+	// none of the actions take arguments, so anything in them is either a
+	// mistake or an attempt to steer a handler which would silently ignore it
+	if len(request.Args) > 0 {
+		logger.Lgr.LogErrorf("Refused privileged request %v with arguments: %v", request.Action, request.Args)
+		return "", fmt.Errorf("Request %v can't take arguments", request.Action)
+	}
+
+	// remember every nonce for as long as its request could still be accepted
+	srv.lock.Lock()
+	for nonce, seen := range srv.nonces {
+		if now.Sub(seen) > 2*MAX_REQUEST_AGE_SECONDS*time.Second {
+			delete(srv.nonces, nonce)
+		}
+	}
+	_, replayed := srv.nonces[request.Nonce]
+	srv.nonces[request.Nonce] = now
+	srv.lock.Unlock()
+
+	if replayed {
+		logger.Lgr.LogErrorf("Refused replayed privileged request %v", request.Action)
+		return "", fmt.Errorf("Request %v has already been performed", request.Action)
+	}
+
+	handlersLock.Lock()
+	handler, found := handlers[request.Action]
+	handlersLock.Unlock()
+
+	if !found {
+		return "", fmt.Errorf("The privileged helper can't perform %v", request.Action)
+	}
+
+	logger.Lgr.LogMessagef("Performing privileged request %v %v", request.Action, request.Args)
+	output, actionErr := handler(request.Args)
+	if actionErr != nil {
+		logger.Lgr.LogErrorf("Privileged request %v failed: %v", request.Action, actionErr)
+		return output, actionErr
+	}
+
+	logger.Lgr.LogMessagef("Successfully performed privileged request %v", request.Action)
+	return output, nil
+}
+
+// Shutdown will stop accepting requests, wait for any being performed to
+// finish or the given context to expire, and remove the socket and key.
+func (srv *Server) Shutdown(ctx context.Context) error {
+
+	closeErr := srv.listener.Close()
+	os.Remove(srv.socketPath)
+	os.Remove(srv.socketPath + KEY_EXTENSION)
+
+	servingLock.Lock()
+	serving = false
+	servingLock.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		srv.requests.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return closeErr
+}
+
+// Verify will make sure the request was signed with the given key and isn't
+// more than MAX_REQUEST_AGE_SECONDS away from now.
+func (request Request) Verify(key string, now time.Time) error {
+
+	expected := Sign(key, request.Action, request.Timestamp, request.Nonce, request.Args)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(request.Signature))) {
+		return fmt.Errorf("Request %v has an invalid signature", request.Action)
+	}
+
+	age := now.Unix() - request.Timestamp
+	if age > MAX_REQUEST_AGE_SECONDS || age < -MAX_REQUEST_AGE_SECONDS {
+		return fmt.Errorf("Request %v has a timestamp %d seconds away from now", request.Action, age)
+	}
+
+	return nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of the action, timestamp, nonce
+// and args, encoded by utils.SigningArgs, joined by newlines using the given
+// key.
+func Sign(key string, action string, timestamp int64, nonce string, args []string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(action + "\n" + strconv.FormatInt(timestamp, 10) + "\n" + nonce + "\n" + utils.SigningArgs(args)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Available returns whether requests should be sent to a privileged helper,
+// which is when this isn't the helper itself and the key of a running one can
+// be read.
+func Available() bool {
+
+	servingLock.Lock()
+	isHelper := serving
+	servingLock.Unlock()
+
+	if isHelper || config.Cfg == nil || config.Cfg.PrivilegedSocket == "" {
+		return false
+	}
+
+	_, statErr := os.Stat(config.Cfg.PrivilegedSocket + KEY_EXTENSION)
+	return statErr == nil
+}
+
+// Call will ask the privileged helper listening on PrivilegedSocket to
+// perform the given action and return its output.
+func Call(action string, args []string) (string, error) {
+
+	socketPath := config.Cfg.PrivilegedSocket
+
+	key, readErr := ioutil.ReadFile(socketPath + KEY_EXTENSION)
+	if readErr != nil {
+		return "", fmt.Errorf("Unable to read the privileged helper's key: %v", readErr)
+	}
+
+	nonceBytes := make([]byte, 16)
+	if _, randErr := rand.Read(nonceBytes); randErr != nil {
+		return "", randErr
+	}
+
+	request := Request{Action: action, Args: args, Timestamp: time.Now().Unix(), Nonce: hex.EncodeToString(nonceBytes)}
+	request.Signature = Sign(strings.TrimSpace(string(key)), request.Action, request.Timestamp, request.Nonce, request.Args)
+
+	conn, dialErr := net.DialTimeout("unix", socketPath, MAX_REQUEST_AGE_SECONDS*time.Second)
+	if dialErr != nil {
+		return "", fmt.Errorf("Unable to reach the privileged helper on %v: %v", socketPath, dialErr)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(CALL_TIMEOUT_SECONDS * time.Second))
+
+	if encodeErr := json.NewEncoder(conn).Encode(request); encodeErr != nil {
+		return "", encodeErr
+	}
+
+	var response Response
+	if decodeErr := json.NewDecoder(conn).Decode(&response); decodeErr != nil {
+		return "", fmt.Errorf("No reply from the privileged helper to %v: %v", action, decodeErr)
+	}
+
+	if response.Error != "" {
+		return response.Output, fmt.Errorf("The privileged helper couldn't %v: %v", action, response.Error)
+	}
+
+	logger.Lgr.LogMessagef("Successfully had the privileged helper perform %v", action)
+	return response.Output, nil
+}
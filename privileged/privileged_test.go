@@ -0,0 +1,134 @@
+package privileged
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+func TestMain(m *testing.M) {
+
+	logErr := logger.StandardLogger("privileged_test")
+	if logErr != nil {
+		fmt.Println(fmt.Sprintf("Could not initialize logger: %v", logErr))
+		return
+	}
+
+	configErr := config.FromFile()
+	if configErr != nil {
+		return
+	}
+
+	result := m.Run()
+	os.Exit(result)
+}
+
+func TestServe(t *testing.T) {
+
+	current, userErr := user.Current()
+	if userErr != nil {
+		t.Fatal(userErr)
+	}
+
+	socketDir, dirErr := ioutil.TempDir("", "privileged_test")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(socketDir)
+
+	defer func(socketPath string) {
+		config.Cfg.PrivilegedSocket = socketPath
+	}(config.Cfg.PrivilegedSocket)
+	config.Cfg.PrivilegedSocket = filepath.Join(socketDir, "privileged.sock")
+
+	Handle("echo", func(args []string) (string, error) {
+		return "echo" + strings.Join(args, " "), nil
+	})
+
+	// a symlink left where the key goes must not be written through
+	victim := filepath.Join(socketDir, "victim")
+	ioutil.WriteFile(victim, []byte("untouched"), 0644)
+	os.Symlink(victim, config.Cfg.PrivilegedSocket+KEY_EXTENSION)
+
+	srv, serveErr := Serve(config.Cfg.PrivilegedSocket, current.Username)
+	if serveErr != nil {
+		t.Fatal(serveErr)
+	}
+
+	if contents, _ := ioutil.ReadFile(victim); string(contents) != "untouched" {
+		t.Errorf("expected the key to be written to a new file, got: %s", contents)
+	}
+
+	if Available() {
+		t.Errorf("expected the helper never to send requests to itself")
+	}
+
+	if info, statErr := os.Stat(config.Cfg.PrivilegedSocket + KEY_EXTENSION); statErr != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the key to be readable by its owner only, got: %v %v", info, statErr)
+	}
+
+	output, callErr := Call("echo", nil)
+	if callErr != nil || output != "echo" {
+		t.Errorf("expected the helper to perform the action, got: %v %v", output, callErr)
+	}
+
+	if _, argsErr := Call("echo", []string{"hello", "world"}); argsErr == nil {
+		t.Errorf("expected a request with arguments to be refused")
+	}
+
+	if _, unknownErr := Call("format-disk", nil); unknownErr == nil {
+		t.Errorf("expected an action without a handler to be refused")
+	}
+
+	// a request signed with the wrong key, an old request and a replayed one
+	now := time.Now()
+	forged := Request{Action: "echo", Timestamp: now.Unix(), Nonce: "forged"}
+	forged.Signature = Sign("not the key", forged.Action, forged.Timestamp, forged.Nonce, forged.Args)
+	if _, forgedErr := srv.perform(forged, now); forgedErr == nil {
+		t.Errorf("expected a request signed with the wrong key to be refused")
+	}
+
+	old := Request{Action: "echo", Timestamp: now.Unix() - MAX_REQUEST_AGE_SECONDS - 1, Nonce: "old"}
+	old.Signature = Sign(srv.key, old.Action, old.Timestamp, old.Nonce, old.Args)
+	if _, oldErr := srv.perform(old, now); oldErr == nil {
+		t.Errorf("expected an old request to be refused")
+	}
+
+	genuine := Request{Action: "echo", Timestamp: now.Unix(), Nonce: "genuine"}
+	genuine.Signature = Sign(srv.key, genuine.Action, genuine.Timestamp, genuine.Nonce, genuine.Args)
+	if _, genuineErr := srv.perform(genuine, now); genuineErr != nil {
+		t.Errorf("expected a genuine request to be performed, got: %v", genuineErr)
+	}
+	if _, replayErr := srv.perform(genuine, now); replayErr == nil {
+		t.Errorf("expected a replayed request to be refused")
+	}
+
+	if shutdownErr := srv.Shutdown(context.Background()); shutdownErr != nil {
+		t.Error(shutdownErr)
+	}
+
+	if Available() {
+		t.Errorf("expected the helper to be unavailable once it's shut down")
+	}
+
+	if _, statErr := os.Stat(config.Cfg.PrivilegedSocket); !os.IsNotExist(statErr) {
+		t.Errorf("expected the socket to be removed, got: %v", statErr)
+	}
+}
+
+func TestRunAs(t *testing.T) {
+
+	if runAsErr := RunAs(exec.Command("true"), "root"); runAsErr == nil {
+		t.Errorf("expected the agent to never be run as root")
+	}
+}
@@ -0,0 +1,150 @@
+//go:build !windows
+
+package privileged
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+// Added to the flags the key is created with so a symlink left in its place
+// is never followed
+const NO_FOLLOW_FLAG = syscall.O_NOFOLLOW
+
+// lookup returns the user and group IDs of the given user.
+func lookup(username string) (int, int, error) {
+
+	account, lookupErr := user.Lookup(username)
+	if lookupErr != nil {
+		return 0, 0, lookupErr
+	}
+
+	uid, uidErr := strconv.Atoi(account.Uid)
+	if uidErr != nil {
+		return 0, 0, uidErr
+	}
+
+	gid, gidErr := strconv.Atoi(account.Gid)
+	if gidErr != nil {
+		return 0, 0, gidErr
+	}
+
+	return uid, gid, nil
+}
+
+// chownTo will make the given user the owner of the given file.
+func chownTo(path string, username string) error {
+
+	uid, gid, lookupErr := lookup(username)
+	if lookupErr != nil {
+		return lookupErr
+	}
+
+	return os.Lchown(path, uid, gid)
+}
+
+// agentIds returns the user and group IDs of the given user, refusing root
+// since running the agent as root would defeat the helper.
+func agentIds(username string) (int, int, error) {
+
+	uid, gid, lookupErr := lookup(username)
+	if lookupErr != nil {
+		return 0, 0, lookupErr
+	}
+
+	if uid == 0 {
+		return 0, 0, fmt.Errorf("The AgentUser %v is root. Set it to an unprivileged user in %v", username, CONFIG_FILE)
+	}
+
+	return uid, gid, nil
+}
+
+// RunAs will make the given command run as the given user when it's started,
+// keeping its data in AGENT_DATA_DIR.
+func RunAs(cmd *exec.Cmd, username string) error {
+
+	uid, gid, lookupErr := agentIds(username)
+	if lookupErr != nil {
+		return lookupErr
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}}
+	cmd.Env = append(os.Environ(), config.DATA_DIR_VARIABLE+"="+AGENT_DATA_DIR)
+	return nil
+}
+
+// Prepare will create AGENT_DATA_DIR, unless it already exists, and hand it
+// over to the given user. Nothing else is handed over, and nothing within it
+// is touched, so the agent can't steer the helper into giving it a file it
+// links there.
+func Prepare(username string) error {
+
+	uid, gid, lookupErr := agentIds(username)
+	if lookupErr != nil {
+		return lookupErr
+	}
+
+	if mkdirErr := os.Mkdir(AGENT_DATA_DIR, 0700); mkdirErr != nil && !os.IsExist(mkdirErr) {
+		return mkdirErr
+	}
+
+	// a symlink isn't a directory, so this also refuses one planted in its place
+	info, statErr := os.Lstat(AGENT_DATA_DIR)
+	if statErr != nil {
+		return statErr
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%v isn't a directory. Remove it so the privileged helper can create it", AGENT_DATA_DIR)
+	}
+
+	if chownErr := os.Lchown(AGENT_DATA_DIR, uid, gid); chownErr != nil {
+		return chownErr
+	}
+	if chmodErr := os.Chmod(AGENT_DATA_DIR, 0700); chmodErr != nil {
+		return chmodErr
+	}
+
+	logger.Lgr.LogMessagef("Successfully handed %v over to %v", AGENT_DATA_DIR, username)
+	return nil
+}
+
+// LoadConfig will replace the config with CONFIG_FILE, refusing it unless it
+// and the directory it's in are owned by root and writable by root only.
+func LoadConfig() error {
+
+	for _, path := range []string{filepath.Dir(CONFIG_FILE), CONFIG_FILE} {
+		if ownerErr := rootOwned(path); ownerErr != nil {
+			return ownerErr
+		}
+	}
+
+	return config.FromPath(CONFIG_FILE)
+}
+
+// rootOwned returns an error unless the given path is owned by root, isn't
+// writable by anyone else and isn't a symlink.
+func rootOwned(path string) error {
+
+	info, statErr := os.Lstat(path)
+	if statErr != nil {
+		return statErr
+	}
+
+	stat, isStat := info.Sys().(*syscall.Stat_t)
+	if !isStat {
+		return fmt.Errorf("Unable to find the owner of %v", path)
+	}
+	if stat.Uid != 0 || info.Mode()&os.ModeSymlink != 0 || info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%v must be owned by root and writable by root only, but it's %v owned by %d", path, info.Mode(), stat.Uid)
+	}
+
+	return nil
+}
@@ -0,0 +1,31 @@
+package privileged
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// Windows has no flag to refuse a symlink when a file is opened, and the
+// helper isn't supported there anyway
+const NO_FOLLOW_FLAG = 0
+
+// chownTo does nothing on windows, where the helper isn't supported.
+func chownTo(path string, username string) error {
+	return nil
+}
+
+// RunAs isn't supported on windows, where starting a process as another user
+// needs that user's password.
+func RunAs(cmd *exec.Cmd, username string) error {
+	return fmt.Errorf("Running the agent as %v isn't supported on windows. Leave AgentUser empty to run everything as the service's user", username)
+}
+
+// Prepare isn't supported on windows.
+func Prepare(username string) error {
+	return fmt.Errorf("Running the agent as %v isn't supported on windows. Leave AgentUser empty to run everything as the service's user", username)
+}
+
+// LoadConfig isn't supported on windows.
+func LoadConfig() error {
+	return fmt.Errorf("The privileged helper isn't supported on windows. Leave AgentUser empty to run everything as the service's user")
+}
@@ -0,0 +1,66 @@
+package profiler
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the prefix of the name of every GPU metric, followed by the index of the GPU
+const GPU_METRIC_PREFIX = "gpu"
+
+// how long nvidia-smi has to report the GPU metrics. In seconds
+const GPU_QUERY_TIMEOUT_SECONDS = 10
+
+// the fields nvidia-smi is asked for, in order, along with the name of the
+// metric each is recorded as
+var gpuQueryFields = []string{"index", "temperature.gpu", "power.draw", "utilization.gpu", "fan.speed"}
+var gpuMetricNames = []string{"", "temp_c", "power_w", "utilization", "fan_percent"}
+
+// readGPUMetrics will ask nvidia-smi for the temperature, power draw,
+// utilization and fan speed of every NVIDIA GPU in this machine. Only
+// available where nvidia-smi is installed.
+func readGPUMetrics() (map[string]float64, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), GPU_QUERY_TIMEOUT_SECONDS*time.Second)
+	defer cancel()
+
+	output, queryErr := exec.CommandContext(ctx, "nvidia-smi", "--query-gpu="+strings.Join(gpuQueryFields, ","), "--format=csv,noheader,nounits").Output()
+	if queryErr != nil {
+		return nil, queryErr
+	}
+
+	return parseGPUMetrics(string(output))
+}
+
+// parseGPUMetrics converts the csv written by nvidia-smi into metrics named
+// like gpu0_temp_c. Fields a GPU doesn't support, which nvidia-smi reports as
+// [N/A], are left out.
+func parseGPUMetrics(output string) (map[string]float64, error) {
+
+	metrics := make(map[string]float64)
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		fields := strings.Split(line, ",")
+		if len(fields) != len(gpuQueryFields) {
+			return nil, fmt.Errorf("nvidia-smi reported %d fields instead of %d: %v", len(fields), len(gpuQueryFields), line)
+		}
+
+		index := strings.TrimSpace(fields[0])
+		for position := 1; position < len(fields); position++ {
+			value, parseErr := strconv.ParseFloat(strings.TrimSpace(fields[position]), 64)
+			if parseErr != nil {
+				continue
+			}
+			metrics[GPU_METRIC_PREFIX+index+"_"+gpuMetricNames[position]] = value
+		}
+	}
+
+	return metrics, nil
+}
@@ -0,0 +1,300 @@
+package profiler
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+// the number of seconds between each sample recorded into the profile history
+const HISTORY_SAMPLE_SECONDS = 300
+
+// the number of samples held on to in the profile history. 288 samples taken
+// every 5 minutes covers the last 24 hours.
+const MAX_HISTORY_SAMPLES = 288
+
+// the one minute load average per CPU at or above which this machine is short
+// of CPU
+const PRESSURE_LOAD_PER_CPU = 1.0
+
+// the available memory below which this machine is short of memory. In megabytes
+const PRESSURE_MEM_AVAILABLE_MB = 256
+
+// the share of MemoryLimitMB the agent's heap can reach before it's short of
+// memory itself
+const PRESSURE_MEMORY_LIMIT_SHARE = 0.9
+
+// how many times less often the profiler runs while under pressure
+const PRESSURE_SLOWDOWN_FACTOR = 4
+
+// the LogSampling category the profile history samples are logged under
+const HISTORY_LOG_CATEGORY = "profiler"
+
+// the names of the metrics recorded into the profile history
+const HEAP_MB_METRIC = "heap_mb"
+const GOROUTINES_METRIC = "goroutines"
+const LOAD1_METRIC = "load1"
+const MEM_AVAILABLE_MB_METRIC = "mem_available_mb"
+
+// Sample is a single point in time measurement of the key metrics of this
+// machine.
+type Sample struct {
+	Time    time.Time
+	Metrics map[string]float64
+}
+
+// Collector measures extra metrics to add to every sample, such as those of a
+// plugin.
+type Collector func() (map[string]float64, error)
+
+var history []Sample
+var historyLock sync.Mutex
+var collectors = make(map[string]Collector)
+var collectorsLock sync.Mutex
+var underPressure bool
+var pressureLock sync.Mutex
+
+// RegisterCollector will add the metrics measured by the given collector to
+// every sample taken from now on. Registering a name a second time replaces
+// the previous collector. A collector which fails is logged and left out of
+// that sample.
+func RegisterCollector(name string, collector Collector) {
+	collectorsLock.Lock()
+	defer collectorsLock.Unlock()
+
+	collectors[name] = collector
+	logger.Lgr.LogMessagef("Successfully registered metric collector: %v", name)
+}
+
+// TakeSample will measure the key metrics of this machine right now along with
+// those of every registered collector. Metrics which aren't available on the
+// current GOOS are left out.
+func TakeSample() Sample {
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	sample := Sample{Time: time.Now(), Metrics: make(map[string]float64)}
+	sample.Metrics[HEAP_MB_METRIC] = float64(memStats.HeapAlloc) / (1024 * 1024)
+	sample.Metrics[GOROUTINES_METRIC] = float64(runtime.NumGoroutine())
+
+	if load1, loadErr := readLoadAverage(); loadErr == nil {
+		sample.Metrics[LOAD1_METRIC] = load1
+	}
+
+	if available, memErr := readMemAvailable(); memErr == nil {
+		sample.Metrics[MEM_AVAILABLE_MB_METRIC] = available
+	}
+
+	if gpuMetrics, gpuErr := readGPUMetrics(); gpuErr == nil {
+		for metric, value := range gpuMetrics {
+			sample.Metrics[metric] = value
+		}
+	}
+
+	collectorsLock.Lock()
+	registered := make(map[string]Collector, len(collectors))
+	for name, collector := range collectors {
+		registered[name] = collector
+	}
+	collectorsLock.Unlock()
+
+	for name, collector := range registered {
+		metrics, collectErr := collector()
+		if collectErr != nil {
+			logger.Lgr.LogErrorf("Metric collector %v failed: %v", name, collectErr)
+			continue
+		}
+		for metric, value := range metrics {
+			sample.Metrics[metric] = value
+		}
+	}
+
+	return sample
+}
+
+// RecordSample will take a new sample and add it to the profile history,
+// dropping the oldest sample once MAX_HISTORY_SAMPLES is reached.
+func RecordSample() Sample {
+
+	sample := TakeSample()
+
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	history = append(history, sample)
+	if len(history) > MAX_HISTORY_SAMPLES {
+		history = history[len(history)-MAX_HISTORY_SAMPLES:]
+	}
+
+	return sample
+}
+
+// History returns the recorded values of the given metric, oldest first.
+// Samples which are missing the metric are skipped.
+func History(metric string) []float64 {
+
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	var values []float64
+	for _, sample := range history {
+		if value, exists := sample.Metrics[metric]; exists {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+// Samples returns a copy of every sample in the profile history, oldest first.
+func Samples() []Sample {
+
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	samples := make([]Sample, len(history))
+	copy(samples, history)
+	return samples
+}
+
+// HistoryMetrics returns the names of every metric in the profile history in
+// alphabetical order.
+func HistoryMetrics() []string {
+
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	seen := make(map[string]bool)
+	var metrics []string
+	for _, sample := range history {
+		for metric := range sample.Metrics {
+			if !seen[metric] {
+				seen[metric] = true
+				metrics = append(metrics, metric)
+			}
+		}
+	}
+
+	sort.Strings(metrics)
+	return metrics
+}
+
+// RunHistory will record a new sample into the profile history every
+// HISTORY_SAMPLE_SECONDS while the profiler isn't turned off under Subsystems in
+// the config. Samples are taken PRESSURE_SLOWDOWN_FACTOR times less often
+// while the machine is UnderPressure.
+func RunHistory() {
+	go func() {
+		for 1 == 1 {
+			if config.Enabled(config.SUBSYSTEM_PROFILER) {
+				sample := RecordSample()
+				logger.Lgr.LogSampledf(HISTORY_LOG_CATEGORY, "Recorded profile history sample: %+v", sample.Metrics)
+			}
+			time.Sleep(Interval(HISTORY_SAMPLE_SECONDS * time.Second))
+		}
+	}()
+}
+
+// UnderPressure returns whether this machine is short of CPU or memory, so
+// the agent should back off to leave more for the workload. That's when the
+// one minute load average per CPU reaches PRESSURE_LOAD_PER_CPU, when less
+// than PRESSURE_MEM_AVAILABLE_MB is available, or when the agent's own heap
+// reaches PRESSURE_MEMORY_LIMIT_SHARE of MemoryLimitMB.
+func UnderPressure() bool {
+
+	if load1, loadErr := readLoadAverage(); loadErr == nil && load1/float64(runtime.NumCPU()) >= PRESSURE_LOAD_PER_CPU {
+		return true
+	}
+
+	if available, memErr := readMemAvailable(); memErr == nil && available < PRESSURE_MEM_AVAILABLE_MB {
+		return true
+	}
+
+	if config.Cfg.MemoryLimitMB > 0 {
+		var memStats runtime.MemStats
+		runtime.ReadMemStats(&memStats)
+		if float64(memStats.HeapAlloc)/(1024*1024) >= PRESSURE_MEMORY_LIMIT_SHARE*float64(config.Cfg.MemoryLimitMB) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Interval returns the given interval stretched by PRESSURE_SLOWDOWN_FACTOR
+// while the machine is UnderPressure. Logs whenever the machine comes under
+// pressure or recovers.
+func Interval(interval time.Duration) time.Duration {
+
+	pressured := UnderPressure()
+
+	pressureLock.Lock()
+	changed := pressured != underPressure
+	underPressure = pressured
+	pressureLock.Unlock()
+
+	if changed && pressured {
+		logger.Lgr.LogMessagef("This machine is short of CPU or memory. Profiling %d times less often until it recovers", PRESSURE_SLOWDOWN_FACTOR)
+	} else if changed {
+		logger.Lgr.LogMessage("This machine is no longer short of CPU or memory. Profiling at the usual rate")
+	}
+
+	if pressured {
+		return interval * PRESSURE_SLOWDOWN_FACTOR
+	}
+
+	return interval
+}
+
+// readLoadAverage will read the one minute load average from /proc/loadavg.
+// Only available on linux.
+func readLoadAverage() (float64, error) {
+
+	loadBytes, readErr := ioutil.ReadFile("/proc/loadavg")
+	if readErr != nil {
+		return 0, readErr
+	}
+
+	fields := strings.Fields(string(loadBytes))
+	if len(fields) == 0 {
+		return 0, os.ErrNotExist
+	}
+
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// readMemAvailable will read the amount of available memory in megabytes from
+// /proc/meminfo. Only available on linux.
+func readMemAvailable() (float64, error) {
+
+	memInfo, openErr := os.Open("/proc/meminfo")
+	if openErr != nil {
+		return 0, openErr
+	}
+
+	defer memInfo.Close()
+
+	scanner := bufio.NewScanner(memInfo)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kilobytes, parseErr := strconv.ParseFloat(fields[1], 64)
+			if parseErr != nil {
+				return 0, parseErr
+			}
+			return kilobytes / 1024, nil
+		}
+	}
+
+	return 0, os.ErrNotExist
+}
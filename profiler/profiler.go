@@ -21,6 +21,9 @@ const PROFILE_EMAIL_SUBJECT = "System Profile"
 // the base name of the archive file that we save all our individual reports into
 const SYS_PROFILE_ARCHIVE_NAME = "profile_archive"
 
+// the number of the most recent main log files to attach alongside the profile
+const PROFILE_LOG_ATTACHMENT_COUNT = 3
+
 // ProfileAsArchive will generate an individual file for each
 // system resources and then compress them all together. Returns a pointer to
 // the compressed file containing all of the profile pieces inside of it.
@@ -37,21 +40,21 @@ func ProfileAsArchive() (*os.File, error) {
 		return nil, err
 	}
 
-	logger.Lgr.LogMessage("Successfully created new archive tar: %v", tarBall.Name())
+	logger.Lgr.LogMessagef("Successfully created new archive tar: %v", tarBall.Name())
 
 	loaderAssetPath, assetErr := utils.SysAssetPath("profiler_loader.json")
 	if assetErr != nil {
 		return nil, assetErr
 	}
 
-	logger.Lgr.LogMessage("Successfully loaded profile_loader asset: %v", loaderAssetPath)
+	logger.Lgr.LogMessagef("Successfully loaded profile_loader asset: %v", loaderAssetPath)
 
 	profileLoader, err = loader.NewLoader(loaderAssetPath)
 	if err != nil {
 		return nil, fmt.Errorf("Loader returned error while trying to generate Profile: %v", err)
 	}
 
-	logger.Lgr.LogMessage("Successfully created new profile loader instance with: %v", loaderAssetPath)
+	logger.Lgr.LogMessagef("Successfully created new profile loader instance with: %v", loaderAssetPath)
 
 	profilerProcesses := profileLoader.StartAsynchronous()
 
@@ -93,7 +96,7 @@ func ProfileAsArchive() (*os.File, error) {
 			break
 		}
 
-		logger.Lgr.LogMessage("Successfully wrote %v to the tarball and deleted it from disk", logName)
+		logger.Lgr.LogMessagef("Successfully wrote %v to the tarball and deleted it from disk", logName)
 	}
 
 	if err != nil {
@@ -112,7 +115,8 @@ func ProfileAsArchive() (*os.File, error) {
 // system profile inside its own file. It will then gzip and tarball the
 // resulting pieces into a single archive for compressing and convenience
 // purposes. The original pieces will be automatically cleaned up when the
-// archive is generated.
+// archive is generated. The most recent main log files are attached alongside
+// the archive so the report contains everything needed to diagnose the host.
 func SendArchiveProfileAsAttachment() (*os.File, error) {
 	filePtr, err := ProfileAsArchive()
 	if err != nil {
@@ -121,7 +125,10 @@ func SendArchiveProfileAsAttachment() (*os.File, error) {
 
 	logger.Lgr.LogMessage("Successfully created system profile archive. Will attempt to email now")
 
-	return filePtr, reporter.SendAttachment(generateEmailSubject(), generateEmailBody(), filePtr)
+	attachments := reporter.FileAttachments(filePtr.Name())
+	attachments = append(attachments, reporter.LogAttachments(logger.Lgr, PROFILE_LOG_ATTACHMENT_COUNT)...)
+
+	return filePtr, reporter.SendReport(generateEmailSubject(), generateEmailBody(), attachments)
 }
 
 // generateEmailSubject will create the necessary formatted and pretty email
@@ -130,7 +137,7 @@ func generateEmailSubject() string {
 	var buf bytes.Buffer
 	buf.WriteString(PROFILE_EMAIL_SUBJECT)
 	buf.WriteString(" ")
-	buf.WriteString(utils.FullDateString())
+	buf.WriteString(utils.TimeStamp(time.Now()))
 	return string(buf.Bytes())
 }
 
@@ -138,19 +145,27 @@ func generateEmailSubject() string {
 // for the current profile that was just generated.
 func generateEmailBody() []byte {
 	var buf bytes.Buffer
-	buf.WriteString("A full system profile is attached.")
+	buf.WriteString("A full system profile is attached along with the most recent logs.")
 	return buf.Bytes()
 }
 
 // Run will ensure that the profiler is constantly active and sending out
-// new profile updates at the interval defined by CheckInFrequencySeconds.
+// new profile updates at the interval defined by CheckInFrequencySeconds, or
+// PRESSURE_SLOWDOWN_FACTOR times less often while the machine is
+// UnderPressure. Profiles aren't sent while the profiler is turned off under
+// Subsystems in the config.
 func Run() {
 	// kick off the system profiler loop to send out system profiles at the specified interval
 	go func() {
 		for 1 == 1 {
-			logger.Lgr.LogMessage("Sleeping for %d seconds before sending a system profile", config.Cfg.CheckInFrequencySeconds)
-			time.Sleep(time.Duration(config.Cfg.CheckInFrequencySeconds) * time.Second)
-			logger.Lgr.LogMessage("Sending archive to provided email after sleeping %d seconds", config.Cfg.CheckInFrequencySeconds)
+			wait := Interval(time.Duration(config.Cfg.CheckInFrequencySeconds) * time.Second)
+			logger.Lgr.LogMessagef("Sleeping for %v before sending a system profile", wait)
+			time.Sleep(wait)
+			if !config.Enabled(config.SUBSYSTEM_PROFILER) {
+				logger.Lgr.LogMessage("The profiler is turned off in the config. Skipping the system profile")
+				continue
+			}
+			logger.Lgr.LogMessagef("Sending archive to provided email after sleeping %v", wait)
 			SendArchiveProfileAsAttachment()
 		}
 	}()
@@ -3,7 +3,9 @@ package profiler
 import (
 	"fmt"
 	"os"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/seantcanavan/anon-eth-net/config"
 	"github.com/seantcanavan/anon-eth-net/logger"
@@ -33,3 +35,77 @@ func TestSendFileArchiveAsAttachment(t *testing.T) {
 	}
 	fmt.Println(fmt.Sprintf("Archive successfully created: %v", filePtr.Name()))
 }
+
+func TestRecordSample(t *testing.T) {
+	RecordSample()
+	RecordSample()
+
+	if values := History(GOROUTINES_METRIC); len(values) < 2 {
+		t.Errorf("expected at least 2 goroutine samples, got: %v", values)
+	}
+}
+
+func TestRegisterCollector(t *testing.T) {
+
+	RegisterCollector("test", func() (map[string]float64, error) {
+		return map[string]float64{"test_metric": 42}, nil
+	})
+	RegisterCollector("failing", func() (map[string]float64, error) {
+		return nil, fmt.Errorf("failed on purpose")
+	})
+	defer func() {
+		collectorsLock.Lock()
+		delete(collectors, "test")
+		delete(collectors, "failing")
+		collectorsLock.Unlock()
+	}()
+
+	sample := TakeSample()
+	if sample.Metrics["test_metric"] != 42 {
+		t.Errorf("expected the registered collector's metric in the sample, got: %+v", sample.Metrics)
+	}
+	if _, exists := sample.Metrics[GOROUTINES_METRIC]; !exists {
+		t.Errorf("expected a failing collector not to stop the rest of the sample, got: %+v", sample.Metrics)
+	}
+}
+
+func TestInterval(t *testing.T) {
+
+	defer func(limitMB int) {
+		config.Cfg.MemoryLimitMB = limitMB
+	}(config.Cfg.MemoryLimitMB)
+
+	// a heap well past 90% of the limit puts the agent itself under pressure
+	config.Cfg.MemoryLimitMB = 1
+	ballast := make([]byte, 4*1024*1024)
+
+	if !UnderPressure() {
+		t.Errorf("expected a heap past the MemoryLimitMB to count as pressure")
+	}
+
+	if interval := Interval(time.Minute); interval != PRESSURE_SLOWDOWN_FACTOR*time.Minute {
+		t.Errorf("expected the interval to be stretched under pressure, got: %v", interval)
+	}
+
+	runtime.KeepAlive(ballast)
+}
+
+func TestParseGPUMetrics(t *testing.T) {
+
+	metrics, parseErr := parseGPUMetrics("0, 64, 121.50, 98, 70\n1, 58, 110.25, 97, [N/A]\n")
+	if parseErr != nil {
+		t.Fatal(parseErr)
+	}
+
+	if metrics["gpu0_temp_c"] != 64 || metrics["gpu0_power_w"] != 121.5 || metrics["gpu1_utilization"] != 97 {
+		t.Errorf("expected the metrics of both GPUs, got: %+v", metrics)
+	}
+
+	if _, exists := metrics["gpu1_fan_percent"]; exists {
+		t.Errorf("expected a field the GPU doesn't support to be left out, got: %+v", metrics)
+	}
+
+	if _, parseErr := parseGPUMetrics("0, 64\n"); parseErr == nil {
+		t.Errorf("expected a line with missing fields to fail")
+	}
+}
@@ -0,0 +1,356 @@
+package profit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/eth"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/pool"
+	"github.com/seantcanavan/anon-eth-net/profiler"
+	"github.com/seantcanavan/anon-eth-net/transport"
+)
+
+// How long the price service has to reply. In seconds
+const PRICE_TIMEOUT_SECONDS = 30
+
+// The most bytes read from the price service
+const MAX_PRICE_RESPONSE_BYTES = 64 * 1024
+
+// The number of blocks the average block time is measured over
+const BLOCK_TIME_BLOCKS = 100
+
+// The hashes per second in one megahash per second
+const HASHES_PER_MEGAHASH = 1000000
+
+// The names of the metrics recorded into the profile history
+const PRICE_METRIC = "eth_price"
+const DIFFICULTY_METRIC = "network_difficulty_th"
+const REVENUE_METRIC = "revenue_daily"
+const POWER_COST_METRIC = "power_cost_daily"
+const PROFIT_METRIC = "profit_daily"
+
+// Estimate is the estimated daily profit of this machine at a point in time.
+// Amounts are in the ProfitCurrency.
+type Estimate struct {
+	Time            time.Time `json:"time"`
+	Currency        string    `json:"currency"`
+	Price           float64   `json:"price"`
+	Difficulty      float64   `json:"difficulty"`
+	BlockSeconds    float64   `json:"blockSeconds"`
+	HashrateMHs     float64   `json:"hashrateMHs"`
+	HashrateSource  string    `json:"hashrateSource"`
+	PowerWatts      float64   `json:"powerWatts"`
+	PowerSource     string    `json:"powerSource"`
+	CoinsPerDay     float64   `json:"coinsPerDay"`
+	RevenuePerDay   float64   `json:"revenuePerDay"`
+	PowerCostPerDay float64   `json:"powerCostPerDay"`
+	ProfitPerDay    float64   `json:"profitPerDay"`
+}
+
+// block is the part of a block returned by eth_getBlockByNumber which is
+// needed.
+type block struct {
+	Number     string `json:"number"`
+	Difficulty string `json:"difficulty"`
+	Timestamp  string `json:"timestamp"`
+}
+
+var latest *Estimate
+var latestErr error
+var estimateLock sync.Mutex
+
+// Run will estimate the daily profit every ProfitCheckSeconds. Does nothing
+// while ProfitCheckSeconds is zero, so it can be turned on via the config
+// without a restart.
+func Run() {
+	go func() {
+		for 1 == 1 {
+			if config.Cfg.ProfitCheckSeconds > 0 {
+				if _, estimateErr := Check(); estimateErr != nil {
+					logger.Lgr.LogErrorf("Failed to estimate the daily profit: %v", estimateErr)
+				}
+				time.Sleep(time.Duration(config.Cfg.ProfitCheckSeconds) * time.Second)
+				continue
+			}
+
+			time.Sleep(time.Minute)
+		}
+	}()
+}
+
+// Check will fetch the price of ETH and the network difficulty, combine them
+// with the measured hashrate and power draw, and keep the resulting estimate
+// for the status report and the metrics.
+func Check() (Estimate, error) {
+
+	estimate, estimateErr := Estimated()
+
+	estimateLock.Lock()
+	latestErr = estimateErr
+	if estimateErr == nil {
+		latest = &estimate
+	}
+	estimateLock.Unlock()
+
+	if estimateErr == nil {
+		logger.Lgr.LogMessagef("Successfully estimated a daily profit of %.2f %v at %.1f MH/s", estimate.ProfitPerDay, estimate.Currency, estimate.HashrateMHs)
+	}
+
+	return estimate, estimateErr
+}
+
+// Estimated returns the estimated daily profit of this machine right now.
+// The hashrate is that of the loader's miners or, when there aren't any, the
+// effective hashrate reported by the Pools. The power draw is PowerDrawWatts
+// or, when it isn't set, what the GPUs report drawing.
+func Estimated() (Estimate, error) {
+
+	estimate := Estimate{Time: time.Now(), Currency: strings.ToUpper(config.Cfg.ProfitCurrency)}
+
+	price, priceErr := FetchPrice()
+	if priceErr != nil {
+		return estimate, fmt.Errorf("Could not fetch the price of ETH: %v", priceErr)
+	}
+	estimate.Price = price
+
+	difficulty, blockSeconds, difficultyErr := FetchDifficulty()
+	if difficultyErr != nil {
+		return estimate, fmt.Errorf("Could not fetch the network difficulty: %v", difficultyErr)
+	}
+	estimate.Difficulty = difficulty
+	estimate.BlockSeconds = blockSeconds
+
+	estimate.HashrateMHs, estimate.HashrateSource = measuredHashrate()
+	estimate.PowerWatts, estimate.PowerSource = powerDraw()
+
+	return Calculate(estimate), nil
+}
+
+// Calculate fills in the daily coins, revenue, power cost and profit of the
+// given estimate from its price, difficulty, hashrate and power draw, after
+// the PoolFeePercent and at the PowerCostPerKWh. Each block pays
+// BlockRewardEth and takes difficulty hashes to find on average.
+func Calculate(estimate Estimate) Estimate {
+
+	if estimate.Difficulty > 0 {
+		hashesPerDay := estimate.HashrateMHs * HASHES_PER_MEGAHASH * 24 * 60 * 60
+		estimate.CoinsPerDay = hashesPerDay / estimate.Difficulty * config.Cfg.BlockRewardEth * (1 - config.Cfg.PoolFeePercent/100)
+	}
+
+	estimate.RevenuePerDay = estimate.CoinsPerDay * estimate.Price
+	estimate.PowerCostPerDay = estimate.PowerWatts / 1000 * 24 * config.Cfg.PowerCostPerKWh
+	estimate.ProfitPerDay = estimate.RevenuePerDay - estimate.PowerCostPerDay
+
+	return estimate
+}
+
+// FetchPrice will ask the PriceURL for the price of one ETH in the
+// ProfitCurrency. The reply is expected to look like CoinGecko's, e.g.
+// {"ethereum": {"usd": 3012.5}}.
+func FetchPrice() (float64, error) {
+
+	priceURL := config.Cfg.PriceURL
+	if strings.Contains(priceURL, "%v") {
+		priceURL = fmt.Sprintf(priceURL, strings.ToLower(config.Cfg.ProfitCurrency))
+	}
+
+	client := transport.NewClient("profit", PRICE_TIMEOUT_SECONDS*time.Second, transport.DEFAULT_CLIENT_RETRIES)
+	response, getErr := client.Get(priceURL)
+	if getErr != nil {
+		return 0, getErr
+	}
+	defer response.Body.Close()
+
+	if statusErr := transport.CheckStatus(response); statusErr != nil {
+		return 0, statusErr
+	}
+
+	body, readErr := ioutil.ReadAll(io.LimitReader(response.Body, MAX_PRICE_RESPONSE_BYTES))
+	if readErr != nil {
+		return 0, readErr
+	}
+
+	var prices map[string]map[string]float64
+	if jsonErr := json.Unmarshal(body, &prices); jsonErr != nil {
+		return 0, fmt.Errorf("Unable to read the reply from the price service: %v", jsonErr)
+	}
+
+	for _, currencies := range prices {
+		if price, priced := currencies[strings.ToLower(config.Cfg.ProfitCurrency)]; priced {
+			return price, nil
+		}
+	}
+
+	return 0, fmt.Errorf("The price service didn't reply with a price in %v", config.Cfg.ProfitCurrency)
+}
+
+// FetchDifficulty will ask the EthRPCURL for the difficulty of the latest
+// block and the average number of seconds between the last
+// BLOCK_TIME_BLOCKS blocks.
+func FetchDifficulty() (float64, float64, error) {
+
+	if config.Cfg.EthRPCURL == "" {
+		return 0, 0, fmt.Errorf("Set EthRPCURL to a node or provider to read the network difficulty from")
+	}
+
+	var head block
+	if callErr := eth.Call(config.Cfg.EthRPCURL, "eth_getBlockByNumber", []interface{}{"latest", false}, &head); callErr != nil {
+		return 0, 0, callErr
+	}
+
+	number, numberErr := eth.ParseQuantity(head.Number)
+	difficulty, difficultyErr := eth.ParseQuantity(head.Difficulty)
+	headTime, timeErr := eth.ParseQuantity(head.Timestamp)
+	if numberErr != nil || difficultyErr != nil || timeErr != nil {
+		return 0, 0, fmt.Errorf("The latest block %+v couldn't be read", head)
+	}
+
+	if number.Int64() < BLOCK_TIME_BLOCKS {
+		return 0, 0, fmt.Errorf("The chain only has %v blocks", number)
+	}
+
+	var earlier block
+	earlierNumber := fmt.Sprintf("0x%x", number.Int64()-BLOCK_TIME_BLOCKS)
+	if callErr := eth.Call(config.Cfg.EthRPCURL, "eth_getBlockByNumber", []interface{}{earlierNumber, false}, &earlier); callErr != nil {
+		return 0, 0, callErr
+	}
+
+	earlierTime, timeErr := eth.ParseQuantity(earlier.Timestamp)
+	if timeErr != nil {
+		return 0, 0, fmt.Errorf("Block %v couldn't be read: %v", earlierNumber, timeErr)
+	}
+
+	blockSeconds := float64(headTime.Int64()-earlierTime.Int64()) / BLOCK_TIME_BLOCKS
+	difficultyFloat, _ := new(big.Float).SetInt(difficulty).Float64()
+
+	return difficultyFloat, blockSeconds, nil
+}
+
+// Latest returns the last estimate made by Check, if there is one.
+func Latest() (Estimate, bool) {
+
+	estimateLock.Lock()
+	defer estimateLock.Unlock()
+
+	if latest == nil {
+		return Estimate{}, false
+	}
+
+	return *latest, true
+}
+
+// Metrics returns the price, difficulty, revenue, power cost and profit of the
+// last estimate for the profile history.
+func Metrics() (map[string]float64, error) {
+
+	metrics := make(map[string]float64)
+
+	estimate, estimated := Latest()
+	if !estimated {
+		return metrics, nil
+	}
+
+	metrics[PRICE_METRIC] = estimate.Price
+	metrics[DIFFICULTY_METRIC] = estimate.Difficulty / 1e12
+	metrics[REVENUE_METRIC] = estimate.RevenuePerDay
+	metrics[POWER_COST_METRIC] = estimate.PowerCostPerDay
+	metrics[PROFIT_METRIC] = estimate.ProfitPerDay
+
+	return metrics, nil
+}
+
+// Summary describes the last estimate for the status report.
+func Summary() (string, error) {
+
+	if config.Cfg.ProfitCheckSeconds <= 0 {
+		return "Profitability tracking is off. Set ProfitCheckSeconds to turn it on\n", nil
+	}
+
+	estimateLock.Lock()
+	estimate := latest
+	estimateErr := latestErr
+	estimateLock.Unlock()
+
+	var summary bytes.Buffer
+	if estimateErr != nil {
+		summary.WriteString(fmt.Sprintf("The last estimate failed: %v\n", estimateErr))
+	}
+	if estimate == nil {
+		return summary.String(), nil
+	}
+
+	currency := estimate.Currency
+	summary.WriteString(fmt.Sprintf("As of %v ago:\n", time.Since(estimate.Time).Round(time.Minute)))
+	summary.WriteString(fmt.Sprintf("ETH price: %.2f %v\n", estimate.Price, currency))
+	summary.WriteString(fmt.Sprintf("Network difficulty: %.2f TH with a block every %.1f seconds\n", estimate.Difficulty/1e12, estimate.BlockSeconds))
+	summary.WriteString(fmt.Sprintf("Hashrate: %.1f MH/s from %v\n", estimate.HashrateMHs, estimate.HashrateSource))
+	summary.WriteString(fmt.Sprintf("Revenue: %.6f ETH or %.2f %v a day after a pool fee of %.1f%%\n", estimate.CoinsPerDay, estimate.RevenuePerDay, currency, config.Cfg.PoolFeePercent))
+	summary.WriteString(fmt.Sprintf("Power: %.1f W from %v costing %.2f %v a day\n", estimate.PowerWatts, estimate.PowerSource, estimate.PowerCostPerDay, currency))
+	summary.WriteString(fmt.Sprintf("Profit: %.2f %v a day\n", estimate.ProfitPerDay, currency))
+
+	return summary.String(), nil
+}
+
+// measuredHashrate returns the combined hashrate of the loader's miners in
+// megahashes per second, as last recorded by the profiler, or the effective
+// hashrate of the Pools when no miners are running. Also returns where it
+// came from.
+func measuredHashrate() (float64, string) {
+
+	var hashrate float64
+	var miners int
+	for metric, value := range latestSample() {
+		if strings.HasPrefix(metric, "miner_") && strings.HasSuffix(metric, "_mhs") {
+			hashrate += value
+			miners++
+		}
+	}
+	if miners > 0 {
+		return hashrate, fmt.Sprintf("%d local miners", miners)
+	}
+
+	for _, stats := range pool.Latest() {
+		hashrate += stats.EffectiveHashrate / HASHES_PER_MEGAHASH
+	}
+
+	return hashrate, "the pools' effective hashrate"
+}
+
+// powerDraw returns PowerDrawWatts, or the combined power draw of the GPUs
+// last recorded by the profiler when it isn't set. Also returns where it came
+// from.
+func powerDraw() (float64, string) {
+
+	if config.Cfg.PowerDrawWatts > 0 {
+		return config.Cfg.PowerDrawWatts, "PowerDrawWatts"
+	}
+
+	var watts float64
+	for metric, value := range latestSample() {
+		if strings.HasPrefix(metric, profiler.GPU_METRIC_PREFIX) && strings.HasSuffix(metric, "_power_w") {
+			watts += value
+		}
+	}
+
+	return watts, "the GPUs"
+}
+
+// latestSample returns the metrics of the most recent profile history sample.
+func latestSample() map[string]float64 {
+
+	samples := profiler.Samples()
+	if len(samples) == 0 {
+		return nil
+	}
+
+	return samples[len(samples)-1].Metrics
+}
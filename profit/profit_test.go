@@ -0,0 +1,140 @@
+package profit
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/profiler"
+)
+
+func TestMain(m *testing.M) {
+
+	logErr := logger.StandardLogger("profit_test")
+	if logErr != nil {
+		fmt.Println(fmt.Sprintf("Could not initialize logger: %v", logErr))
+		return
+	}
+
+	configErr := config.FromFile()
+	if configErr != nil {
+		return
+	}
+
+	result := m.Run()
+	os.Exit(result)
+}
+
+// nearly reports whether the two amounts are equal to within rounding.
+func nearly(amount float64, expected float64) bool {
+	return math.Abs(amount-expected) < 0.000001
+}
+
+func TestCheck(t *testing.T) {
+
+	defer func(previous *config.Config) { config.Cfg = previous }(config.Cfg)
+	testConfig := *config.Cfg
+	config.Cfg = &testConfig
+
+	// a difficulty of 1000 TH with a block every 13 seconds
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/price" {
+			fmt.Fprintf(writer, `{"ethereum":{"%v":2000}}`, request.URL.Query().Get("vs_currencies"))
+			return
+		}
+
+		var call struct {
+			Method string        `json:"method"`
+			Params []interface{} `json:"params"`
+		}
+		json.NewDecoder(request.Body).Decode(&call)
+		switch {
+		case call.Method != "eth_getBlockByNumber" || len(call.Params) != 2:
+			fmt.Fprint(writer, `{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"the method does not exist"}}`)
+		case call.Params[0] == "latest":
+			fmt.Fprint(writer, `{"jsonrpc":"2.0","id":1,"result":{"number":"0x3e8","difficulty":"0x38d7ea4c68000","timestamp":"0x514"}}`)
+		case call.Params[0] == "0x384":
+			fmt.Fprint(writer, `{"jsonrpc":"2.0","id":1,"result":{"number":"0x384","difficulty":"0x38d7ea4c68000","timestamp":"0x0"}}`)
+		default:
+			fmt.Fprint(writer, `{"jsonrpc":"2.0","id":1,"result":null}`)
+		}
+	}))
+	defer server.Close()
+
+	config.Cfg.ProfitCheckSeconds = 3600
+	config.Cfg.ProfitCurrency = "eur"
+	config.Cfg.PriceURL = server.URL + "/price?ids=ethereum&vs_currencies=%v"
+	config.Cfg.EthRPCURL = server.URL
+	config.Cfg.BlockRewardEth = 2
+	config.Cfg.PoolFeePercent = 1
+	config.Cfg.PowerCostPerKWh = 0.1
+	config.Cfg.PowerDrawWatts = 1000
+
+	// stand in for a miner run by the loader
+	profiler.RegisterCollector("profit_test", func() (map[string]float64, error) {
+		return map[string]float64{"miner_rig_mhs": 500}, nil
+	})
+	profiler.RecordSample()
+
+	estimate, checkErr := Check()
+	if checkErr != nil {
+		t.Fatalf("expected the estimate to succeed, got: %v", checkErr)
+	}
+
+	// 500 MH/s for a day is 0.0432 blocks at 1000 TH, or 0.0864 ETH less 1%
+	if estimate.Price != 2000 || estimate.Difficulty != 1e15 || estimate.BlockSeconds != 13 || estimate.HashrateMHs != 500 {
+		t.Errorf("expected the price, difficulty, block time and hashrate, got: %+v", estimate)
+	}
+	if !nearly(estimate.CoinsPerDay, 0.085536) || !nearly(estimate.RevenuePerDay, 171.072) || !nearly(estimate.PowerCostPerDay, 2.4) || !nearly(estimate.ProfitPerDay, 168.672) {
+		t.Errorf("expected the daily revenue, power cost and profit, got: %+v", estimate)
+	}
+
+	metrics, _ := Metrics()
+	if metrics[PRICE_METRIC] != 2000 || metrics[DIFFICULTY_METRIC] != 1000 || !nearly(metrics[PROFIT_METRIC], 168.672) {
+		t.Errorf("expected the profitability metrics, got: %+v", metrics)
+	}
+
+	summary, _ := Summary()
+	for _, expected := range []string{
+		"ETH price: 2000.00 EUR",
+		"Network difficulty: 1000.00 TH with a block every 13.0 seconds",
+		"Hashrate: 500.0 MH/s from 1 local miners",
+		"Power: 1000.0 W from PowerDrawWatts costing 2.40 EUR a day",
+		"Profit: 168.67 EUR a day",
+	} {
+		if !strings.Contains(summary, expected) {
+			t.Errorf("expected the summary to contain %q, got: %v", expected, summary)
+		}
+	}
+
+	config.Cfg.ProfitCurrency = "gbp"
+	server.Close()
+	if _, checkErr := Check(); checkErr == nil {
+		t.Errorf("expected the estimate to fail without the price service")
+	}
+	if summary, _ := Summary(); !strings.Contains(summary, "The last estimate failed") || !strings.Contains(summary, "ETH price: 2000.00 EUR") {
+		t.Errorf("expected the summary to show the failure along with the last estimate, got: %v", summary)
+	}
+}
+
+func TestCalculate(t *testing.T) {
+
+	defer func(previous *config.Config) { config.Cfg = previous }(config.Cfg)
+	testConfig := *config.Cfg
+	config.Cfg = &testConfig
+
+	config.Cfg.PowerCostPerKWh = 0.25
+
+	// without any difficulty, e.g. on a proof of stake chain, nothing is mined
+	estimate := Calculate(Estimate{Price: 2000, HashrateMHs: 100, PowerWatts: 200})
+	if estimate.CoinsPerDay != 0 || !nearly(estimate.PowerCostPerDay, 1.2) || !nearly(estimate.ProfitPerDay, -1.2) {
+		t.Errorf("expected only the cost of power without any difficulty, got: %+v", estimate)
+	}
+}
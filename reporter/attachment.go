@@ -0,0 +1,168 @@
+package reporter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/jordan-wright/email"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The default maximum number of bytes a single attachment may contain before
+// it is truncated. Only the newest (tail end) bytes of the file are kept.
+// Files which are already gzipped can't be truncated and are skipped instead.
+const MAX_ATTACHMENT_BYTES = 5 * 1024 * 1024
+
+// The file extension appended to attachments that have been compressed
+const GZIP_EXTENSION = ".gz"
+
+// The MIME type used for all compressed attachments
+const GZIP_CONTENT_TYPE = "application/gzip"
+
+// The magic number that every gzip stream starts with
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Attachment represents a single file on disk which should be included in an
+// outgoing report. Attachments are capped in size and automatically gzipped
+// so a single status email can carry everything needed to diagnose a remote
+// machine without running into mail server size limits.
+type Attachment struct {
+	Path     string // The path on disk to read the attachment contents from
+	Name     string // The file name the attachment will appear as in the email. Defaults to the base name of Path
+	MaxBytes int64  // The maximum number of bytes to include from the file. Defaults to MAX_ATTACHMENT_BYTES
+}
+
+// LogAttachments will return an Attachment for each of the count most recent
+// log files held on to by the given logger. The current log file is always
+// included first.
+func LogAttachments(lgr *logger.Logger, count int) []Attachment {
+
+	var attachments []Attachment
+
+	for _, logName := range lgr.RecentLogFiles(count) {
+		attachments = append(attachments, Attachment{Path: logName})
+	}
+
+	return attachments
+}
+
+// FileAttachments will return an Attachment with the default size cap for
+// each of the given file paths.
+func FileAttachments(paths ...string) []Attachment {
+
+	var attachments []Attachment
+
+	for _, path := range paths {
+		attachments = append(attachments, Attachment{Path: path})
+	}
+
+	return attachments
+}
+
+// prepare will read in the attachment from disk, truncate it down to its size
+// cap and gzip the result if it isn't already compressed. A file which is
+// already gzipped is refused when it's over the cap since cutting it down
+// would leave a corrupt archive. The final file name and contents to attach
+// to the email are returned.
+func (att Attachment) prepare() (string, []byte, error) {
+
+	name := att.Name
+	if name == "" {
+		name = filepath.Base(att.Path)
+	}
+
+	maxBytes := att.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = MAX_ATTACHMENT_BYTES
+	}
+
+	filePtr, openErr := os.Open(att.Path)
+	if openErr != nil {
+		return "", nil, openErr
+	}
+
+	defer filePtr.Close()
+
+	fileInfo, statErr := filePtr.Stat()
+	if statErr != nil {
+		return "", nil, statErr
+	}
+
+	magic := make([]byte, len(gzipMagic))
+	read, _ := io.ReadFull(filePtr, magic)
+	compressed := read == len(gzipMagic) && bytes.Equal(magic, gzipMagic)
+
+	if compressed && fileInfo.Size() > maxBytes {
+		return "", nil, fmt.Errorf("it's already compressed and %v, over the %v limit, so it can't be cut down without corrupting it", utils.FormatBytes(fileInfo.Size()), utils.FormatBytes(maxBytes))
+	}
+
+	if _, seekErr := filePtr.Seek(0, io.SeekStart); seekErr != nil {
+		return "", nil, seekErr
+	}
+
+	var contents bytes.Buffer
+
+	// only keep the newest bytes of the file if it's too large
+	if fileInfo.Size() > maxBytes {
+		if _, seekErr := filePtr.Seek(fileInfo.Size()-maxBytes, io.SeekStart); seekErr != nil {
+			return "", nil, seekErr
+		}
+		log().LogMessagef("Truncating attachment %v from %d bytes to the last %d bytes", att.Path, fileInfo.Size(), maxBytes)
+	}
+
+	if _, copyErr := io.Copy(&contents, io.LimitReader(filePtr, maxBytes)); copyErr != nil {
+		return "", nil, copyErr
+	}
+
+	if compressed {
+		return name, contents.Bytes(), nil
+	}
+
+	var gzipped bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipped)
+	gzipWriter.Name = name
+
+	if _, writeErr := gzipWriter.Write(contents.Bytes()); writeErr != nil {
+		return "", nil, writeErr
+	}
+
+	if closeErr := gzipWriter.Close(); closeErr != nil {
+		return "", nil, closeErr
+	}
+
+	log().LogMessagef("Successfully compressed attachment %v from %d bytes to %d bytes", name, contents.Len(), gzipped.Len())
+
+	return name + GZIP_EXTENSION, gzipped.Bytes(), nil
+}
+
+// attachAll will prepare and attach every one of the given attachments to the
+// email. Attachments which can't be read are skipped and noted in the returned
+// summary rather than failing the whole report.
+func attachAll(jwEmail *email.Email, attachments []Attachment) string {
+
+	var summary bytes.Buffer
+
+	for _, att := range attachments {
+		name, contents, prepErr := att.prepare()
+		if prepErr != nil {
+			log().LogMessagef("Skipping attachment %v: %v", att.Path, prepErr)
+			summary.WriteString(fmt.Sprintf("skipped attachment %v: %v\n", att.Path, prepErr))
+			continue
+		}
+
+		if _, attachErr := jwEmail.Attach(bytes.NewReader(contents), name, GZIP_CONTENT_TYPE); attachErr != nil {
+			log().LogMessagef("Skipping attachment %v: %v", att.Path, attachErr)
+			summary.WriteString(fmt.Sprintf("skipped attachment %v: %v\n", att.Path, attachErr))
+			continue
+		}
+
+		log().LogMessagef("Successfully attached file: %v as %v", att.Path, name)
+	}
+
+	return summary.String()
+}
@@ -0,0 +1,210 @@
+package reporter
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/transport"
+)
+
+// The subject of the notification which contains a batch of digested events
+const DIGEST_SUBJECT = "Digest of %d notifications"
+
+// digestEntry is one distinct notification waiting in a digest along with the
+// number of times it occurred.
+type digestEntry struct {
+	notification Notification
+	count        int
+	first        time.Time
+	last         time.Time
+}
+
+// channelDigest holds every notification waiting to be delivered to a single
+// channel in its next digest.
+type channelDigest struct {
+	ch      channel
+	entries []*digestEntry
+	index   map[string]*digestEntry
+}
+
+var digests = make(map[string]*channelDigest)
+var lastDelivered = make(map[string]time.Time)
+var digestsLock sync.Mutex
+
+// digestKey identifies repeats of the same notification on the same channel.
+func digestKey(ch channel, notification Notification) string {
+	return ch.name + "|" + notification.Severity.String() + "|" + notification.Subject
+}
+
+// digestInterval returns how often digests are delivered.
+func digestInterval() time.Duration {
+	return time.Duration(config.Cfg.DigestIntervalSeconds) * time.Second
+}
+
+// recentlyDelivered reports whether the same non-critical notification was
+// already delivered to the channel within the last digest interval. Repeats
+// are batched into the digest rather than sent again.
+func recentlyDelivered(ch channel, notification Notification) bool {
+
+	if notification.Severity == CRITICAL {
+		return false
+	}
+
+	digestsLock.Lock()
+	defer digestsLock.Unlock()
+
+	delivered, exists := lastDelivered[digestKey(ch, notification)]
+	return exists && time.Since(delivered) < digestInterval()
+}
+
+// markDelivered records when the notification was delivered to the channel.
+func markDelivered(ch channel, notification Notification) {
+	digestsLock.Lock()
+	defer digestsLock.Unlock()
+
+	lastDelivered[digestKey(ch, notification)] = time.Now()
+}
+
+// addToDigest will batch the notification into the next digest for the
+// channel. Repeats of the same notification are counted rather than stored
+// again.
+func addToDigest(ch channel, notification Notification) {
+
+	digestsLock.Lock()
+	defer digestsLock.Unlock()
+
+	pending, exists := digests[ch.name]
+	if !exists {
+		pending = &channelDigest{ch: ch, index: make(map[string]*digestEntry)}
+		digests[ch.name] = pending
+	}
+
+	now := time.Now()
+	key := digestKey(ch, notification)
+
+	if entry, seen := pending.index[key]; seen {
+		entry.count++
+		entry.last = now
+		entry.notification.Body = notification.Body
+		return
+	}
+
+	entry := &digestEntry{notification: notification, count: 1, first: now, last: now}
+	pending.entries = append(pending.entries, entry)
+	pending.index[key] = entry
+
+	log().LogMessagef("Added %v notification %v to the digest for channel %v", notification.Severity, notification.Subject, ch.name)
+}
+
+// FlushDigests will immediately deliver every pending digest to its channel.
+// Digests bypass the channel rate limit since there's at most one per channel
+// per interval. While offline they're queued instead.
+func FlushDigests() {
+
+	digestsLock.Lock()
+	pending := digests
+	digests = make(map[string]*channelDigest)
+
+	// forget deliveries old enough that a repeat should be sent again
+	for key, delivered := range lastDelivered {
+		if time.Since(delivered) >= digestInterval() {
+			delete(lastDelivered, key)
+		}
+	}
+	digestsLock.Unlock()
+
+	for name, channelDigest := range pending {
+		digestNotification := channelDigest.notification()
+		if !transport.Online() {
+			queueNotification(channelDigest.ch, digestNotification)
+			continue
+		}
+		if notifyErr := channelDigest.ch.notifier.Notify(digestNotification); notifyErr != nil {
+			log().LogErrorf("Failed to deliver digest via %v: %v", name, notifyErr)
+			queueNotification(channelDigest.ch, digestNotification)
+			continue
+		}
+		log().LogMessagef("Successfully delivered digest of %d entries via %v", len(channelDigest.entries), name)
+	}
+}
+
+// notification will combine every entry in the digest into one notification
+// with the highest severity of any entry.
+func (cd *channelDigest) notification() Notification {
+
+	var body bytes.Buffer
+	severity := INFO
+	total := 0
+
+	for _, entry := range cd.entries {
+		if entry.notification.Severity > severity {
+			severity = entry.notification.Severity
+		}
+		total += entry.count
+
+		body.WriteString(fmt.Sprintf("[%v] %v (x%d, first %v, last %v)\n",
+			entry.notification.Severity, entry.notification.Subject, entry.count,
+			entry.first.Format(time.RFC3339), entry.last.Format(time.RFC3339)))
+		body.Write(entry.notification.Body)
+		body.WriteString("\n\n")
+	}
+
+	return Notification{Id: newNotificationId(), Severity: severity, Subject: fmt.Sprintf(DIGEST_SUBJECT, total), Body: body.Bytes()}
+}
+
+// RunDigests will deliver pending digests every DigestIntervalSeconds. It
+// should only be called once all configuration options have been correctly
+// setup.
+func RunDigests() {
+	go func() {
+		for 1 == 1 {
+			clk().Sleep(digestInterval())
+			FlushDigests()
+		}
+	}()
+}
+
+// rateLimiter allows at most limit events within any sliding window of the
+// given duration. A limit of zero allows everything.
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+	events []time.Time
+	lock   sync.Mutex
+}
+
+// newRateLimiter will create a sliding window rate limiter.
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window}
+}
+
+// allow reports whether another event fits within the limit and records it if
+// so.
+func (rl *rateLimiter) allow() bool {
+
+	if rl == nil || rl.limit <= 0 {
+		return true
+	}
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	now := time.Now()
+	kept := rl.events[:0]
+	for _, event := range rl.events {
+		if now.Sub(event) < rl.window {
+			kept = append(kept, event)
+		}
+	}
+	rl.events = kept
+
+	if len(rl.events) >= rl.limit {
+		return false
+	}
+
+	rl.events = append(rl.events, now)
+	return true
+}
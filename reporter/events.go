@@ -0,0 +1,46 @@
+package reporter
+
+import (
+	"github.com/seantcanavan/anon-eth-net/events"
+)
+
+// The severity each kind of event is delivered to the notification channels at
+var eventSeverities = map[string]Severity{
+	events.UPDATE_APPLIED:           INFO,
+	events.CONFIG_CHANGED:           INFO,
+	events.PUBLIC_IP_CHANGED:        WARN,
+	events.CONNECTIVITY_CHANGED:     WARN,
+	events.CLOCK_SKEWED:             WARN,
+	events.PAYOUT_RECEIVED:          INFO,
+	events.PAYOUT_OVERDUE:           WARN,
+	events.NODE_UNHEALTHY:           WARN,
+	events.NODE_RESTARTED:           INFO,
+	events.CERTIFICATE_PIN_MISMATCH: CRITICAL,
+	events.UPDATE_REJECTED:          CRITICAL,
+	events.UPDATE_ROLLED_BACK:       CRITICAL,
+	events.TOKEN_EXPIRING:           WARN,
+	events.POSTURE_CHANGED:          WARN,
+	events.APPROVAL_REQUESTED:       WARN,
+	events.INTEGRITY_VIOLATED:       CRITICAL,
+	events.JOB_CRASHED:              WARN,
+	events.THRESHOLD_BREACHED:       CRITICAL,
+	events.AGENT_CRASHED:            CRITICAL,
+}
+
+// The kinds of events which are too frequent to be worth a notification
+var quietEvents = map[string]bool{
+	events.UPDATE_PROGRESS: true,
+}
+
+// SubscribeToEvents will deliver every event published to the event bus as a
+// notification, except for the quiet kinds such as UpdateProgress. The
+// severity of the notification depends on the kind of the event. Unknown
+// kinds of events are delivered as INFO.
+func SubscribeToEvents() {
+	events.Subscribe("reporter", func(record events.Record) {
+		if quietEvents[record.Kind] {
+			return
+		}
+		Notify(eventSeverities[record.Kind], record.Kind, []byte(record.Event.Summary()))
+	})
+}
@@ -0,0 +1,274 @@
+package reporter
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/jordan-wright/email"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The name of the optional asset which overrides the built in HTML template
+const STATUS_REPORT_TEMPLATE_ASSET = "status_report.html"
+
+// The dimensions of each sparkline chart in pixels
+const SPARKLINE_WIDTH = 240
+const SPARKLINE_HEIGHT = 40
+
+// The built in template used to render HTML status reports. It can be
+// overridden by placing a status_report.html template in the assets folder.
+const DEFAULT_STATUS_REPORT_TEMPLATE = `<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; color: #222;">
+<h2>{{.DeviceName}}</h2>
+<table cellpadding="4">
+<tr><td><b>Device ID</b></td><td>{{.DeviceId}}</td></tr>
+<tr><td><b>Version</b></td><td>{{.Version}}</td></tr>
+<tr><td><b>Build</b></td><td>{{.Build}}</td></tr>
+<tr><td><b>Uptime</b></td><td>{{.Uptime}}</td></tr>
+<tr><td><b>Generated</b></td><td>{{.Generated.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+</table>
+{{if .Charts}}<h3>History</h3>
+<table cellpadding="4">
+{{range .Charts}}<tr><td><b>{{.Title}}</b></td><td><img src="cid:{{.ContentId}}" width="{{.Width}}" height="{{.Height}}" alt="{{.Title}}"></td><td>min {{printf "%.2f" .Min}} / max {{printf "%.2f" .Max}} / last {{printf "%.2f" .Last}}</td></tr>
+{{end}}</table>{{end}}
+{{range .Sections}}<h3>{{.Title}}</h3>
+<pre style="background: #f4f4f4; padding: 8px;">{{.Body}}</pre>
+{{end}}
+</body>
+</html>
+`
+
+// StatusChart returns the series of values to graph in the status report,
+// oldest first.
+type StatusChart func() []float64
+
+var charts = make(map[string]StatusChart)
+var chartsLock sync.Mutex
+
+// RegisterStatusChart will add a sparkline of the given series to every HTML
+// status report that is generated from now on under the given title.
+func RegisterStatusChart(title string, chart StatusChart) {
+	chartsLock.Lock()
+	defer chartsLock.Unlock()
+
+	charts[title] = chart
+	log().LogMessagef("Successfully registered status report chart: %v", title)
+}
+
+// renderedChart is a single sparkline ready to be referenced by the template.
+type renderedChart struct {
+	Title     string
+	ContentId string
+	Width     int
+	Height    int
+	Min       float64
+	Max       float64
+	Last      float64
+	png       []byte
+}
+
+// htmlStatusReport is the data handed to the HTML template.
+type htmlStatusReport struct {
+	statusReport
+	Charts []renderedChart
+}
+
+// StatusReportHTML will render the current status of this machine as HTML
+// along with a PNG sparkline for every registered chart with at least two
+// values. The charts are referenced from the HTML by content id and must be
+// attached inline to the email.
+func StatusReportHTML() ([]byte, []renderedChart, error) {
+
+	reportTemplate, templateErr := statusTemplate()
+	if templateErr != nil {
+		return nil, nil, templateErr
+	}
+
+	report := htmlStatusReport{statusReport: gatherStatus()}
+
+	chartsLock.Lock()
+	titles := make([]string, 0, len(charts))
+	for title := range charts {
+		titles = append(titles, title)
+	}
+	sort.Strings(titles)
+
+	for index, title := range titles {
+		values := charts[title]()
+		if len(values) < 2 {
+			continue
+		}
+
+		pngBytes, pngErr := Sparkline(values, SPARKLINE_WIDTH, SPARKLINE_HEIGHT)
+		if pngErr != nil {
+			chartsLock.Unlock()
+			return nil, nil, pngErr
+		}
+
+		min, max := bounds(values)
+		report.Charts = append(report.Charts, renderedChart{
+			Title:     title,
+			ContentId: fmt.Sprintf("chart%d.png", index),
+			Width:     SPARKLINE_WIDTH,
+			Height:    SPARKLINE_HEIGHT,
+			Min:       min,
+			Max:       max,
+			Last:      values[len(values)-1],
+			png:       pngBytes,
+		})
+	}
+	chartsLock.Unlock()
+
+	var html bytes.Buffer
+	if executeErr := reportTemplate.Execute(&html, report); executeErr != nil {
+		return nil, nil, executeErr
+	}
+
+	return html.Bytes(), report.Charts, nil
+}
+
+// attachStatusHTML will render the HTML status report into the email and
+// attach every chart inline so it can be displayed alongside the report.
+func attachStatusHTML(jwEmail *email.Email) error {
+
+	html, rendered, htmlErr := StatusReportHTML()
+	if htmlErr != nil {
+		return htmlErr
+	}
+
+	for _, chart := range rendered {
+		inline, attachErr := jwEmail.Attach(bytes.NewReader(chart.png), chart.ContentId, "image/png")
+		if attachErr != nil {
+			return attachErr
+		}
+		inline.Header.Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%v\"", chart.ContentId))
+		inline.Header.Set("Content-ID", fmt.Sprintf("<%v>", chart.ContentId))
+	}
+
+	jwEmail.HTML = html
+
+	log().LogMessagef("Successfully rendered HTML status report with %d charts", len(rendered))
+
+	return nil
+}
+
+// statusTemplate will load the status report template from the assets folder
+// if one has been provided otherwise the built in template is used.
+func statusTemplate() (*template.Template, error) {
+
+	templateText := DEFAULT_STATUS_REPORT_TEMPLATE
+
+	templatePath, assetErr := utils.AssetPath(STATUS_REPORT_TEMPLATE_ASSET)
+	if assetErr == nil {
+		templateBytes, readErr := ioutil.ReadFile(templatePath)
+		if readErr != nil {
+			return nil, readErr
+		}
+		templateText = string(templateBytes)
+		log().LogMessagef("Successfully loaded status report template asset: %v", templatePath)
+	}
+
+	return template.New(STATUS_REPORT_TEMPLATE_ASSET).Parse(templateText)
+}
+
+// Sparkline will draw the given values as a simple line graph scaled to fit a
+// PNG image of the given dimensions.
+func Sparkline(values []float64, width int, height int) ([]byte, error) {
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	background := color.RGBA{0xff, 0xff, 0xff, 0xff}
+	foreground := color.RGBA{0x1f, 0x6f, 0xb4, 0xff}
+
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, background)
+		}
+	}
+
+	min, max := bounds(values)
+	span := max - min
+	if span == 0 {
+		span = 1
+	}
+
+	point := func(index int) (int, int) {
+		x := index * (width - 1) / (len(values) - 1)
+		y := (height - 1) - int((values[index]-min)/span*float64(height-1))
+		return x, y
+	}
+
+	for index := 1; index < len(values); index++ {
+		x0, y0 := point(index - 1)
+		x1, y1 := point(index)
+		drawLine(img, x0, y0, x1, y1, foreground)
+	}
+
+	var pngBuffer bytes.Buffer
+	if encodeErr := png.Encode(&pngBuffer, img); encodeErr != nil {
+		return nil, encodeErr
+	}
+
+	return pngBuffer.Bytes(), nil
+}
+
+// drawLine will draw a straight line between the two points using
+// Bresenham's line algorithm.
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, lineColor color.Color) {
+
+	dx := abs(x1 - x0)
+	dy := -abs(y1 - y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+
+	err := dx + dy
+	for {
+		img.Set(x0, y0, lineColor)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * err
+		if e2 >= dy {
+			err += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			err += dx
+			y0 += sy
+		}
+	}
+}
+
+// bounds returns the smallest and largest of the given values.
+func bounds(values []float64) (float64, float64) {
+	min, max := values[0], values[0]
+	for _, value := range values[1:] {
+		if value < min {
+			min = value
+		}
+		if value > max {
+			max = value
+		}
+	}
+	return min, max
+}
+
+// abs returns the absolute value of the given integer.
+func abs(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
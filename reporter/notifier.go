@@ -0,0 +1,271 @@
+package reporter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/buildinfo"
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/transport"
+)
+
+// Severity describes how important a notification is. Each notification
+// channel only receives notifications at or above its configured severity.
+type Severity int
+
+const (
+	INFO Severity = iota
+	WARN
+	CRITICAL
+)
+
+// The notifier types which can be used in the Notifiers config value
+const EMAIL_NOTIFIER = "email"
+const SLACK_NOTIFIER = "slack"
+const TELEGRAM_NOTIFIER = "telegram"
+const DISCORD_NOTIFIER = "discord"
+const WEBHOOK_NOTIFIER = "webhook"
+const TWILIO_NOTIFIER = "twilio"
+
+// String returns the canonical lower case name of the severity.
+func (sev Severity) String() string {
+	switch sev {
+	case INFO:
+		return "info"
+	case WARN:
+		return "warn"
+	case CRITICAL:
+		return "critical"
+	default:
+		return fmt.Sprintf("severity(%d)", int(sev))
+	}
+}
+
+// ParseSeverity converts the name of a severity back into a Severity. The empty
+// string is treated as INFO so channels receive everything by default.
+func ParseSeverity(name string) (Severity, error) {
+	switch strings.ToLower(name) {
+	case "", "info":
+		return INFO, nil
+	case "warn", "warning":
+		return WARN, nil
+	case "critical":
+		return CRITICAL, nil
+	default:
+		return INFO, fmt.Errorf("Unknown severity: %v", name)
+	}
+}
+
+// ErrorSeverity returns the severity a failure caused by the given error
+// should be reported at. A config which isn't valid, a remote version which
+// isn't a number and a server refusing a request outright all need someone to
+// fix them so they're CRITICAL. Everything else, including servers which are
+// only temporarily failing, is a WARN since it may well sort itself out.
+func ErrorSeverity(err error) Severity {
+
+	var invalidErr config.ErrConfigInvalid
+	var versionErr buildinfo.ErrVersionParse
+	var downloadErr transport.ErrDownloadFailed
+
+	switch {
+	case errors.As(err, &invalidErr), errors.As(err, &versionErr):
+		return CRITICAL
+	case errors.As(err, &downloadErr) && !downloadErr.Temporary():
+		return CRITICAL
+	}
+	return WARN
+}
+
+// Notification is a single message to deliver to one or more channels.
+type Notification struct {
+	Id       string
+	Severity Severity
+	Subject  string
+	Body     []byte
+}
+
+// Notifier delivers notifications to a single channel such as email or a chat
+// service. Many operators don't watch email so the reporter can deliver to any
+// number of channels at once.
+type Notifier interface {
+	Name() string                           // The name of the channel used in logs
+	Notify(notification Notification) error // Deliver the notification to the channel
+}
+
+// channel pairs a Notifier with the name it's routed by, the minimum severity
+// it should receive and the rate limit it's delivered at.
+type channel struct {
+	name        string
+	notifier    Notifier
+	minSeverity Severity
+	limiter     *rateLimiter
+}
+
+var channels []channel
+var channelsLock sync.Mutex
+
+// RegisterNotifier will deliver every notification at or above minSeverity to
+// the given notifier from now on. The notifier can be referred to by its Name()
+// in the NotificationRoutes and EscalationChannels config values.
+func RegisterNotifier(notifier Notifier, minSeverity Severity) {
+	registerChannel(notifier.Name(), notifier, minSeverity, 0)
+}
+
+// registerChannel will register the notifier under the given channel name. At
+// most maxPerHour notifications are delivered to the channel each hour with
+// the rest being batched into its digest. Zero means unlimited. Critical
+// notifications are always delivered and don't count towards the limit.
+func registerChannel(name string, notifier Notifier, minSeverity Severity, maxPerHour int) {
+	channelsLock.Lock()
+	defer channelsLock.Unlock()
+
+	channels = append(channels, channel{name: name, notifier: notifier, minSeverity: minSeverity, limiter: newRateLimiter(maxPerHour, time.Hour)})
+	log().LogMessagef("Successfully registered notifier: %v as channel: %v for severity: %v and above", notifier.Name(), name, minSeverity)
+}
+
+// NotifiersFromConfig will create and register a notifier for each entry in
+// the Notifiers config value. If no notifiers are configured then email is
+// registered for every severity to preserve the original behavior.
+func NotifiersFromConfig() error {
+
+	if len(config.Cfg.Notifiers) == 0 {
+		RegisterNotifier(EmailNotifier{}, INFO)
+		return verifyRoutes()
+	}
+
+	for _, notifierConfig := range config.Cfg.Notifiers {
+		notifier, notifierErr := newNotifier(notifierConfig)
+		if notifierErr != nil {
+			return notifierErr
+		}
+
+		minSeverity, severityErr := ParseSeverity(notifierConfig.MinSeverity)
+		if severityErr != nil {
+			return severityErr
+		}
+
+		// text messages are reserved for critical events unless asked otherwise
+		if notifierConfig.Type == TWILIO_NOTIFIER && notifierConfig.MinSeverity == "" {
+			minSeverity = CRITICAL
+		}
+
+		name := notifierConfig.Name
+		if name == "" {
+			name = notifierConfig.Type
+		}
+
+		registerChannel(name, notifier, minSeverity, notifierConfig.MaxPerHour)
+	}
+
+	return verifyRoutes()
+}
+
+// newNotifier will create the appropriate Notifier for the type of the given
+// notifier config.
+func newNotifier(notifierConfig config.NotifierConfig) (Notifier, error) {
+	switch notifierConfig.Type {
+	case EMAIL_NOTIFIER:
+		return EmailNotifier{}, nil
+	case SLACK_NOTIFIER:
+		return SlackNotifier{WebhookURL: notifierConfig.URL}, nil
+	case TELEGRAM_NOTIFIER:
+		return TelegramNotifier{BotToken: notifierConfig.Token, ChatId: notifierConfig.ChatId}, nil
+	case DISCORD_NOTIFIER:
+		return DiscordNotifier{WebhookURL: notifierConfig.URL}, nil
+	case WEBHOOK_NOTIFIER:
+		return WebhookNotifier{URL: notifierConfig.URL}, nil
+	case TWILIO_NOTIFIER:
+		return TwilioNotifier{AccountSid: notifierConfig.AccountSid, AuthToken: notifierConfig.Token, From: notifierConfig.From, To: notifierConfig.To}, nil
+	default:
+		return nil, fmt.Errorf("Unknown notifier type: %v", notifierConfig.Type)
+	}
+}
+
+// Notify will deliver a notification with the given severity, subject and body
+// to the channels routed to that severity. When no route is configured for the
+// severity every channel which accepts that severity is used. Every channel is
+// attempted even if an earlier one fails. The first error received is
+// returned. Critical notifications are escalated if they're not acknowledged
+// in time. Notifications are logged and dropped while the reporter is turned
+// off under Subsystems in the config.
+func Notify(severity Severity, subject string, body []byte) error {
+
+	if !config.Enabled(config.SUBSYSTEM_REPORTER) {
+		log().LogMessagef("The reporter is turned off in the config. Dropping the %v notification: %v", severity, subject)
+		return nil
+	}
+
+	notification := Notification{Id: newNotificationId(), Severity: severity, Subject: subject, Body: body}
+
+	if severity == CRITICAL && config.Cfg.EscalationTimeoutSeconds > 0 {
+		notification.Body = append(notification.Body, []byte(fmt.Sprintf(ACKNOWLEDGE_INSTRUCTIONS, notification.Id))...)
+		trackEscalation(notification)
+	}
+
+	targets, digestOnly := routeFor(severity)
+
+	return deliver(notification, targets, digestOnly)
+}
+
+// deliver will send the notification to each of the given channels. Any
+// notification which fails to be delivered, or can't be because this machine
+// is offline, is queued on disk to be retried later. When
+// digestOnly is set, or the notification was already delivered to a channel
+// recently, or the channel has hit its rate limit, the notification is batched
+// into the channel's next digest instead. Critical notifications are exempt
+// from the rate limit so a storm of warnings can't hold one back for an hour.
+func deliver(notification Notification, targets []channel, digestOnly bool) error {
+
+	var firstErr error
+
+	for _, ch := range targets {
+		if digestOnly || recentlyDelivered(ch, notification) || (notification.Severity != CRITICAL && !ch.limiter.allow()) {
+			addToDigest(ch, notification)
+			continue
+		}
+
+		if !transport.Online() {
+			queueNotification(ch, notification)
+			continue
+		}
+
+		if notifyErr := ch.notifier.Notify(notification); notifyErr != nil {
+			log().LogErrorf("Failed to deliver %v notification %v via %v: %v", notification.Severity, notification.Subject, ch.name, notifyErr)
+			queueNotification(ch, notification)
+			if firstErr == nil {
+				firstErr = notifyErr
+			}
+			continue
+		}
+
+		markDelivered(ch, notification)
+		log().LogMessagef("Successfully delivered %v notification %v via %v", notification.Severity, notification.Subject, ch.name)
+	}
+
+	return firstErr
+}
+
+// EmailNotifier delivers notifications as plain emails to the configured check
+// in address.
+type EmailNotifier struct{}
+
+// Name returns the name of the email channel.
+func (en EmailNotifier) Name() string {
+	return EMAIL_NOTIFIER
+}
+
+// Notify will email the notification to the configured check in address.
+// Failures aren't queued here since the notification itself is queued by the
+// caller.
+func (en EmailNotifier) Notify(notification Notification) error {
+	return sendEmail(newEmail(notificationSubject(notification), notification.Body))
+}
+
+// notificationSubject will prefix the subject of the notification with its
+// severity so the most important messages stand out.
+func notificationSubject(notification Notification) string {
+	return "[" + strings.ToUpper(notification.Severity.String()) + "] " + notification.Subject
+}
@@ -0,0 +1,220 @@
+package reporter
+
+import (
+	"bytes"
+	_ "crypto/sha256" // registers the hash openpgp signs and encrypts with
+	"fmt"
+	"os"
+
+	"github.com/jordan-wright/email"
+	"github.com/seantcanavan/anon-eth-net/config"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// The file extension appended to every attachment which has been encrypted
+const PGP_EXTENSION = ".pgp"
+
+// The file extension of the detached signatures attached for signed attachments
+const PGP_SIGNATURE_EXTENSION = ".asc"
+
+// The content type used for encrypted attachments and detached signatures
+const PGP_CONTENT_TYPE = "application/pgp-encrypted"
+const PGP_SIGNATURE_CONTENT_TYPE = "application/pgp-signature"
+
+// The name of the attachment the HTML body is moved into when encrypting
+const PGP_HTML_ATTACHMENT = "report.html"
+
+var pgpRecipients openpgp.EntityList
+var pgpSigner *openpgp.Entity
+
+// PGPKeysFromConfig will load the recipient public keys and the agent's own
+// signing key defined by the PGPRecipientKeyFile and PGPSigningKeyFile config
+// values. Once loaded every email sent out is encrypted to the recipients
+// and / or signed by the agent. Neither is required.
+func PGPKeysFromConfig() error {
+
+	pgpRecipients = nil
+	pgpSigner = nil
+
+	if config.Cfg.PGPRecipientKeyFile != "" {
+		recipients, readErr := readArmoredKeyFile(config.Cfg.PGPRecipientKeyFile)
+		if readErr != nil {
+			return readErr
+		}
+		pgpRecipients = recipients
+		log().LogMessagef("Successfully loaded %d PGP recipient keys from: %v", len(recipients), config.Cfg.PGPRecipientKeyFile)
+	}
+
+	if config.Cfg.PGPSigningKeyFile != "" {
+		signers, readErr := readArmoredKeyFile(config.Cfg.PGPSigningKeyFile)
+		if readErr != nil {
+			return readErr
+		}
+
+		signer := signers[0]
+		if signer.PrivateKey == nil {
+			return fmt.Errorf("PGP signing key file %v does not contain a private key", config.Cfg.PGPSigningKeyFile)
+		}
+
+		if signer.PrivateKey.Encrypted {
+			if decryptErr := signer.PrivateKey.Decrypt([]byte(config.Cfg.PGPSigningKeyPassphrase)); decryptErr != nil {
+				return fmt.Errorf("Unable to unlock PGP signing key: %v", decryptErr)
+			}
+		}
+
+		pgpSigner = signer
+		log().LogMessagef("Successfully loaded PGP signing key from: %v", config.Cfg.PGPSigningKeyFile)
+	}
+
+	return nil
+}
+
+// readArmoredKeyFile will read every ASCII armored key out of the given file.
+func readArmoredKeyFile(path string) (openpgp.EntityList, error) {
+
+	keyFile, openErr := os.Open(path)
+	if openErr != nil {
+		return nil, openErr
+	}
+
+	defer keyFile.Close()
+
+	keys, readErr := openpgp.ReadArmoredKeyRing(keyFile)
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No PGP keys found in: %v", path)
+	}
+
+	return keys, nil
+}
+
+// protectEmail will encrypt and / or sign the body and attachments of the
+// email in place according to the loaded PGP keys. When encrypting, the body
+// is replaced with an armored PGP message, the HTML alternative is moved into
+// an encrypted attachment and every attachment is encrypted individually.
+// When only signing, the body is clearsigned and a detached signature is added
+// for every attachment. Does nothing when no keys have been loaded.
+func protectEmail(jwEmail *email.Email) error {
+
+	if len(pgpRecipients) == 0 && pgpSigner == nil {
+		return nil
+	}
+
+	if len(pgpRecipients) == 0 {
+		return signEmail(jwEmail)
+	}
+
+	body, encryptErr := pgpEncrypt(jwEmail.Text)
+	if encryptErr != nil {
+		return encryptErr
+	}
+
+	attachments := jwEmail.Attachments
+	jwEmail.Attachments = nil
+
+	if len(jwEmail.HTML) > 0 {
+		if attachErr := attachEncrypted(jwEmail, PGP_HTML_ATTACHMENT, jwEmail.HTML); attachErr != nil {
+			return attachErr
+		}
+		jwEmail.HTML = nil
+	}
+
+	for _, att := range attachments {
+		if attachErr := attachEncrypted(jwEmail, att.Filename, att.Content); attachErr != nil {
+			return attachErr
+		}
+	}
+
+	jwEmail.Text = body
+
+	log().LogMessagef("Successfully encrypted email %v with %d attachments", jwEmail.Subject, len(jwEmail.Attachments))
+
+	return nil
+}
+
+// signEmail will clearsign the body of the email and attach a detached
+// signature for each of its attachments.
+func signEmail(jwEmail *email.Email) error {
+
+	var signed bytes.Buffer
+
+	signWriter, signErr := clearsign.Encode(&signed, pgpSigner.PrivateKey, nil)
+	if signErr != nil {
+		return signErr
+	}
+
+	if _, writeErr := signWriter.Write(jwEmail.Text); writeErr != nil {
+		return writeErr
+	}
+
+	if closeErr := signWriter.Close(); closeErr != nil {
+		return closeErr
+	}
+
+	for _, att := range jwEmail.Attachments {
+		var signature bytes.Buffer
+		if detachErr := openpgp.ArmoredDetachSign(&signature, pgpSigner, bytes.NewReader(att.Content), nil); detachErr != nil {
+			return detachErr
+		}
+
+		if _, attachErr := jwEmail.Attach(&signature, att.Filename+PGP_SIGNATURE_EXTENSION, PGP_SIGNATURE_CONTENT_TYPE); attachErr != nil {
+			return attachErr
+		}
+	}
+
+	jwEmail.Text = signed.Bytes()
+
+	log().LogMessagef("Successfully signed email %v", jwEmail.Subject)
+
+	return nil
+}
+
+// attachEncrypted will encrypt the given contents and attach them to the email
+// under the given name with PGP_EXTENSION appended.
+func attachEncrypted(jwEmail *email.Email, name string, contents []byte) error {
+
+	encrypted, encryptErr := pgpEncrypt(contents)
+	if encryptErr != nil {
+		return encryptErr
+	}
+
+	_, attachErr := jwEmail.Attach(bytes.NewReader(encrypted), name+PGP_EXTENSION, PGP_CONTENT_TYPE)
+	return attachErr
+}
+
+// pgpEncrypt returns the given plain text as an ASCII armored PGP message
+// encrypted to every recipient and signed by the agent if a signing key has
+// been loaded.
+func pgpEncrypt(plainText []byte) ([]byte, error) {
+
+	var encrypted bytes.Buffer
+
+	armorWriter, armorErr := armor.Encode(&encrypted, "PGP MESSAGE", nil)
+	if armorErr != nil {
+		return nil, armorErr
+	}
+
+	encryptWriter, encryptErr := openpgp.Encrypt(armorWriter, pgpRecipients, pgpSigner, nil, nil)
+	if encryptErr != nil {
+		return nil, encryptErr
+	}
+
+	if _, writeErr := encryptWriter.Write(plainText); writeErr != nil {
+		return nil, writeErr
+	}
+
+	if closeErr := encryptWriter.Close(); closeErr != nil {
+		return nil, closeErr
+	}
+
+	if closeErr := armorWriter.Close(); closeErr != nil {
+		return nil, closeErr
+	}
+
+	return encrypted.Bytes(), nil
+}
@@ -0,0 +1,217 @@
+package reporter
+
+import (
+	"fmt"
+	"net/smtp"
+	"sync"
+	"time"
+
+	"github.com/jordan-wright/email"
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/state"
+	"github.com/seantcanavan/anon-eth-net/transport"
+)
+
+// The state bucket undelivered notifications are saved in
+const QUEUE_BUCKET = "notification_queue"
+
+// The shortest amount of time to wait between attempts to flush the queue
+const MIN_QUEUE_RETRY_SECONDS = 30
+
+// The longest amount of time to wait between attempts to flush the queue
+const MAX_QUEUE_RETRY_SECONDS = 3600
+
+// The maximum age of a queued notification before it's discarded
+const MAX_QUEUE_AGE_HOURS = 168
+
+// queuedItem is a single outbound notification or email which couldn't be
+// delivered and is waiting in the state store to be retried. Notifications are retried
+// through the channel they failed on. Emails are retried as raw messages so
+// any attachments are preserved even if the original files are gone.
+type queuedItem struct {
+	Channel      string       `json:"channel"`
+	Notification Notification `json:"notification"`
+	From         string       `json:"from"`
+	To           []string     `json:"to"`
+	Raw          []byte       `json:"raw"`
+	Queued       time.Time    `json:"queued"`
+	Attempts     int          `json:"attempts"`
+}
+
+var queueLock sync.Mutex
+
+// queueNotification will save a notification which failed to be delivered to
+// the given channel so it can be retried later.
+func queueNotification(ch channel, notification Notification) {
+	enqueue(queuedItem{Channel: ch.name, Notification: notification})
+}
+
+// queueEmail will save an email which failed to be sent so it can be retried
+// later.
+func queueEmail(jwEmail *email.Email) {
+
+	raw, rawErr := jwEmail.Bytes()
+	if rawErr != nil {
+		log().LogErrorf("Unable to queue email %v: %v", jwEmail.Subject, rawErr)
+		return
+	}
+
+	enqueue(queuedItem{From: jwEmail.From, To: jwEmail.To, Raw: raw, Notification: Notification{Subject: jwEmail.Subject}})
+}
+
+// enqueue will save the item in the QUEUE_BUCKET. Items are keyed by the time
+// they were queued so they're retried in order.
+func enqueue(item queuedItem) {
+
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	if item.Queued.IsZero() {
+		item.Queued = time.Now()
+	}
+
+	updateErr := state.Update(func(tx *state.Tx) error {
+		queue := tx.Bucket(QUEUE_BUCKET)
+		queued := item.Queued.UnixNano()
+		// clocks too coarse to tell two items apart would otherwise overwrite one
+		for queue.Has(queueKey(queued)) {
+			queued++
+		}
+		return queue.Put(queueKey(queued), item)
+	})
+
+	if updateErr != nil {
+		log().LogErrorf("Unable to queue notification %v: %v", item.Notification.Subject, updateErr)
+		return
+	}
+
+	log().LogMessagef("Queued undelivered notification %v for retry", item.Notification.Subject)
+}
+
+// queueKey returns the key of an item queued at the given time in nanoseconds
+// which sorts in the order items were queued.
+func queueKey(queued int64) string {
+	return fmt.Sprintf("%020d", queued)
+}
+
+// QueueLength returns the number of notifications waiting in the queue.
+func QueueLength() int {
+	keys, _ := state.Keys(QUEUE_BUCKET)
+	return len(keys)
+}
+
+// FlushQueue will attempt to deliver every queued notification in the order
+// they were queued. Once a channel fails, the rest of its notifications are
+// left for the next flush so their order is preserved. Notifications older
+// than MAX_QUEUE_AGE_HOURS are discarded. Nothing is attempted while offline.
+// The number of notifications still waiting is returned.
+func FlushQueue() int {
+
+	if !transport.Online() {
+		return QueueLength()
+	}
+
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	keys, keysErr := state.Keys(QUEUE_BUCKET)
+	if keysErr != nil {
+		log().LogErrorf("Unable to read the notification queue: %v", keysErr)
+		return 0
+	}
+
+	failedChannels := make(map[string]bool)
+	remaining := 0
+
+	for _, key := range keys {
+
+		var item queuedItem
+		if _, getErr := state.Get(QUEUE_BUCKET, key, &item); getErr != nil {
+			log().LogErrorf("Discarding unreadable queued notification %v: %v", key, getErr)
+			state.Delete(QUEUE_BUCKET, key)
+			continue
+		}
+
+		if time.Since(item.Queued) > MAX_QUEUE_AGE_HOURS*time.Hour {
+			log().LogErrorf("Discarding queued notification %v which is older than %d hours", item.Notification.Subject, MAX_QUEUE_AGE_HOURS)
+			state.Delete(QUEUE_BUCKET, key)
+			continue
+		}
+
+		route := item.Channel
+		if route == "" {
+			route = EMAIL_NOTIFIER
+		}
+
+		if failedChannels[route] {
+			remaining++
+			continue
+		}
+
+		if sendErr := item.send(); sendErr != nil {
+			item.Attempts++
+			log().LogMessagef("Retry %d of queued notification %v via %v failed: %v", item.Attempts, item.Notification.Subject, route, sendErr)
+			state.Put(QUEUE_BUCKET, key, item)
+			failedChannels[route] = true
+			remaining++
+			continue
+		}
+
+		state.Delete(QUEUE_BUCKET, key)
+		log().LogMessagef("Successfully delivered queued notification %v via %v after %d retries", item.Notification.Subject, route, item.Attempts+1)
+	}
+
+	return remaining
+}
+
+// send will make a single attempt to deliver the queued item.
+func (item queuedItem) send() error {
+
+	if item.Channel == "" {
+		emailAuth := smtp.PlainAuth("", config.Cfg.CheckInGmailAddress, config.Cfg.CheckInGmailPassword, EMAIL_SERVER)
+		return transport.SendMail(EMAIL_SERVER+":"+EMAIL_PORT, emailAuth, item.From, item.To, item.Raw)
+	}
+
+	channelsLock.Lock()
+	targets := channelsNamed([]string{item.Channel})
+	channelsLock.Unlock()
+
+	if len(targets) == 0 {
+		return fmt.Errorf("Unknown channel: %v", item.Channel)
+	}
+
+	return targets[0].notifier.Notify(item.Notification)
+}
+
+// RunQueue will continuously retry queued notifications. The time between
+// attempts doubles each time notifications remain in the queue, up to
+// MAX_QUEUE_RETRY_SECONDS, and resets once the queue is empty. The queue is
+// also flushed as soon as connectivity returns after an outage. This way
+// notifications generated while the uplink is down are delivered in order
+// shortly after connectivity returns without hammering unreachable endpoints.
+func RunQueue() {
+	go func() {
+		backoff := time.Duration(MIN_QUEUE_RETRY_SECONDS) * time.Second
+
+		for 1 == 1 {
+			select {
+			case <-time.After(backoff):
+			case <-transport.Reconnected():
+				backoff = time.Duration(MIN_QUEUE_RETRY_SECONDS) * time.Second
+			}
+
+			remaining := FlushQueue()
+			if remaining == 0 {
+				backoff = time.Duration(MIN_QUEUE_RETRY_SECONDS) * time.Second
+				continue
+			}
+
+			backoff *= 2
+			if backoff > MAX_QUEUE_RETRY_SECONDS*time.Second {
+				backoff = MAX_QUEUE_RETRY_SECONDS * time.Second
+			}
+
+			log().LogMessagef("%d notifications remain queued. Retrying in %v", remaining, backoff)
+		}
+	}()
+}
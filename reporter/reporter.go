@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"net/smtp"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/jordan-wright/email"
+	"github.com/seantcanavan/anon-eth-net/clock"
 	"github.com/seantcanavan/anon-eth-net/config"
 	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/transport"
 )
 
 const EMAIL_SERVER = "smtp.gmail.com"
@@ -16,20 +19,101 @@ const EMAIL_PORT = "587"
 const MAX_EMAIL_TIMEOUT_ATTEMPTS = 5
 const SUCCESSIVE_EMAIL_ATTEMPTS_DELAY = 5
 
+// The Backend the reporter logs to, logger.Lgr when nil
+var backend logger.Backend
+var reportClock clock.Clock = clock.Real
+var backendLock sync.Mutex
+
+// SetLogger will make the reporter log to the given Backend instead of
+// logger.Lgr. Passing nil goes back to logger.Lgr.
+func SetLogger(lgr logger.Backend) {
+	backendLock.Lock()
+	defer backendLock.Unlock()
+	backend = lgr
+}
+
+// log returns the Backend the reporter logs to.
+func log() logger.Backend {
+	backendLock.Lock()
+	defer backendLock.Unlock()
+	if backend == nil {
+		return logger.Lgr
+	}
+	return backend
+}
+
+// SetClock will make the status reports and digests wait for their schedule
+// with the given clock instead of clock.Real, e.g. a clock.Fake in tests.
+// Passing nil goes back to clock.Real.
+func SetClock(clk clock.Clock) {
+	backendLock.Lock()
+	defer backendLock.Unlock()
+	if clk == nil {
+		clk = clock.Real
+	}
+	reportClock = clk
+}
+
+// clk returns the clock the reporter schedules with.
+func clk() clock.Clock {
+	backendLock.Lock()
+	defer backendLock.Unlock()
+	return reportClock
+}
+
 // SendPlainEmail will send the content of the byte array as the body of an
 // email along with the provided subject. The default sender and receiver are
 // defined by NewReporter() which in turn can be defined via a
-// config.json file. A sample is provided in the config package folder.
+// config.json file. A sample is provided in the config package folder. Emails
+// which can't be sent are queued on disk and retried later.
 func SendPlainEmail(subject string, contents []byte) error {
 	return SendAttachment(subject, contents, nil)
 }
 
-//SendAttachment will send the content of the byte array as the body of an email
+// SendAttachment will send the content of the byte array as the body of an email
 // along with the provided subject. The device ID is automatically added to the
 // email subject line in order to help differentiate emails from multiple
 // devices to the same address. The sender and receiver are defined by
 // NewReporter() which in turn can be defined via config.json file.
 func SendAttachment(subject string, contents []byte, attachmentPtr *os.File) error {
+	jwEmail := newEmail(subject, contents)
+
+	if attachmentPtr != nil {
+		jwEmail.AttachFile(attachmentPtr.Name())
+		log().LogMessagef("Successfully attached file: %v", attachmentPtr.Name())
+	}
+
+	return sendOrQueueEmail(jwEmail)
+}
+
+// SendReport will send the content of the byte array as the body of an email
+// along with every one of the given attachments. Each attachment is capped in
+// size and gzipped before being attached so a single report can contain the
+// recent logs, profiles and archives needed to diagnose a remote machine. Any
+// attachment which can't be read is listed at the bottom of the email body.
+func SendReport(subject string, contents []byte, attachments []Attachment) error {
+	return SendReportTo([]string{config.Cfg.CheckInGmailAddress}, subject, contents, attachments)
+}
+
+// SendReportTo behaves exactly like SendReport but delivers the report to the
+// given recipients instead of the configured check in address.
+func SendReportTo(recipients []string, subject string, contents []byte, attachments []Attachment) error {
+	jwEmail := newEmail(subject, contents)
+	jwEmail.To = recipients
+
+	skipped := attachAll(jwEmail, attachments)
+	if skipped != "" {
+		jwEmail.Text = append(jwEmail.Text, []byte("\n\n"+skipped)...)
+	}
+
+	log().LogMessagef("Successfully attached %d files to report: %v", len(jwEmail.Attachments), subject)
+
+	return sendOrQueueEmail(jwEmail)
+}
+
+// newEmail will create a new jwemail instance addressed to and from the
+// configured check in address with the given subject and body.
+func newEmail(subject string, contents []byte) *email.Email {
 	jwEmail := &email.Email{
 		To:      []string{config.Cfg.CheckInGmailAddress},
 		From:    config.Cfg.CheckInGmailAddress,
@@ -37,34 +121,76 @@ func SendAttachment(subject string, contents []byte, attachmentPtr *os.File) err
 		Text:    contents,
 	}
 
-	logger.Lgr.LogMessage("Successfully created new jwemail instance to: %v", config.Cfg.CheckInGmailAddress)
+	log().LogMessagef("Successfully created new jwemail instance to: %v", config.Cfg.CheckInGmailAddress)
 
-	if attachmentPtr != nil {
-		jwEmail.AttachFile(attachmentPtr.Name())
-		logger.Lgr.LogMessage("Successfully attached file: %v", attachmentPtr.Name())
+	return jwEmail
+}
+
+// sendEmail will encrypt and / or sign the given email if PGP keys have been
+// loaded and then send it out via the configured SMTP server. The email is
+// never sent if it can't be protected.
+func sendEmail(jwEmail *email.Email) error {
+	if protectErr := protectEmail(jwEmail); protectErr != nil {
+		log().LogErrorf("Refusing to send email %v which could not be protected with PGP: %v", jwEmail.Subject, protectErr)
+		return protectErr
 	}
 
+	return transmitEmail(jwEmail)
+}
+
+// transmitEmail will send out the given email via the configured SMTP server.
+// It will retry up to MAX_EMAIL_TIMEOUT_ATTEMPTS times before giving up and
+// returning the last error received.
+func transmitEmail(jwEmail *email.Email) error {
 	emailAuth := smtp.PlainAuth("", config.Cfg.CheckInGmailAddress, config.Cfg.CheckInGmailPassword, EMAIL_SERVER)
 
-	logger.Lgr.LogMessage("Successfully generated SMTP email auth: %+v", emailAuth)
+	log().LogMessagef("Successfully generated SMTP email auth: %+v", emailAuth)
+
+	raw, rawErr := jwEmail.Bytes()
+	if rawErr != nil {
+		return rawErr
+	}
 
 	count := 0
 	var emailErr error
 
 	for count < MAX_EMAIL_TIMEOUT_ATTEMPTS {
-		emailErr = jwEmail.Send(EMAIL_SERVER+":"+EMAIL_PORT, emailAuth)
+		emailErr = transport.SendMail(EMAIL_SERVER+":"+EMAIL_PORT, emailAuth, jwEmail.From, jwEmail.To, raw)
 		if emailErr == nil {
-			logger.Lgr.LogMessage("Successfully sent out email to: %v", config.Cfg.CheckInGmailAddress)
+			log().LogMessagef("Successfully sent out email to: %v", config.Cfg.CheckInGmailAddress)
 			break
 		}
 		count++
-		logger.Lgr.LogMessage("Unsuccessfully sent out email to: %v. Sleeping for %d", config.Cfg.CheckInGmailAddress, SUCCESSIVE_EMAIL_ATTEMPTS_DELAY)
+		log().LogMessagef("Unsuccessfully sent out email to: %v. Sleeping for %d", config.Cfg.CheckInGmailAddress, SUCCESSIVE_EMAIL_ATTEMPTS_DELAY)
 		time.Sleep(time.Second * SUCCESSIVE_EMAIL_ATTEMPTS_DELAY)
 	}
 
 	return emailErr
 }
 
+// sendOrQueueEmail will send out the given email. If it can't be sent then it's
+// queued on disk so it can be retried once connectivity returns. The original
+// error is still returned to the caller. While offline the email is queued
+// straight away without trying. Emails are protected with PGP before being
+// queued so they're never written to disk in the clear.
+func sendOrQueueEmail(jwEmail *email.Email) error {
+	if protectErr := protectEmail(jwEmail); protectErr != nil {
+		log().LogErrorf("Refusing to send email %v which could not be protected with PGP: %v", jwEmail.Subject, protectErr)
+		return protectErr
+	}
+
+	if !transport.Online() {
+		queueEmail(jwEmail)
+		return nil
+	}
+
+	emailErr := transmitEmail(jwEmail)
+	if emailErr != nil {
+		queueEmail(jwEmail)
+	}
+	return emailErr
+}
+
 // generateSubject will append the device ID to the beginning of the email
 // subject for easier sorting / searching through the list of emails to help
 // keep track of emails by device.
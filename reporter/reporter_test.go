@@ -1,13 +1,28 @@
 package reporter
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/jordan-wright/email"
+	"github.com/seantcanavan/anon-eth-net/buildinfo"
 	"github.com/seantcanavan/anon-eth-net/config"
 	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/state"
+	"github.com/seantcanavan/anon-eth-net/transport"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
 )
 
 func TestMain(m *testing.M) {
@@ -50,3 +65,461 @@ func TestEmailAttachment(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestAttachmentPrepare(t *testing.T) {
+	testName := "attachment_prepare_test.txt"
+	ioutil.WriteFile(testName, []byte("0123456789abcdefghij"), 0644)
+	defer os.Remove(testName)
+
+	name, contents, err := Attachment{Path: testName, MaxBytes: 10}.prepare()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if name != testName+GZIP_EXTENSION {
+		t.Errorf("expected: %v, got: %v", testName+GZIP_EXTENSION, name)
+	}
+
+	gzipReader, gzipErr := gzip.NewReader(bytes.NewReader(contents))
+	if gzipErr != nil {
+		t.Fatal(gzipErr)
+	}
+
+	uncompressed, readErr := ioutil.ReadAll(gzipReader)
+	if readErr != nil {
+		t.Error(readErr)
+	}
+
+	if string(uncompressed) != "abcdefghij" {
+		t.Errorf("expected the last 10 bytes to be kept, got: %v", string(uncompressed))
+	}
+
+	// an archive over the cap can't be cut down so it's left out altogether
+	archiveName := "attachment_prepare_test.log.gz"
+	archiveFile, createErr := os.Create(archiveName)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	defer os.Remove(archiveName)
+	archiveWriter := gzip.NewWriter(archiveFile)
+	archiveWriter.Write([]byte(strings.Repeat("a log line which compresses well\n", 100)))
+	archiveWriter.Close()
+	archiveFile.Close()
+
+	if _, _, oversizedErr := (Attachment{Path: archiveName, MaxBytes: 10}).prepare(); oversizedErr == nil {
+		t.Errorf("expected an archive over the cap to be refused")
+	}
+
+	attachedName, archive, archiveErr := Attachment{Path: archiveName}.prepare()
+	if archiveErr != nil || attachedName != archiveName {
+		t.Fatalf("expected an archive under the cap to be attached as is, got: %v %v", attachedName, archiveErr)
+	}
+	if _, gzipErr := gzip.NewReader(bytes.NewReader(archive)); gzipErr != nil {
+		t.Errorf("expected the archive to be attached whole, got: %v", gzipErr)
+	}
+}
+
+func TestUntilNextStatusReport(t *testing.T) {
+	config.Cfg.StatusReportTime = "08:00"
+
+	before := time.Date(2017, 1, 1, 7, 30, 0, 0, time.Local)
+	wait, err := untilNextStatusReport(before)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if wait != 30*time.Minute {
+		t.Errorf("expected: %v, got: %v", 30*time.Minute, wait)
+	}
+
+	after := time.Date(2017, 1, 1, 8, 0, 0, 0, time.Local)
+	wait, err = untilNextStatusReport(after)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if wait != 24*time.Hour {
+		t.Errorf("expected: %v, got: %v", 24*time.Hour, wait)
+	}
+}
+
+func TestStatusReport(t *testing.T) {
+	RegisterStatusSection("Test Section", func() (string, error) {
+		return "test section body\n", nil
+	})
+
+	report := string(StatusReport())
+	if !strings.Contains(report, "test section body") {
+		t.Errorf("status report is missing the registered section: %v", report)
+	}
+}
+
+type testNotifier struct {
+	received []Notification
+	lock     sync.Mutex
+}
+
+func (tn *testNotifier) Name() string {
+	return "test"
+}
+
+func (tn *testNotifier) Notify(notification Notification) error {
+	tn.lock.Lock()
+	defer tn.lock.Unlock()
+	tn.received = append(tn.received, notification)
+	return nil
+}
+
+func (tn *testNotifier) Received() []Notification {
+	tn.lock.Lock()
+	defer tn.lock.Unlock()
+	return append([]Notification{}, tn.received...)
+}
+
+func TestNotifySeverityFilter(t *testing.T) {
+	critical := &testNotifier{}
+	RegisterNotifier(critical, CRITICAL)
+
+	Notify(WARN, "TestNotifySeverityFilter", []byte("warn"))
+	Notify(CRITICAL, "TestNotifySeverityFilter", []byte("critical"))
+
+	received := critical.Received()
+	if len(received) != 1 || received[0].Severity != CRITICAL {
+		t.Errorf("expected only the critical notification, got: %+v", received)
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+
+	var lines []string
+	var linesLock sync.Mutex
+	SetLogger(logger.FromLeveled(testLeveled(func(line string) {
+		linesLock.Lock()
+		lines = append(lines, line)
+		linesLock.Unlock()
+	})))
+	defer SetLogger(nil)
+
+	RegisterNotifier(&testNotifier{}, INFO)
+	Notify(INFO, "TestSetLogger", []byte("info"))
+
+	linesLock.Lock()
+	defer linesLock.Unlock()
+	if !strings.Contains(strings.Join(lines, "\n"), "Successfully delivered info notification TestSetLogger via test") {
+		t.Errorf("expected the reporter to log to the given logger, got: %q", lines)
+	}
+}
+
+// testLeveled is a logger.Leveled which hands every line to a function.
+type testLeveled func(line string)
+
+func (tl testLeveled) Infof(template string, args ...interface{}) {
+	tl(fmt.Sprintf(template, args...))
+}
+
+func (tl testLeveled) Errorf(template string, args ...interface{}) {
+	tl(fmt.Sprintf(template, args...))
+}
+
+func TestErrorSeverity(t *testing.T) {
+
+	for _, tc := range []struct {
+		err      error
+		expected Severity
+	}{
+		{fmt.Errorf("something broke"), WARN},
+		{config.ErrConfigInvalid{Fields: []string{"ProxyURL"}, Err: fmt.Errorf("bad proxy")}, CRITICAL},
+		{fmt.Errorf("Could not check for updates: %w", buildinfo.ErrVersionParse{Source: "version.no"}), CRITICAL},
+		{transport.ErrDownloadFailed{URL: "https://example.com", Status: http.StatusNotFound}, CRITICAL},
+		{transport.ErrDownloadFailed{URL: "https://example.com", Status: http.StatusBadGateway}, WARN},
+	} {
+		if severity := ErrorSeverity(tc.err); severity != tc.expected {
+			t.Errorf("expected %v to be %v, got: %v", tc.err, tc.expected, severity)
+		}
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var payload WebhookPayload
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		json.NewDecoder(request.Body).Decode(&payload)
+	}))
+	defer server.Close()
+
+	err := WebhookNotifier{URL: config.Endpoints{server.URL}}.Notify(Notification{Severity: WARN, Subject: "TestWebhookNotifier", Body: []byte("body")})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if payload.Severity != "warn" || payload.Subject != "TestWebhookNotifier" || payload.DeviceId != config.Cfg.DeviceId {
+		t.Errorf("webhook payload did not arrive correctly: %+v", payload)
+	}
+}
+
+// refusingTransport fails every request as though the server couldn't be
+// reached.
+type refusingTransport struct{}
+
+func (rt refusingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("connection refused")
+}
+
+func TestTelegramNotifierError(t *testing.T) {
+	SetHTTPClient(&http.Client{Transport: refusingTransport{}})
+	defer SetHTTPClient(nil)
+
+	err := TelegramNotifier{BotToken: "123456:secret-bot-token", ChatId: "42"}.Notify(Notification{Severity: WARN, Subject: "TestTelegramNotifierError"})
+	if err == nil || strings.Contains(err.Error(), "secret-bot-token") {
+		t.Errorf("expected an error without the bot token, got: %v", err)
+	}
+}
+
+func TestTwilioNotifier(t *testing.T) {
+	var recipients []string
+	var lock sync.Mutex
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		user, password, _ := request.BasicAuth()
+		if user != "sid" || password != "token" || request.URL.Path != "/Accounts/sid/Messages.json" {
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		lock.Lock()
+		recipients = append(recipients, request.FormValue("To"))
+		lock.Unlock()
+		writer.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	notifier := TwilioNotifier{AccountSid: "sid", AuthToken: "token", From: "+15550000000", To: []string{"+15551111111", "+15552222222"}, APIURI: server.URL}
+	if err := notifier.Notify(Notification{Severity: CRITICAL, Subject: "TestTwilioNotifier", Body: []byte("body")}); err != nil {
+		t.Error(err)
+	}
+
+	if len(recipients) != 2 || recipients[0] != "+15551111111" || recipients[1] != "+15552222222" {
+		t.Errorf("SMS was not sent to every number: %v", recipients)
+	}
+
+	notifier.AuthToken = "wrong"
+	if err := notifier.Notify(Notification{Severity: CRITICAL, Subject: "TestTwilioNotifier"}); err == nil {
+		t.Errorf("expected an error when Twilio rejects the credentials")
+	}
+}
+
+func TestEscalation(t *testing.T) {
+	escalation := &testNotifier{}
+	RegisterNotifier(escalation, CRITICAL)
+
+	config.Cfg.EscalationTimeoutSeconds = 1
+	defer func() { config.Cfg.EscalationTimeoutSeconds = 0 }()
+
+	Notify(CRITICAL, "TestEscalation acknowledged", []byte("acknowledged"))
+	Notify(CRITICAL, "TestEscalation ignored", []byte("ignored"))
+
+	pending := PendingAcknowledgements()
+	if len(pending) != 2 {
+		t.Fatalf("expected 2 pending acknowledgements, got: %d", len(pending))
+	}
+
+	if err := Acknowledge(pending[0].Id); err != nil {
+		t.Error(err)
+	}
+
+	time.Sleep(2 * time.Second)
+
+	escalated := 0
+	for _, notification := range escalation.Received() {
+		if strings.HasPrefix(notification.Subject, ESCALATED_PREFIX) {
+			escalated++
+		}
+	}
+
+	if escalated != 1 {
+		t.Errorf("expected exactly 1 escalated notification, got: %d", escalated)
+	}
+}
+
+func TestDigestAndRateLimit(t *testing.T) {
+	limited := &testNotifier{}
+	registerChannel("TestDigestAndRateLimit", limited, INFO, 2)
+
+	limitedChannel, _ := routeFor(INFO)
+	for _, ch := range limitedChannel {
+		if ch.name != "TestDigestAndRateLimit" {
+			continue
+		}
+		for count := 0; count < 5; count++ {
+			deliver(Notification{Severity: WARN, Subject: fmt.Sprintf("storm %d", count%3)}, []channel{ch}, false)
+		}
+	}
+
+	if received := limited.Received(); len(received) != 2 {
+		t.Errorf("expected the rate limit to allow 2 notifications, got: %d", len(received))
+	}
+
+	for _, ch := range limitedChannel {
+		if ch.name == "TestDigestAndRateLimit" {
+			deliver(Notification{Severity: CRITICAL, Subject: "disk failing"}, []channel{ch}, false)
+		}
+	}
+
+	if received := limited.Received(); len(received) != 3 || received[2].Subject != "disk failing" {
+		t.Errorf("expected a critical notification to be delivered over the rate limit, got: %+v", received)
+	}
+
+	FlushDigests()
+
+	received := limited.Received()
+	if len(received) != 4 || received[3].Subject != fmt.Sprintf(DIGEST_SUBJECT, 3) {
+		t.Errorf("expected a digest of the 3 limited notifications, got: %+v", received)
+	}
+}
+
+type failingNotifier struct {
+	fail bool
+	testNotifier
+}
+
+func (fn *failingNotifier) Notify(notification Notification) error {
+	if fn.fail {
+		return fmt.Errorf("unreachable")
+	}
+	return fn.testNotifier.Notify(notification)
+}
+
+func TestQueueRetry(t *testing.T) {
+	stateDir, dirErr := ioutil.TempDir("", "reporter_test")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(stateDir)
+	if openErr := state.Open(filepath.Join(stateDir, "agent_state.json")); openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer state.Open(config.Cfg.StateFile)
+
+	offline := &failingNotifier{fail: true}
+	registerChannel("TestQueueRetry", offline, INFO, 0)
+
+	channelsLock.Lock()
+	targets := channelsNamed([]string{"TestQueueRetry"})
+	channelsLock.Unlock()
+
+	deliver(Notification{Severity: WARN, Subject: "queued 1"}, targets, false)
+	deliver(Notification{Severity: WARN, Subject: "queued 2"}, targets, false)
+
+	if remaining := FlushQueue(); remaining != 2 {
+		t.Errorf("expected 2 notifications to remain queued, got: %d", remaining)
+	}
+
+	offline.fail = false
+
+	if remaining := FlushQueue(); remaining != 0 {
+		t.Errorf("expected the queue to be empty, got: %d", remaining)
+	}
+
+	received := offline.Received()
+	if len(received) != 2 || received[0].Subject != "queued 1" || received[1].Subject != "queued 2" {
+		t.Errorf("expected the queued notifications to be delivered in order, got: %+v", received)
+	}
+}
+
+func TestStatusReportHTML(t *testing.T) {
+	RegisterStatusChart("Test Chart", func() []float64 {
+		return []float64{1, 3, 2, 5, 4}
+	})
+
+	html, rendered, err := StatusReportHTML()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rendered) != 1 || !bytes.HasPrefix(rendered[0].png, []byte("\x89PNG")) {
+		t.Fatalf("expected one rendered PNG chart, got: %d", len(rendered))
+	}
+
+	if !strings.Contains(string(html), "cid:"+rendered[0].ContentId) {
+		t.Errorf("HTML status report does not reference the chart: %v", string(html))
+	}
+}
+
+func writeArmoredKey(t *testing.T, blockType string, serialize func(*bytes.Buffer) error) string {
+
+	var key bytes.Buffer
+	armorWriter, _ := armor.Encode(&key, blockType, nil)
+	var raw bytes.Buffer
+	if serializeErr := serialize(&raw); serializeErr != nil {
+		t.Fatalf("Could not serialize key: %v", serializeErr)
+	}
+	armorWriter.Write(raw.Bytes())
+	armorWriter.Close()
+
+	keyFile, _ := ioutil.TempFile("", "pgp_key")
+	keyFile.Write(key.Bytes())
+	keyFile.Close()
+	return keyFile.Name()
+}
+
+func TestProtectEmail(t *testing.T) {
+
+	recipient, _ := openpgp.NewEntity("recipient", "", "recipient@example.com", nil)
+	agent, _ := openpgp.NewEntity("agent", "", "agent@example.com", nil)
+
+	// keys generated by gpg always advertise their preferred hashes
+	for _, identity := range recipient.Identities {
+		identity.SelfSignature.PreferredHash = []uint8{8} // SHA256
+		identity.SelfSignature.SignUserId(identity.UserId.Id, recipient.PrimaryKey, recipient.PrivateKey, nil)
+	}
+
+	publicKeyFile := writeArmoredKey(t, openpgp.PublicKeyType, func(w *bytes.Buffer) error { return recipient.Serialize(w) })
+	privateKeyFile := writeArmoredKey(t, openpgp.PrivateKeyType, func(w *bytes.Buffer) error { return agent.SerializePrivate(w, nil) })
+	defer os.Remove(publicKeyFile)
+	defer os.Remove(privateKeyFile)
+
+	defer func() {
+		config.Cfg.PGPRecipientKeyFile = ""
+		config.Cfg.PGPSigningKeyFile = ""
+		PGPKeysFromConfig()
+	}()
+
+	config.Cfg.PGPRecipientKeyFile = publicKeyFile
+	config.Cfg.PGPSigningKeyFile = privateKeyFile
+
+	if keysErr := PGPKeysFromConfig(); keysErr != nil {
+		t.Fatalf("PGPKeysFromConfig failed: %v", keysErr)
+	}
+
+	jwEmail := &email.Email{Subject: "secret", Text: []byte("host details"), HTML: []byte("<p>host details</p>")}
+	jwEmail.Attach(strings.NewReader("log contents"), "main.log.gz", GZIP_CONTENT_TYPE)
+
+	if protectErr := protectEmail(jwEmail); protectErr != nil {
+		t.Fatalf("protectEmail failed: %v", protectErr)
+	}
+
+	if len(jwEmail.HTML) != 0 || len(jwEmail.Attachments) != 2 || jwEmail.Attachments[1].Filename != "main.log.gz"+PGP_EXTENSION {
+		t.Fatalf("protectEmail did not move the HTML and attachments into encrypted attachments: %+v", jwEmail.Attachments)
+	}
+
+	keyring := openpgp.EntityList{recipient, agent}
+	for _, encrypted := range [][]byte{jwEmail.Text, jwEmail.Attachments[1].Content} {
+		block, armorErr := armor.Decode(bytes.NewReader(encrypted))
+		if armorErr != nil {
+			t.Fatalf("Encrypted contents are not armored: %v", armorErr)
+		}
+
+		message, readErr := openpgp.ReadMessage(block.Body, keyring, nil, nil)
+		if readErr != nil {
+			t.Fatalf("Could not decrypt contents: %v", readErr)
+		}
+
+		plainText, _ := ioutil.ReadAll(message.UnverifiedBody)
+		if message.SignatureError != nil || message.SignedBy == nil {
+			t.Errorf("Encrypted contents were not signed by the agent: %v", message.SignatureError)
+		}
+
+		if string(plainText) != "host details" && string(plainText) != "log contents" {
+			t.Errorf("Decrypted contents did not match: %v", string(plainText))
+		}
+	}
+}
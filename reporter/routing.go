@@ -0,0 +1,204 @@
+package reporter
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The text appended to critical notifications explaining how to stop escalation
+const ACKNOWLEDGE_INSTRUCTIONS = "\n\nAcknowledge this notification via REST to prevent escalation: POST /acknowledge/{timestamp}/%v"
+
+// The prefix added to the subject of notifications which have been escalated
+const ESCALATED_PREFIX = "ESCALATED: "
+
+// pendingAcknowledgement is a critical notification which will be escalated
+// when its timer fires unless it's acknowledged first.
+type pendingAcknowledgement struct {
+	notification Notification
+	sent         time.Time
+	timer        *time.Timer
+}
+
+var pendingAcks = make(map[string]*pendingAcknowledgement)
+var pendingAcksLock sync.Mutex
+
+// routeFor will return the channels a notification of the given severity
+// should be delivered to. If the NotificationRoutes config value has a route
+// for the severity then exactly the channels it names are used, and the
+// returned flag reports whether the route only delivers via digest. Otherwise
+// every channel whose minimum severity is at or below the given severity is
+// used.
+func routeFor(severity Severity) ([]channel, bool) {
+
+	channelsLock.Lock()
+	defer channelsLock.Unlock()
+
+	for _, route := range config.Cfg.NotificationRoutes {
+		routeSeverity, _ := ParseSeverity(route.Severity)
+		if routeSeverity == severity {
+			return channelsNamed(route.Channels), route.Digest
+		}
+	}
+
+	var targets []channel
+	for _, ch := range channels {
+		if severity >= ch.minSeverity {
+			targets = append(targets, ch)
+		}
+	}
+
+	return targets, false
+}
+
+// channelsNamed will return every registered channel with one of the given
+// names. channelsLock must be held by the caller.
+func channelsNamed(names []string) []channel {
+
+	var targets []channel
+
+	for _, name := range names {
+		for _, ch := range channels {
+			if ch.name == name {
+				targets = append(targets, ch)
+			}
+		}
+	}
+
+	return targets
+}
+
+// verifyRoutes will make sure that every severity and channel name referenced
+// by the NotificationRoutes and EscalationChannels config values exists.
+func verifyRoutes() error {
+
+	channelsLock.Lock()
+	defer channelsLock.Unlock()
+
+	known := make(map[string]bool)
+	for _, ch := range channels {
+		known[ch.name] = true
+	}
+
+	for _, route := range config.Cfg.NotificationRoutes {
+		if _, severityErr := ParseSeverity(route.Severity); severityErr != nil {
+			return severityErr
+		}
+		for _, name := range route.Channels {
+			if !known[name] {
+				return fmt.Errorf("Notification route for %v refers to unknown channel: %v", route.Severity, name)
+			}
+		}
+	}
+
+	for _, name := range config.Cfg.EscalationChannels {
+		if !known[name] {
+			return fmt.Errorf("Escalation refers to unknown channel: %v", name)
+		}
+	}
+
+	return nil
+}
+
+// trackEscalation will start the escalation timer for the given critical
+// notification.
+func trackEscalation(notification Notification) {
+
+	timeout := time.Duration(config.Cfg.EscalationTimeoutSeconds) * time.Second
+
+	pendingAcksLock.Lock()
+	defer pendingAcksLock.Unlock()
+
+	pendingAcks[notification.Id] = &pendingAcknowledgement{
+		notification: notification,
+		sent:         time.Now(),
+		timer:        time.AfterFunc(timeout, func() { escalate(notification.Id) }),
+	}
+
+	log().LogMessagef("Notification %v will be escalated in %v unless acknowledged", notification.Id, timeout)
+}
+
+// escalate will deliver the notification with the given id to the escalation
+// channels. If no escalation channels are configured every channel is used.
+func escalate(id string) {
+
+	pendingAcksLock.Lock()
+	pending, exists := pendingAcks[id]
+	delete(pendingAcks, id)
+	pendingAcksLock.Unlock()
+
+	if !exists {
+		return
+	}
+
+	escalated := pending.notification
+	escalated.Subject = ESCALATED_PREFIX + escalated.Subject
+
+	channelsLock.Lock()
+	targets := channelsNamed(config.Cfg.EscalationChannels)
+	if len(config.Cfg.EscalationChannels) == 0 {
+		targets = append(targets, channels...)
+	}
+	channelsLock.Unlock()
+
+	log().LogErrorf("Notification %v was not acknowledged within %d seconds. Escalating.", id, config.Cfg.EscalationTimeoutSeconds)
+
+	deliver(escalated, targets, false)
+}
+
+// Acknowledge will stop the escalation of the critical notification with the
+// given id. An error is returned if there's no pending notification with that
+// id.
+func Acknowledge(id string) error {
+
+	pendingAcksLock.Lock()
+	defer pendingAcksLock.Unlock()
+
+	pending, exists := pendingAcks[id]
+	if !exists {
+		return fmt.Errorf("No pending notification with id: %v", id)
+	}
+
+	pending.timer.Stop()
+	delete(pendingAcks, id)
+
+	log().LogMessagef("Successfully acknowledged notification %v after %v", id, time.Since(pending.sent).Truncate(time.Second))
+
+	return nil
+}
+
+// PendingAcknowledgements returns every critical notification which hasn't
+// been acknowledged or escalated yet, oldest first.
+func PendingAcknowledgements() []Notification {
+
+	pendingAcksLock.Lock()
+	defer pendingAcksLock.Unlock()
+
+	var pending []*pendingAcknowledgement
+	for _, value := range pendingAcks {
+		pending = append(pending, value)
+	}
+
+	sort.Slice(pending, func(i, j int) bool { return pending[i].sent.Before(pending[j].sent) })
+
+	notifications := make([]Notification, len(pending))
+	for index, value := range pending {
+		notifications[index] = value.notification
+	}
+
+	return notifications
+}
+
+// newNotificationId will generate a new unique id for a notification. It's a
+// ULID so notifications sort in the order they were sent.
+func newNotificationId() string {
+	id, err := utils.NewULID()
+	if err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return id
+}
@@ -0,0 +1,88 @@
+package reporter
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The subject of the test message sent through every channel
+const SELF_TEST_SUBJECT = "Reporter Self Test"
+
+// The name the SMTP check is reported under when email isn't a channel
+const SMTP_SELF_TEST = "smtp"
+
+// SelfTestResult describes whether a test message was successfully delivered
+// through a single channel.
+type SelfTestResult struct {
+	Channel string `json:"channel"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ReporterSelfTest will send a test message through every registered channel
+// regardless of its minimum severity, rate limit or routes and return whether
+// each one succeeded. Failures aren't queued or retried. Reports are always
+// sent via SMTP so it's tested too even when email isn't a channel. This lets
+// misconfigured credentials be found at deploy time rather than during the
+// first real incident.
+func ReporterSelfTest() []SelfTestResult {
+
+	channelsLock.Lock()
+	targets := make([]channel, len(channels))
+	copy(targets, channels)
+	channelsLock.Unlock()
+
+	body := []byte(fmt.Sprintf("This is a test message sent at %v to verify that notifications can be delivered. No action is required.", utils.TimeStamp(time.Now())))
+
+	var results []SelfTestResult
+	emailTested := false
+
+	for _, ch := range targets {
+		if _, isEmail := ch.notifier.(EmailNotifier); isEmail {
+			emailTested = true
+		}
+
+		notification := Notification{Id: newNotificationId(), Severity: INFO, Subject: SELF_TEST_SUBJECT, Body: body}
+		results = append(results, selfTestResult(ch.name, ch.notifier.Notify(notification)))
+	}
+
+	if !emailTested {
+		results = append(results, selfTestResult(SMTP_SELF_TEST, sendEmail(newEmail(SELF_TEST_SUBJECT, body))))
+	}
+
+	return results
+}
+
+// selfTestResult will log and record the result of testing a single channel.
+func selfTestResult(name string, testErr error) SelfTestResult {
+
+	if testErr != nil {
+		log().LogErrorf("Reporter self test failed for channel %v: %v", name, testErr)
+		return SelfTestResult{Channel: name, Success: false, Error: testErr.Error()}
+	}
+
+	log().LogMessagef("Successfully delivered reporter self test via channel: %v", name)
+	return SelfTestResult{Channel: name, Success: true}
+}
+
+// SelfTestSummary returns a human readable summary of the given self test
+// results along with whether every channel succeeded.
+func SelfTestSummary(results []SelfTestResult) (string, bool) {
+
+	var summary bytes.Buffer
+	allPassed := true
+
+	for _, result := range results {
+		if result.Success {
+			summary.WriteString(fmt.Sprintf("%v: ok\n", result.Channel))
+		} else {
+			allPassed = false
+			summary.WriteString(fmt.Sprintf("%v: FAILED: %v\n", result.Channel, result.Error))
+		}
+	}
+
+	return summary.String(), allPassed
+}
@@ -0,0 +1,92 @@
+package reporter
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The base URI of the Twilio REST API
+const TWILIO_API_URI = "https://api.twilio.com/2010-04-01"
+
+// The maximum number of characters sent in a single SMS notification. Twilio
+// splits anything longer than a single segment into several billed messages.
+const SMS_MAX_CONTENT = 320
+
+// TwilioNotifier delivers notifications as SMS messages to one or more phone
+// numbers via Twilio. SMS is expensive and intrusive so it defaults to only
+// receiving critical notifications.
+type TwilioNotifier struct {
+	AccountSid string   // The Twilio account SID which also acts as the API username
+	AuthToken  string   // The Twilio auth token for the account
+	From       string   // The Twilio phone number to send from
+	To         []string // The phone numbers to send to
+	APIURI     string   // The base URI of the Twilio API. Defaults to TWILIO_API_URI.
+}
+
+// Name returns the name of the Twilio channel.
+func (tn TwilioNotifier) Name() string {
+	return TWILIO_NOTIFIER
+}
+
+// Notify will text the notification to every configured phone number. Every
+// number is attempted even if an earlier one fails. The first error received
+// is returned.
+func (tn TwilioNotifier) Notify(notification Notification) error {
+
+	apiURI := tn.APIURI
+	if apiURI == "" {
+		apiURI = TWILIO_API_URI
+	}
+
+	uri := fmt.Sprintf("%v/Accounts/%v/Messages.json", apiURI, tn.AccountSid)
+
+	content := chatText(notification)
+	if len(content) > SMS_MAX_CONTENT {
+		content = content[:SMS_MAX_CONTENT]
+	}
+
+	var firstErr error
+
+	for _, to := range tn.To {
+		if sendErr := tn.send(uri, to, content); sendErr != nil && firstErr == nil {
+			firstErr = sendErr
+		}
+	}
+
+	return firstErr
+}
+
+// send will ask Twilio to text the content to a single phone number.
+func (tn TwilioNotifier) send(uri string, to string, content string) error {
+
+	form := url.Values{}
+	form.Set("To", to)
+	form.Set("From", tn.From)
+	form.Set("Body", content)
+
+	request, requestErr := http.NewRequest(http.MethodPost, uri, strings.NewReader(form.Encode()))
+	if requestErr != nil {
+		return requestErr
+	}
+
+	request.SetBasicAuth(tn.AccountSid, tn.AuthToken)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	response, postErr := httpClient().Do(request)
+	if postErr != nil {
+		return postErr
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode < http.StatusOK || response.StatusCode >= http.StatusMultipleChoices {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("Twilio returned status %d for %v: %v", response.StatusCode, to, string(body))
+	}
+
+	return nil
+}
@@ -0,0 +1,206 @@
+package reporter
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/buildinfo"
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/timesync"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The subject of the email that is sent out on the status report schedule
+const STATUS_REPORT_SUBJECT = "Status Report"
+
+// The layout used to parse the StatusReportTime config value
+const STATUS_REPORT_TIME_LAYOUT = "15:04"
+
+// The number of recent errors to include in each status report
+const STATUS_REPORT_ERROR_COUNT = 20
+
+// The time this process started up. Used to calculate uptime for reports.
+var startTime = time.Now()
+
+// StatusSection generates the body of one section of the status report. Other
+// packages register sections with RegisterStatusSection so the reporter can
+// describe their state without importing them directly.
+type StatusSection func() (string, error)
+
+var sections = make(map[string]StatusSection)
+var sectionsLock sync.Mutex
+
+// RegisterStatusSection will add the given section to every status report
+// that is generated from now on under the given title. Registering a title a
+// second time replaces the previous section.
+func RegisterStatusSection(title string, section StatusSection) {
+	sectionsLock.Lock()
+	defer sectionsLock.Unlock()
+
+	sections[title] = section
+	log().LogMessagef("Successfully registered status report section: %v", title)
+}
+
+// statusReport holds every piece of a status report so it can be rendered as
+// either plain text or HTML.
+type statusReport struct {
+	DeviceName string
+	DeviceId   string
+	Version    uint64
+	Build      string
+	Uptime     time.Duration
+	Generated  time.Time
+	Sections   []statusSection
+}
+
+// statusSection is a single titled section of a status report.
+type statusSection struct {
+	Title string
+	Body  string
+}
+
+// gatherStatus will collect the current status of this machine. The runtime
+// metrics and most recent errors are always included followed by every
+// registered section in alphabetical order.
+func gatherStatus() statusReport {
+
+	report := statusReport{
+		DeviceName: config.Cfg.DeviceName,
+		DeviceId:   config.Cfg.DeviceId,
+		Version:    config.Cfg.LocalVersion,
+		Build:      buildinfo.Version().String(),
+		Uptime:     time.Since(startTime).Truncate(time.Second),
+		Generated:  clk().Now(),
+	}
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	report.Sections = append(report.Sections, statusSection{"Metrics", fmt.Sprintf("goroutines: %d\nheap alloc: %d bytes\nsys: %d bytes\ngc cycles: %d\n",
+		runtime.NumGoroutine(), memStats.HeapAlloc, memStats.Sys, memStats.NumGC)})
+
+	recentErrors := logger.Lgr.RecentErrors(STATUS_REPORT_ERROR_COUNT)
+	if len(recentErrors) == 0 {
+		report.Sections = append(report.Sections, statusSection{"Recent Errors", "none\n"})
+	} else {
+		report.Sections = append(report.Sections, statusSection{"Recent Errors", strings.Join(recentErrors, "\n") + "\n"})
+	}
+
+	sectionsLock.Lock()
+	titles := make([]string, 0, len(sections))
+	for title := range sections {
+		titles = append(titles, title)
+	}
+	sort.Strings(titles)
+
+	for _, title := range titles {
+		body, sectionErr := sections[title]()
+		if sectionErr != nil {
+			body = fmt.Sprintf("unavailable: %v\n", sectionErr)
+		}
+		report.Sections = append(report.Sections, statusSection{title, body})
+	}
+	sectionsLock.Unlock()
+
+	return report
+}
+
+// StatusReport will assemble the current status of this machine into a
+// human readable plain text report. The version, uptime, runtime metrics and
+// most recent errors are always included followed by every registered section
+// in alphabetical order.
+func StatusReport() []byte {
+
+	status := gatherStatus()
+
+	var report bytes.Buffer
+
+	report.WriteString(fmt.Sprintf("Device:  %v (%v)\n", status.DeviceName, status.DeviceId))
+	report.WriteString(fmt.Sprintf("Version: %d\n", status.Version))
+	report.WriteString(fmt.Sprintf("Build:   %v\n", status.Build))
+	report.WriteString(fmt.Sprintf("Uptime:  %v\n", status.Uptime))
+	report.WriteString("\n")
+
+	for _, section := range status.Sections {
+		writeSection(&report, section.Title, section.Body)
+	}
+
+	return report.Bytes()
+}
+
+// SendStatusReport will generate a new status report and email it out to all
+// of the configured status report recipients. The report is sent as HTML with
+// inline charts of the profile history along with a plain text alternative.
+func SendStatusReport() error {
+
+	jwEmail := newEmail(STATUS_REPORT_SUBJECT+" "+utils.TimeStamp(time.Now()), StatusReport())
+	jwEmail.To = config.Cfg.StatusReportRecipients
+
+	if htmlErr := attachStatusHTML(jwEmail); htmlErr != nil {
+		log().LogErrorf("Unable to render the HTML status report. Sending plain text only: %v", htmlErr)
+	}
+
+	log().LogMessagef("Sending status report to: %v", jwEmail.To)
+
+	return sendOrQueueEmail(jwEmail)
+}
+
+// RunStatusReports will send out a status report every day at the time of day
+// defined by StatusReportTime, corrected for any skew of the local clock. It should only be called once all configuration
+// options have been correctly setup. Reports aren't sent while the reporter is
+// turned off under Subsystems in the config.
+func RunStatusReports() {
+	go func() {
+		for 1 == 1 {
+			wait, waitErr := untilNextStatusReport(clk().Now().Add(timesync.Offset()))
+			if waitErr != nil {
+				log().LogErrorf("Invalid StatusReportTime %v. Status reports are disabled: %v", config.Cfg.StatusReportTime, waitErr)
+				return
+			}
+
+			log().LogMessagef("Sleeping for %v before sending the next status report", wait)
+			clk().Sleep(wait)
+
+			if !config.Enabled(config.SUBSYSTEM_REPORTER) {
+				log().LogMessage("The reporter is turned off in the config. Skipping the status report")
+				continue
+			}
+
+			if reportErr := SendStatusReport(); reportErr != nil {
+				log().LogErrorf("Failed to send status report: %v", reportErr)
+			}
+		}
+	}()
+}
+
+// untilNextStatusReport will calculate how long to wait from now until the next
+// occurrence of the configured StatusReportTime in local time.
+func untilNextStatusReport(now time.Time) (time.Duration, error) {
+
+	reportTime, parseErr := time.Parse(STATUS_REPORT_TIME_LAYOUT, config.Cfg.StatusReportTime)
+	if parseErr != nil {
+		return 0, parseErr
+	}
+
+	next := time.Date(now.Year(), now.Month(), now.Day(), reportTime.Hour(), reportTime.Minute(), 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+
+	return next.Sub(now), nil
+}
+
+// writeSection will write a titled section to the given report buffer.
+func writeSection(report *bytes.Buffer, title string, body string) {
+	report.WriteString("---------- ")
+	report.WriteString(title)
+	report.WriteString(" ----------\n")
+	report.WriteString(body)
+	report.WriteString("\n")
+}
@@ -0,0 +1,192 @@
+package reporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/transport"
+)
+
+// The maximum amount of time to wait on a chat service or webhook to respond
+const WEBHOOK_TIMEOUT_SECONDS = 30
+
+// The maximum number of characters Discord accepts in a single message
+const DISCORD_MAX_CONTENT = 2000
+
+// The base URI of the Telegram bot API
+const TELEGRAM_API_URI = "https://api.telegram.org"
+
+// The name the requests of the chat services and webhooks are counted under
+const WEBHOOK_CLIENT = "webhook"
+
+var webhookClient transport.Doer = transport.NewClient(WEBHOOK_CLIENT, WEBHOOK_TIMEOUT_SECONDS*time.Second, 0)
+var webhookClientLock sync.Mutex
+
+// SetHTTPClient will make the chat services, webhooks and SMS gateways post
+// notifications with the given client. Passing nil goes back to the client
+// made by transport.NewClient.
+func SetHTTPClient(client transport.Doer) {
+	webhookClientLock.Lock()
+	defer webhookClientLock.Unlock()
+	if client == nil {
+		client = transport.NewClient(WEBHOOK_CLIENT, WEBHOOK_TIMEOUT_SECONDS*time.Second, 0)
+	}
+	webhookClient = client
+}
+
+// httpClient returns the client notifications are posted with.
+func httpClient() transport.Doer {
+	webhookClientLock.Lock()
+	defer webhookClientLock.Unlock()
+	return webhookClient
+}
+
+// SlackNotifier delivers notifications to a Slack incoming webhook.
+type SlackNotifier struct {
+	WebhookURL config.Endpoints
+}
+
+// Name returns the name of the Slack channel.
+func (sn SlackNotifier) Name() string {
+	return SLACK_NOTIFIER
+}
+
+// Notify will post the notification to the Slack incoming webhook.
+func (sn SlackNotifier) Notify(notification Notification) error {
+	return postJSONFailover(sn.WebhookURL, map[string]string{"text": chatText(notification)})
+}
+
+// TelegramNotifier delivers notifications to a Telegram chat via a bot.
+type TelegramNotifier struct {
+	BotToken string
+	ChatId   string
+}
+
+// Name returns the name of the Telegram channel.
+func (tn TelegramNotifier) Name() string {
+	return TELEGRAM_NOTIFIER
+}
+
+// Notify will send the notification to the configured chat as the bot. The
+// bot token is part of the request URL so it's left out of the returned
+// error, which is logged and queued with the notification.
+func (tn TelegramNotifier) Notify(notification Notification) error {
+	uri := fmt.Sprintf("%v/bot%v/sendMessage", TELEGRAM_API_URI, tn.BotToken)
+
+	postErr := postJSON(uri, map[string]string{"chat_id": tn.ChatId, "text": chatText(notification)})
+
+	var urlErr *url.Error
+	if errors.As(postErr, &urlErr) {
+		return fmt.Errorf("Could not reach the Telegram bot API: %v", urlErr.Err)
+	}
+
+	return postErr
+}
+
+// DiscordNotifier delivers notifications to a Discord webhook.
+type DiscordNotifier struct {
+	WebhookURL config.Endpoints
+}
+
+// Name returns the name of the Discord channel.
+func (dn DiscordNotifier) Name() string {
+	return DISCORD_NOTIFIER
+}
+
+// Notify will post the notification to the Discord webhook. Messages longer
+// than Discord allows are truncated.
+func (dn DiscordNotifier) Notify(notification Notification) error {
+	content := chatText(notification)
+	if len(content) > DISCORD_MAX_CONTENT {
+		content = content[:DISCORD_MAX_CONTENT]
+	}
+	return postJSONFailover(dn.WebhookURL, map[string]string{"content": content})
+}
+
+// WebhookNotifier delivers notifications as a JSON payload to any HTTP
+// endpoint.
+type WebhookNotifier struct {
+	URL config.Endpoints
+}
+
+// WebhookPayload is the JSON body posted by WebhookNotifier.
+type WebhookPayload struct {
+	DeviceId   string `json:"deviceId"`
+	DeviceName string `json:"deviceName"`
+	Severity   string `json:"severity"`
+	Subject    string `json:"subject"`
+	Body       string `json:"body"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+// Name returns the name of the generic webhook channel.
+func (wn WebhookNotifier) Name() string {
+	return WEBHOOK_NOTIFIER
+}
+
+// Notify will post the notification along with the identity of this device to
+// the webhook as JSON.
+func (wn WebhookNotifier) Notify(notification Notification) error {
+	return postJSONFailover(wn.URL, WebhookPayload{
+		DeviceId:   config.Cfg.DeviceId,
+		DeviceName: config.Cfg.DeviceName,
+		Severity:   notification.Severity.String(),
+		Subject:    notification.Subject,
+		Body:       string(notification.Body),
+		Timestamp:  time.Now().Unix(),
+	})
+}
+
+// chatText will format the notification as a single message for chat services
+// which don't have a separate subject line.
+func chatText(notification Notification) string {
+	return generateSubject(notificationSubject(notification)) + "\n" + string(notification.Body)
+}
+
+// postJSONFailover will POST the payload to each of the given endpoints in
+// turn until one of them accepts it.
+func postJSONFailover(uris config.Endpoints, payload interface{}) error {
+	_, failoverErr := transport.Failover(uris, func(uri string) error {
+		return postJSON(uri, payload)
+	})
+	return failoverErr
+}
+
+// postJSON will marshal the payload to JSON and POST it to the given URI. Any
+// non 2xx response is treated as an error.
+func postJSON(uri string, payload interface{}) error {
+
+	jsonBytes, jsonErr := json.Marshal(payload)
+	if jsonErr != nil {
+		return jsonErr
+	}
+
+	request, requestErr := http.NewRequest(http.MethodPost, uri, bytes.NewReader(jsonBytes))
+	if requestErr != nil {
+		return requestErr
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, postErr := httpClient().Do(request)
+	if postErr != nil {
+		return postErr
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode < http.StatusOK || response.StatusCode >= http.StatusMultipleChoices {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("Webhook returned status %d: %v", response.StatusCode, string(body))
+	}
+
+	return nil
+}
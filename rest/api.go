@@ -0,0 +1,130 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The prefix every versioned REST endpoint is served under. The unversioned
+// endpoints are kept for older clients.
+const API_V1_PREFIX = "/api/v1"
+
+// The header carrying the correlation ID of a request. A valid ID sent by the
+// client is reused, otherwise a new one is generated, and the ID is always
+// echoed back in the response.
+const CORRELATION_ID_HEADER = "X-Correlation-Id"
+
+// The machine readable codes of structured error responses
+const BAD_REQUEST_CODE = "bad_request"
+const UNAUTHORIZED_CODE = "unauthorized"
+const FORBIDDEN_CODE = "forbidden"
+const NOT_FOUND_CODE = "not_found"
+const METHOD_NOT_ALLOWED_CODE = "method_not_allowed"
+const CONFLICT_CODE = "conflict"
+const TOO_LARGE_CODE = "too_large"
+const RATE_LIMITED_CODE = "rate_limited"
+const INVALID_CONFIG_CODE = "invalid_config"
+const INTERNAL_ERROR_CODE = "internal_error"
+const UPSTREAM_FAILED_CODE = "upstream_failed"
+const UNAVAILABLE_CODE = "unavailable"
+const UPSTREAM_TIMEOUT_CODE = "upstream_timeout"
+
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            BAD_REQUEST_CODE,
+	http.StatusUnauthorized:          UNAUTHORIZED_CODE,
+	http.StatusForbidden:             FORBIDDEN_CODE,
+	http.StatusNotFound:              NOT_FOUND_CODE,
+	http.StatusMethodNotAllowed:      METHOD_NOT_ALLOWED_CODE,
+	http.StatusConflict:              CONFLICT_CODE,
+	http.StatusRequestEntityTooLarge: TOO_LARGE_CODE,
+	http.StatusTooManyRequests:       RATE_LIMITED_CODE,
+	http.StatusUnprocessableEntity:   INVALID_CONFIG_CODE,
+	http.StatusInternalServerError:   INTERNAL_ERROR_CODE,
+	http.StatusBadGateway:            UPSTREAM_FAILED_CODE,
+	http.StatusServiceUnavailable:    UNAVAILABLE_CODE,
+	http.StatusGatewayTimeout:        UPSTREAM_TIMEOUT_CODE,
+}
+
+// Correlation IDs sent by clients must look like this to be reused
+var validCorrelationId = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// correlationKey is the request context key the correlation ID is stored under
+type correlationKey struct{}
+
+// APIError is the JSON body of every error response so client tooling can
+// react to the code and quote the correlation ID when digging through logs.
+type APIError struct {
+	Code          string `json:"code"`
+	Message       string `json:"message"`
+	CorrelationId string `json:"correlationId"`
+}
+
+// correlate wraps the given handler so every request carries a correlation ID
+// in its context and in the response headers.
+func (rh *RestHandler) correlate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get(CORRELATION_ID_HEADER)
+		if !validCorrelationId.MatchString(id) {
+			id = newCorrelationId()
+		}
+
+		writer.Header().Set(CORRELATION_ID_HEADER, id)
+		next.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), correlationKey{}, id)))
+	})
+}
+
+// correlationId returns the correlation ID of the given request. Requests
+// which didn't pass through correlate are given a new one.
+func correlationId(writer http.ResponseWriter, request *http.Request) string {
+	if id, exists := request.Context().Value(correlationKey{}).(string); exists {
+		return id
+	}
+
+	if id := writer.Header().Get(CORRELATION_ID_HEADER); id != "" {
+		return id
+	}
+
+	id := newCorrelationId()
+	writer.Header().Set(CORRELATION_ID_HEADER, id)
+	return id
+}
+
+// newCorrelationId returns a new correlation ID. It's a ULID so the requests
+// of a log sort in the order they arrived.
+func newCorrelationId() string {
+	id, idErr := utils.NewULID()
+	if idErr != nil {
+		logger.Lgr.LogErrorf("Could not generate a correlation ID: %v", idErr)
+		return "unknown"
+	}
+	return id
+}
+
+// writeAPIError will write the structured JSON error body for the given status
+// code. The message defaults to the standard text of the status code.
+func writeAPIError(message string, httpStatusCode int, id string, writer http.ResponseWriter) {
+
+	code, known := errorCodes[httpStatusCode]
+	if !known {
+		code = INTERNAL_ERROR_CODE
+	}
+
+	if message == "" {
+		message = http.StatusText(httpStatusCode)
+	}
+
+	jsonBytes, jsonErr := json.Marshal(APIError{Code: code, Message: message, CorrelationId: id})
+	if jsonErr != nil {
+		logger.Lgr.LogErrorf("Could not marshal the error response: %v", jsonErr)
+		return
+	}
+
+	if _, writeErr := writer.Write(append(jsonBytes, '\n')); writeErr != nil {
+		logger.Lgr.LogMessagef("Failed to write error response body: %v", writeErr)
+	}
+}
@@ -0,0 +1,512 @@
+package rest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The REST path name which lists the actions waiting for approval
+const APPROVALS_REST_PATH = "approvals"
+
+// The REST path name which approves or rejects an action waiting for approval
+const APPROVE_REST_PATH = "approvals/approve"
+
+// The key to the query parameter for the id of an approval
+const APPROVAL_ID = "approvalid"
+
+// The header an approved request carries its approval token in
+const APPROVAL_HEADER = "X-Approval-Token"
+
+// The maximum size of the body of a request which needs approval in bytes
+const MAX_APPROVAL_BODY_BYTES = 32 * 1024 * 1024
+
+// The maximum number of actions waiting for approval at once
+const MAX_PENDING_APPROVALS = 100
+
+// The maximum number of characters of a request body shown in its summary
+const MAX_APPROVAL_PREVIEW = 200
+
+// The config settings which control who can reach and act on the agent. A
+// config.json asset changing any of them is an auth change.
+var authSettings = []string{
+	"RestTokens",
+	"RestTokenHashes",
+	"RestClientCAFile",
+	"RestAllowedCIDRs",
+	"RestListenInterface",
+	"ExecAllowlist",
+	"FileRoots",
+	"ApprovalActions",
+	"UpdateWindow",
+	"AgentUser",
+	"TLSPins",
+	"CommandAllowedSenders",
+	"CommandSecret",
+	"FleetSecret",
+}
+
+// Approval is a REST action held until a second admin approves it. The
+// request is identified by its method, endpoint, path parameters other than
+// the timestamp, and the SHA256 of its body, so the approval only lets the
+// exact same request through. ApprovedBy is empty until it's approved.
+type Approval struct {
+	Id          string    `json:"id"`
+	Action      string    `json:"action"`
+	Summary     string    `json:"summary"`
+	BodySHA256  string    `json:"bodySha256"`
+	RequestedBy string    `json:"requestedBy"`
+	ApprovedBy  string    `json:"approvedBy,omitempty"`
+	Requested   time.Time `json:"requested"`
+	Expires     time.Time `json:"expires"`
+	key         string
+}
+
+// ApprovalGrant is the JSON response of approving an action. Token is sent by
+// the requester in the APPROVAL_HEADER of the same request to run it, and is
+// only ever shown this once.
+type ApprovalGrant struct {
+	Approval
+	Token string `json:"token"`
+}
+
+// Every action waiting for approval or waiting to be used, by id
+var approvals = make(map[string]*Approval)
+var approvalsLock sync.Mutex
+
+// The key approval tokens are signed with. Generated when it's first needed
+// so approvals don't outlive the agent.
+var approvalSigningKey []byte
+
+// approvalsHandler will handle receiving and verifying approval listing
+// requests via REST. A GET returns every action waiting for approval, and every
+// approved action which hasn't been run yet, as JSON.
+func (rh *RestHandler) approvalsHandler(writer http.ResponseWriter, request *http.Request) {
+
+	if !rh.verifyRequestTimeStamp("approvalsHandler", writer, request) {
+		return
+	}
+
+	if request.Method != "GET" {
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for approvalsHandler", request.Method)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+		return
+	}
+
+	jsonBytes, jsonErr := json.Marshal(PendingApprovals())
+	if jsonErr != nil {
+		rh.writeResponseAndLog(jsonErr.Error(), http.StatusInternalServerError, writer, request)
+		return
+	}
+
+	rh.writeBodyAndLog("", http.StatusOK, "application/json", jsonBytes, writer, request)
+}
+
+// approveHandler will handle receiving and verifying approvals via REST. A
+// POST approves the action with the given id and returns the ApprovalGrant
+// whose token lets the requester run it. A DELETE rejects the action. Only an
+// admin token other than the one which requested the action can approve it.
+func (rh *RestHandler) approveHandler(writer http.ResponseWriter, request *http.Request) {
+
+	if !rh.verifyRequestTimeStamp("approveHandler", writer, request) {
+		return
+	}
+
+	approvalId := mux.Vars(request)[APPROVAL_ID]
+	if err := rh.verifyQueryParams(approvalId); err != nil {
+		rh.writeResponseAndLog(err.Error(), http.StatusBadRequest, writer, request)
+		return
+	}
+
+	auditDetail(request, "approval", approvalId)
+
+	switch request.Method {
+	case "POST":
+		token, authenticated := requestToken(request)
+		if !authenticated {
+			rh.writeResponseAndLog("Approving an action needs an admin token", http.StatusForbidden, writer, request)
+			return
+		}
+
+		grant, approveErr := approve(approvalId, token.Name)
+		if approveErr != nil {
+			rh.writeResponseAndLog(approveErr.Error(), http.StatusForbidden, writer, request)
+			return
+		}
+
+		logger.Lgr.LogMessagef("AUDIT %v %v %v approved by %v for %v", grant.Action, grant.Id, grant.Summary, token.Name, requestIdentity(request))
+
+		jsonBytes, jsonErr := json.Marshal(grant)
+		if jsonErr != nil {
+			rh.writeResponseAndLog(jsonErr.Error(), http.StatusInternalServerError, writer, request)
+			return
+		}
+		rh.writeBodyAndLog("", http.StatusOK, "application/json", jsonBytes, writer, request)
+	case "DELETE":
+		approvalsLock.Lock()
+		rejected, exists := approvals[approvalId]
+		delete(approvals, approvalId)
+		approvalsLock.Unlock()
+
+		if !exists {
+			rh.writeResponseAndLog("No action waiting for approval with id: "+approvalId, http.StatusNotFound, writer, request)
+			return
+		}
+
+		logger.Lgr.LogMessagef("AUDIT %v %v %v rejected by %v", rejected.Action, rejected.Id, rejected.Summary, requestIdentity(request))
+		rh.writeResponseAndLog("", http.StatusOK, writer, request)
+	default:
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for approveHandler", request.Method)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+	}
+}
+
+// requireApproval wraps the handler of the named endpoint so the actions listed
+// in the ApprovalActions only run once a second admin has approved them. A
+// request without an approval token is held as a pending Approval and answered
+// with http.StatusAccepted. The requester then sends the same request again
+// with the approval token in the APPROVAL_HEADER.
+func (rh *RestHandler) requireApproval(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+
+		if len(config.Cfg.ApprovalActions) == 0 || !guardedRoute(name, request.Method) {
+			handler(writer, request)
+			return
+		}
+
+		body, readErr := ioutil.ReadAll(http.MaxBytesReader(writer, request.Body, MAX_APPROVAL_BODY_BYTES))
+		if readErr != nil {
+			rh.writeResponseAndLog(readErr.Error(), http.StatusRequestEntityTooLarge, writer, request)
+			return
+		}
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		action := approvalAction(name, request, body)
+		if !requiresApproval(action) {
+			handler(writer, request)
+			return
+		}
+
+		token, authenticated := requestToken(request)
+		if !authenticated {
+			rh.writeResponseAndLog(fmt.Sprintf("The %v action needs the approval of a second admin token, so it can't be made without one", action), http.StatusForbidden, writer, request)
+			return
+		}
+
+		bodyHash := sha256.Sum256(body)
+		pending := Approval{
+			Action:      action,
+			Summary:     describeRequest(name, request, body),
+			BodySHA256:  hex.EncodeToString(bodyHash[:]),
+			RequestedBy: token.Name,
+		}
+		pending.key = approvalKey(name, request, pending.BodySHA256)
+
+		if approvalToken := request.Header.Get(APPROVAL_HEADER); approvalToken != "" {
+			approved, useErr := useApproval(approvalToken, pending)
+			if useErr != nil {
+				rh.writeResponseAndLog(useErr.Error(), http.StatusForbidden, writer, request)
+				return
+			}
+
+			auditDetail(request, "approval", approved.Id)
+			auditDetail(request, "approvedBy", approved.ApprovedBy)
+			logger.Lgr.LogMessagef("AUDIT %v %v %v requested by %v and approved by %v is running", approved.Action, approved.Id, approved.Summary, approved.RequestedBy, approved.ApprovedBy)
+			handler(writer, request)
+			return
+		}
+
+		held, holdErr := holdApproval(pending)
+		if holdErr != nil {
+			rh.writeResponseAndLog(holdErr.Error(), http.StatusTooManyRequests, writer, request)
+			return
+		}
+
+		auditDetail(request, "approval", held.Id)
+
+		jsonBytes, jsonErr := json.Marshal(held)
+		if jsonErr != nil {
+			rh.writeResponseAndLog(jsonErr.Error(), http.StatusInternalServerError, writer, request)
+			return
+		}
+		rh.writeBodyAndLog("", http.StatusAccepted, "application/json", jsonBytes, writer, request)
+	}
+}
+
+// guardedRoute returns whether the named endpoint with the given method can be
+// one of the APPROVAL_ACTIONS.
+func guardedRoute(name string, method string) bool {
+	switch name {
+	case EXEC_REST_PATH, EXECUTE_REST_PATH, UPDATE_APPLY_REST_PATH, TOKEN_ROTATE_REST_PATH:
+		return method == "POST"
+	case UPDATE_REST_PATH:
+		return true
+	case ASSET_REST_PATH:
+		return method == "POST" || method == "DELETE"
+	}
+	return false
+}
+
+// approvalAction returns which of the APPROVAL_ACTIONS the given request to
+// the named endpoint is, or an empty string when it doesn't need approval.
+// Updates inside of the UpdateWindow and config.json assets which leave the
+// auth settings as they are don't need approval.
+func approvalAction(name string, request *http.Request, body []byte) string {
+	switch name {
+	case EXEC_REST_PATH, EXECUTE_REST_PATH:
+		return config.APPROVAL_EXEC
+	case UPDATE_APPLY_REST_PATH, UPDATE_REST_PATH:
+		if config.Cfg.UpdateWindow != "" && config.InWindow(config.Cfg.UpdateWindow, time.Now()) {
+			return ""
+		}
+		return config.APPROVAL_UPDATE
+	case TOKEN_ROTATE_REST_PATH:
+		return config.APPROVAL_AUTH
+	case ASSET_REST_PATH:
+		if mux.Vars(request)[ASSET_NAME] != "config.json" {
+			return ""
+		}
+		if request.Method == "DELETE" || changesAuthSettings(body) {
+			return config.APPROVAL_AUTH
+		}
+	}
+	return ""
+}
+
+// requiresApproval returns whether the given action is one of the
+// ApprovalActions.
+func requiresApproval(action string) bool {
+	for _, required := range config.Cfg.ApprovalActions {
+		if action != "" && action == required {
+			return true
+		}
+	}
+	return false
+}
+
+// changesAuthSettings returns whether the given config.json contents set any
+// of the authSettings differently from the running config. Contents which
+// can't be read as a config are treated as a change.
+func changesAuthSettings(body []byte) bool {
+
+	var proposed config.Config
+	if jsonErr := json.Unmarshal(body, &proposed); jsonErr != nil {
+		return true
+	}
+
+	current := reflect.ValueOf(*config.Cfg)
+	replacement := reflect.ValueOf(proposed)
+	for _, setting := range authSettings {
+		// compare as JSON so nil and empty lists are told apart the same way
+		// the config file would
+		currentJSON, _ := json.Marshal(current.FieldByName(setting).Interface())
+		replacementJSON, _ := json.Marshal(replacement.FieldByName(setting).Interface())
+		if !bytes.Equal(currentJSON, replacementJSON) {
+			return true
+		}
+	}
+	return false
+}
+
+// approvalKey returns what identifies the given request to the named endpoint:
+// the method, the endpoint, every path parameter other than the timestamp, and
+// the SHA256 of the body.
+func approvalKey(name string, request *http.Request, bodySHA256 string) string {
+
+	var parameters []string
+	for parameter, value := range mux.Vars(request) {
+		if parameter != TIMESTAMP {
+			parameters = append(parameters, parameter+"="+value)
+		}
+	}
+	sort.Strings(parameters)
+
+	return strings.Join([]string{request.Method, name, strings.Join(parameters, "&"), bodySHA256}, "|")
+}
+
+// describeRequest returns a single line description of the given request to
+// the named endpoint for whoever approves it. Bodies which are text are shown
+// up to MAX_APPROVAL_PREVIEW characters.
+func describeRequest(name string, request *http.Request, body []byte) string {
+
+	description := request.Method + " " + name
+	var parameters []string
+	for parameter, value := range mux.Vars(request) {
+		if parameter != TIMESTAMP {
+			parameters = append(parameters, value)
+		}
+	}
+	sort.Strings(parameters)
+	if len(parameters) > 0 {
+		description += "/" + strings.Join(parameters, "/")
+	}
+
+	if len(body) == 0 {
+		return description
+	}
+	if !utf8.Valid(body) {
+		return fmt.Sprintf("%v with a %v byte body", description, len(body))
+	}
+
+	preview := strings.Join(strings.Fields(string(body)), " ")
+	if len(preview) > MAX_APPROVAL_PREVIEW {
+		preview = preview[:MAX_APPROVAL_PREVIEW] + "..."
+	}
+	return description + " " + preview
+}
+
+// holdApproval will store the given request as waiting for approval and
+// publish an ApprovalRequested event. The same request held again by the same
+// token returns the approval which is already waiting.
+func holdApproval(pending Approval) (Approval, error) {
+
+	approvalsLock.Lock()
+	defer approvalsLock.Unlock()
+
+	pruneApprovals()
+
+	for _, existing := range approvals {
+		if existing.key == pending.key && existing.RequestedBy == pending.RequestedBy && existing.ApprovedBy == "" {
+			return *existing, nil
+		}
+	}
+
+	if len(approvals) >= MAX_PENDING_APPROVALS {
+		return Approval{}, fmt.Errorf("There are already %v actions waiting for approval. Approve or reject some of them first", len(approvals))
+	}
+
+	id, idErr := utils.NewUUID()
+	if idErr != nil {
+		return Approval{}, idErr
+	}
+
+	pending.Id = id
+	pending.Requested = time.Now().UTC()
+	pending.Expires = pending.Requested.Add(time.Duration(config.Cfg.ApprovalTimeoutMinutes) * time.Minute)
+	approvals[pending.Id] = &pending
+
+	requested := events.ApprovalRequested{Id: pending.Id, Action: pending.Action, Request: pending.Summary, RequestedBy: pending.RequestedBy}
+	logger.Lgr.LogMessagef("%v", requested.Summary())
+	events.Publish(requested)
+
+	return pending, nil
+}
+
+// approve will approve the action with the given id on behalf of the named
+// token, which can't be the token which requested it, and return the grant
+// holding the signed approval token. The approval can be used once within the
+// ApprovalTimeoutMinutes.
+func approve(id string, approver string) (ApprovalGrant, error) {
+
+	approvalsLock.Lock()
+	defer approvalsLock.Unlock()
+
+	pruneApprovals()
+
+	pending, exists := approvals[id]
+	if !exists {
+		return ApprovalGrant{}, fmt.Errorf("No action waiting for approval with id: %v", id)
+	}
+	if pending.ApprovedBy != "" {
+		return ApprovalGrant{}, fmt.Errorf("The action %v was already approved by %v", id, pending.ApprovedBy)
+	}
+	if pending.RequestedBy == approver {
+		return ApprovalGrant{}, fmt.Errorf("The action %v was requested by %v, so it needs to be approved by a different admin token", id, approver)
+	}
+
+	if approvalSigningKey == nil {
+		signingKey := make([]byte, sha256.Size)
+		if _, randErr := rand.Read(signingKey); randErr != nil {
+			return ApprovalGrant{}, randErr
+		}
+		approvalSigningKey = signingKey
+	}
+
+	pending.ApprovedBy = approver
+	pending.Expires = time.Now().UTC().Add(time.Duration(config.Cfg.ApprovalTimeoutMinutes) * time.Minute)
+
+	return ApprovalGrant{Approval: *pending, Token: pending.Id + "." + signApproval(*pending)}, nil
+}
+
+// useApproval will check the given approval token was signed for the given
+// request, made by the token which requested it, and remove the approval so it
+// can't be used again. Returns the approval which was used.
+func useApproval(approvalToken string, request Approval) (Approval, error) {
+
+	approvalsLock.Lock()
+	defer approvalsLock.Unlock()
+
+	pruneApprovals()
+
+	parts := strings.SplitN(approvalToken, ".", 2)
+	approved, exists := approvals[parts[0]]
+	if len(parts) != 2 || !exists || approved.ApprovedBy == "" {
+		return Approval{}, fmt.Errorf("The %v isn't an approval which is waiting to be used", APPROVAL_HEADER)
+	}
+	if !hmac.Equal([]byte(parts[1]), []byte(signApproval(*approved))) {
+		return Approval{}, fmt.Errorf("The %v wasn't signed by this agent", APPROVAL_HEADER)
+	}
+	if approved.key != request.key || approved.RequestedBy != request.RequestedBy {
+		return Approval{}, fmt.Errorf("The approval %v is for %v requested by %v, not this request", approved.Id, approved.Summary, approved.RequestedBy)
+	}
+
+	delete(approvals, approved.Id)
+	return *approved, nil
+}
+
+// signApproval returns the signature of the given approved action, which ties
+// its approval token to the request, the requester and the approver. The
+// approvalsLock must be held.
+func signApproval(approved Approval) string {
+	mac := hmac.New(sha256.New, approvalSigningKey)
+	mac.Write([]byte(strings.Join([]string{approved.Id, approved.key, approved.RequestedBy, approved.ApprovedBy}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// pruneApprovals will remove every approval which has expired. The
+// approvalsLock must be held.
+func pruneApprovals() {
+	now := time.Now()
+	for id, approval := range approvals {
+		if now.After(approval.Expires) {
+			logger.Lgr.LogMessagef("The %v action %v %v expired without being used", approval.Action, id, approval.Summary)
+			delete(approvals, id)
+		}
+	}
+}
+
+// PendingApprovals returns every action waiting for approval, and every
+// approved action which hasn't been run yet, oldest first.
+func PendingApprovals() []Approval {
+
+	approvalsLock.Lock()
+	defer approvalsLock.Unlock()
+
+	pruneApprovals()
+
+	pending := []Approval{}
+	for _, approval := range approvals {
+		pending = append(pending, *approval)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Requested.Before(pending[j].Requested) })
+
+	return pending
+}
@@ -0,0 +1,82 @@
+package rest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/seantcanavan/anon-eth-net/audit"
+)
+
+// auditKey is the request context key the audit details of a request are
+// stored under
+type auditKey struct{}
+
+// auditDetails holds the parameters handlers add to the audit entry of the
+// request they're handling.
+type auditDetails struct {
+	parameters map[string]string
+	lock       sync.Mutex
+}
+
+// auditTrail wraps the given handler so every request which reaches it is
+// recorded in the audit log along with the parameters of the request and the
+// resulting status code. It belongs behind authenticate so only authenticated
+// requests are recorded as actions.
+func (rh *RestHandler) auditTrail(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+
+		if request.Method == "OPTIONS" {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		details := &auditDetails{parameters: make(map[string]string)}
+		for key, values := range request.URL.Query() {
+			details.parameters[key] = strings.Join(values, ",")
+		}
+
+		recorder := &statusRecorder{ResponseWriter: writer}
+		request = request.WithContext(context.WithValue(request.Context(), auditKey{}, details))
+
+		next.ServeHTTP(recorder, request)
+
+		details.lock.Lock()
+		defer details.lock.Unlock()
+
+		details.parameters["correlationId"] = correlationId(writer, request)
+
+		audit.Record(requestActor(request), request.Method+" "+request.URL.Path, details.parameters, strconv.Itoa(recorder.status)+" "+http.StatusText(recorder.status))
+	})
+}
+
+// auditDetail will add the given parameter to the audit entry of the given
+// request, e.g. the command line run by the exec handler. Does nothing for
+// requests which aren't being audited.
+func auditDetail(request *http.Request, key string, value string) {
+	details, audited := request.Context().Value(auditKey{}).(*auditDetails)
+	if !audited {
+		return
+	}
+
+	details.lock.Lock()
+	defer details.lock.Unlock()
+	details.parameters[key] = value
+}
+
+// requestActor describes who sent the given request for the audit log: the
+// remote address, client certificate subject, and the name and role of the
+// authenticated token, if any.
+func requestActor(request *http.Request) string {
+
+	actor := requestIdentity(request)
+
+	if token, authenticated := requestToken(request); authenticated {
+		actor += fmt.Sprintf(" %v (%v)", token.Name, token.Role)
+	}
+
+	return actor
+}
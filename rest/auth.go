@@ -0,0 +1,197 @@
+package rest
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+// The prefix of the Authorization header value which carries a bearer token
+const BEARER_PREFIX = "Bearer "
+
+// The name requests to the health check are audited under when there's no way
+// to authenticate them
+const ANONYMOUS_TOKEN_NAME = "anonymous"
+
+// authFailures tracks the recent failed authentication attempts of a single
+// remote address.
+type authFailures struct {
+	count       int
+	lockedUntil time.Time
+}
+
+var failures = make(map[string]*authFailures)
+var failuresLock sync.Mutex
+
+// HashToken returns the hex encoded SHA-256 hash of the given bearer token.
+// This is the value which belongs in the RestTokens or RestTokenHashes config
+// values so the tokens themselves are never stored on the remote machine.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticate wraps the given handler so every request must present one of
+// the configured bearer tokens before it's handled. The matching token is
+// stored in the request so authorize can check its role. Each remote address
+// is locked out for RestLockoutSeconds after RestMaxAuthFailures failures in a
+// row. The dashboard page, which holds no host data, is served to everyone.
+// When no tokens are configured a client certificate verified against the
+// RestClientCAFile authenticates the request as an admin, and when there's no
+// RestClientCAFile either only the health check is served.
+func (rh *RestHandler) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+
+		if dashboardRequest(request) {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		remote := remoteHost(request)
+
+		if len(configuredTokens()) == 0 {
+			if token, verified := certificateToken(request); verified {
+				next.ServeHTTP(writer, withToken(request, token))
+				return
+			}
+			if healthRequest(request) {
+				next.ServeHTTP(writer, withToken(request, apiToken{Name: ANONYMOUS_TOKEN_NAME, Role: ROLE_READ_ONLY}))
+				return
+			}
+			rh.writeResponseAndLog(fmt.Sprintf("Rejected request from %v: %v", remote, authConfigured()), http.StatusUnauthorized, writer, request)
+			return
+		}
+
+		if lockedOut(remote) {
+			rh.writeResponseAndLog(fmt.Sprintf("Rejected request from locked out address: %v", remote), http.StatusTooManyRequests, writer, request)
+			return
+		}
+
+		token, valid := matchToken(request.Header.Get("Authorization"))
+		if !valid {
+			recordAuthFailure(remote)
+			rh.writeResponseAndLog(fmt.Sprintf("Rejected request with a missing or invalid bearer token from: %v", remote), http.StatusUnauthorized, writer, request)
+			return
+		}
+
+		clearAuthFailures(remote)
+		next.ServeHTTP(writer, withToken(request, token))
+	})
+}
+
+// authConfigured returns nil when requests can be authenticated, by a bearer
+// token or a client certificate, and which config values are missing
+// otherwise.
+func authConfigured() error {
+
+	if len(configuredTokens()) > 0 || config.Cfg.RestClientCAFile != "" {
+		return nil
+	}
+
+	return fmt.Errorf("Neither RestTokens, RestTokenHashes nor a RestClientCAFile for mutual TLS are configured so only the dashboard and health check are served. Please add a token or a client CA to the config.json asset and restart.")
+}
+
+// certificateToken returns the token of a request which presented a client
+// certificate verified against the RestClientCAFile, named after the common
+// name of the certificate.
+func certificateToken(request *http.Request) (apiToken, bool) {
+
+	if config.Cfg.RestClientCAFile == "" || request.TLS == nil || len(request.TLS.VerifiedChains) == 0 || len(request.TLS.VerifiedChains[0]) == 0 {
+		return apiToken{}, false
+	}
+
+	return apiToken{Name: "cert:" + request.TLS.VerifiedChains[0][0].Subject.CommonName, Role: ROLE_ADMIN}, true
+}
+
+// healthRequest returns true if the given request is for the health check,
+// either at its own path or under API_V1_PREFIX.
+func healthRequest(request *http.Request) bool {
+	return request.URL.Path == "/"+HEALTH_REST_PATH || request.URL.Path == API_V1_PREFIX+"/"+HEALTH_REST_PATH
+}
+
+// remoteHost returns the address of the client which sent the request without
+// its port.
+func remoteHost(request *http.Request) string {
+	host, _, splitErr := net.SplitHostPort(request.RemoteAddr)
+	if splitErr != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// lockedOut returns whether the given remote address is currently locked out.
+func lockedOut(remote string) bool {
+	failuresLock.Lock()
+	defer failuresLock.Unlock()
+
+	record, exists := failures[remote]
+	return exists && time.Now().Before(record.lockedUntil)
+}
+
+// recordAuthFailure will count a failed authentication attempt from the given
+// remote address and lock it out once it has failed too many times.
+func recordAuthFailure(remote string) {
+	failuresLock.Lock()
+	defer failuresLock.Unlock()
+
+	record, exists := failures[remote]
+	if !exists {
+		record = &authFailures{}
+		failures[remote] = record
+	}
+
+	record.count++
+	if record.count >= config.Cfg.RestMaxAuthFailures {
+		record.count = 0
+		record.lockedUntil = time.Now().Add(time.Duration(config.Cfg.RestLockoutSeconds) * time.Second)
+		logger.Lgr.LogErrorf("Locking out %v for %d seconds after %d failed REST authentication attempts", remote, config.Cfg.RestLockoutSeconds, config.Cfg.RestMaxAuthFailures)
+	}
+}
+
+// clearAuthFailures will forget the failed authentication attempts of the
+// given remote address after it successfully authenticates.
+func clearAuthFailures(remote string) {
+	failuresLock.Lock()
+	defer failuresLock.Unlock()
+
+	delete(failures, remote)
+}
+
+// serverTLSConfig returns the TLS config for the REST server. When a
+// RestClientCAFile is configured every client must present a certificate
+// signed by that CA.
+func serverTLSConfig() (*tls.Config, error) {
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if config.Cfg.RestClientCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	caBytes, readErr := ioutil.ReadFile(config.Cfg.RestClientCAFile)
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	clientCAs := x509.NewCertPool()
+	if ok := clientCAs.AppendCertsFromPEM(caBytes); !ok {
+		return nil, fmt.Errorf("No PEM certificates found in RestClientCAFile: %v", config.Cfg.RestClientCAFile)
+	}
+
+	tlsConfig.ClientCAs = clientCAs
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+
+	logger.Lgr.LogMessagef("Successfully loaded REST client CA for mutual TLS: %v", config.Cfg.RestClientCAFile)
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,253 @@
+package rest
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The REST path name which serves the web dashboard
+const DASHBOARD_REST_PATH = "dashboard"
+
+// The name of the optional asset which overrides the built in dashboard page
+const DASHBOARD_ASSET = "dashboard.html"
+
+// The content security policy of the dashboard page. Everything it needs is
+// inline and it only ever talks to the agent which served it.
+const DASHBOARD_CONTENT_SECURITY_POLICY = "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; img-src data:; connect-src 'self'; frame-ancestors 'none'"
+
+// The built in single page dashboard. It holds no host data itself. The
+// bearer token entered by the operator is kept in session storage and sent
+// with every API request the page makes, so what it can see and do is
+// governed by the role of that token. It can be overridden by placing a
+// dashboard.html page in the assets folder.
+const DEFAULT_DASHBOARD_HTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>anon-eth-net</title>
+<style>
+body { font-family: sans-serif; color: #222; margin: 0; background: #fafafa; }
+header { background: #263238; color: #fff; padding: 10px 16px; display: flex; gap: 12px; align-items: center; }
+header h1 { font-size: 18px; margin: 0; flex: 1; }
+main { display: grid; grid-template-columns: repeat(auto-fit, minmax(420px, 1fr)); gap: 16px; padding: 16px; }
+section { background: #fff; border: 1px solid #ddd; border-radius: 4px; padding: 12px; overflow: auto; }
+section h2 { font-size: 15px; margin: 0 0 8px 0; }
+pre { background: #f4f4f4; padding: 8px; margin: 0; max-height: 360px; overflow: auto; font-size: 12px; }
+table { border-collapse: collapse; width: 100%; font-size: 13px; }
+td, th { text-align: left; padding: 4px 6px; border-bottom: 1px solid #eee; }
+button { cursor: pointer; }
+.error { color: #b00020; }
+.metric { display: flex; align-items: center; gap: 8px; font-size: 12px; }
+.metric span { width: 180px; }
+</style>
+</head>
+<body>
+<header>
+<h1 id="device">anon-eth-net</h1>
+<input id="token" type="password" placeholder="bearer token" size="32">
+<button id="save">Connect</button>
+</header>
+<p id="message" class="error"></p>
+<main>
+<section><h2>Status</h2><pre id="status"></pre></section>
+<section><h2>Metrics</h2><div id="metrics"></div></section>
+<section><h2>Jobs</h2><table id="jobs"></table></section>
+<section><h2>Logs <button id="refreshLogs">Refresh</button></h2><pre id="logs"></pre></section>
+</main>
+<script>
+"use strict";
+
+const LOG_LINES = 200;
+const REFRESH_MILLISECONDS = 10000;
+
+function timestamp() {
+	return Math.floor(Date.now() / 1000);
+}
+
+async function api(method, path, accept) {
+	const headers = {"Accept": accept || "text/plain"};
+	const token = sessionStorage.getItem("token");
+	if (token) {
+		headers["Authorization"] = "Bearer " + token;
+	}
+	const response = await fetch("/api/v1/" + path, {method: method, headers: headers});
+	if (!response.ok) {
+		let message = response.status + " " + response.statusText;
+		try {
+			message = (await response.json()).message || message;
+		} catch (ignored) {}
+		throw new Error(path + ": " + message);
+	}
+	return accept === "application/json" ? response.json() : response.text();
+}
+
+function showError(err) {
+	document.getElementById("message").textContent = err.message;
+}
+
+function sparkline(values) {
+	const width = 240, height = 40;
+	const canvas = document.createElement("canvas");
+	canvas.width = width;
+	canvas.height = height;
+	if (values.length < 2) {
+		return canvas;
+	}
+	const min = Math.min.apply(null, values), max = Math.max.apply(null, values);
+	const range = max - min || 1;
+	const context = canvas.getContext("2d");
+	context.strokeStyle = "#1565c0";
+	context.beginPath();
+	values.forEach(function(value, index) {
+		const x = index * (width - 1) / (values.length - 1);
+		const y = height - 1 - (value - min) * (height - 1) / range;
+		index === 0 ? context.moveTo(x, y) : context.lineTo(x, y);
+	});
+	context.stroke();
+	return canvas;
+}
+
+async function loadStatus() {
+	document.getElementById("status").textContent = await api("GET", "status/" + timestamp());
+}
+
+async function loadMetrics() {
+	const samples = await api("GET", "metrics/" + timestamp(), "application/json");
+	const series = {};
+	samples.forEach(function(sample) {
+		Object.keys(sample.Metrics).forEach(function(name) {
+			(series[name] = series[name] || []).push(sample.Metrics[name]);
+		});
+	});
+	const metrics = document.getElementById("metrics");
+	metrics.textContent = "";
+	Object.keys(series).sort().forEach(function(name) {
+		const values = series[name];
+		const row = document.createElement("div");
+		row.className = "metric";
+		const label = document.createElement("span");
+		label.textContent = name + ": " + values[values.length - 1].toFixed(2);
+		row.appendChild(label);
+		row.appendChild(sparkline(values));
+		metrics.appendChild(row);
+	});
+}
+
+async function jobAction(action, name) {
+	try {
+		await api("POST", "jobs/" + action + "/" + timestamp() + "/" + encodeURIComponent(name));
+		await loadJobs();
+	} catch (err) {
+		showError(err);
+	}
+}
+
+async function loadJobs() {
+	const jobs = await api("GET", "jobs/" + timestamp(), "application/json");
+	const table = document.getElementById("jobs");
+	table.textContent = "";
+	const header = table.insertRow();
+	["Name", "State", "Runs", "Last exit", ""].forEach(function(title) {
+		const cell = document.createElement("th");
+		cell.textContent = title;
+		header.appendChild(cell);
+	});
+	jobs.forEach(function(job) {
+		const row = table.insertRow();
+		const state = job.running ? "running" : (job.disabled ? "disabled" : "stopped");
+		[job.name, state, job.runs, job.exitStatus].forEach(function(value) {
+			row.insertCell().textContent = value;
+		});
+		const actions = row.insertCell();
+		const buttons = job.disabled ? ["start"] : ["stop", "restart"];
+		buttons.forEach(function(action) {
+			const button = document.createElement("button");
+			button.textContent = action;
+			button.onclick = function() { jobAction(action, job.name); };
+			actions.appendChild(button);
+		});
+	});
+}
+
+async function loadLogs() {
+	const lines = (await api("GET", "logs/" + timestamp())).split("\n");
+	const logs = document.getElementById("logs");
+	logs.textContent = lines.slice(-LOG_LINES).join("\n");
+	logs.scrollTop = logs.scrollHeight;
+}
+
+async function refresh() {
+	document.getElementById("message").textContent = "";
+	for (const load of [loadStatus, loadMetrics, loadJobs, loadLogs]) {
+		try {
+			await load();
+		} catch (err) {
+			showError(err);
+		}
+	}
+}
+
+document.getElementById("device").textContent = "anon-eth-net " + location.host;
+document.getElementById("save").onclick = function() {
+	sessionStorage.setItem("token", document.getElementById("token").value);
+	document.getElementById("token").value = "";
+	refresh();
+};
+document.getElementById("refreshLogs").onclick = function() { loadLogs().catch(showError); };
+
+refresh();
+setInterval(refresh, REFRESH_MILLISECONDS);
+</script>
+</body>
+</html>
+`
+
+// dashboardHandler will serve the web dashboard so operators who don't use
+// the command line can manage this machine by browsing to its REST port. It's
+// served to everyone who can reach the REST server since the page holds no
+// host data. Every request it makes must still be authenticated.
+func (rh *RestHandler) dashboardHandler(writer http.ResponseWriter, request *http.Request) {
+
+	switch request.Method {
+	case "GET", "HEAD":
+		page, pageErr := dashboardPage()
+		if pageErr != nil {
+			rh.writeResponseAndLog(pageErr.Error(), http.StatusInternalServerError, writer, request)
+			return
+		}
+		writer.Header().Set("Content-Security-Policy", DASHBOARD_CONTENT_SECURITY_POLICY)
+		writer.Header().Set("X-Content-Type-Options", "nosniff")
+		writer.Header().Set("Cache-Control", "no-store")
+		rh.writeBodyAndLog("", http.StatusOK, "text/html; charset=utf-8", page, writer, request)
+	default:
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for dashboardHandler", request.Method)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+	}
+
+	return
+}
+
+// dashboardPage will load the dashboard page from the assets folder if one
+// has been provided otherwise the built in page is used.
+func dashboardPage() ([]byte, error) {
+
+	pagePath, assetErr := utils.AssetPath(DASHBOARD_ASSET)
+	if assetErr != nil {
+		return []byte(DEFAULT_DASHBOARD_HTML), nil
+	}
+
+	return ioutil.ReadFile(pagePath)
+}
+
+// dashboardRequest returns true if the given request is for the dashboard
+// page itself rather than one of the API endpoints it calls.
+func dashboardRequest(request *http.Request) bool {
+	if request.Method != "GET" && request.Method != "HEAD" {
+		return false
+	}
+	return request.URL.Path == "/" || request.URL.Path == "/"+DASHBOARD_REST_PATH
+}
@@ -0,0 +1,82 @@
+package rest
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/seantcanavan/anon-eth-net/diagnostics"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The REST path name which calls the diagnostics handler
+const DIAGNOSTICS_REST_PATH = "diagnostics"
+
+// The REST path name which calls the effective config handler
+const CONFIG_REST_PATH = "config"
+
+// The URL query parameter which, when true, emails the diagnostics bundle instead of returning it
+const EMAIL_QUERY = "email"
+
+// diagnosticsHandler will handle receiving and verifying diagnostics bundle
+// requests via REST. A POST assembles a single gzipped tarball holding the
+// recent logs, the redacted config, the profiler history, the job states, the
+// update history and the system fingerprint and returns it as the response
+// body. With email=true the bundle is instead emailed via the reporter as an
+// asynchronous operation.
+func (rh *RestHandler) diagnosticsHandler(writer http.ResponseWriter, request *http.Request) {
+
+	if !rh.verifyRequestTimeStamp("diagnosticsHandler", writer, request) {
+		return
+	}
+
+	switch request.Method {
+	case "POST":
+		if request.URL.Query().Get(EMAIL_QUERY) == "true" {
+			auditDetail(request, EMAIL_QUERY, "true")
+			rh.startOperation(DIAGNOSTICS_EMAIL_OPERATION, writer, request)
+			return
+		}
+
+		var bundle bytes.Buffer
+		if bundleErr := diagnostics.Bundle(rh.MainLoader, &bundle); bundleErr != nil {
+			rh.writeResponseAndLog(bundleErr.Error(), http.StatusInternalServerError, writer, request)
+			return
+		}
+
+		bundleName := utils.TimeStampFileName(diagnostics.DIAGNOSTICS_BASE_NAME, diagnostics.DIAGNOSTICS_EXTENSION)
+		writer.Header().Set("Content-Disposition", "attachment; filename=\""+bundleName+"\"")
+		rh.writeBodyAndLog("", http.StatusOK, GZIP_CONTENT_TYPE, bundle.Bytes(), writer, request)
+	default:
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for diagnosticsHandler", request.Method)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+	}
+
+	return
+}
+
+// configHandler will serve the config the agent is running with, every
+// secret redacted, with each setting annotated with where its value came
+// from: a default, the config.json asset, a template, an include or overlay
+// file, the emaillogin.conf asset or a remote push.
+func (rh *RestHandler) configHandler(writer http.ResponseWriter, request *http.Request) {
+
+	if !rh.verifyRequestTimeStamp("configHandler", writer, request) {
+		return
+	}
+
+	switch request.Method {
+	case "GET":
+		jsonBytes, effectiveErr := diagnostics.EffectiveConfig()
+		if effectiveErr != nil {
+			rh.writeResponseAndLog(effectiveErr.Error(), http.StatusInternalServerError, writer, request)
+			return
+		}
+		rh.writeBodyAndLog("", http.StatusOK, "application/json", jsonBytes, writer, request)
+	default:
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for configHandler", request.Method)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+	}
+
+	return
+}
@@ -0,0 +1,218 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+// The REST path name which calls the exec handler
+const EXEC_REST_PATH = "exec"
+
+// The maximum size of the JSON body of an exec request in bytes
+const MAX_EXEC_REQUEST_BYTES = 65536
+
+// The exit code reported for a command which couldn't be started or was killed
+const EXEC_FAILED_EXIT_CODE = -1
+
+// ExecRequest is the JSON body of a POST to the exec handler.
+type ExecRequest struct {
+	Command   string   `json:"command"`
+	Arguments []string `json:"args"`
+}
+
+// ExecResult is the JSON response of the exec handler describing how the
+// command finished.
+type ExecResult struct {
+	Stdout          string `json:"stdout"`
+	Stderr          string `json:"stderr"`
+	ExitCode        int    `json:"exitCode"`
+	TimedOut        bool   `json:"timedOut"`
+	OutputTruncated bool   `json:"outputTruncated"`
+	DurationMillis  int64  `json:"durationMillis"`
+	Error           string `json:"error,omitempty"`
+}
+
+// cappedBuffer collects at most limit bytes written to it and silently
+// discards the rest so a chatty command can't exhaust memory.
+type cappedBuffer struct {
+	buffer    bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+// Write satisfies the io.Writer interface. It always reports the full length
+// as written so the command isn't killed by a short write.
+func (cb *cappedBuffer) Write(p []byte) (int, error) {
+	remaining := cb.limit - cb.buffer.Len()
+	if remaining < len(p) {
+		cb.truncated = true
+		if remaining > 0 {
+			cb.buffer.Write(p[:remaining])
+		}
+		return len(p), nil
+	}
+	return cb.buffer.Write(p)
+}
+
+// execHandler will handle receiving and verifying remote command execution
+// requests via REST. A POST with an ExecRequest body runs the command directly,
+// without a shell, if it's in the configured allowlist and returns an
+// ExecResult. Every request is written to the audit log whether or not it's
+// allowed to run.
+func (rh *RestHandler) execHandler(writer http.ResponseWriter, request *http.Request) {
+
+	if !rh.verifyRequestTimeStamp("execHandler", writer, request) {
+		return
+	}
+
+	if request.Method != "POST" {
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for execHandler", request.Method)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+		return
+	}
+
+	bodyBytes, readErr := ioutil.ReadAll(http.MaxBytesReader(writer, request.Body, MAX_EXEC_REQUEST_BYTES))
+	if readErr != nil {
+		rh.writeResponseAndLog(readErr.Error(), http.StatusBadRequest, writer, request)
+		return
+	}
+
+	var execRequest ExecRequest
+	if jsonErr := json.Unmarshal(bodyBytes, &execRequest); jsonErr != nil {
+		rh.writeResponseAndLog(jsonErr.Error(), http.StatusBadRequest, writer, request)
+		return
+	}
+
+	if execRequest.Command == "" {
+		rh.writeResponseAndLog("No command given to execute", http.StatusBadRequest, writer, request)
+		return
+	}
+
+	commandLine := strings.Join(append([]string{execRequest.Command}, execRequest.Arguments...), " ")
+	auditDetail(request, "command", commandLine)
+
+	if !execAllowed(execRequest) {
+		logger.Lgr.LogErrorf("AUDIT exec denied for %v: %v", requestIdentity(request), commandLine)
+		rh.writeResponseAndLog(fmt.Sprintf("Command is not in the exec allowlist: %v", execRequest.Command), http.StatusForbidden, writer, request)
+		return
+	}
+
+	logger.Lgr.LogMessagef("AUDIT exec started for %v: %v", requestIdentity(request), commandLine)
+
+	result := runAllowedCommand(request.Context(), execRequest)
+
+	logger.Lgr.LogMessagef("AUDIT exec finished for %v: %v exit code: %d timed out: %v duration: %dms stdout bytes: %d stderr bytes: %d error: %v",
+		requestIdentity(request), commandLine, result.ExitCode, result.TimedOut, result.DurationMillis, len(result.Stdout), len(result.Stderr), result.Error)
+
+	auditDetail(request, "exitCode", strconv.Itoa(result.ExitCode))
+
+	jsonBytes, jsonErr := json.Marshal(result)
+	if jsonErr != nil {
+		rh.writeResponseAndLog(jsonErr.Error(), http.StatusInternalServerError, writer, request)
+		return
+	}
+
+	rh.writeBodyAndLog("", http.StatusOK, "application/json", jsonBytes, writer, request)
+}
+
+// execAllowed returns true if the given request matches an entry in the exec
+// allowlist. Each entry is the command followed by exactly the arguments it
+// allows, compared one by one. An entry ending in config.EXEC_ANY_ARGUMENTS
+// allows any further arguments after the ones before it.
+func execAllowed(execRequest ExecRequest) bool {
+
+	argv := append([]string{execRequest.Command}, execRequest.Arguments...)
+
+	for _, allowed := range config.Cfg.ExecAllowlist {
+		if argvMatches(allowed, argv) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// argvMatches returns true if the given command line is the allowed one, or
+// starts with it when the allowed one ends in config.EXEC_ANY_ARGUMENTS.
+func argvMatches(allowed []string, argv []string) bool {
+
+	if len(allowed) > 0 && allowed[len(allowed)-1] == config.EXEC_ANY_ARGUMENTS {
+		allowed = allowed[:len(allowed)-1]
+		if len(argv) < len(allowed) {
+			return false
+		}
+		argv = argv[:len(allowed)]
+	}
+
+	if len(allowed) == 0 || len(allowed) != len(argv) {
+		return false
+	}
+
+	for index := range allowed {
+		if allowed[index] != argv[index] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// runAllowedCommand will run the command of the given request until it exits
+// or ExecTimeoutSeconds elapses, capturing at most ExecMaxOutputBytes of both
+// stdout and stderr.
+func runAllowedCommand(parent context.Context, execRequest ExecRequest) ExecResult {
+
+	ctx, cancel := context.WithTimeout(parent, time.Duration(config.Cfg.ExecTimeoutSeconds)*time.Second)
+	defer cancel()
+
+	stdout := &cappedBuffer{limit: config.Cfg.ExecMaxOutputBytes}
+	stderr := &cappedBuffer{limit: config.Cfg.ExecMaxOutputBytes}
+
+	cmd := exec.CommandContext(ctx, execRequest.Command, execRequest.Arguments...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	start := time.Now()
+	runErr := cmd.Run()
+
+	result := ExecResult{
+		Stdout:          stdout.buffer.String(),
+		Stderr:          stderr.buffer.String(),
+		ExitCode:        0,
+		TimedOut:        ctx.Err() == context.DeadlineExceeded,
+		OutputTruncated: stdout.truncated || stderr.truncated,
+		DurationMillis:  int64(time.Since(start) / time.Millisecond),
+	}
+
+	if runErr != nil {
+		result.Error = runErr.Error()
+		result.ExitCode = EXEC_FAILED_EXIT_CODE
+		var exitErr *exec.ExitError
+		if errors.As(runErr, &exitErr) && !result.TimedOut {
+			result.ExitCode = exitErr.ExitCode()
+		}
+	}
+
+	return result
+}
+
+// requestIdentity describes who sent the given request for the audit log: the
+// remote address and the subject of the client certificate, if one was given.
+func requestIdentity(request *http.Request) string {
+	if request.TLS != nil && len(request.TLS.PeerCertificates) > 0 {
+		return fmt.Sprintf("%v (%v)", remoteHost(request), request.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+	return remoteHost(request)
+}
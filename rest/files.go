@@ -0,0 +1,262 @@
+package rest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The REST path name which calls the files handler
+const FILES_REST_PATH = "files"
+
+// The URL query parameter holding the path of the file to transfer
+const FILE_PATH_QUERY = "path"
+
+// The header holding the hex SHA-256 checksum of a whole file
+const CHECKSUM_HEADER = "X-Checksum-Sha256"
+
+// The header holding the number of bytes of an upload received so far
+const UPLOAD_OFFSET_HEADER = "X-Upload-Offset"
+
+// The extension of files which are still being uploaded
+const PARTIAL_EXTENSION = ".partial"
+
+// filesHandler will handle receiving and verifying file transfer requests via
+// REST. Only files inside one of the configured FileRoots can be transferred.
+// A GET downloads the file with its checksum in the X-Checksum-Sha256 header
+// and supports Range requests so interrupted downloads can be resumed. A PUT
+// uploads the file. Uploads can be split across several PUTs with a
+// Content-Range header each; the data is held in a .partial file until the
+// last chunk arrives and a HEAD reports how much of it has been received in
+// the X-Upload-Offset header. If the X-Checksum-Sha256 header is sent with the
+// last chunk the complete file must match it.
+func (rh *RestHandler) filesHandler(writer http.ResponseWriter, request *http.Request) {
+
+	if !rh.verifyRequestTimeStamp("filesHandler", writer, request) {
+		return
+	}
+
+	filePath, pathErr := resolveFilePath(request.URL.Query().Get(FILE_PATH_QUERY))
+	if pathErr != nil {
+		rh.writeResponseAndLog(pathErr.Error(), http.StatusForbidden, writer, request)
+		return
+	}
+
+	logger.Lgr.LogMessagef("AUDIT files %v for %v: %v", request.Method, requestIdentity(request), filePath)
+
+	switch request.Method {
+	case "GET":
+		rh.serveFile(filePath, writer, request)
+	case "HEAD":
+		partialInfo, statErr := os.Stat(filePath + PARTIAL_EXTENSION)
+		if statErr == nil {
+			writer.Header().Set(UPLOAD_OFFSET_HEADER, strconv.FormatInt(partialInfo.Size(), 10))
+			rh.writeResponseAndLog("", http.StatusOK, writer, request)
+			return
+		}
+		rh.serveFile(filePath, writer, request)
+	case "PUT":
+		rh.receiveFile(filePath, writer, request)
+	default:
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for filesHandler", request.Method)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+	}
+
+	return
+}
+
+// serveFile will write the file at the given path along with its checksum.
+// Range requests are handled by http.ServeContent.
+func (rh *RestHandler) serveFile(filePath string, writer http.ResponseWriter, request *http.Request) {
+
+	file, openErr := os.Open(filePath)
+	if openErr != nil {
+		rh.writeResponseAndLog(openErr.Error(), http.StatusNotFound, writer, request)
+		return
+	}
+	defer file.Close()
+
+	fileInfo, statErr := file.Stat()
+	if statErr != nil || fileInfo.IsDir() {
+		rh.writeResponseAndLog(fmt.Sprintf("Not a regular file: %v", filePath), http.StatusNotFound, writer, request)
+		return
+	}
+
+	if fileInfo.Size() > int64(config.Cfg.FileMaxBytes) {
+		rh.writeResponseAndLog(fmt.Sprintf("File is larger than the %v limit: %v", config.Cfg.FileMaxBytes, filePath), http.StatusForbidden, writer, request)
+		return
+	}
+
+	checksum, checksumErr := fileChecksum(filePath)
+	if checksumErr != nil {
+		rh.writeResponseAndLog(checksumErr.Error(), http.StatusInternalServerError, writer, request)
+		return
+	}
+
+	writer.Header().Set(CHECKSUM_HEADER, checksum)
+	writer.Header().Set("ETag", `"`+checksum+`"`)
+	http.ServeContent(writer, request, fileInfo.Name(), fileInfo.ModTime(), file)
+
+	logger.Lgr.LogMessagef("Successfully served file: %v", filePath)
+}
+
+// receiveFile will write the body of the request into the .partial file for
+// the given path at the offset given by its Content-Range header, if any. Once
+// the whole file has been received its checksum is verified and it's moved
+// into place.
+func (rh *RestHandler) receiveFile(filePath string, writer http.ResponseWriter, request *http.Request) {
+
+	start, length, total, rangeErr := parseContentRange(request.Header.Get("Content-Range"), request.ContentLength)
+	if rangeErr != nil {
+		rh.writeResponseAndLog(rangeErr.Error(), http.StatusBadRequest, writer, request)
+		return
+	}
+
+	if total > int64(config.Cfg.FileMaxBytes) {
+		rh.writeResponseAndLog(fmt.Sprintf("File is larger than the %v limit", config.Cfg.FileMaxBytes), http.StatusRequestEntityTooLarge, writer, request)
+		return
+	}
+
+	partialPath := filePath + PARTIAL_EXTENSION
+
+	var received int64
+	if partialInfo, statErr := os.Stat(partialPath); statErr == nil {
+		received = partialInfo.Size()
+	}
+
+	// a fresh upload always starts over
+	if start == 0 {
+		received = 0
+	}
+
+	if start != received {
+		writer.Header().Set(UPLOAD_OFFSET_HEADER, strconv.FormatInt(received, 10))
+		rh.writeResponseAndLog(fmt.Sprintf("Upload chunk starts at %d but %d bytes have been received", start, received), http.StatusConflict, writer, request)
+		return
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if start == 0 {
+		flags |= os.O_TRUNC
+	}
+
+	partial, openErr := os.OpenFile(partialPath, flags, 0600)
+	if openErr != nil {
+		rh.writeResponseAndLog(openErr.Error(), http.StatusInternalServerError, writer, request)
+		return
+	}
+
+	written, copyErr := io.Copy(partial, io.LimitReader(request.Body, length))
+	partial.Close()
+
+	received = start + written
+	writer.Header().Set(UPLOAD_OFFSET_HEADER, strconv.FormatInt(received, 10))
+
+	if copyErr != nil {
+		rh.writeResponseAndLog(copyErr.Error(), http.StatusInternalServerError, writer, request)
+		return
+	}
+
+	if received < total {
+		logger.Lgr.LogMessagef("Successfully received %d of %d bytes for file: %v", received, total, filePath)
+		rh.writeResponseAndLog("", http.StatusAccepted, writer, request)
+		return
+	}
+
+	checksum, checksumErr := fileChecksum(partialPath)
+	if checksumErr != nil {
+		rh.writeResponseAndLog(checksumErr.Error(), http.StatusInternalServerError, writer, request)
+		return
+	}
+
+	if expected := request.Header.Get(CHECKSUM_HEADER); expected != "" && !strings.EqualFold(expected, checksum) {
+		os.Remove(partialPath)
+		rh.writeResponseAndLog(fmt.Sprintf("Checksum mismatch for %v. expected: %v got: %v", filePath, expected, checksum), http.StatusBadRequest, writer, request)
+		return
+	}
+
+	if renameErr := os.Rename(partialPath, filePath); renameErr != nil {
+		rh.writeResponseAndLog(renameErr.Error(), http.StatusInternalServerError, writer, request)
+		return
+	}
+
+	logger.Lgr.LogMessagef("Successfully received file: %v with checksum: %v", filePath, checksum)
+
+	writer.Header().Set(CHECKSUM_HEADER, checksum)
+	rh.writeResponseAndLog("", http.StatusCreated, writer, request)
+}
+
+// resolveFilePath will return the absolute, resolved version of the given
+// path if it lies inside one of the configured FileRoots, trying them in
+// order. A relative path is taken relative to the root. See
+// utils.ResolveWithin for how symbolic links are kept from escaping a root.
+func resolveFilePath(requested string) (string, error) {
+
+	if len(config.Cfg.FileRoots) == 0 {
+		return "", errors.New("File transfers are disabled. Set FileRoots in the config to enable them.")
+	}
+
+	if requested == "" {
+		return "", errors.New("No file path given")
+	}
+
+	for _, root := range config.Cfg.FileRoots {
+		if resolvedPath, resolveErr := utils.ResolveWithin(root, requested); resolveErr == nil {
+			return resolvedPath, nil
+		}
+	}
+
+	return "", fmt.Errorf("Path is outside of the configured file roots: %v", requested)
+}
+
+// parseContentRange will return the offset of the first byte of the chunk, the
+// length of the chunk and the total size of the file from a Content-Range
+// header of the form "bytes start-end/total". Without the header the body is
+// the whole file.
+func parseContentRange(contentRange string, contentLength int64) (int64, int64, int64, error) {
+
+	if contentRange == "" {
+		if contentLength < 0 {
+			return 0, 0, 0, errors.New("A Content-Length or Content-Range header is required")
+		}
+		return 0, contentLength, contentLength, nil
+	}
+
+	var start, end, total int64
+	if _, scanErr := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &start, &end, &total); scanErr != nil {
+		return 0, 0, 0, fmt.Errorf("Malformed Content-Range header: %v", contentRange)
+	}
+
+	if start < 0 || end < start || end >= total {
+		return 0, 0, 0, fmt.Errorf("Invalid Content-Range header: %v", contentRange)
+	}
+
+	return start, end - start + 1, total, nil
+}
+
+// fileChecksum returns the hex SHA-256 checksum of the file at the given path.
+func fileChecksum(filePath string) (string, error) {
+
+	file, openErr := os.Open(filePath)
+	if openErr != nil {
+		return "", openErr
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, copyErr := io.Copy(hasher, file); copyErr != nil {
+		return "", copyErr
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,182 @@
+package rest
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/facebookgo/freeport"
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The lowest port the REST server listens on when RestListenAddress isn't set
+const MACHINE_BASE_PORT = 20000
+
+// How many ports from MACHINE_BASE_PORT each machine picks its own from
+const MACHINE_PORT_SPAN = 10000
+
+// The networks allowed to connect when RestAllowedCIDRs is empty: loopback
+// and the private IPv4 and IPv6 ranges, so an agent isn't reachable from the
+// open internet until it's told to be, e.g. with 0.0.0.0/0
+var DEFAULT_ALLOWED_CIDRS = []string{"127.0.0.0/8", "::1/128", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}
+
+// allowlistListener only accepts connections from the given networks. Every
+// other connection is closed as soon as it's accepted, before the TLS
+// handshake and long before any authentication.
+type allowlistListener struct {
+	net.Listener
+	networks []*net.IPNet
+}
+
+// Accept waits for and returns the next connection from an allowed network.
+func (al *allowlistListener) Accept() (net.Conn, error) {
+	for {
+		conn, acceptErr := al.Listener.Accept()
+		if acceptErr != nil {
+			return nil, acceptErr
+		}
+
+		if addressAllowed(conn.RemoteAddr(), al.networks) {
+			return conn, nil
+		}
+
+		logger.Lgr.LogMessagef("Rejected REST connection from address outside of RestAllowedCIDRs: %v", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// addressAllowed returns true if the given address lies in one of the given
+// networks.
+func addressAllowed(address net.Addr, networks []*net.IPNet) bool {
+
+	host, _, splitErr := net.SplitHostPort(address.String())
+	if splitErr != nil {
+		host = address.String()
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowedNetworks parses RestAllowedCIDRs, or DEFAULT_ALLOWED_CIDRS when it's
+// empty. Plain IP addresses are allowed as single host networks.
+func allowedNetworks() ([]*net.IPNet, error) {
+
+	var networks []*net.IPNet
+
+	for _, cidr := range allowedCIDRs() {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid address in RestAllowedCIDRs: %v", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, parseErr := net.ParseCIDR(cidr)
+		if parseErr != nil {
+			return nil, fmt.Errorf("Invalid CIDR in RestAllowedCIDRs: %v", cidr)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// allowedCIDRs returns RestAllowedCIDRs, or DEFAULT_ALLOWED_CIDRS when it's
+// empty.
+func allowedCIDRs() []string {
+
+	if len(config.Cfg.RestAllowedCIDRs) == 0 {
+		return DEFAULT_ALLOWED_CIDRS
+	}
+
+	return config.Cfg.RestAllowedCIDRs
+}
+
+// listenAddress returns the host:port the REST server should listen on. The
+// port comes from RestListenAddress or is derived from the machine, so it
+// stays the same across restarts, falling back to a random free port when
+// that one is taken. When a RestListenInterface is configured the host is the
+// first address of that interface so the server is only reachable through it,
+// e.g. lo or wg0.
+func listenAddress() (string, error) {
+
+	address := config.Cfg.RestListenAddress
+	if address == "" {
+		port := MACHINE_BASE_PORT + config.MachineOffset(MACHINE_PORT_SPAN)
+		if utils.PortFree(":"+strconv.Itoa(port)) != nil {
+			freePort, err := freeport.Get()
+			if err != nil {
+				return "", err
+			}
+			port = freePort
+		}
+		address = ":" + strconv.Itoa(port)
+	}
+
+	if config.Cfg.RestListenInterface == "" {
+		return address, nil
+	}
+
+	_, port, splitErr := net.SplitHostPort(address)
+	if splitErr != nil {
+		return "", splitErr
+	}
+
+	iface, ifaceErr := net.InterfaceByName(config.Cfg.RestListenInterface)
+	if ifaceErr != nil {
+		return "", fmt.Errorf("Could not find RestListenInterface %v: %v", config.Cfg.RestListenInterface, ifaceErr)
+	}
+
+	addresses, addrErr := iface.Addrs()
+	if addrErr != nil {
+		return "", addrErr
+	}
+
+	for _, ifaceAddress := range addresses {
+		if ipNet, isIPNet := ifaceAddress.(*net.IPNet); isIPNet {
+			logger.Lgr.LogMessagef("Successfully resolved RestListenInterface %v to %v", iface.Name, ipNet.IP)
+			return net.JoinHostPort(ipNet.IP.String(), port), nil
+		}
+	}
+
+	return "", fmt.Errorf("RestListenInterface %v has no addresses", config.Cfg.RestListenInterface)
+}
+
+// listen will start listening on the given address and restrict the listener
+// to RestAllowedCIDRs, or to DEFAULT_ALLOWED_CIDRS when none are configured.
+func listen(address string) (net.Listener, error) {
+
+	networks, networksErr := allowedNetworks()
+	if networksErr != nil {
+		return nil, networksErr
+	}
+
+	listener, listenErr := net.Listen("tcp", address)
+	if listenErr != nil {
+		return nil, listenErr
+	}
+
+	logger.Lgr.LogMessagef("Successfully restricted the REST listener to: %v", strings.Join(allowedCIDRs(), ", "))
+	return &allowlistListener{Listener: listener, networks: networks}, nil
+}
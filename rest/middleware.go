@@ -0,0 +1,288 @@
+package rest
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+// The prefix of every access log line so they're easy to pick out of the log
+const ACCESS_LOG_PREFIX = "ACCESS "
+
+// The LogSampling category access log lines are logged under
+const ACCESS_LOG_CATEGORY = "rest_access"
+
+// How long a client's rate limit bucket can sit full and unused before it's forgotten
+const RATE_BUCKET_IDLE_SECONDS = 600
+
+// The headers browsers are allowed to send and read on cross origin requests
+const CORS_ALLOWED_HEADERS = "Authorization, Content-Type, Content-Range, X-Correlation-Id, X-Checksum-Sha256, X-Approval-Token"
+const CORS_EXPOSED_HEADERS = "Location, X-Correlation-Id, X-Checksum-Sha256, X-Upload-Offset"
+const CORS_ALLOWED_METHODS = "GET, HEAD, POST, PUT, DELETE, OPTIONS"
+
+// AccessLogEntry is the structured record written to the log for every request
+// handled by the REST server.
+type AccessLogEntry struct {
+	Time           time.Time `json:"time"`
+	CorrelationId  string    `json:"correlationId"`
+	Remote         string    `json:"remote"`
+	Method         string    `json:"method"`
+	Path           string    `json:"path"`
+	Status         int       `json:"status"`
+	Bytes          int64     `json:"bytes"`
+	DurationMillis int64     `json:"durationMillis"`
+	UserAgent      string    `json:"userAgent"`
+}
+
+// tokenBucket holds the rate limiting state of a single client address.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+var buckets = make(map[string]*tokenBucket)
+var bucketsLock sync.Mutex
+
+// chain wraps the given router in every middleware used by the REST server. A
+// request passes through them in order: correlation, access logging, CORS,
+// rate limiting, compression, authentication, and finally the audit trail.
+func (rh *RestHandler) chain(router http.Handler) http.Handler {
+	return rh.correlate(rh.accessLog(rh.cors(rh.rateLimit(rh.compress(rh.authenticate(rh.auditTrail(router)))))))
+}
+
+// statusRecorder remembers the status code and number of bytes written for
+// a response so they can be included in the access log.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// WriteHeader records the status code before writing it.
+func (sr *statusRecorder) WriteHeader(httpStatusCode int) {
+	if sr.status == 0 {
+		sr.status = httpStatusCode
+	}
+	sr.ResponseWriter.WriteHeader(httpStatusCode)
+}
+
+// Write records the number of bytes written.
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	written, writeErr := sr.ResponseWriter.Write(p)
+	sr.bytes += int64(written)
+	return written, writeErr
+}
+
+// Flush satisfies http.Flusher so streaming handlers keep working.
+func (sr *statusRecorder) Flush() {
+	if flusher, canFlush := sr.ResponseWriter.(http.Flusher); canFlush {
+		flusher.Flush()
+	}
+}
+
+// accessLog wraps the given handler so a structured AccessLogEntry is logged
+// as JSON once every request has been handled, sampled by the LogSampling of
+// ACCESS_LOG_CATEGORY.
+func (rh *RestHandler) accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: writer}
+
+		next.ServeHTTP(recorder, request)
+
+		entry := AccessLogEntry{
+			Time:           start,
+			CorrelationId:  correlationId(writer, request),
+			Remote:         remoteHost(request),
+			Method:         request.Method,
+			Path:           request.URL.Path,
+			Status:         recorder.status,
+			Bytes:          recorder.bytes,
+			DurationMillis: int64(time.Since(start) / time.Millisecond),
+			UserAgent:      request.UserAgent(),
+		}
+
+		jsonBytes, jsonErr := json.Marshal(entry)
+		if jsonErr != nil {
+			logger.Lgr.LogErrorf("Could not marshal access log entry: %v", jsonErr)
+			return
+		}
+
+		logger.Lgr.LogSampledf(ACCESS_LOG_CATEGORY, "%s%s", ACCESS_LOG_PREFIX, jsonBytes)
+	})
+}
+
+// cors wraps the given handler so browsers on one of the RestCORSOrigins can
+// call the REST server. Preflight requests are answered directly since they
+// never carry credentials.
+func (rh *RestHandler) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+
+		origin := request.Header.Get("Origin")
+		if origin == "" || !corsAllowed(origin) {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		writer.Header().Add("Vary", "Origin")
+		writer.Header().Set("Access-Control-Allow-Origin", origin)
+		writer.Header().Set("Access-Control-Expose-Headers", CORS_EXPOSED_HEADERS)
+
+		if request.Method == "OPTIONS" && request.Header.Get("Access-Control-Request-Method") != "" {
+			writer.Header().Set("Access-Control-Allow-Methods", CORS_ALLOWED_METHODS)
+			writer.Header().Set("Access-Control-Allow-Headers", CORS_ALLOWED_HEADERS)
+			writer.Header().Set("Access-Control-Max-Age", "600")
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// corsAllowed returns true if the given origin is in RestCORSOrigins or if
+// every origin is allowed with "*".
+func corsAllowed(origin string) bool {
+	for _, allowed := range config.Cfg.RestCORSOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimit wraps the given handler so each client address can make at most
+// RestRateLimitBurst requests at once, refilled at RestRateLimitPerSecond.
+// Requests over the limit get http.StatusTooManyRequests.
+func (rh *RestHandler) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+
+		if retryAfter, allowed := takeToken(remoteHost(request), time.Now()); !allowed {
+			writer.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			rh.writeResponseAndLog("Rate limit exceeded for: "+remoteHost(request), http.StatusTooManyRequests, writer, request)
+			return
+		}
+
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// takeToken will take one token from the bucket of the given client address.
+// Returns whether one was available and, if not, how many seconds until one
+// will be.
+func takeToken(remote string, now time.Time) (int, bool) {
+
+	bucketsLock.Lock()
+	defer bucketsLock.Unlock()
+
+	rate := config.Cfg.RestRateLimitPerSecond
+	burst := float64(config.Cfg.RestRateLimitBurst)
+
+	for address, bucket := range buckets {
+		if now.Sub(bucket.updated) > RATE_BUCKET_IDLE_SECONDS*time.Second {
+			delete(buckets, address)
+		}
+	}
+
+	bucket, exists := buckets[remote]
+	if !exists {
+		bucket = &tokenBucket{tokens: burst, updated: now}
+		buckets[remote] = bucket
+	}
+
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*rate)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		return int(math.Ceil((1 - bucket.tokens) / rate)), false
+	}
+
+	bucket.tokens--
+	return 0, true
+}
+
+// The content type of responses which are already gzip compressed
+const GZIP_CONTENT_TYPE = "application/gzip"
+
+// gzipResponseWriter compresses everything written to it once the status code
+// has been written.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+// WriteHeader will switch the response to gzip encoding unless it has no body
+// or is already encoded or compressed.
+func (gw *gzipResponseWriter) WriteHeader(httpStatusCode int) {
+	if gw.wroteHeader {
+		return
+	}
+	gw.wroteHeader = true
+
+	header := gw.ResponseWriter.Header()
+	if httpStatusCode != http.StatusNoContent && httpStatusCode != http.StatusNotModified && header.Get("Content-Encoding") == "" && header.Get("Content-Type") != GZIP_CONTENT_TYPE {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		gw.gz = gzip.NewWriter(gw.ResponseWriter)
+	}
+
+	gw.ResponseWriter.WriteHeader(httpStatusCode)
+}
+
+// Write compresses the given bytes if the response is gzip encoded.
+func (gw *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+	if gw.gz == nil {
+		return gw.ResponseWriter.Write(p)
+	}
+	return gw.gz.Write(p)
+}
+
+// Flush satisfies http.Flusher by flushing the compressed stream first.
+func (gw *gzipResponseWriter) Flush() {
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	if flusher, canFlush := gw.ResponseWriter.(http.Flusher); canFlush {
+		flusher.Flush()
+	}
+}
+
+// compress wraps the given handler so responses are gzip compressed for
+// clients which accept it. Range and HEAD requests are left alone so resumed
+// downloads get the exact bytes they asked for.
+func (rh *RestHandler) compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+
+		writer.Header().Add("Vary", "Accept-Encoding")
+
+		if !strings.Contains(request.Header.Get("Accept-Encoding"), "gzip") || request.Header.Get("Range") != "" || request.Method == "HEAD" {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		gzipWriter := &gzipResponseWriter{ResponseWriter: writer}
+		defer func() {
+			if gzipWriter.gz != nil {
+				gzipWriter.gz.Close()
+			}
+		}()
+
+		next.ServeHTTP(gzipWriter, request)
+	})
+}
@@ -0,0 +1,216 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+// The REST path name which serves the OpenAPI specification
+const SPEC_REST_PATH = "api/spec"
+
+// The version of the OpenAPI specification format which is served
+const OPENAPI_VERSION = "3.0.3"
+
+// The name of the bearer token security scheme in the specification
+const BEARER_SECURITY_SCHEME = "bearerAuth"
+
+// OpenAPIDocument is an OpenAPI 3 document describing every REST endpoint.
+// Only the parts of the format this agent needs are modelled.
+type OpenAPIDocument struct {
+	OpenAPI    string                                 `json:"openapi"`
+	Info       OpenAPIInfo                            `json:"info"`
+	Paths      map[string]map[string]OpenAPIOperation `json:"paths"`
+	Components OpenAPIComponents                      `json:"components"`
+	Security   []map[string][]string                  `json:"security"`
+}
+
+// OpenAPIInfo describes the API as a whole.
+type OpenAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// OpenAPIOperation describes a single method of a single path.
+type OpenAPIOperation struct {
+	OperationId  string                     `json:"operationId"`
+	Summary      string                     `json:"summary"`
+	Parameters   []OpenAPIParameter         `json:"parameters,omitempty"`
+	RequestBody  *OpenAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses    map[string]OpenAPIResponse `json:"responses"`
+	RequiredRole string                     `json:"x-required-role"`
+}
+
+// OpenAPIParameter describes a path or query parameter.
+type OpenAPIParameter struct {
+	Name        string            `json:"name"`
+	In          string            `json:"in"`
+	Description string            `json:"description,omitempty"`
+	Required    bool              `json:"required"`
+	Schema      map[string]string `json:"schema"`
+}
+
+// OpenAPIRequestBody describes the body an operation accepts.
+type OpenAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]OpenAPIMediaType `json:"content"`
+}
+
+// OpenAPIResponse describes a single response of an operation.
+type OpenAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]OpenAPIMediaType `json:"content,omitempty"`
+}
+
+// OpenAPIMediaType holds the schema of a request or response body.
+type OpenAPIMediaType struct {
+	Schema map[string]interface{} `json:"schema"`
+}
+
+// OpenAPIComponents holds the schemas and security schemes referenced from
+// the rest of the document.
+type OpenAPIComponents struct {
+	Schemas         map[string]interface{}       `json:"schemas"`
+	SecuritySchemes map[string]map[string]string `json:"securitySchemes"`
+}
+
+// OpenAPISpec will build the OpenAPI document describing every route
+// registered with this handler. Paths are listed under API_V1_PREFIX which is
+// the stable contract for client tooling.
+func (rh *RestHandler) OpenAPISpec() OpenAPIDocument {
+
+	document := OpenAPIDocument{
+		OpenAPI: OPENAPI_VERSION,
+		Info: OpenAPIInfo{
+			Title:       "anon-eth-net agent",
+			Version:     strconv.FormatUint(config.Cfg.LocalVersion, 10),
+			Description: "Remote management of a single anon-eth-net agent.",
+		},
+		Paths: make(map[string]map[string]OpenAPIOperation),
+		Components: OpenAPIComponents{
+			Schemas: map[string]interface{}{
+				"Error": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"code":          map[string]string{"type": "string"},
+						"message":       map[string]string{"type": "string"},
+						"correlationId": map[string]string{"type": "string"},
+					},
+				},
+			},
+			SecuritySchemes: map[string]map[string]string{
+				BEARER_SECURITY_SCHEME: {"type": "http", "scheme": "bearer"},
+			},
+		},
+		Security: []map[string][]string{{BEARER_SECURITY_SCHEME: {}}},
+	}
+
+	for _, route := range rh.routes {
+		path := rh.Endpoints[route.Name]
+		if !route.Unversioned {
+			path = API_V1_PREFIX + path
+		}
+
+		operations := make(map[string]OpenAPIOperation)
+		for _, method := range route.Methods {
+			operations[strings.ToLower(method.Method)] = openAPIOperation(route, method)
+		}
+		document.Paths[path] = operations
+	}
+
+	return document
+}
+
+// openAPIOperation will describe the given method of the given route.
+func openAPIOperation(route Route, method RouteMethod) OpenAPIOperation {
+
+	operation := OpenAPIOperation{
+		OperationId:  strings.ToLower(method.Method) + "_" + strings.Replace(route.Name, "/", "_", -1),
+		Summary:      method.Summary,
+		RequiredRole: requiredRole(route.Name, method.Method),
+	}
+
+	for _, param := range route.Params {
+		operation.Parameters = append(operation.Parameters, OpenAPIParameter{
+			Name:        param,
+			In:          "path",
+			Description: pathParameters[param],
+			Required:    true,
+			Schema:      map[string]string{"type": "string"},
+		})
+	}
+
+	for _, query := range route.Query {
+		operation.Parameters = append(operation.Parameters, OpenAPIParameter{
+			Name:        query.Name,
+			In:          "query",
+			Description: query.Description,
+			Schema:      map[string]string{"type": "string"},
+		})
+	}
+
+	if method.RequestType != "" {
+		operation.RequestBody = &OpenAPIRequestBody{
+			Required: true,
+			Content:  map[string]OpenAPIMediaType{method.RequestType: {Schema: bodySchema(method.RequestType)}},
+		}
+	}
+
+	status := method.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	success := OpenAPIResponse{Description: http.StatusText(status)}
+	if method.ResponseType != "" {
+		success.Content = map[string]OpenAPIMediaType{method.ResponseType: {Schema: bodySchema(method.ResponseType)}}
+	}
+
+	operation.Responses = map[string]OpenAPIResponse{
+		strconv.Itoa(status): success,
+		"default": {
+			Description: "Error",
+			Content:     map[string]OpenAPIMediaType{"application/json": {Schema: map[string]interface{}{"$ref": "#/components/schemas/Error"}}},
+		},
+	}
+
+	return operation
+}
+
+// bodySchema returns the schema of a body with the given content type.
+func bodySchema(contentType string) map[string]interface{} {
+	switch contentType {
+	case "application/json":
+		return map[string]interface{}{"type": "object"}
+	case "application/octet-stream", GZIP_CONTENT_TYPE:
+		return map[string]interface{}{"type": "string", "format": "binary"}
+	default:
+		return map[string]interface{}{"type": "string"}
+	}
+}
+
+// specHandler will serve the OpenAPI specification of every REST endpoint so
+// clients can be generated from it and external tooling can stay in sync
+// with the handlers this agent actually has.
+func (rh *RestHandler) specHandler(writer http.ResponseWriter, request *http.Request) {
+
+	switch request.Method {
+	case "GET":
+		jsonBytes, jsonErr := json.MarshalIndent(rh.OpenAPISpec(), "", "  ")
+		if jsonErr != nil {
+			rh.writeResponseAndLog(jsonErr.Error(), http.StatusInternalServerError, writer, request)
+			return
+		}
+		rh.writeBodyAndLog("", http.StatusOK, "application/json", jsonBytes, writer, request)
+	default:
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for specHandler", request.Method)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+	}
+
+	return
+}
@@ -0,0 +1,103 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/seantcanavan/anon-eth-net/diagnostics"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/operations"
+	"github.com/seantcanavan/anon-eth-net/updater"
+)
+
+// The REST path name which calls the operations handler
+const OPERATIONS_REST_PATH = "operations"
+
+// The key to the query parameter for the id of an asynchronous operation
+const OPERATION_ID = "operationid"
+
+// The kind of operation started by the update apply handler
+const UPDATE_APPLY_OPERATION = "update-apply"
+
+// The kind of operation started by the update fetch handler
+const UPDATE_FETCH_OPERATION = "update-fetch"
+
+// The kind of operation started by the diagnostics handler to email a bundle
+const DIAGNOSTICS_EMAIL_OPERATION = "diagnostics-email"
+
+// registerOperations will register every kind of asynchronous operation which
+// can be started via REST.
+func (rh *RestHandler) registerOperations() {
+	operations.RegisterKind(UPDATE_APPLY_OPERATION, func(progress operations.Progress) (string, error) {
+		progress(0, "checking for a newer remote version")
+		return updater.UpdateNow()
+	})
+	operations.RegisterKind(UPDATE_FETCH_OPERATION, func(progress operations.Progress) (string, error) {
+		progress(0, "downloading the components of a newer remote version")
+		return updater.FetchUpdate()
+	})
+	operations.RegisterKind(DIAGNOSTICS_EMAIL_OPERATION, func(progress operations.Progress) (string, error) {
+		progress(0, "assembling the diagnostics bundle")
+		return diagnostics.EmailBundle(rh.MainLoader)
+	})
+}
+
+// operationsHandler will handle receiving and verifying operation status
+// requests via REST. A GET returns the progress and result of the operation
+// with the given id as JSON.
+func (rh *RestHandler) operationsHandler(writer http.ResponseWriter, request *http.Request) {
+
+	if !rh.verifyRequestTimeStamp("operationsHandler", writer, request) {
+		return
+	}
+
+	operationId := mux.Vars(request)[OPERATION_ID]
+
+	if err := rh.verifyQueryParams(operationId); err != nil {
+		rh.writeResponseAndLog(err.Error(), http.StatusBadRequest, writer, request)
+		return
+	}
+
+	switch request.Method {
+	case "GET":
+		operation, exists := operations.Get(operationId)
+		if !exists {
+			rh.writeResponseAndLog("No operation with id: "+operationId, http.StatusNotFound, writer, request)
+			return
+		}
+		rh.writeOperation(operation, http.StatusOK, writer, request)
+	default:
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for operationsHandler", request.Method)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+	}
+
+	return
+}
+
+// startOperation will start an asynchronous operation of the given kind and
+// respond with http.StatusAccepted and the new operation. Its id can be used
+// to follow it via the operations handler.
+func (rh *RestHandler) startOperation(kind string, writer http.ResponseWriter, request *http.Request) {
+
+	operation, startErr := operations.Start(kind)
+	if startErr != nil {
+		rh.writeResponseAndLog(startErr.Error(), http.StatusInternalServerError, writer, request)
+		return
+	}
+
+	writer.Header().Set("Location", API_V1_PREFIX+"/"+OPERATIONS_REST_PATH+"/"+mux.Vars(request)[TIMESTAMP]+"/"+operation.ID)
+	rh.writeOperation(operation, http.StatusAccepted, writer, request)
+}
+
+// writeOperation will write the given operation as JSON with the given status.
+func (rh *RestHandler) writeOperation(operation operations.Operation, httpStatusCode int, writer http.ResponseWriter, request *http.Request) {
+
+	jsonBytes, jsonErr := json.Marshal(operation)
+	if jsonErr != nil {
+		rh.writeResponseAndLog(jsonErr.Error(), http.StatusInternalServerError, writer, request)
+		return
+	}
+
+	rh.writeBodyAndLog("", httpStatusCode, "application/json", jsonBytes, writer, request)
+}
@@ -2,23 +2,32 @@ package rest
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/facebookgo/freeport"
 	"github.com/gorilla/mux"
+	"github.com/seantcanavan/anon-eth-net/buildinfo"
 	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/lifecycle"
 	"github.com/seantcanavan/anon-eth-net/loader"
 	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/network"
 	"github.com/seantcanavan/anon-eth-net/profiler"
 	"github.com/seantcanavan/anon-eth-net/reporter"
+	"github.com/seantcanavan/anon-eth-net/transport"
+	"github.com/seantcanavan/anon-eth-net/updater"
 	"github.com/seantcanavan/anon-eth-net/utils"
 )
 
@@ -38,15 +47,27 @@ const FILE_TYPE = "filetype"
 // The key to the query parameter for the asset file name to perform CRUD operations on over REST
 const ASSET_NAME = "assetname"
 
+// The key to the query parameter for the id of a notification to acknowledge
+const NOTIFICATION_ID = "notificationid"
+
+// The key to the query parameter for the name of a job managed by the main loader
+const JOB_NAME = "jobname"
+
 // The subject of the email to send out after a successfully REST port has been negotiated
 const REST_EMAIL_SUBJECT = "REST Service Successfully Started"
 
+// How long the REST server has to accept connections once it's started. In seconds
+const REST_READY_TIMEOUT_SECONDS = 10
+
 // The REST path name which calls the execute handler
 const EXECUTE_REST_PATH = "execute"
 
 // The REST path name which calls the reboot handler
 const REBOOT_REST_PATH = "reboot"
 
+// The REST path name which calls the restart handler
+const RESTART_REST_PATH = "restart"
+
 // The REST path name which calls the log handler
 const LOG_REST_PATH = "logs"
 
@@ -59,6 +80,57 @@ const CHECKIN_REST_PATH = "checkin"
 // The REST path name which calls the asset handler
 const ASSET_REST_PATH = "asset"
 
+// The REST path name which calls the acknowledge handler
+const ACKNOWLEDGE_REST_PATH = "acknowledge"
+
+// The REST path name which calls the self test handler
+const SELFTEST_REST_PATH = "selftest"
+
+// The REST path name which calls the events handler
+const EVENTS_REST_PATH = "events"
+
+// The maximum number of recent events returned by the events handler
+const MAX_REST_EVENTS = 100
+
+// The REST path name which calls the health handler
+const HEALTH_REST_PATH = "health"
+
+// The REST path name which calls the version handler
+const VERSION_REST_PATH = "version"
+
+// The REST path name which calls the status handler
+const STATUS_REST_PATH = "status"
+
+// The REST path name which calls the update check handler
+const UPDATE_CHECK_REST_PATH = "update/check"
+
+// The REST path name which calls the update apply handler
+const UPDATE_APPLY_REST_PATH = "update/apply"
+
+// The REST path name which calls the update fetch handler
+const UPDATE_FETCH_REST_PATH = "update/fetch"
+
+// The REST path name which calls the jobs handler
+const JOBS_REST_PATH = "jobs"
+
+// The REST path name which calls the job restart handler
+const JOB_RESTART_REST_PATH = "jobs/restart"
+
+// The REST path name which calls the job stop handler
+const JOB_STOP_REST_PATH = "jobs/stop"
+
+// The REST path name which calls the job start handler
+const JOB_START_REST_PATH = "jobs/start"
+
+// The REST path name which calls the job validate handler
+const JOB_VALIDATE_REST_PATH = "jobs/validate"
+
+// The maximum size of the job definitions sent to the job validate handler in bytes
+const MAX_JOB_DEFINITIONS_BYTES = 65536
+
+// The REST path name which calls the metrics handler
+const METRICS_REST_PATH = "metrics"
+
 // The subject of the email to send out when the REST package is finished executing remote code via the loader package
 const REST_LOADER_SUBJECT = "Rest Execute Handler Results"
 
@@ -66,12 +138,15 @@ const REST_LOADER_SUBJECT = "Rest Execute Handler Results"
 // machine via REST calls. All calls right now require a timestamp that is
 // required to be within an acceptable delta to the running machine's timestamp.
 // This is designed to prevent replay attacks against the remote host.
-// Eventually encryption will be added to authenticate the remote user to
-// prevent remote code execution.
+// Requests can also be required to carry a bearer token and / or a client
+// certificate signed by a trusted CA to authenticate the remote user.
 type RestHandler struct {
-	rtr       *mux.Router
-	Port      string
-	Endpoints map[string]string
+	rtr        *mux.Router
+	Port       string
+	Endpoints  map[string]string
+	MainLoader *loader.Loader // the loader whose jobs can be controlled via REST. Set before starting the server.
+	routes     []Route        // every registered endpoint, in registration order
+	server     *http.Server   // the running server, once StartupRestServer has been called
 }
 
 // NewRestHandler will return a new RestHandler struct with all of the REST
@@ -81,24 +156,23 @@ func NewRestHandler() (*RestHandler, error) {
 	rh := RestHandler{}
 
 	rh.Endpoints = make(map[string]string)
-	rh.Endpoints[LOG_REST_PATH] = buildGorillaPath(LOG_REST_PATH, TIMESTAMP)
-	rh.Endpoints[REBOOT_REST_PATH] = buildGorillaPath(REBOOT_REST_PATH, TIMESTAMP, REBOOT_DELAY)
-	rh.Endpoints[UPDATE_REST_PATH] = buildGorillaPath(UPDATE_REST_PATH, TIMESTAMP)
-	rh.Endpoints[CHECKIN_REST_PATH] = buildGorillaPath(CHECKIN_REST_PATH, TIMESTAMP)
-	rh.Endpoints[EXECUTE_REST_PATH] = buildGorillaPath(EXECUTE_REST_PATH, TIMESTAMP, FILE_TYPE)
-	rh.Endpoints[ASSET_REST_PATH] = buildGorillaPath(ASSET_REST_PATH, TIMESTAMP, ASSET_NAME)
+	rh.rtr = mux.NewRouter()
 
-	logger.Lgr.LogMessage("Successfully generated REST endpoint map: %+v", rh.Endpoints)
+	for _, route := range rh.routeTable() {
+		rh.handle(route)
+	}
 
-	rh.rtr = mux.NewRouter()
-	rh.rtr.HandleFunc(rh.Endpoints[LOG_REST_PATH], rh.logHandler)
-	rh.rtr.HandleFunc(rh.Endpoints[REBOOT_REST_PATH], rh.rebootHandler)
-	rh.rtr.HandleFunc(rh.Endpoints[UPDATE_REST_PATH], rh.updateHandler)
-	rh.rtr.HandleFunc(rh.Endpoints[CHECKIN_REST_PATH], rh.checkinHandler)
-	rh.rtr.HandleFunc(rh.Endpoints[EXECUTE_REST_PATH], rh.executeHandler)
-	rh.rtr.HandleFunc(rh.Endpoints[ASSET_REST_PATH], rh.assetHandler)
+	logger.Lgr.LogMessagef("Successfully generated REST endpoint map: %+v", rh.Endpoints)
 
-	logger.Lgr.LogMessage("Successfully generated REST gorilla mux router: %+v", rh.rtr)
+	rh.rtr.HandleFunc("/", rh.dashboardHandler)
+	rh.rtr.HandleFunc("/"+DASHBOARD_REST_PATH, rh.dashboardHandler)
+	rh.rtr.NotFoundHandler = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		rh.writeResponseAndLog("No REST endpoint at: "+request.URL.Path, http.StatusNotFound, writer, request)
+	})
+
+	rh.registerOperations()
+
+	logger.Lgr.LogMessagef("Successfully generated REST gorilla mux router: %+v", rh.rtr)
 
 	logger.Lgr.LogMessage("Started up TLS REST server")
 	return &rh, nil
@@ -145,42 +219,64 @@ func buildRestPath(protocol, host, port, root string, arguments ...string) strin
 }
 
 // StartupRestServer will start up the local REST server where this remote
-// machine will listen for incoming commands on. A free port on this local
-// machine will be automatically detected and used. The randomly chosen
-// available port will be logged locally as well as reported via email.
+// machine will listen for incoming commands on. Unless RestListenAddress is
+// configured a port derived from this machine, or a free one when that's
+// taken, will be automatically detected and used. The chosen port will be
+// logged locally as well as reported via email. See configureCertificates for where the HTTPS
+// certificate comes from and listen for how connections are restricted.
 func (rh *RestHandler) StartupRestServer() error {
-	port, err := freeport.Get()
-	if err != nil {
-		return err
+	address, addressErr := listenAddress()
+	if addressErr != nil {
+		return addressErr
 	}
 
-	rh.Port = strconv.Itoa(port)
+	_, port, splitErr := net.SplitHostPort(address)
+	if splitErr != nil {
+		return splitErr
+	}
+
+	rh.Port = port
 
-	pKeyPath, pKeyPathErr := utils.AssetPath("server.pkey")
-	if pKeyPathErr != nil {
-		return pKeyPathErr
+	if tokenErr := ValidateTokens(); tokenErr != nil {
+		return tokenErr
 	}
 
-	logger.Lgr.LogMessage("Successfully located private key asset: %v", pKeyPath)
+	if authErr := authConfigured(); authErr != nil {
+		logger.Lgr.LogErrorf("REST requests can't be authenticated: %v", authErr)
+	}
 
-	certPath, certPathErr := utils.AssetPath("server.cert")
-	if certPathErr != nil {
-		return certPathErr
+	tlsConfig, tlsErr := serverTLSConfig()
+	if tlsErr != nil {
+		return tlsErr
 	}
 
-	logger.Lgr.LogMessage("Successfully located server cert asset: %v", certPath)
+	certErr := configureCertificates(tlsConfig)
+	if certErr != nil {
+		return certErr
+	}
 
-	go http.ListenAndServeTLS(":"+rh.Port, certPath, pKeyPath, rh.rtr)
+	listener, listenErr := listen(address)
+	if listenErr != nil {
+		return listenErr
+	}
 
-	logger.Lgr.LogMessage("REST server successfully started up on port %v", port)
+	rh.server = &http.Server{Addr: address, Handler: rh.chain(rh.rtr), TLSConfig: tlsConfig}
 
-	externalIp, extIpErr := utils.ExternalIPAddress()
+	go rh.server.ServeTLS(listener, "", "")
+
+	if readyErr := utils.WaitForPort(address, REST_READY_TIMEOUT_SECONDS*time.Second); readyErr != nil {
+		return readyErr
+	}
+
+	logger.Lgr.LogMessagef("REST server successfully started up on port %v", port)
+
+	externalIp, extIpErr := network.ResolvePublicIP()
 	if extIpErr != nil {
-		logger.Lgr.LogMessage("Failed to retrieve external IP address: %v", extIpErr)
-		return reporter.SendPlainEmail(REST_EMAIL_SUBJECT, []byte(strconv.Itoa(port)))
+		logger.Lgr.LogMessagef("Failed to retrieve external IP address: %v", extIpErr)
+		return reporter.Notify(reporter.INFO, REST_EMAIL_SUBJECT, []byte(rh.Port))
 	}
 
-	logger.Lgr.LogMessage("Successfully retrieved external IP: %v", externalIp)
+	logger.Lgr.LogMessagef("Successfully retrieved external IP: %v", externalIp)
 
 	var baseRestPath bytes.Buffer
 	baseRestPath.WriteString("https://")
@@ -192,21 +288,85 @@ func (rh *RestHandler) StartupRestServer() error {
 
 	for _, value := range rh.Endpoints {
 		emailBody.WriteString(baseRestPath.String())
+		emailBody.WriteString(API_V1_PREFIX)
 		emailBody.WriteString(value)
 		emailBody.WriteString("\n")
 	}
 
-	logger.Lgr.LogMessage("Sending out full REST path specs via email")
+	logger.Lgr.LogMessage("Sending out full REST path specs via the configured notifiers")
+
+	return reporter.Notify(reporter.INFO, REST_EMAIL_SUBJECT, emailBody.Bytes())
+}
+
+// Shutdown will stop the REST server from accepting new connections and wait
+// for the requests in flight to finish until the given context is done. Any
+// connections still open then, such as log streams, are closed.
+func (rh *RestHandler) Shutdown(ctx context.Context) error {
+
+	if rh.server == nil {
+		return nil
+	}
+
+	if shutdownErr := rh.server.Shutdown(ctx); shutdownErr != nil {
+		rh.server.Close()
+		return shutdownErr
+	}
 
-	return reporter.SendPlainEmail(REST_EMAIL_SUBJECT, emailBody.Bytes())
+	logger.Lgr.LogMessagef("Successfully shut down the REST server on port %v", rh.Port)
+	return nil
 }
 
 // writeResponseAndLog will write the appropriate HTTP status code to the writer
 // and also log an appropriate success or failure message to the logger in this
-// RestHandler instance.
+// RestHandler instance. Error status codes are followed by a structured JSON
+// APIError body carrying the error message and the correlation ID of the
+// request.
 func (rh *RestHandler) writeResponseAndLog(errorMessage string, httpStatusCode int, writer http.ResponseWriter, request *http.Request) {
+
+	if httpStatusCode < http.StatusBadRequest {
+		rh.writeStatusAndLog(errorMessage, httpStatusCode, writer, request)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	id := rh.writeStatusAndLog(errorMessage, httpStatusCode, writer, request)
+	writeAPIError(errorMessage, httpStatusCode, id, writer)
+}
+
+// errorStatus returns the HTTP status code which describes the given error: 422
+// for a config which isn't valid, 502 when a server the agent depends on
+// failed or served something unusable, 504 when it timed out, and 503 once
+// the monthly byte budget is used up. Any other error gets the given fallback.
+func errorStatus(err error, fallback int) int {
+
+	var invalidErr config.ErrConfigInvalid
+	var downloadErr transport.ErrDownloadFailed
+	var versionErr buildinfo.ErrVersionParse
+	var budgetErr transport.ErrBudgetExhausted
+	var netErr net.Error
+
+	switch {
+	case errors.As(err, &invalidErr):
+		return http.StatusUnprocessableEntity
+	case errors.As(err, &budgetErr):
+		return http.StatusServiceUnavailable
+	case errors.As(err, &downloadErr), errors.As(err, &versionErr):
+		return http.StatusBadGateway
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout
+	}
+	return fallback
+}
+
+// writeStatusAndLog will write the given HTTP status code to the writer and log
+// it along with the error message and correlation ID of the request, which is
+// returned.
+func (rh *RestHandler) writeStatusAndLog(errorMessage string, httpStatusCode int, writer http.ResponseWriter, request *http.Request) string {
 	var statusBuffer bytes.Buffer
 
+	id := correlationId(writer, request)
+	statusBuffer.WriteString("[" + id + "] ")
+
 	switch httpStatusCode {
 	case http.StatusUnauthorized:
 		statusBuffer.WriteString("http.StatusUnauthorized")
@@ -214,8 +374,32 @@ func (rh *RestHandler) writeResponseAndLog(errorMessage string, httpStatusCode i
 		statusBuffer.WriteString("http.StatusBadRequest")
 	case http.StatusOK:
 		statusBuffer.WriteString("http.StatusOK")
+	case http.StatusCreated:
+		statusBuffer.WriteString("http.StatusCreated")
+	case http.StatusAccepted:
+		statusBuffer.WriteString("http.StatusAccepted")
 	case http.StatusMethodNotAllowed:
 		statusBuffer.WriteString("http.StatusMethodNotAllowed")
+	case http.StatusForbidden:
+		statusBuffer.WriteString("http.StatusForbidden")
+	case http.StatusNotFound:
+		statusBuffer.WriteString("http.StatusNotFound")
+	case http.StatusConflict:
+		statusBuffer.WriteString("http.StatusConflict")
+	case http.StatusRequestEntityTooLarge:
+		statusBuffer.WriteString("http.StatusRequestEntityTooLarge")
+	case http.StatusInternalServerError:
+		statusBuffer.WriteString("http.StatusInternalServerError")
+	case http.StatusTooManyRequests:
+		statusBuffer.WriteString("http.StatusTooManyRequests")
+	case http.StatusUnprocessableEntity:
+		statusBuffer.WriteString("http.StatusUnprocessableEntity")
+	case http.StatusBadGateway:
+		statusBuffer.WriteString("http.StatusBadGateway")
+	case http.StatusServiceUnavailable:
+		statusBuffer.WriteString("http.StatusServiceUnavailable")
+	case http.StatusGatewayTimeout:
+		statusBuffer.WriteString("http.StatusGatewayTimeout")
 	default:
 		statusBuffer.WriteString(fmt.Sprintf("Unknown HTTP status code: %d", httpStatusCode))
 	}
@@ -228,10 +412,22 @@ func (rh *RestHandler) writeResponseAndLog(errorMessage string, httpStatusCode i
 	statusBuffer.WriteString(fmt.Sprintf("%+v", &request))
 
 	if errorMessage != "" {
-		logger.Lgr.LogMessage(errorMessage)
+		logger.Lgr.LogMessagef("[%v] %v", id, errorMessage)
 	}
 
 	logger.Lgr.LogMessage(statusBuffer.String())
+	return id
+}
+
+// writeBodyAndLog behaves like writeResponseAndLog but writes the given body
+// with the given content type after the status code instead of an APIError.
+func (rh *RestHandler) writeBodyAndLog(errorMessage string, httpStatusCode int, contentType string, body []byte, writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", contentType)
+	rh.writeStatusAndLog(errorMessage, httpStatusCode, writer, request)
+
+	if _, writeErr := writer.Write(body); writeErr != nil {
+		logger.Lgr.LogMessagef("Failed to write response body: %v", writeErr)
+	}
 }
 
 // checkinHandler will handle receiving and verifying check-in commands via
@@ -244,7 +440,7 @@ func (rh *RestHandler) checkinHandler(writer http.ResponseWriter, request *http.
 	queryParams := mux.Vars(request)
 	remoteTimestamp := queryParams[TIMESTAMP]
 
-	logger.Lgr.LogMessage("checkinHandler - remoteTimestamp: %v recipientEmail: %v", remoteTimestamp, config.Cfg.CheckInGmailAddress)
+	logger.Lgr.LogMessagef("checkinHandler - remoteTimestamp: %v recipientEmail: %v", remoteTimestamp, config.Cfg.CheckInGmailAddress)
 	defer logger.Lgr.LogMessage("checkinHandler finished\n")
 
 	err = rh.verifyTimeStamp(remoteTimestamp)
@@ -261,7 +457,7 @@ func (rh *RestHandler) checkinHandler(writer http.ResponseWriter, request *http.
 		logger.Lgr.LogMessage("Received http.GET request - sending profile out via email")
 		archive, err := profiler.SendArchiveProfileAsAttachment()
 		if err != nil {
-			logger.Lgr.LogMessage("checkinHandler failed to email system profile: %v", err.Error())
+			logger.Lgr.LogMessagef("checkinHandler failed to email system profile: %v", err.Error())
 			rh.writeResponseAndLog(err.Error(), http.StatusInternalServerError, writer, request)
 		} else {
 			defer os.Remove(archive.Name())
@@ -269,7 +465,7 @@ func (rh *RestHandler) checkinHandler(writer http.ResponseWriter, request *http.
 			rh.writeResponseAndLog("", http.StatusOK, writer, request)
 		}
 	default:
-		logger.Lgr.LogMessage("Received unsupported REST method %v for checkinHandler", request.Method)
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for checkinHandler", request.Method)
 		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
 	}
 	return
@@ -286,7 +482,7 @@ func (rh *RestHandler) executeHandler(writer http.ResponseWriter, request *http.
 	remoteTimestamp := queryParams[TIMESTAMP]
 	fileType := queryParams[FILE_TYPE]
 
-	logger.Lgr.LogMessage("remoteTimestamp: %v fileType: %v", remoteTimestamp, fileType)
+	logger.Lgr.LogMessagef("remoteTimestamp: %v fileType: %v", remoteTimestamp, fileType)
 	defer logger.Lgr.LogMessage("executeHandler finished\n")
 
 	err = rh.verifyTimeStamp(remoteTimestamp)
@@ -317,22 +513,22 @@ func (rh *RestHandler) executeHandler(writer http.ResponseWriter, request *http.
 	case "POST":
 		switch fileType {
 		case "python", "binary", "script":
-			logger.Lgr.LogMessage("executeHandler is executing remote %v file", fileType)
+			logger.Lgr.LogMessagef("executeHandler is executing remote %v file", fileType)
 			// save the bytes to a local file and execute the file in the appropriate manner
 			loaderError := rh.executeLoader(fileType, bodyContents)
 			if loaderError != nil {
-				logger.Lgr.LogMessage("error executing remote code: %v", loaderError.Error())
+				logger.Lgr.LogMessagef("error executing remote code: %v", loaderError.Error())
 				rh.writeResponseAndLog(loaderError.Error(), http.StatusBadRequest, writer, request)
 				return
 			}
 			logger.Lgr.LogMessage("Successfully executed remote code")
 			rh.writeResponseAndLog("", http.StatusOK, writer, request)
 		default:
-			logger.Lgr.LogMessage("Received unsupported code type: %v", fileType)
+			logger.Lgr.LogMessagef("Received unsupported code type: %v", fileType)
 			rh.writeResponseAndLog("", http.StatusBadRequest, writer, request)
 		}
 	default:
-		logger.Lgr.LogMessage("Received unsupported REST method %v for executeHandler", request.Method)
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for executeHandler", request.Method)
 		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
 	}
 	return
@@ -346,9 +542,9 @@ func (rh *RestHandler) executeHandler(writer http.ResponseWriter, request *http.
 func (rh *RestHandler) executeLoader(fileType string, fileContents []byte) error {
 
 	processMap := make(map[string]string)
-	fileName := utils.FullDateStringSafe() + ".run"
+	fileName := utils.FileTimeStamp(time.Now()) + ".run"
 
-	logger.Lgr.LogMessage("Successfully created temp file for rest execute loader: %v", fileName)
+	logger.Lgr.LogMessagef("Successfully created temp file for rest execute loader: %v", fileName)
 
 	writeErr := ioutil.WriteFile(fileName, fileContents, 0777)
 	if writeErr != nil {
@@ -392,7 +588,7 @@ func (rh *RestHandler) executeLoader(fileType string, fileContents []byte) error
 		return tmpLoaderErr
 	}
 
-	logger.Lgr.LogMessage("Successfully created tmp rest loader file: %v", tmpLoaderFile.Name())
+	logger.Lgr.LogMessagef("Successfully created tmp rest loader file: %v", tmpLoaderFile.Name())
 
 	defer os.Remove(tmpLoaderFile.Name())
 
@@ -410,7 +606,7 @@ func (rh *RestHandler) executeLoader(fileType string, fileContents []byte) error
 		return loaderErr
 	}
 
-	logger.Lgr.LogMessage("Successfully instantiated a new Loader instance: %+v", restLoader)
+	logger.Lgr.LogMessagef("Successfully instantiated a new Loader instance: %+v", restLoader)
 
 	finishedProcesses := restLoader.StartSynchronous()
 	logger.Lgr.LogMessage("Successfully ran code over REST synchronously")
@@ -435,7 +631,7 @@ func (rh *RestHandler) rebootHandler(writer http.ResponseWriter, request *http.R
 	remoteTimestamp := queryParams[TIMESTAMP]
 	rebootDelay := queryParams[REBOOT_DELAY]
 
-	logger.Lgr.LogMessage("rebootHandler - remoteTimestamp: %v rebootDelay: %v", remoteTimestamp, rebootDelay)
+	logger.Lgr.LogMessagef("rebootHandler - remoteTimestamp: %v rebootDelay: %v", remoteTimestamp, rebootDelay)
 	defer logger.Lgr.LogMessage("rebootHandler finished\n")
 
 	err = rh.verifyTimeStamp(remoteTimestamp)
@@ -459,37 +655,37 @@ func (rh *RestHandler) rebootHandler(writer http.ResponseWriter, request *http.R
 	case "GET":
 		intDelay, intErr := strconv.Atoi(rebootDelay)
 		if intErr != nil {
-			logger.Lgr.LogMessage("could not convert reboot parameter to an int: %v", intErr.Error())
+			logger.Lgr.LogMessagef("could not convert reboot parameter to an int: %v", intErr.Error())
 			rh.writeResponseAndLog(intErr.Error(), http.StatusInternalServerError, writer, request)
 			return
 		}
 
-		logger.Lgr.LogMessage("sleeping for %d seconds before rebooting", intDelay)
+		logger.Lgr.LogMessagef("sleeping for %d seconds before rebooting", intDelay)
 
 		time.Sleep(time.Duration(intDelay) * time.Second)
 		assetPath, assetErr := utils.SysAssetPath("reboot_loader.json")
 		if assetErr != nil {
-			logger.Lgr.LogMessage("could not successfully locate reboot loader JSON file: %v", assetErr.Error())
+			logger.Lgr.LogMessagef("could not successfully locate reboot loader JSON file: %v", assetErr.Error())
 			rh.writeResponseAndLog(assetErr.Error(), http.StatusInternalServerError, writer, request)
 			return
 		}
 
-		logger.Lgr.LogMessage("Successfully loaded reboot_loader asset: %v", assetPath)
+		logger.Lgr.LogMessagef("Successfully loaded reboot_loader asset: %v", assetPath)
 
 		rebootLoader, loaderError := loader.NewLoader(assetPath)
 		if loaderError != nil {
-			logger.Lgr.LogMessage("could not initialize new reboot loader: %v", loaderError.Error())
+			logger.Lgr.LogMessagef("could not initialize new reboot loader: %v", loaderError.Error())
 			rh.writeResponseAndLog(loaderError.Error(), http.StatusInternalServerError, writer, request)
 			return
 		}
 
-		logger.Lgr.LogMessage("Successfully instantiated new reboot loader: %+v", rebootLoader)
+		logger.Lgr.LogMessagef("Successfully instantiated new reboot loader: %+v", rebootLoader)
 
 		rh.writeResponseAndLog("", http.StatusOK, writer, request)
 		defer rebootLoader.StartSynchronous()
 
 	default:
-		logger.Lgr.LogMessage("Received unsupported REST method %v for rebootHandler", request.Method)
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for rebootHandler", request.Method)
 		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
 	}
 
@@ -497,14 +693,15 @@ func (rh *RestHandler) rebootHandler(writer http.ResponseWriter, request *http.R
 }
 
 // logHandler will handle receiving and verifying log retrieval commands via
-// REST. Still a work in progress.
+// REST. A GET returns the contents of the current log file. Deleting logs is
+// still a work in progress.
 func (rh *RestHandler) logHandler(writer http.ResponseWriter, request *http.Request) {
 
 	var err error
 	queryParams := mux.Vars(request)
 	remoteTimestamp := queryParams[TIMESTAMP]
 
-	logger.Lgr.LogMessage("logHandler - remoteTimestamp: %v recipientEmail: %v", remoteTimestamp, config.Cfg.CheckInGmailAddress)
+	logger.Lgr.LogMessagef("logHandler - remoteTimestamp: %v recipientEmail: %v", remoteTimestamp, config.Cfg.CheckInGmailAddress)
 	defer logger.Lgr.LogMessage("logHandler finished\n")
 
 	err = rh.verifyTimeStamp(remoteTimestamp)
@@ -517,13 +714,18 @@ func (rh *RestHandler) logHandler(writer http.ResponseWriter, request *http.Requ
 
 	switch request.Method {
 	case "GET":
-		logger.Lgr.LogMessage("collating logs and sending to gmail address: %v", config.Cfg.CheckInGmailAddress)
-		rh.writeResponseAndLog("", http.StatusOK, writer, request)
+		logger.Lgr.LogMessage("returning the contents of the current log file")
+		logContents, logErr := logger.Lgr.CurrentLogContents()
+		if logErr != nil {
+			rh.writeResponseAndLog(logErr.Error(), http.StatusInternalServerError, writer, request)
+			return
+		}
+		rh.writeBodyAndLog("", http.StatusOK, "text/plain", logContents, writer, request)
 	case "DELETE":
 		logger.Lgr.LogMessage("deleting all temp files from the local working directory to free up disk space")
 		rh.writeResponseAndLog("", http.StatusOK, writer, request)
 	default:
-		logger.Lgr.LogMessage("Received unsupported REST method %v for logHandler", request.Method)
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for logHandler", request.Method)
 		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
 	}
 
@@ -540,7 +742,7 @@ func (rh *RestHandler) updateHandler(writer http.ResponseWriter, request *http.R
 	queryParams := mux.Vars(request)
 	remoteTimestamp := queryParams[TIMESTAMP]
 
-	logger.Lgr.LogMessage("updateHandler - remoteTimestamp: %v", remoteTimestamp)
+	logger.Lgr.LogMessagef("updateHandler - remoteTimestamp: %v", remoteTimestamp)
 	defer logger.Lgr.LogMessage("updateHandler finished\n")
 
 	err = rh.verifyTimeStamp(remoteTimestamp)
@@ -559,7 +761,7 @@ func (rh *RestHandler) updateHandler(writer http.ResponseWriter, request *http.R
 		logger.Lgr.LogMessage("need to retrieve the URL that was posted and update config with it")
 		rh.writeResponseAndLog("", http.StatusOK, writer, request)
 	default:
-		logger.Lgr.LogMessage("Received unsupported REST method %v for updateHandler", request.Method)
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for updateHandler", request.Method)
 		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
 	}
 
@@ -578,7 +780,7 @@ func (rh *RestHandler) assetHandler(writer http.ResponseWriter, request *http.Re
 	remoteTimestamp := queryParams[TIMESTAMP]
 	targetFileName := queryParams[ASSET_NAME]
 
-	logger.Lgr.LogMessage("assetHandler - remoteTimestamp: %v targetFileName: %v", remoteTimestamp, targetFileName)
+	logger.Lgr.LogMessagef("assetHandler - remoteTimestamp: %v targetFileName: %v", remoteTimestamp, targetFileName)
 	defer logger.Lgr.LogMessage("assetHandler finished\n")
 
 	err = rh.verifyTimeStamp(remoteTimestamp)
@@ -599,24 +801,24 @@ func (rh *RestHandler) assetHandler(writer http.ResponseWriter, request *http.Re
 
 	assetPath, assetErr := utils.AssetPath(targetFileName)
 	if assetErr != nil {
-		rh.writeResponseAndLog(err.Error(), http.StatusBadRequest, writer, request)
+		rh.writeResponseAndLog(assetErr.Error(), http.StatusBadRequest, writer, request)
 		return
 	}
 
-	logger.Lgr.LogMessage("Successfully located asset: %v", assetPath)
+	logger.Lgr.LogMessagef("Successfully located asset: %v", assetPath)
 
 	switch request.Method {
 	case "GET":
-		logger.Lgr.LogMessage("received remote request to retrieve file: %v", targetFileName)
+		logger.Lgr.LogMessagef("received remote request to retrieve file: %v", targetFileName)
 		rh.actionAssetAndReturn("GET", assetPath, writer, request)
 	case "POST":
-		logger.Lgr.LogMessage("received remote request to create new file: %v", targetFileName)
+		logger.Lgr.LogMessagef("received remote request to create new file: %v", targetFileName)
 		rh.actionAssetAndReturn("POST", assetPath, writer, request)
 	case "DELETE":
-		logger.Lgr.LogMessage("received remote request to delete file: %v", targetFileName)
+		logger.Lgr.LogMessagef("received remote request to delete file: %v", targetFileName)
 		rh.actionAssetAndReturn("DELETE", assetPath, writer, request)
 	default:
-		logger.Lgr.LogMessage("Received unsupported REST method %v for assetHandler", request.Method)
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for assetHandler", request.Method)
 		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
 	}
 
@@ -677,6 +879,456 @@ func (rh *RestHandler) actionAssetAndReturn(action string, assetPath string, wri
 	return
 }
 
+// acknowledgeHandler will handle receiving and verifying acknowledgements of
+// critical notifications via REST. Acknowledging a critical notification stops
+// it from being escalated to the escalation channels.
+func (rh *RestHandler) acknowledgeHandler(writer http.ResponseWriter, request *http.Request) {
+
+	var err error
+	queryParams := mux.Vars(request)
+	remoteTimestamp := queryParams[TIMESTAMP]
+	notificationId := queryParams[NOTIFICATION_ID]
+
+	logger.Lgr.LogMessagef("acknowledgeHandler - remoteTimestamp: %v notificationId: %v", remoteTimestamp, notificationId)
+	defer logger.Lgr.LogMessage("acknowledgeHandler finished\n")
+
+	err = rh.verifyTimeStamp(remoteTimestamp)
+	if err != nil {
+		rh.writeResponseAndLog(err.Error(), http.StatusUnauthorized, writer, request)
+		return
+	}
+
+	logger.Lgr.LogMessage("Successfully validated incoming timestamp")
+
+	err = rh.verifyQueryParams(notificationId)
+	if err != nil {
+		rh.writeResponseAndLog(err.Error(), http.StatusBadRequest, writer, request)
+		return
+	}
+
+	logger.Lgr.LogMessage("Successfully verified query parameters")
+
+	switch request.Method {
+	case "POST":
+		ackErr := reporter.Acknowledge(notificationId)
+		if ackErr != nil {
+			rh.writeResponseAndLog(ackErr.Error(), http.StatusNotFound, writer, request)
+			return
+		}
+		rh.writeResponseAndLog("", http.StatusOK, writer, request)
+	default:
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for acknowledgeHandler", request.Method)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+	}
+
+	return
+}
+
+// selfTestHandler will handle receiving and verifying self test commands via
+// REST. A test message is sent through every configured notification channel
+// and the result for each channel is returned as JSON. The status is
+// http.StatusInternalServerError if any channel failed.
+func (rh *RestHandler) selfTestHandler(writer http.ResponseWriter, request *http.Request) {
+
+	var err error
+	queryParams := mux.Vars(request)
+	remoteTimestamp := queryParams[TIMESTAMP]
+
+	logger.Lgr.LogMessagef("selfTestHandler - remoteTimestamp: %v", remoteTimestamp)
+	defer logger.Lgr.LogMessage("selfTestHandler finished\n")
+
+	err = rh.verifyTimeStamp(remoteTimestamp)
+	if err != nil {
+		rh.writeResponseAndLog(err.Error(), http.StatusUnauthorized, writer, request)
+		return
+	}
+
+	logger.Lgr.LogMessage("Successfully validated incoming timestamp")
+
+	switch request.Method {
+	case "POST":
+		results := reporter.ReporterSelfTest()
+		summary, allPassed := reporter.SelfTestSummary(results)
+
+		jsonBytes, jsonErr := json.Marshal(results)
+		if jsonErr != nil {
+			rh.writeResponseAndLog(jsonErr.Error(), http.StatusInternalServerError, writer, request)
+			return
+		}
+
+		if allPassed {
+			rh.writeBodyAndLog("", http.StatusOK, "application/json", jsonBytes, writer, request)
+		} else {
+			rh.writeBodyAndLog("Reporter self test failed:\n"+summary, http.StatusInternalServerError, "application/json", jsonBytes, writer, request)
+		}
+	default:
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for selfTestHandler", request.Method)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+	}
+
+	return
+}
+
+// eventsHandler will handle receiving and verifying requests for the most
+// recent events published to the event bus via REST. Up to MAX_REST_EVENTS
+// events are returned as JSON, oldest first.
+func (rh *RestHandler) eventsHandler(writer http.ResponseWriter, request *http.Request) {
+
+	var err error
+	queryParams := mux.Vars(request)
+	remoteTimestamp := queryParams[TIMESTAMP]
+
+	logger.Lgr.LogMessagef("eventsHandler - remoteTimestamp: %v", remoteTimestamp)
+	defer logger.Lgr.LogMessage("eventsHandler finished\n")
+
+	err = rh.verifyTimeStamp(remoteTimestamp)
+	if err != nil {
+		rh.writeResponseAndLog(err.Error(), http.StatusUnauthorized, writer, request)
+		return
+	}
+
+	logger.Lgr.LogMessage("Successfully validated incoming timestamp")
+
+	switch request.Method {
+	case "GET":
+		jsonBytes, jsonErr := json.Marshal(events.Recent(MAX_REST_EVENTS))
+		if jsonErr != nil {
+			rh.writeResponseAndLog(jsonErr.Error(), http.StatusInternalServerError, writer, request)
+			return
+		}
+
+		rh.writeBodyAndLog("", http.StatusOK, "application/json", jsonBytes, writer, request)
+	default:
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for eventsHandler", request.Method)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+	}
+
+	return
+}
+
+// healthHandler will respond to liveness checks. It doesn't require a
+// timestamp so it can be used by monitoring tools and load balancers.
+func (rh *RestHandler) healthHandler(writer http.ResponseWriter, request *http.Request) {
+
+	switch request.Method {
+	case "GET":
+		rh.writeBodyAndLog("", http.StatusOK, "text/plain", []byte("ok\n"), writer, request)
+	default:
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for healthHandler", request.Method)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+	}
+
+	return
+}
+
+// versionHandler will respond with the local version of this program, or
+// everything known about its build as JSON when asked for. It doesn't require
+// a timestamp.
+func (rh *RestHandler) versionHandler(writer http.ResponseWriter, request *http.Request) {
+
+	switch request.Method {
+	case "GET":
+		if strings.Contains(request.Header.Get("Accept"), "application/json") {
+			jsonBytes, jsonErr := json.Marshal(buildinfo.Version())
+			if jsonErr != nil {
+				rh.writeResponseAndLog(jsonErr.Error(), http.StatusInternalServerError, writer, request)
+				return
+			}
+			rh.writeBodyAndLog("", http.StatusOK, "application/json", jsonBytes, writer, request)
+			return
+		}
+		rh.writeBodyAndLog("", http.StatusOK, "text/plain", []byte(fmt.Sprintf("%d\n", config.Cfg.LocalVersion)), writer, request)
+	default:
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for versionHandler", request.Method)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+	}
+
+	return
+}
+
+// statusHandler will handle receiving and verifying status requests via REST.
+// A GET returns the same status report that is emailed out daily.
+func (rh *RestHandler) statusHandler(writer http.ResponseWriter, request *http.Request) {
+
+	if !rh.verifyRequestTimeStamp("statusHandler", writer, request) {
+		return
+	}
+
+	switch request.Method {
+	case "GET":
+		rh.writeBodyAndLog("", http.StatusOK, "text/plain", reporter.StatusReport(), writer, request)
+	default:
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for statusHandler", request.Method)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+	}
+
+	return
+}
+
+// updateCheckHandler will handle receiving and verifying update check commands
+// via REST. A POST checks the remote version immediately and returns whether
+// an update is pending without applying it.
+func (rh *RestHandler) updateCheckHandler(writer http.ResponseWriter, request *http.Request) {
+
+	if !rh.verifyRequestTimeStamp("updateCheckHandler", writer, request) {
+		return
+	}
+
+	switch request.Method {
+	case "POST":
+		summary, checkErr := updater.PendingUpdateSummary()
+		if checkErr != nil {
+			rh.writeResponseAndLog(checkErr.Error(), errorStatus(checkErr, http.StatusInternalServerError), writer, request)
+			return
+		}
+		rh.writeBodyAndLog("", http.StatusOK, "text/plain", []byte(summary), writer, request)
+	default:
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for updateCheckHandler", request.Method)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+	}
+
+	return
+}
+
+// updateApplyHandler will handle receiving and verifying update apply commands
+// via REST. A POST starts an asynchronous operation which applies a newer
+// remote version immediately if one exists and returns the operation.
+func (rh *RestHandler) updateApplyHandler(writer http.ResponseWriter, request *http.Request) {
+
+	if !rh.verifyRequestTimeStamp("updateApplyHandler", writer, request) {
+		return
+	}
+
+	switch request.Method {
+	case "POST":
+		rh.startOperation(UPDATE_APPLY_OPERATION, writer, request)
+	default:
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for updateApplyHandler", request.Method)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+	}
+
+	return
+}
+
+// updateFetchHandler will handle receiving and verifying update fetch commands
+// via REST. A POST starts an asynchronous operation which downloads and
+// verifies the components of a newer release without applying them and
+// returns the operation. Applying them afterwards doesn't download them again.
+func (rh *RestHandler) updateFetchHandler(writer http.ResponseWriter, request *http.Request) {
+
+	if !rh.verifyRequestTimeStamp("updateFetchHandler", writer, request) {
+		return
+	}
+
+	switch request.Method {
+	case "POST":
+		rh.startOperation(UPDATE_FETCH_OPERATION, writer, request)
+	default:
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for updateFetchHandler", request.Method)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+	}
+
+	return
+}
+
+// jobsHandler will handle receiving and verifying job listing requests via
+// REST. A GET returns the status of every job managed by the main loader.
+func (rh *RestHandler) jobsHandler(writer http.ResponseWriter, request *http.Request) {
+
+	if !rh.verifyRequestTimeStamp("jobsHandler", writer, request) {
+		return
+	}
+
+	if rh.MainLoader == nil {
+		rh.writeResponseAndLog("No main loader has been configured for the REST handler", http.StatusNotFound, writer, request)
+		return
+	}
+
+	switch request.Method {
+	case "GET":
+		if strings.Contains(request.Header.Get("Accept"), "application/json") {
+			jsonBytes, jsonErr := json.Marshal(rh.MainLoader.Jobs())
+			if jsonErr != nil {
+				rh.writeResponseAndLog(jsonErr.Error(), http.StatusInternalServerError, writer, request)
+				return
+			}
+			rh.writeBodyAndLog("", http.StatusOK, "application/json", jsonBytes, writer, request)
+			return
+		}
+		summary, _ := rh.MainLoader.StatusSummary()
+		rh.writeBodyAndLog("", http.StatusOK, "text/plain", []byte(summary), writer, request)
+	default:
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for jobsHandler", request.Method)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+	}
+
+	return
+}
+
+// jobRestartHandler will handle receiving and verifying job restart commands
+// via REST. A POST kills the named job so the main loader starts it again.
+func (rh *RestHandler) jobRestartHandler(writer http.ResponseWriter, request *http.Request) {
+	rh.controlJob("jobRestartHandler", (*loader.Loader).Restart, writer, request)
+}
+
+// jobStopHandler will handle receiving and verifying job stop commands via
+// REST. A POST kills the named job and keeps the main loader from starting it
+// again until it's started via the job start handler.
+func (rh *RestHandler) jobStopHandler(writer http.ResponseWriter, request *http.Request) {
+	rh.controlJob("jobStopHandler", (*loader.Loader).Stop, writer, request)
+}
+
+// jobStartHandler will handle receiving and verifying job start commands via
+// REST. A POST lets the main loader start the named job again after it was
+// stopped.
+func (rh *RestHandler) jobStartHandler(writer http.ResponseWriter, request *http.Request) {
+	rh.controlJob("jobStartHandler", (*loader.Loader).Start, writer, request)
+}
+
+// restartHandler will handle receiving and verifying agent restart commands via
+// REST. A POST responds straight away and then drains every subsystem,
+// flushes the logs, and replaces the agent with the same executable. Jobs
+// started by the main loader keep running and are adopted by the new copy.
+func (rh *RestHandler) restartHandler(writer http.ResponseWriter, request *http.Request) {
+
+	if !rh.verifyRequestTimeStamp("restartHandler", writer, request) {
+		return
+	}
+
+	switch request.Method {
+	case "POST":
+		requestedBy := "an unauthenticated request"
+		if token, authenticated := requestToken(request); authenticated {
+			requestedBy = token.Name
+		}
+		rh.writeResponseAndLog("", http.StatusAccepted, writer, request)
+		// shutting down waits for this request to finish
+		go lifecycle.Restart(fmt.Sprintf("was asked to restart via REST by %v", requestedBy))
+	default:
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for restartHandler", request.Method)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+	}
+}
+
+// jobValidateHandler will handle dry runs of job definitions via REST. A POST
+// with a JSON object of definitions by name, written the way they are in the
+// main loader asset, returns the problems of every job which couldn't be
+// started as a JSON list, which is empty when they all could. Nothing is
+// started or saved.
+func (rh *RestHandler) jobValidateHandler(writer http.ResponseWriter, request *http.Request) {
+
+	if !rh.verifyRequestTimeStamp("jobValidateHandler", writer, request) {
+		return
+	}
+
+	switch request.Method {
+	case "POST":
+		bodyBytes, readErr := ioutil.ReadAll(http.MaxBytesReader(writer, request.Body, MAX_JOB_DEFINITIONS_BYTES))
+		if readErr != nil {
+			rh.writeResponseAndLog(readErr.Error(), http.StatusBadRequest, writer, request)
+			return
+		}
+
+		var definitions map[string]json.RawMessage
+		if jsonErr := json.Unmarshal(bodyBytes, &definitions); jsonErr != nil || len(definitions) == 0 {
+			rh.writeResponseAndLog("Expected a JSON object of job definitions by name", http.StatusBadRequest, writer, request)
+			return
+		}
+
+		jobProblems := loader.ValidateAll(definitions)
+		logger.Lgr.LogMessagef("Successfully validated %d job definitions, %d with problems", len(definitions), len(jobProblems))
+
+		jsonBytes, jsonErr := json.Marshal(jobProblems)
+		if jsonErr != nil {
+			rh.writeResponseAndLog(jsonErr.Error(), http.StatusInternalServerError, writer, request)
+			return
+		}
+		rh.writeBodyAndLog("", http.StatusOK, "application/json", jsonBytes, writer, request)
+	default:
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for jobValidateHandler", request.Method)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+	}
+}
+
+// controlJob will verify a job control request and apply the given loader
+// action to the job named in it.
+func (rh *RestHandler) controlJob(handlerName string, action func(*loader.Loader, string) error, writer http.ResponseWriter, request *http.Request) {
+
+	if !rh.verifyRequestTimeStamp(handlerName, writer, request) {
+		return
+	}
+
+	jobName := mux.Vars(request)[JOB_NAME]
+
+	if err := rh.verifyQueryParams(jobName); err != nil {
+		rh.writeResponseAndLog(err.Error(), http.StatusBadRequest, writer, request)
+		return
+	}
+
+	if rh.MainLoader == nil {
+		rh.writeResponseAndLog("No main loader has been configured for the REST handler", http.StatusNotFound, writer, request)
+		return
+	}
+
+	switch request.Method {
+	case "POST":
+		actionErr := action(rh.MainLoader, jobName)
+		if actionErr != nil {
+			rh.writeResponseAndLog(actionErr.Error(), http.StatusNotFound, writer, request)
+			return
+		}
+		rh.writeResponseAndLog("", http.StatusOK, writer, request)
+	default:
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for %v", request.Method, handlerName)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+	}
+
+	return
+}
+
+// metricsHandler will handle receiving and verifying metrics requests via
+// REST. A GET returns every sample in the profiler history as JSON, oldest
+// first.
+func (rh *RestHandler) metricsHandler(writer http.ResponseWriter, request *http.Request) {
+
+	if !rh.verifyRequestTimeStamp("metricsHandler", writer, request) {
+		return
+	}
+
+	switch request.Method {
+	case "GET":
+		jsonBytes, jsonErr := json.Marshal(profiler.Samples())
+		if jsonErr != nil {
+			rh.writeResponseAndLog(jsonErr.Error(), http.StatusInternalServerError, writer, request)
+			return
+		}
+		rh.writeBodyAndLog("", http.StatusOK, "application/json", jsonBytes, writer, request)
+	default:
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for metricsHandler", request.Method)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+	}
+
+	return
+}
+
+// verifyRequestTimeStamp will verify the timestamp query parameter of the
+// request and write http.StatusUnauthorized if it's invalid. Returns whether
+// the handler should continue processing the request.
+func (rh *RestHandler) verifyRequestTimeStamp(handlerName string, writer http.ResponseWriter, request *http.Request) bool {
+
+	remoteTimestamp := mux.Vars(request)[TIMESTAMP]
+
+	logger.Lgr.LogMessagef("%v - remoteTimestamp: %v", handlerName, remoteTimestamp)
+
+	if err := rh.verifyTimeStamp(remoteTimestamp); err != nil {
+		rh.writeResponseAndLog(err.Error(), http.StatusUnauthorized, writer, request)
+		return false
+	}
+
+	logger.Lgr.LogMessage("Successfully validated incoming timestamp")
+	return true
+}
+
 // TimeDiffSeconds returns the difference between the input time and the current
 // time in seconds. Returns error if the input time stamp cannot be correctly
 // converted to a time instance.
@@ -698,7 +1350,7 @@ func (rh *RestHandler) TimeDiffSeconds(unixTimeStamp string) (*UnixTimeDiff, err
 		unixDiff.diff = unixDiff.diff * -1
 	}
 
-	logger.Lgr.LogMessage("Calculated diff: %+v", unixDiff)
+	logger.Lgr.LogMessagef("Calculated diff: %+v", unixDiff)
 
 	return &unixDiff, nil
 }
@@ -709,7 +1361,7 @@ func (rh *RestHandler) TimeDiffSeconds(unixTimeStamp string) (*UnixTimeDiff, err
 // on the remote box.
 func (rh *RestHandler) verifyTimeStamp(remoteTimeStamp string) error {
 
-	logger.Lgr.LogMessage("verifyTimeStamp called with remoteTimeStamp: %v", remoteTimeStamp)
+	logger.Lgr.LogMessagef("verifyTimeStamp called with remoteTimeStamp: %v", remoteTimeStamp)
 
 	// get the difference between then and now in seconds from unix time stamps
 	diff, diffErr := rh.TimeDiffSeconds(remoteTimeStamp)
@@ -717,7 +1369,7 @@ func (rh *RestHandler) verifyTimeStamp(remoteTimeStamp string) error {
 		return fmt.Errorf("verifyTimeStamp failed with diff: %v", diff.diff)
 	}
 
-	logger.Lgr.LogMessage("verifyTimeStamp succeeded with diff: %v", diff.diff)
+	logger.Lgr.LogMessagef("verifyTimeStamp succeeded with diff: %v", diff.diff)
 	return nil
 }
 
@@ -729,7 +1381,7 @@ func (rh *RestHandler) verifyTimeStamp(remoteTimeStamp string) error {
 func (rh *RestHandler) verifyQueryParams(parameters ...string) error {
 	for _, value := range parameters {
 		if value == "" {
-			logger.Lgr.LogMessage("verifyQueryParams failed with: %v", value)
+			logger.Lgr.LogMessagef("verifyQueryParams failed with: %v", value)
 			return fmt.Errorf("verifyQueryParams failed with: %v", value)
 		}
 	}
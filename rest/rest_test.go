@@ -1,19 +1,31 @@
 package rest
 
 import (
+	"archive/tar"
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/seantcanavan/anon-eth-net/audit"
+	"github.com/seantcanavan/anon-eth-net/buildinfo"
 	"github.com/seantcanavan/anon-eth-net/config"
 	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/transport"
 	"github.com/seantcanavan/anon-eth-net/utils"
 )
 
@@ -23,10 +35,35 @@ var nowString string
 var protocol string
 var host string
 var port string
-var transport *http.Transport
+var tlsTransport *http.Transport
 var client *http.Client
 var restHandler *RestHandler
 
+// the admin token every request to the test server is sent with
+var testToken = "rest test token"
+
+// bearerTransport sends every request with testToken unless it already has an
+// Authorization header.
+type bearerTransport struct {
+	next http.RoundTripper
+}
+
+func (bt bearerTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.Header.Get("Authorization") == "" {
+		request = request.Clone(request.Context())
+		request.Header.Set("Authorization", BEARER_PREFIX+testToken)
+	}
+	return bt.next.RoundTrip(request)
+}
+
+// asAdmin wraps the given handler so every request reaches it with an admin
+// token, as though authenticate had let it through.
+func asAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		next.ServeHTTP(writer, withToken(request, apiToken{Name: "rest_test", Role: ROLE_ADMIN}))
+	})
+}
+
 func TestMain(m *testing.M) {
 
 	logErr := logger.StandardLogger("rest_test")
@@ -41,6 +78,14 @@ func TestMain(m *testing.M) {
 		return
 	}
 
+	auditDir, dirErr := ioutil.TempDir("", "rest_audit")
+	if dirErr != nil {
+		fmt.Println(dirErr)
+		return
+	}
+	config.Cfg.AuditLogFile = filepath.Join(auditDir, "audit.jsonl")
+	config.Cfg.RestTokenHashes = []string{HashToken(testToken)}
+
 	certPath, certPathErr := utils.AssetPath("server.cert")
 	if certPathErr != nil {
 		fmt.Println(certPathErr)
@@ -76,10 +121,11 @@ func TestMain(m *testing.M) {
 		return
 	}
 
-	transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: rootAuthorities}}
-	client = &http.Client{Transport: transport}
+	tlsTransport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: rootAuthorities}}
+	client = &http.Client{Transport: bearerTransport{tlsTransport}}
 
 	result := m.Run()
+	os.RemoveAll(auditDir)
 	os.Exit(result)
 }
 
@@ -284,6 +330,119 @@ func TestUpdateHandlerPass(t *testing.T) {
 	}
 }
 
+func TestAcknowledgeHandlerPass(t *testing.T) {
+	path = buildRestPath(protocol, host, port, ACKNOWLEDGE_REST_PATH, nowString, "not-a-notification")
+
+	fmt.Println(fmt.Sprintf("TestAcknowledgeHandlerPass: client.Post -> %v", path))
+
+	response, err := client.Post(path, "text/plain", bytes.NewBuffer([]byte("")))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if response.StatusCode != http.StatusNotFound {
+		t.Error(fmt.Errorf("expected: %v, got: %v", http.StatusNotFound, response.StatusCode))
+	}
+
+	fmt.Println(fmt.Sprintf("TestAcknowledgeHandlerPass: client.Get -> %v", path))
+
+	response, err = client.Get(path)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if response.StatusCode != http.StatusMethodNotAllowed {
+		t.Error(fmt.Errorf("expected: %v, got: %v", http.StatusMethodNotAllowed, response.StatusCode))
+	}
+}
+
+func TestSelfTestHandlerMethod(t *testing.T) {
+	path = buildRestPath(protocol, host, port, SELFTEST_REST_PATH, nowString)
+
+	fmt.Println(fmt.Sprintf("TestSelfTestHandlerMethod: client.Get -> %v", path))
+
+	response, err := client.Get(path)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if response.StatusCode != http.StatusMethodNotAllowed {
+		t.Error(fmt.Errorf("expected: %v, got: %v", http.StatusMethodNotAllowed, response.StatusCode))
+	}
+}
+
+func TestHealthAndVersionHandlerPass(t *testing.T) {
+	for _, root := range []string{HEALTH_REST_PATH, VERSION_REST_PATH} {
+		path = buildRestPath(protocol, host, port, root)
+
+		fmt.Println(fmt.Sprintf("TestHealthAndVersionHandlerPass: client.Get -> %v", path))
+
+		response, err := client.Get(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if response.StatusCode != http.StatusOK {
+			t.Error(fmt.Errorf("expected: %v, got: %v", http.StatusOK, response.StatusCode))
+		}
+	}
+
+	path = buildRestPath(protocol, host, port, VERSION_REST_PATH)
+
+	response, err := client.Get(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+	if string(body) != fmt.Sprintf("%d\n", config.Cfg.LocalVersion) {
+		t.Error(fmt.Errorf("expected version: %d, got: %v", config.Cfg.LocalVersion, string(body)))
+	}
+}
+
+func TestStatusHandlerPass(t *testing.T) {
+	path = buildRestPath(protocol, host, port, STATUS_REST_PATH, nowString)
+
+	fmt.Println(fmt.Sprintf("TestStatusHandlerPass: client.Get -> %v", path))
+
+	response, err := client.Get(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.StatusCode != http.StatusOK {
+		t.Error(fmt.Errorf("expected: %v, got: %v", http.StatusOK, response.StatusCode))
+	}
+
+	path = buildRestPath(protocol, host, port, STATUS_REST_PATH, "0")
+
+	fmt.Println(fmt.Sprintf("TestStatusHandlerPass: client.Get -> %v", path))
+
+	response, err = client.Get(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Error(fmt.Errorf("expected: %v, got: %v", http.StatusUnauthorized, response.StatusCode))
+	}
+}
+
+func TestJobRestartHandlerFail(t *testing.T) {
+	path = buildRestPath(protocol, host, port, JOB_RESTART_REST_PATH, nowString, "not-a-job")
+
+	fmt.Println(fmt.Sprintf("TestJobRestartHandlerFail: client.Post -> %v", path))
+
+	response, err := client.Post(path, "text/plain", bytes.NewBuffer([]byte("")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.StatusCode != http.StatusNotFound {
+		t.Error(fmt.Errorf("expected: %v, got: %v", http.StatusNotFound, response.StatusCode))
+	}
+}
+
 func TestAssetHandlerPass(t *testing.T) {
 	path = buildRestPath(protocol, host, port, ASSET_REST_PATH, nowString, "config.json")
 
@@ -341,3 +500,899 @@ func TestAssetHandlerPass(t *testing.T) {
 	// 	t.Error(fmt.Errorf("expected: %v, got: %v", http.StatusOK, response.StatusCode))
 	// }
 }
+
+func TestAuthenticateLockout(t *testing.T) {
+
+	defer func(hashes []string) { config.Cfg.RestTokenHashes = hashes }(config.Cfg.RestTokenHashes)
+	config.Cfg.RestTokenHashes = []string{HashToken("let me in")}
+
+	handled := false
+	authenticated := restHandler.authenticate(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		handled = true
+		writer.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(remoteAddr string, token string) int {
+		request := httptest.NewRequest("GET", "/"+HEALTH_REST_PATH, nil)
+		request.RemoteAddr = remoteAddr
+		if token != "" {
+			request.Header.Set("Authorization", BEARER_PREFIX+token)
+		}
+		recorder := httptest.NewRecorder()
+		authenticated.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	if code := send("10.0.0.1:1234", "let me in"); code != http.StatusOK || !handled {
+		t.Errorf("expected a valid token to be accepted, got: %v", code)
+	}
+
+	for attempt := 0; attempt < config.Cfg.RestMaxAuthFailures; attempt++ {
+		if code := send("10.0.0.2:1234", "wrong"); code != http.StatusUnauthorized {
+			t.Errorf("expected: %v, got: %v", http.StatusUnauthorized, code)
+		}
+	}
+
+	if code := send("10.0.0.2:1234", "let me in"); code != http.StatusTooManyRequests {
+		t.Errorf("expected a locked out address to be rejected, got: %v", code)
+	}
+
+	if code := send("10.0.0.3:1234", ""); code != http.StatusUnauthorized {
+		t.Errorf("expected a missing token to be rejected, got: %v", code)
+	}
+
+	config.Cfg.RestTokenHashes = nil
+	if authConfigured() == nil {
+		t.Error("expected no tokens and no client CA to be reported")
+	}
+
+	sendTo := func(path string) int {
+		request := httptest.NewRequest("GET", path, nil)
+		request.RemoteAddr = "10.0.0.4:1234"
+		recorder := httptest.NewRecorder()
+		authenticated.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	if code := sendTo(API_V1_PREFIX + "/" + HEALTH_REST_PATH); code != http.StatusOK {
+		t.Errorf("expected the health check to be served without any tokens configured, got: %v", code)
+	}
+
+	if code := sendTo("/" + STATUS_REST_PATH + "/" + strconv.FormatInt(time.Now().Unix(), 10)); code != http.StatusUnauthorized {
+		t.Errorf("expected every other endpoint to be refused without any tokens configured, got: %v", code)
+	}
+}
+
+func TestSelfSignedCertReload(t *testing.T) {
+
+	certDir, dirErr := ioutil.TempDir("", "rest_certs")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(certDir)
+
+	certPath := filepath.Join(certDir, CERT_ASSET)
+	keyPath := filepath.Join(certDir, KEY_ASSET)
+
+	if generateErr := generateSelfSigned(certPath, keyPath); generateErr != nil {
+		t.Fatal(generateErr)
+	}
+
+	reloader, reloadErr := newCertReloader(certPath, keyPath)
+	if reloadErr != nil {
+		t.Fatal(reloadErr)
+	}
+
+	first, _ := reloader.GetCertificate(nil)
+
+	// rotate the certificate and make sure the change is picked up
+	if generateErr := generateSelfSigned(certPath, keyPath); generateErr != nil {
+		t.Fatal(generateErr)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certPath, future, future)
+
+	second, _ := reloader.GetCertificate(nil)
+	if bytes.Equal(first.Certificate[0], second.Certificate[0]) {
+		t.Errorf("expected the rotated certificate to be reloaded")
+	}
+
+	// a broken certificate keeps the previous one being served
+	ioutil.WriteFile(certPath, []byte("not a certificate"), 0644)
+	future = future.Add(time.Minute)
+	os.Chtimes(certPath, future, future)
+
+	third, _ := reloader.GetCertificate(nil)
+	if !bytes.Equal(second.Certificate[0], third.Certificate[0]) {
+		t.Errorf("expected the previous certificate to be served when the new one is invalid")
+	}
+}
+
+func TestLogStreamHandler(t *testing.T) {
+
+	server := httptest.NewServer(asAdmin(restHandler.rtr))
+	defer server.Close()
+
+	streamPath := server.URL + "/" + LOG_STREAM_REST_PATH + "/" + strconv.FormatInt(time.Now().Unix(), 10)
+
+	badResponse, badErr := http.Get(streamPath + "?" + LEVEL_QUERY + "=verbose")
+	if badErr != nil {
+		t.Fatal(badErr)
+	}
+	badResponse.Body.Close()
+	if badResponse.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected: %v, got: %v", http.StatusBadRequest, badResponse.StatusCode)
+	}
+
+	response, getErr := http.Get(streamPath + "?" + LEVEL_QUERY + "=error&" + PACKAGE_QUERY + "=rest_test")
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, response.StatusCode)
+	}
+
+	logger.Lgr.LogMessage("this info message should not be streamed")
+	logger.Lgr.LogError("this error message should be streamed")
+
+	reader := bufio.NewReader(response.Body)
+	for {
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		if strings.HasPrefix(line, "data: ") {
+			if !strings.Contains(line, "this error message should be streamed") {
+				t.Errorf("unexpected streamed entry: %v", line)
+			}
+			break
+		}
+	}
+}
+
+func TestExecHandler(t *testing.T) {
+
+	defer func(allowlist [][]string, maxOutput int) {
+		config.Cfg.ExecAllowlist = allowlist
+		config.Cfg.ExecMaxOutputBytes = maxOutput
+	}(config.Cfg.ExecAllowlist, config.Cfg.ExecMaxOutputBytes)
+	config.Cfg.ExecAllowlist = [][]string{{"uptime"}, {"systemctl", "status", "miner"}, {"journalctl", "-u", config.EXEC_ANY_ARGUMENTS}, {"echo a"}}
+	for _, tc := range []struct {
+		request  ExecRequest
+		expected bool
+	}{
+		{ExecRequest{Command: "uptime"}, true},
+		{ExecRequest{Command: "uptime", Arguments: []string{"-p"}}, false},
+		{ExecRequest{Command: "systemctl", Arguments: []string{"status", "miner"}}, true},
+		{ExecRequest{Command: "systemctl", Arguments: []string{"status miner"}}, false},
+		{ExecRequest{Command: "systemctl", Arguments: []string{"status", "miner", "--no-pager"}}, false},
+		{ExecRequest{Command: "journalctl", Arguments: []string{"-u"}}, true},
+		{ExecRequest{Command: "journalctl", Arguments: []string{"-u", "miner", "-n", "50"}}, true},
+		{ExecRequest{Command: "journalctl", Arguments: []string{"-f"}}, false},
+		{ExecRequest{Command: "echo", Arguments: []string{"a"}}, false},
+		{ExecRequest{Command: "echo a"}, true},
+	} {
+		if allowed := execAllowed(tc.request); allowed != tc.expected {
+			t.Errorf("expected %+v to be allowed: %v, got: %v", tc.request, tc.expected, allowed)
+		}
+	}
+
+	config.Cfg.ExecAllowlist = [][]string{{"echo", config.EXEC_ANY_ARGUMENTS}}
+	config.Cfg.ExecMaxOutputBytes = 5
+
+	server := httptest.NewServer(asAdmin(restHandler.rtr))
+	defer server.Close()
+
+	execPath := server.URL + "/" + EXEC_REST_PATH + "/" + strconv.FormatInt(time.Now().Unix(), 10)
+
+	denied, deniedErr := http.Post(execPath, "application/json", strings.NewReader(`{"command": "ls", "args": ["/"]}`))
+	if deniedErr != nil {
+		t.Fatal(deniedErr)
+	}
+	denied.Body.Close()
+	if denied.StatusCode != http.StatusForbidden {
+		t.Errorf("expected: %v, got: %v", http.StatusForbidden, denied.StatusCode)
+	}
+
+	response, postErr := http.Post(execPath, "application/json", strings.NewReader(`{"command": "echo", "args": ["hello", "world"]}`))
+	if postErr != nil {
+		t.Fatal(postErr)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, response.StatusCode)
+	}
+
+	var result ExecResult
+	if jsonErr := json.NewDecoder(response.Body).Decode(&result); jsonErr != nil {
+		t.Fatal(jsonErr)
+	}
+
+	if result.Stdout != "hello" || !result.OutputTruncated || result.ExitCode != 0 {
+		t.Errorf("unexpected exec result: %+v", result)
+	}
+}
+
+func TestFilesHandler(t *testing.T) {
+
+	fileRoot, dirErr := ioutil.TempDir("", "rest_files")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(fileRoot)
+
+	defer func(roots []string) { config.Cfg.FileRoots = roots }(config.Cfg.FileRoots)
+	config.Cfg.FileRoots = []string{fileRoot}
+
+	server := httptest.NewServer(asAdmin(restHandler.rtr))
+	defer server.Close()
+
+	filesPath := server.URL + "/" + FILES_REST_PATH + "/" + strconv.FormatInt(time.Now().Unix(), 10) + "?" + FILE_PATH_QUERY + "="
+
+	send := func(method string, target string, body string, headers map[string]string) *http.Response {
+		request, requestErr := http.NewRequest(method, filesPath+target, strings.NewReader(body))
+		if requestErr != nil {
+			t.Fatal(requestErr)
+		}
+		for key, value := range headers {
+			request.Header.Set(key, value)
+		}
+		response, sendErr := http.DefaultClient.Do(request)
+		if sendErr != nil {
+			t.Fatal(sendErr)
+		}
+		return response
+	}
+
+	outside := send("GET", filepath.Join(fileRoot, "..", "passwd"), "", nil)
+	outside.Body.Close()
+	if outside.StatusCode != http.StatusForbidden {
+		t.Errorf("expected: %v, got: %v", http.StatusForbidden, outside.StatusCode)
+	}
+
+	target := filepath.Join(fileRoot, "uploaded.txt")
+	contents := "hello resumable world"
+	checksum := fmt.Sprintf("%x", sha256.Sum256([]byte(contents)))
+
+	first := send("PUT", target, contents[:5], map[string]string{"Content-Range": fmt.Sprintf("bytes 0-4/%d", len(contents))})
+	first.Body.Close()
+	if first.StatusCode != http.StatusAccepted {
+		t.Errorf("expected: %v, got: %v", http.StatusAccepted, first.StatusCode)
+	}
+
+	offset := send("HEAD", target, "", nil)
+	offset.Body.Close()
+	if offset.Header.Get(UPLOAD_OFFSET_HEADER) != "5" {
+		t.Errorf("expected an upload offset of 5, got: %v", offset.Header.Get(UPLOAD_OFFSET_HEADER))
+	}
+
+	last := send("PUT", target, contents[5:], map[string]string{
+		"Content-Range": fmt.Sprintf("bytes 5-%d/%d", len(contents)-1, len(contents)),
+		CHECKSUM_HEADER: checksum,
+	})
+	last.Body.Close()
+	if last.StatusCode != http.StatusCreated {
+		t.Errorf("expected: %v, got: %v", http.StatusCreated, last.StatusCode)
+	}
+
+	download := send("GET", target, "", nil)
+	defer download.Body.Close()
+	downloaded, _ := ioutil.ReadAll(download.Body)
+	if string(downloaded) != contents || download.Header.Get(CHECKSUM_HEADER) != checksum {
+		t.Errorf("expected %v with checksum %v, got: %v with checksum %v", contents, checksum, string(downloaded), download.Header.Get(CHECKSUM_HEADER))
+	}
+}
+
+func TestStructuredErrors(t *testing.T) {
+
+	server := httptest.NewServer(restHandler.correlate(asAdmin(restHandler.rtr)))
+	defer server.Close()
+
+	request, requestErr := http.NewRequest("POST", server.URL+API_V1_PREFIX+"/"+JOB_RESTART_REST_PATH+"/"+strconv.FormatInt(time.Now().Unix(), 10)+"/missing", nil)
+	if requestErr != nil {
+		t.Fatal(requestErr)
+	}
+	request.Header.Set(CORRELATION_ID_HEADER, "trace-me-123")
+
+	response, sendErr := http.DefaultClient.Do(request)
+	if sendErr != nil {
+		t.Fatal(sendErr)
+	}
+	defer response.Body.Close()
+
+	var apiError APIError
+	if jsonErr := json.NewDecoder(response.Body).Decode(&apiError); jsonErr != nil {
+		t.Fatal(jsonErr)
+	}
+
+	if response.StatusCode != http.StatusNotFound || apiError.Code != NOT_FOUND_CODE || apiError.CorrelationId != "trace-me-123" || apiError.Message == "" {
+		t.Errorf("unexpected error response %v: %+v", response.StatusCode, apiError)
+	}
+
+	if response.Header.Get(CORRELATION_ID_HEADER) != "trace-me-123" {
+		t.Errorf("expected the correlation ID to be echoed, got: %v", response.Header.Get(CORRELATION_ID_HEADER))
+	}
+
+	unknown, getErr := http.Get(server.URL + API_V1_PREFIX + "/nothing/here")
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	defer unknown.Body.Close()
+
+	if unknown.StatusCode != http.StatusNotFound || unknown.Header.Get(CORRELATION_ID_HEADER) == "" {
+		t.Errorf("expected a not found response with a generated correlation ID, got: %v %v", unknown.StatusCode, unknown.Header)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+
+	for _, tc := range []struct {
+		err      error
+		expected int
+	}{
+		{fmt.Errorf("something broke"), http.StatusInternalServerError},
+		{fmt.Errorf("Could not save the rotated token: %w", config.ErrConfigInvalid{Err: fmt.Errorf("bad token")}), http.StatusUnprocessableEntity},
+		{transport.ErrEndpointsFailed{Endpoints: []string{"a", "b"}, Errs: []error{fmt.Errorf("a is down"), transport.ErrDownloadFailed{URL: "b", Status: http.StatusNotFound}}}, http.StatusBadGateway},
+		{buildinfo.ErrVersionParse{Source: "version.no", Value: "<html>"}, http.StatusBadGateway},
+		{transport.ErrBudgetExhausted{Used: 2, Budget: 1}, http.StatusServiceUnavailable},
+		{&net.OpError{Op: "dial", Err: timeoutError{}}, http.StatusGatewayTimeout},
+	} {
+		if status := errorStatus(tc.err, http.StatusInternalServerError); status != tc.expected {
+			t.Errorf("expected %v to be status %d, got: %d", tc.err, tc.expected, status)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	restHandler.writeResponseAndLog("bad proxy", errorStatus(config.ErrConfigInvalid{}, http.StatusBadRequest), recorder, httptest.NewRequest("POST", "/", nil))
+	var apiError APIError
+	if jsonErr := json.NewDecoder(recorder.Body).Decode(&apiError); jsonErr != nil || apiError.Code != INVALID_CONFIG_CODE {
+		t.Errorf("expected an invalid_config error, got: %+v %v", apiError, jsonErr)
+	}
+}
+
+// timeoutError is a net.Error which timed out.
+type timeoutError struct{}
+
+func (te timeoutError) Error() string   { return "i/o timeout" }
+func (te timeoutError) Timeout() bool   { return true }
+func (te timeoutError) Temporary() bool { return true }
+
+func TestMiddlewareChain(t *testing.T) {
+
+	defer func(rate float64, burst int, origins []string) {
+		config.Cfg.RestRateLimitPerSecond = rate
+		config.Cfg.RestRateLimitBurst = burst
+		config.Cfg.RestCORSOrigins = origins
+	}(config.Cfg.RestRateLimitPerSecond, config.Cfg.RestRateLimitBurst, config.Cfg.RestCORSOrigins)
+	config.Cfg.RestRateLimitPerSecond = 0.001
+	config.Cfg.RestRateLimitBurst = 3
+	config.Cfg.RestCORSOrigins = []string{"https://dashboard.example.com"}
+
+	chained := restHandler.chain(restHandler.rtr)
+
+	send := func(method string, remoteAddr string, headers map[string]string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, API_V1_PREFIX+"/"+HEALTH_REST_PATH, nil)
+		request.RemoteAddr = remoteAddr
+		request.Header.Set("Authorization", BEARER_PREFIX+testToken)
+		for key, value := range headers {
+			request.Header.Set(key, value)
+		}
+		recorder := httptest.NewRecorder()
+		chained.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	compressed := send("GET", "10.1.0.1:1234", map[string]string{"Accept-Encoding": "gzip"})
+	if compressed.Code != http.StatusOK || compressed.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("expected a gzip response, got: %v %v", compressed.Code, compressed.Header())
+	}
+
+	gzipReader, gzipErr := gzip.NewReader(compressed.Body)
+	if gzipErr != nil {
+		t.Fatal(gzipErr)
+	}
+	if body, _ := ioutil.ReadAll(gzipReader); string(body) != "ok\n" {
+		t.Errorf("unexpected decompressed body: %v", string(body))
+	}
+
+	preflight := send("OPTIONS", "10.1.0.2:1234", map[string]string{"Origin": "https://dashboard.example.com", "Access-Control-Request-Method": "GET"})
+	if preflight.Code != http.StatusNoContent || preflight.Header().Get("Access-Control-Allow-Origin") != "https://dashboard.example.com" {
+		t.Errorf("expected a successful preflight, got: %v %v", preflight.Code, preflight.Header())
+	}
+
+	foreign := send("GET", "10.1.0.2:1234", map[string]string{"Origin": "https://evil.example.com"})
+	if foreign.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected an unknown origin to be refused, got: %v", foreign.Header())
+	}
+
+	for attempt := 0; attempt < config.Cfg.RestRateLimitBurst; attempt++ {
+		if allowed := send("GET", "10.1.0.3:1234", nil); allowed.Code != http.StatusOK {
+			t.Errorf("expected request %d to be allowed, got: %v", attempt, allowed.Code)
+		}
+	}
+
+	limited := send("GET", "10.1.0.3:1234", nil)
+	if limited.Code != http.StatusTooManyRequests || limited.Header().Get("Retry-After") == "" {
+		t.Errorf("expected the request over the burst to be rate limited, got: %v %v", limited.Code, limited.Header())
+	}
+
+	if other := send("GET", "10.1.0.4:1234", nil); other.Code != http.StatusOK {
+		t.Errorf("expected another address to be unaffected, got: %v", other.Code)
+	}
+
+	recorded := audit.Recent(1)
+	if len(recorded) != 1 || !strings.HasPrefix(recorded[0].Actor, "10.1.0.4 ") || recorded[0].Action != "GET "+API_V1_PREFIX+"/"+HEALTH_REST_PATH || recorded[0].Result != "200 OK" {
+		t.Errorf("expected the last request to be audited, got: %+v", recorded)
+	}
+}
+
+func TestRoleBasedAccess(t *testing.T) {
+
+	defer func(tokens []config.RestTokenConfig) { config.Cfg.RestTokens = tokens }(config.Cfg.RestTokens)
+	config.Cfg.RestTokens = []config.RestTokenConfig{
+		{Name: "dashboard", Hash: HashToken("dashboard token"), Role: ROLE_READ_ONLY},
+		{Name: "oncall", Hash: HashToken("oncall token"), Role: ROLE_OPERATOR},
+		{Name: "fleet-admin", Hash: HashToken("admin token"), Role: ROLE_ADMIN},
+	}
+
+	if validateErr := ValidateTokens(); validateErr != nil {
+		t.Fatal(validateErr)
+	}
+
+	chained := restHandler.chain(restHandler.rtr)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	send := func(method string, path string, token string) int {
+		request := httptest.NewRequest(method, API_V1_PREFIX+"/"+path, nil)
+		request.RemoteAddr = "10.2.0.1:1234"
+		request.Header.Set("Authorization", BEARER_PREFIX+token)
+		recorder := httptest.NewRecorder()
+		chained.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	if code := send("GET", HEALTH_REST_PATH, "dashboard token"); code != http.StatusOK {
+		t.Errorf("expected read-only tokens to read health, got: %v", code)
+	}
+
+	if code := send("POST", JOB_RESTART_REST_PATH+"/"+timestamp+"/miner", "dashboard token"); code != http.StatusForbidden {
+		t.Errorf("expected read-only tokens to be refused a job restart, got: %v", code)
+	}
+
+	// no main loader is configured so getting past authorization means not found
+	if code := send("POST", JOB_RESTART_REST_PATH+"/"+timestamp+"/miner", "oncall token"); code != http.StatusNotFound {
+		t.Errorf("expected operator tokens to restart jobs, got: %v", code)
+	}
+
+	if code := send("POST", EXEC_REST_PATH+"/"+timestamp, "oncall token"); code != http.StatusForbidden {
+		t.Errorf("expected operator tokens to be refused exec, got: %v", code)
+	}
+
+	if code := send("POST", JOB_VALIDATE_REST_PATH+"/"+timestamp, "oncall token"); code != http.StatusForbidden {
+		t.Errorf("expected operator tokens to be refused a job dry run, got: %v", code)
+	}
+
+	if code := send("POST", EXEC_REST_PATH+"/"+timestamp, "admin token"); code != http.StatusBadRequest {
+		t.Errorf("expected admin tokens to reach exec, got: %v", code)
+	}
+
+	recorded := audit.Recent(1)
+	if len(recorded) != 1 || !strings.Contains(recorded[0].Actor, "fleet-admin (admin)") {
+		t.Errorf("expected the token name and role in the audit log, got: %+v", recorded)
+	}
+
+	defer func(hashes []string) { config.Cfg.RestTokenHashes = hashes }(config.Cfg.RestTokenHashes)
+	config.Cfg.RestTokens = nil
+	config.Cfg.RestTokenHashes = nil
+
+	request := httptest.NewRequest("GET", API_V1_PREFIX+"/"+STATUS_REST_PATH+"/"+timestamp, nil)
+	recorder := httptest.NewRecorder()
+	restHandler.rtr.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("expected a request without a token to be refused even with no tokens configured, got: %v", recorder.Code)
+	}
+}
+
+func TestAllowlistListener(t *testing.T) {
+
+	defer func(cidrs []string) { config.Cfg.RestAllowedCIDRs = cidrs }(config.Cfg.RestAllowedCIDRs)
+
+	config.Cfg.RestAllowedCIDRs = []string{"10.0.0.0/8", "not a network"}
+	if _, networksErr := allowedNetworks(); networksErr == nil {
+		t.Error("expected an invalid CIDR to be refused")
+	}
+
+	config.Cfg.RestAllowedCIDRs = []string{"10.0.0.0/8", "192.168.1.7", "::1"}
+	networks, networksErr := allowedNetworks()
+	if networksErr != nil {
+		t.Fatal(networksErr)
+	}
+
+	for address, expected := range map[string]bool{
+		"10.20.30.40:443":  true,
+		"192.168.1.7:443":  true,
+		"192.168.1.8:443":  false,
+		"[::1]:443":        true,
+		"203.0.113.1:8443": false,
+	} {
+		tcpAddress, resolveErr := net.ResolveTCPAddr("tcp", address)
+		if resolveErr != nil {
+			t.Fatal(resolveErr)
+		}
+		if allowed := addressAllowed(tcpAddress, networks); allowed != expected {
+			t.Errorf("expected %v to be allowed: %v, got: %v", address, expected, allowed)
+		}
+	}
+
+	config.Cfg.RestAllowedCIDRs = nil
+	defaults, defaultsErr := allowedNetworks()
+	if defaultsErr != nil {
+		t.Fatal(defaultsErr)
+	}
+
+	for address, expected := range map[string]bool{
+		"127.0.0.1:443":     true,
+		"[::1]:443":         true,
+		"192.168.1.8:443":   true,
+		"[fd00::1]:443":     true,
+		"203.0.113.1:8443":  false,
+		"[2001:db8::1]:443": false,
+	} {
+		tcpAddress, resolveErr := net.ResolveTCPAddr("tcp", address)
+		if resolveErr != nil {
+			t.Fatal(resolveErr)
+		}
+		if allowed := addressAllowed(tcpAddress, defaults); allowed != expected {
+			t.Errorf("expected %v to be allowed without RestAllowedCIDRs: %v, got: %v", address, expected, allowed)
+		}
+	}
+
+	config.Cfg.RestAllowedCIDRs = []string{"10.0.0.0/8"}
+	listener, listenErr := listen("127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	defer listener.Close()
+
+	go func() {
+		if conn, acceptErr := listener.Accept(); acceptErr == nil {
+			conn.Write([]byte("should never be accepted"))
+			conn.Close()
+		}
+	}()
+
+	conn, dialErr := net.Dial("tcp", listener.Addr().String())
+	if dialErr != nil {
+		t.Fatal(dialErr)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if read, _ := conn.Read(make([]byte, 64)); read != 0 {
+		t.Error("expected a connection from outside of the allowlist to be closed")
+	}
+}
+
+func TestDiagnosticsHandler(t *testing.T) {
+
+	chained := restHandler.chain(restHandler.rtr)
+
+	request := httptest.NewRequest("POST", API_V1_PREFIX+"/"+DIAGNOSTICS_REST_PATH+"/"+strconv.FormatInt(time.Now().Unix(), 10), nil)
+	request.RemoteAddr = "10.3.0.1:1234"
+	request.Header.Set("Accept-Encoding", "gzip")
+	request.Header.Set("Authorization", BEARER_PREFIX+testToken)
+	recorder := httptest.NewRecorder()
+	chained.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != GZIP_CONTENT_TYPE {
+		t.Fatalf("expected a gzip diagnostics bundle, got: %v %v", recorder.Code, recorder.Header())
+	}
+
+	if recorder.Header().Get("Content-Encoding") != "" {
+		t.Errorf("expected the diagnostics bundle not to be compressed twice, got: %v", recorder.Header().Get("Content-Encoding"))
+	}
+
+	gzipReader, gzipErr := gzip.NewReader(recorder.Body)
+	if gzipErr != nil {
+		t.Fatal(gzipErr)
+	}
+
+	tarReader := tar.NewReader(gzipReader)
+	header, nextErr := tarReader.Next()
+	if nextErr != nil || header.Name != "fingerprint.json" {
+		t.Errorf("expected the bundle to start with the system fingerprint, got: %v %v", header, nextErr)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+
+	defer func(tokens []config.RestTokenConfig) { config.Cfg.RestTokens = tokens }(config.Cfg.RestTokens)
+	config.Cfg.RestTokens = []config.RestTokenConfig{{Name: "dashboard", Hash: HashToken("dashboard token"), Role: ROLE_READ_ONLY}}
+
+	chained := restHandler.chain(restHandler.rtr)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	send := func(method string, path string, token string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, nil)
+		request.RemoteAddr = "10.4.0.1:1234"
+		if token != "" {
+			request.Header.Set("Authorization", BEARER_PREFIX+token)
+		}
+		recorder := httptest.NewRecorder()
+		chained.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	page := send("GET", "/"+DASHBOARD_REST_PATH, "")
+	if page.Code != http.StatusOK || !strings.Contains(page.Body.String(), "<!DOCTYPE html>") {
+		t.Fatalf("expected the dashboard page without a token, got: %v", page.Code)
+	}
+	if page.Header().Get("Content-Security-Policy") != DASHBOARD_CONTENT_SECURITY_POLICY {
+		t.Errorf("expected the dashboard content security policy, got: %v", page.Header())
+	}
+
+	if code := send("GET", API_V1_PREFIX+"/"+METRICS_REST_PATH+"/"+timestamp, "").Code; code != http.StatusUnauthorized {
+		t.Errorf("expected the API calls made by the dashboard to require a token, got: %v", code)
+	}
+
+	metrics := send("GET", API_V1_PREFIX+"/"+METRICS_REST_PATH+"/"+timestamp, "dashboard token")
+	var samples []json.RawMessage
+	if metrics.Code != http.StatusOK || json.Unmarshal(metrics.Body.Bytes(), &samples) != nil {
+		t.Errorf("expected the profiler history as JSON, got: %v %v", metrics.Code, metrics.Body.String())
+	}
+
+	if code := send("POST", API_V1_PREFIX+"/"+JOB_STOP_REST_PATH+"/"+timestamp+"/miner", "dashboard token").Code; code != http.StatusForbidden {
+		t.Errorf("expected read-only tokens to be refused a job stop, got: %v", code)
+	}
+}
+
+func TestOpenAPISpec(t *testing.T) {
+
+	request := httptest.NewRequest("GET", "/"+SPEC_REST_PATH, nil)
+	request.RemoteAddr = "10.5.0.1:1234"
+	request.Header.Set("Authorization", BEARER_PREFIX+testToken)
+	recorder := httptest.NewRecorder()
+	restHandler.chain(restHandler.rtr).ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, recorder.Code)
+	}
+
+	var document OpenAPIDocument
+	if jsonErr := json.Unmarshal(recorder.Body.Bytes(), &document); jsonErr != nil {
+		t.Fatal(jsonErr)
+	}
+
+	if document.OpenAPI != OPENAPI_VERSION {
+		t.Errorf("expected OpenAPI version %v, got: %v", OPENAPI_VERSION, document.OpenAPI)
+	}
+
+	for _, route := range restHandler.routes {
+		if _, known := endpointRoles[route.Name]; !known {
+			t.Errorf("expected roles to be defined for %v", route.Name)
+		}
+	}
+
+	restart, exists := document.Paths[API_V1_PREFIX+restHandler.Endpoints[JOB_RESTART_REST_PATH]]["post"]
+	if !exists || restart.RequiredRole != ROLE_OPERATOR || len(restart.Parameters) != 2 {
+		t.Errorf("expected the job restart endpoint in the spec, got: %+v", restart)
+	}
+
+	if _, exists := document.Paths["/"+SPEC_REST_PATH]["get"]; !exists {
+		t.Errorf("expected the spec to describe itself, got paths: %v", document.Paths)
+	}
+}
+
+func TestTokenRotation(t *testing.T) {
+
+	configPath, pathErr := utils.AssetPath("config.json")
+	if pathErr != nil {
+		t.Fatal(pathErr)
+	}
+	original, readErr := ioutil.ReadFile(configPath)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	defer ioutil.WriteFile(configPath, original, 0644)
+
+	defer func(previous *config.Config) { config.Cfg = previous }(config.Cfg)
+	testConfig := *config.Cfg
+	config.Cfg = &testConfig
+
+	config.Cfg.RestTokens = []config.RestTokenConfig{
+		{Name: "dashboard", Hash: HashToken("dashboard token"), Role: ROLE_READ_ONLY, Expires: time.Now().Add(48 * time.Hour).UTC().Format(time.RFC3339)},
+		{Name: "fleet-admin", Hash: HashToken("admin token"), Role: ROLE_ADMIN},
+		{Name: "old", Hash: HashToken("old token"), Role: ROLE_ADMIN, Expires: time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)},
+	}
+	config.Cfg.RestTokenLifetimeDays = 30
+	config.Cfg.RestTokenOverlapMinutes = 60
+	config.Cfg.RestTokenWarnDays = 14
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	send := func(method string, path string, token string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, API_V1_PREFIX+"/"+path, strings.NewReader(body))
+		request.RemoteAddr = "10.3.0.1:1234"
+		request.Header.Set("Authorization", BEARER_PREFIX+token)
+		recorder := httptest.NewRecorder()
+		restHandler.chain(restHandler.rtr).ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	if code := send("GET", HEALTH_REST_PATH, "old token", "").Code; code != http.StatusUnauthorized {
+		t.Errorf("expected an expired token to be refused, got: %v", code)
+	}
+
+	warnings := CheckTokens()
+	if len(warnings) != 2 || warnings[0].Name != "dashboard" || warnings[1].Name != "old" || !strings.Contains(warnings[1].Summary(), "no longer accepted") {
+		t.Errorf("expected warnings about the expiring and the expired token, got: %+v", warnings)
+	}
+
+	if code := send("POST", TOKEN_ROTATE_REST_PATH+"/"+timestamp, "dashboard token", `{"name": "dashboard"}`).Code; code != http.StatusForbidden {
+		t.Errorf("expected a read-only token to be refused a rotation, got: %v", code)
+	}
+
+	recorder := send("POST", TOKEN_ROTATE_REST_PATH+"/"+timestamp, "admin token", `{"name": "dashboard", "overlapMinutes": 5}`)
+	var rotated TokenRotateResult
+	if jsonErr := json.Unmarshal(recorder.Body.Bytes(), &rotated); jsonErr != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("expected the dashboard token to be rotated, got: %v %v", recorder.Code, recorder.Body.String())
+	}
+	if rotated.Role != ROLE_READ_ONLY || rotated.Token == "" || time.Until(rotated.Expires) < 29*24*time.Hour || time.Until(rotated.PreviousExpires) > 5*time.Minute {
+		t.Errorf("expected a new read-only token for 30 days replacing the old one in 5 minutes, got: %+v", rotated)
+	}
+
+	// the expired token is gone and both dashboard tokens work during the overlap
+	if len(config.Cfg.RestTokens) != 3 || config.Cfg.RestTokens[1].Name != "fleet-admin" || config.Cfg.RestTokens[2].Hash != HashToken(rotated.Token) {
+		t.Errorf("expected the rotated token to be saved in place of the expired one, got: %+v", config.Cfg.RestTokens)
+	}
+	for _, token := range []string{"dashboard token", rotated.Token} {
+		if code := send("GET", HEALTH_REST_PATH, token, "").Code; code != http.StatusOK {
+			t.Errorf("expected both dashboard tokens to be accepted during the overlap, got: %v", code)
+		}
+	}
+
+	if warnings = CheckTokens(); len(warnings) != 0 {
+		t.Errorf("expected no warnings once the token was rotated, got: %+v", warnings)
+	}
+
+	// a token rotating itself without any overlap stops being accepted at once
+	recorder = send("POST", TOKEN_ROTATE_REST_PATH+"/"+timestamp, "admin token", `{"overlapMinutes": 0}`)
+	if jsonErr := json.Unmarshal(recorder.Body.Bytes(), &rotated); jsonErr != nil || rotated.Name != "fleet-admin" {
+		t.Fatalf("expected the admin token to rotate itself, got: %v %v", recorder.Code, recorder.Body.String())
+	}
+	time.Sleep(time.Second)
+	if code := send("GET", HEALTH_REST_PATH, "admin token", "").Code; code != http.StatusUnauthorized {
+		t.Errorf("expected the replaced admin token to be refused, got: %v", code)
+	}
+	if code := send("GET", HEALTH_REST_PATH, rotated.Token, "").Code; code != http.StatusOK {
+		t.Errorf("expected the new admin token to be accepted, got: %v", code)
+	}
+
+	if _, rotateErr := RotateToken("nobody", 0); rotateErr == nil {
+		t.Errorf("expected rotating an unknown token to fail")
+	}
+}
+
+func TestApprovals(t *testing.T) {
+
+	configPath, pathErr := utils.AssetPath("config.json")
+	if pathErr != nil {
+		t.Fatal(pathErr)
+	}
+	original, readErr := ioutil.ReadFile(configPath)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	defer ioutil.WriteFile(configPath, original, 0644)
+
+	defer func(previous *config.Config) { config.Cfg = previous }(config.Cfg)
+	testConfig := *config.Cfg
+	config.Cfg = &testConfig
+
+	config.Cfg.RestTokenHashes = nil
+	config.Cfg.RestTokens = []config.RestTokenConfig{
+		{Name: "dashboard", Hash: HashToken("dashboard token"), Role: ROLE_READ_ONLY},
+		{Name: "alice", Hash: HashToken("alice token"), Role: ROLE_ADMIN},
+	}
+	config.Cfg.ApprovalActions = []string{config.APPROVAL_AUTH, config.APPROVAL_UPDATE}
+	config.Cfg.ApprovalTimeoutMinutes = 60
+
+	if validateErr := ValidateTokens(); validateErr == nil {
+		t.Errorf("expected approvals with a single admin token to be refused")
+	}
+	config.Cfg.RestTokens = append(config.Cfg.RestTokens, config.RestTokenConfig{Name: "bob", Hash: HashToken("bob token"), Role: ROLE_ADMIN})
+	if validateErr := ValidateTokens(); validateErr != nil {
+		t.Fatal(validateErr)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	send := func(method string, path string, token string, approval string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, API_V1_PREFIX+"/"+path, strings.NewReader(body))
+		request.RemoteAddr = "10.3.0.1:1234"
+		request.Header.Set("Authorization", BEARER_PREFIX+token)
+		if approval != "" {
+			request.Header.Set(APPROVAL_HEADER, approval)
+		}
+		recorder := httptest.NewRecorder()
+		restHandler.chain(restHandler.rtr).ServeHTTP(recorder, request)
+		return recorder
+	}
+	rotate := TOKEN_ROTATE_REST_PATH + "/" + timestamp
+
+	// the rotation is held rather than run
+	recorder := send("POST", rotate, "alice token", "", `{"name": "dashboard"}`)
+	var held Approval
+	if jsonErr := json.Unmarshal(recorder.Body.Bytes(), &held); jsonErr != nil || recorder.Code != http.StatusAccepted {
+		t.Fatalf("expected the rotation to wait for approval, got: %v %v", recorder.Code, recorder.Body.String())
+	}
+	if held.Action != config.APPROVAL_AUTH || held.RequestedBy != "alice" || !strings.Contains(held.Summary, `"dashboard"`) {
+		t.Errorf("expected an auth approval requested by alice, got: %+v", held)
+	}
+	if config.Cfg.RestTokens[0].Hash != HashToken("dashboard token") {
+		t.Errorf("expected the token not to be rotated before it's approved")
+	}
+
+	var pending []Approval
+	recorder = send("GET", APPROVALS_REST_PATH+"/"+timestamp, "dashboard token", "", "")
+	if jsonErr := json.Unmarshal(recorder.Body.Bytes(), &pending); jsonErr != nil || len(pending) != 1 || pending[0].Id != held.Id {
+		t.Errorf("expected the held rotation to be listed, got: %v %v", recorder.Code, recorder.Body.String())
+	}
+
+	approve := APPROVE_REST_PATH + "/" + timestamp + "/" + held.Id
+	if code := send("POST", approve, "alice token", "", "").Code; code != http.StatusForbidden {
+		t.Errorf("expected alice to be refused approving her own rotation, got: %v", code)
+	}
+	if code := send("POST", approve, "dashboard token", "", "").Code; code != http.StatusForbidden {
+		t.Errorf("expected a read-only token to be refused approving, got: %v", code)
+	}
+
+	recorder = send("POST", approve, "bob token", "", "")
+	var grant ApprovalGrant
+	if jsonErr := json.Unmarshal(recorder.Body.Bytes(), &grant); jsonErr != nil || grant.ApprovedBy != "bob" || grant.Token == "" {
+		t.Fatalf("expected bob to approve the rotation, got: %v %v", recorder.Code, recorder.Body.String())
+	}
+
+	// the approval only lets through the same request from the same token
+	if code := send("POST", rotate, "alice token", grant.Token, `{"name": "alice"}`).Code; code != http.StatusForbidden {
+		t.Errorf("expected the approval to be refused for a different body, got: %v", code)
+	}
+	if code := send("POST", rotate, "bob token", grant.Token, `{"name": "dashboard"}`).Code; code != http.StatusForbidden {
+		t.Errorf("expected the approval to be refused for a different requester, got: %v", code)
+	}
+	if code := send("POST", rotate, "alice token", grant.Token+"0", `{"name": "dashboard"}`).Code; code != http.StatusForbidden {
+		t.Errorf("expected a tampered approval to be refused, got: %v", code)
+	}
+
+	recorder = send("POST", rotate, "alice token", grant.Token, `{"name": "dashboard"}`)
+	if recorder.Code != http.StatusOK || len(config.Cfg.RestTokens) != 4 || config.Cfg.RestTokens[3].Name != "dashboard" {
+		t.Errorf("expected the approved rotation to run, got: %v %v", recorder.Code, recorder.Body.String())
+	}
+	if code := send("POST", rotate, "alice token", grant.Token, `{"name": "dashboard"}`).Code; code != http.StatusForbidden {
+		t.Errorf("expected the approval to only be used once, got: %v", code)
+	}
+
+	// a config which leaves the auth settings alone doesn't need approval
+	unchanged, _ := json.Marshal(config.Cfg)
+	if changesAuthSettings(unchanged) {
+		t.Errorf("expected the running config not to change the auth settings")
+	}
+	changed := testConfig
+	changed.ExecAllowlist = append([][]string{{"/bin/sh", config.EXEC_ANY_ARGUMENTS}}, changed.ExecAllowlist...)
+	changedJSON, _ := json.Marshal(&changed)
+	if !changesAuthSettings(changedJSON) {
+		t.Errorf("expected a changed ExecAllowlist to be an auth change")
+	}
+
+	// updates inside of the window run straight away
+	now := time.Now()
+	config.Cfg.UpdateWindow = now.Add(-time.Hour).Format("15:04") + "-" + now.Add(time.Hour).Format("15:04")
+	if action := approvalAction(UPDATE_REST_PATH, httptest.NewRequest("POST", "/", nil), nil); action != "" {
+		t.Errorf("expected an update inside of the window not to need approval, got: %v", action)
+	}
+	config.Cfg.UpdateWindow = now.Add(time.Hour).Format("15:04") + "-" + now.Add(2*time.Hour).Format("15:04")
+	if action := approvalAction(UPDATE_REST_PATH, httptest.NewRequest("POST", "/", nil), nil); action != config.APPROVAL_UPDATE {
+		t.Errorf("expected an update outside of the window to need approval, got: %v", action)
+	}
+}
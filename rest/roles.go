@@ -0,0 +1,227 @@
+package rest
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+// The roles an API token can be given, from least to most privileged
+const ROLE_READ_ONLY = "read-only"
+const ROLE_OPERATOR = "operator"
+const ROLE_ADMIN = "admin"
+
+// The number of characters of a token hash used to identify the token in logs
+const TOKEN_FINGERPRINT_LENGTH = 12
+
+// Every role from least to most privileged
+var roles = []string{ROLE_READ_ONLY, ROLE_OPERATOR, ROLE_ADMIN}
+
+// endpointRoles holds the role required to read from (GET and HEAD) and to
+// act on (every other method) each endpoint. Anything which triggers an
+// update, runs commands, changes config, or expands job templates, which can
+// read the agent's environment, requires ROLE_ADMIN.
+var endpointRoles = map[string][2]string{
+	HEALTH_REST_PATH:       {ROLE_READ_ONLY, ROLE_ADMIN},
+	VERSION_REST_PATH:      {ROLE_READ_ONLY, ROLE_ADMIN},
+	STATUS_REST_PATH:       {ROLE_READ_ONLY, ROLE_ADMIN},
+	EVENTS_REST_PATH:       {ROLE_READ_ONLY, ROLE_ADMIN},
+	JOBS_REST_PATH:         {ROLE_READ_ONLY, ROLE_ADMIN},
+	METRICS_REST_PATH:      {ROLE_READ_ONLY, ROLE_ADMIN},
+	SPEC_REST_PATH:         {ROLE_READ_ONLY, ROLE_ADMIN},
+	OPERATIONS_REST_PATH:   {ROLE_READ_ONLY, ROLE_ADMIN},
+	LOG_REST_PATH:          {ROLE_READ_ONLY, ROLE_OPERATOR},
+	LOG_STREAM_REST_PATH:   {ROLE_READ_ONLY, ROLE_ADMIN},
+	CHECKIN_REST_PATH:      {ROLE_OPERATOR, ROLE_OPERATOR},
+	SELFTEST_REST_PATH:     {ROLE_OPERATOR, ROLE_OPERATOR},
+	ACKNOWLEDGE_REST_PATH:  {ROLE_OPERATOR, ROLE_OPERATOR},
+	UPDATE_CHECK_REST_PATH: {ROLE_OPERATOR, ROLE_OPERATOR},
+	UPDATE_FETCH_REST_PATH: {ROLE_OPERATOR, ROLE_OPERATOR},
+	JOB_RESTART_REST_PATH:  {ROLE_OPERATOR, ROLE_OPERATOR},
+	JOB_STOP_REST_PATH:     {ROLE_OPERATOR, ROLE_OPERATOR},
+	JOB_START_REST_PATH:    {ROLE_OPERATOR, ROLE_OPERATOR},
+	DIAGNOSTICS_REST_PATH:  {ROLE_OPERATOR, ROLE_OPERATOR},
+	CONFIG_REST_PATH:       {ROLE_OPERATOR, ROLE_ADMIN},
+	FILES_REST_PATH:        {ROLE_OPERATOR, ROLE_ADMIN},
+	UPDATE_REST_PATH:       {ROLE_ADMIN, ROLE_ADMIN},
+	JOB_VALIDATE_REST_PATH: {ROLE_ADMIN, ROLE_ADMIN},
+	UPDATE_APPLY_REST_PATH: {ROLE_ADMIN, ROLE_ADMIN},
+	EXEC_REST_PATH:         {ROLE_ADMIN, ROLE_ADMIN},
+	EXECUTE_REST_PATH:      {ROLE_ADMIN, ROLE_ADMIN},
+	REBOOT_REST_PATH:       {ROLE_ADMIN, ROLE_ADMIN},
+	RESTART_REST_PATH:      {ROLE_ADMIN, ROLE_ADMIN},
+	ASSET_REST_PATH:        {ROLE_ADMIN, ROLE_ADMIN},
+	TOKEN_ROTATE_REST_PATH: {ROLE_ADMIN, ROLE_ADMIN},
+	APPROVALS_REST_PATH:    {ROLE_READ_ONLY, ROLE_ADMIN},
+	APPROVE_REST_PATH:      {ROLE_ADMIN, ROLE_ADMIN},
+}
+
+// apiToken is a bearer token accepted by the REST server. Expires is zero
+// when the token never expires.
+type apiToken struct {
+	Name    string
+	Hash    string
+	Role    string
+	Expires time.Time
+}
+
+// tokenKey is the request context key the authenticated token is stored under
+type tokenKey struct{}
+
+// configuredTokens returns every token accepted by the REST server. Hashes
+// listed in RestTokenHashes are admin tokens named after their fingerprint.
+func configuredTokens() []apiToken {
+
+	var tokens []apiToken
+
+	for _, tokenConfig := range config.Cfg.RestTokens {
+		// Expires was checked when the config was loaded
+		expires, _ := time.Parse(time.RFC3339, tokenConfig.Expires)
+		tokens = append(tokens, apiToken{Name: tokenConfig.Name, Hash: strings.ToLower(tokenConfig.Hash), Role: tokenConfig.Role, Expires: expires})
+	}
+
+	for _, tokenHash := range config.Cfg.RestTokenHashes {
+		tokenHash = strings.ToLower(tokenHash)
+		tokens = append(tokens, apiToken{Name: "token:" + fingerprint(tokenHash), Hash: tokenHash, Role: ROLE_ADMIN})
+	}
+
+	return tokens
+}
+
+// ValidateTokens will make sure every configured token has a known role, a
+// name, and a hash, and that there are two admin tokens to request and approve
+// the ApprovalActions.
+func ValidateTokens() error {
+	for _, token := range config.Cfg.RestTokens {
+		if roleRank(token.Role) < 0 {
+			return fmt.Errorf("REST token %v has unknown role %v. Use one of: %v", token.Name, token.Role, strings.Join(roles, ", "))
+		}
+		if token.Name == "" || token.Hash == "" {
+			return fmt.Errorf("Every REST token needs a Name and a Hash")
+		}
+	}
+
+	if len(config.Cfg.ApprovalActions) > 0 {
+		admins := make(map[string]bool)
+		for _, token := range configuredTokens() {
+			if token.Role == ROLE_ADMIN {
+				admins[token.Name] = true
+			}
+		}
+		if len(admins) < 2 {
+			return fmt.Errorf("The ApprovalActions need admin tokens with at least two different names, one to request and one to approve them")
+		}
+	}
+	return nil
+}
+
+// matchToken will compare the hash of the bearer token in the given
+// Authorization header against every configured token in constant time and
+// return the matching one. Expired tokens don't match.
+func matchToken(authorization string) (apiToken, bool) {
+
+	if !strings.HasPrefix(authorization, BEARER_PREFIX) {
+		return apiToken{}, false
+	}
+
+	presented := []byte(HashToken(strings.TrimPrefix(authorization, BEARER_PREFIX)))
+	matched := -1
+
+	// compare against every hash so the timing doesn't reveal which one matched
+	tokens := configuredTokens()
+	for index, token := range tokens {
+		if subtle.ConstantTimeCompare(presented, []byte(token.Hash)) == 1 {
+			matched = index
+		}
+	}
+
+	if matched < 0 {
+		return apiToken{}, false
+	}
+
+	if tokens[matched].expired() {
+		logger.Lgr.LogErrorf("Rejected the REST token %v which expired at %v", tokens[matched].Name, tokens[matched].Expires.Format(time.RFC3339))
+		return apiToken{}, false
+	}
+	return tokens[matched], true
+}
+
+// expired returns whether the token has expired.
+func (at apiToken) expired() bool {
+	return !at.Expires.IsZero() && time.Now().After(at.Expires)
+}
+
+// withToken returns a copy of the given request which carries the given
+// authenticated token.
+func withToken(request *http.Request, token apiToken) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), tokenKey{}, token))
+}
+
+// requestToken returns the authenticated token of the given request, if any.
+func requestToken(request *http.Request) (apiToken, bool) {
+	token, exists := request.Context().Value(tokenKey{}).(apiToken)
+	return token, exists
+}
+
+// authorize wraps the handler of the named endpoint so only tokens with the
+// role the endpoint requires for the request method can use it. Requests
+// which authenticate didn't give a token are refused.
+func (rh *RestHandler) authorize(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+
+		token, authenticated := requestToken(request)
+		if !authenticated {
+			rh.writeResponseAndLog("Request reached "+name+" without an authenticated token", http.StatusUnauthorized, writer, request)
+			return
+		}
+
+		required := requiredRole(name, request.Method)
+		if roleRank(token.Role) < roleRank(required) {
+			rh.writeResponseAndLog(fmt.Sprintf("Token %v with role %v can't %v %v which requires role %v", token.Name, token.Role, request.Method, name, required), http.StatusForbidden, writer, request)
+			return
+		}
+
+		handler(writer, request)
+	}
+}
+
+// requiredRole returns the role needed to use the named endpoint with the
+// given method. Unknown endpoints require ROLE_ADMIN.
+func requiredRole(name string, method string) string {
+	rule, known := endpointRoles[name]
+	if !known {
+		logger.Lgr.LogErrorf("No roles defined for REST endpoint %v, requiring %v", name, ROLE_ADMIN)
+		return ROLE_ADMIN
+	}
+
+	if method == "GET" || method == "HEAD" {
+		return rule[0]
+	}
+	return rule[1]
+}
+
+// roleRank returns how privileged the given role is, higher being more
+// privileged, or -1 if the role is unknown.
+func roleRank(role string) int {
+	for rank, current := range roles {
+		if current == role {
+			return rank
+		}
+	}
+	return -1
+}
+
+// fingerprint returns the start of the given token hash which is enough to
+// tell tokens apart in logs without revealing the hash.
+func fingerprint(tokenHash string) string {
+	if len(tokenHash) < TOKEN_FINGERPRINT_LENGTH {
+		return tokenHash
+	}
+	return tokenHash[:TOKEN_FINGERPRINT_LENGTH]
+}
@@ -0,0 +1,145 @@
+package rest
+
+import (
+	"net/http"
+)
+
+// Route describes a single REST endpoint: where it lives, which methods it
+// responds to, and the handler behind it. Every endpoint is registered from
+// its Route so the OpenAPI specification always matches the real handler set.
+type Route struct {
+	Name        string           // the REST path name of the endpoint, e.g. JOBS_REST_PATH
+	Params      []string         // the path parameters which follow the name, in order
+	Query       []QueryParameter // the optional URL query parameters
+	Methods     []RouteMethod    // the HTTP methods the endpoint responds to
+	Handler     http.HandlerFunc // the handler behind the endpoint
+	Unversioned bool             // only serve the endpoint at its own path rather than also under API_V1_PREFIX
+}
+
+// RouteMethod documents one HTTP method a Route responds to.
+type RouteMethod struct {
+	Method       string // the HTTP method, e.g. "GET"
+	Summary      string // a one line description of what the method does
+	RequestType  string // the content type of the request body, if it takes one
+	ResponseType string // the content type of a successful response body, if it has one
+	Status       int    // the status of a successful response. Defaults to http.StatusOK
+}
+
+// QueryParameter documents an optional URL query parameter of a Route.
+type QueryParameter struct {
+	Name        string
+	Description string
+}
+
+// The description of every path parameter used by the REST endpoints
+var pathParameters = map[string]string{
+	TIMESTAMP:       "The current unix time in seconds. Requests too far from the agent's clock are refused.",
+	REBOOT_DELAY:    "The number of seconds to wait before rebooting.",
+	FILE_TYPE:       "The type of the uploaded code: python, shell, or binary.",
+	ASSET_NAME:      "The name of a file in the assets folder.",
+	NOTIFICATION_ID: "The id of a critical notification.",
+	JOB_NAME:        "The name of a job managed by the main loader.",
+	OPERATION_ID:    "The id of an asynchronous operation.",
+	APPROVAL_ID:     "The id of an action waiting for approval.",
+}
+
+// routeTable returns every REST endpoint served by this handler.
+func (rh *RestHandler) routeTable() []Route {
+	return []Route{
+		{Name: HEALTH_REST_PATH, Handler: rh.healthHandler, Methods: []RouteMethod{
+			{Method: "GET", Summary: "Liveness check", ResponseType: "text/plain"}}},
+		{Name: VERSION_REST_PATH, Handler: rh.versionHandler, Methods: []RouteMethod{
+			{Method: "GET", Summary: "The local version of the agent. The version, commit, build date and release channel as JSON when requested via the Accept header", ResponseType: "text/plain"}}},
+		{Name: STATUS_REST_PATH, Params: []string{TIMESTAMP}, Handler: rh.statusHandler, Methods: []RouteMethod{
+			{Method: "GET", Summary: "The status report which is emailed out daily", ResponseType: "text/plain"}}},
+		{Name: METRICS_REST_PATH, Params: []string{TIMESTAMP}, Handler: rh.metricsHandler, Methods: []RouteMethod{
+			{Method: "GET", Summary: "Every sample in the profiler history, oldest first", ResponseType: "application/json"}}},
+		{Name: EVENTS_REST_PATH, Params: []string{TIMESTAMP}, Handler: rh.eventsHandler, Methods: []RouteMethod{
+			{Method: "GET", Summary: "The most recent events published to the event bus", ResponseType: "application/json"}}},
+		{Name: LOG_REST_PATH, Params: []string{TIMESTAMP}, Handler: rh.logHandler, Methods: []RouteMethod{
+			{Method: "GET", Summary: "The contents of the current log file", ResponseType: "text/plain"},
+			{Method: "DELETE", Summary: "Delete temporary files to free up disk space"}}},
+		{Name: LOG_STREAM_REST_PATH, Params: []string{TIMESTAMP}, Handler: rh.logStreamHandler,
+			Query: []QueryParameter{
+				{Name: LEVEL_QUERY, Description: "Only stream entries at this level or above: info or error."},
+				{Name: PACKAGE_QUERY, Description: "A comma separated list of logger names to stream."}},
+			Methods: []RouteMethod{
+				{Method: "GET", Summary: "Follow new log entries live as server-sent events", ResponseType: "text/event-stream"}}},
+		{Name: JOBS_REST_PATH, Params: []string{TIMESTAMP}, Handler: rh.jobsHandler, Methods: []RouteMethod{
+			{Method: "GET", Summary: "The status of every job managed by the main loader. JSON when requested via the Accept header", ResponseType: "application/json"}}},
+		{Name: JOB_RESTART_REST_PATH, Params: []string{TIMESTAMP, JOB_NAME}, Handler: rh.jobRestartHandler, Methods: []RouteMethod{
+			{Method: "POST", Summary: "Kill a job so the main loader starts it again"}}},
+		{Name: JOB_STOP_REST_PATH, Params: []string{TIMESTAMP, JOB_NAME}, Handler: rh.jobStopHandler, Methods: []RouteMethod{
+			{Method: "POST", Summary: "Kill a job and keep it stopped until it's started again"}}},
+		{Name: JOB_START_REST_PATH, Params: []string{TIMESTAMP, JOB_NAME}, Handler: rh.jobStartHandler, Methods: []RouteMethod{
+			{Method: "POST", Summary: "Let the main loader start a stopped job again"}}},
+		{Name: JOB_VALIDATE_REST_PATH, Params: []string{TIMESTAMP}, Handler: rh.jobValidateHandler, Methods: []RouteMethod{
+			{Method: "POST", Summary: "Dry run job definitions and list the problems of every one which couldn't be started", RequestType: "application/json", ResponseType: "application/json"}}},
+		{Name: CHECKIN_REST_PATH, Params: []string{TIMESTAMP}, Handler: rh.checkinHandler, Methods: []RouteMethod{
+			{Method: "GET", Summary: "Email a check-in with the current operating status of the machine"}}},
+		{Name: SELFTEST_REST_PATH, Params: []string{TIMESTAMP}, Handler: rh.selfTestHandler, Methods: []RouteMethod{
+			{Method: "POST", Summary: "Send a test message through every notification channel", ResponseType: "application/json"}}},
+		{Name: ACKNOWLEDGE_REST_PATH, Params: []string{TIMESTAMP, NOTIFICATION_ID}, Handler: rh.acknowledgeHandler, Methods: []RouteMethod{
+			{Method: "POST", Summary: "Acknowledge a critical notification so it isn't escalated"}}},
+		{Name: DIAGNOSTICS_REST_PATH, Params: []string{TIMESTAMP}, Handler: rh.diagnosticsHandler,
+			Query: []QueryParameter{
+				{Name: EMAIL_QUERY, Description: "Set to true to email the bundle as an operation instead of returning it."}},
+			Methods: []RouteMethod{
+				{Method: "POST", Summary: "Assemble a diagnostics bundle of logs, redacted config, and system state", ResponseType: GZIP_CONTENT_TYPE}}},
+		{Name: CONFIG_REST_PATH, Params: []string{TIMESTAMP}, Handler: rh.configHandler, Methods: []RouteMethod{
+			{Method: "GET", Summary: "The config the agent is running with, secrets redacted, with where each setting's value came from", ResponseType: "application/json"}}},
+		{Name: OPERATIONS_REST_PATH, Params: []string{TIMESTAMP, OPERATION_ID}, Handler: rh.operationsHandler, Methods: []RouteMethod{
+			{Method: "GET", Summary: "The progress and result of an asynchronous operation", ResponseType: "application/json"}}},
+		{Name: UPDATE_CHECK_REST_PATH, Params: []string{TIMESTAMP}, Handler: rh.updateCheckHandler, Methods: []RouteMethod{
+			{Method: "POST", Summary: "Check whether a newer remote version exists without applying it", ResponseType: "text/plain"}}},
+		{Name: UPDATE_APPLY_REST_PATH, Params: []string{TIMESTAMP}, Handler: rh.updateApplyHandler, Methods: []RouteMethod{
+			{Method: "POST", Summary: "Start an operation which applies a newer remote version", ResponseType: "application/json", Status: http.StatusAccepted}}},
+		{Name: UPDATE_FETCH_REST_PATH, Params: []string{TIMESTAMP}, Handler: rh.updateFetchHandler, Methods: []RouteMethod{
+			{Method: "POST", Summary: "Start an operation which downloads a newer remote version without applying it", ResponseType: "application/json", Status: http.StatusAccepted}}},
+		{Name: UPDATE_REST_PATH, Params: []string{TIMESTAMP}, Handler: rh.updateHandler, Methods: []RouteMethod{
+			{Method: "GET", Summary: "Force an update from the remote update URI"},
+			{Method: "POST", Summary: "Force an update from the remote update URI"}}},
+		{Name: FILES_REST_PATH, Params: []string{TIMESTAMP}, Handler: rh.filesHandler,
+			Query: []QueryParameter{
+				{Name: FILE_PATH_QUERY, Description: "The path of the file within one of the FileRoots."}},
+			Methods: []RouteMethod{
+				{Method: "GET", Summary: "Download a file. Supports Range requests", ResponseType: "application/octet-stream"},
+				{Method: "HEAD", Summary: "The size and checksum of a file"},
+				{Method: "PUT", Summary: "Upload a file. Supports resuming via Content-Range", RequestType: "application/octet-stream", Status: http.StatusCreated}}},
+		{Name: EXEC_REST_PATH, Params: []string{TIMESTAMP}, Handler: rh.execHandler, Methods: []RouteMethod{
+			{Method: "POST", Summary: "Run an allowlisted command", RequestType: "application/json", ResponseType: "application/json"}}},
+		{Name: EXECUTE_REST_PATH, Params: []string{TIMESTAMP, FILE_TYPE}, Handler: rh.executeHandler, Methods: []RouteMethod{
+			{Method: "POST", Summary: "Execute the python, shell script, or binary in the request body", RequestType: "application/octet-stream"}}},
+		{Name: RESTART_REST_PATH, Params: []string{TIMESTAMP}, Handler: rh.restartHandler, Methods: []RouteMethod{
+			{Method: "POST", Summary: "Drain, flush, and restart the agent in place, leaving the jobs of the main loader running", Status: http.StatusAccepted}}},
+		{Name: REBOOT_REST_PATH, Params: []string{TIMESTAMP, REBOOT_DELAY}, Handler: rh.rebootHandler, Methods: []RouteMethod{
+			{Method: "GET", Summary: "Reboot the machine after the given delay"}}},
+		{Name: ASSET_REST_PATH, Params: []string{TIMESTAMP, ASSET_NAME}, Handler: rh.assetHandler, Methods: []RouteMethod{
+			{Method: "GET", Summary: "Download an asset", ResponseType: "application/octet-stream"},
+			{Method: "POST", Summary: "Create or replace an asset with the request body", RequestType: "application/octet-stream"},
+			{Method: "DELETE", Summary: "Delete an asset"}}},
+		{Name: TOKEN_ROTATE_REST_PATH, Params: []string{TIMESTAMP}, Handler: rh.tokenRotateHandler, Methods: []RouteMethod{
+			{Method: "POST", Summary: "Replace a token with a newly generated one, accepting the old one for an overlap window", RequestType: "application/json", ResponseType: "application/json"}}},
+		{Name: APPROVALS_REST_PATH, Params: []string{TIMESTAMP}, Handler: rh.approvalsHandler, Methods: []RouteMethod{
+			{Method: "GET", Summary: "The actions waiting for a second admin's approval, and the approved actions which haven't run yet", ResponseType: "application/json"}}},
+		{Name: APPROVE_REST_PATH, Params: []string{TIMESTAMP, APPROVAL_ID}, Handler: rh.approveHandler, Methods: []RouteMethod{
+			{Method: "POST", Summary: "Approve an action requested by another admin token, returning the token which lets it run once", ResponseType: "application/json"},
+			{Method: "DELETE", Summary: "Reject an action waiting for approval"}}},
+		{Name: SPEC_REST_PATH, Handler: rh.specHandler, Unversioned: true, Methods: []RouteMethod{
+			{Method: "GET", Summary: "This OpenAPI specification", ResponseType: "application/json"}}},
+	}
+}
+
+// handle will register the given route under both API_V1_PREFIX and the
+// original unversioned path. Only tokens with the role the endpoint requires
+// can reach the handler.
+func (rh *RestHandler) handle(route Route) {
+	rh.Endpoints[route.Name] = buildGorillaPath(route.Name, route.Params...)
+	rh.routes = append(rh.routes, route)
+
+	authorized := rh.authorize(route.Name, rh.requireApproval(route.Name, route.Handler))
+	if !route.Unversioned {
+		rh.rtr.HandleFunc(API_V1_PREFIX+rh.Endpoints[route.Name], authorized)
+	}
+	rh.rtr.HandleFunc(rh.Endpoints[route.Name], authorized)
+}
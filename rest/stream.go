@@ -0,0 +1,121 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+// The REST path name which calls the log stream handler
+const LOG_STREAM_REST_PATH = "logs/stream"
+
+// The URL query parameter holding the minimum level of streamed log entries
+const LEVEL_QUERY = "level"
+
+// The URL query parameter holding a comma separated list of logger names to stream
+const PACKAGE_QUERY = "package"
+
+// The number of seconds between keep alive comments sent over an idle log stream
+const STREAM_KEEPALIVE_SECONDS = 15
+
+// logStreamHandler will handle receiving and verifying live log stream
+// requests via REST. A GET holds the connection open and streams every new log
+// entry as a server-sent event so the remote user can follow the logs in a
+// browser or with curl. The optional level and package URL query parameters
+// restrict which entries are streamed.
+func (rh *RestHandler) logStreamHandler(writer http.ResponseWriter, request *http.Request) {
+
+	if !rh.verifyRequestTimeStamp("logStreamHandler", writer, request) {
+		return
+	}
+
+	if request.Method != "GET" {
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for logStreamHandler", request.Method)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+		return
+	}
+
+	filter, filterErr := streamFilter(request)
+	if filterErr != nil {
+		rh.writeResponseAndLog(filterErr.Error(), http.StatusBadRequest, writer, request)
+		return
+	}
+
+	flusher, canFlush := writer.(http.Flusher)
+	if !canFlush {
+		rh.writeResponseAndLog("Streaming is not supported by this connection", http.StatusInternalServerError, writer, request)
+		return
+	}
+
+	entries, cancel := logger.Stream(filter)
+	defer cancel()
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+	rh.writeResponseAndLog("", http.StatusOK, writer, request)
+	flusher.Flush()
+
+	logger.Lgr.LogMessagef("Successfully started log stream for %v with filter: %+v", remoteHost(request), filter)
+	defer logger.Lgr.LogMessagef("Log stream for %v finished", remoteHost(request))
+
+	keepAlive := time.NewTicker(STREAM_KEEPALIVE_SECONDS * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-request.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, writeErr := fmt.Fprint(writer, ": keepalive\n\n"); writeErr != nil {
+				return
+			}
+			flusher.Flush()
+		case entry := <-entries:
+			if writeErr := writeStreamEntry(writer, entry); writeErr != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// streamFilter will build the log filter for a stream request from its level
+// and package URL query parameters.
+func streamFilter(request *http.Request) (logger.Filter, error) {
+
+	var filter logger.Filter
+
+	level := strings.ToLower(request.URL.Query().Get(LEVEL_QUERY))
+	if level != "" {
+		if !logger.ValidLevel(level) {
+			return filter, fmt.Errorf("Unknown log level: %v", level)
+		}
+		filter.MinLevel = level
+	}
+
+	for _, pkg := range strings.Split(request.URL.Query().Get(PACKAGE_QUERY), ",") {
+		if pkg = strings.TrimSpace(pkg); pkg != "" {
+			filter.Packages = append(filter.Packages, pkg)
+		}
+	}
+
+	return filter, nil
+}
+
+// writeStreamEntry will write the given log entry to the writer as a single
+// server-sent event with the entry encoded as JSON in its data field.
+func writeStreamEntry(writer http.ResponseWriter, entry logger.Entry) error {
+
+	jsonBytes, jsonErr := json.Marshal(entry)
+	if jsonErr != nil {
+		return jsonErr
+	}
+
+	_, writeErr := fmt.Fprintf(writer, "event: log\ndata: %s\n\n", jsonBytes)
+	return writeErr
+}
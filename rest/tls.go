@@ -0,0 +1,242 @@
+package rest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/utils"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The asset names of the default REST server certificate and private key
+const CERT_ASSET = "server.cert"
+const KEY_ASSET = "server.pkey"
+
+// How long a generated self signed certificate is valid for
+const SELF_SIGNED_VALIDITY_DAYS = 365
+
+// The address the ACME http-01 challenge responder listens on
+const ACME_HTTP_ADDRESS = ":80"
+
+// configureCertificates will set up where the REST server gets its certificate
+// from. When RestACMEDomains are configured the certificate is obtained and
+// renewed automatically via ACME, e.g. Let's Encrypt. Otherwise the configured
+// certificate and key files are used, or the server.cert and server.pkey
+// assets by default, and a self signed certificate is generated in their place
+// if they don't exist yet. Certificate files are reloaded whenever they change
+// on disk so they can be rotated without a restart.
+func configureCertificates(tlsConfig *tls.Config) error {
+
+	if len(config.Cfg.RestACMEDomains) > 0 {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(config.Cfg.RestACMEDomains...),
+			Cache:      autocert.DirCache(config.Cfg.RestACMECacheDir),
+			Email:      config.Cfg.CheckInGmailAddress,
+		}
+
+		go func() {
+			serveErr := http.ListenAndServe(ACME_HTTP_ADDRESS, manager.HTTPHandler(nil))
+			logger.Lgr.LogErrorf("ACME http-01 challenge responder stopped: %v", serveErr)
+		}()
+
+		tlsConfig.GetCertificate = manager.GetCertificate
+		tlsConfig.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+
+		logger.Lgr.LogMessagef("Successfully configured ACME certificates for: %v", config.Cfg.RestACMEDomains)
+		return nil
+	}
+
+	certPath, keyPath := certPaths()
+
+	_, certStatErr := os.Stat(certPath)
+	_, keyStatErr := os.Stat(keyPath)
+	if os.IsNotExist(certStatErr) || os.IsNotExist(keyStatErr) {
+		if generateErr := generateSelfSigned(certPath, keyPath); generateErr != nil {
+			return generateErr
+		}
+	}
+
+	reloader, reloadErr := newCertReloader(certPath, keyPath)
+	if reloadErr != nil {
+		return reloadErr
+	}
+
+	tlsConfig.GetCertificate = reloader.GetCertificate
+
+	return nil
+}
+
+// certPaths returns the configured certificate and key file paths, falling
+// back to the server.cert and server.pkey assets.
+func certPaths() (string, string) {
+
+	certPath := config.Cfg.RestCertFile
+	if certPath == "" {
+		certPath = filepath.Join("..", utils.ASSET_ROOT_DIR, CERT_ASSET)
+	}
+
+	keyPath := config.Cfg.RestKeyFile
+	if keyPath == "" {
+		keyPath = filepath.Join("..", utils.ASSET_ROOT_DIR, KEY_ASSET)
+	}
+
+	return certPath, keyPath
+}
+
+// generateSelfSigned will create a new ECDSA private key and a self signed
+// certificate for localhost and this machine's hostname and save them to the
+// given paths. Used to bootstrap HTTPS on first run before a real certificate
+// has been provided.
+func generateSelfSigned(certPath string, keyPath string) error {
+
+	privateKey, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		return keyErr
+	}
+
+	serialNumber, serialErr := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if serialErr != nil {
+		return serialErr
+	}
+
+	dnsNames := []string{"localhost"}
+	if hostname, hostErr := os.Hostname(); hostErr == nil {
+		dnsNames = append(dnsNames, hostname)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: "anon-eth-net " + config.Cfg.DeviceId},
+		DNSNames:              dnsNames,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(0, 0, SELF_SIGNED_VALIDITY_DAYS),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	certBytes, certErr := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if certErr != nil {
+		return certErr
+	}
+
+	keyBytes, marshalErr := x509.MarshalECPrivateKey(privateKey)
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	if writeErr := writePEM(keyPath, "EC PRIVATE KEY", keyBytes, 0600); writeErr != nil {
+		return writeErr
+	}
+
+	if writeErr := writePEM(certPath, "CERTIFICATE", certBytes, 0644); writeErr != nil {
+		return writeErr
+	}
+
+	logger.Lgr.LogMessagef("Successfully generated self signed REST certificate: %v for: %v", certPath, dnsNames)
+
+	return nil
+}
+
+// writePEM will save the given bytes as a single PEM block to the given path.
+func writePEM(filePath string, blockType string, contents []byte, mode os.FileMode) error {
+
+	pemFile, openErr := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if openErr != nil {
+		return openErr
+	}
+
+	if encodeErr := pem.Encode(pemFile, &pem.Block{Type: blockType, Bytes: contents}); encodeErr != nil {
+		pemFile.Close()
+		return encodeErr
+	}
+
+	return pemFile.Close()
+}
+
+// certReloader serves a certificate loaded from disk and loads it again
+// whenever the certificate or key file is modified.
+type certReloader struct {
+	certPath string
+	keyPath  string
+	cert     *tls.Certificate
+	modTime  time.Time
+	lock     sync.Mutex
+}
+
+// newCertReloader will load the certificate and key from the given paths.
+func newCertReloader(certPath string, keyPath string) (*certReloader, error) {
+
+	reloader := &certReloader{certPath: certPath, keyPath: keyPath}
+
+	if reloadErr := reloader.reload(reloader.latestModTime()); reloadErr != nil {
+		return nil, reloadErr
+	}
+
+	return reloader, nil
+}
+
+// GetCertificate satisfies tls.Config.GetCertificate. The certificate is
+// reloaded first if either file has changed since it was last loaded. If the
+// new files can't be loaded the previous certificate continues to be served.
+func (cr *certReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	if modTime := cr.latestModTime(); modTime.After(cr.modTime) {
+		if reloadErr := cr.reload(modTime); reloadErr != nil {
+			logger.Lgr.LogErrorf("Failed to reload REST certificate %v. Serving the previous certificate: %v", cr.certPath, reloadErr)
+		}
+	}
+
+	return cr.cert, nil
+}
+
+// reload will load the certificate and key from disk.
+func (cr *certReloader) reload(modTime time.Time) error {
+
+	cert, loadErr := tls.LoadX509KeyPair(cr.certPath, cr.keyPath)
+	if loadErr != nil {
+		return loadErr
+	}
+
+	cr.cert = &cert
+	cr.modTime = modTime
+
+	logger.Lgr.LogMessagef("Successfully loaded REST certificate: %v", cr.certPath)
+
+	return nil
+}
+
+// latestModTime returns the most recent modification time of the certificate
+// and key files.
+func (cr *certReloader) latestModTime() time.Time {
+
+	var latest time.Time
+
+	for _, filePath := range []string{cr.certPath, cr.keyPath} {
+		if fileInfo, statErr := os.Stat(filePath); statErr == nil && fileInfo.ModTime().After(latest) {
+			latest = fileInfo.ModTime()
+		}
+	}
+
+	return latest
+}
@@ -0,0 +1,225 @@
+package rest
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+// The REST path name which calls the token rotation handler
+const TOKEN_ROTATE_REST_PATH = "tokens/rotate"
+
+// The maximum size of the JSON body of a token rotation request in bytes
+const MAX_TOKEN_REQUEST_BYTES = 4096
+
+// The number of random bytes in a newly generated token
+const TOKEN_BYTES = 32
+
+// How often the RestTokens are checked for ones about to expire. In hours
+const TOKEN_CHECK_HOURS = 24
+
+// Serializes rotations so two at once can't each keep a token the other
+// replaced
+var rotateLock sync.Mutex
+
+// TokenRotateRequest is the JSON body of a POST to the token rotation
+// handler. Name is the name of the token to rotate, which defaults to the
+// token the request is made with. OverlapMinutes is how long the token being
+// replaced is still accepted for and defaults to RestTokenOverlapMinutes. Zero
+// stops accepting it straight away.
+type TokenRotateRequest struct {
+	Name           string `json:"name"`
+	OverlapMinutes *int   `json:"overlapMinutes"`
+}
+
+// TokenRotateResult is the JSON response of the token rotation handler. Token
+// is the new bearer token itself, which is only ever shown this once.
+type TokenRotateResult struct {
+	Name            string    `json:"name"`
+	Role            string    `json:"role"`
+	Token           string    `json:"token"`
+	Expires         time.Time `json:"expires"`
+	PreviousExpires time.Time `json:"previousExpires"`
+}
+
+// tokenRotateHandler will handle receiving and verifying token rotation
+// commands via REST. A POST with a TokenRotateRequest body replaces the named
+// token with a newly generated one with the same name and role which expires
+// after RestTokenLifetimeDays. The replaced token keeps being accepted for the
+// overlap window so clients can switch over without an outage. The new token
+// is returned in a TokenRotateResult and only its hash is saved in the config.
+func (rh *RestHandler) tokenRotateHandler(writer http.ResponseWriter, request *http.Request) {
+
+	if !rh.verifyRequestTimeStamp("tokenRotateHandler", writer, request) {
+		return
+	}
+
+	if request.Method != "POST" {
+		logger.Lgr.LogMessagef("Received unsupported REST method %v for tokenRotateHandler", request.Method)
+		rh.writeResponseAndLog("", http.StatusMethodNotAllowed, writer, request)
+		return
+	}
+
+	bodyBytes, readErr := ioutil.ReadAll(http.MaxBytesReader(writer, request.Body, MAX_TOKEN_REQUEST_BYTES))
+	if readErr != nil {
+		rh.writeResponseAndLog(readErr.Error(), http.StatusBadRequest, writer, request)
+		return
+	}
+
+	var rotateRequest TokenRotateRequest
+	if len(bodyBytes) > 0 {
+		if jsonErr := json.Unmarshal(bodyBytes, &rotateRequest); jsonErr != nil {
+			rh.writeResponseAndLog(jsonErr.Error(), http.StatusBadRequest, writer, request)
+			return
+		}
+	}
+
+	if rotateRequest.Name == "" {
+		token, authenticated := requestToken(request)
+		if !authenticated {
+			rh.writeResponseAndLog("Name the token to rotate", http.StatusBadRequest, writer, request)
+			return
+		}
+		rotateRequest.Name = token.Name
+	}
+
+	overlap := time.Duration(config.Cfg.RestTokenOverlapMinutes) * time.Minute
+	if rotateRequest.OverlapMinutes != nil {
+		if *rotateRequest.OverlapMinutes < 0 {
+			rh.writeResponseAndLog("The overlap can't be negative", http.StatusBadRequest, writer, request)
+			return
+		}
+		overlap = time.Duration(*rotateRequest.OverlapMinutes) * time.Minute
+	}
+
+	auditDetail(request, "token", rotateRequest.Name)
+
+	result, rotateErr := RotateToken(rotateRequest.Name, overlap)
+	if rotateErr != nil {
+		rh.writeResponseAndLog(rotateErr.Error(), errorStatus(rotateErr, http.StatusBadRequest), writer, request)
+		return
+	}
+
+	logger.Lgr.LogMessagef("AUDIT token %v rotated for %v. The previous token is accepted until %v", result.Name, requestIdentity(request), result.PreviousExpires.Format(time.RFC3339))
+
+	jsonBytes, jsonErr := json.Marshal(result)
+	if jsonErr != nil {
+		rh.writeResponseAndLog(jsonErr.Error(), http.StatusInternalServerError, writer, request)
+		return
+	}
+
+	rh.writeBodyAndLog("", http.StatusOK, "application/json", jsonBytes, writer, request)
+}
+
+// RotateToken will replace the RestTokens with the given name with a newly
+// generated token with the same name and role, which expires after
+// RestTokenLifetimeDays, and save the config. The tokens being replaced are
+// accepted for the given overlap at most, and tokens which have already
+// expired are removed. Returns the new token, which isn't stored anywhere,
+// along with when it and the tokens it replaced expire.
+func RotateToken(name string, overlap time.Duration) (TokenRotateResult, error) {
+
+	rotateLock.Lock()
+	defer rotateLock.Unlock()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	previousExpires := now.Add(overlap)
+	result := TokenRotateResult{Name: name, Expires: now.AddDate(0, 0, config.Cfg.RestTokenLifetimeDays)}
+
+	var tokens []config.RestTokenConfig
+	for _, rotating := range config.Cfg.RestTokens {
+		// Expires was checked when the config was loaded
+		expires, _ := time.Parse(time.RFC3339, rotating.Expires)
+		if !expires.IsZero() && now.After(expires) {
+			continue
+		}
+		if rotating.Name == name {
+			result.Role = rotating.Role
+			if expires.IsZero() || expires.After(previousExpires) {
+				expires = previousExpires
+				rotating.Expires = expires.Format(time.RFC3339)
+			}
+			if expires.After(result.PreviousExpires) {
+				result.PreviousExpires = expires
+			}
+		}
+		tokens = append(tokens, rotating)
+	}
+
+	if result.Role == "" {
+		return TokenRotateResult{}, fmt.Errorf("None of the RestTokens which haven't expired is named %v. Tokens in RestTokenHashes can't be rotated, so move them to the RestTokens first", name)
+	}
+
+	tokenBytes := make([]byte, TOKEN_BYTES)
+	if _, randErr := rand.Read(tokenBytes); randErr != nil {
+		return TokenRotateResult{}, randErr
+	}
+	result.Token = base64.RawURLEncoding.EncodeToString(tokenBytes)
+
+	tokens = append(tokens, config.RestTokenConfig{Name: name, Hash: HashToken(result.Token), Role: result.Role, Expires: result.Expires.Format(time.RFC3339)})
+
+	overrides, jsonErr := json.Marshal(map[string][]config.RestTokenConfig{"RestTokens": tokens})
+	if jsonErr != nil {
+		return TokenRotateResult{}, jsonErr
+	}
+
+	if applyErr := config.Apply(overrides); applyErr != nil {
+		return TokenRotateResult{}, fmt.Errorf("Could not save the rotated token: %w", applyErr)
+	}
+
+	logger.Lgr.LogMessagef("Successfully rotated the REST token %v. It expires at %v", name, result.Expires.Format(time.RFC3339))
+	return result, nil
+}
+
+// WatchTokens will check the RestTokens every TOKEN_CHECK_HOURS for tokens
+// which are about to expire.
+func WatchTokens() {
+
+	go func() {
+		for 1 == 1 {
+			CheckTokens()
+			time.Sleep(TOKEN_CHECK_HOURS * time.Hour)
+		}
+	}()
+}
+
+// CheckTokens will publish a TokenExpiring event for each of the RestTokens
+// which expires within RestTokenWarnDays or has expired but is still
+// configured, and return them.
+func CheckTokens() []events.TokenExpiring {
+
+	warnBefore := time.Now().AddDate(0, 0, config.Cfg.RestTokenWarnDays)
+
+	// a token which has been rotated is replaced by one which expires later
+	tokens := configuredTokens()
+	replaced := func(token apiToken) bool {
+		for _, other := range tokens {
+			if other.Name == token.Name && (other.Expires.IsZero() || other.Expires.After(token.Expires)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var expiring []events.TokenExpiring
+	for _, token := range tokens {
+		if token.Expires.IsZero() || token.Expires.After(warnBefore) || replaced(token) {
+			continue
+		}
+		warning := events.TokenExpiring{Name: token.Name, Expires: token.Expires}
+		logger.Lgr.LogMessagef("%v", warning.Summary())
+		events.Publish(warning)
+		expiring = append(expiring, warning)
+	}
+
+	return expiring
+}
@@ -0,0 +1,306 @@
+// The retention package deletes the data the agent leaves on disk once it's
+// older than its RetentionDays, optionally overwriting it first, and wipes
+// everything the agent has written when a machine is decommissioned.
+package retention
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/diagnostics"
+	"github.com/seantcanavan/anon-eth-net/lifecycle"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/profiler"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// How long after a wipe is requested the agent shuts down and wipes its data,
+// which leaves time to reply to whoever asked for it. In seconds
+const WIPE_DELAY_SECONDS = 30
+
+// The asset holding the config, which a wipe deletes along with its secrets
+const CONFIG_ASSET = "config.json"
+
+// The asset holding the private key of the bundled REST certificate
+const KEY_ASSET = "server.pkey"
+
+// Cleanup is the result of deleting the expired files of a single class of
+// data.
+type Cleanup struct {
+	Class   string `json:"class"`
+	Days    int    `json:"days"`
+	Removed int    `json:"removed"`
+	Bytes   int64  `json:"bytes"`
+	Errors  int    `json:"errors"`
+}
+
+// String describes the cleanup in a single line.
+func (c Cleanup) String() string {
+	description := fmt.Sprintf("%v kept for %d days: removed %d files, %d bytes", c.Class, c.Days, c.Removed, c.Bytes)
+	if c.Errors > 0 {
+		description += fmt.Sprintf(", %d could not be removed", c.Errors)
+	}
+	return description
+}
+
+// The result of the last cleanup, for the status report
+var lastCleaned time.Time
+var lastCleanups []Cleanup
+var cleanLock sync.Mutex
+
+var wipeRequested bool
+var wipeLock sync.Mutex
+
+// Run will delete the files older than their RetentionDays now and every
+// RetentionCheckHours.
+func Run() {
+
+	go func() {
+		for 1 == 1 {
+			Clean()
+			time.Sleep(time.Duration(config.Cfg.RetentionCheckHours) * time.Hour)
+		}
+	}()
+}
+
+// Clean will delete the files of every class of data listed in RetentionDays
+// which were last modified longer ago than the class is kept for. The log
+// files still being written to are never deleted. Files are overwritten first
+// when SecureDelete is set. Returns what was removed from each class.
+func Clean() []Cleanup {
+
+	cleanLock.Lock()
+	defer cleanLock.Unlock()
+
+	open := make(map[string]bool)
+	for _, openLog := range logger.OpenLogFiles() {
+		open[filepath.Clean(openLog)] = true
+	}
+
+	var cleanups []Cleanup
+	for _, class := range config.RETENTION_CLASSES {
+		days, retained := config.Cfg.RetentionDays[class]
+		if !retained {
+			continue
+		}
+
+		cleanup := Cleanup{Class: class, Days: days}
+		cutoff := time.Now().AddDate(0, 0, -days)
+		for _, classFile := range classFiles(class) {
+			info, statErr := os.Stat(classFile)
+			if statErr != nil || info.IsDir() || open[filepath.Clean(classFile)] || !info.ModTime().Before(cutoff) {
+				continue
+			}
+
+			if removeErr := remove(classFile, config.Cfg.SecureDelete); removeErr != nil {
+				logger.Lgr.LogErrorf("Could not remove the expired %v file %v: %v", class, classFile, removeErr)
+				cleanup.Errors++
+				continue
+			}
+			cleanup.Removed++
+			cleanup.Bytes += info.Size()
+		}
+
+		logger.Lgr.LogMessagef("Successfully cleaned up the %v", cleanup)
+		cleanups = append(cleanups, cleanup)
+	}
+
+	lastCleaned, lastCleanups = time.Now(), cleanups
+	return cleanups
+}
+
+// Summary describes the retention periods and what the last cleanup removed.
+// Used to describe the retention policy in status reports.
+func Summary() (string, error) {
+
+	if len(config.Cfg.RetentionDays) == 0 {
+		return "No RetentionDays are set, so nothing is deleted when it gets old\n", nil
+	}
+
+	cleanLock.Lock()
+	cleaned, cleanups := lastCleaned, lastCleanups
+	cleanLock.Unlock()
+
+	if cleaned.IsZero() {
+		return "Not cleaned up since the agent started\n", nil
+	}
+
+	var summary strings.Builder
+	mode := "deleted"
+	if config.Cfg.SecureDelete {
+		mode = "overwritten and deleted"
+	}
+	summary.WriteString(fmt.Sprintf("Expired files were last %v %v ago\n", mode, time.Since(cleaned).Round(time.Minute)))
+	for _, cleanup := range cleanups {
+		summary.WriteString(cleanup.String() + "\n")
+	}
+	return summary.String(), nil
+}
+
+// RequestWipe will shut the agent down after WIPE_DELAY_SECONDS so that it
+// wipes its data once everything has stopped. Used to decommission a machine.
+func RequestWipe(why string) {
+
+	wipeLock.Lock()
+	wipeRequested = true
+	wipeLock.Unlock()
+
+	logger.Lgr.LogMessagef("Wiping the agent's data in %d seconds because it %v", WIPE_DELAY_SECONDS, why)
+
+	go func() {
+		time.Sleep(WIPE_DELAY_SECONDS * time.Second)
+		lifecycle.Shutdown(why)
+	}()
+}
+
+// WipeRequested returns whether RequestWipe was called, in which case the
+// agent should call Wipe once it has shut down rather than restart.
+func WipeRequested() bool {
+
+	wipeLock.Lock()
+	defer wipeLock.Unlock()
+
+	return wipeRequested
+}
+
+// Wipe will overwrite and delete everything the agent has written: every
+// class of data, including the log files still open, along with the crash
+// reports, operations, audit log, state, integrity key, ACME cache, update
+// cache, the config.json asset and the private key of the REST certificate. The
+// executable and the other assets are left for the service to be
+// uninstalled. Returns the paths which couldn't be removed.
+func Wipe() []string {
+
+	var wiping []string
+	for _, class := range config.RETENTION_CLASSES {
+		wiping = append(wiping, classFiles(class)...)
+	}
+	wiping = append(wiping, logger.OpenLogFiles()...)
+	wiping = append(wiping,
+		config.Cfg.CrashReportDir,
+		config.Cfg.OperationsDir,
+		config.Cfg.AuditLogFile,
+		config.Cfg.StateFile,
+		config.Cfg.IntegrityKeyFile,
+		config.Cfg.RestACMECacheDir,
+		config.Cfg.UpdateQuarantineDir,
+		config.Cfg.UpdateCacheDir,
+		config.Cfg.RestKeyFile,
+	)
+	for _, asset := range []string{CONFIG_ASSET, KEY_ASSET} {
+		if assetPath, assetErr := utils.AssetPath(asset); assetErr == nil {
+			wiping = append(wiping, assetPath)
+		}
+	}
+
+	logger.FlushAll()
+
+	var failed []string
+	wiped := make(map[string]bool)
+	for _, wipePath := range wiping {
+		if wipePath == "" || wiped[filepath.Clean(wipePath)] {
+			continue
+		}
+		wiped[filepath.Clean(wipePath)] = true
+
+		if _, statErr := os.Lstat(wipePath); os.IsNotExist(statErr) {
+			continue
+		}
+		if removeErr := removeAll(wipePath); removeErr != nil {
+			logger.Lgr.LogErrorf("Could not wipe %v: %v", wipePath, removeErr)
+			failed = append(failed, wipePath)
+		}
+	}
+
+	sort.Strings(failed)
+	logger.Lgr.LogMessagef("Successfully wiped the agent's data. %d paths could not be removed", len(failed))
+	return failed
+}
+
+// classFiles returns every file belonging to the given class of data: the log
+// files and crash reports, the profile archives, the diagnostics bundles, or
+// the updates in the UpdateQuarantineDir and the UpdateCacheDir.
+func classFiles(class string) []string {
+
+	var patterns []string
+	switch class {
+	case config.RETENTION_LOGS:
+		patterns = []string{"*" + logger.LOG_EXTENSION, filepath.Join(config.Cfg.CrashReportDir, "*")}
+		if logDir := logger.LogDir(); logDir != "" {
+			patterns = append(patterns, filepath.Join(logDir, "*", "*"+logger.LOG_EXTENSION))
+		}
+	case config.RETENTION_METRICS:
+		patterns = []string{profiler.SYS_PROFILE_ARCHIVE_NAME + "_*"}
+	case config.RETENTION_DIAGNOSTICS:
+		bundles := diagnostics.DIAGNOSTICS_BASE_NAME + "_*" + diagnostics.DIAGNOSTICS_EXTENSION
+		patterns = []string{bundles, filepath.Join(os.TempDir(), bundles)}
+	case config.RETENTION_UPDATES:
+		patterns = []string{filepath.Join(config.Cfg.UpdateQuarantineDir, "*"), filepath.Join(config.Cfg.UpdateCacheDir, "*")}
+	}
+
+	var files []string
+	for _, pattern := range patterns {
+		matches, _ := filepath.Glob(pattern)
+		files = append(files, matches...)
+	}
+	return files
+}
+
+// remove will delete the file at the given path, overwriting it with random
+// data first when secure is true.
+func remove(filePath string, secure bool) error {
+	if secure {
+		if overwriteErr := overwrite(filePath); overwriteErr != nil {
+			return overwriteErr
+		}
+	}
+	return os.Remove(filePath)
+}
+
+// removeAll will overwrite and delete the file at the given path, or every
+// file under the directory at the given path and then the directory itself.
+func removeAll(wipePath string) error {
+
+	walkErr := filepath.Walk(wipePath, func(walkPath string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		return overwrite(walkPath)
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+
+	return os.RemoveAll(wipePath)
+}
+
+// overwrite will write random data over the whole of the file at the given
+// path and commit it to disk. On journalling and copy-on-write filesystems and
+// on SSDs the original blocks may survive, so this is a best effort.
+func overwrite(filePath string) error {
+
+	file, openErr := os.OpenFile(filePath, os.O_WRONLY, 0)
+	if openErr != nil {
+		return openErr
+	}
+	defer file.Close()
+
+	info, statErr := file.Stat()
+	if statErr != nil {
+		return statErr
+	}
+
+	if _, copyErr := io.CopyN(file, rand.Reader, info.Size()); copyErr != nil {
+		return copyErr
+	}
+
+	return file.Sync()
+}
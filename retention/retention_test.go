@@ -0,0 +1,183 @@
+package retention
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+func TestMain(m *testing.M) {
+
+	logErr := logger.StandardLogger("retention_test")
+	if logErr != nil {
+		fmt.Println(fmt.Sprintf("Could not initialize logger: %v", logErr))
+		return
+	}
+
+	configErr := config.FromFile()
+	if configErr != nil {
+		return
+	}
+
+	result := m.Run()
+	os.Exit(result)
+}
+
+func TestClean(t *testing.T) {
+
+	defer func(previous *config.Config) { config.Cfg = previous }(config.Cfg)
+	testConfig := *config.Cfg
+	config.Cfg = &testConfig
+
+	dataDir, dirErr := ioutil.TempDir("", "retention_test")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(dataDir)
+
+	config.Cfg.CrashReportDir = filepath.Join(dataDir, "crash_reports")
+	config.Cfg.UpdateQuarantineDir = filepath.Join(dataDir, "update_quarantine")
+	config.Cfg.UpdateCacheDir = filepath.Join(dataDir, "update_cache")
+	config.Cfg.RetentionDays = map[string]int{config.RETENTION_LOGS: 30, config.RETENTION_UPDATES: 7}
+	config.Cfg.SecureDelete = true
+
+	old := time.Now().AddDate(0, 0, -40)
+	write := func(filePath string, modified time.Time) {
+		os.MkdirAll(filepath.Dir(filePath), 0755)
+		if writeErr := ioutil.WriteFile(filePath, []byte("agent data"), 0644); writeErr != nil {
+			t.Fatal(writeErr)
+		}
+		os.Chtimes(filePath, modified, modified)
+	}
+
+	expiredLog := "retention_test_expired.log"
+	defer os.Remove(expiredLog)
+	write(expiredLog, old)
+	write(filepath.Join(config.Cfg.CrashReportDir, "crash.txt"), time.Now().AddDate(0, 0, -10))
+	write(filepath.Join(config.Cfg.UpdateQuarantineDir, "anon-eth-net.rejected"), time.Now().AddDate(0, 0, -10))
+	write(filepath.Join(config.Cfg.UpdateQuarantineDir, "anon-eth-net"), time.Now())
+	write(filepath.Join(config.Cfg.UpdateCacheDir, "0123abcd"), time.Now())
+
+	// the log still being written to is old but kept
+	openLog := logger.OpenLogFiles()[0]
+	os.Chtimes(openLog, old, old)
+
+	cleanups := Clean()
+	if len(cleanups) != 2 || cleanups[0].String() != "logs kept for 30 days: removed 1 files, 10 bytes" || cleanups[1].String() != "updates kept for 7 days: removed 1 files, 10 bytes" {
+		t.Errorf("expected the expired log and update to be removed, got: %v", cleanups)
+	}
+
+	for filePath, kept := range map[string]bool{
+		expiredLog: false,
+		openLog:    true,
+		filepath.Join(config.Cfg.CrashReportDir, "crash.txt"):                  true,
+		filepath.Join(config.Cfg.UpdateQuarantineDir, "anon-eth-net.rejected"): false,
+		filepath.Join(config.Cfg.UpdateQuarantineDir, "anon-eth-net"):          true,
+		filepath.Join(config.Cfg.UpdateCacheDir, "0123abcd"):                   true,
+	} {
+		if _, statErr := os.Stat(filePath); (statErr == nil) != kept {
+			t.Errorf("expected %v to be kept: %v, got: %v", filePath, kept, statErr)
+		}
+	}
+}
+
+func TestOverwrite(t *testing.T) {
+
+	secret := bytes.Repeat([]byte("wallet passphrase "), 10000)
+	secretFile, createErr := ioutil.TempFile("", "retention_test")
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	defer os.Remove(secretFile.Name())
+	secretFile.Write(secret)
+	secretFile.Close()
+
+	if overwriteErr := overwrite(secretFile.Name()); overwriteErr != nil {
+		t.Fatal(overwriteErr)
+	}
+
+	overwritten, _ := ioutil.ReadFile(secretFile.Name())
+	if len(overwritten) != len(secret) || bytes.Contains(overwritten, []byte("passphrase")) {
+		t.Errorf("expected the whole file to be overwritten in place, got %d bytes", len(overwritten))
+	}
+}
+
+func TestWipe(t *testing.T) {
+
+	defer func(previous *config.Config) { config.Cfg = previous }(config.Cfg)
+	testConfig := *config.Cfg
+	config.Cfg = &testConfig
+
+	// the assets a wipe deletes are put back afterwards
+	for _, asset := range []string{CONFIG_ASSET, KEY_ASSET} {
+		assetPath, pathErr := utils.AssetPath(asset)
+		if pathErr != nil {
+			t.Fatal(pathErr)
+		}
+		original, readErr := ioutil.ReadFile(assetPath)
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		defer ioutil.WriteFile(assetPath, original, 0644)
+	}
+
+	dataDir, dirErr := ioutil.TempDir("", "retention_test")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(dataDir)
+
+	config.Cfg.CrashReportDir = filepath.Join(dataDir, "crash_reports")
+	config.Cfg.OperationsDir = filepath.Join(dataDir, "operations")
+	config.Cfg.AuditLogFile = filepath.Join(dataDir, "audit.jsonl")
+	config.Cfg.StateFile = filepath.Join(dataDir, "agent_state.json")
+	config.Cfg.IntegrityKeyFile = filepath.Join(dataDir, "integrity.key")
+	config.Cfg.RestACMECacheDir = filepath.Join(dataDir, "acme")
+	config.Cfg.UpdateQuarantineDir = filepath.Join(dataDir, "update_quarantine")
+	config.Cfg.UpdateCacheDir = filepath.Join(dataDir, "update_cache")
+	config.Cfg.RestKeyFile = ""
+
+	kept := filepath.Join(dataDir, "not_agent_data.txt")
+	agentData := []string{
+		filepath.Join(config.Cfg.CrashReportDir, "crash.txt"),
+		filepath.Join(config.Cfg.OperationsDir, "1234.json"),
+		filepath.Join(config.Cfg.RestACMECacheDir, "nested", "account.key"),
+		filepath.Join(config.Cfg.UpdateQuarantineDir, "anon-eth-net"),
+		filepath.Join(config.Cfg.UpdateCacheDir, "0123abcd"),
+		config.Cfg.AuditLogFile,
+		config.Cfg.StateFile,
+		config.Cfg.IntegrityKeyFile,
+	}
+	for _, filePath := range append(agentData, kept) {
+		os.MkdirAll(filepath.Dir(filePath), 0755)
+		if writeErr := ioutil.WriteFile(filePath, []byte("agent data"), 0600); writeErr != nil {
+			t.Fatal(writeErr)
+		}
+	}
+
+	if failed := Wipe(); len(failed) != 0 {
+		t.Errorf("expected everything to be wiped, got: %v", failed)
+	}
+
+	for _, filePath := range append(agentData, logger.OpenLogFiles()...) {
+		if _, statErr := os.Stat(filePath); !os.IsNotExist(statErr) {
+			t.Errorf("expected %v to be wiped, got: %v", filePath, statErr)
+		}
+	}
+	for _, asset := range []string{CONFIG_ASSET, KEY_ASSET} {
+		if _, pathErr := utils.AssetPath(asset); pathErr == nil {
+			t.Errorf("expected the %v asset to be wiped", asset)
+		}
+	}
+	if _, statErr := os.Stat(kept); statErr != nil {
+		t.Errorf("expected files which aren't the agent's to be kept, got: %v", statErr)
+	}
+}
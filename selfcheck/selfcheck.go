@@ -0,0 +1,274 @@
+// The selfcheck package runs a check of every dependency of the agent when it
+// starts, such as the config, the log directory, the network and the REST
+// listener. A failed check doesn't stop the agent. It starts in degraded mode
+// without whatever failed instead, and says so in the logs, in a notification
+// and in every status report, so a single broken dependency can't keep the
+// rest of the agent from running.
+package selfcheck
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/reporter"
+	"github.com/seantcanavan/anon-eth-net/transport"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The names of the checks built in to this package
+const CONFIG_CHECK = "config"
+const LOG_DIR_CHECK = "log directory"
+const NETWORK_CHECK = "network"
+const LISTENER_CHECK = "REST listener"
+
+// The subject of the notification sent when any check fails
+const DEGRADED_SUBJECT = "Started in degraded mode"
+
+// The number of seconds to wait for the network check to get a response
+const NETWORK_CHECK_TIMEOUT_SECONDS = 10
+
+// Result is the outcome of a single check.
+type Result struct {
+	Name    string    `json:"name"`
+	Passed  bool      `json:"passed"`
+	Error   string    `json:"error,omitempty"`
+	Checked time.Time `json:"checked"`
+
+	severity reporter.Severity
+}
+
+// check is a single registered check.
+type check struct {
+	name string
+	run  func() error
+}
+
+var checks []check
+var results []Result
+var lock sync.Mutex
+
+// Register will add a check which is run by Run, in the order it was
+// registered. The check passes if it returns nil.
+func Register(name string, run func() error) {
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	checks = append(checks, check{name: name, run: run})
+}
+
+// Run will run every registered check in order and log the outcome of each.
+// Every check runs even if an earlier one fails.
+func Run() []Result {
+
+	lock.Lock()
+	registered := make([]check, len(checks))
+	copy(registered, checks)
+	lock.Unlock()
+
+	var ran []Result
+	for _, chk := range registered {
+		result := Result{Name: chk.name, Passed: true, Checked: time.Now()}
+		if checkErr := chk.run(); checkErr != nil {
+			result.Passed = false
+			result.Error = checkErr.Error()
+			result.severity = reporter.ErrorSeverity(checkErr)
+			logger.Lgr.LogErrorf("Self check %v failed. Starting without it: %v", chk.name, checkErr)
+		} else {
+			logger.Lgr.LogMessagef("Successfully passed self check: %v", chk.name)
+		}
+		ran = append(ran, result)
+	}
+
+	lock.Lock()
+	results = ran
+	lock.Unlock()
+
+	return ran
+}
+
+// Results returns the outcome of every check from the last Run.
+func Results() []Result {
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	ran := make([]Result, len(results))
+	copy(ran, results)
+	return ran
+}
+
+// Degraded returns whether any check failed in the last Run.
+func Degraded() bool {
+
+	for _, result := range Results() {
+		if !result.Passed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Summary will describe the given results one per line and return whether
+// every one of them passed.
+func Summary(ran []Result) (string, bool) {
+
+	var summary bytes.Buffer
+	allPassed := true
+
+	for _, result := range ran {
+		if result.Passed {
+			summary.WriteString(fmt.Sprintf("%v: ok\n", result.Name))
+		} else {
+			allPassed = false
+			summary.WriteString(fmt.Sprintf("%v: FAILED: %v\n", result.Name, result.Error))
+		}
+	}
+
+	return summary.String(), allPassed
+}
+
+// Report will send a notification listing every check if any of them failed
+// in the last Run. It's sent at the highest reporter.ErrorSeverity of the
+// failures, so a config which isn't valid is CRITICAL while a network which
+// is only down for now is a WARN.
+func Report() error {
+
+	ran := Results()
+	summary, allPassed := Summary(ran)
+	if allPassed {
+		return nil
+	}
+
+	severity := reporter.WARN
+	for _, result := range ran {
+		if !result.Passed && result.severity > severity {
+			severity = result.severity
+		}
+	}
+
+	body := fmt.Sprintf("%v started without everything which failed its self check. Everything else is running.\n\n%v", config.Cfg.DeviceName, summary)
+	return reporter.Notify(severity, DEGRADED_SUBJECT, []byte(body))
+}
+
+// StatusSummary describes the outcome of the last Run for the status report.
+func StatusSummary() (string, error) {
+
+	ran := Results()
+	if len(ran) == 0 {
+		return "No self checks have run\n", nil
+	}
+
+	summary, allPassed := Summary(ran)
+	if allPassed {
+		return "Every self check passed\n" + summary, nil
+	}
+
+	return "Running in degraded mode\n" + summary, nil
+}
+
+// ConfigValid will make sure the config.json asset is still well formed JSON
+// and can be written to, since config changes and shutdown both save it.
+func ConfigValid() error {
+
+	configAssetPath, assetErr := utils.AssetPath("config.json")
+	if assetErr != nil {
+		return assetErr
+	}
+
+	contents, readErr := ioutil.ReadFile(configAssetPath)
+	if readErr != nil {
+		return readErr
+	}
+
+	if !json.Valid(contents) {
+		return config.ErrConfigInvalid{Err: fmt.Errorf("%v isn't valid JSON", configAssetPath)}
+	}
+
+	// opened for appending so nothing in it changes
+	configFile, openErr := os.OpenFile(configAssetPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if openErr != nil {
+		return openErr
+	}
+
+	return configFile.Close()
+}
+
+// LogDirWritable will make sure a new file can be written next to the
+// current log file so the logs can keep rotating.
+func LogDirWritable() error {
+
+	// the full path, as the log file may be within the LogDir
+	return writable(filepath.Dir(logger.Lgr.CurrentLogFile().Name()))
+}
+
+// NetworkReachable will make sure the primary RemoteVersionURI answers within
+// NETWORK_CHECK_TIMEOUT_SECONDS. Any response counts. The agent is marked
+// offline if it doesn't so notifications are queued straight away.
+func NetworkReachable() error {
+
+	client := transport.HTTPClient(NETWORK_CHECK_TIMEOUT_SECONDS * time.Second)
+
+	response, headErr := client.Head(config.Cfg.RemoteVersionURI.Primary())
+	if headErr != nil {
+		transport.MarkOffline()
+		return headErr
+	}
+	response.Body.Close()
+
+	return nil
+}
+
+// ListenerBindable will make sure the port in RestListenAddress isn't already
+// taken. Passes when the REST subsystem is turned off or the port is picked
+// when the server starts.
+func ListenerBindable() error {
+
+	address := config.Cfg.RestListenAddress
+	if address == "" || !config.Enabled(config.SUBSYSTEM_REST) {
+		return nil
+	}
+
+	// the address is resolved against RestListenInterface when the server
+	// starts so only the port can be checked here
+	if config.Cfg.RestListenInterface != "" {
+		_, port, splitErr := net.SplitHostPort(address)
+		if splitErr != nil {
+			return splitErr
+		}
+		address = net.JoinHostPort("", port)
+	}
+
+	return utils.PortFree(address)
+}
+
+// writable will make sure a file can be created in the given directory.
+func writable(dir string) error {
+
+	probe, createErr := ioutil.TempFile(dir, ".selfcheck")
+	if createErr != nil {
+		return createErr
+	}
+
+	_, writeErr := probe.Write([]byte("ok"))
+	closeErr := probe.Close()
+	removeErr := os.Remove(probe.Name())
+
+	if writeErr != nil {
+		return writeErr
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return removeErr
+}
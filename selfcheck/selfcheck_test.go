@@ -0,0 +1,86 @@
+package selfcheck
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+func TestMain(m *testing.M) {
+
+	logErr := logger.StandardLogger("selfcheck_test")
+	if logErr != nil {
+		fmt.Println(fmt.Sprintf("Could not initialize logger: %v", logErr))
+		return
+	}
+
+	configErr := config.FromFile()
+	if configErr != nil {
+		return
+	}
+
+	result := m.Run()
+	os.Exit(result)
+}
+
+func TestRun(t *testing.T) {
+
+	if summary, _ := StatusSummary(); summary != "No self checks have run\n" {
+		t.Errorf("unexpected summary before any checks ran: %v", summary)
+	}
+
+	ranAfterFailure := false
+	Register(CONFIG_CHECK, ConfigValid)
+	Register(LOG_DIR_CHECK, LogDirWritable)
+	Register("broken", func() error { return fmt.Errorf("it's broken") })
+	Register("after", func() error {
+		ranAfterFailure = true
+		return nil
+	})
+
+	ran := Run()
+	if len(ran) != 4 || !ran[0].Passed || !ran[1].Passed || ran[2].Passed || !ran[3].Passed {
+		t.Errorf("expected only the broken check to fail, got: %+v", ran)
+	}
+
+	if !ranAfterFailure {
+		t.Errorf("expected every check to run after one fails")
+	}
+
+	if !Degraded() {
+		t.Errorf("expected a failed check to mean degraded mode")
+	}
+
+	summary, _ := StatusSummary()
+	if !strings.HasPrefix(summary, "Running in degraded mode\n") || !strings.Contains(summary, "broken: FAILED: it's broken\n") || !strings.Contains(summary, "config: ok\n") {
+		t.Errorf("unexpected summary: %v", summary)
+	}
+}
+
+func TestListenerBindable(t *testing.T) {
+
+	taken, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	defer taken.Close()
+
+	defer func(address string) {
+		config.Cfg.RestListenAddress = address
+	}(config.Cfg.RestListenAddress)
+
+	config.Cfg.RestListenAddress = taken.Addr().String()
+	if bindErr := ListenerBindable(); bindErr == nil {
+		t.Errorf("expected a port which is already taken to fail")
+	}
+
+	config.Cfg.RestListenAddress = ""
+	if bindErr := ListenerBindable(); bindErr != nil {
+		t.Errorf("expected a random port to pass, got: %v", bindErr)
+	}
+}
@@ -0,0 +1,413 @@
+// The service package installs the agent as a service which starts on boot and
+// is restarted when it fails: a systemd unit on linux, a launchd daemon on mac
+// and a service control manager service on windows. The binary and the assets
+// directory are copied to a standard location first so the service doesn't
+// depend on wherever the agent was unpacked.
+package service
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/privileged"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The name the service is registered under
+const SERVICE_NAME = "anon-eth-net"
+
+// The label of the launchd daemon on mac
+const LAUNCHD_LABEL = "com.seantcanavan.anon-eth-net"
+
+// Where the systemd unit is written on linux
+const SYSTEMD_UNIT_PATH = "/etc/systemd/system/anon-eth-net.service"
+
+// Where the launchd daemon is written on mac
+const LAUNCHD_PLIST_PATH = "/Library/LaunchDaemons/com.seantcanavan.anon-eth-net.plist"
+
+// How long to wait before restarting the agent after it fails. In seconds
+const RESTART_DELAY_SECONDS = 10
+
+// How long the service manager waits for the agent to stop before killing it.
+// Longer than the shutdown deadline of the lifecycle package. In seconds
+const STOP_TIMEOUT_SECONDS = 45
+
+// InstallDir returns the directory the agent is installed into on this
+// platform. The binary goes in its bin directory, which the service runs from,
+// so the assets directory beside it is found the same way as during
+// development.
+func InstallDir() string {
+	switch runtime.GOOS {
+	case "windows":
+		programFiles := os.Getenv("ProgramFiles")
+		if programFiles == "" {
+			programFiles = `C:\Program Files`
+		}
+		return filepath.Join(programFiles, SERVICE_NAME)
+	case "darwin":
+		return filepath.Join("/usr/local", SERVICE_NAME)
+	default:
+		return filepath.Join("/opt", SERVICE_NAME)
+	}
+}
+
+// binaryPath returns where the binary is installed to inside installDir.
+func binaryPath(installDir string) string {
+	binaryName := SERVICE_NAME
+	if runtime.GOOS == "windows" {
+		binaryName += ".exe"
+	}
+	return filepath.Join(installDir, "bin", binaryName)
+}
+
+// Install will copy the running binary and the assets directory into
+// InstallDir, register the agent as a service which restarts on failure and
+// starts on boot, and start it. Installing again replaces the binary, assets
+// and service definition of the previous install. Needs to run as root, or as
+// an administrator on windows.
+func Install() error {
+
+	if runtime.GOOS != "windows" && os.Geteuid() != 0 {
+		return fmt.Errorf("Installing the service needs to run as root")
+	}
+
+	installDir := InstallDir()
+	if copyErr := copyInstallation(installDir); copyErr != nil {
+		return copyErr
+	}
+
+	binary := binaryPath(installDir)
+	workDir := filepath.Dir(binary)
+
+	var registerErr error
+	switch runtime.GOOS {
+	case "linux":
+		registerErr = installSystemd(binary, workDir)
+	case "darwin":
+		registerErr = installLaunchd(binary, workDir)
+	case "windows":
+		registerErr = installWindows(binary)
+	default:
+		registerErr = fmt.Errorf("Installing as a service isn't supported on %v", runtime.GOOS)
+	}
+
+	if registerErr != nil {
+		return registerErr
+	}
+
+	logger.Lgr.LogMessagef("Successfully installed and started the %v service from %v", SERVICE_NAME, installDir)
+	return nil
+}
+
+// Uninstall will stop the service, stop it starting on boot, remove the
+// service definition and then delete InstallDir along with the config, logs
+// and anything else inside it.
+func Uninstall() error {
+
+	if runtime.GOOS != "windows" && os.Geteuid() != 0 {
+		return fmt.Errorf("Uninstalling the service needs to run as root")
+	}
+
+	var removeErr error
+	switch runtime.GOOS {
+	case "linux":
+		removeErr = uninstallSystemd()
+	case "darwin":
+		removeErr = uninstallLaunchd()
+	case "windows":
+		removeErr = uninstallWindows()
+	default:
+		removeErr = fmt.Errorf("Installing as a service isn't supported on %v", runtime.GOOS)
+	}
+
+	if removeErr != nil {
+		return removeErr
+	}
+
+	installDir := InstallDir()
+	if deleteErr := os.RemoveAll(installDir); deleteErr != nil {
+		return deleteErr
+	}
+
+	logger.Lgr.LogMessagef("Successfully uninstalled the %v service and removed %v", SERVICE_NAME, installDir)
+	return nil
+}
+
+// SystemdUnit returns the systemd unit which runs the given binary from the
+// given working directory, restarts it when it fails and starts it on boot
+// once the network is up.
+func SystemdUnit(binary string, workDir string) string {
+	return fmt.Sprintf(`[Unit]
+Description=anon-eth-net agent
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=simple
+ExecStart="%v" %v
+WorkingDirectory=%v
+Restart=on-failure
+RestartSec=%d
+TimeoutStopSec=%d
+KillSignal=SIGTERM
+
+[Install]
+WantedBy=multi-user.target
+`, binary, serviceCommand(), workDir, RESTART_DELAY_SECONDS, STOP_TIMEOUT_SECONDS)
+}
+
+// LaunchdPlist returns the launchd daemon which runs the given binary from the
+// given working directory at boot and restarts it whenever it exits with a
+// non zero status.
+func LaunchdPlist(binary string, workDir string) string {
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%v</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>%v</string>
+		<string>%v</string>
+	</array>
+	<key>WorkingDirectory</key>
+	<string>%v</string>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>ThrottleInterval</key>
+	<integer>%d</integer>
+	<key>ExitTimeOut</key>
+	<integer>%d</integer>
+</dict>
+</plist>
+`, LAUNCHD_LABEL, html.EscapeString(binary), serviceCommand(), html.EscapeString(workDir), RESTART_DELAY_SECONDS, STOP_TIMEOUT_SECONDS)
+}
+
+// WindowsCommands returns the sc.exe invocations which register the given
+// binary as a service starting on boot, restart it after a failure and start
+// it.
+func WindowsCommands(binary string) [][]string {
+	restartDelay := fmt.Sprintf("restart/%d", RESTART_DELAY_SECONDS*1000)
+	return [][]string{
+		{"sc.exe", "create", SERVICE_NAME, "binPath=", fmt.Sprintf(`"%v" run`, binary), "start=", "auto", "DisplayName=", SERVICE_NAME},
+		{"sc.exe", "description", SERVICE_NAME, "anon-eth-net agent"},
+		{"sc.exe", "failure", SERVICE_NAME, "reset=", "86400", "actions=", strings.Join([]string{restartDelay, restartDelay, restartDelay}, "/")},
+		{"sc.exe", "failureflag", SERVICE_NAME, "1"},
+		{"sc.exe", "start", SERVICE_NAME},
+	}
+}
+
+// serviceCommand returns the subcommand the service runs: the privileged
+// helper when the agent is to run as AgentUser, or the agent itself.
+func serviceCommand() string {
+	if config.Cfg != nil && config.Cfg.AgentUser != "" {
+		return privileged.HELPER_COMMAND
+	}
+	return "run"
+}
+
+// installSystemd will write the systemd unit, enable it and start it. A copy
+// which is already running is restarted so it picks up the new binary.
+func installSystemd(binary string, workDir string) error {
+
+	if writeErr := ioutil.WriteFile(SYSTEMD_UNIT_PATH, []byte(SystemdUnit(binary, workDir)), 0644); writeErr != nil {
+		return writeErr
+	}
+
+	if reloadErr := runCommand("systemctl", "daemon-reload"); reloadErr != nil {
+		return reloadErr
+	}
+
+	if enableErr := runCommand("systemctl", "enable", SERVICE_NAME); enableErr != nil {
+		return enableErr
+	}
+
+	return runCommand("systemctl", "restart", SERVICE_NAME)
+}
+
+// uninstallSystemd will stop and disable the systemd unit and remove it.
+func uninstallSystemd() error {
+
+	if disableErr := runCommand("systemctl", "disable", "--now", SERVICE_NAME); disableErr != nil {
+		logger.Lgr.LogErrorf("Failed to disable the %v service, removing it anyway: %v", SERVICE_NAME, disableErr)
+	}
+
+	if removeErr := os.Remove(SYSTEMD_UNIT_PATH); removeErr != nil && !os.IsNotExist(removeErr) {
+		return removeErr
+	}
+
+	return runCommand("systemctl", "daemon-reload")
+}
+
+// installLaunchd will write the launchd daemon and load it, which starts it.
+// A daemon left behind by a previous install is unloaded first.
+func installLaunchd(binary string, workDir string) error {
+
+	if _, statErr := os.Stat(LAUNCHD_PLIST_PATH); statErr == nil {
+		runCommand("launchctl", "unload", LAUNCHD_PLIST_PATH)
+	}
+
+	if writeErr := ioutil.WriteFile(LAUNCHD_PLIST_PATH, []byte(LaunchdPlist(binary, workDir)), 0644); writeErr != nil {
+		return writeErr
+	}
+
+	return runCommand("launchctl", "load", "-w", LAUNCHD_PLIST_PATH)
+}
+
+// uninstallLaunchd will unload the launchd daemon, which stops it, and remove
+// it.
+func uninstallLaunchd() error {
+
+	if unloadErr := runCommand("launchctl", "unload", "-w", LAUNCHD_PLIST_PATH); unloadErr != nil {
+		logger.Lgr.LogErrorf("Failed to unload the %v daemon, removing it anyway: %v", LAUNCHD_LABEL, unloadErr)
+	}
+
+	if removeErr := os.Remove(LAUNCHD_PLIST_PATH); removeErr != nil && !os.IsNotExist(removeErr) {
+		return removeErr
+	}
+
+	return nil
+}
+
+// installWindows will register, configure and start the windows service. A
+// service left behind by a previous install is removed first.
+func installWindows(binary string) error {
+
+	if runCommand("sc.exe", "query", SERVICE_NAME) == nil {
+		if removeErr := uninstallWindows(); removeErr != nil {
+			return removeErr
+		}
+	}
+
+	for _, command := range WindowsCommands(binary) {
+		if commandErr := runCommand(command[0], command[1:]...); commandErr != nil {
+			return commandErr
+		}
+	}
+
+	return nil
+}
+
+// uninstallWindows will stop and delete the windows service.
+func uninstallWindows() error {
+
+	if stopErr := runCommand("sc.exe", "stop", SERVICE_NAME); stopErr != nil {
+		logger.Lgr.LogErrorf("Failed to stop the %v service, deleting it anyway: %v", SERVICE_NAME, stopErr)
+	}
+
+	return runCommand("sc.exe", "delete", SERVICE_NAME)
+}
+
+// runCommand will run the given command and return its output as part of the
+// error when it fails.
+func runCommand(name string, args ...string) error {
+
+	output, runErr := exec.Command(name, args...).CombinedOutput()
+	if runErr != nil {
+		return fmt.Errorf("%v %v failed: %v %v", name, strings.Join(args, " "), runErr, strings.TrimSpace(string(output)))
+	}
+
+	logger.Lgr.LogMessagef("Successfully ran %v %v", name, strings.Join(args, " "))
+	return nil
+}
+
+// copyInstallation will copy the running binary into the bin directory of the
+// given install directory and the assets directory alongside it. The service
+// may already be running from there so the binary is replaced by renaming a
+// copy over it rather than writing to it in place.
+func copyInstallation(installDir string) error {
+
+	executable, executableErr := os.Executable()
+	if executableErr != nil {
+		return executableErr
+	}
+
+	assetDir, assetErr := filepath.Abs(filepath.Join("..", utils.ASSET_ROOT_DIR))
+	if assetErr != nil {
+		return assetErr
+	}
+
+	if _, statErr := os.Stat(assetDir); statErr != nil {
+		return fmt.Errorf("Unable to find the assets directory to install at %v: %v", assetDir, statErr)
+	}
+
+	binary := binaryPath(installDir)
+	if mkdirErr := os.MkdirAll(filepath.Dir(binary), 0755); mkdirErr != nil {
+		return mkdirErr
+	}
+
+	if copyErr := copyFile(executable, binary+".new", 0755); copyErr != nil {
+		return copyErr
+	}
+
+	if renameErr := os.Rename(binary+".new", binary); renameErr != nil {
+		return renameErr
+	}
+
+	if copyErr := copyDir(assetDir, filepath.Join(installDir, utils.ASSET_ROOT_DIR)); copyErr != nil {
+		return copyErr
+	}
+
+	logger.Lgr.LogMessagef("Successfully copied %v and %v into %v", executable, assetDir, installDir)
+	return nil
+}
+
+// copyDir will copy every file under source into destination, keeping the
+// permissions of each file so the config stays as private as it was.
+func copyDir(source string, destination string) error {
+
+	return filepath.Walk(source, func(path string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+
+		relative, relativeErr := filepath.Rel(source, path)
+		if relativeErr != nil {
+			return relativeErr
+		}
+
+		target := filepath.Join(destination, relative)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+
+		return copyFile(path, target, info.Mode().Perm())
+	})
+}
+
+// copyFile will copy source to destination with the given permissions.
+func copyFile(source string, destination string, mode os.FileMode) error {
+
+	in, openErr := os.Open(source)
+	if openErr != nil {
+		return openErr
+	}
+	defer in.Close()
+
+	out, createErr := os.OpenFile(destination, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if createErr != nil {
+		return createErr
+	}
+
+	if _, copyErr := io.Copy(out, in); copyErr != nil {
+		out.Close()
+		return copyErr
+	}
+
+	return out.Close()
+}
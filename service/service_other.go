@@ -0,0 +1,14 @@
+//go:build !windows
+
+package service
+
+// Supervise does nothing outside of windows. systemd and launchd run the agent
+// from the working directory in its service definition and stop it with
+// SIGTERM.
+func Supervise() error {
+	return nil
+}
+
+// Wait returns straight away outside of windows.
+func Wait() {
+}
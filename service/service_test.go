@@ -0,0 +1,119 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/privileged"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+func TestMain(m *testing.M) {
+
+	logErr := logger.StandardLogger("service_test")
+	if logErr != nil {
+		fmt.Println(fmt.Sprintf("Could not initialize logger: %v", logErr))
+		return
+	}
+
+	result := m.Run()
+	os.Exit(result)
+}
+
+func TestServiceDefinitions(t *testing.T) {
+
+	unit := SystemdUnit("/opt/anon-eth-net/bin/anon-eth-net", "/opt/anon-eth-net/bin")
+	for _, line := range []string{
+		`ExecStart="/opt/anon-eth-net/bin/anon-eth-net" run`,
+		"WorkingDirectory=/opt/anon-eth-net/bin",
+		"Restart=on-failure",
+		"WantedBy=multi-user.target",
+		fmt.Sprintf("TimeoutStopSec=%d", STOP_TIMEOUT_SECONDS),
+	} {
+		if !strings.Contains(unit, line+"\n") {
+			t.Errorf("expected the systemd unit to contain %v:\n%v", line, unit)
+		}
+	}
+
+	plist := LaunchdPlist("/usr/local/anon & co/bin/anon-eth-net", "/usr/local/anon & co/bin")
+	for _, element := range []string{
+		"<string>/usr/local/anon &amp; co/bin/anon-eth-net</string>",
+		"<key>RunAtLoad</key>\n\t<true/>",
+		"<key>SuccessfulExit</key>\n\t\t<false/>",
+	} {
+		if !strings.Contains(plist, element) {
+			t.Errorf("expected the launchd plist to contain %v:\n%v", element, plist)
+		}
+	}
+
+	commands := WindowsCommands(`C:\Program Files\anon-eth-net\bin\anon-eth-net.exe`)
+	if commands[0][4] != `"C:\Program Files\anon-eth-net\bin\anon-eth-net.exe" run` || commands[0][6] != "auto" {
+		t.Errorf("expected the windows service to run the quoted binary on boot: %v", commands[0])
+	}
+	if !strings.Contains(strings.Join(commands[2], " "), "actions= restart/") {
+		t.Errorf("expected the windows service to restart on failure: %v", commands[2])
+	}
+	if commands[len(commands)-1][1] != "start" {
+		t.Errorf("expected the windows service to be started last: %v", commands[len(commands)-1])
+	}
+
+	// the privileged helper is run instead when the agent runs as another user
+	defer func(cfg *config.Config) {
+		config.Cfg = cfg
+	}(config.Cfg)
+	config.Cfg = &config.Config{AgentUser: "anon"}
+
+	unit = SystemdUnit("/opt/anon-eth-net/bin/anon-eth-net", "/opt/anon-eth-net/bin")
+	if !strings.Contains(unit, `ExecStart="/opt/anon-eth-net/bin/anon-eth-net" `+privileged.HELPER_COMMAND+"\n") {
+		t.Errorf("expected the systemd unit to run the privileged helper:\n%v", unit)
+	}
+}
+
+func TestCopyInstallation(t *testing.T) {
+
+	installDir, tempErr := ioutil.TempDir("", "service_test")
+	if tempErr != nil {
+		t.Fatal(tempErr)
+	}
+	defer os.RemoveAll(installDir)
+
+	// installing twice replaces the previous copy
+	for attempt := 0; attempt < 2; attempt++ {
+		if copyErr := copyInstallation(installDir); copyErr != nil {
+			t.Fatal(copyErr)
+		}
+	}
+
+	binaryInfo, statErr := os.Stat(binaryPath(installDir))
+	if statErr != nil {
+		t.Fatal(statErr)
+	}
+	if binaryInfo.Mode().Perm()&0100 == 0 {
+		t.Errorf("expected the installed binary to be executable, got %v", binaryInfo.Mode())
+	}
+
+	configPath, pathErr := utils.AssetPath("config.json")
+	if pathErr != nil {
+		t.Fatal(pathErr)
+	}
+
+	original, readErr := ioutil.ReadFile(configPath)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+
+	installed, installedErr := ioutil.ReadFile(filepath.Join(installDir, utils.ASSET_ROOT_DIR, "config.json"))
+	if installedErr != nil {
+		t.Fatal(installedErr)
+	}
+
+	if string(original) != string(installed) {
+		t.Errorf("expected the installed config.json to match the original")
+	}
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/seantcanavan/anon-eth-net/lifecycle"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"golang.org/x/sys/windows/svc"
+)
+
+var stopped = make(chan struct{})
+var supervised bool
+
+// agentService answers the windows service control manager on behalf of the
+// agent.
+type agentService struct{}
+
+// Execute reports the agent as running and shuts it down when the service
+// control manager asks it to stop. Returns once the agent has shut down,
+// whoever started the shutdown.
+func (agentService) Execute(args []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for 1 == 1 {
+		select {
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				changes <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				lifecycle.Shutdown("the service was stopped")
+				return false, 0
+			}
+		case <-lifecycle.Done():
+			changes <- svc.Status{State: svc.StopPending}
+			return false, 0
+		}
+	}
+
+	return false, 0
+}
+
+// Supervise will, when the agent was started by the windows service control
+// manager, change into the directory of the binary so the assets directory is
+// found and answer the service control manager until the agent shuts down.
+// Services start in the system directory otherwise. Does nothing when the agent
+// was started any other way. Call before anything loads an asset.
+func Supervise() error {
+
+	isService, checkErr := svc.IsWindowsService()
+	if checkErr != nil {
+		return checkErr
+	}
+	if !isService {
+		close(stopped)
+		return nil
+	}
+
+	executable, executableErr := os.Executable()
+	if executableErr != nil {
+		return executableErr
+	}
+	if chdirErr := os.Chdir(filepath.Dir(executable)); chdirErr != nil {
+		return chdirErr
+	}
+
+	supervised = true
+	go func() {
+		defer close(stopped)
+		if runErr := svc.Run(SERVICE_NAME, agentService{}); runErr != nil {
+			logger.Lgr.LogErrorf("The %v service failed: %v", SERVICE_NAME, runErr)
+		}
+	}()
+
+	return nil
+}
+
+// Wait will block until the service control manager has been told the agent
+// stopped, so exiting straight after isn't mistaken for a crash. Returns
+// straight away when the agent isn't running as a service.
+func Wait() {
+	if supervised {
+		<-stopped
+	}
+}
@@ -0,0 +1,433 @@
+// The state package is a small embedded key-value store for everything the
+// agent needs to remember across restarts, such as queued notifications, the
+// fleet backlog, job restart counters and the update history. Values are kept
+// in named buckets, encoded as JSON, and held in memory with every change
+// written through to a single StateFile which is replaced atomically so a
+// crash can never leave it half written.
+//
+// Changes are made inside Update, which either commits all of them or none:
+//
+//	state.Update(func(tx *state.Tx) error {
+//		return tx.Bucket("jobs").Put("miner", runs)
+//	})
+//
+// and read inside View, or with the Get, Put, Delete and Keys shortcuts for a
+// single value. A transaction must not call the package level functions
+// itself.
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+// The version of the layout of the state file
+const FORMAT_VERSION = 1
+
+// Store is a set of buckets of JSON values saved to a single file.
+type Store struct {
+	path    string
+	buckets map[string]map[string]json.RawMessage
+	lock    sync.Mutex
+}
+
+// stateFile is the layout of the state file on disk.
+type stateFile struct {
+	Version int                                   `json:"version"`
+	Buckets map[string]map[string]json.RawMessage `json:"buckets"`
+}
+
+// Tx is a single transaction against a store. Buckets are only created and
+// changed by transactions started via Update.
+type Tx struct {
+	store    *Store
+	writable bool
+	changed  map[string]map[string]json.RawMessage
+}
+
+// Bucket is a named set of keys within a transaction.
+type Bucket struct {
+	tx   *Tx
+	name string
+}
+
+var defaultStore *Store
+var defaultLock sync.Mutex
+
+// NewStore will load the store saved at the given path, or start an empty one
+// if nothing has been saved there yet.
+func NewStore(path string) (*Store, error) {
+
+	store := &Store{path: path, buckets: make(map[string]map[string]json.RawMessage)}
+
+	contents, readErr := ioutil.ReadFile(path)
+	if os.IsNotExist(readErr) {
+		return store, nil
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	var saved stateFile
+	if jsonErr := json.Unmarshal(contents, &saved); jsonErr != nil {
+		return nil, fmt.Errorf("Unable to read the state file %v: %v", path, jsonErr)
+	}
+
+	if saved.Version > FORMAT_VERSION {
+		return nil, fmt.Errorf("The state file %v was written by a newer version of the agent in format %d", path, saved.Version)
+	}
+
+	if saved.Buckets != nil {
+		store.buckets = saved.Buckets
+	}
+
+	return store, nil
+}
+
+// Path returns the file the store is saved to.
+func (st *Store) Path() string {
+	return st.path
+}
+
+// View will call the given function with a read only transaction.
+func (st *Store) View(fn func(tx *Tx) error) error {
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	return fn(&Tx{store: st})
+}
+
+// Update will call the given function with a writable transaction. Its
+// changes are saved if it returns nil and discarded otherwise, as they are if
+// they can't be saved.
+func (st *Store) Update(fn func(tx *Tx) error) error {
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	tx := &Tx{store: st, writable: true, changed: make(map[string]map[string]json.RawMessage)}
+	if txErr := fn(tx); txErr != nil {
+		return txErr
+	}
+
+	if len(tx.changed) == 0 {
+		return nil
+	}
+
+	buckets := make(map[string]map[string]json.RawMessage, len(st.buckets))
+	for name, items := range st.buckets {
+		buckets[name] = items
+	}
+	for name, items := range tx.changed {
+		if len(items) == 0 {
+			delete(buckets, name)
+			continue
+		}
+		buckets[name] = items
+	}
+
+	if saveErr := save(st.path, buckets); saveErr != nil {
+		return saveErr
+	}
+
+	st.buckets = buckets
+	return nil
+}
+
+// save will replace the file at the given path with the given buckets.
+func save(path string, buckets map[string]map[string]json.RawMessage) error {
+
+	contents, jsonErr := json.Marshal(stateFile{Version: FORMAT_VERSION, Buckets: buckets})
+	if jsonErr != nil {
+		return jsonErr
+	}
+
+	if dir := filepath.Dir(path); dir != "." {
+		if mkdirErr := os.MkdirAll(dir, 0700); mkdirErr != nil {
+			return mkdirErr
+		}
+	}
+
+	tempPath := path + ".tmp"
+
+	temp, createErr := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if createErr != nil {
+		return createErr
+	}
+
+	if _, writeErr := temp.Write(contents); writeErr != nil {
+		temp.Close()
+		return writeErr
+	}
+
+	if syncErr := temp.Sync(); syncErr != nil {
+		temp.Close()
+		return syncErr
+	}
+
+	if closeErr := temp.Close(); closeErr != nil {
+		return closeErr
+	}
+
+	return os.Rename(tempPath, path)
+}
+
+// Bucket returns the bucket with the given name. A bucket which doesn't exist
+// yet is empty and is created by the first Put.
+func (tx *Tx) Bucket(name string) *Bucket {
+	return &Bucket{tx: tx, name: name}
+}
+
+// Buckets returns the name of every bucket, sorted.
+func (tx *Tx) Buckets() []string {
+
+	var names []string
+	for name := range tx.store.buckets {
+		if items, changed := tx.changed[name]; !changed || len(items) > 0 {
+			names = append(names, name)
+		}
+	}
+	for name, items := range tx.changed {
+		if _, existed := tx.store.buckets[name]; !existed && len(items) > 0 {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Get will decode the value of the given key into value. Returns false if the
+// key doesn't exist.
+func (bucket *Bucket) Get(key string, value interface{}) (bool, error) {
+
+	raw, exists := bucket.items()[key]
+	if !exists {
+		return false, nil
+	}
+
+	return true, json.Unmarshal(raw, value)
+}
+
+// Has returns whether the given key exists.
+func (bucket *Bucket) Has(key string) bool {
+	_, exists := bucket.items()[key]
+	return exists
+}
+
+// Put will set the given key to the JSON encoding of value.
+func (bucket *Bucket) Put(key string, value interface{}) error {
+
+	raw, jsonErr := json.Marshal(value)
+	if jsonErr != nil {
+		return jsonErr
+	}
+
+	items, writeErr := bucket.writableItems()
+	if writeErr != nil {
+		return writeErr
+	}
+
+	items[key] = raw
+	return nil
+}
+
+// Delete will remove the given key. Removing the last key removes the bucket.
+func (bucket *Bucket) Delete(key string) error {
+
+	if _, exists := bucket.items()[key]; !exists {
+		return nil
+	}
+
+	items, writeErr := bucket.writableItems()
+	if writeErr != nil {
+		return writeErr
+	}
+
+	delete(items, key)
+	return nil
+}
+
+// Keys returns every key in the bucket, sorted.
+func (bucket *Bucket) Keys() []string {
+
+	items := bucket.items()
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// items returns the keys of the bucket as changed by the transaction so far.
+func (bucket *Bucket) items() map[string]json.RawMessage {
+
+	if items, changed := bucket.tx.changed[bucket.name]; changed {
+		return items
+	}
+
+	return bucket.tx.store.buckets[bucket.name]
+}
+
+// writableItems returns a copy of the items of the bucket which the
+// transaction can change without touching the store until it's committed.
+func (bucket *Bucket) writableItems() (map[string]json.RawMessage, error) {
+
+	if !bucket.tx.writable {
+		return nil, fmt.Errorf("Cannot change bucket %v in a read only transaction", bucket.name)
+	}
+
+	if items, changed := bucket.tx.changed[bucket.name]; changed {
+		return items, nil
+	}
+
+	current := bucket.tx.store.buckets[bucket.name]
+	items := make(map[string]json.RawMessage, len(current)+1)
+	for key, raw := range current {
+		items[key] = raw
+	}
+
+	bucket.tx.changed[bucket.name] = items
+	return items, nil
+}
+
+// Open will load the store saved at the given path and use it for the package
+// level functions from now on.
+func Open(path string) error {
+
+	store, storeErr := NewStore(path)
+	if storeErr != nil {
+		return storeErr
+	}
+
+	defaultLock.Lock()
+	defaultStore = store
+	defaultLock.Unlock()
+
+	logger.Lgr.LogMessagef("Successfully opened the state store: %v", path)
+	return nil
+}
+
+// ErrNoStore is returned by Default, and the package level functions, when
+// Open hasn't been called and there's no StateFile configured to open.
+var ErrNoStore = errors.New("No state store has been opened and no StateFile is configured")
+
+// Default returns the store used by the package level functions. The
+// StateFile in the config is opened the first time it's needed unless Open
+// has already been called. Returns ErrNoStore when the config hasn't been
+// loaded or has no StateFile.
+func Default() (*Store, error) {
+
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
+
+	if defaultStore != nil {
+		return defaultStore, nil
+	}
+
+	if config.Cfg == nil || config.Cfg.StateFile == "" {
+		return nil, ErrNoStore
+	}
+
+	store, storeErr := NewStore(config.Cfg.StateFile)
+	if storeErr != nil {
+		return nil, storeErr
+	}
+
+	defaultStore = store
+	logger.Lgr.LogMessagef("Successfully opened the state store: %v", config.Cfg.StateFile)
+	return defaultStore, nil
+}
+
+// View will call the given function with a read only transaction against the
+// default store.
+func View(fn func(tx *Tx) error) error {
+
+	store, storeErr := Default()
+	if storeErr != nil {
+		return storeErr
+	}
+
+	return store.View(fn)
+}
+
+// Update will call the given function with a writable transaction against the
+// default store.
+func Update(fn func(tx *Tx) error) error {
+
+	store, storeErr := Default()
+	if storeErr != nil {
+		return storeErr
+	}
+
+	return store.Update(fn)
+}
+
+// Get will decode the value of the given key in the given bucket of the
+// default store into value. Returns false if the key doesn't exist.
+func Get(bucket string, key string, value interface{}) (bool, error) {
+
+	var found bool
+	viewErr := View(func(tx *Tx) error {
+		var getErr error
+		found, getErr = tx.Bucket(bucket).Get(key, value)
+		return getErr
+	})
+
+	return found, viewErr
+}
+
+// Put will set the given key in the given bucket of the default store.
+func Put(bucket string, key string, value interface{}) error {
+	return Update(func(tx *Tx) error {
+		return tx.Bucket(bucket).Put(key, value)
+	})
+}
+
+// Delete will remove the given key from the given bucket of the default
+// store.
+func Delete(bucket string, key string) error {
+	return Update(func(tx *Tx) error {
+		return tx.Bucket(bucket).Delete(key)
+	})
+}
+
+// Keys returns every key in the given bucket of the default store, sorted.
+func Keys(bucket string) ([]string, error) {
+
+	var keys []string
+	viewErr := View(func(tx *Tx) error {
+		keys = tx.Bucket(bucket).Keys()
+		return nil
+	})
+
+	return keys, viewErr
+}
+
+// StatusSummary lists every bucket in the default store along with how many
+// keys it holds.
+func StatusSummary() (string, error) {
+
+	var summary string
+	viewErr := View(func(tx *Tx) error {
+		summary = fmt.Sprintf("Saved to %v\n", tx.store.path)
+		for _, name := range tx.Buckets() {
+			summary += fmt.Sprintf("%v: %d keys\n", name, len(tx.Bucket(name).items()))
+		}
+		return nil
+	})
+
+	return summary, viewErr
+}
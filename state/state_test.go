@@ -0,0 +1,152 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+func TestMain(m *testing.M) {
+
+	logErr := logger.StandardLogger("state_test")
+	if logErr != nil {
+		fmt.Println(fmt.Sprintf("Could not initialize logger: %v", logErr))
+		return
+	}
+
+	configErr := config.FromFile()
+	if configErr != nil {
+		return
+	}
+
+	result := m.Run()
+	os.Exit(result)
+}
+
+func TestStore(t *testing.T) {
+
+	stateDir, dirErr := ioutil.TempDir("", "state_test")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(stateDir)
+
+	statePath := filepath.Join(stateDir, "nested", "agent_state.json")
+
+	store, storeErr := NewStore(statePath)
+	if storeErr != nil {
+		t.Fatal(storeErr)
+	}
+
+	updateErr := store.Update(func(tx *Tx) error {
+		jobs := tx.Bucket("jobs")
+		if putErr := jobs.Put("miner", 3); putErr != nil {
+			return putErr
+		}
+		var runs int
+		if found, _ := jobs.Get("miner", &runs); !found || runs != 3 {
+			t.Errorf("expected a transaction to see its own changes, got: %v %v", found, runs)
+		}
+		return tx.Bucket("jobs").Put("pool", 1)
+	})
+	if updateErr != nil {
+		t.Fatal(updateErr)
+	}
+
+	// a transaction which fails changes nothing
+	store.Update(func(tx *Tx) error {
+		tx.Bucket("jobs").Put("miner", 99)
+		tx.Bucket("jobs").Delete("pool")
+		return fmt.Errorf("changed my mind")
+	})
+
+	// read only transactions can't change anything
+	store.View(func(tx *Tx) error {
+		if putErr := tx.Bucket("jobs").Put("miner", 100); putErr == nil {
+			t.Errorf("expected a read only transaction to refuse a change")
+		}
+		return nil
+	})
+
+	reopened, reopenErr := NewStore(statePath)
+	if reopenErr != nil {
+		t.Fatal(reopenErr)
+	}
+
+	reopened.View(func(tx *Tx) error {
+		var runs int
+		if found, _ := tx.Bucket("jobs").Get("miner", &runs); !found || runs != 3 {
+			t.Errorf("expected the committed value to be saved, got: %v %v", found, runs)
+		}
+		if keys := tx.Bucket("jobs").Keys(); strings.Join(keys, ",") != "miner,pool" {
+			t.Errorf("expected the keys sorted, got: %v", keys)
+		}
+		return nil
+	})
+
+	// removing the last key removes the bucket
+	reopened.Update(func(tx *Tx) error {
+		tx.Bucket("jobs").Delete("miner")
+		return tx.Bucket("jobs").Delete("pool")
+	})
+	reopened.View(func(tx *Tx) error {
+		if buckets := tx.Buckets(); len(buckets) != 0 {
+			t.Errorf("expected no buckets, got: %v", buckets)
+		}
+		return nil
+	})
+
+	ioutil.WriteFile(statePath, []byte("not json"), 0600)
+	if _, corruptErr := NewStore(statePath); corruptErr == nil {
+		t.Errorf("expected an unreadable state file to be refused")
+	}
+}
+
+func TestDefault(t *testing.T) {
+
+	// without a config there's no StateFile to open rather than a panic
+	defer func(cfg *config.Config, store *Store) {
+		config.Cfg = cfg
+		defaultStore = store
+	}(config.Cfg, defaultStore)
+	config.Cfg = nil
+	defaultStore = nil
+	if _, getErr := Get("fleet", "lastCheckIn", new(string)); !errors.Is(getErr, ErrNoStore) {
+		t.Errorf("expected ErrNoStore without a config, got: %v", getErr)
+	}
+
+	stateDir, dirErr := ioutil.TempDir("", "state_test")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(stateDir)
+
+	if openErr := Open(filepath.Join(stateDir, "agent_state.json")); openErr != nil {
+		t.Fatal(openErr)
+	}
+
+	if putErr := Put("fleet", "lastCheckIn", "2024-01-02T03:04:05Z"); putErr != nil {
+		t.Fatal(putErr)
+	}
+
+	var lastCheckIn string
+	if found, getErr := Get("fleet", "lastCheckIn", &lastCheckIn); !found || getErr != nil || lastCheckIn != "2024-01-02T03:04:05Z" {
+		t.Errorf("expected the value back, got: %v %v %v", found, getErr, lastCheckIn)
+	}
+
+	if summary, _ := StatusSummary(); !strings.Contains(summary, "fleet: 1 keys") {
+		t.Errorf("unexpected state summary: %v", summary)
+	}
+
+	Delete("fleet", "lastCheckIn")
+	if keys, _ := Keys("fleet"); len(keys) != 0 {
+		t.Errorf("expected the key to be deleted, got: %v", keys)
+	}
+}
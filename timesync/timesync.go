@@ -0,0 +1,263 @@
+package timesync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/transport"
+)
+
+// How long a single time source has to reply. In seconds
+const TIME_SOURCE_TIMEOUT_SECONDS = 10
+
+// The port NTP servers listen on when a TimeSources entry doesn't give one
+const NTP_PORT = "123"
+
+// The seconds between the NTP epoch of 1900 and the unix epoch of 1970
+const NTP_EPOCH_OFFSET_SECONDS = 2208988800
+
+// The size of an NTP request and reply in bytes
+const NTP_PACKET_SIZE = 48
+
+var syncLock sync.Mutex
+var offset time.Duration
+var offsetSource string
+var offsetChecked time.Time
+var skewed bool
+
+// Run will measure the clock skew straight away, so anything scheduled from
+// here on uses the corrected time, and then every TimeSyncSeconds. A
+// ClockSkewed event is published whenever the clock drifts further than
+// MaxClockSkewSeconds from the TimeSources, and again once it's back. Does
+// nothing when TimeSyncSeconds is negative.
+func Run() {
+
+	if config.Cfg.TimeSyncSeconds < 0 {
+		logger.Lgr.LogMessage("TimeSyncSeconds is negative. Clock skew detection is disabled.")
+		return
+	}
+
+	if _, checkErr := Check(); checkErr != nil {
+		logger.Lgr.LogErrorf("Failed to measure the clock skew: %v", checkErr)
+	}
+
+	go func() {
+		for 1 == 1 {
+			time.Sleep(time.Duration(config.Cfg.TimeSyncSeconds) * time.Second)
+
+			if _, checkErr := Check(); checkErr != nil {
+				logger.Lgr.LogErrorf("Failed to measure the clock skew: %v", checkErr)
+			}
+		}
+	}()
+}
+
+// Check will measure how far the local clock is from the first of the
+// TimeSources which replies, and remember it so Now can correct for it.
+// Publishes a ClockSkewed event when the skew crosses MaxClockSkewSeconds in
+// either direction. Returns the measured skew, positive when the local clock
+// is behind.
+func Check() (time.Duration, error) {
+
+	measured, source, measureErr := Measure()
+	if measureErr != nil {
+		return 0, measureErr
+	}
+
+	limit := time.Duration(config.Cfg.MaxClockSkewSeconds) * time.Second
+	nowSkewed := measured > limit || measured < -limit
+
+	syncLock.Lock()
+	wasSkewed := skewed
+	offset = measured
+	offsetSource = source
+	offsetChecked = time.Now()
+	skewed = nowSkewed
+	syncLock.Unlock()
+
+	if nowSkewed {
+		logger.Lgr.LogErrorf("The local clock is %v away from %v. Scheduling uses the corrected time", measured.Round(time.Millisecond), source)
+	} else {
+		logger.Lgr.LogMessagef("Successfully measured the clock skew against %v: %v", source, measured.Round(time.Millisecond))
+	}
+
+	if nowSkewed != wasSkewed {
+		events.Publish(events.ClockSkewed{Skewed: nowSkewed, OffsetSeconds: measured.Seconds(), Source: source})
+	}
+
+	return measured, nil
+}
+
+// Measure will ask each of the TimeSources in turn for the time until one
+// replies and return how far the local clock is from it along with the
+// source which replied. ntp:// sources are skipped when ProxyURL is set since
+// NTP can't be sent through it.
+func Measure() (time.Duration, string, error) {
+
+	if len(config.Cfg.TimeSources) == 0 {
+		return 0, "", fmt.Errorf("No TimeSources configured")
+	}
+
+	var lastErr error
+	for _, source := range config.Cfg.TimeSources {
+		sourceURL, parseErr := url.Parse(source)
+		if parseErr != nil {
+			lastErr = parseErr
+			continue
+		}
+
+		var measured time.Duration
+		var measureErr error
+
+		switch sourceURL.Scheme {
+		case "ntp":
+			if config.Cfg.ProxyURL != "" {
+				logger.Lgr.LogMessagef("Skipping time source %v since NTP can't be sent through ProxyURL", source)
+				continue
+			}
+			measured, measureErr = queryNTP(sourceURL.Host)
+		case "http", "https":
+			measured, measureErr = queryHTTPDate(source)
+		default:
+			measureErr = fmt.Errorf("Time source %v must be an ntp://, http:// or https:// URL", source)
+		}
+
+		if measureErr != nil {
+			lastErr = measureErr
+			logger.Lgr.LogMessagef("Time source %v failed: %v", source, measureErr)
+			continue
+		}
+
+		return measured, source, nil
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("None of the TimeSources could be used")
+	}
+
+	return 0, "", lastErr
+}
+
+// Offset returns the clock skew measured by the last successful Check.
+// Positive when the local clock is behind.
+func Offset() time.Duration {
+
+	syncLock.Lock()
+	defer syncLock.Unlock()
+
+	return offset
+}
+
+// Now returns the current time corrected for the skew measured by the last
+// successful Check, for scheduling things at a time of day on machines whose
+// clock can't be trusted. The local clock is used as is until then.
+func Now() time.Time {
+	return time.Now().Add(Offset())
+}
+
+// Summary describes the last measured clock skew for the status report.
+func Summary() (string, error) {
+
+	syncLock.Lock()
+	defer syncLock.Unlock()
+
+	if offsetChecked.IsZero() {
+		return "The clock skew hasn't been measured yet\n", nil
+	}
+
+	var summary bytes.Buffer
+	summary.WriteString(fmt.Sprintf("The local clock was %v away from %v %v ago\n", offset.Round(time.Millisecond), offsetSource, time.Since(offsetChecked).Round(time.Second)))
+	if skewed {
+		summary.WriteString(fmt.Sprintf("This is more than the MaxClockSkewSeconds of %d\n", config.Cfg.MaxClockSkewSeconds))
+	}
+
+	return summary.String(), nil
+}
+
+// queryNTP will send a single SNTP request to the given server and return
+// the offset of the local clock calculated from its reply.
+func queryNTP(server string) (time.Duration, error) {
+
+	if _, _, splitErr := net.SplitHostPort(server); splitErr != nil {
+		server = net.JoinHostPort(server, NTP_PORT)
+	}
+
+	conn, dialErr := net.DialTimeout("udp", server, TIME_SOURCE_TIMEOUT_SECONDS*time.Second)
+	if dialErr != nil {
+		return 0, dialErr
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(TIME_SOURCE_TIMEOUT_SECONDS * time.Second))
+
+	// no leap indicator, version 3, client mode
+	request := make([]byte, NTP_PACKET_SIZE)
+	request[0] = 0x1B
+
+	sent := time.Now()
+	if _, writeErr := conn.Write(request); writeErr != nil {
+		return 0, writeErr
+	}
+
+	reply := make([]byte, NTP_PACKET_SIZE)
+	read, readErr := conn.Read(reply)
+	if readErr != nil {
+		return 0, readErr
+	}
+	received := time.Now()
+
+	// a server reply with a non zero stratum, anything else is a kiss of death
+	if read < NTP_PACKET_SIZE || reply[0]&0x07 != 4 || reply[1] == 0 {
+		return 0, fmt.Errorf("%v didn't reply with a valid NTP server response", server)
+	}
+
+	serverReceived := ntpTime(reply[32:40])
+	serverSent := ntpTime(reply[40:48])
+
+	return (serverReceived.Sub(sent) + serverSent.Sub(received)) / 2, nil
+}
+
+// ntpTime converts the given 64 bit NTP timestamp to a time.
+func ntpTime(timestamp []byte) time.Time {
+
+	seconds := int64(binary.BigEndian.Uint32(timestamp[0:4])) - NTP_EPOCH_OFFSET_SECONDS
+	fraction := int64(binary.BigEndian.Uint32(timestamp[4:8]))
+
+	return time.Unix(seconds, fraction*int64(time.Second)>>32)
+}
+
+// queryHTTPDate will send a HEAD request to the given URL and return the
+// offset of the local clock calculated from the Date header of the reply. The
+// header only has a resolution of one second.
+func queryHTTPDate(source string) (time.Duration, error) {
+
+	client := transport.HTTPClient(TIME_SOURCE_TIMEOUT_SECONDS * time.Second)
+
+	sent := time.Now()
+	response, headErr := client.Head(source)
+	if headErr != nil {
+		return 0, headErr
+	}
+	response.Body.Close()
+	received := time.Now()
+
+	date, parseErr := http.ParseTime(response.Header.Get("Date"))
+	if parseErr != nil {
+		return 0, fmt.Errorf("%v didn't reply with a valid Date header: %v", source, parseErr)
+	}
+
+	// the header is truncated to the second so the middle of it is the best guess
+	serverTime := date.Add(500 * time.Millisecond)
+	localTime := sent.Add(received.Sub(sent) / 2)
+
+	return serverTime.Sub(localTime), nil
+}
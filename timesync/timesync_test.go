@@ -0,0 +1,145 @@
+package timesync
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+func TestMain(m *testing.M) {
+
+	logErr := logger.StandardLogger("timesync_test")
+	if logErr != nil {
+		fmt.Println(fmt.Sprintf("Could not initialize logger: %v", logErr))
+		return
+	}
+
+	configErr := config.FromFile()
+	if configErr != nil {
+		return
+	}
+
+	result := m.Run()
+	os.Exit(result)
+}
+
+// withinSecond returns whether the measured skew is within a second of the
+// expected skew, since the Date header is truncated to the second.
+func withinSecond(measured time.Duration, expected time.Duration) bool {
+	difference := measured - expected
+	return difference < time.Second && difference > -time.Second
+}
+
+func TestCheck(t *testing.T) {
+
+	defer func(sources []string) {
+		config.Cfg.TimeSources = sources
+	}(config.Cfg.TimeSources)
+
+	skew := 2 * time.Hour
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Date", time.Now().Add(skew).UTC().Format(http.TimeFormat))
+	}))
+	defer server.Close()
+
+	published := make(chan events.Record, 10)
+	unsubscribe := events.Subscribe("timesync_test", func(record events.Record) {
+		if record.Kind == events.CLOCK_SKEWED {
+			published <- record
+		}
+	})
+	defer unsubscribe()
+
+	// a source which can't be used is skipped over
+	config.Cfg.TimeSources = []string{"ftp://time.example.com", server.URL}
+
+	measured, checkErr := Check()
+	if checkErr != nil {
+		t.Fatal(checkErr)
+	}
+
+	if !withinSecond(measured, skew) || !withinSecond(Offset(), skew) {
+		t.Errorf("expected a skew of %v, got: %v", skew, measured)
+	}
+
+	if corrected := Now(); !withinSecond(corrected.Sub(time.Now()), skew) {
+		t.Errorf("expected Now to correct for the skew, got: %v", corrected)
+	}
+
+	select {
+	case record := <-published:
+		if !record.Event.(events.ClockSkewed).Skewed {
+			t.Errorf("expected the clock to be reported as skewed, got: %+v", record.Event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a ClockSkewed event")
+	}
+
+	skew = 0
+	if _, checkErr := Check(); checkErr != nil {
+		t.Fatal(checkErr)
+	}
+
+	select {
+	case record := <-published:
+		if record.Event.(events.ClockSkewed).Skewed {
+			t.Errorf("expected the clock to be reported as fixed, got: %+v", record.Event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a ClockSkewed event once the clock was fixed")
+	}
+
+	config.Cfg.TimeSources = []string{"ftp://time.example.com"}
+	if _, checkErr := Check(); checkErr == nil {
+		t.Errorf("expected a check without a usable source to fail")
+	}
+}
+
+func TestQueryNTP(t *testing.T) {
+
+	conn, listenErr := net.ListenPacket("udp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	defer conn.Close()
+
+	skew := -90 * time.Minute
+	go func() {
+		request := make([]byte, NTP_PACKET_SIZE)
+		_, client, readErr := conn.ReadFrom(request)
+		if readErr != nil {
+			return
+		}
+
+		serverTime := time.Now().Add(skew)
+		seconds := uint32(serverTime.Unix() + NTP_EPOCH_OFFSET_SECONDS)
+		fraction := uint32((int64(serverTime.Nanosecond()) << 32) / int64(time.Second))
+
+		reply := make([]byte, NTP_PACKET_SIZE)
+		reply[0] = 0x1C // no leap indicator, version 3, server mode
+		reply[1] = 2
+		for _, position := range []int{32, 40} {
+			binary.BigEndian.PutUint32(reply[position:], seconds)
+			binary.BigEndian.PutUint32(reply[position+4:], fraction)
+		}
+		conn.WriteTo(reply, client)
+	}()
+
+	measured, queryErr := queryNTP(conn.LocalAddr().String())
+	if queryErr != nil {
+		t.Fatal(queryErr)
+	}
+
+	if !withinSecond(measured, skew) {
+		t.Errorf("expected a skew of %v, got: %v", skew, measured)
+	}
+}
@@ -0,0 +1,228 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/state"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The state bucket and key the bytes used so far this month are saved in
+const BANDWIDTH_BUCKET = "bandwidth"
+const BANDWIDTH_USAGE_KEY = "usage"
+
+// How often the bytes used this month are saved to the state store. In seconds
+const BANDWIDTH_SAVE_SECONDS = 60
+
+// The name of the metric published when the monthly byte budget runs out
+const MONTHLY_BYTES_METRIC = "bytes used this month"
+
+// The layout of the month the usage was counted in
+const USAGE_MONTH_LAYOUT = "2006-01"
+
+// ErrBudgetExhausted is returned instead of opening a connection once
+// MonthlyByteBudget has been used up.
+type ErrBudgetExhausted struct {
+	Used   int64
+	Budget int64
+}
+
+// Error describes the exhausted budget.
+func (ebe ErrBudgetExhausted) Error() string {
+	return fmt.Sprintf("The monthly byte budget of %v is used up: %v used", utils.FormatBytes(ebe.Budget), utils.FormatBytes(ebe.Used))
+}
+
+// bandwidthUsage is the number of bytes sent and received in a month. It's
+// saved in the state store so restarts don't reset the count.
+type bandwidthUsage struct {
+	Month string `json:"month"`
+	Bytes int64  `json:"bytes"`
+}
+
+var bandwidthLock sync.Mutex
+var usage bandwidthUsage
+var usageLoaded bool
+var usageSaved time.Time
+var tokens float64
+var tokensUpdated time.Time
+
+// meteredConn counts every byte sent and received over a connection against
+// MonthlyByteBudget and holds the connection to BandwidthLimitKbps, which is
+// shared by every connection.
+type meteredConn struct {
+	net.Conn
+}
+
+// Read will wait for bandwidth to be available for the bytes just read.
+func (mc meteredConn) Read(buffer []byte) (int, error) {
+	count, readErr := mc.Conn.Read(buffer)
+	if count > 0 {
+		useBandwidth(count)
+	}
+	return count, readErr
+}
+
+// Write will wait for bandwidth to be available before each chunk is written.
+func (mc meteredConn) Write(buffer []byte) (int, error) {
+
+	written := 0
+	for written < len(buffer) {
+		chunk := len(buffer) - written
+		if burst := burstBytes(); burst > 0 && chunk > burst {
+			chunk = burst
+		}
+
+		useBandwidth(chunk)
+
+		count, writeErr := mc.Conn.Write(buffer[written : written+chunk])
+		written += count
+		if writeErr != nil {
+			return written, writeErr
+		}
+	}
+
+	return written, nil
+}
+
+// meter will wrap the given connection so it counts against the bandwidth
+// limits. Connections to this machine aren't metered.
+func meter(conn net.Conn, address string) net.Conn {
+	if loopback(address) {
+		return conn
+	}
+	return meteredConn{Conn: conn}
+}
+
+// checkBudget returns ErrBudgetExhausted if MonthlyByteBudget has been used up
+// so new connections aren't opened.
+func checkBudget(address string) error {
+
+	if config.Cfg.MonthlyByteBudget <= 0 || loopback(address) {
+		return nil
+	}
+
+	bandwidthLock.Lock()
+	defer bandwidthLock.Unlock()
+
+	rollUsage(time.Now())
+	if budget := int64(config.Cfg.MonthlyByteBudget); usage.Bytes >= budget {
+		return ErrBudgetExhausted{Used: usage.Bytes, Budget: budget}
+	}
+
+	return nil
+}
+
+// BytesUsedThisMonth returns the number of bytes sent and received by this
+// machine's outbound connections since the start of the month.
+func BytesUsedThisMonth() int64 {
+	bandwidthLock.Lock()
+	defer bandwidthLock.Unlock()
+
+	rollUsage(time.Now())
+	return usage.Bytes
+}
+
+// BandwidthSummary describes the bandwidth used this month and the limits for
+// the status report.
+func BandwidthSummary() (string, error) {
+
+	used := BytesUsedThisMonth()
+
+	summary := fmt.Sprintf("%v used this month", utils.FormatBytes(used))
+	if config.Cfg.MonthlyByteBudget > 0 {
+		summary += fmt.Sprintf(" of a %v budget", config.Cfg.MonthlyByteBudget)
+	}
+	if config.Cfg.BandwidthLimitKbps > 0 {
+		summary += fmt.Sprintf(". Limited to %d kbps", config.Cfg.BandwidthLimitKbps)
+	}
+
+	return summary + "\n", nil
+}
+
+// burstBytes returns the largest number of bytes which can be sent at once
+// under BandwidthLimitKbps, one second's worth. Zero when there's no limit.
+func burstBytes() int {
+	return config.Cfg.BandwidthLimitKbps * 1000 / 8
+}
+
+// useBandwidth will count the given number of bytes towards this month's
+// usage and, when BandwidthLimitKbps is set, sleep until the shared token
+// bucket has room for them.
+func useBandwidth(count int) {
+
+	bandwidthLock.Lock()
+
+	now := time.Now()
+	rollUsage(now)
+
+	before := usage.Bytes
+	usage.Bytes += int64(count)
+	if budget := int64(config.Cfg.MonthlyByteBudget); budget > 0 && before < budget && usage.Bytes >= budget {
+		events.Publish(events.ThresholdBreached{Metric: MONTHLY_BYTES_METRIC, Value: float64(usage.Bytes), Limit: float64(budget), Detail: "No new outbound connections will be opened until next month."})
+	}
+
+	if now.Sub(usageSaved) > BANDWIDTH_SAVE_SECONDS*time.Second {
+		saveUsage()
+		usageSaved = now
+	}
+
+	var wait time.Duration
+	if burst := float64(burstBytes()); burst > 0 {
+		if tokensUpdated.IsZero() {
+			tokens = burst
+		} else {
+			tokens += now.Sub(tokensUpdated).Seconds() * burst
+		}
+		if tokens > burst {
+			tokens = burst
+		}
+		tokensUpdated = now
+
+		tokens -= float64(count)
+		if tokens < 0 {
+			wait = time.Duration(-tokens / burst * float64(time.Second))
+		}
+	}
+
+	bandwidthLock.Unlock()
+
+	time.Sleep(wait)
+}
+
+// rollUsage will load the saved usage the first time it's needed and start
+// counting from zero when a new month begins. The caller must hold
+// bandwidthLock.
+func rollUsage(now time.Time) {
+
+	if !usageLoaded {
+		usageLoaded = true
+		if _, loadErr := state.Get(BANDWIDTH_BUCKET, BANDWIDTH_USAGE_KEY, &usage); loadErr != nil {
+			logger.Lgr.LogErrorf("Discarding unreadable bandwidth usage: %v", loadErr)
+			usage = bandwidthUsage{}
+		}
+	}
+
+	month := now.Format(USAGE_MONTH_LAYOUT)
+	if usage.Month != month {
+		if usage.Month != "" {
+			logger.Lgr.LogMessagef("Used %d bytes in %v. Starting a new month", usage.Bytes, usage.Month)
+		}
+		usage = bandwidthUsage{Month: month}
+		saveUsage()
+	}
+}
+
+// saveUsage will save this month's usage in the state store. The caller must
+// hold bandwidthLock.
+func saveUsage() {
+
+	if saveErr := state.Put(BANDWIDTH_BUCKET, BANDWIDTH_USAGE_KEY, usage); saveErr != nil {
+		logger.Lgr.LogErrorf("Unable to save the bandwidth usage: %v", saveErr)
+	}
+}
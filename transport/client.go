@@ -0,0 +1,197 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+// The name the requests of clients returned by HTTPClient are counted under
+const DEFAULT_CLIENT_NAME = "default"
+
+// How many times a GET or HEAD which failed temporarily is retried by clients
+// which retry at all
+const DEFAULT_CLIENT_RETRIES = 2
+
+// How long to wait before the first retry. Doubled for each retry after it.
+// In milliseconds
+const RETRY_BACKOFF_MILLISECONDS = 500
+
+// Doer sends a single HTTP request. *http.Client satisfies it, so the
+// updater, the reporter's webhooks and the fleet check-in can be handed any
+// client in place of the one they make via NewClient.
+type Doer interface {
+	Do(request *http.Request) (*http.Response, error)
+}
+
+// ClientStats counts the requests sent by every client sharing a name.
+// Latency is the total time spent on the requests, retries included.
+type ClientStats struct {
+	Requests int64
+	Failures int64
+	Retries  int64
+	Latency  time.Duration
+}
+
+var clientStats = make(map[string]*ClientStats)
+var clientStatsLock sync.Mutex
+
+// NewClient returns an HTTP client with the given timeout which makes every
+// connection via DialContext, exactly like HTTPClient. GET and HEAD requests
+// which fail to connect or get a 429 or 5xx reply are retried up to the given
+// number of times, backing off between each. Every request is counted under
+// the given name for ClientMetrics and, when LogHTTPRequests is set, logged.
+// The timeout covers the retries too.
+func NewClient(name string, timeout time.Duration, retries int) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: clientTransport{
+			name:    name,
+			retries: retries,
+			next: pinningTransport{&http.Transport{
+				Proxy:               nil,
+				DialContext:         DialContext,
+				TLSClientConfig:     TLSConfig(""),
+				TLSHandshakeTimeout: DIAL_TIMEOUT_SECONDS * time.Second,
+			}},
+		},
+	}
+}
+
+// clientTransport retries, counts and logs the requests it hands to the next
+// transport.
+type clientTransport struct {
+	name    string
+	retries int
+	next    http.RoundTripper
+}
+
+// RoundTrip satisfies the http.RoundTripper interface.
+func (ct clientTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+
+	started := time.Now()
+	backoff := RETRY_BACKOFF_MILLISECONDS * time.Millisecond
+
+	attempt := 0
+	response, tripErr := ct.next.RoundTrip(request)
+	for ; attempt < ct.retries && retryable(request, response, tripErr); attempt++ {
+		if response != nil {
+			response.Body.Close()
+		}
+
+		select {
+		case <-request.Context().Done():
+			ct.record(request, started, attempt, nil, request.Context().Err())
+			return nil, request.Context().Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+
+		if request.GetBody != nil {
+			body, bodyErr := request.GetBody()
+			if bodyErr != nil {
+				ct.record(request, started, attempt, nil, bodyErr)
+				return nil, bodyErr
+			}
+			request = request.Clone(request.Context())
+			request.Body = body
+		}
+		response, tripErr = ct.next.RoundTrip(request)
+	}
+
+	ct.record(request, started, attempt, response, tripErr)
+	return response, tripErr
+}
+
+// record will count the finished request under the name of the client and log
+// it when LogHTTPRequests is set. Only the host is logged since the path and
+// query of some services hold credentials.
+func (ct clientTransport) record(request *http.Request, started time.Time, retries int, response *http.Response, tripErr error) {
+
+	took := time.Since(started)
+
+	clientStatsLock.Lock()
+	stats, found := clientStats[ct.name]
+	if !found {
+		stats = &ClientStats{}
+		clientStats[ct.name] = stats
+	}
+	stats.Requests++
+	stats.Retries += int64(retries)
+	stats.Latency += took
+	if tripErr != nil || response.StatusCode >= http.StatusBadRequest {
+		stats.Failures++
+	}
+	clientStatsLock.Unlock()
+
+	if config.Cfg == nil || !config.Cfg.LogHTTPRequests {
+		return
+	}
+
+	outcome := fmt.Sprintf("%v", tripErr)
+	if tripErr == nil {
+		outcome = response.Status
+	}
+	logger.Lgr.LogMessagef("%v request %v %v: %v in %v after %d retries", ct.name, request.Method, request.URL.Host, outcome, took.Round(time.Millisecond), retries)
+}
+
+// retryable returns whether the given request can be sent again after it got
+// the given response or error: it has to be a GET or HEAD whose body can be
+// replayed, which couldn't connect or got a 429 or 5xx reply. Requests the
+// MonthlyByteBudget refused or whose context is done aren't retried.
+func retryable(request *http.Request, response *http.Response, tripErr error) bool {
+
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		return false
+	}
+	if request.Body != nil && request.Body != http.NoBody && request.GetBody == nil {
+		return false
+	}
+	if request.Context().Err() != nil {
+		return false
+	}
+
+	if tripErr != nil {
+		var netErr net.Error
+		return errors.As(tripErr, &netErr) && !errors.As(tripErr, &ErrBudgetExhausted{})
+	}
+	return ErrDownloadFailed{Status: response.StatusCode}.Temporary()
+}
+
+// Stats returns the requests counted under each client name since the agent
+// started.
+func Stats() map[string]ClientStats {
+
+	clientStatsLock.Lock()
+	defer clientStatsLock.Unlock()
+
+	stats := make(map[string]ClientStats, len(clientStats))
+	for name, counted := range clientStats {
+		stats[name] = *counted
+	}
+	return stats
+}
+
+// ClientMetrics returns the requests, failures and retries of each client
+// name along with the mean time a request took in milliseconds, e.g.
+// http_updater_requests and http_updater_latency_ms. Meant to be registered with the
+// profiler.
+func ClientMetrics() (map[string]float64, error) {
+
+	metrics := make(map[string]float64)
+	for name, counted := range Stats() {
+		metrics["http_"+name+"_requests"] = float64(counted.Requests)
+		metrics["http_"+name+"_failures"] = float64(counted.Failures)
+		metrics["http_"+name+"_retries"] = float64(counted.Retries)
+		if counted.Requests > 0 {
+			metrics["http_"+name+"_latency_ms"] = float64(counted.Latency.Milliseconds()) / float64(counted.Requests)
+		}
+	}
+	return metrics, nil
+}
@@ -0,0 +1,217 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The number of outbound connections in a row which can fail before this
+// machine is considered offline
+const OFFLINE_DIAL_FAILURES = 3
+
+// The number of different destinations those connections must have failed to
+// reach, so a single broken endpoint doesn't look like an outage
+const OFFLINE_DIAL_DESTINATIONS = 2
+
+// How often the recently used destinations are probed while offline. In seconds
+const OFFLINE_PROBE_SECONDS = 30
+
+// The number of recently used destinations which are probed while offline
+const MAX_PROBE_DESTINATIONS = 5
+
+var connectivityLock sync.Mutex
+var offline bool
+var outageStarted time.Time
+var outageCount int
+var lastOutage time.Duration
+var dialFailures int
+var failedDestinations = make(map[string]bool)
+var probeDestinations []string
+var reconnected = make(chan struct{})
+
+// Online returns false while this machine is considered offline. Subsystems
+// which need connectivity should queue their work instead of trying, and
+// failing, while offline.
+func Online() bool {
+	connectivityLock.Lock()
+	defer connectivityLock.Unlock()
+	return !offline
+}
+
+// OutageDuration returns how long the current outage has lasted. Zero while
+// online.
+func OutageDuration() time.Duration {
+	connectivityLock.Lock()
+	defer connectivityLock.Unlock()
+
+	if !offline {
+		return 0
+	}
+	return time.Since(outageStarted)
+}
+
+// Reconnected returns a channel which is closed the next time connectivity
+// returns after an outage, so queued work can be flushed straight away.
+func Reconnected() <-chan struct{} {
+	connectivityLock.Lock()
+	defer connectivityLock.Unlock()
+	return reconnected
+}
+
+// WaitOnline will block until this machine is online. Returns straight away
+// when it already is.
+func WaitOnline() {
+
+	connectivityLock.Lock()
+	if !offline {
+		connectivityLock.Unlock()
+		return
+	}
+	waitOn := reconnected
+	connectivityLock.Unlock()
+
+	<-waitOn
+}
+
+// MarkOnline will end the current outage, if there is one, and publish a
+// ConnectivityChanged event with how long it lasted.
+func MarkOnline() {
+
+	connectivityLock.Lock()
+	dialFailures = 0
+	failedDestinations = make(map[string]bool)
+	if !offline {
+		connectivityLock.Unlock()
+		return
+	}
+
+	offline = false
+	lastOutage = time.Since(outageStarted)
+	close(reconnected)
+	reconnected = make(chan struct{})
+	outage := lastOutage
+	connectivityLock.Unlock()
+
+	logger.Lgr.LogMessagef("Successfully reconnected after an outage of %v", utils.FormatDuration(outage))
+	events.Publish(events.ConnectivityChanged{Online: true, OutageSeconds: outage.Seconds()})
+}
+
+// MarkOffline will start an outage, if one isn't already in progress, and
+// publish a ConnectivityChanged event. The recently used destinations are
+// probed every OFFLINE_PROBE_SECONDS until one of them can be reached again.
+func MarkOffline() {
+
+	connectivityLock.Lock()
+	if offline {
+		connectivityLock.Unlock()
+		return
+	}
+
+	offline = true
+	outageStarted = time.Now()
+	outageCount++
+	connectivityLock.Unlock()
+
+	logger.Lgr.LogError("Connectivity lost. Outbound work will be queued until it returns")
+	events.Publish(events.ConnectivityChanged{Online: false})
+
+	go probe()
+}
+
+// ConnectivitySummary describes the current connectivity and past outages
+// for the status report.
+func ConnectivitySummary() (string, error) {
+
+	connectivityLock.Lock()
+	defer connectivityLock.Unlock()
+
+	if offline {
+		return fmt.Sprintf("offline for %v. %d outages since startup\n", utils.FormatDuration(time.Since(outageStarted)), outageCount), nil
+	}
+
+	if outageCount == 0 {
+		return "online with no outages since startup\n", nil
+	}
+
+	return fmt.Sprintf("online. %d outages since startup, the last lasting %v\n", outageCount, utils.FormatDuration(lastOutage)), nil
+}
+
+// recordDial will track the outcome of a connection to the given address so
+// repeated failures to more than one destination start an outage and any
+// success ends one. Loopback destinations say nothing about connectivity and
+// are ignored.
+func recordDial(address string, dialErr error) {
+
+	if loopback(address) {
+		return
+	}
+
+	if dialErr == nil {
+		MarkOnline()
+		return
+	}
+
+	connectivityLock.Lock()
+	dialFailures++
+	failedDestinations[address] = true
+	outage := dialFailures >= OFFLINE_DIAL_FAILURES && len(failedDestinations) >= OFFLINE_DIAL_DESTINATIONS
+
+	known := false
+	for _, destination := range probeDestinations {
+		known = known || destination == address
+	}
+	if !known {
+		probeDestinations = append(probeDestinations, address)
+		if len(probeDestinations) > MAX_PROBE_DESTINATIONS {
+			probeDestinations = probeDestinations[1:]
+		}
+	}
+	connectivityLock.Unlock()
+
+	if outage {
+		MarkOffline()
+	}
+}
+
+// probe will try to connect to the recently failed destinations every
+// OFFLINE_PROBE_SECONDS until connectivity returns.
+func probe() {
+
+	for !Online() {
+		time.Sleep(OFFLINE_PROBE_SECONDS * time.Second)
+
+		connectivityLock.Lock()
+		destinations := append([]string{}, probeDestinations...)
+		connectivityLock.Unlock()
+
+		for _, destination := range destinations {
+			conn, dialErr := Dial("tcp", destination)
+			if dialErr == nil {
+				conn.Close()
+				break
+			}
+		}
+	}
+}
+
+// loopback returns true if the given host:port refers to this machine.
+func loopback(address string) bool {
+
+	host, _, splitErr := net.SplitHostPort(address)
+	if splitErr != nil {
+		host = address
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
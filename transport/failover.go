@@ -0,0 +1,180 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+// How long the time taken to connect to an endpoint is remembered for when
+// EndpointSelection is latency. In seconds
+const LATENCY_CACHE_SECONDS = 600
+
+// How long to wait on an endpoint when measuring how fast it is to connect to.
+// In seconds
+const LATENCY_TIMEOUT_SECONDS = 5
+
+var failoverLock sync.Mutex
+var lastWorking = make(map[string]string)
+var latencies = make(map[string]measuredLatency)
+
+// measuredLatency is how long it took to connect to an endpoint and when.
+type measuredLatency struct {
+	latency  time.Duration
+	measured time.Time
+}
+
+// ErrEndpointsFailed is returned by Failover when none of several endpoints
+// worked. Each of the errors is kept so callers can still tell what kind of
+// failure it was via errors.As.
+type ErrEndpointsFailed struct {
+	Endpoints []string
+	Errs      []error
+}
+
+// Error describes the error from each endpoint.
+func (eef ErrEndpointsFailed) Error() string {
+	failures := make([]string, 0, len(eef.Errs))
+	for index, failure := range eef.Errs {
+		failures = append(failures, fmt.Sprintf("%v: %v", eef.Endpoints[index], failure))
+	}
+	return fmt.Sprintf("Every endpoint failed. %v", strings.Join(failures, ". "))
+}
+
+// Unwrap returns the error from each endpoint.
+func (eef ErrEndpointsFailed) Unwrap() []error {
+	return eef.Errs
+}
+
+// Failover will call try with each of the given endpoints until one of them
+// succeeds. The endpoint which worked last time is tried first, followed by
+// the rest as listed or, when EndpointSelection is latency, fastest to
+// connect to first. Returns the endpoint which worked, or every error along
+// the way in ErrEndpointsFailed when none of them did. A single endpoint's
+// error is returned as is.
+func Failover(endpoints []string, try func(endpoint string) error) (string, error) {
+
+	if len(endpoints) == 0 {
+		return "", fmt.Errorf("No endpoints are configured")
+	}
+
+	key := strings.Join(endpoints, " ")
+	var failed ErrEndpointsFailed
+
+	for _, endpoint := range endpointOrder(key, endpoints) {
+		tryErr := try(endpoint)
+		if tryErr == nil {
+			failoverLock.Lock()
+			previous := lastWorking[key]
+			lastWorking[key] = endpoint
+			failoverLock.Unlock()
+
+			if previous != "" && previous != endpoint {
+				logger.Lgr.LogMessagef("Successfully failed over from %v to %v", previous, endpoint)
+			}
+			return endpoint, nil
+		}
+
+		if len(endpoints) == 1 {
+			return "", tryErr
+		}
+
+		failed.Endpoints = append(failed.Endpoints, endpoint)
+		failed.Errs = append(failed.Errs, tryErr)
+	}
+
+	return "", failed
+}
+
+// endpointOrder returns the given endpoints in the order they should be
+// tried in.
+func endpointOrder(key string, endpoints []string) []string {
+
+	ordered := append([]string{}, endpoints...)
+
+	if config.Cfg.EndpointSelection == "latency" && len(ordered) > 1 {
+		measured := make(map[string]time.Duration)
+		for _, endpoint := range ordered {
+			measured[endpoint] = endpointLatency(endpoint)
+		}
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return measured[ordered[i]] < measured[ordered[j]]
+		})
+	}
+
+	failoverLock.Lock()
+	working := lastWorking[key]
+	failoverLock.Unlock()
+
+	for index, endpoint := range ordered {
+		if endpoint == working {
+			copy(ordered[1:index+1], ordered[:index])
+			ordered[0] = working
+			break
+		}
+	}
+
+	return ordered
+}
+
+// endpointLatency returns how long it takes to connect to the host of the
+// given endpoint, via the proxy when there is one. Unreachable endpoints take
+// forever so they're tried last.
+func endpointLatency(endpoint string) time.Duration {
+
+	failoverLock.Lock()
+	cached, found := latencies[endpoint]
+	failoverLock.Unlock()
+
+	if found && time.Since(cached.measured) < LATENCY_CACHE_SECONDS*time.Second {
+		return cached.latency
+	}
+
+	latency := time.Duration(1<<63 - 1)
+
+	address, addressErr := endpointAddress(endpoint)
+	if addressErr == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), LATENCY_TIMEOUT_SECONDS*time.Second)
+		started := time.Now()
+		conn, dialErr := DialContext(ctx, "tcp", address)
+		cancel()
+		if dialErr == nil {
+			latency = time.Since(started)
+			conn.Close()
+		}
+	}
+
+	failoverLock.Lock()
+	latencies[endpoint] = measuredLatency{latency: latency, measured: time.Now()}
+	failoverLock.Unlock()
+
+	return latency
+}
+
+// endpointAddress returns the host:port the given URL connects to.
+func endpointAddress(endpoint string) (string, error) {
+
+	parsed, parseErr := url.Parse(endpoint)
+	if parseErr != nil {
+		return "", parseErr
+	}
+
+	if parsed.Port() != "" {
+		return parsed.Host, nil
+	}
+
+	port := "80"
+	if parsed.Scheme == "https" || parsed.Scheme == "wss" {
+		port = "443"
+	}
+
+	return net.JoinHostPort(parsed.Hostname(), port), nil
+}
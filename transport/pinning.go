@@ -0,0 +1,156 @@
+package transport
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+// The prefix every pin is written with, as in HTTP public key pinning
+const PIN_PREFIX = "sha256/"
+
+// How long to wait before publishing another mismatch for the same host. In
+// minutes
+const PIN_ALERT_MINUTES = 60
+
+var pinAlerts = make(map[string]time.Time)
+var pinAlertsLock sync.Mutex
+
+// pinningTransport refuses plain HTTP requests to hosts with TLSPins before
+// handing requests to the underlying transport.
+type pinningTransport struct {
+	*http.Transport
+}
+
+// RoundTrip satisfies the http.RoundTripper interface.
+func (pt pinningTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.URL.Scheme != "https" {
+		if plaintextErr := CheckPlaintext(request.URL.Hostname()); plaintextErr != nil {
+			return nil, plaintextErr
+		}
+	}
+	return pt.Transport.RoundTrip(request)
+}
+
+// TLSConfig returns the TLS config every outbound connection to the given
+// server is made with. On top of the usual verification against the system's
+// certificate authorities, the handshake fails unless the verified chain
+// contains a key pinned for the server in TLSPins, so a rogue or compromised
+// authority can't be used to intercept the connection. Servers without pins
+// are only verified the usual way. An empty server name is filled in by the
+// HTTP client for each request.
+func TLSConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		ServerName:       serverName,
+		MinVersion:       tls.VersionTLS12,
+		VerifyConnection: verifyPins,
+	}
+}
+
+// CheckPlaintext returns an error if the given host has TLSPins, since a
+// connection which isn't encrypted can't be pinned and would give away what
+// the pins are protecting.
+func CheckPlaintext(host string) error {
+	if len(Pins(host)) > 0 {
+		return fmt.Errorf("%v has TLSPins so it can only be reached over TLS", host)
+	}
+	return nil
+}
+
+// Pins returns the pins of the given host from TLSPins, if it has any.
+func Pins(host string) []string {
+	return config.Cfg.TLSPins[strings.ToLower(host)]
+}
+
+// SPKIPin returns the pin of the given certificate's public key: PIN_PREFIX
+// followed by the base64 SHA-256 hash of its DER encoded SubjectPublicKeyInfo.
+func SPKIPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return PIN_PREFIX + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// FetchPins will complete a TLS handshake with the given host:port through
+// Dial and return the pin of every certificate it presents, leaf first. The
+// chain is verified as usual, but not against any TLSPins, so the pins of a
+// server can be found before it's pinned or after its keys change.
+func FetchPins(address string) ([]string, error) {
+
+	host, _, splitErr := net.SplitHostPort(address)
+	if splitErr != nil {
+		return nil, splitErr
+	}
+
+	rawConn, dialErr := Dial("tcp", address)
+	if dialErr != nil {
+		return nil, dialErr
+	}
+	defer rawConn.Close()
+
+	conn := tls.Client(rawConn, &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12})
+	conn.SetDeadline(time.Now().Add(DIAL_TIMEOUT_SECONDS * time.Second))
+	if handshakeErr := conn.Handshake(); handshakeErr != nil {
+		return nil, handshakeErr
+	}
+
+	var pins []string
+	for _, cert := range conn.ConnectionState().PeerCertificates {
+		pins = append(pins, SPKIPin(cert))
+	}
+
+	return pins, nil
+}
+
+// verifyPins fails the handshake described by the given state unless one of
+// the certificates of a verified chain has a key pinned for the server.
+// Publishes a CertificatePinMismatch event, at most once every
+// PIN_ALERT_MINUTES for each host, when it fails.
+func verifyPins(state tls.ConnectionState) error {
+
+	pins := Pins(state.ServerName)
+	if len(pins) == 0 {
+		return nil
+	}
+
+	chains := state.VerifiedChains
+	if len(chains) == 0 {
+		chains = [][]*x509.Certificate{state.PeerCertificates}
+	}
+
+	var presented []string
+	for _, chain := range chains {
+		for _, cert := range chain {
+			pin := SPKIPin(cert)
+			for _, pinned := range pins {
+				if pin == pinned {
+					return nil
+				}
+			}
+			presented = append(presented, pin)
+		}
+	}
+
+	pinAlertsLock.Lock()
+	alerted := time.Since(pinAlerts[state.ServerName]) < PIN_ALERT_MINUTES*time.Minute
+	if !alerted {
+		pinAlerts[state.ServerName] = time.Now()
+	}
+	pinAlertsLock.Unlock()
+
+	logger.Lgr.LogErrorf("The certificate chain of %v doesn't contain any of its TLSPins. It presented: %v", state.ServerName, strings.Join(presented, ", "))
+	if !alerted {
+		events.Publish(events.CertificatePinMismatch{Host: state.ServerName, Presented: presented})
+	}
+
+	return fmt.Errorf("The certificate chain of %v doesn't contain any of its TLSPins", state.ServerName)
+}
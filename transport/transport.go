@@ -0,0 +1,197 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"golang.org/x/net/proxy"
+)
+
+// How long to wait for a single outbound connection to open. In seconds
+const DIAL_TIMEOUT_SECONDS = 30
+
+// The destinations which are always reached directly since a proxy running on
+// another machine can't reach them
+const LOOPBACK_BYPASS = "localhost,127.0.0.0/8,::1/128"
+
+// Dial will open a connection to the given address through ProxyURL unless the
+// destination is listed in ProxyBypass. Host names are resolved by the proxy
+// so DNS lookups don't leak outside of it either. The outcome feeds into
+// whether this machine is considered Online. The connection counts against
+// MonthlyByteBudget and BandwidthLimitKbps, and ErrBudgetExhausted is returned
+// once the budget is used up.
+func Dial(network string, address string) (net.Conn, error) {
+	return DialContext(context.Background(), network, address)
+}
+
+// DialContext will open a connection to the given address the same way as
+// Dial and gives up when the given context is done.
+func DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+
+	if budgetErr := checkBudget(address); budgetErr != nil {
+		return nil, budgetErr
+	}
+
+	dialer, dialerErr := contextDialer()
+	if dialerErr != nil {
+		return nil, dialerErr
+	}
+
+	conn, dialErr := dialer.DialContext(ctx, network, address)
+	if ctx.Err() == nil {
+		recordDial(address, dialErr)
+	}
+
+	if dialErr != nil {
+		return nil, dialErr
+	}
+
+	return meter(conn, address), nil
+}
+
+// HTTPClient returns an HTTP client with the given timeout which makes every
+// connection via DialContext. Proxies set in the environment are ignored so
+// ProxyURL is the only way traffic leaves the machine. HTTPS connections are
+// checked against the TLSPins and plain HTTP to a pinned host is refused.
+// Requests aren't retried and are counted under DEFAULT_CLIENT_NAME. Use
+// NewClient to name them or retry them.
+func HTTPClient(timeout time.Duration) *http.Client {
+	return NewClient(DEFAULT_CLIENT_NAME, timeout, 0)
+}
+
+// ErrDownloadFailed is returned by CheckStatus when a server replies to a
+// request with anything other than 200 OK. URL is the address requested
+// without its query, which may hold credentials.
+type ErrDownloadFailed struct {
+	URL    string
+	Status int
+}
+
+// Error describes the server and the status it replied with.
+func (edf ErrDownloadFailed) Error() string {
+	return fmt.Sprintf("%v responded with status: %d %v", edf.URL, edf.Status, http.StatusText(edf.Status))
+}
+
+// Temporary returns whether the request could succeed if it's tried again
+// later, i.e. the server is overloaded or failing rather than refusing it.
+func (edf ErrDownloadFailed) Temporary() bool {
+	return edf.Status == http.StatusTooManyRequests || edf.Status >= http.StatusInternalServerError
+}
+
+// CheckStatus returns ErrDownloadFailed unless the given response is a 200 OK.
+func CheckStatus(response *http.Response) error {
+
+	if response.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	requested := ""
+	if response.Request != nil && response.Request.URL != nil {
+		withoutQuery := *response.Request.URL
+		withoutQuery.User, withoutQuery.RawQuery, withoutQuery.Fragment = nil, "", ""
+		requested = withoutQuery.String()
+	}
+
+	return ErrDownloadFailed{URL: requested, Status: response.StatusCode}
+}
+
+// SendMail behaves exactly like smtp.SendMail except the connection to the
+// SMTP server is opened via Dial and STARTTLS is checked against the TLSPins.
+func SendMail(address string, auth smtp.Auth, from string, to []string, message []byte) error {
+
+	host, _, splitErr := net.SplitHostPort(address)
+	if splitErr != nil {
+		return splitErr
+	}
+
+	conn, dialErr := Dial("tcp", address)
+	if dialErr != nil {
+		return dialErr
+	}
+
+	client, clientErr := smtp.NewClient(conn, host)
+	if clientErr != nil {
+		conn.Close()
+		return clientErr
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); !ok {
+		if plaintextErr := CheckPlaintext(host); plaintextErr != nil {
+			return plaintextErr
+		}
+	} else {
+		if tlsErr := client.StartTLS(TLSConfig(host)); tlsErr != nil {
+			return tlsErr
+		}
+	}
+
+	if auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return fmt.Errorf("The SMTP server %v doesn't support AUTH", address)
+		}
+		if authErr := client.Auth(auth); authErr != nil {
+			return authErr
+		}
+	}
+
+	if mailErr := client.Mail(from); mailErr != nil {
+		return mailErr
+	}
+
+	for _, recipient := range to {
+		if rcptErr := client.Rcpt(recipient); rcptErr != nil {
+			return rcptErr
+		}
+	}
+
+	writer, dataErr := client.Data()
+	if dataErr != nil {
+		return dataErr
+	}
+
+	if _, writeErr := writer.Write(message); writeErr != nil {
+		return writeErr
+	}
+
+	if closeErr := writer.Close(); closeErr != nil {
+		return closeErr
+	}
+
+	return client.Quit()
+}
+
+// contextDialer returns the dialer for the current config. Destinations in
+// ProxyBypass and loopback addresses are dialed directly, everything else goes
+// through ProxyURL. Everything is dialed directly when ProxyURL isn't set.
+func contextDialer() (proxy.ContextDialer, error) {
+
+	direct := &net.Dialer{Timeout: DIAL_TIMEOUT_SECONDS * time.Second}
+
+	if config.Cfg.ProxyURL == "" {
+		return direct, nil
+	}
+
+	proxyURL, parseErr := url.Parse(config.Cfg.ProxyURL)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+
+	proxied, proxyErr := proxy.FromURL(proxyURL, direct)
+	if proxyErr != nil {
+		return nil, proxyErr
+	}
+
+	perHost := proxy.NewPerHost(proxied, direct)
+	perHost.AddFromString(LOOPBACK_BYPASS)
+	perHost.AddFromString(strings.Join(config.Cfg.ProxyBypass, ","))
+
+	return perHost, nil
+}
@@ -0,0 +1,535 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/state"
+)
+
+func TestMain(m *testing.M) {
+
+	logErr := logger.StandardLogger("transport_test")
+	if logErr != nil {
+		fmt.Println(fmt.Sprintf("Could not initialize logger: %v", logErr))
+		return
+	}
+
+	configErr := config.FromFile()
+	if configErr != nil {
+		fmt.Println(configErr)
+		return
+	}
+
+	result := m.Run()
+	os.Exit(result)
+}
+
+// fakeSOCKS5 is a minimal SOCKS5 server which records the destination of every
+// CONNECT and forwards it to target regardless of where it was meant to go.
+type fakeSOCKS5 struct {
+	listener     net.Listener
+	target       string
+	lock         sync.Mutex
+	destinations []string
+}
+
+func (fs *fakeSOCKS5) serve() {
+	for 1 == 1 {
+		conn, acceptErr := fs.listener.Accept()
+		if acceptErr != nil {
+			return
+		}
+		go fs.handle(conn)
+	}
+}
+
+func (fs *fakeSOCKS5) handle(conn net.Conn) {
+	defer conn.Close()
+
+	greeting := make([]byte, 2)
+	if _, readErr := io.ReadFull(conn, greeting); readErr != nil {
+		return
+	}
+	io.ReadFull(conn, make([]byte, greeting[1]))
+	conn.Write([]byte{5, 0})
+
+	request := make([]byte, 4)
+	if _, readErr := io.ReadFull(conn, request); readErr != nil {
+		return
+	}
+
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 3:
+		length := make([]byte, 1)
+		io.ReadFull(conn, length)
+		name := make([]byte, length[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	io.ReadFull(conn, port)
+
+	fs.lock.Lock()
+	fs.destinations = append(fs.destinations, net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	fs.lock.Unlock()
+
+	upstream, dialErr := net.Dial("tcp", fs.target)
+	if dialErr != nil {
+		conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func (fs *fakeSOCKS5) seen() []string {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return append([]string{}, fs.destinations...)
+}
+
+func TestProxiedHTTP(t *testing.T) {
+
+	defer func(proxyURL string, bypass []string) {
+		config.Cfg.ProxyURL = proxyURL
+		config.Cfg.ProxyBypass = bypass
+	}(config.Cfg.ProxyURL, config.Cfg.ProxyBypass)
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	defer listener.Close()
+
+	socks := &fakeSOCKS5{listener: listener, target: server.Listener.Addr().String()}
+	go socks.serve()
+
+	config.Cfg.ProxyURL = "socks5://" + listener.Addr().String()
+	config.Cfg.ProxyBypass = []string{"*.internal.example"}
+
+	client := HTTPClient(10 * time.Second)
+
+	response, getErr := client.Get("http://fleet.example.com:8080/")
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+
+	if string(body) != "hello" {
+		t.Errorf("expected the request to be forwarded by the proxy, got: %v", string(body))
+	}
+
+	if seen := socks.seen(); len(seen) != 1 || seen[0] != "fleet.example.com:8080" {
+		t.Errorf("expected the proxy to resolve the host name itself, got: %v", seen)
+	}
+
+	// loopback is always dialed directly
+	response, getErr = client.Get(server.URL)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	response.Body.Close()
+
+	// bypassed destinations never reach the proxy even when they can't be dialed
+	Dial("tcp", "mail.internal.example:25")
+
+	if seen := socks.seen(); len(seen) != 1 {
+		t.Errorf("expected loopback and bypassed destinations to skip the proxy, got: %v", seen)
+	}
+}
+
+func TestDirectWithoutProxy(t *testing.T) {
+
+	defer func(proxyURL string) {
+		config.Cfg.ProxyURL = proxyURL
+	}(config.Cfg.ProxyURL)
+	config.Cfg.ProxyURL = ""
+
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	defer listener.Close()
+
+	conn, dialErr := Dial("tcp", listener.Addr().String())
+	if dialErr != nil {
+		t.Fatal(dialErr)
+	}
+	conn.Close()
+}
+
+func TestConnectivity(t *testing.T) {
+
+	changes := make(chan events.ConnectivityChanged, 2)
+	unsubscribe := events.Subscribe("transport_test", func(record events.Record) {
+		if changed, ok := record.Event.(events.ConnectivityChanged); ok {
+			changes <- changed
+		}
+	})
+	defer unsubscribe()
+
+	// forget the failures of earlier tests
+	MarkOnline()
+
+	// repeated failures to a single destination aren't an outage
+	for attempt := 0; attempt < OFFLINE_DIAL_FAILURES; attempt++ {
+		Dial("tcp", "first.invalid:80")
+	}
+
+	if !Online() {
+		t.Fatalf("expected a single broken destination not to start an outage")
+	}
+
+	Dial("tcp", "second.invalid:80")
+
+	if Online() || OutageDuration() <= 0 {
+		t.Fatalf("expected failures to several destinations to start an outage")
+	}
+
+	reconnected := Reconnected()
+	MarkOnline()
+
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Reconnected to be closed when connectivity returned")
+	}
+
+	WaitOnline()
+
+	for _, online := range []bool{false, true} {
+		select {
+		case changed := <-changes:
+			if changed.Online != online {
+				t.Errorf("expected a ConnectivityChanged event with Online %v, got: %+v", online, changed)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected a ConnectivityChanged event")
+		}
+	}
+
+	if summary, _ := ConnectivitySummary(); !strings.HasPrefix(summary, "online.") || !strings.Contains(summary, "the last lasting") {
+		t.Errorf("unexpected connectivity summary: %v", summary)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+
+	defer func(limit int, budget config.ByteSize) {
+		config.Cfg.BandwidthLimitKbps = limit
+		config.Cfg.MonthlyByteBudget = budget
+	}(config.Cfg.BandwidthLimitKbps, config.Cfg.MonthlyByteBudget)
+
+	stateDir, dirErr := ioutil.TempDir("", "transport_test")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(stateDir)
+	if openErr := state.Open(filepath.Join(stateDir, "agent_state.json")); openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer state.Open(config.Cfg.StateFile)
+	usageLoaded = false
+
+	// 80 kbps is 10000 bytes per second
+	config.Cfg.BandwidthLimitKbps = 80
+	config.Cfg.MonthlyByteBudget = 25000
+
+	client, server := net.Pipe()
+	defer server.Close()
+	go io.Copy(ioutil.Discard, server)
+
+	before := BytesUsedThisMonth()
+	started := time.Now()
+
+	metered := meter(client, "fleet.example.com:443")
+	if _, writeErr := metered.Write(make([]byte, 30000)); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	metered.Close()
+
+	if elapsed := time.Since(started); elapsed < 1500*time.Millisecond {
+		t.Errorf("expected 30000 bytes at 10000 bytes per second to be held back, took: %v", elapsed)
+	}
+
+	if used := BytesUsedThisMonth() - before; used != 30000 {
+		t.Errorf("expected 30000 bytes to be counted, got: %d", used)
+	}
+
+	if _, dialErr := Dial("tcp", "fleet.example.com:443"); dialErr == nil {
+		t.Errorf("expected no new connections once the budget is used up")
+	} else if _, exhausted := dialErr.(ErrBudgetExhausted); !exhausted {
+		t.Errorf("expected ErrBudgetExhausted, got: %v", dialErr)
+	}
+
+	if summary, _ := BandwidthSummary(); !strings.Contains(summary, "Limited to 80 kbps") {
+		t.Errorf("unexpected bandwidth summary: %v", summary)
+	}
+}
+
+func TestFailover(t *testing.T) {
+
+	defer func(selection string) {
+		config.Cfg.EndpointSelection = selection
+	}(config.Cfg.EndpointSelection)
+	config.Cfg.EndpointSelection = "order"
+
+	endpoints := []string{"http://primary.invalid", "http://secondary.invalid", "http://tertiary.invalid"}
+	down := map[string]bool{"http://primary.invalid": true}
+
+	var tried []string
+	try := func(endpoint string) error {
+		tried = append(tried, endpoint)
+		if down[endpoint] {
+			return fmt.Errorf("%v is down", endpoint)
+		}
+		return nil
+	}
+
+	worked, failoverErr := Failover(endpoints, try)
+	if failoverErr != nil || worked != "http://secondary.invalid" || strings.Join(tried, " ") != "http://primary.invalid http://secondary.invalid" {
+		t.Fatalf("expected to fail over to the secondary, got: %v %v tried %v", worked, failoverErr, tried)
+	}
+
+	// the last working endpoint is tried first even once the primary is back
+	down = map[string]bool{}
+	tried = nil
+	if worked, _ = Failover(endpoints, try); worked != "http://secondary.invalid" || len(tried) != 1 {
+		t.Errorf("expected the cached secondary to be tried first, got: %v tried %v", worked, tried)
+	}
+
+	down = map[string]bool{"http://secondary.invalid": true, "http://tertiary.invalid": true}
+	tried = nil
+	if worked, _ = Failover(endpoints, try); worked != "http://primary.invalid" || strings.Join(tried, " ") != "http://secondary.invalid http://primary.invalid" {
+		t.Errorf("expected to fail back to the primary, got: %v tried %v", worked, tried)
+	}
+
+	down = map[string]bool{"http://primary.invalid": true, "http://secondary.invalid": true, "http://tertiary.invalid": true}
+	if _, failoverErr = Failover(endpoints, try); failoverErr == nil || !strings.Contains(failoverErr.Error(), "tertiary.invalid is down") {
+		t.Errorf("expected every failure to be reported, got: %v", failoverErr)
+	}
+
+	// the kind of each failure survives failing over
+	try = func(endpoint string) error {
+		return ErrDownloadFailed{URL: endpoint, Status: http.StatusNotFound}
+	}
+	var downloadErr ErrDownloadFailed
+	if _, failoverErr = Failover(endpoints, try); !errors.As(failoverErr, &downloadErr) || downloadErr.Status != http.StatusNotFound {
+		t.Errorf("expected the ErrDownloadFailed of an endpoint, got: %#v", failoverErr)
+	}
+
+	if _, failoverErr = Failover(nil, try); failoverErr == nil {
+		t.Errorf("expected an error without any endpoints")
+	}
+}
+
+func TestCheckStatus(t *testing.T) {
+
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	for _, expected := range []int{http.StatusOK, http.StatusNotFound, http.StatusServiceUnavailable} {
+		status = expected
+		response, getErr := http.Get(server.URL + "/version.no?key=secret")
+		if getErr != nil {
+			t.Fatal(getErr)
+		}
+		response.Body.Close()
+
+		statusErr := CheckStatus(response)
+		if expected == http.StatusOK {
+			if statusErr != nil {
+				t.Errorf("expected 200 OK to pass, got: %v", statusErr)
+			}
+			continue
+		}
+
+		downloadErr, failed := statusErr.(ErrDownloadFailed)
+		if !failed || downloadErr.Status != expected || downloadErr.URL != server.URL+"/version.no" {
+			t.Errorf("expected an ErrDownloadFailed with status %d and no query, got: %#v", expected, statusErr)
+		}
+		if downloadErr.Temporary() != (expected == http.StatusServiceUnavailable) {
+			t.Errorf("expected only status 503 to be temporary, got %v for %d", downloadErr.Temporary(), expected)
+		}
+	}
+}
+
+func TestFailoverByLatency(t *testing.T) {
+
+	defer func(selection string) {
+		config.Cfg.EndpointSelection = selection
+	}(config.Cfg.EndpointSelection)
+	config.Cfg.EndpointSelection = "latency"
+
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	defer listener.Close()
+
+	// nothing listens on the first endpoint so it's measured as unreachable
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedAddress := closed.Addr().String()
+	closed.Close()
+
+	endpoints := []string{"http://" + closedAddress, "http://" + listener.Addr().String()}
+
+	var tried []string
+	worked, failoverErr := Failover(endpoints, func(endpoint string) error {
+		tried = append(tried, endpoint)
+		return nil
+	})
+
+	if failoverErr != nil || worked != endpoints[1] || len(tried) != 1 {
+		t.Errorf("expected the reachable endpoint to be tried first, got: %v %v tried %v", worked, failoverErr, tried)
+	}
+}
+
+func TestPinning(t *testing.T) {
+
+	defer func(pins map[string][]string) { config.Cfg.TLSPins = pins }(config.Cfg.TLSPins)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		fmt.Fprint(writer, "ok")
+	}))
+	defer server.Close()
+
+	certificate := server.Certificate()
+	state := tls.ConnectionState{ServerName: "fleet.example.com", PeerCertificates: []*x509.Certificate{certificate}}
+
+	config.Cfg.TLSPins = nil
+	if pinErr := verifyPins(state); pinErr != nil {
+		t.Errorf("expected a host without pins to only be verified the usual way, got: %v", pinErr)
+	}
+
+	var mismatches []events.Record
+	var mismatchesLock sync.Mutex
+	unsubscribe := events.Subscribe("transport_test_pins", func(record events.Record) {
+		if record.Kind == events.CERTIFICATE_PIN_MISMATCH {
+			mismatchesLock.Lock()
+			mismatches = append(mismatches, record)
+			mismatchesLock.Unlock()
+		}
+	})
+	defer unsubscribe()
+
+	config.Cfg.TLSPins = map[string][]string{"fleet.example.com": {"sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}}
+	if pinErr := verifyPins(state); pinErr == nil {
+		t.Errorf("expected a certificate without a pinned key to be refused")
+	}
+	verifyPins(state)
+
+	config.Cfg.TLSPins["fleet.example.com"] = append(config.Cfg.TLSPins["fleet.example.com"], SPKIPin(certificate))
+	if pinErr := verifyPins(state); pinErr != nil {
+		t.Errorf("expected a certificate with a pinned key to be accepted, got: %v", pinErr)
+	}
+
+	// plain HTTP to a pinned host is refused before it's sent
+	config.Cfg.TLSPins["127.0.0.1"] = []string{SPKIPin(certificate)}
+	if _, getErr := HTTPClient(5 * time.Second).Get("http://127.0.0.1:1/"); getErr == nil || !strings.Contains(getErr.Error(), "can only be reached over TLS") {
+		t.Errorf("expected plain HTTP to a pinned host to be refused, got: %v", getErr)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	mismatchesLock.Lock()
+	defer mismatchesLock.Unlock()
+	if len(mismatches) != 1 {
+		t.Errorf("expected a single mismatch to be published, got: %+v", mismatches)
+	}
+}
+
+func TestNewClient(t *testing.T) {
+
+	var attemptsLock sync.Mutex
+	attempts := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		attemptsLock.Lock()
+		attempts[request.Method]++
+		attempt := attempts[request.Method]
+		attemptsLock.Unlock()
+
+		if attempt < 3 || request.URL.Path == "/down" {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		writer.Write([]byte("42"))
+	}))
+	defer server.Close()
+
+	client := NewClient("transport_test", 10*time.Second, DEFAULT_CLIENT_RETRIES)
+
+	// the GET fails twice and then succeeds on its last retry
+	response, getErr := client.Get(server.URL)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || string(body) != "42" {
+		t.Errorf("expected the GET to be retried until it succeeded, got: %v %s", response.Status, body)
+	}
+
+	// a POST may already have been acted on so it's never retried
+	response, postErr := client.Post(server.URL, "application/json", strings.NewReader("{}"))
+	if postErr != nil {
+		t.Fatal(postErr)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusServiceUnavailable || attempts[http.MethodPost] != 1 {
+		t.Errorf("expected the POST to be sent once, got: %v after %d attempts", response.Status, attempts[http.MethodPost])
+	}
+
+	stats := Stats()["transport_test"]
+	if stats.Requests != 2 || stats.Retries != 2 || stats.Failures != 1 || stats.Latency <= 0 {
+		t.Errorf("expected 2 requests, 2 retries and 1 failure to be counted, got: %+v", stats)
+	}
+
+	metrics, _ := ClientMetrics()
+	if metrics["http_transport_test_requests"] != 2 || metrics["http_transport_test_retries"] != 2 {
+		t.Errorf("expected the counts to be published as metrics, got: %v", metrics)
+	}
+
+	// a client which gave up doesn't keep retrying after its timeout
+	started := time.Now()
+	if _, getErr := NewClient("transport_test", 100*time.Millisecond, 10).Get(server.URL + "/down"); getErr == nil || time.Since(started) > 5*time.Second {
+		t.Errorf("expected the timeout to cover the retries, got: %v after %v", getErr, time.Since(started))
+	}
+}
@@ -0,0 +1,265 @@
+package updater
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/clock"
+	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/transport"
+	"github.com/seantcanavan/anon-eth-net/utils"
+)
+
+// The suffix of an artifact in the UpdateCacheDir which is still being
+// downloaded. It's resumed from where it stopped on the next fetch
+const PARTIAL_SUFFIX = ".partial"
+
+// How long downloading a single artifact can take before it's given up on
+// and resumed on the next fetch. In minutes
+const ARTIFACT_TIMEOUT_MINUTES = 30
+
+// ErrOutsideDownloadWindow is returned by scheduled fetches which would have
+// to download an artifact outside of the UpdateDownloadWindow.
+type ErrOutsideDownloadWindow struct {
+	Window string
+}
+
+// Error describes when downloads are allowed.
+func (eodw ErrOutsideDownloadWindow) Error() string {
+	return fmt.Sprintf("Artifacts are only downloaded between %v", eodw.Window)
+}
+
+// Only one artifact is fetched at a time so two fetches of the same hash
+// don't write to the same partial download
+var cacheLock sync.Mutex
+
+// FetchArtifact will return the path of the artifact with the given SHA-256
+// hash in the UpdateCacheDir, downloading it from the given URL first unless
+// it's already cached. Artifacts are kept by hash, so the same artifact is
+// only ever downloaded once however many times it's installed, re-applied or
+// rolled back to. A download which is interrupted is resumed where it stopped
+// on the next fetch, even after a restart, as long as the server supports
+// range requests. The artifact is verified against the hash before it's
+// cached and a download which doesn't match is thrown away. The progress of
+// the download is published as UpdateProgress events.
+func (u *Updater) FetchArtifact(artifactURL string, hash string) (string, error) {
+
+	name := artifactURL
+	if parsed, parseErr := url.Parse(artifactURL); parseErr == nil {
+		name = path.Base(parsed.Path)
+	}
+	return u.fetchArtifact(name, artifactURL, hash, false)
+}
+
+// fetchArtifact will fetch the artifact like FetchArtifact, publishing its
+// progress under the given component name. A scheduled fetch of an artifact
+// which isn't cached yet fails with ErrOutsideDownloadWindow outside of the
+// UpdateDownloadWindow.
+func (u *Updater) fetchArtifact(component string, artifactURL string, hash string, scheduled bool) (string, error) {
+
+	hash = strings.ToLower(hash)
+	if decoded, decodeErr := hex.DecodeString(hash); decodeErr != nil || len(decoded) != 32 {
+		return "", fmt.Errorf("The artifact hash %q isn't a hex SHA-256 hash", hash)
+	}
+
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	cacheDir := u.settings().UpdateCacheDir
+	if mkdirErr := os.MkdirAll(cacheDir, 0700); mkdirErr != nil {
+		return "", mkdirErr
+	}
+
+	cached := filepath.Join(cacheDir, hash)
+	if actual, hashErr := fileHash(cached); hashErr == nil {
+		if actual == hash {
+			// the retention policy keeps artifacts which are still being used
+			now := u.clk().Now()
+			os.Chtimes(cached, now, now)
+			progress(events.UPDATE_STAGE_VERIFYING, component, "found in the update cache")
+			u.log().LogMessagef("Successfully found the artifact %v in the update cache", hash)
+			return cached, nil
+		}
+		u.log().LogErrorf("The cached artifact %v was corrupted. Downloading it again", hash)
+		os.Remove(cached)
+	}
+
+	window := u.settings().UpdateDownloadWindow
+	if scheduled && window != "" && !config.InWindow(window, u.clk().Now()) {
+		return "", ErrOutsideDownloadWindow{Window: window}
+	}
+
+	partial := cached + PARTIAL_SUFFIX
+	if downloadErr := u.download(component, artifactURL, partial); downloadErr != nil {
+		return "", downloadErr
+	}
+
+	progress(events.UPDATE_STAGE_VERIFYING, component, "checking the SHA-256 hash of the download")
+	actual, hashErr := fileHash(partial)
+	if hashErr != nil {
+		return "", hashErr
+	}
+	if actual != hash {
+		os.Remove(partial)
+		return "", fmt.Errorf("The artifact downloaded from %v has the SHA-256 hash %v instead of %v so it was thrown away", artifactURL, actual, hash)
+	}
+
+	if renameErr := os.Rename(partial, cached); renameErr != nil {
+		return "", renameErr
+	}
+
+	u.log().LogMessagef("Successfully downloaded the artifact %v from %v", hash, artifactURL)
+	return cached, nil
+}
+
+// download will append the rest of the artifact at the given URL to the given
+// partial download, or start it again when the server doesn't support range
+// requests. Whatever was downloaded is kept when the download fails. Progress
+// is published under the given component name when the server says how big
+// the artifact is. The download is kept under UpdateDownloadRate.
+func (u *Updater) download(component string, artifactURL string, partial string) error {
+
+	file, openErr := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0600)
+	if openErr != nil {
+		return openErr
+	}
+	defer file.Close()
+
+	offset, seekErr := file.Seek(0, io.SeekEnd)
+	if seekErr != nil {
+		return seekErr
+	}
+
+	request, requestErr := http.NewRequest(http.MethodGet, artifactURL, nil)
+	if requestErr != nil {
+		return requestErr
+	}
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	response, getErr := u.httpClient(ARTIFACT_TIMEOUT_MINUTES * time.Minute).Do(request)
+	if getErr != nil {
+		return getErr
+	}
+	defer response.Body.Close()
+
+	total := response.ContentLength
+	switch {
+	case response.StatusCode == http.StatusPartialContent && strings.HasPrefix(response.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)):
+		u.log().LogMessagef("Resuming the download of %v from %d bytes", artifactURL, offset)
+		if total >= 0 {
+			total += offset
+		}
+	case response.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// everything was already downloaded, which the hash will confirm
+		return nil
+	case response.StatusCode == http.StatusOK:
+		if offset > 0 {
+			u.log().LogMessagef("%v can't resume downloads. Starting the download again", artifactURL)
+		}
+		if truncateErr := file.Truncate(0); truncateErr != nil {
+			return truncateErr
+		}
+		if _, seekErr := file.Seek(0, io.SeekStart); seekErr != nil {
+			return seekErr
+		}
+		offset = 0
+	default:
+		return transport.CheckStatus(response)
+	}
+
+	body := io.Reader(response.Body)
+	if rate := int64(u.settings().UpdateDownloadRate); rate > 0 {
+		body = &throttledReader{reader: body, rate: rate, clk: u.clk(), started: u.clk().Now()}
+	}
+	if pw := newProgressWriter(component, offset, total); pw != nil {
+		body = io.TeeReader(body, pw)
+	}
+
+	if _, copyErr := io.Copy(file, body); copyErr != nil {
+		file.Sync()
+		return fmt.Errorf("The download of %v was interrupted and will be resumed: %w", artifactURL, copyErr)
+	}
+
+	return file.Sync()
+}
+
+// StageArtifact will copy the given cached artifact into the
+// UpdateQuarantineDir under the given name, where it's scanned before it's
+// installed. The cached copy is left alone so it can be staged again.
+func (u *Updater) StageArtifact(cached string, name string) (string, error) {
+
+	quarantineDir := u.settings().UpdateQuarantineDir
+	if mkdirErr := os.MkdirAll(quarantineDir, 0700); mkdirErr != nil {
+		return "", mkdirErr
+	}
+
+	source, openErr := os.Open(cached)
+	if openErr != nil {
+		return "", openErr
+	}
+	defer source.Close()
+
+	// the name comes from the manifest so make sure it can't lead out of the
+	// quarantine directory, e.g. when it's ".."
+	staged, resolveErr := utils.ResolveWithin(quarantineDir, filepath.Base(name))
+	if resolveErr != nil {
+		return "", resolveErr
+	}
+	destination, createErr := os.OpenFile(staged, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if createErr != nil {
+		return "", createErr
+	}
+
+	if _, copyErr := io.Copy(destination, source); copyErr != nil {
+		destination.Close()
+		os.Remove(staged)
+		return "", copyErr
+	}
+
+	if closeErr := destination.Close(); closeErr != nil {
+		return "", closeErr
+	}
+
+	u.log().LogMessagef("Successfully staged the update %v for scanning", staged)
+	return staged, nil
+}
+
+// throttledReader reads no faster than the given rate by sleeping whenever it
+// gets ahead of it.
+type throttledReader struct {
+	reader  io.Reader
+	rate    int64 // in bytes per second
+	clk     clock.Clock
+	started time.Time
+	read    int64
+}
+
+// Read satisfies the io.Reader interface. No more than a second's worth of
+// bytes are read at once.
+func (tr *throttledReader) Read(buffer []byte) (int, error) {
+
+	if int64(len(buffer)) > tr.rate {
+		buffer = buffer[:tr.rate]
+	}
+
+	count, readErr := tr.reader.Read(buffer)
+	tr.read += int64(count)
+
+	due := tr.started.Add(time.Duration(float64(tr.read) / float64(tr.rate) * float64(time.Second)))
+	if wait := due.Sub(tr.clk.Now()); wait > 0 {
+		tr.clk.Sleep(wait)
+	}
+	return count, readErr
+}
@@ -0,0 +1,605 @@
+package updater
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/state"
+	"github.com/seantcanavan/anon-eth-net/transport"
+)
+
+// The name of the component in a manifest which is the agent itself
+const AGENT_COMPONENT = "agent"
+
+// The state bucket the installed version of each component is saved in, by
+// name
+const COMPONENTS_BUCKET = "components"
+
+// The largest manifest accepted
+const MAX_MANIFEST_BYTES = 1024 * 1024
+
+// How long the health check of a single component can take. In seconds
+const HEALTH_CHECK_TIMEOUT_SECONDS = 60
+
+// Replaced with the path a component is installed to in its health check
+const PATH_PLACEHOLDER = "{path}"
+
+// Replaced with the UpdatePinnedVersion in the UpdateManifestURI, or with
+// LATEST_VERSION when it isn't set
+const VERSION_PLACEHOLDER = "{version}"
+
+// Replaces VERSION_PLACEHOLDER when the updater isn't pinned to a version
+const LATEST_VERSION = "latest"
+
+// The most output of a failed health check kept in the error
+const MAX_HEALTH_OUTPUT_BYTES = 512
+
+// Manifest describes every component of a single release. Components are
+// installed in the order they're listed.
+type Manifest struct {
+	Version    uint64      `json:"version"`
+	Components []Component `json:"components"`
+}
+
+// Component is a single program of a release, such as the agent, the watchdog
+// or a bundled miner. It's either a single build at URL, or one of Artifacts
+// for each platform it's built for, of which the one for this machine is
+// installed. Requires holds the versions of other components it works with,
+// by name, as comma separated constraints such as ">=70,<80". HealthCheck is
+// the command run once it's installed, with PATH_PLACEHOLDER replaced by
+// where it was installed. Exiting with anything other than 0 rolls back the
+// whole release.
+type Component struct {
+	Name        string            `json:"name"`
+	Version     uint64            `json:"version"`
+	URL         string            `json:"url,omitempty"`
+	SHA256      string            `json:"sha256,omitempty"`
+	Artifacts   []Artifact        `json:"artifacts,omitempty"`
+	Requires    map[string]string `json:"requires,omitempty"`
+	HealthCheck []string          `json:"healthCheck,omitempty"`
+}
+
+// plannedComponent is a component of a manifest which is about to be
+// installed on this machine.
+type plannedComponent struct {
+	Component
+	path        string // where it's installed
+	from        uint64 // the version installed now, zero if it isn't
+	cached      string // the verified artifact in the UpdateCacheDir
+	staged      string // the copy in the UpdateQuarantineDir which is scanned
+	previous    string // the hash of the file it replaced in the UpdateCacheDir, empty if there wasn't one
+	replacedNew bool   // whether there was no file at path before it was installed
+}
+
+// String describes the planned component, e.g. miner 3 -> 4.
+func (pc plannedComponent) String() string {
+	return fmt.Sprintf("%v %d -> %d", pc.Name, pc.from, pc.Version)
+}
+
+// Validate returns an error describing the first problem with the manifest:
+// a component without a name, a build without a URL or SHA-256 hash or a
+// platform, a name listed twice or a constraint which can't be parsed.
+func (m Manifest) Validate() error {
+
+	seen := make(map[string]bool)
+	for _, component := range m.Components {
+		if component.Name == "" {
+			return fmt.Errorf("Every component of the manifest needs a name")
+		}
+		if seen[component.Name] {
+			return fmt.Errorf("The component %v is listed more than once in the manifest", component.Name)
+		}
+		seen[component.Name] = true
+
+		artifacts := component.Artifacts
+		if len(artifacts) == 0 {
+			artifacts = []Artifact{{URL: component.URL, SHA256: component.SHA256}}
+		}
+		for _, artifact := range artifacts {
+			build := component.Name
+			if len(component.Artifacts) > 0 {
+				if artifact.OS == "" || artifact.Arch == "" {
+					return fmt.Errorf("Every artifact of the component %v needs an os and an arch", component.Name)
+				}
+				build += " for " + artifact.Platform.String()
+			}
+			if artifact.URL == "" {
+				return fmt.Errorf("The component %v needs a url", build)
+			}
+			if decoded, decodeErr := hex.DecodeString(artifact.SHA256); decodeErr != nil || len(decoded) != 32 {
+				return fmt.Errorf("The sha256 of the component %v isn't a hex SHA-256 hash", build)
+			}
+		}
+		for required, constraint := range component.Requires {
+			if _, constraintErr := satisfies(0, constraint); constraintErr != nil {
+				return fmt.Errorf("The component %v requires %v %v: %v", component.Name, required, constraint, constraintErr)
+			}
+		}
+	}
+	return nil
+}
+
+// satisfies returns whether the given version meets every one of the comma
+// separated constraints, each an operator of =, !=, <, <=, > or >= followed
+// by a version number, e.g. ">=70,<80".
+func satisfies(version uint64, constraints string) (bool, error) {
+
+	met := true
+	for _, constraint := range strings.Split(constraints, ",") {
+		constraint = strings.TrimSpace(constraint)
+
+		operator := strings.TrimRight(constraint, "0123456789 ")
+		bound, parseErr := strconv.ParseUint(strings.TrimSpace(constraint[len(operator):]), 10, 64)
+		if parseErr != nil {
+			return false, fmt.Errorf("%q isn't an operator followed by a version number", constraint)
+		}
+
+		switch operator {
+		case "=", "==":
+			met = met && version == bound
+		case "!=":
+			met = met && version != bound
+		case "<":
+			met = met && version < bound
+		case "<=":
+			met = met && version <= bound
+		case ">":
+			met = met && version > bound
+		case ">=":
+			met = met && version >= bound
+		default:
+			return false, fmt.Errorf("%q has an unknown operator %q", constraint, operator)
+		}
+	}
+	return met, nil
+}
+
+// fetchManifest will download and validate the manifest at the first of the
+// UpdateManifestURI which works, with VERSION_PLACEHOLDER replaced by the
+// UpdatePinnedVersion or LATEST_VERSION. When the UpdateTUFURI is set the
+// manifest is downloaded from there instead and only trusted once the TUF
+// metadata vouches for it. A pinned manifest has to be of the pinned version.
+func (u *Updater) fetchManifest() (Manifest, error) {
+
+	progress(events.UPDATE_STAGE_CHECKING, "", "retrieving the manifest")
+
+	version := LATEST_VERSION
+	pinned := u.settings().UpdatePinnedVersion
+	if pinned != 0 {
+		version = strconv.FormatUint(pinned, 10)
+	}
+
+	if len(u.settings().UpdateTUFURI) > 0 {
+		body, tufErr := u.fetchTUFManifest(version)
+		if tufErr != nil {
+			return Manifest{}, tufErr
+		}
+		return u.decodeManifest(TUF_MANIFEST_TARGET, body)
+	}
+
+	manifestURIs := make([]string, 0, len(u.settings().UpdateManifestURI))
+	for _, manifestURI := range u.settings().UpdateManifestURI {
+		manifestURIs = append(manifestURIs, strings.Replace(manifestURI, VERSION_PLACEHOLDER, version, -1))
+	}
+
+	var manifest Manifest
+	_, failoverErr := transport.Failover(manifestURIs, func(manifestURI string) error {
+
+		request, requestErr := http.NewRequest(http.MethodGet, manifestURI, nil)
+		if requestErr != nil {
+			return requestErr
+		}
+
+		response, getErr := u.httpClient(VERSION_CHECK_TIMEOUT_SECONDS * time.Second).Do(request)
+		if getErr != nil {
+			return getErr
+		}
+		defer response.Body.Close()
+
+		if statusErr := transport.CheckStatus(response); statusErr != nil {
+			return statusErr
+		}
+
+		body, readErr := ioutil.ReadAll(io.LimitReader(response.Body, MAX_MANIFEST_BYTES))
+		if readErr != nil {
+			return readErr
+		}
+
+		var decodeErr error
+		manifest, decodeErr = u.decodeManifest(manifestURI, body)
+		return decodeErr
+	})
+
+	return manifest, failoverErr
+}
+
+// decodeManifest will decode and validate the manifest downloaded from the
+// given source. A pinned manifest has to be of the pinned version.
+func (u *Updater) decodeManifest(source string, body []byte) (Manifest, error) {
+
+	var manifest Manifest
+	if jsonErr := json.Unmarshal(body, &manifest); jsonErr != nil {
+		return Manifest{}, fmt.Errorf("Could not decode the manifest from %v: %v", source, jsonErr)
+	}
+
+	if pinned := u.settings().UpdatePinnedVersion; pinned != 0 && manifest.Version != pinned {
+		return Manifest{}, fmt.Errorf("The manifest from %v is of version %d instead of the pinned version %d. Put %v where the version goes", source, manifest.Version, pinned, VERSION_PLACEHOLDER)
+	}
+
+	if validateErr := manifest.Validate(); validateErr != nil {
+		return Manifest{}, validateErr
+	}
+
+	u.log().LogMessagef("Successfully retrieved the manifest of version %d with %d components from %v", manifest.Version, len(manifest.Components), source)
+	return manifest, nil
+}
+
+// manifestConfigured returns whether updates are described by a manifest,
+// from either the UpdateManifestURI or the UpdateTUFURI.
+func (u *Updater) manifestConfigured() bool {
+	return len(u.settings().UpdateManifestURI) > 0 || len(u.settings().UpdateTUFURI) > 0
+}
+
+// installedVersions returns the version of each component installed on this
+// machine, by name. The agent is at least the LocalVersion.
+func (u *Updater) installedVersions() map[string]uint64 {
+
+	installed := make(map[string]uint64)
+	viewErr := state.View(func(tx *state.Tx) error {
+		components := tx.Bucket(COMPONENTS_BUCKET)
+		for _, name := range components.Keys() {
+			var version uint64
+			if _, getErr := components.Get(name, &version); getErr != nil {
+				return getErr
+			}
+			installed[name] = version
+		}
+		return nil
+	})
+	if viewErr != nil {
+		u.log().LogErrorf("Unable to read the installed versions of the components: %v", viewErr)
+	}
+
+	if installed[AGENT_COMPONENT] < u.settings().LocalVersion {
+		installed[AGENT_COMPONENT] = u.settings().LocalVersion
+	}
+	return installed
+}
+
+// componentPath returns where the named component is installed on this
+// machine, and false if it isn't listed in the UpdateComponents. The agent is
+// always the running executable.
+func (u *Updater) componentPath(name string) (string, bool) {
+
+	if name == AGENT_COMPONENT {
+		executable, executableErr := os.Executable()
+		if executableErr != nil {
+			return "", false
+		}
+		if resolved, resolveErr := filepath.EvalSymlinks(executable); resolveErr == nil {
+			executable = resolved
+		}
+		return executable, true
+	}
+
+	componentPath, listed := u.settings().UpdateComponents[name]
+	return componentPath, listed
+}
+
+// planManifest returns the components of the given manifest which are
+// installed on this machine and newer than the installed version, or any
+// other version while the UpdatePinnedVersion is set, in the order they're
+// listed, each with the URL and hash of its build for the platform of this
+// machine. Returns an error when a component of the release, installed here,
+// would be left with another component at a version it doesn't work with, or
+// when one to be installed wasn't built for this platform.
+func (u *Updater) planManifest(manifest Manifest) ([]plannedComponent, error) {
+
+	platform := u.platform()
+	pinned := u.settings().UpdatePinnedVersion != 0
+	installed := u.installedVersions()
+	after := make(map[string]uint64)
+	for name, version := range installed {
+		after[name] = version
+	}
+
+	var plan []plannedComponent
+	var local []Component
+	for _, component := range manifest.Components {
+		componentPath, listed := u.componentPath(component.Name)
+		if !listed {
+			continue
+		}
+		local = append(local, component)
+		if component.Version > installed[component.Name] || pinned && component.Version != installed[component.Name] {
+			artifact, selectErr := selectArtifact(component, platform)
+			if selectErr != nil {
+				return nil, selectErr
+			}
+			component.URL, component.SHA256 = artifact.URL, artifact.SHA256
+			plan = append(plan, plannedComponent{Component: component, path: componentPath, from: installed[component.Name]})
+			after[component.Name] = component.Version
+		}
+	}
+
+	for _, component := range local {
+		for required, constraint := range component.Requires {
+			version, known := after[required]
+			if !known {
+				return nil, fmt.Errorf("The component %v %d requires %v %v, which isn't installed", component.Name, after[component.Name], required, constraint)
+			}
+			if met, _ := satisfies(version, constraint); !met {
+				return nil, fmt.Errorf("The component %v %d requires %v %v, which would be at version %d", component.Name, after[component.Name], required, constraint, version)
+			}
+		}
+	}
+
+	return plan, nil
+}
+
+// fetchPlan will download the manifest, plan which of its components to
+// install, and fetch each of them into the UpdateCacheDir. Scheduled fetches
+// only download outside of the UpdateDownloadWindow when the artifacts are
+// already cached, and fail with ErrOutsideDownloadWindow otherwise.
+func (u *Updater) fetchPlan(scheduled bool) (Manifest, []plannedComponent, error) {
+
+	manifest, manifestErr := u.fetchManifest()
+	if manifestErr != nil {
+		return manifest, nil, manifestErr
+	}
+
+	plan, planErr := u.planManifest(manifest)
+	if planErr != nil {
+		return manifest, nil, planErr
+	}
+
+	for index := range plan {
+		cached, fetchErr := u.fetchArtifact(plan[index].Name, plan[index].URL, plan[index].SHA256, scheduled)
+		if fetchErr != nil {
+			return manifest, nil, fmt.Errorf("Could not download the %v component: %w", plan[index].Name, fetchErr)
+		}
+		plan[index].cached = cached
+	}
+
+	return manifest, plan, nil
+}
+
+// prepareManifest will fetch the planned components of the manifest, unless
+// they're already cached, and stage each of them in the UpdateQuarantineDir
+// so they're scanned before anything is installed.
+func (u *Updater) prepareManifest() (Manifest, []plannedComponent, error) {
+
+	manifest, plan, fetchErr := u.fetchPlan(false)
+	if fetchErr != nil {
+		return manifest, nil, fetchErr
+	}
+
+	for index := range plan {
+		staged, stageErr := u.StageArtifact(plan[index].cached, plan[index].Name)
+		if stageErr != nil {
+			return manifest, nil, stageErr
+		}
+		plan[index].staged = staged
+	}
+
+	return manifest, plan, nil
+}
+
+// FetchUpdate will download every component of the release described by the
+// manifest which InstallUpdate would install into the UpdateCacheDir, without
+// installing anything, so the update is applied straight away later on.
+// Unlike the downloads Run schedules it doesn't wait for the
+// UpdateDownloadWindow. Returns what was fetched.
+func (u *Updater) FetchUpdate() (string, error) {
+
+	if !u.manifestConfigured() {
+		return "", fmt.Errorf("Updates can only be fetched ahead of installing them with the UpdateManifestURI or the UpdateTUFURI")
+	}
+
+	_, plan, fetchErr := u.fetchPlan(false)
+	if fetchErr != nil {
+		return "", fetchErr
+	}
+	if len(plan) == 0 {
+		return "Every component is up to date", nil
+	}
+
+	descriptions := make([]string, 0, len(plan))
+	for _, component := range plan {
+		descriptions = append(descriptions, component.String())
+	}
+	return "Fetched " + strings.Join(descriptions, ", "), nil
+}
+
+// installComponents will install each planned component in order and run its
+// health check. When a component fails to install or fails its health check,
+// every component installed so far, including that one, is put back the way
+// it was in reverse order and an UpdateRolledBack event is published. Returns
+// a description of what was installed.
+func (u *Updater) installComponents(manifest Manifest, plan []plannedComponent) (string, error) {
+
+	if len(plan) == 0 {
+		return "Every component is up to date", nil
+	}
+
+	var installed []plannedComponent
+	for _, component := range plan {
+
+		var previousErr error
+		if _, statErr := os.Stat(component.path); os.IsNotExist(statErr) {
+			component.replacedNew = true
+		} else {
+			component.previous, previousErr = u.cacheFile(component.path)
+		}
+
+		installErr := previousErr
+		if installErr == nil {
+			progress(events.UPDATE_STAGE_SWAPPING, component.Name, component.String())
+			installErr = installFile(component.cached, component.path, component.SHA256)
+			installed = append(installed, component)
+		}
+		if installErr == nil {
+			installErr = healthCheck(component)
+		}
+
+		if installErr != nil {
+			rolledBack := u.rollback(installed)
+			events.Publish(events.UpdateRolledBack{ToVersion: manifest.Version, Component: component.Name, Reason: installErr.Error(), RolledBack: rolledBack})
+			return "", fmt.Errorf("The %v component failed so the update was rolled back: %w", component, installErr)
+		}
+
+		u.log().LogMessagef("Successfully installed the %v component to %v", component, component.path)
+		progress(events.UPDATE_STAGE_HEALTHY, component.Name, component.String())
+	}
+
+	descriptions := make([]string, 0, len(installed))
+	updateErr := state.Update(func(tx *state.Tx) error {
+		components := tx.Bucket(COMPONENTS_BUCKET)
+		for _, component := range installed {
+			if putErr := components.Put(component.Name, component.Version); putErr != nil {
+				return putErr
+			}
+			descriptions = append(descriptions, component.String())
+			os.Remove(component.staged)
+		}
+		return nil
+	})
+	if updateErr != nil {
+		u.log().LogErrorf("Unable to record the installed versions of the components: %v", updateErr)
+	}
+
+	return "Installed " + strings.Join(descriptions, ", "), nil
+}
+
+// rollback will put back the file each of the given components replaced, in
+// reverse order, and return a description of each component it put back.
+func (u *Updater) rollback(installed []plannedComponent) []string {
+
+	var rolledBack []string
+	for index := len(installed) - 1; index >= 0; index-- {
+		component := installed[index]
+
+		var restoreErr error
+		if component.replacedNew {
+			restoreErr = os.Remove(component.path)
+		} else {
+			restoreErr = installFile(filepath.Join(u.settings().UpdateCacheDir, component.previous), component.path, component.previous)
+		}
+		if restoreErr != nil {
+			u.log().LogErrorf("Unable to roll back the %v component at %v: %v", component, component.path, restoreErr)
+			continue
+		}
+
+		rolledBack = append(rolledBack, fmt.Sprintf("%v %d -> %d", component.Name, component.Version, component.from))
+		u.log().LogMessagef("Successfully rolled back the %v component to version %d", component.Name, component.from)
+	}
+	return rolledBack
+}
+
+// cacheFile will copy the file at the given path into the UpdateCacheDir by
+// its hash, unless it's already there, so it can be put back. Returns the
+// hash.
+func (u *Updater) cacheFile(filePath string) (string, error) {
+
+	hash, hashErr := fileHash(filePath)
+	if hashErr != nil {
+		return "", hashErr
+	}
+
+	cached := filepath.Join(u.settings().UpdateCacheDir, hash)
+	if _, statErr := os.Stat(cached); statErr == nil {
+		return hash, nil
+	}
+	if mkdirErr := os.MkdirAll(u.settings().UpdateCacheDir, 0700); mkdirErr != nil {
+		return "", mkdirErr
+	}
+
+	return hash, installFile(filePath, cached, hash)
+}
+
+// installFile will copy the given file over the destination without ever
+// leaving it half written: the copy is made next to the destination and then
+// renamed over it. The copy is executable. It's only renamed over the
+// destination when the copy itself has the given SHA-256 hash, since the
+// source may be in an UpdateCacheDir the agent can write to and be swapped
+// after it was checked.
+func installFile(source string, destination string, hash string) error {
+
+	input, openErr := os.Open(source)
+	if openErr != nil {
+		return openErr
+	}
+	defer input.Close()
+
+	if mkdirErr := os.MkdirAll(filepath.Dir(destination), 0755); mkdirErr != nil {
+		return mkdirErr
+	}
+
+	// a new file of our own, so nothing left in its place can be written through
+	output, createErr := ioutil.TempFile(filepath.Dir(destination), filepath.Base(destination)+".installing")
+	if createErr != nil {
+		return createErr
+	}
+	temporary := output.Name()
+
+	digest := sha256.New()
+	_, copyErr := io.Copy(io.MultiWriter(output, digest), input)
+	if copyErr == nil {
+		copyErr = output.Chmod(0755)
+	}
+	if copyErr == nil {
+		copyErr = output.Sync()
+	}
+	if closeErr := output.Close(); copyErr == nil {
+		copyErr = closeErr
+	}
+	if actual := hex.EncodeToString(digest.Sum(nil)); copyErr == nil && actual != strings.ToLower(hash) {
+		copyErr = fmt.Errorf("%v has the SHA-256 hash %v instead of %v so it wasn't installed", source, actual, hash)
+	}
+	if copyErr != nil {
+		os.Remove(temporary)
+		return copyErr
+	}
+
+	return os.Rename(temporary, destination)
+}
+
+// healthCheck will run the HealthCheck of the given component, if it has one,
+// and return an error holding its output unless it exits with 0 within
+// HEALTH_CHECK_TIMEOUT_SECONDS.
+func healthCheck(component plannedComponent) error {
+
+	if len(component.HealthCheck) == 0 {
+		return nil
+	}
+
+	command := make([]string, len(component.HealthCheck))
+	for index, arg := range component.HealthCheck {
+		command[index] = strings.Replace(arg, PATH_PLACEHOLDER, component.path, -1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), HEALTH_CHECK_TIMEOUT_SECONDS*time.Second)
+	defer cancel()
+
+	output, runErr := exec.CommandContext(ctx, command[0], command[1:]...).CombinedOutput()
+	if runErr != nil {
+		if len(output) > MAX_HEALTH_OUTPUT_BYTES {
+			output = output[:MAX_HEALTH_OUTPUT_BYTES]
+		}
+		return fmt.Errorf("The health check failed: %v %s", runErr, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
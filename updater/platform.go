@@ -0,0 +1,107 @@
+package updater
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// The C library of Linux distributions such as Alpine
+const LIBC_MUSL = "musl"
+
+// The C library of most other Linux distributions
+const LIBC_GLIBC = "glibc"
+
+// The dynamic loader of musl, which only machines using musl have
+const MUSL_LOADER_GLOB = "/lib/ld-musl-*"
+
+// Platform is what an artifact was built for: the GOOS and GOARCH it runs on
+// and, for Linux builds linked against a C library, which one.
+type Platform struct {
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+	Libc string `json:"libc,omitempty"`
+}
+
+// String returns the platform as os/arch or os/arch/libc, e.g.
+// linux/arm64/musl.
+func (p Platform) String() string {
+	if p.Libc == "" {
+		return p.OS + "/" + p.Arch
+	}
+	return p.OS + "/" + p.Arch + "/" + p.Libc
+}
+
+// ParsePlatform returns the platform written as os/arch or os/arch/libc, e.g.
+// linux/amd64 or linux/arm64/musl.
+func ParsePlatform(platform string) (Platform, error) {
+
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("%q isn't a platform such as linux/amd64 or linux/arm64/musl", platform)
+	}
+
+	parsed := Platform{OS: parts[0], Arch: parts[1]}
+	if len(parts) == 3 {
+		parsed.Libc = parts[2]
+	}
+	return parsed, nil
+}
+
+// Artifact is the build of a component for a single platform.
+type Artifact struct {
+	Platform
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+// platform returns the UpdatePlatform, or the platform the agent is running
+// on when it isn't set. The C library is only detected on Linux.
+func (u *Updater) platform() Platform {
+
+	if u.settings().UpdatePlatform != "" {
+		if configured, parseErr := ParsePlatform(u.settings().UpdatePlatform); parseErr == nil {
+			return configured
+		}
+	}
+
+	running := Platform{OS: runtime.GOOS, Arch: runtime.GOARCH}
+	if running.OS == "linux" {
+		running.Libc = LIBC_GLIBC
+		if loaders, _ := filepath.Glob(MUSL_LOADER_GLOB); len(loaders) > 0 {
+			running.Libc = LIBC_MUSL
+		}
+	}
+	return running
+}
+
+// selectArtifact returns the artifact of the given component built for the
+// given platform. An artifact built for a specific C library is preferred
+// over one which doesn't name a C library, such as a statically linked build.
+// A component without any artifacts is a single build which runs everywhere
+// it's installed.
+func selectArtifact(component Component, platform Platform) (Artifact, error) {
+
+	if len(component.Artifacts) == 0 {
+		return Artifact{URL: component.URL, SHA256: component.SHA256}, nil
+	}
+
+	var anyLibc *Artifact
+	for index, artifact := range component.Artifacts {
+		if artifact.OS != platform.OS || artifact.Arch != platform.Arch {
+			continue
+		}
+		if artifact.Libc == platform.Libc {
+			return artifact, nil
+		}
+		if artifact.Libc == "" && anyLibc == nil {
+			anyLibc = &component.Artifacts[index]
+		}
+	}
+
+	if anyLibc != nil {
+		return *anyLibc, nil
+	}
+	return Artifact{}, fmt.Errorf("The release has no build of the component %v for %v", component.Name, platform)
+}
@@ -0,0 +1,61 @@
+package updater
+
+import (
+	"github.com/seantcanavan/anon-eth-net/events"
+)
+
+// How far a download gets between each UpdateProgress event. In percent
+const PROGRESS_STEP_PERCENT = 10
+
+// progress will publish an UpdateProgress event for the given stage.
+func progress(stage string, component string, detail string) {
+	events.Publish(events.UpdateProgress{Stage: stage, Component: component, Detail: detail})
+}
+
+// progressWriter counts the bytes of a download written through it and
+// publishes an UpdateProgress event each time another PROGRESS_STEP_PERCENT
+// of the total has been downloaded.
+type progressWriter struct {
+	component string
+	written   int64 // including whatever was downloaded before a resume
+	total     int64
+	reported  int
+}
+
+// newProgressWriter returns a progressWriter for a download of the given
+// total size which resumes from the given offset, and publishes where it
+// starts from. Returns nil when the size isn't known.
+func newProgressWriter(component string, offset int64, total int64) *progressWriter {
+
+	if total <= 0 {
+		return nil
+	}
+
+	pw := &progressWriter{component: component, written: offset, total: total, reported: -PROGRESS_STEP_PERCENT}
+	pw.publish()
+	return pw
+}
+
+// Write satisfies the io.Writer interface.
+func (pw *progressWriter) Write(chunk []byte) (int, error) {
+	pw.written += int64(len(chunk))
+	pw.publish()
+	return len(chunk), nil
+}
+
+// publish will publish the progress of the download if it's gone another
+// PROGRESS_STEP_PERCENT since it was last published.
+func (pw *progressWriter) publish() {
+
+	percent := int(pw.written * 100 / pw.total)
+	if percent > 100 {
+		percent = 100
+	}
+	step := percent - percent%PROGRESS_STEP_PERCENT
+	if step <= pw.reported {
+		return
+	}
+
+	pw.reported = step
+	events.Publish(events.UpdateProgress{Stage: events.UPDATE_STAGE_DOWNLOADING, Component: pw.component, Percent: pw.reported})
+}
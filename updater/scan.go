@@ -0,0 +1,270 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/transport"
+)
+
+// The suffix added to an update in the UpdateQuarantineDir once a scanner
+// finds it to be malicious. Rejected updates are left in place for
+// inspection but never scanned or installed again
+const REJECTED_SUFFIX = ".rejected"
+
+// The exit status of the UpdateScanCommand when the update is clean
+const SCAN_CLEAN_EXIT = 0
+
+// The exit status of the UpdateScanCommand when the update is malicious. Any
+// other exit status is a failed scan
+const SCAN_MALICIOUS_EXIT = 1
+
+// The header holding the hex SHA-256 hash of the update POSTed to the
+// UpdateScanURL
+const SCAN_HASH_HEADER = "X-Artifact-SHA256"
+
+// The most of a scanner's reply which is kept as its verdict. In bytes
+const MAX_SCAN_REPLY_BYTES = 64 * 1024
+
+// The longest verdict recorded in the update history. In characters
+const MAX_VERDICT_LENGTH = 200
+
+// Verdict is the outcome of scanning a single update before it's installed.
+// Scanner is empty when neither an UpdateScanCommand nor an UpdateScanURL is
+// configured and the update wasn't scanned.
+type Verdict struct {
+	Artifact  string `json:"artifact"`
+	SHA256    string `json:"sha256"`
+	Scanner   string `json:"scanner,omitempty"`
+	Malicious bool   `json:"malicious"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+// String describes the verdict in a single line.
+func (v Verdict) String() string {
+
+	if v.Scanner == "" {
+		return fmt.Sprintf("%v not scanned", v.Artifact)
+	}
+
+	outcome := "clean"
+	if v.Malicious {
+		outcome = "MALICIOUS"
+	}
+	if v.Detail != "" {
+		outcome = fmt.Sprintf("%v (%v)", outcome, v.Detail)
+	}
+
+	return fmt.Sprintf("%v %v according to %v", v.Artifact, outcome, v.Scanner)
+}
+
+// ScanQuarantine will scan every update waiting in the UpdateQuarantineDir.
+// An update found to be malicious is renamed with REJECTED_SUFFIX and an
+// UpdateRejected event is published. Returns an error as soon as an update is
+// malicious or can't be scanned, since installing it would mean trusting an
+// update nothing vouched for. Returns the verdicts reached up to that point
+// either way.
+func (u *Updater) ScanQuarantine() ([]Verdict, error) {
+
+	entries, readErr := ioutil.ReadDir(u.settings().UpdateQuarantineDir)
+	if os.IsNotExist(readErr) {
+		return nil, nil
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	var verdicts []Verdict
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), REJECTED_SUFFIX) {
+			continue
+		}
+
+		artifactPath := filepath.Join(u.settings().UpdateQuarantineDir, entry.Name())
+		verdict, scanErr := u.ScanArtifact(artifactPath)
+		if scanErr != nil {
+			return verdicts, fmt.Errorf("Could not scan the update %v so it wasn't installed: %v", entry.Name(), scanErr)
+		}
+		verdicts = append(verdicts, verdict)
+
+		if verdict.Malicious {
+			if renameErr := os.Rename(artifactPath, artifactPath+REJECTED_SUFFIX); renameErr != nil {
+				u.log().LogErrorf("Unable to mark the malicious update %v as rejected: %v", artifactPath, renameErr)
+			}
+			events.Publish(events.UpdateRejected{Artifact: verdict.Artifact, SHA256: verdict.SHA256, Scanner: verdict.Scanner, Verdict: verdict.Detail})
+			return verdicts, fmt.Errorf("The update %v was found to be malicious by %v so it wasn't installed", entry.Name(), verdict.Scanner)
+		}
+	}
+
+	return verdicts, nil
+}
+
+// ScanArtifact will submit the update at the given path to the
+// UpdateScanCommand and then the UpdateScanURL, whichever are configured, and
+// return the verdict. The update is malicious if either scanner says it is.
+// Returns an error if a scanner fails or takes longer than
+// UpdateScanTimeoutSeconds.
+func (u *Updater) ScanArtifact(artifactPath string) (Verdict, error) {
+
+	hash, hashErr := fileHash(artifactPath)
+	if hashErr != nil {
+		return Verdict{}, hashErr
+	}
+
+	verdict := Verdict{Artifact: filepath.Base(artifactPath), SHA256: hash}
+	timeout := time.Duration(u.settings().UpdateScanTimeoutSeconds) * time.Second
+
+	if len(u.settings().UpdateScanCommand) > 0 {
+		malicious, detail, scanErr := scanWithCommand(artifactPath, u.settings().UpdateScanCommand, timeout)
+		if scanErr != nil {
+			return verdict, scanErr
+		}
+		verdict.Scanner = filepath.Base(u.settings().UpdateScanCommand[0])
+		verdict.Malicious, verdict.Detail = malicious, detail
+	}
+
+	if u.settings().UpdateScanURL != "" && !verdict.Malicious {
+		malicious, detail, scanErr := scanWithURL(artifactPath, hash, u.settings().UpdateScanURL, u.httpClient(timeout))
+		if scanErr != nil {
+			return verdict, scanErr
+		}
+		if verdict.Scanner != "" {
+			verdict.Scanner += " and "
+		}
+		verdict.Scanner += u.settings().UpdateScanURL
+		verdict.Malicious = malicious
+		if detail != "" {
+			verdict.Detail = detail
+		}
+	}
+
+	verdict.Detail = truncateVerdict(verdict.Detail)
+	u.log().LogMessagef("Successfully scanned the update: %v", verdict)
+	return verdict, nil
+}
+
+// scanWithCommand will run the given scanner command with the path of the
+// update appended and return whether it's malicious along with the first
+// line the scanner printed.
+func scanWithCommand(artifactPath string, command []string, timeout time.Duration) (bool, string, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	arguments := append(append([]string{}, command[1:]...), artifactPath)
+	output, runErr := exec.CommandContext(ctx, command[0], arguments...).CombinedOutput()
+	detail := strings.TrimSpace(strings.SplitN(strings.TrimSpace(string(output)), "\n", 2)[0])
+
+	if ctx.Err() != nil {
+		return false, "", fmt.Errorf("The UpdateScanCommand took longer than %v", timeout)
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case runErr == nil:
+		return false, detail, nil
+	case errors.As(runErr, &exitErr) && exitErr.ExitCode() == SCAN_MALICIOUS_EXIT:
+		return true, detail, nil
+	default:
+		return false, "", fmt.Errorf("The UpdateScanCommand failed: %v %v", runErr, detail)
+	}
+}
+
+// scanWithURL will POST the update to the given scanning service with the
+// given client and return whether it's malicious along with the verdict the
+// service gave.
+func scanWithURL(artifactPath string, hash string, scanURL string, client transport.Doer) (bool, string, error) {
+
+	artifact, openErr := os.Open(artifactPath)
+	if openErr != nil {
+		return false, "", openErr
+	}
+	defer artifact.Close()
+
+	request, requestErr := http.NewRequest(http.MethodPost, scanURL, artifact)
+	if requestErr != nil {
+		return false, "", requestErr
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set(SCAN_HASH_HEADER, hash)
+
+	response, postErr := client.Do(request)
+	if postErr != nil {
+		return false, "", postErr
+	}
+	defer response.Body.Close()
+
+	body, readErr := ioutil.ReadAll(io.LimitReader(response.Body, MAX_SCAN_REPLY_BYTES))
+	if readErr != nil {
+		return false, "", readErr
+	}
+
+	if statusErr := transport.CheckStatus(response); statusErr != nil {
+		return false, "", fmt.Errorf("The UpdateScanURL failed: %w. %s", statusErr, bytes.TrimSpace(body))
+	}
+
+	var reply struct {
+		Malicious *bool  `json:"malicious"`
+		Verdict   string `json:"verdict"`
+	}
+	if decodeErr := json.Unmarshal(body, &reply); decodeErr != nil {
+		return false, "", fmt.Errorf("Could not decode the reply of the UpdateScanURL: %v", decodeErr)
+	}
+	if reply.Malicious == nil {
+		return false, "", fmt.Errorf("The reply of the UpdateScanURL didn't say whether the update is malicious")
+	}
+
+	return *reply.Malicious, reply.Verdict, nil
+}
+
+// fileHash returns the hex SHA-256 hash of the file at the given path.
+func fileHash(filePath string) (string, error) {
+
+	file, openErr := os.Open(filePath)
+	if openErr != nil {
+		return "", openErr
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, copyErr := io.Copy(hash, file); copyErr != nil {
+		return "", copyErr
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// truncateVerdict shortens the given verdict to MAX_VERDICT_LENGTH
+// characters so a chatty scanner can't bloat the update history.
+func truncateVerdict(verdict string) string {
+	if len(verdict) <= MAX_VERDICT_LENGTH {
+		return verdict
+	}
+	return verdict[:MAX_VERDICT_LENGTH] + "..."
+}
+
+// describeVerdicts returns the given verdicts as a single line for the update
+// history.
+func describeVerdicts(verdicts []Verdict) string {
+
+	descriptions := make([]string, 0, len(verdicts))
+	for _, verdict := range verdicts {
+		descriptions = append(descriptions, verdict.String())
+	}
+
+	return strings.Join(descriptions, "; ")
+}
@@ -0,0 +1,494 @@
+package updater
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/state"
+	"github.com/seantcanavan/anon-eth-net/transport"
+)
+
+// The state bucket the trusted root and the versions of the other TUF
+// metadata seen so far are kept in
+const TUF_BUCKET = "tuf"
+
+// The roles of The Update Framework. The root role signs the keys of every
+// role, the timestamp role says which snapshot is current, the snapshot role
+// says which targets metadata is current and the targets role signs the hash
+// of each file which can be installed
+const ROOT_ROLE = "root"
+const TIMESTAMP_ROLE = "timestamp"
+const SNAPSHOT_ROLE = "snapshot"
+const TARGETS_ROLE = "targets"
+
+// The only kind of key metadata can be signed with
+const ED25519_KEY_TYPE = "ed25519"
+
+// The largest metadata file accepted, other than a target
+const MAX_TUF_METADATA_BYTES = 1024 * 1024
+
+// The most root rotations followed in a single update, so a repository can't
+// keep the updater busy forever
+const MAX_ROOT_ROTATIONS = 64
+
+// The name of the release manifest among the targets. VERSION_PLACEHOLDER is
+// replaced like it is in the UpdateManifestURI
+const TUF_MANIFEST_TARGET = VERSION_PLACEHOLDER + "/manifest.json"
+
+// signedMetadata is a TUF metadata file: the metadata of a role and the
+// signatures over its exact bytes.
+type signedMetadata struct {
+	Signed     json.RawMessage `json:"signed"`
+	Signatures []tufSignature  `json:"signatures"`
+}
+
+// tufSignature is the hex ed25519 signature of a single key.
+type tufSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+// tufKey is a hex ed25519 public key. Its key ID is the hex SHA-256 hash of
+// the public key.
+type tufKey struct {
+	KeyType string `json:"keytype"`
+	KeyVal  struct {
+		Public string `json:"public"`
+	} `json:"keyval"`
+}
+
+// tufRole lists the keys of a role and how many of them have to sign its
+// metadata.
+type tufRole struct {
+	KeyIDs    []string `json:"keyids"`
+	Threshold int      `json:"threshold"`
+}
+
+// tufCommon is shared by the metadata of every role.
+type tufCommon struct {
+	Type    string    `json:"_type"`
+	Version uint64    `json:"version"`
+	Expires time.Time `json:"expires"`
+}
+
+// tufRoot is the metadata of the root role.
+type tufRoot struct {
+	tufCommon
+	Keys  map[string]tufKey  `json:"keys"`
+	Roles map[string]tufRole `json:"roles"`
+}
+
+// tufFileMeta describes a metadata file or a target. Metadata files are
+// described by their version and, optionally, their length and hash. Targets
+// have to have both.
+type tufFileMeta struct {
+	Version uint64            `json:"version,omitempty"`
+	Length  int64             `json:"length,omitempty"`
+	Hashes  map[string]string `json:"hashes,omitempty"`
+}
+
+// tufMeta is the metadata of the timestamp and snapshot roles.
+type tufMeta struct {
+	tufCommon
+	Meta map[string]tufFileMeta `json:"meta"`
+}
+
+// tufTargets is the metadata of the targets role.
+type tufTargets struct {
+	tufCommon
+	Targets map[string]tufFileMeta `json:"targets"`
+}
+
+// tufTrusted is what was last trusted: the root and the version of each other
+// role's metadata, which is never allowed to go back.
+type tufTrusted struct {
+	root     tufRoot
+	rawRoot  []byte
+	versions map[string]uint64
+}
+
+// fetchTUFManifest will refresh the TUF metadata from the UpdateTUFURI, then
+// download the release manifest for the given version, or LATEST_VERSION, and
+// return it once its length and hash match the signed targets metadata.
+// Returns an error if any of the metadata isn't signed by enough of the keys
+// of its role, has expired, or is older than metadata already seen.
+func (u *Updater) fetchTUFManifest(version string) ([]byte, error) {
+
+	trusted, trustedErr := u.trustedTUF()
+	if trustedErr != nil {
+		return nil, trustedErr
+	}
+
+	if rotateErr := u.updateTUFRoot(&trusted); rotateErr != nil {
+		return nil, rotateErr
+	}
+
+	targets, refreshErr := u.refreshTUF(&trusted)
+	if refreshErr != nil {
+		return nil, refreshErr
+	}
+
+	name := strings.Replace(TUF_MANIFEST_TARGET, VERSION_PLACEHOLDER, version, -1)
+	target, found := targets.Targets[name]
+	if !found || target.Length <= 0 || target.Hashes["sha256"] == "" {
+		return nil, fmt.Errorf("The targets metadata of version %d doesn't sign the target %v with its length and sha256 hash", targets.Version, name)
+	}
+
+	body, fetchErr := u.fetchTUF("targets/"+name, target.Length)
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+	if matchErr := checkFileMeta(name, body, target); matchErr != nil {
+		return nil, matchErr
+	}
+
+	u.log().LogMessagef("Successfully verified the target %v against the targets metadata of version %d", name, targets.Version)
+	return body, nil
+}
+
+// trustedTUF returns the root trusted after the last update along with the
+// versions of the metadata seen so far, or the root in the UpdateTUFRootFile
+// the first time. The root in the file has to be signed by its own root keys.
+func (u *Updater) trustedTUF() (tufTrusted, error) {
+
+	trusted := tufTrusted{versions: make(map[string]uint64)}
+	viewErr := state.View(func(tx *state.Tx) error {
+		bucket := tx.Bucket(TUF_BUCKET)
+		var rawRoot string
+		if _, getErr := bucket.Get(ROOT_ROLE, &rawRoot); getErr != nil {
+			return getErr
+		}
+		trusted.rawRoot = []byte(rawRoot)
+		for _, role := range []string{TIMESTAMP_ROLE, SNAPSHOT_ROLE, TARGETS_ROLE} {
+			var version uint64
+			if _, getErr := bucket.Get(role, &version); getErr != nil {
+				return getErr
+			}
+			trusted.versions[role] = version
+		}
+		return nil
+	})
+	if viewErr != nil {
+		return trusted, viewErr
+	}
+
+	if len(trusted.rawRoot) == 0 {
+		rawRoot, readErr := ioutil.ReadFile(u.settings().UpdateTUFRootFile)
+		if readErr != nil {
+			return trusted, fmt.Errorf("Could not read the trusted TUF root from the UpdateTUFRootFile: %v", readErr)
+		}
+		trusted.rawRoot = rawRoot
+	}
+
+	var metadata signedMetadata
+	if jsonErr := json.Unmarshal(trusted.rawRoot, &metadata); jsonErr != nil {
+		return trusted, fmt.Errorf("Could not decode the trusted TUF root: %v", jsonErr)
+	}
+	if jsonErr := json.Unmarshal(metadata.Signed, &trusted.root); jsonErr != nil {
+		return trusted, fmt.Errorf("Could not decode the trusted TUF root: %v", jsonErr)
+	}
+	if trusted.root.Type != ROOT_ROLE {
+		return trusted, fmt.Errorf("The trusted TUF root is %q metadata", trusted.root.Type)
+	}
+	if verifyErr := verifyTUF(trusted.root, ROOT_ROLE, metadata); verifyErr != nil {
+		return trusted, verifyErr
+	}
+
+	return trusted, nil
+}
+
+// updateTUFRoot will follow every rotation of the root keys since the trusted
+// root. Each new root has to be the next version and be signed by enough of
+// both the old and the new root keys. When the timestamp or snapshot keys
+// were rotated the versions seen so far are forgotten, so the repository can
+// recover from an attack on those keys. The final root mustn't have expired.
+func (u *Updater) updateTUFRoot(trusted *tufTrusted) error {
+
+	for rotations := 0; rotations < MAX_ROOT_ROTATIONS; rotations++ {
+
+		next := trusted.root.Version + 1
+		rawRoot, fetchErr := u.fetchTUF(fmt.Sprintf("%d.root.json", next), MAX_TUF_METADATA_BYTES)
+		var failed transport.ErrDownloadFailed
+		if errors.As(fetchErr, &failed) && failed.Status == http.StatusNotFound {
+			break
+		}
+		if fetchErr != nil {
+			return fetchErr
+		}
+
+		var metadata signedMetadata
+		var root tufRoot
+		if jsonErr := json.Unmarshal(rawRoot, &metadata); jsonErr != nil {
+			return fmt.Errorf("Could not decode version %d of the TUF root: %v", next, jsonErr)
+		}
+		if jsonErr := json.Unmarshal(metadata.Signed, &root); jsonErr != nil {
+			return fmt.Errorf("Could not decode version %d of the TUF root: %v", next, jsonErr)
+		}
+		if root.Type != ROOT_ROLE || root.Version != next {
+			return fmt.Errorf("The TUF root fetched as version %d is %q metadata of version %d", next, root.Type, root.Version)
+		}
+		if verifyErr := verifyTUF(trusted.root, ROOT_ROLE, metadata); verifyErr != nil {
+			return fmt.Errorf("Version %d of the TUF root isn't signed by the previous root keys: %w", next, verifyErr)
+		}
+		if verifyErr := verifyTUF(root, ROOT_ROLE, metadata); verifyErr != nil {
+			return fmt.Errorf("Version %d of the TUF root isn't signed by its own root keys: %w", next, verifyErr)
+		}
+
+		resetVersions := !sameKeys(trusted.root.Roles[TIMESTAMP_ROLE], root.Roles[TIMESTAMP_ROLE]) || !sameKeys(trusted.root.Roles[SNAPSHOT_ROLE], root.Roles[SNAPSHOT_ROLE])
+		updateErr := state.Update(func(tx *state.Tx) error {
+			bucket := tx.Bucket(TUF_BUCKET)
+			if resetVersions {
+				bucket.Delete(TIMESTAMP_ROLE)
+				bucket.Delete(SNAPSHOT_ROLE)
+			}
+			return bucket.Put(ROOT_ROLE, string(rawRoot))
+		})
+		if updateErr != nil {
+			return updateErr
+		}
+
+		if resetVersions {
+			trusted.versions[TIMESTAMP_ROLE], trusted.versions[SNAPSHOT_ROLE] = 0, 0
+		}
+		trusted.root, trusted.rawRoot = root, rawRoot
+		u.log().LogMessagef("Successfully rotated to version %d of the TUF root", next)
+	}
+
+	if !u.clk().Now().Before(trusted.root.Expires) {
+		return fmt.Errorf("Version %d of the TUF root expired at %v", trusted.root.Version, trusted.root.Expires)
+	}
+	return nil
+}
+
+// refreshTUF will download the timestamp, snapshot and targets metadata in
+// that order, verify each against the trusted root and the metadata before it,
+// and remember their versions. Returns the targets metadata.
+func (u *Updater) refreshTUF(trusted *tufTrusted) (tufTargets, error) {
+
+	var timestamp tufMeta
+	if loadErr := u.loadTUF(trusted, TIMESTAMP_ROLE, tufFileMeta{}, &timestamp, &timestamp.tufCommon); loadErr != nil {
+		return tufTargets{}, loadErr
+	}
+
+	var snapshot tufMeta
+	snapshotMeta := timestamp.Meta[SNAPSHOT_ROLE+".json"]
+	if loadErr := u.loadTUF(trusted, SNAPSHOT_ROLE, snapshotMeta, &snapshot, &snapshot.tufCommon); loadErr != nil {
+		return tufTargets{}, loadErr
+	}
+
+	var targets tufTargets
+	targetsMeta := snapshot.Meta[TARGETS_ROLE+".json"]
+	if loadErr := u.loadTUF(trusted, TARGETS_ROLE, targetsMeta, &targets, &targets.tufCommon); loadErr != nil {
+		return tufTargets{}, loadErr
+	}
+
+	updateErr := state.Update(func(tx *state.Tx) error {
+		bucket := tx.Bucket(TUF_BUCKET)
+		for role, version := range map[string]uint64{TIMESTAMP_ROLE: timestamp.Version, SNAPSHOT_ROLE: snapshot.Version, TARGETS_ROLE: targets.Version} {
+			if putErr := bucket.Put(role, version); putErr != nil {
+				return putErr
+			}
+			trusted.versions[role] = version
+		}
+		return nil
+	})
+	return targets, updateErr
+}
+
+// loadTUF will download the metadata of the given role and decode it into
+// the given metadata, whose common fields are given too. It has to match the
+// given description from the metadata before it, unless it's the timestamp,
+// be signed by enough of the role's keys, be unexpired and be no older than
+// the version seen last.
+func (u *Updater) loadTUF(trusted *tufTrusted, role string, described tufFileMeta, decoded interface{}, common *tufCommon) error {
+
+	name := role + ".json"
+	if role != TIMESTAMP_ROLE && described.Version == 0 {
+		return fmt.Errorf("The TUF metadata doesn't describe %v", name)
+	}
+
+	limit := int64(MAX_TUF_METADATA_BYTES)
+	if described.Length > 0 {
+		limit = described.Length
+	}
+
+	raw, fetchErr := u.fetchTUF(name, limit)
+	if fetchErr != nil {
+		return fetchErr
+	}
+	if matchErr := checkFileMeta(name, raw, described); matchErr != nil {
+		return matchErr
+	}
+
+	var metadata signedMetadata
+	if jsonErr := json.Unmarshal(raw, &metadata); jsonErr != nil {
+		return fmt.Errorf("Could not decode the TUF %v: %v", name, jsonErr)
+	}
+	if verifyErr := verifyTUF(trusted.root, role, metadata); verifyErr != nil {
+		return fmt.Errorf("The TUF %v isn't trusted: %w", name, verifyErr)
+	}
+	if jsonErr := json.Unmarshal(metadata.Signed, decoded); jsonErr != nil {
+		return fmt.Errorf("Could not decode the TUF %v: %v", name, jsonErr)
+	}
+
+	switch {
+	case common.Type != role:
+		return fmt.Errorf("The TUF %v is %q metadata", name, common.Type)
+	case described.Version != 0 && common.Version != described.Version:
+		return fmt.Errorf("The TUF %v is version %d instead of version %d", name, common.Version, described.Version)
+	case common.Version < trusted.versions[role]:
+		return fmt.Errorf("The TUF %v was rolled back to version %d from version %d", name, common.Version, trusted.versions[role])
+	case !u.clk().Now().Before(common.Expires):
+		return fmt.Errorf("Version %d of the TUF %v expired at %v", common.Version, name, common.Expires)
+	}
+
+	return nil
+}
+
+// fetchTUF will download the named file from the first of the UpdateTUFURI
+// which works, failing if it's larger than the given limit.
+func (u *Updater) fetchTUF(name string, limit int64) ([]byte, error) {
+
+	var body []byte
+	_, failoverErr := transport.Failover(u.settings().UpdateTUFURI, func(repository string) error {
+
+		request, requestErr := http.NewRequest(http.MethodGet, strings.TrimRight(repository, "/")+"/"+name, nil)
+		if requestErr != nil {
+			return requestErr
+		}
+
+		response, getErr := u.httpClient(VERSION_CHECK_TIMEOUT_SECONDS * time.Second).Do(request)
+		if getErr != nil {
+			return getErr
+		}
+		defer response.Body.Close()
+
+		if statusErr := transport.CheckStatus(response); statusErr != nil {
+			return statusErr
+		}
+
+		var readErr error
+		body, readErr = ioutil.ReadAll(io.LimitReader(response.Body, limit+1))
+		if readErr != nil {
+			return readErr
+		}
+		if int64(len(body)) > limit {
+			return fmt.Errorf("%v is larger than %d bytes", name, limit)
+		}
+		return nil
+	})
+
+	return body, failoverErr
+}
+
+// verifyTUF returns an error unless the given metadata is signed by at least
+// the threshold of distinct keys the given root lists for the given role.
+func verifyTUF(root tufRoot, role string, metadata signedMetadata) error {
+
+	roleKeys, found := root.Roles[role]
+	if !found || roleKeys.Threshold < 1 {
+		return fmt.Errorf("Version %d of the TUF root has no %v role with a threshold", root.Version, role)
+	}
+
+	allowed := make(map[string]bool)
+	for _, keyID := range roleKeys.KeyIDs {
+		allowed[keyID] = true
+	}
+
+	signed := make(map[string]bool)
+	for _, signature := range metadata.Signatures {
+		if !allowed[signature.KeyID] || signed[signature.KeyID] {
+			continue
+		}
+		publicKey, keyErr := root.Keys[signature.KeyID].publicKey(signature.KeyID)
+		if keyErr != nil {
+			continue
+		}
+		sig, decodeErr := hex.DecodeString(signature.Sig)
+		if decodeErr == nil && ed25519.Verify(publicKey, metadata.Signed, sig) {
+			signed[signature.KeyID] = true
+		}
+	}
+
+	if len(signed) < roleKeys.Threshold {
+		return fmt.Errorf("Only %d of the %d %v signatures needed are valid", len(signed), roleKeys.Threshold, role)
+	}
+	return nil
+}
+
+// publicKey returns the ed25519 public key, as long as the given key ID is its
+// hash.
+func (tk tufKey) publicKey(keyID string) (ed25519.PublicKey, error) {
+
+	if tk.KeyType != ED25519_KEY_TYPE {
+		return nil, fmt.Errorf("The key %v is of the unsupported type %q", keyID, tk.KeyType)
+	}
+
+	publicKey, decodeErr := hex.DecodeString(tk.KeyVal.Public)
+	if decodeErr != nil || len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("The key %v isn't a hex ed25519 public key", keyID)
+	}
+
+	if hash := sha256.Sum256(publicKey); hex.EncodeToString(hash[:]) != keyID {
+		return nil, fmt.Errorf("The key ID %v isn't the SHA-256 hash of its key", keyID)
+	}
+	return publicKey, nil
+}
+
+// checkFileMeta returns an error unless the given file has the length and
+// SHA-256 hash it's described with, when it's described with them.
+func checkFileMeta(name string, body []byte, described tufFileMeta) error {
+
+	if described.Length > 0 && int64(len(body)) != described.Length {
+		return fmt.Errorf("%v is %d bytes instead of %d", name, len(body), described.Length)
+	}
+
+	if expected := described.Hashes["sha256"]; expected != "" {
+		if hash := sha256.Sum256(body); !strings.EqualFold(hex.EncodeToString(hash[:]), expected) {
+			return fmt.Errorf("%v doesn't have the SHA-256 hash %v", name, expected)
+		}
+	}
+	return nil
+}
+
+// sameKeys returns whether the two roles have the same keys.
+func sameKeys(first tufRole, second tufRole) bool {
+
+	firstIDs := append([]string{}, first.KeyIDs...)
+	secondIDs := append([]string{}, second.KeyIDs...)
+	sort.Strings(firstIDs)
+	sort.Strings(secondIDs)
+	return strings.Join(firstIDs, " ") == strings.Join(secondIDs, " ")
+}
+
+// TUFSummary describes the trusted TUF root and the version of the timestamp,
+// snapshot and targets metadata seen last. Used in status reports.
+func TUFSummary() (string, error) {
+
+	if len(std.settings().UpdateTUFURI) == 0 {
+		return "No UpdateTUFURI configured\n", nil
+	}
+
+	trusted, trustedErr := std.trustedTUF()
+	if trustedErr != nil {
+		return "", trustedErr
+	}
+
+	var summary bytes.Buffer
+	fmt.Fprintf(&summary, "root version %d, expires %v\n", trusted.root.Version, trusted.root.Expires.Format(time.RFC1123))
+	for _, role := range []string{TIMESTAMP_ROLE, SNAPSHOT_ROLE, TARGETS_ROLE} {
+		fmt.Fprintf(&summary, "%v version %d\n", role, trusted.versions[role])
+	}
+	return summary.String(), nil
+}
@@ -1,43 +1,287 @@
 package updater
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
-	"strconv"
 	"strings"
 	"time"
 
+	"github.com/seantcanavan/anon-eth-net/buildinfo"
+	"github.com/seantcanavan/anon-eth-net/clock"
 	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/integrity"
+	"github.com/seantcanavan/anon-eth-net/lifecycle"
 	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/network"
+	"github.com/seantcanavan/anon-eth-net/privileged"
+	"github.com/seantcanavan/anon-eth-net/state"
+	"github.com/seantcanavan/anon-eth-net/transport"
 )
 
+// The number of update checks in a row which can fail before it's critical
+const MAX_UPDATE_FAILURES = 3
+
+// The name of the metric published when update checks keep failing
+const UPDATE_FAILURES_METRIC = "consecutive update check failures"
+
+// How long a single remote version check can take. In seconds
+const VERSION_CHECK_TIMEOUT_SECONDS = 30
+
+// The name the requests of the updater are counted under
+const UPDATER_CLIENT = "updater"
+
+// The state bucket every attempted update is recorded in
+const HISTORY_BUCKET = "updates"
+
+// The most attempted updates which are remembered. The oldest are dropped
+// first
+const MAX_UPDATE_HISTORY = 50
+
+// UpdateRecord is a single attempt to update from one version to another.
+// Error is empty when the update was applied. Scan holds the verdicts of the
+// update scanners, if any were reached.
+type UpdateRecord struct {
+	Time        time.Time `json:"time"`
+	FromVersion uint64    `json:"fromVersion"`
+	ToVersion   uint64    `json:"toVersion"`
+	Error       string    `json:"error,omitempty"`
+	Scan        string    `json:"scan,omitempty"`
+}
+
+// PermitFunc is asked for permission to update from one version to another.
+// It returns an error when the update mustn't be applied yet, or else a
+// function which is called with the outcome once the update has been applied
+// or has failed.
+type PermitFunc func(from uint64, to uint64) (func(updateErr error), error)
+
+// Updater checks for, scans and installs updates using the config and logger
+// it was given rather than config.Cfg and logger.Lgr, so it can be tested and
+// embedded in another program.
+type Updater struct {
+	cfg    *config.Config
+	lgr    logger.Backend
+	client transport.Doer
+	clock  clock.Clock
+	permit PermitFunc
+}
+
+// The updater behind the package level functions. It has neither a config
+// nor a logger so it always uses config.Cfg and logger.Lgr, even once they're
+// replaced
+var std = &Updater{}
+
+// NewUpdater returns an Updater which reads the given config and logs to the
+// given logger.
+func NewUpdater(cfg *config.Config, lgr logger.Backend) *Updater {
+	return &Updater{cfg: cfg, lgr: lgr}
+}
+
+// settings returns the config of the updater, or config.Cfg when it wasn't
+// given one.
+func (u *Updater) settings() *config.Config {
+	if u.cfg == nil {
+		return config.Cfg
+	}
+	return u.cfg
+}
+
+// log returns the logger of the updater, or logger.Lgr when it wasn't given
+// one.
+func (u *Updater) log() logger.Backend {
+	if u.lgr == nil {
+		return logger.Lgr
+	}
+	return u.lgr
+}
+
+// SetHTTPClient will make the updater check versions and reach the
+// UpdateScanURL with the given client instead of one made by
+// transport.NewClient. The client's own timeouts apply rather than
+// VERSION_CHECK_TIMEOUT_SECONDS and UpdateScanTimeoutSeconds.
+func (u *Updater) SetHTTPClient(client transport.Doer) {
+	u.client = client
+}
+
+// SetClock will make the updater sleep between checks and time its update
+// history with the given clock instead of clock.Real, e.g. a clock.Fake in
+// tests.
+func (u *Updater) SetClock(clk clock.Clock) {
+	u.clock = clk
+}
+
+// SetPermit will make the updater ask the given function for permission
+// before it applies each update, e.g. so a fleet server can stop every agent
+// at a site updating at once. Passing nil applies updates without asking.
+func (u *Updater) SetPermit(permit PermitFunc) {
+	u.permit = permit
+}
+
+// clk returns the clock given to SetClock, or clock.Real.
+func (u *Updater) clk() clock.Clock {
+	if u.clock == nil {
+		return clock.Real
+	}
+	return u.clock
+}
+
+// httpClient returns the client given to SetHTTPClient, or a new client with
+// the given timeout counted under UPDATER_CLIENT.
+func (u *Updater) httpClient(timeout time.Duration) transport.Doer {
+	if u.client == nil {
+		return transport.NewClient(UPDATER_CLIENT, timeout, transport.DEFAULT_CLIENT_RETRIES)
+	}
+	return u.client
+}
+
+// Run will check for updates using config.Cfg and logger.Lgr. See
+// Updater.Run.
+func Run() {
+	std.Run()
+}
+
+// SetPermit will make the updater behind the package level functions ask the
+// given function for permission before it applies each update. See
+// Updater.SetPermit.
+func SetPermit(permit PermitFunc) {
+	std.SetPermit(permit)
+}
+
+// UpdateNecessary will compare the local and remote versions using config.Cfg
+// and logger.Lgr. See Updater.UpdateNecessary.
+func UpdateNecessary() (bool, error) {
+	return std.UpdateNecessary()
+}
+
+// PendingUpdateSummary describes whether an update is available using
+// config.Cfg and logger.Lgr. See Updater.PendingUpdateSummary.
+func PendingUpdateSummary() (string, error) {
+	return std.PendingUpdateSummary()
+}
+
+// UpdateNow will check for and apply an update immediately using config.Cfg
+// and logger.Lgr. See Updater.UpdateNow.
+func UpdateNow() (string, error) {
+	return std.UpdateNow()
+}
+
+// InstallUpdate will scan and install the waiting updates using config.Cfg
+// and logger.Lgr. See Updater.InstallUpdate.
+func InstallUpdate() (string, error) {
+	return std.InstallUpdate()
+}
+
+// ScanQuarantine will scan the waiting updates using config.Cfg and
+// logger.Lgr. See Updater.ScanQuarantine.
+func ScanQuarantine() ([]Verdict, error) {
+	return std.ScanQuarantine()
+}
+
+// ScanArtifact will scan the update at the given path using config.Cfg and
+// logger.Lgr. See Updater.ScanArtifact.
+func ScanArtifact(artifactPath string) (Verdict, error) {
+	return std.ScanArtifact(artifactPath)
+}
+
+// FetchArtifact will download the artifact with the given hash unless it's
+// cached using config.Cfg and logger.Lgr. See Updater.FetchArtifact.
+func FetchArtifact(artifactURL string, hash string) (string, error) {
+	return std.FetchArtifact(artifactURL, hash)
+}
+
+// FetchUpdate will download the next update without installing it using
+// config.Cfg and logger.Lgr. See Updater.FetchUpdate.
+func FetchUpdate() (string, error) {
+	return std.FetchUpdate()
+}
+
+// StageArtifact will copy the cached artifact into the UpdateQuarantineDir
+// using config.Cfg and logger.Lgr. See Updater.StageArtifact.
+func StageArtifact(cached string, name string) (string, error) {
+	return std.StageArtifact(cached, name)
+}
+
+// FetchVersion will grab the version number from the given URI using
+// config.Cfg and logger.Lgr. See Updater.FetchVersion.
+func FetchVersion(versionURI string) (uint64, error) {
+	return std.FetchVersion(versionURI)
+}
+
 // Run will continuously check for updated versions of the software
 // and update to a newer version if found. Successive version checks will take
 // place after a given number of seconds and compare the remote build number
-// to the local build number to see if an update is required.
-func Run() {
+// to the local build number to see if an update is required. While offline
+// the check waits for connectivity to return instead of failing, and failed
+// checks during an outage don't count towards MAX_UPDATE_FAILURES. The alert
+// raised once they're exceeded includes a diagnosis of why the primary
+// RemoteVersionURI can't be reached. Checks are skipped while the updater is
+// turned off under Subsystems in the config. The components of a manifest are
+// only downloaded within the UpdateDownloadWindow, and applied as soon as
+// they're cached and verified.
+func (u *Updater) Run() {
 
 	go func() {
 
+		failures := 0
+
 		for 1 == 1 {
 
-			logger.Lgr.LogMessage("waiting for updates. sleeping %v", config.Cfg.UpdateFrequencySeconds)
-			time.Sleep(time.Duration(config.Cfg.UpdateFrequencySeconds) * time.Second)
+			u.log().LogMessagef("waiting for updates. sleeping %v", u.settings().UpdateFrequencySeconds)
+			u.clk().Sleep(time.Duration(u.settings().UpdateFrequencySeconds) * time.Second)
 
-			local := config.Cfg.LocalVersion
-			remote, remoteErr := remoteVersion()
+			if !u.settings().Enabled(config.SUBSYSTEM_UPDATER) {
+				u.log().LogMessage("The updater is turned off in the config. Skipping the update check")
+				continue
+			}
+
+			if !transport.Online() {
+				u.log().LogMessagef("Offline for %v. Deferring the update check until connectivity returns", transport.OutageDuration())
+				transport.WaitOnline()
+			}
+
+			local := u.settings().LocalVersion
+			remote, pinned, remoteErr := u.targetVersion()
 
 			if remoteErr != nil {
-				logger.Lgr.LogMessage("Error retrieving the remote version: %v", remoteErr.Error())
+				u.log().LogErrorf("Error retrieving the remote version: %v", remoteErr.Error())
+				if !transport.Online() {
+					continue
+				}
+				failures++
+				if failures == MAX_UPDATE_FAILURES {
+					diagnosis := network.Diagnose(u.settings().RemoteVersionURI.Primary())
+					events.Publish(events.ThresholdBreached{Metric: UPDATE_FAILURES_METRIC, Value: float64(failures), Limit: MAX_UPDATE_FAILURES, Detail: fmt.Sprintf("Most recent error: %v. Diagnosis: %v", remoteErr, diagnosis)})
+				}
+				continue
+			}
+
+			failures = 0
+
+			if pinned && remote != local {
+				u.log().LogMessagef("Pinned to version %d while running version %d. Moving to the pinned version.", remote, local)
+			} else if remote > local {
+				u.log().LogMessagef("localVersion: %v", local)
+				u.log().LogMessagef("remoteVersion: %v", remote)
+				u.log().LogMessage("Newer remote version available. Performing update.")
+			} else {
 				continue
 			}
 
-			if remote > local {
-				logger.Lgr.LogMessage("localVersion: %v", local)
-				logger.Lgr.LogMessage("remoteVersion: %v", remote)
-				logger.Lgr.LogMessage("Newer remote version available. Performing update.")
-				doUpdate()
+			if u.manifestConfigured() {
+				if _, _, fetchErr := u.fetchPlan(true); fetchErr != nil {
+					var outside ErrOutsideDownloadWindow
+					if errors.As(fetchErr, &outside) {
+						u.log().LogMessagef("Deferring the download of version %d: %v", remote, fetchErr)
+					} else {
+						u.log().LogErrorf("Failed to fetch version %d: %v", remote, fetchErr)
+					}
+					continue
+				}
 			}
+
+			u.applyUpdate(local, remote)
 		}
 	}()
 }
@@ -45,64 +289,325 @@ func Run() {
 // UpdateNecessary will look at the remotely defined version number as well as
 // the locally defined version number and compare the two. Based on the result
 // it will recommend a course of action. It will return True is the remote
-// version is higher (newer) than the local version.
-func UpdateNecessary() (bool, error) {
+// version is higher (newer) than the local version, or when the
+// UpdatePinnedVersion is set and isn't the local version.
+func (u *Updater) UpdateNecessary() (bool, error) {
 
-	localVersion := config.Cfg.LocalVersion
+	localVersion := u.settings().LocalVersion
 
-	remoteVersion, remoteErr := remoteVersion()
+	remoteVersion, pinned, remoteErr := u.targetVersion()
 	if remoteErr != nil {
 		return false, remoteErr
 	}
 
+	if pinned {
+		u.log().LogMessagef("Your version, %v, is pinned to: %v", localVersion, remoteVersion)
+		return remoteVersion != localVersion, nil
+	}
+
 	if localVersion > remoteVersion {
-		logger.Lgr.LogMessage("Your version, %v, is higher than the remote: %v. Push your changes!", localVersion, remoteVersion)
+		u.log().LogMessagef("Your version, %v, is higher than the remote: %v. Push your changes!", localVersion, remoteVersion)
 	}
 
 	if localVersion == remoteVersion {
-		logger.Lgr.LogMessage("Your version, %v, equals the remote: %v. Do some work!", localVersion, remoteVersion)
+		u.log().LogMessagef("Your version, %v, equals the remote: %v. Do some work!", localVersion, remoteVersion)
 	}
 
 	if localVersion < remoteVersion {
-		logger.Lgr.LogMessage("Your version, %v, is lower than the remote: %v. Pull the latest code and build it!", localVersion, remoteVersion)
+		u.log().LogMessagef("Your version, %v, is lower than the remote: %v. Pull the latest code and build it!", localVersion, remoteVersion)
 	}
 
 	return remoteVersion > localVersion, nil
 
 }
 
+// PendingUpdateSummary returns a human readable description of whether or not
+// a newer remote version is available. Used to describe the updater in
+// status reports.
+func (u *Updater) PendingUpdateSummary() (string, error) {
+
+	remote, pinned, remoteErr := u.targetVersion()
+	if remoteErr != nil {
+		return "", remoteErr
+	}
+
+	local := u.settings().LocalVersion
+
+	if pinned && remote != local {
+		return fmt.Sprintf("update pending: local version %d, pinned to version %d\n", local, remote), nil
+	}
+	if pinned {
+		return fmt.Sprintf("pinned: local version %d, pinned to version %d\n", local, remote), nil
+	}
+
+	if remote > local {
+		return fmt.Sprintf("update pending: local version %d, remote version %d\n", local, remote), nil
+	}
+
+	return fmt.Sprintf("up to date: local version %d, remote version %d\n", local, remote), nil
+}
+
+// UpdateNow will check for a newer remote version immediately instead of
+// waiting for the next scheduled check and perform the update if one is found.
+// While the UpdatePinnedVersion is set it moves to the pinned version instead,
+// even when that's a downgrade. Returns a human readable description of what
+// happened.
+func (u *Updater) UpdateNow() (string, error) {
+
+	progress(events.UPDATE_STAGE_CHECKING, "", "retrieving the remote version")
+	local := u.settings().LocalVersion
+
+	remote, pinned, remoteErr := u.targetVersion()
+	if remoteErr != nil {
+		return "", remoteErr
+	}
+
+	if pinned && remote == local {
+		return fmt.Sprintf("already at the pinned version %d\n", local), nil
+	}
+	if !pinned && remote <= local {
+		return fmt.Sprintf("already up to date at version %d\n", local), nil
+	}
+
+	if updateErr := u.applyUpdate(local, remote); updateErr != nil {
+		return "", updateErr
+	}
+
+	return "update performed\n", nil
+}
+
+// targetVersion returns the version the updater should be at: the
+// UpdatePinnedVersion when it's set, without checking the remote version, or
+// else the remote version. Returns whether it's pinned.
+func (u *Updater) targetVersion() (uint64, bool, error) {
+
+	if pinned := u.settings().UpdatePinnedVersion; pinned != 0 {
+		return pinned, true, nil
+	}
+
+	remote, remoteErr := u.remoteVersion()
+	return remote, false, remoteErr
+}
+
 // remoteVersion will grab the version of this program from the remote given
 // file path where the version number should reside as a whole integer number.
 // The default project structure is to have this file be named 'version.no' and
-// queried directly via the github.com API.
-func remoteVersion() (uint64, error) {
+// queried directly via the github.com API. Each of the RemoteVersionURI
+// endpoints is tried until one of them replies with a version.
+func (u *Updater) remoteVersion() (uint64, error) {
 
-	var s string // hold the value from the http GET
-	resp, getError := http.Get(config.Cfg.RemoteVersionURI)
+	var remoteVersion uint64
+	endpoint, failoverErr := transport.Failover(u.settings().RemoteVersionURI, func(versionURI string) error {
+		var fetchErr error
+		remoteVersion, fetchErr = u.fetchVersion(versionURI)
+		return fetchErr
+	})
+	if failoverErr != nil {
+		return 0, failoverErr
+	}
+
+	u.log().LogMessagef("Successfully retrieved remote version: %v from %v", remoteVersion, endpoint)
+	return remoteVersion, nil
+}
+
+// FetchVersion will grab the version number from the given URI alone,
+// without failing over to the other RemoteVersionURI, so a URI can be checked
+// before it's saved. See fetchVersion.
+func (u *Updater) FetchVersion(versionURI string) (uint64, error) {
+	return u.fetchVersion(versionURI)
+}
+
+// fetchVersion will grab the version number from the given URI. Returns
+// transport.ErrDownloadFailed when the URI can't be downloaded and
+// buildinfo.ErrVersionParse when it doesn't hold a version number.
+func (u *Updater) fetchVersion(versionURI string) (uint64, error) {
+
+	request, requestErr := http.NewRequest(http.MethodGet, versionURI, nil)
+	if requestErr != nil {
+		return 0, requestErr
+	}
+
+	resp, getError := u.httpClient(VERSION_CHECK_TIMEOUT_SECONDS * time.Second).Do(request)
 	if getError != nil {
 		return 0, getError
 	}
 
 	defer resp.Body.Close()
+	if statusErr := transport.CheckStatus(resp); statusErr != nil {
+		return 0, statusErr
+	}
+
 	body, readError := ioutil.ReadAll(resp.Body)
 	if readError != nil {
 		return 0, readError
 	}
 
-	s = string(body[:])
-	s = strings.Trim(s, "\n")
+	return buildinfo.ParseVersion(versionURI, body)
+}
+
+// applyUpdate will update from the local version to the remote version and
+// publish an UpdateApplied event if it succeeds, after recording the hashes of
+// the updated files so they aren't mistaken for tampering. The attempt is
+// recorded in the update history either way. Nothing is applied until the
+// function given to SetPermit allows it, and it's told the outcome after.
+func (u *Updater) applyUpdate(local uint64, remote uint64) error {
 
-	remoteVersion, castError := strconv.ParseUint(s, 10, 64)
-	if castError != nil {
-		return 0, castError
+	done := func(error) {}
+	if u.permit != nil {
+		progress(events.UPDATE_STAGE_WAITING, "", "asking for permission to apply the update")
+		var permitErr error
+		done, permitErr = u.permit(local, remote)
+		if permitErr != nil {
+			u.log().LogErrorf("Not permitted to update from version %d to version %d yet: %v", local, remote, permitErr)
+			return permitErr
+		}
+		u.log().LogMessagef("Successfully received permission to update from version %d to version %d", local, remote)
 	}
 
-	logger.Lgr.LogMessage("Successfully retrieved remote version: %v", remoteVersion)
-	return remoteVersion, nil
-}
+	scan, updateErr := u.doUpdate()
+	done(updateErr)
+	if updateErr != nil {
+		u.log().LogErrorf("Failed to update from version %d to version %d: %v", local, remote, updateErr)
+		u.recordUpdate(UpdateRecord{Time: u.clk().Now(), FromVersion: local, ToVersion: remote, Error: updateErr.Error(), Scan: scan})
+		return updateErr
+	}
 
-// doUpdate will hopefully someday actually perform the update
-func doUpdate() error {
-	logger.Lgr.LogMessage("performing an update")
+	u.recordUpdate(UpdateRecord{Time: u.clk().Now(), FromVersion: local, ToVersion: remote, Scan: scan})
+	if recordErr := integrity.Record(fmt.Sprintf("the update to version %d", remote)); recordErr != nil {
+		u.log().LogErrorf("Unable to record the hashes of the files updated to version %d: %v", remote, recordErr)
+	}
+	events.Publish(events.UpdateApplied{FromVersion: local, ToVersion: remote})
 	return nil
 }
+
+// recordUpdate will add the given attempt to the update history and drop the
+// oldest attempts beyond MAX_UPDATE_HISTORY.
+func (u *Updater) recordUpdate(record UpdateRecord) {
+
+	updateErr := state.Update(func(tx *state.Tx) error {
+		history := tx.Bucket(HISTORY_BUCKET)
+		if putErr := history.Put(fmt.Sprintf("%020d", record.Time.UnixNano()), record); putErr != nil {
+			return putErr
+		}
+		for keys := history.Keys(); len(keys) > MAX_UPDATE_HISTORY; keys = keys[1:] {
+			history.Delete(keys[0])
+		}
+		return nil
+	})
+
+	if updateErr != nil {
+		u.log().LogErrorf("Unable to record the update from version %d to version %d: %v", record.FromVersion, record.ToVersion, updateErr)
+	}
+}
+
+// History returns every remembered attempt to update, oldest first.
+func History() ([]UpdateRecord, error) {
+
+	var records []UpdateRecord
+	viewErr := state.View(func(tx *state.Tx) error {
+		history := tx.Bucket(HISTORY_BUCKET)
+		for _, key := range history.Keys() {
+			var record UpdateRecord
+			if _, getErr := history.Get(key, &record); getErr != nil {
+				return getErr
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+
+	return records, viewErr
+}
+
+// HistorySummary describes every remembered attempt to update, most recent
+// first. Used to describe the updater in status reports.
+func HistorySummary() (string, error) {
+
+	records, historyErr := History()
+	if historyErr != nil {
+		return "", historyErr
+	}
+
+	if len(records) == 0 {
+		return "No updates have been attempted\n", nil
+	}
+
+	var summary strings.Builder
+	for index := len(records) - 1; index >= 0; index-- {
+		record := records[index]
+		outcome := "applied"
+		if record.Error != "" {
+			outcome = "failed: " + record.Error
+		}
+		if record.Scan != "" {
+			outcome = fmt.Sprintf("%v. Scanned: %v", outcome, record.Scan)
+		}
+		summary.WriteString(fmt.Sprintf("%v: version %d to version %d %v\n", record.Time.Format(time.RFC3339), record.FromVersion, record.ToVersion, outcome))
+	}
+
+	return summary.String(), nil
+}
+
+// doUpdate will install the update, asking the privileged helper to do it when
+// the agent is running under one without root. When the update replaced the
+// running executable the agent restarts into the new one. Returns the
+// verdicts of the update scanners either way.
+func (u *Updater) doUpdate() (string, error) {
+
+	executable, _ := u.componentPath(AGENT_COMPONENT)
+	before, _ := fileHash(executable)
+
+	var installed string
+	var updateErr error
+	if privileged.Available() {
+		installed, updateErr = privileged.Call(privileged.UPDATE_ACTION, nil)
+	} else {
+		installed, updateErr = u.InstallUpdate()
+	}
+
+	if after, _ := fileHash(executable); updateErr == nil && before != "" && after != before {
+		progress(events.UPDATE_STAGE_RESTARTING, AGENT_COMPONENT, "")
+		lifecycle.Restart("updated the agent")
+	}
+
+	return installed, updateErr
+}
+
+// InstallUpdate will install the components of the release described by the
+// UpdateManifestURI which are newer than the ones on this machine, in the
+// order the manifest lists them. Every update waiting in the
+// UpdateQuarantineDir, the downloaded components included, is scanned first
+// and nothing is installed if one of them is malicious or can't be scanned.
+// When a component fails its health check every component of the release is
+// rolled back. Returns the verdicts of the scanners followed by what was
+// installed. Needs root when the binary is installed as a service.
+func (u *Updater) InstallUpdate() (string, error) {
+
+	var manifest Manifest
+	var plan []plannedComponent
+	if u.manifestConfigured() {
+		var prepareErr error
+		manifest, plan, prepareErr = u.prepareManifest()
+		if prepareErr != nil {
+			return "", prepareErr
+		}
+	}
+
+	progress(events.UPDATE_STAGE_SCANNING, "", "")
+	verdicts, scanErr := u.ScanQuarantine()
+	scan := describeVerdicts(verdicts)
+	if scanErr != nil {
+		return scan, scanErr
+	}
+
+	if !u.manifestConfigured() {
+		u.log().LogMessage("performing an update")
+		return scan, nil
+	}
+
+	installed, installErr := u.installComponents(manifest, plan)
+	if scan == "" {
+		return installed, installErr
+	}
+	return scan + "; " + installed, installErr
+}
@@ -1,13 +1,30 @@
 package updater
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/seantcanavan/anon-eth-net/clock"
 	"github.com/seantcanavan/anon-eth-net/config"
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/integrity"
 	"github.com/seantcanavan/anon-eth-net/logger"
+	"github.com/seantcanavan/anon-eth-net/state"
 )
 
 func TestMain(m *testing.M) {
@@ -45,3 +62,825 @@ func TestRun(t *testing.T) {
 	time.Sleep(time.Second * 6)
 
 }
+
+func TestHistory(t *testing.T) {
+
+	stateDir, dirErr := ioutil.TempDir("", "updater_test")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(stateDir)
+	if openErr := state.Open(filepath.Join(stateDir, "agent_state.json")); openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer state.Open(config.Cfg.StateFile)
+	defer func(keyFile string) { config.Cfg.IntegrityKeyFile = keyFile }(config.Cfg.IntegrityKeyFile)
+	config.Cfg.IntegrityKeyFile = filepath.Join(stateDir, "integrity.key")
+
+	for version := uint64(1); version <= MAX_UPDATE_HISTORY+2; version++ {
+		std.recordUpdate(UpdateRecord{Time: time.Unix(int64(version), 0), FromVersion: version, ToVersion: version + 1})
+	}
+	std.applyUpdate(100, 101)
+
+	history, historyErr := History()
+	if historyErr != nil {
+		t.Fatal(historyErr)
+	}
+
+	if len(history) != MAX_UPDATE_HISTORY || history[0].FromVersion != 4 || history[len(history)-1].ToVersion != 101 {
+		t.Errorf("expected only the most recent %d updates oldest first, got: %+v", MAX_UPDATE_HISTORY, history)
+	}
+
+	if summary, _ := HistorySummary(); !strings.Contains(summary, "version 100 to version 101 applied") {
+		t.Errorf("unexpected update history summary: %v", summary)
+	}
+
+	if summary, _ := integrity.Summary(); !strings.Contains(summary, "for the update to version 101") {
+		t.Errorf("expected the updated files to be recorded, got: %v", summary)
+	}
+}
+
+func TestScanQuarantine(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("the test scanner is a shell script")
+	}
+
+	// a config and logger of its own leave the globals untouched
+	testConfig := *config.Cfg
+	testLogger := &recordingLogger{}
+	testUpdater := NewUpdater(&testConfig, testLogger)
+
+	quarantineDir, dirErr := ioutil.TempDir("", "updater_test_quarantine")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(quarantineDir)
+
+	testConfig.UpdateQuarantineDir = quarantineDir
+	testConfig.UpdateScanTimeoutSeconds = 10
+	testConfig.UpdateScanCommand = []string{"sh", "-c", `if grep -q EICAR "$0"; then echo "found EICAR"; exit 1; fi; echo "no threats"`}
+	testConfig.UpdateScanURL = ""
+
+	ioutil.WriteFile(filepath.Join(quarantineDir, "anon-eth-net"), []byte("a clean update"), 0600)
+	if scan, installErr := testUpdater.InstallUpdate(); installErr != nil || scan != "anon-eth-net clean (no threats) according to sh" {
+		t.Errorf("expected the clean update to be installed, got: %v %v", scan, installErr)
+	}
+
+	// the scanning service says otherwise
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		hash := sha256.Sum256(body)
+		if request.Header.Get(SCAN_HASH_HEADER) != hex.EncodeToString(hash[:]) {
+			http.Error(writer, "the hash doesn't match", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(writer, `{"malicious": true, "verdict": "Trojan.Generic"}`)
+	}))
+	defer server.Close()
+	testConfig.UpdateScanURL = server.URL
+
+	var rejectedLock sync.Mutex
+	var rejected events.UpdateRejected
+	unsubscribe := events.Subscribe("updater_test", func(record events.Record) {
+		if updateRejected, isRejected := record.Event.(events.UpdateRejected); isRejected {
+			rejectedLock.Lock()
+			rejected = updateRejected
+			rejectedLock.Unlock()
+		}
+	})
+	defer unsubscribe()
+
+	scan, installErr := testUpdater.InstallUpdate()
+	if installErr == nil || !strings.Contains(scan, "MALICIOUS (Trojan.Generic) according to sh and "+server.URL) {
+		t.Errorf("expected the update to be rejected, got: %v %v", scan, installErr)
+	}
+	if _, statErr := os.Stat(filepath.Join(quarantineDir, "anon-eth-net"+REJECTED_SUFFIX)); statErr != nil {
+		t.Errorf("expected the malicious update to be marked as rejected: %v", statErr)
+	}
+
+	// a rejected update is never scanned again and a failed scan fails closed
+	testConfig.UpdateScanURL = ""
+	ioutil.WriteFile(filepath.Join(quarantineDir, "anon-eth-net-2"), []byte("EICAR"), 0600)
+	if scan, installErr = testUpdater.InstallUpdate(); installErr == nil || scan != "anon-eth-net-2 MALICIOUS (found EICAR) according to sh" {
+		t.Errorf("expected only the new update to be scanned and rejected, got: %v %v", scan, installErr)
+	}
+
+	testConfig.UpdateScanCommand = []string{"sh", "-c", "exit 2"}
+	ioutil.WriteFile(filepath.Join(quarantineDir, "anon-eth-net-3"), []byte("an update"), 0600)
+	if _, installErr = testUpdater.InstallUpdate(); installErr == nil {
+		t.Errorf("expected a failed scan to stop the update")
+	}
+
+	if testConfig.UpdateQuarantineDir == config.Cfg.UpdateQuarantineDir || len(testLogger.Messages()) == 0 {
+		t.Errorf("expected the updater to use its own config and logger, got: %v", testLogger.Messages())
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	rejectedLock.Lock()
+	defer rejectedLock.Unlock()
+	if rejected.Artifact != "anon-eth-net-2" || rejected.Verdict != "found EICAR" {
+		t.Errorf("expected the rejected update to be published, got: %+v", rejected)
+	}
+}
+
+func TestSetHTTPClient(t *testing.T) {
+
+	testConfig := *config.Cfg
+	testConfig.RemoteVersionURI = config.Endpoints{"https://updates.example.com/version.no"}
+	testUpdater := NewUpdater(&testConfig, &recordingLogger{})
+
+	client := &versionClient{version: "70\n"}
+	testUpdater.SetHTTPClient(client)
+
+	remote, remoteErr := testUpdater.remoteVersion()
+	if remoteErr != nil || remote != 70 {
+		t.Errorf("expected the version to be checked with the given client, got: %v %v", remote, remoteErr)
+	}
+	if len(client.requested) != 1 || client.requested[0] != "https://updates.example.com/version.no" {
+		t.Errorf("expected the RemoteVersionURI to be requested once, got: %v", client.requested)
+	}
+}
+
+func TestRunWithClock(t *testing.T) {
+
+	testConfig := *config.Cfg
+	testConfig.UpdateFrequencySeconds = 3600
+	testConfig.RemoteVersionURI = config.Endpoints{"https://updates.example.com/version.no"}
+	testUpdater := NewUpdater(&testConfig, &recordingLogger{})
+
+	client := &versionClient{version: fmt.Sprintf("%d", testConfig.LocalVersion)}
+	testUpdater.SetHTTPClient(client)
+	fake := clock.NewFake(time.Now())
+	testUpdater.SetClock(fake)
+
+	testUpdater.Run()
+	if !fake.WaitForSleepers(1, 5*time.Second) {
+		t.Fatal("expected the updater to sleep until the first check")
+	}
+
+	fake.Advance(59 * time.Minute)
+	if len(client.requested) != 0 {
+		t.Errorf("expected no check before UpdateFrequencySeconds, got: %v", client.requested)
+	}
+
+	// each check happens once the clock moves on by UpdateFrequencySeconds
+	for checks := 1; checks <= 2; checks++ {
+		fake.Advance(time.Hour)
+		if !fake.WaitForSleepers(1, 5*time.Second) || len(client.requested) != checks {
+			t.Errorf("expected %d checks, got: %v", checks, client.requested)
+		}
+	}
+}
+
+func TestFetchArtifact(t *testing.T) {
+
+	cacheDir, dirErr := ioutil.TempDir("", "updater_test")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	testConfig := *config.Cfg
+	testConfig.UpdateCacheDir = filepath.Join(cacheDir, "update_cache")
+	testConfig.UpdateQuarantineDir = filepath.Join(cacheDir, "update_quarantine")
+	testUpdater := NewUpdater(&testConfig, &recordingLogger{})
+
+	artifact := []byte(strings.Repeat("anon-eth-net update ", 50000))
+	sum := sha256.Sum256(artifact)
+	hash := hex.EncodeToString(sum[:])
+
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ranges = append(ranges, request.Header.Get("Range"))
+		http.ServeContent(writer, request, "anon-eth-net", time.Time{}, bytes.NewReader(artifact))
+	}))
+	defer server.Close()
+
+	var progressLock sync.Mutex
+	var published []string
+	unsubscribe := events.Subscribe("updater_test_progress", func(record events.Record) {
+		if updateProgress, isProgress := record.Event.(events.UpdateProgress); isProgress {
+			progressLock.Lock()
+			published = append(published, updateProgress.Summary())
+			progressLock.Unlock()
+		}
+	})
+	defer unsubscribe()
+
+	// half of it was downloaded before the agent restarted
+	os.MkdirAll(testConfig.UpdateCacheDir, 0700)
+	partial := filepath.Join(testConfig.UpdateCacheDir, hash+PARTIAL_SUFFIX)
+	ioutil.WriteFile(partial, artifact[:len(artifact)/2], 0600)
+
+	cached, fetchErr := testUpdater.FetchArtifact(server.URL+"/anon-eth-net", strings.ToUpper(hash))
+	if fetchErr != nil {
+		t.Fatal(fetchErr)
+	}
+	if contents, _ := ioutil.ReadFile(cached); !bytes.Equal(contents, artifact) || filepath.Base(cached) != hash {
+		t.Errorf("expected the whole artifact to be cached by its hash, got %d bytes at %v", len(contents), cached)
+	}
+	if len(ranges) != 1 || ranges[0] != fmt.Sprintf("bytes=%d-", len(artifact)/2) {
+		t.Errorf("expected the download to be resumed, got ranges: %q", ranges)
+	}
+	if _, statErr := os.Stat(partial); !os.IsNotExist(statErr) {
+		t.Errorf("expected the partial download to be gone, got: %v", statErr)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	progressLock.Lock()
+	expected := "Update downloading anon-eth-net: 50%, Update downloading anon-eth-net: 60%, Update downloading anon-eth-net: 70%, Update downloading anon-eth-net: 80%, Update downloading anon-eth-net: 90%, Update downloading anon-eth-net: 100%, Update verifying anon-eth-net: checking the SHA-256 hash of the download"
+	if strings.Join(published, ", ") != expected {
+		t.Errorf("expected the download to be published from where it resumed, got: %q", published)
+	}
+	progressLock.Unlock()
+
+	// re-applying it doesn't download it again
+	if again, fetchErr := testUpdater.FetchArtifact(server.URL+"/anon-eth-net", hash); fetchErr != nil || again != cached || len(ranges) != 1 {
+		t.Errorf("expected the cached artifact to be reused, got: %v %v after %d requests", again, fetchErr, len(ranges))
+	}
+
+	// a download which doesn't match its hash is thrown away
+	otherHash := strings.Repeat("ab", 32)
+	if _, fetchErr := testUpdater.FetchArtifact(server.URL+"/anon-eth-net", otherHash); fetchErr == nil || !strings.Contains(fetchErr.Error(), "thrown away") {
+		t.Errorf("expected the mismatched download to fail, got: %v", fetchErr)
+	}
+	if _, statErr := os.Stat(filepath.Join(testConfig.UpdateCacheDir, otherHash+PARTIAL_SUFFIX)); !os.IsNotExist(statErr) {
+		t.Errorf("expected the mismatched download to be removed, got: %v", statErr)
+	}
+	if _, fetchErr := testUpdater.FetchArtifact(server.URL, "not a hash"); fetchErr == nil {
+		t.Error("expected a malformed hash to be refused")
+	}
+
+	staged, stageErr := testUpdater.StageArtifact(cached, "anon-eth-net")
+	if contents, _ := ioutil.ReadFile(staged); stageErr != nil || !bytes.Equal(contents, artifact) || filepath.Dir(staged) != testConfig.UpdateQuarantineDir {
+		t.Errorf("expected the artifact to be copied into the quarantine, got: %v %v", staged, stageErr)
+	}
+	if _, statErr := os.Stat(cached); statErr != nil {
+		t.Errorf("expected the cached artifact to be kept, got: %v", statErr)
+	}
+}
+
+func TestInstallComponents(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("the health checks are shell commands")
+	}
+
+	dataDir, dirErr := ioutil.TempDir("", "updater_test")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(dataDir)
+	if openErr := state.Open(filepath.Join(dataDir, "agent_state.json")); openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer state.Open(config.Cfg.StateFile)
+
+	watchdog := filepath.Join(dataDir, "bin", "aen-watchdog")
+	miner := filepath.Join(dataDir, "bin", "ethminer")
+	os.MkdirAll(filepath.Dir(watchdog), 0755)
+	ioutil.WriteFile(watchdog, []byte("watchdog 1"), 0755)
+
+	testConfig := *config.Cfg
+	testConfig.UpdateCacheDir = filepath.Join(dataDir, "update_cache")
+	testConfig.UpdateQuarantineDir = filepath.Join(dataDir, "update_quarantine")
+	testConfig.UpdateScanCommand = []string{"sh", "-c", "echo no threats"}
+	testConfig.UpdateScanURL = ""
+	testConfig.UpdateComponents = map[string]string{"watchdog": watchdog, "miner": miner}
+	testUpdater := NewUpdater(&testConfig, &recordingLogger{})
+
+	artifacts := map[string][]byte{"/watchdog": []byte("watchdog 2"), "/miner": []byte("miner 4")}
+	component := func(name string, version uint64, healthCheck ...string) Component {
+		sum := sha256.Sum256(artifacts["/"+name])
+		return Component{Name: name, Version: version, SHA256: hex.EncodeToString(sum[:]), HealthCheck: healthCheck}
+	}
+
+	var manifestLock sync.Mutex
+	var manifest Manifest
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/manifest.json" {
+			manifestLock.Lock()
+			defer manifestLock.Unlock()
+			json.NewEncoder(writer).Encode(manifest)
+			return
+		}
+		writer.Write(artifacts[request.URL.Path])
+	}))
+	defer server.Close()
+	testConfig.UpdateManifestURI = config.Endpoints{server.URL + "/manifest.json"}
+
+	setManifest := func(components ...Component) {
+		manifestLock.Lock()
+		defer manifestLock.Unlock()
+		manifest = Manifest{Version: 2, Components: components}
+		for index := range manifest.Components {
+			manifest.Components[index].URL = server.URL + "/" + manifest.Components[index].Name
+		}
+	}
+
+	var rolledBackLock sync.Mutex
+	var rolledBack events.UpdateRolledBack
+	unsubscribe := events.Subscribe("updater_test_components", func(record events.Record) {
+		if updateRolledBack, isRolledBack := record.Event.(events.UpdateRolledBack); isRolledBack {
+			rolledBackLock.Lock()
+			rolledBack = updateRolledBack
+			rolledBackLock.Unlock()
+		}
+	})
+	defer unsubscribe()
+
+	// the miner fails its health check so the watchdog is put back too
+	watchdogComponent := component("watchdog", 2, "test", "-x", PATH_PLACEHOLDER)
+	watchdogComponent.Requires = map[string]string{"miner": ">=4"}
+	setManifest(watchdogComponent, component("miner", 4, "false"))
+	if installed, installErr := testUpdater.InstallUpdate(); installErr == nil || !strings.Contains(installErr.Error(), "miner 0 -> 4") {
+		t.Errorf("expected the update to be rolled back, got: %v %v", installed, installErr)
+	}
+	if contents, _ := ioutil.ReadFile(watchdog); string(contents) != "watchdog 1" {
+		t.Errorf("expected the watchdog to be rolled back, got: %s", contents)
+	}
+	if _, statErr := os.Stat(miner); !os.IsNotExist(statErr) {
+		t.Errorf("expected the new miner to be removed, got: %v", statErr)
+	}
+	time.Sleep(100 * time.Millisecond)
+	rolledBackLock.Lock()
+	if rolledBack.Component != "miner" || strings.Join(rolledBack.RolledBack, ", ") != "miner 4 -> 0, watchdog 2 -> 0" {
+		t.Errorf("expected the rollback to be published, got: %+v", rolledBack)
+	}
+	rolledBackLock.Unlock()
+
+	// the watchdog needs a newer miner than the release has
+	watchdogComponent.Requires = map[string]string{"miner": ">=5"}
+	setManifest(watchdogComponent, component("miner", 4))
+	if _, installErr := testUpdater.InstallUpdate(); installErr == nil || !strings.Contains(installErr.Error(), "requires miner >=5") {
+		t.Errorf("expected the incompatible release to be refused, got: %v", installErr)
+	}
+
+	watchdogComponent.Requires = map[string]string{"miner": ">=4,<5"}
+	setManifest(watchdogComponent, component("miner", 4, "test", "-f", PATH_PLACEHOLDER))
+	installed, installErr := testUpdater.InstallUpdate()
+	if installErr != nil || !strings.HasSuffix(installed, "Installed watchdog 0 -> 2, miner 0 -> 4") || !strings.Contains(installed, "clean (no threats)") {
+		t.Errorf("expected both components to be installed, got: %v %v", installed, installErr)
+	}
+	for componentPath, expected := range map[string]string{watchdog: "watchdog 2", miner: "miner 4"} {
+		if contents, _ := ioutil.ReadFile(componentPath); string(contents) != expected {
+			t.Errorf("expected %v to hold %v, got: %s", componentPath, expected, contents)
+		}
+	}
+
+	// nothing is newer than what's installed now
+	if installed, installErr := testUpdater.InstallUpdate(); installErr != nil || installed != "Every component is up to date" {
+		t.Errorf("expected nothing to be installed, got: %v %v", installed, installErr)
+	}
+
+	// an artifact swapped in the UpdateCacheDir after its hash was checked
+	swapped := filepath.Join(dataDir, "swapped")
+	ioutil.WriteFile(swapped, []byte("not the miner"), 0755)
+	if swapErr := installFile(swapped, miner, component("miner", 4).SHA256); swapErr == nil {
+		t.Errorf("expected an artifact which doesn't match its hash to be refused")
+	}
+	if contents, _ := ioutil.ReadFile(miner); string(contents) != "miner 4" {
+		t.Errorf("expected the miner to be left alone, got: %s", contents)
+	}
+	if leftovers, _ := filepath.Glob(miner + ".installing*"); len(leftovers) > 0 {
+		t.Errorf("expected the refused copy to be removed, got: %v", leftovers)
+	}
+}
+
+func TestSelectArtifact(t *testing.T) {
+
+	hash := strings.Repeat("ab", 32)
+	miner := Component{Name: "miner", Version: 4, Artifacts: []Artifact{
+		{Platform: Platform{OS: "linux", Arch: "amd64"}, URL: "https://updates.example.com/ethminer-linux-amd64", SHA256: hash},
+		{Platform: Platform{OS: "linux", Arch: "arm64", Libc: LIBC_GLIBC}, URL: "https://updates.example.com/ethminer-linux-arm64-glibc", SHA256: hash},
+		{Platform: Platform{OS: "linux", Arch: "arm64", Libc: LIBC_MUSL}, URL: "https://updates.example.com/ethminer-linux-arm64-musl", SHA256: hash},
+		{Platform: Platform{OS: "windows", Arch: "amd64"}, URL: "https://updates.example.com/ethminer.exe", SHA256: hash},
+	}}
+	if validateErr := (Manifest{Components: []Component{miner}}).Validate(); validateErr != nil {
+		t.Fatal(validateErr)
+	}
+
+	for platform, expected := range map[string]string{
+		"linux/amd64/musl":  "https://updates.example.com/ethminer-linux-amd64",
+		"linux/arm64/glibc": "https://updates.example.com/ethminer-linux-arm64-glibc",
+		"linux/arm64/musl":  "https://updates.example.com/ethminer-linux-arm64-musl",
+		"windows/amd64":     "https://updates.example.com/ethminer.exe",
+	} {
+		parsed, parseErr := ParsePlatform(platform)
+		if parseErr != nil {
+			t.Fatal(parseErr)
+		}
+		if artifact, selectErr := selectArtifact(miner, parsed); selectErr != nil || artifact.URL != expected {
+			t.Errorf("expected %v to get %v, got: %v %v", platform, expected, artifact.URL, selectErr)
+		}
+	}
+
+	if _, selectErr := selectArtifact(miner, Platform{OS: "darwin", Arch: "arm64"}); selectErr == nil || !strings.Contains(selectErr.Error(), "darwin/arm64") {
+		t.Errorf("expected a platform without a build to be refused, got: %v", selectErr)
+	}
+	if _, parseErr := ParsePlatform("linux"); parseErr == nil {
+		t.Error("expected a platform without an arch to be refused")
+	}
+
+	// the UpdatePlatform picks the build in place of the running platform
+	testConfig := *config.Cfg
+	testConfig.UpdatePlatform = "windows/amd64"
+	testConfig.UpdateComponents = map[string]string{"miner": "ethminer.exe"}
+	plan, planErr := NewUpdater(&testConfig, &recordingLogger{}).planManifest(Manifest{Components: []Component{miner}})
+	if planErr != nil || len(plan) != 1 || plan[0].URL != "https://updates.example.com/ethminer.exe" {
+		t.Errorf("expected the windows build to be planned, got: %+v %v", plan, planErr)
+	}
+
+	miner.Artifacts[0].Arch = ""
+	if validateErr := (Manifest{Components: []Component{miner}}).Validate(); validateErr == nil {
+		t.Error("expected an artifact without an arch to be refused")
+	}
+}
+
+func TestPinnedVersion(t *testing.T) {
+
+	dataDir, dirErr := ioutil.TempDir("", "updater_test")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(dataDir)
+	if openErr := state.Open(filepath.Join(dataDir, "agent_state.json")); openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer state.Open(config.Cfg.StateFile)
+
+	testConfig := *config.Cfg
+	testConfig.LocalVersion = 70
+	testConfig.UpdatePinnedVersion = 68
+	testConfig.UpdateComponents = map[string]string{"miner": filepath.Join(dataDir, "ethminer")}
+	testUpdater := NewUpdater(&testConfig, &recordingLogger{})
+
+	// the remote version isn't checked while pinned
+	client := &versionClient{version: "71\n"}
+	testUpdater.SetHTTPClient(client)
+	if necessary, necessaryErr := testUpdater.UpdateNecessary(); necessaryErr != nil || !necessary || len(client.requested) != 0 {
+		t.Errorf("expected the downgrade to the pinned version to be necessary, got: %v %v after %d requests", necessary, necessaryErr, len(client.requested))
+	}
+	if summary, _ := testUpdater.PendingUpdateSummary(); summary != "update pending: local version 70, pinned to version 68\n" {
+		t.Errorf("unexpected pending update summary: %q", summary)
+	}
+
+	testConfig.LocalVersion = 68
+	if necessary, _ := testUpdater.UpdateNecessary(); necessary {
+		t.Error("expected nothing to be necessary at the pinned version even though a newer one is out")
+	}
+	if updated, updateErr := testUpdater.UpdateNow(); updateErr != nil || updated != "already at the pinned version 68\n" {
+		t.Errorf("expected the updater not to move off the pin, got: %v %v", updated, updateErr)
+	}
+
+	// the components are moved to the pinned release even when they're newer
+	state.Put(COMPONENTS_BUCKET, "miner", uint64(5))
+	miner := []byte("miner 4")
+	sum := sha256.Sum256(miner)
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		requested = append(requested, request.URL.Path)
+		if request.URL.Path == "/releases/68/manifest.json" {
+			fmt.Fprintf(writer, `{"version": 68, "components": [{"name": "miner", "version": 4, "url": "%v/ethminer-4", "sha256": "%v"}]}`, "http://"+request.Host, hex.EncodeToString(sum[:]))
+			return
+		}
+		writer.Write(miner)
+	}))
+	defer server.Close()
+	testUpdater.SetHTTPClient(nil)
+	testConfig.UpdateManifestURI = config.Endpoints{server.URL + "/releases/" + VERSION_PLACEHOLDER + "/manifest.json"}
+
+	manifest, manifestErr := testUpdater.fetchManifest()
+	if manifestErr != nil {
+		t.Fatal(manifestErr)
+	}
+	plan, planErr := testUpdater.planManifest(manifest)
+	if planErr != nil || len(plan) != 1 || plan[0].String() != "miner 5 -> 4" {
+		t.Errorf("expected the miner to be downgraded, got: %v %v", plan, planErr)
+	}
+
+	testConfig.UpdatePinnedVersion = 0
+	if _, manifestErr := testUpdater.fetchManifest(); manifestErr == nil || requested[len(requested)-1] != "/releases/latest/manifest.json" {
+		t.Errorf("expected the latest manifest to be requested once unpinned, got: %v %v", requested, manifestErr)
+	}
+}
+
+func TestTUFManifest(t *testing.T) {
+
+	dataDir, dirErr := ioutil.TempDir("", "updater_test")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(dataDir)
+	if openErr := state.Open(filepath.Join(dataDir, "agent_state.json")); openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer state.Open(config.Cfg.StateFile)
+
+	type signer struct {
+		id      string
+		key     tufKey
+		private ed25519.PrivateKey
+	}
+	newSigner := func() signer {
+		public, private, _ := ed25519.GenerateKey(nil)
+		hash := sha256.Sum256(public)
+		key := tufKey{KeyType: ED25519_KEY_TYPE}
+		key.KeyVal.Public = hex.EncodeToString(public)
+		return signer{id: hex.EncodeToString(hash[:]), key: key, private: private}
+	}
+	sign := func(signed interface{}, signers ...signer) []byte {
+		raw, _ := json.Marshal(signed)
+		metadata := signedMetadata{Signed: raw}
+		for _, s := range signers {
+			metadata.Signatures = append(metadata.Signatures, tufSignature{KeyID: s.id, Sig: hex.EncodeToString(ed25519.Sign(s.private, raw))})
+		}
+		encoded, _ := json.Marshal(metadata)
+		return encoded
+	}
+
+	expires := time.Now().Add(time.Hour)
+	rootKey, timestampKey, snapshotKey, targetsKey := newSigner(), newSigner(), newSigner(), newSigner()
+	root := func(version uint64, timestamp signer) tufRoot {
+		root := tufRoot{tufCommon: tufCommon{Type: ROOT_ROLE, Version: version, Expires: expires}, Keys: map[string]tufKey{}, Roles: map[string]tufRole{}}
+		for role, s := range map[string]signer{ROOT_ROLE: rootKey, TIMESTAMP_ROLE: timestamp, SNAPSHOT_ROLE: snapshotKey, TARGETS_ROLE: targetsKey} {
+			root.Keys[s.id] = s.key
+			root.Roles[role] = tufRole{KeyIDs: []string{s.id}, Threshold: 1}
+		}
+		return root
+	}
+
+	manifest := []byte(`{"version": 71, "components": []}`)
+	manifestHash := sha256.Sum256(manifest)
+	var filesLock sync.Mutex
+	files := map[string][]byte{"/targets/latest/manifest.json": manifest}
+	publish := func(version uint64, timestampVersion uint64, timestamp signer, timestampExpires time.Time) {
+		filesLock.Lock()
+		defer filesLock.Unlock()
+		targets := sign(tufTargets{tufCommon: tufCommon{Type: TARGETS_ROLE, Version: version, Expires: expires}, Targets: map[string]tufFileMeta{
+			"latest/manifest.json": {Length: int64(len(manifest)), Hashes: map[string]string{"sha256": hex.EncodeToString(manifestHash[:])}},
+		}}, targetsKey)
+		snapshot := sign(tufMeta{tufCommon: tufCommon{Type: SNAPSHOT_ROLE, Version: version, Expires: expires}, Meta: map[string]tufFileMeta{"targets.json": {Version: version}}}, snapshotKey)
+		snapshotHash := sha256.Sum256(snapshot)
+		files["/targets.json"], files["/snapshot.json"] = targets, snapshot
+		files["/timestamp.json"] = sign(tufMeta{tufCommon: tufCommon{Type: TIMESTAMP_ROLE, Version: timestampVersion, Expires: timestampExpires}, Meta: map[string]tufFileMeta{
+			"snapshot.json": {Version: version, Length: int64(len(snapshot)), Hashes: map[string]string{"sha256": hex.EncodeToString(snapshotHash[:])}},
+		}}, timestamp)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		filesLock.Lock()
+		defer filesLock.Unlock()
+		if file, found := files[request.URL.Path]; found {
+			writer.Write(file)
+			return
+		}
+		http.NotFound(writer, request)
+	}))
+	defer server.Close()
+
+	testConfig := *config.Cfg
+	testConfig.UpdateTUFURI = config.Endpoints{server.URL}
+	testConfig.UpdateTUFRootFile = filepath.Join(dataDir, "root.json")
+	testConfig.UpdatePinnedVersion = 0
+	ioutil.WriteFile(testConfig.UpdateTUFRootFile, sign(root(1, timestampKey), rootKey), 0600)
+	testUpdater := NewUpdater(&testConfig, &recordingLogger{})
+
+	publish(2, 2, timestampKey, expires)
+	if fetched, fetchErr := testUpdater.fetchManifest(); fetchErr != nil || fetched.Version != 71 {
+		t.Fatalf("expected the manifest to be trusted, got: %+v %v", fetched, fetchErr)
+	}
+
+	// the repository can't go back to older metadata
+	publish(1, 1, timestampKey, expires)
+	if _, fetchErr := testUpdater.fetchManifest(); fetchErr == nil || !strings.Contains(fetchErr.Error(), "rolled back to version 1 from version 2") {
+		t.Errorf("expected the older timestamp to be refused, got: %v", fetchErr)
+	}
+
+	// nor sign with a key the root doesn't list, or serve expired metadata
+	publish(3, 3, newSigner(), expires)
+	if _, fetchErr := testUpdater.fetchManifest(); fetchErr == nil || !strings.Contains(fetchErr.Error(), "signatures needed are valid") {
+		t.Errorf("expected the timestamp signed by an unknown key to be refused, got: %v", fetchErr)
+	}
+	publish(3, 3, timestampKey, time.Now().Add(-time.Minute))
+	if _, fetchErr := testUpdater.fetchManifest(); fetchErr == nil || !strings.Contains(fetchErr.Error(), "expired") {
+		t.Errorf("expected the expired timestamp to be refused, got: %v", fetchErr)
+	}
+
+	// nor change the manifest the targets vouch for
+	publish(3, 3, timestampKey, expires)
+	filesLock.Lock()
+	files["/targets/latest/manifest.json"] = []byte(`{"version": 99, "components": []}`)
+	filesLock.Unlock()
+	if _, fetchErr := testUpdater.fetchManifest(); fetchErr == nil || !strings.Contains(fetchErr.Error(), "SHA-256") {
+		t.Errorf("expected the tampered manifest to be refused, got: %v", fetchErr)
+	}
+	filesLock.Lock()
+	files["/targets/latest/manifest.json"] = manifest
+	filesLock.Unlock()
+
+	// rotating the timestamp key starts its versions over
+	rotatedKey := newSigner()
+	filesLock.Lock()
+	files["/2.root.json"] = sign(root(2, rotatedKey), rootKey)
+	filesLock.Unlock()
+	publish(4, 1, rotatedKey, expires)
+	if _, fetchErr := testUpdater.fetchManifest(); fetchErr != nil {
+		t.Errorf("expected the rotated timestamp key to be trusted, got: %v", fetchErr)
+	}
+	if trusted, _ := testUpdater.trustedTUF(); trusted.root.Version != 2 || trusted.versions[TIMESTAMP_ROLE] != 1 {
+		t.Errorf("expected the rotated root to be kept, got version %d and timestamp %d", trusted.root.Version, trusted.versions[TIMESTAMP_ROLE])
+	}
+
+	// a root which isn't signed by the previous root keys is never followed
+	filesLock.Lock()
+	impostor := newSigner()
+	forged := root(3, rotatedKey)
+	delete(forged.Keys, rootKey.id)
+	forged.Keys[impostor.id] = impostor.key
+	forged.Roles[ROOT_ROLE] = tufRole{KeyIDs: []string{impostor.id}, Threshold: 1}
+	files["/3.root.json"] = sign(forged, impostor)
+	filesLock.Unlock()
+	if _, fetchErr := testUpdater.fetchManifest(); fetchErr == nil || !strings.Contains(fetchErr.Error(), "previous root keys") {
+		t.Errorf("expected the forged root to be refused, got: %v", fetchErr)
+	}
+}
+
+// versionClient replies to every request with the given version instead of
+// sending it.
+type versionClient struct {
+	version   string
+	requested []string
+}
+
+func (vc *versionClient) Do(request *http.Request) (*http.Response, error) {
+	vc.requested = append(vc.requested, request.URL.String())
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Body:       ioutil.NopCloser(strings.NewReader(vc.version)),
+		Request:    request,
+	}, nil
+}
+
+// recordingLogger is a logger.Backend which remembers every message.
+type recordingLogger struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+func (rl *recordingLogger) LogMessage(message string) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	rl.messages = append(rl.messages, message)
+}
+
+func (rl *recordingLogger) LogMessagef(formatString string, values ...interface{}) {
+	rl.LogMessage(fmt.Sprintf(formatString, values...))
+}
+
+func (rl *recordingLogger) LogError(message string) {
+	rl.LogMessage("ERROR: " + message)
+}
+
+func (rl *recordingLogger) LogErrorf(formatString string, values ...interface{}) {
+	rl.LogError(fmt.Sprintf(formatString, values...))
+}
+
+func (rl *recordingLogger) Messages() []string {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	return append([]string{}, rl.messages...)
+}
+
+func TestScheduledFetch(t *testing.T) {
+
+	dataDir, dirErr := ioutil.TempDir("", "updater_test")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(dataDir)
+	if openErr := state.Open(filepath.Join(dataDir, "agent_state.json")); openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer state.Open(config.Cfg.StateFile)
+
+	// a second's worth of bytes is read before waiting for the clock
+	fake := clock.NewFake(time.Date(2026, 10, 16, 12, 0, 0, 0, time.Local))
+	throttled := &throttledReader{reader: bytes.NewReader(make([]byte, 300)), rate: 100, clk: fake, started: fake.Now()}
+	done := make(chan int)
+	go func() {
+		read, _ := ioutil.ReadAll(throttled)
+		done <- len(read)
+	}()
+	for second := 1; second <= 3; second++ {
+		if !fake.WaitForSleepers(1, time.Second) {
+			t.Fatalf("expected the read to wait for second %d", second)
+		}
+		fake.Advance(time.Second)
+	}
+	if read := <-done; read != 300 {
+		t.Errorf("expected every byte to be read once the clock caught up, got %d", read)
+	}
+
+	miner := []byte("miner 4")
+	sum := sha256.Sum256(miner)
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		requested = append(requested, request.URL.Path)
+		if request.URL.Path == "/manifest.json" {
+			fmt.Fprintf(writer, `{"version": 71, "components": [{"name": "miner", "version": 4, "url": "%v/ethminer-4", "sha256": "%v"}]}`, "http://"+request.Host, hex.EncodeToString(sum[:]))
+			return
+		}
+		writer.Write(miner)
+	}))
+	defer server.Close()
+
+	testConfig := *config.Cfg
+	testConfig.UpdateCacheDir = filepath.Join(dataDir, "update_cache")
+	testConfig.UpdateComponents = map[string]string{"miner": filepath.Join(dataDir, "ethminer")}
+	testConfig.UpdateDownloadWindow = "02:00-05:00"
+	testUpdater := NewUpdater(&testConfig, &recordingLogger{})
+	testUpdater.SetClock(fake)
+
+	if _, fetchErr := testUpdater.FetchUpdate(); fetchErr == nil {
+		t.Error("expected fetching to need a manifest")
+	}
+	testConfig.UpdateManifestURI = config.Endpoints{server.URL + "/manifest.json"}
+
+	// scheduled downloads wait for the window
+	var outside ErrOutsideDownloadWindow
+	if _, _, fetchErr := testUpdater.fetchPlan(true); !errors.As(fetchErr, &outside) || outside.Window != "02:00-05:00" {
+		t.Errorf("expected the download to be deferred outside the window, got: %v", fetchErr)
+	}
+	if requested[len(requested)-1] != "/manifest.json" {
+		t.Errorf("expected only the manifest to be downloaded, got: %v", requested)
+	}
+
+	// fetching on demand doesn't wait for the window
+	if fetched, fetchErr := testUpdater.FetchUpdate(); fetchErr != nil || fetched != "Fetched miner 0 -> 4" {
+		t.Errorf("expected the miner to be fetched, got: %v %v", fetched, fetchErr)
+	}
+	if _, statErr := os.Stat(filepath.Join(testConfig.UpdateCacheDir, hex.EncodeToString(sum[:]))); statErr != nil {
+		t.Errorf("expected the miner to be cached, got: %v", statErr)
+	}
+
+	// once it's cached the scheduled fetch goes ahead straight away
+	downloads := len(requested)
+	_, plan, fetchErr := testUpdater.fetchPlan(true)
+	if fetchErr != nil || len(plan) != 1 || plan[0].cached == "" || len(requested) != downloads+1 {
+		t.Errorf("expected the cached miner to be used outside the window, got: %v %v after %v", plan, fetchErr, requested)
+	}
+
+	fake.Set(time.Date(2026, 10, 17, 3, 0, 0, 0, time.Local))
+	os.RemoveAll(testConfig.UpdateCacheDir)
+	if _, _, fetchErr := testUpdater.fetchPlan(true); fetchErr != nil || requested[len(requested)-1] != "/ethminer-4" {
+		t.Errorf("expected the miner to be downloaded inside the window, got: %v %v", fetchErr, requested)
+	}
+}
+
+func TestPermit(t *testing.T) {
+
+	dataDir, dirErr := ioutil.TempDir("", "updater_test")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	defer os.RemoveAll(dataDir)
+	if openErr := state.Open(filepath.Join(dataDir, "agent_state.json")); openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer state.Open(config.Cfg.StateFile)
+
+	testConfig := *config.Cfg
+	testConfig.LocalVersion = 70
+	testConfig.UpdatePinnedVersion = 71
+	testConfig.UpdateQuarantineDir = filepath.Join(dataDir, "update_quarantine")
+	testUpdater := NewUpdater(&testConfig, &recordingLogger{})
+
+	var asked []string
+	var outcomes []error
+	permitted := false
+	testUpdater.SetPermit(func(from uint64, to uint64) (func(error), error) {
+		asked = append(asked, fmt.Sprintf("%d -> %d", from, to))
+		if !permitted {
+			return nil, fmt.Errorf("another agent at the site is updating")
+		}
+		return func(updateErr error) { outcomes = append(outcomes, updateErr) }, nil
+	})
+
+	if _, updateErr := testUpdater.UpdateNow(); updateErr == nil || updateErr.Error() != "another agent at the site is updating" {
+		t.Errorf("expected the update to wait for permission, got: %v", updateErr)
+	}
+	if history, _ := History(); len(history) != 0 {
+		t.Errorf("expected nothing to be attempted without permission, got: %+v", history)
+	}
+
+	permitted = true
+	if updated, updateErr := testUpdater.UpdateNow(); updateErr != nil || updated != "update performed\n" {
+		t.Errorf("expected the update to be applied once permitted, got: %v %v", updated, updateErr)
+	}
+	if strings.Join(asked, ", ") != "70 -> 71, 70 -> 71" || len(outcomes) != 1 || outcomes[0] != nil {
+		t.Errorf("expected the permit to be told the update was applied, got: %v %v", asked, outcomes)
+	}
+}
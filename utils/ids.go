@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/nu7hatch/gouuid"
+)
+
+// The alphabet ULIDs are written in, Crockford's base32, which leaves out the
+// letters easily mistaken for digits and sorts the same as the numbers it
+// encodes
+const ULID_ALPHABET = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// The number of characters in a ULID
+const ULID_LENGTH = 26
+
+// the time and random part of the last ULID generated, so a ULID generated in
+// the same millisecond sorts after it
+var lastULIDTime uint64
+var lastULIDEntropy [10]byte
+var ulidLock sync.Mutex
+
+// NewUUID returns a new random version 4 UUID, e.g. for an id which shouldn't
+// give away when it was made.
+func NewUUID() (string, error) {
+
+	id, idErr := uuid.NewV4()
+	if idErr != nil {
+		return "", idErr
+	}
+
+	return id.String(), nil
+}
+
+// NameUUID returns the version 5 UUID of the given name, which is the same
+// every time it's given the same name.
+func NameUUID(name string) (string, error) {
+
+	id, idErr := uuid.NewV5(uuid.NamespaceOID, []byte(name))
+	if idErr != nil {
+		return "", idErr
+	}
+
+	return id.String(), nil
+}
+
+// NewULID returns a new ULID, a 26 character id made of the time in
+// milliseconds followed by 80 random bits, so ids sort in the order they were
+// made, e.g. in logs or a list of operations. ULIDs made in the same
+// millisecond carry on from each other so they still sort in order.
+func NewULID() (string, error) {
+	return newULID(time.Now())
+}
+
+// newULID returns a new ULID for the given time.
+func newULID(now time.Time) (string, error) {
+
+	ulidLock.Lock()
+	defer ulidLock.Unlock()
+
+	milliseconds := uint64(now.UnixNano() / int64(time.Millisecond))
+
+	if milliseconds == lastULIDTime {
+		// count up from the last random part, carrying into the time when
+		// it's used up
+		for index := len(lastULIDEntropy) - 1; index >= 0; index-- {
+			lastULIDEntropy[index]++
+			if lastULIDEntropy[index] != 0 {
+				break
+			}
+			if index == 0 {
+				milliseconds++
+			}
+		}
+	} else if _, randErr := rand.Read(lastULIDEntropy[:]); randErr != nil {
+		return "", randErr
+	}
+	lastULIDTime = milliseconds
+
+	var raw [16]byte
+	var timeBytes [8]byte
+	binary.BigEndian.PutUint64(timeBytes[:], milliseconds)
+	copy(raw[:6], timeBytes[2:])
+	copy(raw[6:], lastULIDEntropy[:])
+
+	// 128 bits as 26 characters of 5 bits each, the first holding only 3
+	encoded := make([]byte, ULID_LENGTH)
+	for index := ULID_LENGTH - 1; index >= 0; index-- {
+		encoded[index] = ULID_ALPHABET[raw[15]&0x1f]
+		// shift the whole id right by 5 bits
+		for byteIndex := 15; byteIndex >= 0; byteIndex-- {
+			raw[byteIndex] >>= 5
+			if byteIndex > 0 {
+				raw[byteIndex] |= raw[byteIndex-1] << 3
+			}
+		}
+	}
+
+	return string(encoded), nil
+}
+
+// ULIDTime returns when the given ULID was made. Returns false when it isn't
+// a ULID.
+func ULIDTime(id string) (time.Time, bool) {
+
+	if len(id) != ULID_LENGTH || id[0] > '7' {
+		return time.Time{}, false
+	}
+
+	var milliseconds uint64
+	for index := 0; index < 10; index++ {
+		value := ulidValue(id[index])
+		if value < 0 {
+			return time.Time{}, false
+		}
+		milliseconds = milliseconds<<5 | uint64(value)
+	}
+	for index := 10; index < ULID_LENGTH; index++ {
+		if ulidValue(id[index]) < 0 {
+			return time.Time{}, false
+		}
+	}
+
+	return time.Unix(0, int64(milliseconds)*int64(time.Millisecond)).UTC(), true
+}
+
+// ulidValue returns the value of the given ULID character or -1 when it isn't
+// one, ignoring case.
+func ulidValue(character byte) int {
+
+	if character >= 'a' && character <= 'z' {
+		character -= 'a' - 'A'
+	}
+
+	for value := 0; value < len(ULID_ALPHABET); value++ {
+		if ULID_ALPHABET[value] == character {
+			return value
+		}
+	}
+
+	return -1
+}
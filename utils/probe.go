@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// How long a single attempt to connect to a port or endpoint can take. In
+// seconds
+const PROBE_TIMEOUT_SECONDS = 5
+
+// How often WaitForPort and WaitForEndpoint try again. In milliseconds
+const PROBE_POLL_MILLISECONDS = 250
+
+// The most of a probed endpoint's reply which is read before it's discarded
+const MAX_PROBE_RESPONSE_BYTES = 64 * 1024
+
+// PortFree returns nil when the given TCP address, e.g. ":8080" or
+// "127.0.0.1:8080", can be listened on right now, and why it can't otherwise.
+// Nothing is kept listening so another program can still take the port before
+// it's bound.
+func PortFree(address string) error {
+
+	listener, listenErr := net.Listen("tcp", address)
+	if listenErr != nil {
+		return listenErr
+	}
+
+	return listener.Close()
+}
+
+// WaitForPort will try to connect to the given TCP address until something
+// accepts the connection or the timeout passes. An address without a host,
+// e.g. ":8080", is tried on this machine. Returns the error of the last
+// attempt when nothing accepted in time.
+func WaitForPort(address string, timeout time.Duration) error {
+
+	host, port, splitErr := net.SplitHostPort(address)
+	if splitErr != nil {
+		return splitErr
+	}
+	if host == "" || (net.ParseIP(host) != nil && net.ParseIP(host).IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	address = net.JoinHostPort(host, port)
+
+	deadline := time.Now().Add(timeout)
+	for 1 == 1 {
+		conn, dialErr := net.DialTimeout("tcp", address, PROBE_TIMEOUT_SECONDS*time.Second)
+		if dialErr == nil {
+			return conn.Close()
+		}
+		if time.Now().Add(PROBE_POLL_MILLISECONDS * time.Millisecond).After(deadline) {
+			return fmt.Errorf("Nothing accepted connections on %v within %v: %v", address, timeout, dialErr)
+		}
+		time.Sleep(PROBE_POLL_MILLISECONDS * time.Millisecond)
+	}
+
+	return nil
+}
+
+// ProbeEndpoint will GET the given URL with the given client and return the
+// status it replied with. Returns an error when it can't be reached or its
+// status isn't the expected one. An expected status of 0 accepts any status
+// below http.StatusInternalServerError, e.g. for an endpoint which refuses
+// requests which aren't signed but is up. A nil client gives up after
+// PROBE_TIMEOUT_SECONDS.
+func ProbeEndpoint(client *http.Client, uri string, expected int) (int, error) {
+
+	if client == nil {
+		client = &http.Client{Timeout: PROBE_TIMEOUT_SECONDS * time.Second}
+	}
+
+	response, getErr := client.Get(uri)
+	if getErr != nil {
+		return 0, getErr
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, MAX_PROBE_RESPONSE_BYTES))
+	response.Body.Close()
+
+	if (expected == 0 && response.StatusCode >= http.StatusInternalServerError) || (expected != 0 && response.StatusCode != expected) {
+		return response.StatusCode, fmt.Errorf("responded with status: %v", response.Status)
+	}
+
+	return response.StatusCode, nil
+}
+
+// WaitForEndpoint will call ProbeEndpoint until it succeeds or the timeout
+// passes. Returns the error of the last attempt when it didn't succeed in
+// time.
+func WaitForEndpoint(client *http.Client, uri string, expected int, timeout time.Duration) error {
+
+	deadline := time.Now().Add(timeout)
+	for 1 == 1 {
+		_, probeErr := ProbeEndpoint(client, uri, expected)
+		if probeErr == nil {
+			return nil
+		}
+		if time.Now().Add(PROBE_POLL_MILLISECONDS * time.Millisecond).After(deadline) {
+			return fmt.Errorf("%v wasn't ready within %v: %v", uri, timeout, probeErr)
+		}
+		time.Sleep(PROBE_POLL_MILLISECONDS * time.Millisecond)
+	}
+
+	return nil
+}
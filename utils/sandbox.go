@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrOutsideRoot is returned by ResolveWithin when a path leads outside of
+// the root it has to stay under.
+type ErrOutsideRoot struct {
+	Root string
+	Path string
+}
+
+// Error describes the path and the root it left.
+func (eor ErrOutsideRoot) Error() string {
+	return fmt.Sprintf("The path %v is outside of %v", eor.Path, eor.Root)
+}
+
+// ResolveWithin will return the absolute path the given user supplied path
+// leads to, with every symbolic link resolved, as long as it lies under the
+// given root. A relative path is taken relative to the root. Paths which
+// climb out of the root with .., through a symbolic link or through a broken
+// symbolic link which would be followed when the file is created, and the
+// root itself, return ErrOutsideRoot. The file itself doesn't have to exist
+// yet so the result can be created.
+func ResolveWithin(root string, userPath string) (string, error) {
+
+	if userPath == "" {
+		return "", errors.New("No path given")
+	}
+	if strings.ContainsRune(userPath, 0) {
+		return "", fmt.Errorf("The path %q holds a NUL character", userPath)
+	}
+	// e.g. C:file on windows, which is relative to the working directory of
+	// another drive
+	if !filepath.IsAbs(userPath) && filepath.VolumeName(userPath) != "" {
+		return "", ErrOutsideRoot{Root: root, Path: userPath}
+	}
+
+	resolvedRoot, rootErr := resolveExisting(root)
+	if rootErr != nil {
+		return "", rootErr
+	}
+
+	joined := userPath
+	if !filepath.IsAbs(joined) {
+		joined = filepath.Join(resolvedRoot, joined)
+	}
+
+	resolvedPath, pathErr := resolveExisting(joined)
+	if pathErr != nil {
+		return "", pathErr
+	}
+
+	relative, relErr := filepath.Rel(resolvedRoot, resolvedPath)
+	if relErr != nil || relative == "." || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", ErrOutsideRoot{Root: root, Path: userPath}
+	}
+
+	return resolvedPath, nil
+}
+
+// resolveExisting returns the given path made absolute with the symbolic
+// links of the longest part of it which exists resolved. Returns an error if
+// a part of it is a broken symbolic link.
+func resolveExisting(path string) (string, error) {
+
+	absolutePath, absErr := filepath.Abs(path)
+	if absErr != nil {
+		return "", absErr
+	}
+
+	existing := absolutePath
+	missing := ""
+	for 1 == 1 {
+		resolved, evalErr := filepath.EvalSymlinks(existing)
+		if evalErr == nil {
+			return filepath.Join(resolved, missing), nil
+		}
+		if !os.IsNotExist(evalErr) {
+			return "", evalErr
+		}
+		if _, lstatErr := os.Lstat(existing); lstatErr == nil {
+			return "", fmt.Errorf("The path %v leads through the broken symbolic link %v", path, existing)
+		}
+
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return absolutePath, nil
+		}
+		missing = filepath.Join(filepath.Base(existing), missing)
+		existing = parent
+	}
+
+	return absolutePath, nil
+}
@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+)
+
+// SigningArgs returns the given arguments the way they're written into the
+// message a command's signature is made from: each one as its length in
+// bytes, a colon, the argument itself and a comma, e.g. ["a b", "c"] is
+// "3:a b,1:c,". Unlike joining them with spaces no two different lists of
+// arguments give the same text, so a signature can't be moved to arguments
+// it wasn't made for.
+func SigningArgs(args []string) string {
+
+	var encoded strings.Builder
+	for _, arg := range args {
+		encoded.WriteString(strconv.Itoa(len(arg)))
+		encoded.WriteString(":")
+		encoded.WriteString(arg)
+		encoded.WriteString(",")
+	}
+
+	return encoded.String()
+}
@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The units sizes are parsed in and formatted with, from the largest down.
+// KB and KiB are both 1024 bytes, as they are everywhere else in the agent.
+var sizeUnits = []struct {
+	names []string
+	bytes int64
+}{
+	{[]string{"tb", "tib", "t"}, 1 << 40},
+	{[]string{"gb", "gib", "g"}, 1 << 30},
+	{[]string{"mb", "mib", "m"}, 1 << 20},
+	{[]string{"kb", "kib", "k"}, 1 << 10},
+	{[]string{"b", ""}, 1},
+}
+
+// The units durations are formatted with, from the largest down
+var durationUnits = []struct {
+	name   string
+	length time.Duration
+}{
+	{"d", 24 * time.Hour},
+	{"h", time.Hour},
+	{"m", time.Minute},
+	{"s", time.Second},
+}
+
+// ParseSize returns the number of bytes in the given human readable size,
+// e.g. "10MB", "1.5 GiB", "512k" or "4096". Units are case insensitive and a
+// number without one is in bytes. Returns an error for a negative size or one
+// which doesn't fit in an int64.
+func ParseSize(size string) (int64, error) {
+
+	trimmed := strings.ToLower(strings.TrimSpace(size))
+
+	split := len(trimmed)
+	for split > 0 && !strings.ContainsAny(trimmed[split-1:split], "0123456789.") {
+		split--
+	}
+	number := strings.TrimSpace(trimmed[:split])
+	unit := strings.TrimSpace(trimmed[split:])
+
+	value, parseErr := strconv.ParseFloat(number, 64)
+	if parseErr != nil || number == "" {
+		return 0, fmt.Errorf("%q isn't a size such as 10MB or 1.5GiB", size)
+	}
+	if value < 0 {
+		return 0, fmt.Errorf("The size %q can't be negative", size)
+	}
+
+	for _, sizeUnit := range sizeUnits {
+		for _, name := range sizeUnit.names {
+			if unit != name {
+				continue
+			}
+			bytes := value * float64(sizeUnit.bytes)
+			if bytes >= math.MaxInt64 {
+				return 0, fmt.Errorf("The size %q is too large", size)
+			}
+			return int64(math.Round(bytes)), nil
+		}
+	}
+
+	return 0, fmt.Errorf("%q isn't a known unit of size. Use B, KB, MB, GB or TB", unit)
+}
+
+// FormatBytes returns the given number of bytes in the largest unit there's
+// at least one of with a single decimal, e.g. "1.5 GB" or "512 B".
+func FormatBytes(bytes int64) string {
+
+	for _, sizeUnit := range sizeUnits {
+		if sizeUnit.bytes == 1 {
+			break
+		}
+		if bytes >= sizeUnit.bytes || -bytes >= sizeUnit.bytes {
+			return fmt.Sprintf("%.1f %v", float64(bytes)/float64(sizeUnit.bytes), strings.ToUpper(sizeUnit.names[0]))
+		}
+	}
+
+	return fmt.Sprintf("%d B", bytes)
+}
+
+// FormatSize returns the given number of bytes the way ParseSize reads it
+// back, in the largest unit it's a whole number of, e.g. "100MB" or "1536KB".
+func FormatSize(bytes int64) string {
+
+	for _, sizeUnit := range sizeUnits {
+		if sizeUnit.bytes > 1 && bytes != 0 && bytes%sizeUnit.bytes == 0 {
+			return fmt.Sprintf("%d%v", bytes/sizeUnit.bytes, strings.ToUpper(sizeUnit.names[0]))
+		}
+	}
+
+	return strconv.FormatInt(bytes, 10)
+}
+
+// FormatDuration returns the given duration in at most its two largest units,
+// e.g. "3d 4h", "1h 5m" or "42s", for reports and log lines where
+// time.Duration's own "76h12m3.123456s" is more than anyone needs. Durations
+// under a second are shown in milliseconds.
+func FormatDuration(duration time.Duration) string {
+
+	sign := ""
+	if duration < 0 {
+		sign = "-"
+		duration = -duration
+	}
+
+	if duration < time.Second {
+		return fmt.Sprintf("%v%dms", sign, duration.Milliseconds())
+	}
+
+	var parts []string
+	remaining := duration.Round(time.Second)
+	for _, durationUnit := range durationUnits {
+		if remaining < durationUnit.length && len(parts) == 0 {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%d%v", remaining/durationUnit.length, durationUnit.name))
+		remaining %= durationUnit.length
+		if len(parts) == 2 {
+			break
+		}
+	}
+
+	// leave out a second unit of zero, e.g. "2h" rather than "2h 0m"
+	if len(parts) == 2 && strings.HasPrefix(parts[1], "0") {
+		parts = parts[:1]
+	}
+
+	return sign + strings.Join(parts, " ")
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The layout of time stamps meant to be read: RFC3339 in UTC with a fixed
+// number of fractional digits, so they sort as text, e.g.
+// 2006-01-02T15:04:05.000Z
+const TIME_STAMP_LAYOUT = "2006-01-02T15:04:05.000Z"
+
+// The layout of time stamps in file names: in UTC with a fixed width and no
+// characters any file system treats specially, so names sort by time, e.g.
+// 20060102T150405.000Z
+const FILE_TIME_STAMP_LAYOUT = "20060102T150405.000Z"
+
+// TimeStamp returns the given time in UTC in the TIME_STAMP_LAYOUT. The result
+// is the same whatever the locale or time zone of the machine.
+func TimeStamp(t time.Time) string {
+	return t.UTC().Format(TIME_STAMP_LAYOUT)
+}
+
+// FileTimeStamp returns the given time in UTC in the FILE_TIME_STAMP_LAYOUT.
+func FileTimeStamp(t time.Time) string {
+	return t.UTC().Format(FILE_TIME_STAMP_LAYOUT)
+}
+
+// ParseTimeStamp returns the time in the given stamp, made by TimeStamp or
+// FileTimeStamp, or any RFC3339 time.
+func ParseTimeStamp(stamp string) (time.Time, error) {
+
+	for _, layout := range []string{TIME_STAMP_LAYOUT, FILE_TIME_STAMP_LAYOUT, time.RFC3339Nano} {
+		if parsed, parseErr := time.Parse(layout, stamp); parseErr == nil {
+			return parsed.UTC(), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("%q isn't a time stamp such as %v or %v", stamp, TIME_STAMP_LAYOUT, FILE_TIME_STAMP_LAYOUT)
+}
+
+// TimeStampFileName will generate a string to be used to uniquely name and
+// identify a new file. The characters used in the file name are guaranteed to
+// be safe for a file. The given fileBaseName will be used to append to the
+// beginning of the file name to give some control over the file name, which
+// is followed by an underscore, the FileTimeStamp of now and the given
+// fileExtension, e.g. diagnostics_20060102T150405.000Z.tar.gz.
+func TimeStampFileName(fileBaseName string, fileExtension string) string {
+	return fileBaseName + "_" + FileTimeStamp(time.Now()) + fileExtension
+}
+
+// FileNameTime returns the time in the name of a file named by
+// TimeStampFileName with the given fileBaseName and fileExtension. The name
+// may include its directory.
+func FileNameTime(fileName string, fileBaseName string, fileExtension string) (time.Time, error) {
+
+	name := fileName
+	if index := strings.LastIndexAny(name, `/\`); index >= 0 {
+		name = name[index+1:]
+	}
+
+	if !strings.HasPrefix(name, fileBaseName+"_") || !strings.HasSuffix(name, fileExtension) || len(name) < len(fileBaseName)+1+len(fileExtension) {
+		return time.Time{}, fmt.Errorf("%v isn't named %v_ followed by a time stamp and %v", fileName, fileBaseName, fileExtension)
+	}
+
+	return ParseTimeStamp(name[len(fileBaseName)+1 : len(name)-len(fileExtension)])
+}
@@ -4,23 +4,25 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
-	"time"
 )
 
 // the root asset directory where all the external files used are stored
 const ASSET_ROOT_DIR = "assets"
 
 // AssetPath will return the relative path to the file represented by
-// assetName otherwise it will return an error if the file doesn't exist.
+// assetName otherwise it will return an error if the file doesn't exist or
+// the name leads outside of the asset directory. See ResolveWithin.
 func AssetPath(assetName string) (string, error) {
 
+	if _, resolveErr := ResolveWithin(path.Join("..", ASSET_ROOT_DIR), assetName); resolveErr != nil {
+		return "", resolveErr
+	}
+
 	relativePath := path.Join("..", ASSET_ROOT_DIR, assetName)
 
 	if _, err := os.Stat(relativePath); os.IsNotExist(err) {
@@ -65,6 +67,10 @@ func SysAssetPath(assetName string) (string, error) {
 	relativeName.WriteString(assetName[extIndex:])
 	path := relativeName.String()
 
+	if _, resolveErr := ResolveWithin(filepath.Join("..", ASSET_ROOT_DIR), assetName[0:extIndex]+"_"+runtime.GOOS+assetName[extIndex:]); resolveErr != nil {
+		return "", resolveErr
+	}
+
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return "", fmt.Errorf("Relative file does not exist: %v", path)
 	}
@@ -72,36 +78,6 @@ func SysAssetPath(assetName string) (string, error) {
 	return relativeName.String(), nil
 }
 
-// FullDateString will return the current time formatted as a string.
-func FullDateString() string {
-	return time.Now().String()
-}
-
-// FullDateStringSafe returns the current time as a string with only file-name
-// safe characters. Used to quickly and easily generate unique file names based
-// off of the current system time.
-func FullDateStringSafe() string {
-	t := time.Now()
-	return fmt.Sprintf("[%v-%02d-%02d][%02d_%02d_%02d.%02d]",
-		t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond())
-}
-
-// TimeStampFileName will generate a string to be used to uniquely name and
-// identify a new file. The characters used in the file name are guaranteed to
-// be safe for a file. The given fileBaseName will be used to append to the
-// beginning of the file name to give some control over the file name.
-func TimeStampFileName(fileBaseName string, fileExtension string) string {
-	dts := FullDateStringSafe()
-
-	var nameBuffer bytes.Buffer
-	nameBuffer.WriteString(fileBaseName)
-	nameBuffer.WriteString("_")
-	nameBuffer.WriteString(dts)
-	nameBuffer.WriteString(fileExtension)
-
-	return nameBuffer.String()
-}
-
 // ReadLines reads in a file by path and returns a slice of strings
 // credit to: https://stackoverflow.com/a/18479916/584947
 func ReadLines(path string) ([]string, error) {
@@ -121,24 +97,3 @@ func ReadLines(path string) ([]string, error) {
 
 	return lines, scanner.Err()
 }
-
-// ExternalIPAddress will get this current computer's external IP address.
-// credit to: https://gist.github.com/jniltinho/9788121
-func ExternalIPAddress() (string, error) {
-
-	var ipBuffer bytes.Buffer
-
-	resp, err := http.Get("http://myexternalip.com/raw")
-	if err != nil {
-		return "", err
-	}
-
-	defer resp.Body.Close()
-
-	_, copyErr := io.Copy(&ipBuffer, resp.Body)
-	if copyErr != nil {
-		return "", copyErr
-	}
-
-	return strings.Trim(ipBuffer.String(), "\n"), nil
-}
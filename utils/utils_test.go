@@ -1,9 +1,15 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestMain(m *testing.M) {
@@ -28,3 +34,228 @@ func TestGetSysAssetPathPass(t *testing.T) {
 	}
 	fmt.Println(fmt.Sprintf("relativePath: %v", relativePath))
 }
+
+func TestTimeStamps(t *testing.T) {
+
+	zone := time.FixedZone("UTC+5", 5*60*60)
+	when := time.Date(2026, 10, 17, 13, 15, 0, 42000000, zone)
+
+	if stamp := TimeStamp(when); stamp != "2026-10-17T08:15:00.042Z" {
+		t.Errorf("expected the time stamp in UTC, got: %v", stamp)
+	}
+	if stamp := FileTimeStamp(when); stamp != "20261017T081500.042Z" {
+		t.Errorf("expected the file time stamp in UTC, got: %v", stamp)
+	}
+
+	// fixed width stamps sort the same as the times they hold
+	earlier := time.Date(2026, 10, 17, 8, 15, 0, 0, time.UTC)
+	if !(TimeStamp(earlier) < TimeStamp(when)) || !(FileTimeStamp(earlier) < FileTimeStamp(when)) {
+		t.Errorf("expected the stamps to sort by time: %v %v", TimeStamp(earlier), TimeStamp(when))
+	}
+
+	for _, stamp := range []string{TimeStamp(when), FileTimeStamp(when), when.Format(time.RFC3339Nano)} {
+		parsed, parseErr := ParseTimeStamp(stamp)
+		if parseErr != nil || !parsed.Equal(when) {
+			t.Errorf("expected %v to parse back to %v, got: %v %v", stamp, when, parsed, parseErr)
+		}
+	}
+	if _, parseErr := ParseTimeStamp("[2026-10-17][08_15_00.42]"); parseErr == nil {
+		t.Error("expected an unknown layout to be refused")
+	}
+
+	fileName := TimeStampFileName("diagnostics", ".tar.gz")
+	named, nameErr := FileNameTime(filepath.Join("bundles", fileName), "diagnostics", ".tar.gz")
+	if nameErr != nil || time.Since(named) > time.Minute {
+		t.Errorf("expected the time of %v to parse back, got: %v %v", fileName, named, nameErr)
+	}
+	if _, nameErr := FileNameTime("profile_20261017T081500.042Z.tar", "diagnostics", ".tar.gz"); nameErr == nil {
+		t.Error("expected a file with another name to be refused")
+	}
+}
+
+func TestResolveWithin(t *testing.T) {
+
+	root, _ := filepath.EvalSymlinks(t.TempDir())
+	outside := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "inside"), 0700)
+	os.WriteFile(filepath.Join(root, "inside", "file.txt"), []byte("file"), 0600)
+	os.Symlink(outside, filepath.Join(root, "escape"))
+	os.Symlink(filepath.Join(root, "inside"), filepath.Join(root, "shortcut"))
+
+	for userPath, expected := range map[string]string{
+		"inside/file.txt":                         filepath.Join(root, "inside", "file.txt"),
+		"inside/../inside/new.txt":                filepath.Join(root, "inside", "new.txt"),
+		"shortcut/file.txt":                       filepath.Join(root, "inside", "file.txt"),
+		filepath.Join(root, "inside", "file.txt"): filepath.Join(root, "inside", "file.txt"),
+	} {
+		resolved, resolveErr := ResolveWithin(root, userPath)
+		if resolveErr != nil || resolved != expected {
+			t.Errorf("expected %v to resolve to %v, got: %v %v", userPath, expected, resolved, resolveErr)
+		}
+	}
+
+	for _, userPath := range []string{"../outside.txt", "inside/../../outside.txt", "escape/file.txt", ".", root, outside} {
+		var outsideErr ErrOutsideRoot
+		if _, resolveErr := ResolveWithin(root, userPath); !errors.As(resolveErr, &outsideErr) {
+			t.Errorf("expected %v to be refused as outside of the root, got: %v", userPath, resolveErr)
+		}
+	}
+	if _, resolveErr := ResolveWithin(root, ""); resolveErr == nil {
+		t.Error("expected an empty path to be refused")
+	}
+}
+
+func TestProbes(t *testing.T) {
+
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	address := listener.Addr().String()
+
+	if PortFree(address) == nil {
+		t.Errorf("expected %v to be taken while it's listened on", address)
+	}
+	if waitErr := WaitForPort(address, time.Second); waitErr != nil {
+		t.Errorf("expected %v to accept connections, got: %v", address, waitErr)
+	}
+
+	listener.Close()
+	if freeErr := PortFree(address); freeErr != nil {
+		t.Errorf("expected %v to be free once it's closed, got: %v", address, freeErr)
+	}
+	if WaitForPort(address, 300*time.Millisecond) == nil {
+		t.Errorf("expected waiting for the closed %v to time out", address)
+	}
+
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	if replied, probeErr := ProbeEndpoint(nil, server.URL, 0); probeErr != nil || replied != http.StatusNoContent {
+		t.Errorf("expected any status below 500 to pass, got: %v %v", replied, probeErr)
+	}
+	if _, probeErr := ProbeEndpoint(nil, server.URL, http.StatusOK); probeErr == nil {
+		t.Error("expected a status other than the expected one to fail")
+	}
+	if waitErr := WaitForEndpoint(nil, server.URL, http.StatusNoContent, time.Second); waitErr != nil {
+		t.Errorf("expected the endpoint to be ready, got: %v", waitErr)
+	}
+
+	status = http.StatusServiceUnavailable
+	if replied, probeErr := ProbeEndpoint(nil, server.URL, 0); probeErr == nil || replied != http.StatusServiceUnavailable {
+		t.Errorf("expected a server error to fail, got: %v %v", replied, probeErr)
+	}
+	if WaitForEndpoint(nil, server.URL, 0, 300*time.Millisecond) == nil {
+		t.Error("expected waiting for an endpoint which keeps failing to time out")
+	}
+}
+
+func TestIds(t *testing.T) {
+
+	first, firstErr := NewUUID()
+	second, secondErr := NewUUID()
+	if firstErr != nil || secondErr != nil || len(first) != 36 || first == second {
+		t.Errorf("expected two different UUIDs, got: %v %v %v %v", first, second, firstErr, secondErr)
+	}
+
+	named, _ := NameUUID("machine")
+	if again, _ := NameUUID("machine"); again != named || len(named) != 36 {
+		t.Errorf("expected the same name to give the same UUID, got: %v %v", named, again)
+	}
+
+	// ULIDs made in the same millisecond still sort in order
+	when := time.Date(2026, 10, 17, 8, 15, 0, 42000000, time.UTC)
+	previous := ""
+	for index := 0; index < 100; index++ {
+		id, idErr := newULID(when)
+		if idErr != nil || len(id) != ULID_LENGTH || id <= previous {
+			t.Fatalf("expected ULID %d to sort after %v, got: %v %v", index, previous, id, idErr)
+		}
+		previous = id
+	}
+
+	later, _ := newULID(when.Add(time.Millisecond))
+	if later <= previous {
+		t.Errorf("expected a ULID a millisecond later to sort after %v, got: %v", previous, later)
+	}
+	if made, isULID := ULIDTime(later); !isULID || !made.Equal(when.Add(time.Millisecond)) {
+		t.Errorf("expected the ULID to hold when it was made, got: %v %v", made, isULID)
+	}
+	if _, isULID := ULIDTime(first); isULID {
+		t.Errorf("expected %v not to be taken for a ULID", first)
+	}
+}
+
+func TestSizes(t *testing.T) {
+
+	for size, expected := range map[string]int64{
+		"4096":     4096,
+		"10MB":     10 * 1024 * 1024,
+		"1.5GiB":   1536 * 1024 * 1024,
+		" 512 kb ": 512 * 1024,
+		"2t":       2 << 40,
+		"0":        0,
+	} {
+		if bytes, parseErr := ParseSize(size); parseErr != nil || bytes != expected {
+			t.Errorf("expected %q to parse to %d, got: %d %v", size, expected, bytes, parseErr)
+		}
+	}
+	for _, size := range []string{"", "MB", "-1MB", "10 parsecs", "1.2.3GB", "99999999TB"} {
+		if _, parseErr := ParseSize(size); parseErr == nil {
+			t.Errorf("expected %q to be refused", size)
+		}
+	}
+
+	for bytes, expected := range map[int64]string{512: "512 B", 1536: "1.5 KB", 10 * 1024 * 1024: "10.0 MB", 3 << 40: "3.0 TB"} {
+		if formatted := FormatBytes(bytes); formatted != expected {
+			t.Errorf("expected %d bytes to be formatted as %v, got: %v", bytes, expected, formatted)
+		}
+	}
+	for _, bytes := range []int64{0, 1000, 1536, 100 * 1024 * 1024, 5 << 30} {
+		if parsed, parseErr := ParseSize(FormatSize(bytes)); parseErr != nil || parsed != bytes {
+			t.Errorf("expected %v to parse back to %d, got: %d %v", FormatSize(bytes), bytes, parsed, parseErr)
+		}
+	}
+	if formatted := FormatSize(100 * 1024 * 1024); formatted != "100MB" {
+		t.Errorf("expected 100MB, got: %v", formatted)
+	}
+
+	for duration, expected := range map[time.Duration]string{
+		250 * time.Millisecond:                 "250ms",
+		42 * time.Second:                       "42s",
+		65*time.Minute + 3*time.Second:         "1h 5m",
+		2 * time.Hour:                          "2h",
+		76*time.Hour + 12*time.Minute:          "3d 4h",
+		-(90 * time.Second):                    "-1m 30s",
+		time.Minute + 500*time.Millisecond + 1: "1m 1s",
+	} {
+		if formatted := FormatDuration(duration); formatted != expected {
+			t.Errorf("expected %v to be formatted as %v, got: %v", duration, expected, formatted)
+		}
+	}
+}
+
+func TestSigningArgs(t *testing.T) {
+
+	for _, tc := range []struct {
+		args     []string
+		expected string
+	}{
+		{nil, ""},
+		{[]string{""}, "0:,"},
+		{[]string{"miner"}, "5:miner,"},
+		{[]string{"a b", "c"}, "3:a b,1:c,"},
+		{[]string{"a", "b c"}, "1:a,3:b c,"},
+	} {
+		if encoded := SigningArgs(tc.args); encoded != tc.expected {
+			t.Errorf("expected %q to be encoded as %q, got: %q", tc.args, tc.expected, encoded)
+		}
+	}
+
+	if SigningArgs([]string{"a b"}) == SigningArgs([]string{"a", "b"}) {
+		t.Error("expected one argument holding a space to differ from two arguments")
+	}
+}
@@ -0,0 +1,371 @@
+// The watchdog package runs the agent as a child process and restarts it
+// whenever it exits unexpectedly so a machine without a service manager, or
+// whose service manager has given up, never ends up unmanaged. Every crash is
+// counted, the tail of what the agent wrote to stderr is kept, and both are
+// saved to disk so the agent can include them in its status reports. Restarts
+// back off when the agent crashes over and over again without running for
+// long.
+package watchdog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+// The file the watchdog saves its state to in the working directory
+const STATE_FILE_NAME = "watchdog_state.json"
+
+// The lock file which stops two watchdogs running in the same working
+// directory. Separate from the agent's own lock file which the agent holds
+const LOCK_FILE_NAME = "watchdog.lock"
+
+// How much of the end of the agent's stderr is kept. In bytes
+const MAX_STDERR_BYTES = 8 * 1024
+
+// How long to wait before restarting the agent after a crash. In seconds
+const MIN_RESTART_DELAY_SECONDS = 5
+
+// The longest the wait before restarting the agent backs off to. In seconds
+const MAX_RESTART_DELAY_SECONDS = 1800
+
+// How many crashes in a row without a stable run are restarted after
+// MIN_RESTART_DELAY_SECONDS before backing off
+const CRASH_LOOP_LIMIT = 3
+
+// How long the agent needs to run for before a crash is no longer part of a
+// crash loop. In seconds
+const STABLE_RUN_SECONDS = 600
+
+// How often to check whether the agent has exited during shutdown. In
+// milliseconds
+const SHUTDOWN_POLL_MILLISECONDS = 100
+
+// State is what the watchdog knows about the agent it supervises. It survives
+// restarts of the watchdog itself.
+type State struct {
+	Started        time.Time `json:"started"`
+	Restarts       uint64    `json:"restarts"`
+	Crashes        uint64    `json:"crashes"`
+	RapidCrashes   uint64    `json:"rapidCrashes"`
+	LastCrash      time.Time `json:"lastCrash,omitempty"`
+	LastExitStatus string    `json:"lastExitStatus,omitempty"`
+	LastStderr     string    `json:"lastStderr,omitempty"`
+	NextRestart    time.Time `json:"nextRestart,omitempty"`
+}
+
+// Watchdog runs a command over and over until it exits cleanly or the
+// watchdog is shut down.
+type Watchdog struct {
+	Configure func(cmd *exec.Cmd) error // called on the command before every start, e.g. to run it as another user. Set before calling Run.
+	command   []string
+	statePath string
+	state     State
+	cmd       *exec.Cmd
+	stopping  bool
+	stop      chan struct{}
+	lock      sync.Mutex
+}
+
+// New returns a watchdog which runs the given command and saves its state to
+// the given file, carrying on from the state already saved there if any.
+func New(command []string, statePath string) (*Watchdog, error) {
+
+	if len(command) == 0 {
+		return nil, fmt.Errorf("The watchdog needs a command to run")
+	}
+
+	wd := &Watchdog{command: command, statePath: statePath, stop: make(chan struct{})}
+
+	saved, readErr := ReadState(statePath)
+	if readErr != nil && !os.IsNotExist(readErr) {
+		return nil, readErr
+	}
+	if readErr == nil {
+		wd.state = saved
+	}
+
+	return wd, nil
+}
+
+// ReadState returns the state saved to the given file by a watchdog.
+func ReadState(statePath string) (State, error) {
+
+	var state State
+
+	contents, readErr := ioutil.ReadFile(statePath)
+	if readErr != nil {
+		return state, readErr
+	}
+
+	if jsonErr := json.Unmarshal(contents, &state); jsonErr != nil {
+		return state, fmt.Errorf("Unable to read the watchdog state from %v: %v", statePath, jsonErr)
+	}
+
+	return state, nil
+}
+
+// StatusSummary describes the state saved by the watchdog in the working
+// directory, if the agent is running under one.
+func StatusSummary() (string, error) {
+
+	state, readErr := ReadState(STATE_FILE_NAME)
+	if os.IsNotExist(readErr) {
+		return "Not running under the watchdog\n", nil
+	}
+	if readErr != nil {
+		return "", readErr
+	}
+
+	return state.String(), nil
+}
+
+// String describes the state on multiple lines.
+func (state State) String() string {
+
+	var summary bytes.Buffer
+	fmt.Fprintf(&summary, "Watchdog started: %v\n", state.Started.Format(time.RFC1123))
+	fmt.Fprintf(&summary, "Restarts: %d\n", state.Restarts)
+	fmt.Fprintf(&summary, "Crashes: %d (%d in a row)\n", state.Crashes, state.RapidCrashes)
+
+	if !state.LastCrash.IsZero() {
+		fmt.Fprintf(&summary, "Last crash: %v with %v\n", state.LastCrash.Format(time.RFC1123), state.LastExitStatus)
+	}
+	if state.NextRestart.After(time.Now()) {
+		fmt.Fprintf(&summary, "Backing off until: %v\n", state.NextRestart.Format(time.RFC1123))
+	}
+	if state.LastStderr != "" {
+		fmt.Fprintf(&summary, "Last stderr:\n%v\n", state.LastStderr)
+	}
+
+	return summary.String()
+}
+
+// State returns a copy of the current state.
+func (wd *Watchdog) State() State {
+	wd.lock.Lock()
+	defer wd.lock.Unlock()
+	return wd.state
+}
+
+// Run will start the command and start it again every time it exits with an
+// error, waiting longer and longer between restarts while it keeps crashing
+// soon after starting. Returns nil once the command exits cleanly or Shutdown
+// is called, or an error if the command can't be started at all.
+func (wd *Watchdog) Run() error {
+
+	wd.lock.Lock()
+	wd.state.Started = time.Now()
+	wd.lock.Unlock()
+	wd.save()
+
+	for 1 == 1 {
+		started := time.Now()
+		tail := &tailBuffer{limit: MAX_STDERR_BYTES}
+
+		cmd := exec.Command(wd.command[0], wd.command[1:]...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = io.MultiWriter(os.Stderr, tail)
+		if wd.Configure != nil {
+			if configureErr := wd.Configure(cmd); configureErr != nil {
+				return fmt.Errorf("Unable to start %v: %v", wd.command[0], configureErr)
+			}
+		}
+
+		// start the command while holding the lock so Shutdown never sees a
+		// half started process
+		wd.lock.Lock()
+		if wd.stopping {
+			wd.lock.Unlock()
+			return nil
+		}
+		startErr := cmd.Start()
+		if startErr == nil {
+			wd.cmd = cmd
+		}
+		wd.lock.Unlock()
+
+		if startErr != nil {
+			return fmt.Errorf("Unable to start %v: %v", wd.command[0], startErr)
+		}
+
+		logger.Lgr.LogMessagef("Successfully started %v as process %d", wd.command, cmd.Process.Pid)
+		exitErr := cmd.Wait()
+
+		wd.lock.Lock()
+		wd.cmd = nil
+		stopping := wd.stopping
+		wd.lock.Unlock()
+
+		if stopping {
+			logger.Lgr.LogMessagef("Successfully stopped %v: %v", wd.command[0], exitErr)
+			return nil
+		}
+
+		if exitErr == nil {
+			logger.Lgr.LogMessagef("%v exited cleanly so the watchdog is exiting too", wd.command[0])
+			return nil
+		}
+
+		delay := wd.crashed(exitErr.Error(), tail.String(), time.Since(started))
+		logger.Lgr.LogErrorf("%v crashed after running for %v with %v. Restarting in %v", wd.command[0], time.Since(started).Round(time.Second), exitErr, delay)
+
+		select {
+		case <-time.After(delay):
+		case <-wd.stop:
+			return nil
+		}
+
+		wd.lock.Lock()
+		wd.state.Restarts++
+		wd.lock.Unlock()
+		wd.save()
+	}
+
+	return nil
+}
+
+// crashed will record a crash which happened after the command ran for the
+// given amount of time, publish an AgentCrashed event and return how long to
+// wait before restarting it.
+func (wd *Watchdog) crashed(exitStatus string, stderr string, ran time.Duration) time.Duration {
+
+	wd.lock.Lock()
+
+	if ran >= STABLE_RUN_SECONDS*time.Second {
+		wd.state.RapidCrashes = 0
+	}
+
+	wd.state.Crashes++
+	wd.state.RapidCrashes++
+	wd.state.LastCrash = time.Now()
+	wd.state.LastExitStatus = exitStatus
+	wd.state.LastStderr = stderr
+
+	delay := RestartDelay(wd.state.RapidCrashes)
+	wd.state.NextRestart = time.Now().Add(delay)
+	crash := events.AgentCrashed{
+		ExitStatus:     exitStatus,
+		Crashes:        wd.state.Crashes,
+		RestartSeconds: delay.Seconds(),
+		LastStderr:     stderr,
+	}
+
+	wd.lock.Unlock()
+
+	wd.save()
+	events.Publish(crash)
+	return delay
+}
+
+// RestartDelay returns how long to wait before restarting after the given
+// number of crashes in a row, none of which followed a stable run. The first
+// CRASH_LOOP_LIMIT crashes wait MIN_RESTART_DELAY_SECONDS and every one after
+// that waits twice as long as the last, up to MAX_RESTART_DELAY_SECONDS.
+func RestartDelay(rapidCrashes uint64) time.Duration {
+
+	delay := MIN_RESTART_DELAY_SECONDS * time.Second
+
+	for crash := uint64(CRASH_LOOP_LIMIT); crash < rapidCrashes; crash++ {
+		delay *= 2
+		if delay >= MAX_RESTART_DELAY_SECONDS*time.Second {
+			return MAX_RESTART_DELAY_SECONDS * time.Second
+		}
+	}
+
+	return delay
+}
+
+// Shutdown will stop restarting the command and interrupt it so it can exit
+// cleanly. The command is killed if it's still running once the given context
+// is done.
+func (wd *Watchdog) Shutdown(ctx context.Context) error {
+
+	wd.lock.Lock()
+	if !wd.stopping {
+		wd.stopping = true
+		close(wd.stop)
+	}
+	if wd.cmd != nil {
+		logger.Lgr.LogMessagef("Interrupting %v so it can exit cleanly", wd.command[0])
+		// not every operating system can interrupt a process
+		if signalErr := wd.cmd.Process.Signal(os.Interrupt); signalErr != nil {
+			wd.cmd.Process.Kill()
+		}
+	}
+	wd.lock.Unlock()
+
+	for 1 == 1 {
+		wd.lock.Lock()
+		cmd := wd.cmd
+		wd.lock.Unlock()
+
+		if cmd == nil {
+			return nil
+		}
+
+		select {
+		case <-time.After(SHUTDOWN_POLL_MILLISECONDS * time.Millisecond):
+		case <-ctx.Done():
+			cmd.Process.Kill()
+			return fmt.Errorf("Killed %v which didn't exit in time", wd.command[0])
+		}
+	}
+
+	return nil
+}
+
+// save will write the current state to the state file. A failure is logged
+// rather than stopping the watchdog.
+func (wd *Watchdog) save() {
+
+	wd.lock.Lock()
+	contents, jsonErr := json.MarshalIndent(wd.state, "", "    ")
+	wd.lock.Unlock()
+
+	if jsonErr == nil {
+		jsonErr = ioutil.WriteFile(wd.statePath, contents, 0644)
+	}
+
+	if jsonErr != nil {
+		logger.Lgr.LogErrorf("Failed to save the watchdog state to %v: %v", wd.statePath, jsonErr)
+	}
+}
+
+// tailBuffer keeps the last limit bytes written to it.
+type tailBuffer struct {
+	limit    int
+	contents []byte
+	lock     sync.Mutex
+}
+
+// Write appends to the buffer and drops whatever no longer fits.
+func (tb *tailBuffer) Write(written []byte) (int, error) {
+
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	tb.contents = append(tb.contents, written...)
+	if overflow := len(tb.contents) - tb.limit; overflow > 0 {
+		tb.contents = append([]byte{}, tb.contents[overflow:]...)
+	}
+
+	return len(written), nil
+}
+
+// String returns what's left in the buffer.
+func (tb *tailBuffer) String() string {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+	return string(tb.contents)
+}
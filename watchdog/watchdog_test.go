@@ -0,0 +1,159 @@
+package watchdog
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/seantcanavan/anon-eth-net/events"
+	"github.com/seantcanavan/anon-eth-net/logger"
+)
+
+func TestMain(m *testing.M) {
+
+	logErr := logger.StandardLogger("watchdog_test")
+	if logErr != nil {
+		fmt.Println(fmt.Sprintf("Could not initialize logger: %v", logErr))
+		return
+	}
+
+	result := m.Run()
+	os.Exit(result)
+}
+
+func TestRestartDelay(t *testing.T) {
+
+	for _, expected := range []struct {
+		rapidCrashes uint64
+		delay        time.Duration
+	}{
+		{1, MIN_RESTART_DELAY_SECONDS * time.Second},
+		{CRASH_LOOP_LIMIT, MIN_RESTART_DELAY_SECONDS * time.Second},
+		{CRASH_LOOP_LIMIT + 1, 2 * MIN_RESTART_DELAY_SECONDS * time.Second},
+		{CRASH_LOOP_LIMIT + 2, 4 * MIN_RESTART_DELAY_SECONDS * time.Second},
+		{CRASH_LOOP_LIMIT + 100, MAX_RESTART_DELAY_SECONDS * time.Second},
+	} {
+		if delay := RestartDelay(expected.rapidCrashes); delay != expected.delay {
+			t.Errorf("expected a delay of %v after %d crashes in a row, got %v", expected.delay, expected.rapidCrashes, delay)
+		}
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("the watchdog test runs its commands with sh")
+	}
+
+	stateDir, tempErr := ioutil.TempDir("", "watchdog_test")
+	if tempErr != nil {
+		t.Fatal(tempErr)
+	}
+	defer os.RemoveAll(stateDir)
+	statePath := filepath.Join(stateDir, STATE_FILE_NAME)
+
+	// a clean exit stops the watchdog without counting a crash
+	clean, newErr := New([]string{"sh", "-c", "exit 0"}, statePath)
+	if newErr != nil {
+		t.Fatal(newErr)
+	}
+	if runErr := clean.Run(); runErr != nil {
+		t.Fatal(runErr)
+	}
+	if clean.State().Crashes != 0 {
+		t.Errorf("expected a clean exit not to count as a crash: %+v", clean.State())
+	}
+
+	crashes := make(chan events.Record, 10)
+	unsubscribe := events.Subscribe("watchdog_test", func(record events.Record) {
+		if record.Kind == events.AGENT_CRASHED {
+			crashes <- record
+		}
+	})
+	defer unsubscribe()
+
+	// a crash is recorded, saved and published before the restart
+	crashing, newErr := New([]string{"sh", "-c", "echo first line >&2; echo boom >&2; exit 3"}, statePath)
+	if newErr != nil {
+		t.Fatal(newErr)
+	}
+
+	finished := make(chan error, 1)
+	go func() {
+		finished <- crashing.Run()
+	}()
+
+	select {
+	case record := <-crashes:
+		if !strings.Contains(record.Event.Summary(), "exit status 3") || !strings.HasSuffix(record.Event.Summary(), "Last output: boom") {
+			t.Errorf("expected the crash to describe the exit status and last output: %v", record.Event.Summary())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the crash to be published")
+	}
+
+	saved, readErr := ReadState(statePath)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	if saved.Crashes != 1 || saved.RapidCrashes != 1 || saved.LastStderr != "first line\nboom\n" {
+		t.Errorf("expected the crash to be saved along with stderr: %+v", saved)
+	}
+	if !strings.Contains(saved.String(), "Backing off until") {
+		t.Errorf("expected the saved state to describe the pending restart:\n%v", saved)
+	}
+
+	// shutting down while waiting to restart stops the watchdog straight away
+	if shutdownErr := crashing.Shutdown(context.Background()); shutdownErr != nil {
+		t.Fatal(shutdownErr)
+	}
+	select {
+	case runErr := <-finished:
+		if runErr != nil {
+			t.Fatal(runErr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the watchdog to stop")
+	}
+
+	// shutting down interrupts the running command and doesn't count a crash
+	sleeping, newErr := New([]string{"sh", "-c", "exec sleep 30"}, statePath)
+	if newErr != nil {
+		t.Fatal(newErr)
+	}
+	if sleeping.State().Crashes != 1 {
+		t.Errorf("expected the saved crash count to carry over: %+v", sleeping.State())
+	}
+
+	go func() {
+		finished <- sleeping.Run()
+	}()
+
+	for 1 == 1 {
+		sleeping.lock.Lock()
+		started := sleeping.cmd != nil
+		sleeping.lock.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if shutdownErr := sleeping.Shutdown(ctx); shutdownErr != nil {
+		t.Fatal(shutdownErr)
+	}
+	if runErr := <-finished; runErr != nil {
+		t.Fatal(runErr)
+	}
+	if sleeping.State().Crashes != 1 {
+		t.Errorf("expected shutting down not to count as a crash: %+v", sleeping.State())
+	}
+}